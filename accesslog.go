@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anthdm/foreverstore/admin"
+	"github.com/anthdm/foreverstore/errors"
+)
+
+// headerRequestID carries the ID of a client request. The ID a client sends
+// is kept, else one is made up; either way it is sent back with the answer
+// and recorded in the access log.
+const headerRequestID = "X-Request-ID"
+
+// Rotation of the access log when the configuration leaves it unset.
+const (
+	defaultAccessLogMaxSizeMB  = 100
+	defaultAccessLogMaxBackups = 5
+)
+
+// maxAccessErrorBody bounds what is kept of the body of a failed answer to
+// read its error type from.
+const maxAccessErrorBody = 4 << 10
+
+// AccessRecord is the access log record of a client operation, written as a
+// line of JSON, as HTTP servers log each request they serve.
+type AccessRecord struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id"`
+	// Client is who made the request, as admin.Actor reports it.
+	Client string `json:"client"`
+	// Op is the operation: put, get, head, delete or list on /objects/,
+	// put_chunked or get_chunked on /chunked/.
+	Op  string `json:"op"`
+	Key string `json:"key,omitempty"`
+	// BytesIn counts the bytes of the request body read, and BytesOut those
+	// of the answer written.
+	BytesIn    int64            `json:"bytes_in"`
+	BytesOut   int64            `json:"bytes_out"`
+	DurationMs float64          `json:"duration_ms"`
+	Status     int              `json:"status"`
+	ErrorType  errors.ErrorType `json:"error_type,omitempty"`
+}
+
+// accessLog writes the access records of a server, one line each, to a
+// writer of its own, apart from the application log.
+type accessLog struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (l *accessLog) record(rec AccessRecord) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err = l.w.Write(append(b, '\n'))
+	return err
+}
+
+// accessLogged wraps the handler of a client endpoint so that each request
+// it serves is recorded in the access log. Without an access log it
+// returns the handler as is.
+func (s *FileServer) accessLogged(prefix string, handler http.HandlerFunc) http.HandlerFunc {
+	if s.accessLog == nil {
+		return handler
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := s.Clock.Now()
+		id := r.Header.Get(headerRequestID)
+		if id == "" {
+			id = generateID()
+		}
+		w.Header().Set(headerRequestID, id)
+		body := &countingReader{r: r.Body}
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{body, r.Body}
+		rec := &accessRecorder{ResponseWriter: w}
+
+		handler(rec, r)
+
+		key := strings.TrimPrefix(r.URL.Path, prefix)
+		entry := AccessRecord{
+			Time:       start,
+			RequestID:  id,
+			Client:     admin.Actor(r),
+			Op:         accessOp(prefix, r.Method, key),
+			Key:        key,
+			BytesIn:    body.n,
+			BytesOut:   rec.bytes,
+			DurationMs: float64(s.Clock.Now().Sub(start)) / float64(time.Millisecond),
+			Status:     rec.statusCode(),
+			ErrorType:  rec.errorType(),
+		}
+		if err := s.accessLog.record(entry); err != nil {
+			s.logger.Warn("Failed to write access log record of request %s: %v", id, err)
+		}
+	}
+}
+
+// accessOp names the operation of a request with method on the key of the
+// endpoint at prefix.
+func accessOp(prefix, method, key string) string {
+	op := strings.ToLower(method)
+	switch {
+	case prefix == "/objects/" && key == "" && method == http.MethodGet:
+		return "list"
+	case prefix == "/chunked/":
+		return op + "_chunked"
+	}
+	return op
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// accessRecorder records the status and size of an answer, and the start
+// of its body when it failed, for the error type reported in it.
+type accessRecorder struct {
+	http.ResponseWriter
+	status  int
+	bytes   int64
+	errBody bytes.Buffer
+}
+
+func (r *accessRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *accessRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	if r.status >= http.StatusBadRequest && r.errBody.Len() < maxAccessErrorBody {
+		r.errBody.Write(p)
+	}
+	n, err := r.ResponseWriter.Write(p)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// statusCode returns the status of the answer, 200 when the handler wrote
+// nothing.
+func (r *accessRecorder) statusCode() int {
+	if r.status == 0 {
+		return http.StatusOK
+	}
+	return r.status
+}
+
+// errorType returns the error type of a failed answer written with
+// admin.WriteError, if any.
+func (r *accessRecorder) errorType() errors.ErrorType {
+	if r.status < http.StatusBadRequest {
+		return ""
+	}
+	var resp admin.ErrorResponse
+	if json.Unmarshal(r.errBody.Bytes(), &resp) != nil {
+		return ""
+	}
+	return resp.Type
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/anthdm/foreverstore/admin"
+	"github.com/anthdm/foreverstore/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientOperationsAreAccessLogged(t *testing.T) {
+	access := &logBuffer{}
+	c := newTestClusterWith(t, 1, func(_ int, opts *FileServerOpts) {
+		opts.AccessLog = access
+		opts.AdminToken = testAdminToken
+	})
+	a := admin.NewServer("127.0.0.1:0")
+	registerAdminHandlers(a, c.nodes[0])
+	srv := httptest.NewServer(a.Handler())
+	defer srv.Close()
+
+	do := func(method, path, body string, header http.Header) *http.Response {
+		req, _ := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+testAdminToken)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err)
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp
+	}
+	resp := do(http.MethodPut, "/objects/docs/report", "quarterly", http.Header{headerRequestID: {"req-1"}})
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, "req-1", resp.Header.Get(headerRequestID))
+	resp = do(http.MethodGet, "/objects/docs/report", "", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	generated := resp.Header.Get(headerRequestID)
+	assert.NotEmpty(t, generated)
+	resp = do(http.MethodPut, "/objects/docs/locked", "x", http.Header{headerObjectLock: {"maybe"}})
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	do(http.MethodGet, "/objects/", "", nil)
+	// Other endpoints are left to the application log.
+	do(http.MethodGet, "/health", "", nil)
+
+	var records []AccessRecord
+	assert.Eventually(t, func() bool {
+		records = nil
+		for _, line := range access.lines("{") {
+			var rec AccessRecord
+			assert.Nil(t, json.Unmarshal([]byte(line), &rec))
+			records = append(records, rec)
+		}
+		return len(records) == 4
+	}, 5*time.Second, 10*time.Millisecond)
+	if !assert.Len(t, records, 4) {
+		return
+	}
+
+	put, get, failed, list := records[0], records[1], records[2], records[3]
+	assert.Equal(t, "req-1", put.RequestID)
+	assert.Equal(t, "put", put.Op)
+	assert.Equal(t, "docs/report", put.Key)
+	assert.Equal(t, int64(len("quarterly")), put.BytesIn)
+	assert.Equal(t, http.StatusCreated, put.Status)
+	assert.Empty(t, put.ErrorType)
+	assert.NotEmpty(t, put.Client)
+	assert.False(t, put.Time.IsZero())
+
+	assert.Equal(t, generated, get.RequestID)
+	assert.Equal(t, "get", get.Op)
+	assert.Equal(t, int64(len("quarterly")), get.BytesOut)
+	assert.Equal(t, http.StatusOK, get.Status)
+
+	assert.Equal(t, "put", failed.Op)
+	assert.Equal(t, http.StatusBadRequest, failed.Status)
+	assert.Equal(t, errors.InvalidInputError, failed.ErrorType)
+
+	assert.Equal(t, "list", list.Op)
+	assert.Empty(t, list.Key)
+	assert.Equal(t, http.StatusOK, list.Status)
+}
@@ -0,0 +1,134 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/anthdm/foreverstore/errors"
+	"github.com/anthdm/foreverstore/logger"
+)
+
+// Server is the HTTP control-plane endpoint of a node. Subsystems register
+// their handlers on it; it is meant to be bound to a trusted interface.
+type Server struct {
+	addr     string
+	mux      *http.ServeMux
+	srv      *http.Server
+	listener net.Listener
+	logger   *logger.Logger
+}
+
+// NewServer creates an admin server that will listen on addr.
+func NewServer(addr string) *Server {
+	mux := http.NewServeMux()
+	return &Server{
+		addr:   addr,
+		mux:    mux,
+		srv:    &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second},
+		logger: logger.WithPrefix("ADMIN"),
+	}
+}
+
+// HandleFunc registers the handler for the given pattern.
+func (s *Server) HandleFunc(pattern string, handler http.HandlerFunc) {
+	s.mux.HandleFunc(pattern, handler)
+}
+
+// Handler returns the HTTP handler serving all registered endpoints.
+func (s *Server) Handler() http.Handler {
+	return s.mux
+}
+
+// Addr returns the address the server is listening on, or the configured
+// address if it has not been started yet.
+func (s *Server) Addr() string {
+	if s.listener != nil {
+		return s.listener.Addr().String()
+	}
+	return s.addr
+}
+
+// Start starts listening and serves requests in the background.
+func (s *Server) Start() error {
+	ln, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return errors.Wrap(err, errors.NetworkError, "failed to start admin listener")
+	}
+	s.listener = ln
+
+	go func() {
+		if err := s.srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			s.logger.Error("Admin server failed: %v", err)
+		}
+	}()
+
+	s.logger.Info("Admin API listening on %s", ln.Addr())
+	return nil
+}
+
+// Close shuts the server down, waiting up to the given timeout for active
+// requests to complete.
+func (s *Server) Close(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return s.srv.Shutdown(ctx)
+}
+
+// WriteJSON writes v as a JSON response with the given status code.
+func WriteJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// ErrorResponse is the body of every failed admin request.
+type ErrorResponse struct {
+	Type  errors.ErrorType `json:"type"`
+	Error string           `json:"error"`
+}
+
+// WriteError writes err as a JSON error response, choosing the status code
+// from its error type.
+func WriteError(w http.ResponseWriter, err error) {
+	errorType := errors.GetType(err)
+	WriteJSON(w, StatusCode(errorType), ErrorResponse{Type: errorType, Error: err.Error()})
+}
+
+// StatusCode maps an error type to the HTTP status code reported for it.
+func StatusCode(errorType errors.ErrorType) int {
+	switch errorType {
+	case errors.InvalidInputError, errors.ValidationError, errors.ConfigError, errors.ChecksumError:
+		return http.StatusBadRequest
+	case errors.AuthenticationError:
+		return http.StatusUnauthorized
+	case errors.AuthorizationError:
+		return http.StatusForbidden
+	case errors.FileNotFoundError:
+		return http.StatusNotFound
+	case errors.ObjectLockedError, errors.FencedError:
+		return http.StatusConflict
+	case errors.QuotaExceededError:
+		return http.StatusInsufficientStorage
+	case errors.RateLimitedError:
+		return http.StatusTooManyRequests
+	case errors.ReadOnlyError, errors.QuorumError:
+		return http.StatusServiceUnavailable
+	case errors.TimeoutError:
+		return http.StatusGatewayTimeout
+	case errors.NetworkError, errors.ConnectionError:
+		return http.StatusBadGateway
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// Actor identifies who made an admin request, for audit purposes.
+func Actor(r *http.Request) string {
+	if user := r.Header.Get("X-Admin-User"); user != "" {
+		return user + "@" + r.RemoteAddr
+	}
+	return r.RemoteAddr
+}
@@ -0,0 +1,98 @@
+package admin
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/anthdm/foreverstore/config"
+	"github.com/anthdm/foreverstore/errors"
+	"github.com/anthdm/foreverstore/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatusCode(t *testing.T) {
+	assert.Equal(t, http.StatusNotFound, StatusCode(errors.FileNotFoundError))
+	assert.Equal(t, http.StatusBadRequest, StatusCode(errors.InvalidInputError))
+	assert.Equal(t, http.StatusConflict, StatusCode(errors.ObjectLockedError))
+	assert.Equal(t, http.StatusConflict, StatusCode(errors.FencedError))
+	assert.Equal(t, http.StatusServiceUnavailable, StatusCode(errors.ReadOnlyError))
+	assert.Equal(t, http.StatusServiceUnavailable, StatusCode(errors.QuorumError))
+	assert.Equal(t, http.StatusTooManyRequests, StatusCode(errors.RateLimitedError))
+	assert.Equal(t, http.StatusInternalServerError, StatusCode(errors.InternalError))
+}
+
+func TestConfigHandlers(t *testing.T) {
+	defer logger.SetGlobalLevel(logger.INFO)
+
+	s := NewServer("127.0.0.1:0")
+	rs := config.NewRuntimeSettings(config.DefaultConfig(), "")
+	RegisterConfigHandlers(s, rs, func(r *http.Request) error {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			return errors.NewAuthenticationError("invalid admin token")
+		}
+		return nil
+	})
+
+	srv := httptest.NewServer(s.Handler())
+	defer srv.Close()
+
+	// Changes need the admin token, or anyone could replace it.
+	for _, method := range []string{http.MethodPut, http.MethodPatch} {
+		body, _ := json.Marshal(ConfigUpdate{Settings: map[string]string{"admin_token": "mine"}})
+		req, _ := http.NewRequest(method, srv.URL+"/config", bytes.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, method)
+	}
+
+	body, _ := json.Marshal(ConfigUpdate{Settings: map[string]string{"log_level": "DEBUG"}})
+	req, _ := http.NewRequest(http.MethodPut, srv.URL+"/config", bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("X-Admin-User", "alice")
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, err = http.Get(srv.URL + "/config")
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+
+	var cr ConfigResponse
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&cr))
+	assert.Equal(t, "DEBUG", cr.Settings["log_level"])
+	assert.Len(t, cr.Audit, 1)
+	assert.Contains(t, cr.Audit[0].Actor, "alice")
+
+	// Invalid values are rejected
+	body, _ = json.Marshal(ConfigUpdate{Settings: map[string]string{"log_level": "LOUD"}})
+	req, _ = http.NewRequest(http.MethodPut, srv.URL+"/config", bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err = http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestWriteMetrics(t *testing.T) {
+	var b bytes.Buffer
+	err := WriteMetrics(&b, []Metric{{
+		Name: "replication_pending",
+		Help: "Replicas being sent.",
+		Type: "gauge",
+		Samples: []Sample{
+			{Labels: map[string]string{"peer": `node "a"`}, Value: 2},
+			{Value: 0.5},
+		},
+	}})
+	assert.Nil(t, err)
+	assert.Equal(t, `# HELP replication_pending Replicas being sent.
+# TYPE replication_pending gauge
+replication_pending{peer="node \"a\""} 2
+replication_pending 0.5
+`, b.String())
+}
@@ -0,0 +1,56 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/anthdm/foreverstore/config"
+	"github.com/anthdm/foreverstore/errors"
+)
+
+// ConfigUpdate is the body of a PUT /config request.
+type ConfigUpdate struct {
+	Settings map[string]string `json:"settings"`
+	Persist  bool              `json:"persist"`
+}
+
+// ConfigResponse is returned by the /config endpoints.
+type ConfigResponse struct {
+	Settings map[string]string   `json:"settings"`
+	Audit    []config.AuditEntry `json:"audit,omitempty"`
+}
+
+// RegisterConfigHandlers exposes the runtime settings of a node:
+//
+//	GET /config        current values and audit trail
+//	PUT /config        change one or more settings
+//
+// The changes are only served to the requests authorize accepts: settings
+// include the admin token and the cluster secret themselves.
+func RegisterConfigHandlers(s *Server, rs *config.RuntimeSettings, authorize func(*http.Request) error) {
+	s.HandleFunc("/config", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			WriteJSON(w, http.StatusOK, ConfigResponse{Settings: rs.Values(), Audit: rs.AuditLog()})
+		case http.MethodPut, http.MethodPatch:
+			if err := authorize(r); err != nil {
+				WriteError(w, err)
+				return
+			}
+			var update ConfigUpdate
+			if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+				WriteError(w, errors.Wrap(err, errors.InvalidInputError, "invalid config update"))
+				return
+			}
+			for name, value := range update.Settings {
+				if err := rs.Set(name, value, Actor(r), update.Persist); err != nil {
+					WriteError(w, errors.Wrap(err, errors.ValidationError, "failed to update "+name))
+					return
+				}
+			}
+			WriteJSON(w, http.StatusOK, ConfigResponse{Settings: rs.Values()})
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+}
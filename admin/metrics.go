@@ -0,0 +1,79 @@
+package admin
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Metric is a metric family in the Prometheus text exposition format.
+type Metric struct {
+	Name string
+	Help string
+	// Type is "gauge" or "counter".
+	Type    string
+	Samples []Sample
+}
+
+// Sample is a value of a metric, identified by its labels.
+type Sample struct {
+	Labels map[string]string
+	Value  float64
+}
+
+// WriteMetrics writes the metrics in the Prometheus text exposition format.
+func WriteMetrics(w io.Writer, metrics []Metric) error {
+	for _, m := range metrics {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.Name, escapeHelp(m.Help), m.Name, m.Type); err != nil {
+			return err
+		}
+		for _, sample := range m.Samples {
+			value := strconv.FormatFloat(sample.Value, 'g', -1, 64)
+			if _, err := fmt.Fprintf(w, "%s%s %s\n", m.Name, formatLabels(sample.Labels), value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// MetricsHandler serves the metrics collect returns at the time of each
+// request.
+func MetricsHandler(collect func() []Metric) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		WriteMetrics(w, collect())
+	}
+}
+
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + `="` + escapeLabel(labels[name]) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string  { return helpEscaper.Replace(s) }
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
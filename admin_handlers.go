@@ -0,0 +1,1440 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/anthdm/foreverstore/admin"
+	"github.com/anthdm/foreverstore/config"
+	"github.com/anthdm/foreverstore/errors"
+)
+
+// KeyRotationRequest is the body of a POST /keys/rotate request.
+type KeyRotationRequest struct {
+	Version uint32 `json:"version"`
+	Key     string `json:"key"`
+}
+
+// MigrationRequest is the body of a POST /migrate request. Target is the
+// admin API address of the replacement node, and Token its admin token,
+// this node's own when empty.
+type MigrationRequest struct {
+	Target string `json:"target"`
+	Token  string `json:"token,omitempty"`
+}
+
+// ObjectList is the response to GET /objects/, a page of the node's
+// objects. NextCursor is passed as the cursor parameter to get the next
+// page and is empty on the last one. Prefixes lists the folders of the
+// page when a delimiter is given; see Store.ListDir.
+type ObjectList struct {
+	Objects    []StoreEntry `json:"objects"`
+	Prefixes   []string     `json:"prefixes,omitempty"`
+	NextCursor string       `json:"next_cursor,omitempty"`
+}
+
+// ClusterObjectList is the response to GET /cluster/objects, a page of the
+// objects of each node listed, partial when some nodes did not answer.
+type ClusterObjectList struct {
+	Nodes []NodeObjects `json:"nodes"`
+	Partial
+}
+
+// Statuses reported by GET /health.
+const (
+	HealthOK       = "ok"
+	HealthDraining = "draining"
+	HealthReadOnly = "read_only"
+)
+
+// HealthResponse is the response to GET /health. A node answers 200 while
+// it serves clients, read_only when its disk is full or failing and it
+// only serves reads, and 503 once it is shutting down, for clients and load
+// balancers to send their requests elsewhere.
+type HealthResponse struct {
+	Status string `json:"status"`
+}
+
+// QueryResponse is the response to GET /query, partial when some peers did
+// not answer.
+type QueryResponse struct {
+	Results []QueryResult `json:"results"`
+	Partial
+}
+
+// ObjectLockStatus is the response to the /locks/ endpoint. An expired lock
+// is reported as unlocked along with the time it expired.
+type ObjectLockStatus struct {
+	Locked      bool       `json:"locked"`
+	RetainUntil *time.Time `json:"retain_until,omitempty"`
+}
+
+// Page sizes of GET /objects/.
+const (
+	defaultListLimit = 1000
+	maxListLimit     = 10000
+)
+
+// Page sizes of GET /changes, and the longest it waits for a change.
+const (
+	defaultChangesLimit = 1000
+	maxChangesLimit     = changeRetention
+	maxChangesWait      = time.Minute
+)
+
+// Headers carrying client metadata on the object endpoints.
+const (
+	headerClientEncrypted = "X-Client-Encrypted"
+	headerMetaPrefix      = "X-Meta-"
+)
+
+// Headers carrying an object's lock on the object endpoints. A PUT locks
+// the object indefinitely with X-Object-Lock: true, or until the RFC 3339
+// time in X-Object-Lock-Retain-Until.
+const (
+	headerObjectLock            = "X-Object-Lock"
+	headerObjectLockRetainUntil = "X-Object-Lock-Retain-Until"
+)
+
+// Headers of idempotent stores: a PUT sent with an Idempotency-Key is not
+// applied again when sent again with the same key, and its answer then
+// carries Idempotent-Replayed: true. The answer to a PUT of the content the
+// object holds already carries Deduplicated: true.
+const (
+	headerIdempotencyKey     = "Idempotency-Key"
+	headerIdempotentReplayed = "Idempotent-Replayed"
+	headerDeduplicated       = "Deduplicated"
+)
+
+// clientMetaFromHeaders collects the client metadata sent with a PUT.
+func clientMetaFromHeaders(h http.Header) (*ClientMeta, error) {
+	var client ClientMeta
+	if v := h.Get(headerClientEncrypted); v != "" {
+		encrypted, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, errors.NewInvalidInputError("invalid " + headerClientEncrypted + " header")
+		}
+		client.Encrypted = encrypted
+	}
+	for name, values := range h {
+		if !strings.HasPrefix(name, headerMetaPrefix) || len(values) == 0 {
+			continue
+		}
+		if client.Attributes == nil {
+			client.Attributes = make(map[string]string)
+		}
+		client.Attributes[strings.ToLower(strings.TrimPrefix(name, headerMetaPrefix))] = values[0]
+	}
+	client.ContentType = h.Get("Content-Type")
+	if !client.Encrypted && client.Attributes == nil && client.ContentType == "" {
+		return nil, nil
+	}
+	return &client, nil
+}
+
+// headerChecksum carries the SHA-256 of the content of an object, hex
+// encoded. A PUT sent with it is refused unless the content hashes to it;
+// the answer to a PUT, GET or HEAD carries the checksum of the object.
+const headerChecksum = "X-Checksum-SHA256"
+
+// checksumFromHeaders returns the checksum sent with a PUT, or nil.
+func checksumFromHeaders(h http.Header) ([]byte, error) {
+	v := h.Get(headerChecksum)
+	if v == "" {
+		return nil, nil
+	}
+	sum, err := hex.DecodeString(v)
+	if err != nil || len(sum) != sha256.Size {
+		return nil, errors.NewInvalidInputError("invalid " + headerChecksum + " header")
+	}
+	return sum, nil
+}
+
+// objectLockFromHeaders returns the lock requested with a PUT, or nil.
+func objectLockFromHeaders(h http.Header) (*ObjectLock, error) {
+	var lock ObjectLock
+	if v := h.Get(headerObjectLockRetainUntil); v != "" {
+		until, err := parseRetainUntil(v)
+		if err != nil {
+			return nil, err
+		}
+		lock.RetainUntil = until
+		return &lock, nil
+	}
+	if v := h.Get(headerObjectLock); v != "" {
+		locked, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, errors.NewInvalidInputError("invalid " + headerObjectLock + " header")
+		}
+		if locked {
+			return &lock, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *FileServer) lockStatus(lock *ObjectLock) ObjectLockStatus {
+	status := ObjectLockStatus{Locked: lock.activeAt(s.Clock.Now())}
+	if lock != nil {
+		status.RetainUntil = lock.RetainUntil
+	}
+	return status
+}
+
+func setObjectLockHeaders(h http.Header, status ObjectLockStatus) {
+	if !status.Locked {
+		return
+	}
+	h.Set(headerObjectLock, "true")
+	if status.RetainUntil != nil {
+		h.Set(headerObjectLockRetainUntil, status.RetainUntil.UTC().Format(time.RFC3339))
+	}
+}
+
+// setObjectHeaders sets the standard HTTP headers of an object of size
+// bytes from its metadata. A negative size leaves the length unset.
+func setObjectHeaders(h http.Header, meta ObjectMeta, size int64) {
+	contentType := "application/octet-stream"
+	if meta.Client != nil && meta.Client.ContentType != "" {
+		contentType = meta.Client.ContentType
+	}
+	h.Set("Content-Type", contentType)
+	if size >= 0 {
+		h.Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+	if etag := meta.ETag(); etag != "" {
+		h.Set("ETag", etag)
+	}
+	if sum := meta.ContentSHA256(); sum != "" {
+		h.Set(headerChecksum, sum)
+	}
+	if !meta.StoredAt.IsZero() {
+		h.Set("Last-Modified", meta.StoredAt.UTC().Format(http.TimeFormat))
+	}
+}
+
+// notModified reports whether the request is conditional on the object
+// having changed, and it has not.
+func notModified(r *http.Request, meta ObjectMeta) bool {
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		etag := meta.ETag()
+		if etag == "" {
+			return false
+		}
+		for _, m := range strings.Split(match, ",") {
+			if m = strings.TrimSpace(m); m == etag || m == "W/"+etag || m == "*" {
+				return true
+			}
+		}
+		return false
+	}
+	if since := r.Header.Get("If-Modified-Since"); since != "" && !meta.StoredAt.IsZero() {
+		t, err := http.ParseTime(since)
+		return err == nil && !meta.StoredAt.Truncate(time.Second).After(t)
+	}
+	return false
+}
+
+// onPeer describes where a request passed on to a peer ran, for the audit
+// log.
+func onPeer(peer string) string {
+	if peer == "" {
+		return ""
+	}
+	return " on peer " + peer
+}
+
+func setClientMetaHeaders(h http.Header, client *ClientMeta) {
+	if client == nil {
+		return
+	}
+	if client.Encrypted {
+		h.Set(headerClientEncrypted, "true")
+	}
+	for name, value := range client.Attributes {
+		h.Set(headerMetaPrefix+name, value)
+	}
+}
+
+// registerAdminHandlers exposes the file server operations on the admin API.
+func registerAdminHandlers(a *admin.Server, s *FileServer) {
+	a.HandleFunc("/keys/rotate", s.adminWrites(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			admin.WriteJSON(w, http.StatusOK, s.KeyRotationStatus())
+		case http.MethodPost:
+			var req KeyRotationRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				admin.WriteError(w, errors.Wrap(err, errors.InvalidInputError, "invalid key rotation request"))
+				return
+			}
+			key, err := config.ParseEncryptionKey(req.Key)
+			if err != nil {
+				admin.WriteError(w, errors.Wrap(err, errors.InvalidInputError, "invalid encryption key"))
+				return
+			}
+			if err := s.RotateKey(req.Version, key); err != nil {
+				admin.WriteError(w, err)
+				return
+			}
+			s.logger.Info("AUDIT: key rotation to version %d started by %s", req.Version, admin.Actor(r))
+			admin.WriteJSON(w, http.StatusAccepted, s.KeyRotationStatus())
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+
+	a.HandleFunc("/migrate", s.adminWrites(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			admin.WriteJSON(w, http.StatusOK, s.MigrationStatus())
+		case http.MethodPost:
+			var req MigrationRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				admin.WriteError(w, errors.Wrap(err, errors.InvalidInputError, "invalid migration request"))
+				return
+			}
+			if req.Target == "" {
+				admin.WriteError(w, errors.NewInvalidInputError("migration target is required"))
+				return
+			}
+			token := req.Token
+			if token == "" {
+				token = s.AdminToken
+			}
+			if err := s.Migrate(req.Target, newHTTPMigrationTarget(req.Target, token)); err != nil {
+				admin.WriteError(w, err)
+				return
+			}
+			s.logger.Info("AUDIT: migration to %s started by %s", req.Target, admin.Actor(r))
+			admin.WriteJSON(w, http.StatusAccepted, s.MigrationStatus())
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+
+	a.HandleFunc("/migrate/objects", s.adminOnly(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		obj, err := migratedObjectFromHeaders(r.Header)
+		if err != nil {
+			admin.WriteError(w, err)
+			return
+		}
+		if err := s.ImportObject(obj, r.Body); err != nil {
+			admin.WriteError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+
+	a.HandleFunc("/query", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		params := r.URL.Query()
+		q := Query{Prefix: params.Get("prefix"), Tags: parseTags(params["tag"])}
+		if v := params.Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				admin.WriteError(w, errors.NewInvalidInputError("invalid limit"))
+				return
+			}
+			q.Limit = n
+		}
+		if err := q.Validate(); err != nil {
+			admin.WriteError(w, err)
+			return
+		}
+
+		results, partial, err := s.Query(q, defaultQueryTimeout)
+		if err != nil {
+			admin.WriteError(w, err)
+			return
+		}
+		if results == nil {
+			results = []QueryResult{}
+		}
+		admin.WriteJSON(w, http.StatusOK, QueryResponse{Results: results, Partial: partial})
+	})
+
+	a.HandleFunc("/cluster/objects", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		listClusterObjects(w, r, s)
+	})
+
+	a.HandleFunc("/peers", s.adminWrites(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			admin.WriteJSON(w, http.StatusOK, s.Peers())
+		case http.MethodPost:
+			var req PeerRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				admin.WriteError(w, errors.Wrap(err, errors.InvalidInputError, "invalid peer request"))
+				return
+			}
+			if err := s.AddPeer(req.Addr); err != nil {
+				admin.WriteError(w, err)
+				return
+			}
+			s.logger.Info("AUDIT: peer %s added by %s", req.Addr, admin.Actor(r))
+			admin.WriteJSON(w, http.StatusAccepted, s.Peers())
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+
+	a.HandleFunc("/peers/", s.adminOnly(func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(r.URL.Path, "/peers/")
+		if id == "" {
+			admin.WriteError(w, errors.NewInvalidInputError("missing peer address or ID"))
+			return
+		}
+		if r.Method != http.MethodDelete {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if err := s.RemovePeer(id); err != nil {
+			admin.WriteError(w, err)
+			return
+		}
+		s.logger.Info("AUDIT: peer %s removed by %s", id, admin.Actor(r))
+		admin.WriteJSON(w, http.StatusOK, s.Peers())
+	}))
+
+	a.HandleFunc("/tier", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		admin.WriteJSON(w, http.StatusOK, s.TierStatus())
+	})
+
+	a.HandleFunc("/replication", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		admin.WriteJSON(w, http.StatusOK, s.ReplicationStats())
+	})
+
+	a.HandleFunc("/fetches", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		admin.WriteJSON(w, http.StatusOK, s.FetchStats())
+	})
+
+	a.HandleFunc("/transfers", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		admin.WriteJSON(w, http.StatusOK, s.Transfers())
+	})
+
+	a.HandleFunc("/dht", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		admin.WriteJSON(w, http.StatusOK, s.DHT())
+	})
+
+	a.HandleFunc("/control", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		admin.WriteJSON(w, http.StatusOK, s.ControlStats())
+	})
+
+	a.HandleFunc("/clock", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		admin.WriteJSON(w, http.StatusOK, s.ClockSkew())
+	})
+
+	a.HandleFunc("/capacity", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		cc, err := s.ClusterCapacity()
+		if err != nil {
+			admin.WriteError(w, err)
+			return
+		}
+		admin.WriteJSON(w, http.StatusOK, cc)
+	})
+
+	a.HandleFunc("/quotas", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		usage, err := s.QuotaUsage()
+		if err != nil {
+			admin.WriteError(w, err)
+			return
+		}
+		admin.WriteJSON(w, http.StatusOK, usage)
+	})
+
+	a.HandleFunc("/buckets", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		admin.WriteJSON(w, http.StatusOK, s.ListBucketPolicies())
+	})
+
+	a.HandleFunc("/buckets/", s.adminWrites(func(w http.ResponseWriter, r *http.Request) {
+		// /buckets/{bucket}: the policy of the bucket, set with PUT and
+		// removed with DELETE.
+		bucket := strings.TrimPrefix(r.URL.Path, "/buckets/")
+		if bucket == "" {
+			admin.WriteError(w, errors.NewInvalidInputError("missing bucket"))
+			return
+		}
+		var policy config.BucketPolicy
+		switch r.Method {
+		case http.MethodGet:
+			admin.WriteJSON(w, http.StatusOK, s.bucketPolicy(bucket+"/"))
+			return
+		case http.MethodPut:
+			if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+				admin.WriteError(w, errors.Wrap(err, errors.InvalidInputError, "invalid bucket policy"))
+				return
+			}
+		case http.MethodDelete:
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		policy.Bucket = bucket
+		if err := s.SetBucketPolicy(policy); err != nil {
+			admin.WriteError(w, err)
+			return
+		}
+		s.logger.Info("AUDIT: policy of bucket %s set by %s: %+v", bucket, admin.Actor(r), policy)
+		admin.WriteJSON(w, http.StatusOK, policy)
+	}))
+
+	a.HandleFunc("/metrics", admin.MetricsHandler(s.metrics))
+
+	a.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if s.Draining() {
+			admin.WriteJSON(w, http.StatusServiceUnavailable, HealthResponse{Status: HealthDraining})
+			return
+		}
+		if s.DiskHealth().ReadOnly {
+			admin.WriteJSON(w, http.StatusOK, HealthResponse{Status: HealthReadOnly})
+			return
+		}
+		admin.WriteJSON(w, http.StatusOK, HealthResponse{Status: HealthOK})
+	})
+
+	a.HandleFunc("/disk", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		admin.WriteJSON(w, http.StatusOK, s.DiskHealth())
+	})
+
+	a.HandleFunc("/resources", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		admin.WriteJSON(w, http.StatusOK, s.ResourceUsage())
+	})
+
+	a.HandleFunc("/disk/writable", s.adminOnly(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		health := s.MakeWritable(admin.Actor(r))
+		s.logger.Info("AUDIT: node made writable by %s", admin.Actor(r))
+		admin.WriteJSON(w, http.StatusOK, health)
+	}))
+
+	a.HandleFunc("/mirror", s.adminWrites(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			admin.WriteJSON(w, http.StatusOK, s.MirrorStatus())
+		case http.MethodPost:
+			status, err := s.ReconcileMirror()
+			if err != nil {
+				admin.WriteError(w, err)
+				return
+			}
+			s.logger.Info("AUDIT: mirror reconcile run by %s", admin.Actor(r))
+			admin.WriteJSON(w, http.StatusOK, status)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+
+	// Restoring stores objects: only the admin may. The body names the
+	// node whose objects are restored, this one when empty.
+	a.HandleFunc("/mirror/restore", s.adminOnly(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		var req struct {
+			Node string `json:"node"`
+		}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				admin.WriteError(w, errors.NewInvalidInputError("invalid restore request"))
+				return
+			}
+		}
+		status, err := s.RestoreFromMirror(req.Node)
+		if err != nil && status.Failed == 0 {
+			// Not a single object could be tried.
+			admin.WriteError(w, err)
+			return
+		}
+		s.logger.Info("AUDIT: restore of node %s from the mirror by %s restored %d objects", status.Node, admin.Actor(r), status.Restored)
+		// Objects that failed are counted in the status.
+		admin.WriteJSON(w, http.StatusOK, status)
+	}))
+
+	a.HandleFunc("/changes", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		listChanges(w, r, s)
+	})
+
+	a.HandleFunc("/follow", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		admin.WriteJSON(w, http.StatusOK, s.FollowStatus())
+	})
+
+	a.HandleFunc("/follow/promote", s.adminOnly(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		status, err := s.Promote(admin.Actor(r))
+		if err != nil {
+			admin.WriteError(w, err)
+			return
+		}
+		s.logger.Info("AUDIT: follower of %s promoted by %s", status.Leader, admin.Actor(r))
+		admin.WriteJSON(w, http.StatusOK, status)
+	}))
+
+	a.HandleFunc("/tls", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if s.PeerTLS == nil {
+			admin.WriteError(w, errors.NewConfigError("peer TLS is not enabled"))
+			return
+		}
+		admin.WriteJSON(w, http.StatusOK, s.PeerTLS.Status())
+	})
+
+	a.HandleFunc("/tls/reload", s.adminOnly(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		status, err := s.ReloadTLS()
+		if err != nil {
+			admin.WriteError(w, err)
+			return
+		}
+		s.logger.Info("AUDIT: peer TLS certificate reloaded by %s", admin.Actor(r))
+		admin.WriteJSON(w, http.StatusOK, status)
+	}))
+
+	a.HandleFunc("/cross-site", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		admin.WriteJSON(w, http.StatusOK, s.CrossSiteStatus())
+	})
+
+	a.HandleFunc("/lifecycle", s.adminWrites(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			admin.WriteJSON(w, http.StatusOK, s.LifecycleStatus())
+		case http.MethodPost:
+			status, err := s.RunLifecycle()
+			if err != nil {
+				admin.WriteError(w, err)
+				return
+			}
+			s.logger.Info("AUDIT: lifecycle evaluation run by %s expired %d objects", admin.Actor(r), status.Expired)
+			admin.WriteJSON(w, http.StatusOK, status)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+
+	a.HandleFunc("/gc", s.adminWrites(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			admin.WriteJSON(w, http.StatusOK, s.GCStatus())
+		case http.MethodPost:
+			status, err := s.CollectGarbage()
+			if err != nil {
+				admin.WriteError(w, err)
+				return
+			}
+			s.logger.Info("AUDIT: garbage collection run by %s removed %d directories and %d namespaces",
+				admin.Actor(r), status.Removed.Dirs, status.Removed.Namespaces)
+			admin.WriteJSON(w, http.StatusOK, status)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+
+	a.HandleFunc("/anti-entropy", s.adminWrites(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			admin.WriteJSON(w, http.StatusOK, s.AntiEntropyStatus())
+		case http.MethodPost:
+			status, err := s.SyncReplicas()
+			if err != nil {
+				admin.WriteError(w, err)
+				return
+			}
+			s.logger.Info("AUDIT: anti-entropy run by %s sent %d replicas", admin.Actor(r), status.Sent)
+			admin.WriteJSON(w, http.StatusOK, status)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+
+	a.HandleFunc("/consistency", s.adminWrites(func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+		switch r.Method {
+		case http.MethodGet:
+			key := params.Get("key")
+			if key == "" {
+				admin.WriteError(w, errors.NewInvalidInputError("key is required"))
+				return
+			}
+			report, err := s.CheckConsistency(key)
+			if err != nil {
+				admin.WriteError(w, err)
+				return
+			}
+			admin.WriteJSON(w, http.StatusOK, report)
+		case http.MethodPost:
+			sample := s.ConsistencyCheckSample
+			if v := params.Get("sample"); v != "" {
+				n, err := strconv.Atoi(v)
+				if err != nil || n < 1 {
+					admin.WriteError(w, errors.NewInvalidInputError("invalid sample"))
+					return
+				}
+				sample = n
+			}
+			repair := false
+			if v := params.Get("repair"); v != "" {
+				b, err := strconv.ParseBool(v)
+				if err != nil {
+					admin.WriteError(w, errors.NewInvalidInputError("invalid repair"))
+					return
+				}
+				repair = b
+			}
+			check, err := s.CheckConsistencySample(sample, repair, admin.Actor(r))
+			if err != nil {
+				admin.WriteError(w, err)
+				return
+			}
+			s.logger.Info("AUDIT: consistency check by %s found %d of %d objects divergent",
+				admin.Actor(r), len(check.Divergent), check.Checked)
+			admin.WriteJSON(w, http.StatusOK, check)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+
+	a.HandleFunc("/storage-check", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		admin.WriteJSON(w, http.StatusOK, s.StorageCheckReport())
+	})
+
+	a.HandleFunc("/jobs", s.adminWrites(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			admin.WriteJSON(w, http.StatusOK, s.Jobs())
+		case http.MethodPost:
+			var req JobRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				admin.WriteError(w, errors.Wrap(err, errors.InvalidInputError, "invalid job request"))
+				return
+			}
+			if req.Kind == "" {
+				admin.WriteError(w, errors.NewInvalidInputError("job kind is required"))
+				return
+			}
+			req.Action = JobStart
+			status, err := s.RequestJob(req, admin.Actor(r))
+			if err != nil {
+				admin.WriteError(w, err)
+				return
+			}
+			s.logger.Info("AUDIT: %s job started by %s%s", req.Kind, admin.Actor(r), onPeer(req.Peer))
+			admin.WriteJSON(w, http.StatusAccepted, status)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+
+	a.HandleFunc("/jobs/", s.adminWrites(func(w http.ResponseWriter, r *http.Request) {
+		// /jobs/{id or kind}, and /jobs/{id or kind}/{pause,resume,cancel}.
+		id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/jobs/"), "/")
+		if id == "" {
+			admin.WriteError(w, errors.NewInvalidInputError("missing job ID or kind"))
+			return
+		}
+		switch {
+		case r.Method == http.MethodGet && action == "":
+			status, err := s.Job(id)
+			if err != nil {
+				admin.WriteError(w, err)
+				return
+			}
+			admin.WriteJSON(w, http.StatusOK, status)
+		case r.Method == http.MethodPost && action != "":
+			req := JobRequest{ID: id, Kind: JobKind(id), Action: JobAction(action), Peer: r.URL.Query().Get("peer")}
+			status, err := s.RequestJob(req, admin.Actor(r))
+			if err != nil {
+				admin.WriteError(w, err)
+				return
+			}
+			s.logger.Info("AUDIT: job %s %s by %s%s", id, action, admin.Actor(r), onPeer(req.Peer))
+			admin.WriteJSON(w, http.StatusOK, status)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+
+	a.HandleFunc("/repair", s.adminWrites(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			admin.WriteJSON(w, http.StatusOK, s.RepairStatus())
+		case http.MethodPost:
+			if err := s.RepairAll(); err != nil {
+				admin.WriteError(w, err)
+				return
+			}
+			s.logger.Info("AUDIT: repair of all objects started by %s", admin.Actor(r))
+			admin.WriteJSON(w, http.StatusAccepted, s.RepairStatus())
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+
+	a.HandleFunc("/repair/", s.adminOnly(func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.URL.Path, "/repair/")
+		if key == "" {
+			admin.WriteError(w, errors.NewInvalidInputError("missing object key"))
+			return
+		}
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		report, err := s.Repair(key)
+		if err != nil {
+			admin.WriteError(w, err)
+			return
+		}
+		admin.WriteJSON(w, http.StatusOK, report)
+	}))
+
+	a.HandleFunc("/locks/", s.adminWrites(func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.URL.Path, "/locks/")
+		if key == "" {
+			admin.WriteError(w, errors.NewInvalidInputError("missing object key"))
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			meta, err := s.Meta(key)
+			if err != nil {
+				admin.WriteError(w, err)
+				return
+			}
+			admin.WriteJSON(w, http.StatusOK, s.lockStatus(meta.Lock))
+		case http.MethodPut:
+			var lock ObjectLock
+			if err := json.NewDecoder(r.Body).Decode(&lock); err != nil && err != io.EOF {
+				admin.WriteError(w, errors.Wrap(err, errors.InvalidInputError, "invalid object lock"))
+				return
+			}
+			if err := s.LockObject(key, lock); err != nil {
+				admin.WriteError(w, err)
+				return
+			}
+			s.logger.Info("AUDIT: %s locked %s by %s", key, lock, admin.Actor(r))
+			admin.WriteJSON(w, http.StatusOK, s.lockStatus(&lock))
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+
+	a.HandleFunc("/stat/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		key := strings.TrimPrefix(r.URL.Path, "/stat/")
+		if key == "" {
+			admin.WriteError(w, errors.NewInvalidInputError("missing object key"))
+			return
+		}
+		stat, err := s.Stat(key, defaultStatTimeout)
+		if err != nil {
+			admin.WriteError(w, err)
+			return
+		}
+		admin.WriteJSON(w, http.StatusOK, stat)
+	})
+
+	a.HandleFunc("/join", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		var req JoinRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			admin.WriteError(w, errors.NewInvalidInputError("invalid join request"))
+			return
+		}
+		info, err := s.AcceptJoin(token, req)
+		if err != nil {
+			admin.WriteError(w, err)
+			return
+		}
+		admin.WriteJSON(w, http.StatusOK, info)
+	})
+
+	a.HandleFunc("/chunked/", s.accessLogged("/chunked/", s.rateLimited(s.adminWrites(func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.URL.Path, "/chunked/")
+		if key == "" {
+			admin.WriteError(w, errors.NewInvalidInputError("missing object key"))
+			return
+		}
+		switch r.Method {
+		case http.MethodPut:
+			m, err := s.StoreChunked(key, r.Body)
+			if err != nil {
+				admin.WriteError(w, err)
+				return
+			}
+			admin.WriteJSON(w, http.StatusCreated, m)
+		case http.MethodGet:
+			serveChunked(w, r, s, key)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))))
+
+	a.HandleFunc("/objects/", s.accessLogged("/objects/", s.rateLimited(s.adminWrites(func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.URL.Path, "/objects/")
+		if key == "" && r.Method == http.MethodGet {
+			listObjects(w, r, s)
+			return
+		}
+		if key == "" {
+			admin.WriteError(w, errors.NewInvalidInputError("missing object key"))
+			return
+		}
+
+		switch r.Method {
+		case http.MethodPut:
+			client, err := clientMetaFromHeaders(r.Header)
+			if err != nil {
+				admin.WriteError(w, err)
+				return
+			}
+			lock, err := objectLockFromHeaders(r.Header)
+			if err != nil {
+				admin.WriteError(w, err)
+				return
+			}
+			checksum, err := checksumFromHeaders(r.Header)
+			if err != nil {
+				admin.WriteError(w, err)
+				return
+			}
+			res, err := s.StoreObjectOnce(key, r.Header.Get(headerIdempotencyKey), r.Body, client, lock, checksum)
+			if err != nil {
+				admin.WriteError(w, err)
+				return
+			}
+			if res.ETag != "" {
+				w.Header().Set("ETag", res.ETag)
+			}
+			if res.SHA256 != "" {
+				w.Header().Set(headerChecksum, res.SHA256)
+			}
+			if res.Replayed {
+				w.Header().Set(headerIdempotentReplayed, "true")
+			}
+			if res.Deduplicated {
+				w.Header().Set(headerDeduplicated, "true")
+			}
+			w.WriteHeader(http.StatusCreated)
+		case http.MethodGet, http.MethodHead:
+			if rng := r.Header.Get("Range"); rng != "" && r.Method == http.MethodGet {
+				serveRange(w, s, key, rng)
+				return
+			}
+			rd, err := s.Get(key)
+			if err != nil {
+				admin.WriteError(w, err)
+				return
+			}
+			if c, ok := rd.(io.Closer); ok {
+				defer c.Close()
+			}
+			meta, _ := s.Meta(key)
+			setClientMetaHeaders(w.Header(), meta.Client)
+			setObjectLockHeaders(w.Header(), s.lockStatus(meta.Lock))
+			setObjectHeaders(w.Header(), meta, s.localSize(key))
+			w.Header().Set("Accept-Ranges", "bytes")
+			if notModified(r, meta) {
+				w.Header().Del("Content-Length")
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			if r.Method == http.MethodHead {
+				return
+			}
+			if _, err := io.Copy(w, rd); err != nil {
+				s.logger.Error("Failed to serve object %s: %v", key, err)
+			}
+		case http.MethodDelete:
+			if err := s.Delete(key); err != nil {
+				admin.WriteError(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))))
+}
+
+// serveRange serves a GET of the object stored under key asking for the
+// byte range rng, from its Range header, with a 206 Partial Content.
+func serveRange(w http.ResponseWriter, s *FileServer, key, rng string) {
+	offset, length, err := parseRange(rng)
+	if err != nil {
+		admin.WriteError(w, err)
+		return
+	}
+	rd, size, err := s.GetRange(key, offset, length)
+	if err == nil && offset >= size {
+		rd.Close()
+		err = errors.NewInvalidInputError("range out of bounds").WithContext("key", key)
+	}
+	if errors.IsType(err, errors.InvalidInputError) {
+		admin.WriteJSON(w, http.StatusRequestedRangeNotSatisfiable, admin.ErrorResponse{Type: errors.InvalidInputError, Error: err.Error()})
+		return
+	}
+	if err != nil {
+		admin.WriteError(w, err)
+		return
+	}
+	defer rd.Close()
+	if length < 0 || length > size-offset {
+		length = size - offset
+	}
+
+	meta, _ := s.Meta(key)
+	setClientMetaHeaders(w.Header(), meta.Client)
+	setObjectLockHeaders(w.Header(), s.lockStatus(meta.Lock))
+	setObjectHeaders(w.Header(), meta, length)
+	// The checksum is that of the whole object.
+	w.Header().Del(headerChecksum)
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+length-1, size))
+	w.WriteHeader(http.StatusPartialContent)
+	if _, err := io.Copy(w, rd); err != nil {
+		s.logger.Error("Failed to serve range of object %s: %v", key, err)
+	}
+}
+
+// parseRange parses a Range header asking for a single range of bytes,
+// bytes=first-last or bytes=first-, into its offset and its length, which
+// is negative for a range running to the end of the object.
+func parseRange(rng string) (offset, length int64, err error) {
+	spec := strings.TrimPrefix(rng, "bytes=")
+	dash := strings.Index(spec, "-")
+	if spec == rng || dash <= 0 || strings.Contains(spec, ",") {
+		return 0, 0, errors.NewInvalidInputError("unsupported range").WithContext("range", rng)
+	}
+	offset, err = strconv.ParseInt(spec[:dash], 10, 64)
+	if err != nil || offset < 0 {
+		return 0, 0, errors.NewInvalidInputError("invalid range").WithContext("range", rng)
+	}
+	if spec[dash+1:] == "" {
+		return offset, -1, nil
+	}
+	last, err := strconv.ParseInt(spec[dash+1:], 10, 64)
+	if err != nil || last < offset {
+		return 0, 0, errors.NewInvalidInputError("invalid range").WithContext("range", rng)
+	}
+	return offset, last - offset + 1, nil
+}
+
+// serveChunked serves GET /chunked/<key>?offset=&length=, a range of a
+// file stored chunked, the whole file by default.
+func serveChunked(w http.ResponseWriter, r *http.Request, s *FileServer, key string) {
+	query := r.URL.Query()
+	offset, length := int64(0), int64(-1)
+	if v := query.Get("offset"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			admin.WriteError(w, errors.NewInvalidInputError("invalid offset"))
+			return
+		}
+		offset = n
+	}
+	if v := query.Get("length"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			admin.WriteError(w, errors.NewInvalidInputError("invalid length"))
+			return
+		}
+		length = n
+	}
+
+	rd, err := s.GetChunkedRange(key, offset, length)
+	if err != nil {
+		admin.WriteError(w, err)
+		return
+	}
+	defer rd.Close()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if _, err := io.Copy(w, rd); err != nil {
+		s.logger.Error("Failed to serve chunked file %s: %v", key, err)
+	}
+}
+
+// listObjects serves GET /objects/?prefix=&delimiter=&cursor=&limit=.
+func listObjects(w http.ResponseWriter, r *http.Request, s *FileServer) {
+	query := r.URL.Query()
+	limit := defaultListLimit
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxListLimit {
+			admin.WriteError(w, errors.NewInvalidInputError("limit must be between 1 and "+strconv.Itoa(maxListLimit)))
+			return
+		}
+		limit = n
+	}
+
+	if delimiter := query.Get("delimiter"); delimiter != "" {
+		listing, err := s.ListDir(query.Get("prefix"), delimiter, query.Get("cursor"), limit)
+		if err != nil {
+			admin.WriteError(w, err)
+			return
+		}
+		admin.WriteJSON(w, http.StatusOK, ObjectList{Objects: listing.Objects, Prefixes: listing.Prefixes, NextCursor: listing.NextCursor})
+		return
+	}
+
+	entries, next, err := s.List(query.Get("prefix"), query.Get("cursor"), limit)
+	if err != nil {
+		admin.WriteError(w, err)
+		return
+	}
+	if entries == nil {
+		entries = []StoreEntry{}
+	}
+	admin.WriteJSON(w, http.StatusOK, ObjectList{Objects: entries, NextCursor: next})
+}
+
+// listClusterObjects serves GET /cluster/objects?prefix=&limit=, the first
+// page of the objects of every node, and
+// GET /cluster/objects?node=&prefix=&cursor=&limit=, the next page of the
+// node at the address given.
+func listClusterObjects(w http.ResponseWriter, r *http.Request, s *FileServer) {
+	query := r.URL.Query()
+	limit := defaultListLimit
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxListLimit {
+			admin.WriteError(w, errors.NewInvalidInputError("limit must be between 1 and "+strconv.Itoa(maxListLimit)))
+			return
+		}
+		limit = n
+	}
+
+	if node := query.Get("node"); node != "" {
+		if node == s.advertiseAddr() {
+			node = ""
+		}
+		page, err := s.ListNode(node, query.Get("prefix"), query.Get("cursor"), limit, defaultListTimeout)
+		if err != nil {
+			admin.WriteError(w, err)
+			return
+		}
+		admin.WriteJSON(w, http.StatusOK, ClusterObjectList{Nodes: []NodeObjects{page}})
+		return
+	}
+
+	nodes, partial, err := s.ListCluster(query.Get("prefix"), limit, defaultListTimeout)
+	if err != nil {
+		admin.WriteError(w, err)
+		return
+	}
+	admin.WriteJSON(w, http.StatusOK, ClusterObjectList{Nodes: nodes, Partial: partial})
+}
+
+// listChanges serves GET /changes?bucket=&cursor=&limit=&wait=, the
+// changes after cursor, waiting up to wait (a duration such as 30s) for
+// one when there are none yet.
+func listChanges(w http.ResponseWriter, r *http.Request, s *FileServer) {
+	query := r.URL.Query()
+	limit := defaultChangesLimit
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxChangesLimit {
+			admin.WriteError(w, errors.NewInvalidInputError("limit must be between 1 and "+strconv.Itoa(maxChangesLimit)))
+			return
+		}
+		limit = n
+	}
+	var cursor uint64
+	if v := query.Get("cursor"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			admin.WriteError(w, errors.NewInvalidInputError("invalid cursor "+v))
+			return
+		}
+		cursor = n
+	}
+	var wait time.Duration
+	if v := query.Get("wait"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 || d > maxChangesWait {
+			admin.WriteError(w, errors.NewInvalidInputError("wait must be a duration up to "+maxChangesWait.String()))
+			return
+		}
+		wait = d
+	}
+
+	list, err := s.Changes(r.Context(), query.Get("bucket"), cursor, limit, wait)
+	if err != nil {
+		admin.WriteError(w, err)
+		return
+	}
+	admin.WriteJSON(w, http.StatusOK, list)
+}
+
+// metrics collects the metrics served on GET /metrics.
+func (s *FileServer) metrics() []admin.Metric {
+	stats := s.ReplicationStats()
+	perPeer := func(name, help, typ string, value func(PeerReplicationStats) float64) admin.Metric {
+		m := admin.Metric{Name: name, Help: help, Type: typ}
+		for _, st := range stats {
+			m.Samples = append(m.Samples, admin.Sample{
+				Labels: map[string]string{"peer": st.Peer},
+				Value:  value(st),
+			})
+		}
+		return m
+	}
+
+	metrics := []admin.Metric{
+		perPeer("foreverstore_replication_pending", "Replicas being sent to the peer.", "gauge",
+			func(st PeerReplicationStats) float64 { return float64(st.Pending) }),
+		perPeer("foreverstore_replication_pending_bytes", "Bytes of the replicas being sent to the peer not sent yet.", "gauge",
+			func(st PeerReplicationStats) float64 { return float64(st.PendingBytes) }),
+		perPeer("foreverstore_replication_oldest_pending_seconds", "Age of the oldest replica being sent to the peer.", "gauge",
+			func(st PeerReplicationStats) float64 { return st.OldestPending.Seconds() }),
+		perPeer("foreverstore_replication_replicated_total", "Replicas sent to the peer.", "counter",
+			func(st PeerReplicationStats) float64 { return float64(st.Replicated) }),
+		perPeer("foreverstore_replication_failed_total", "Replicas that failed to reach the peer.", "counter",
+			func(st PeerReplicationStats) float64 { return float64(st.Failed) }),
+		perPeer("foreverstore_replication_sent_bytes_total", "Bytes of replicas sent to the peer.", "counter",
+			func(st PeerReplicationStats) float64 { return float64(st.BytesSent) }),
+		perPeer("foreverstore_replication_verified_total", "Replicas the peer acknowledged persisting as sent.", "counter",
+			func(st PeerReplicationStats) float64 { return float64(st.Verified) }),
+		perPeer("foreverstore_replication_mismatched_total", "Replicas the peer persisted short or different from what was sent.", "counter",
+			func(st PeerReplicationStats) float64 { return float64(st.Mismatched) }),
+		perPeer("foreverstore_replication_unverified_total", "Replicas the peer did not acknowledge in time.", "counter",
+			func(st PeerReplicationStats) float64 { return float64(st.Unverified) }),
+	}
+
+	fetches := s.FetchStats()
+	metrics = append(metrics,
+		admin.Metric{Name: "foreverstore_fetches_in_flight", Help: "Fetches of objects from the network in progress.", Type: "gauge",
+			Samples: []admin.Sample{{Value: float64(len(fetches.InFlight))}}},
+		admin.Metric{Name: "foreverstore_fetches_total", Help: "Fetches of objects from the network.", Type: "counter",
+			Samples: []admin.Sample{{Value: float64(fetches.Fetches)}}},
+		admin.Metric{Name: "foreverstore_fetches_prefetched_total", Help: "Fetches of objects started by read-ahead.", Type: "counter",
+			Samples: []admin.Sample{{Value: float64(fetches.Prefetches)}}},
+		admin.Metric{Name: "foreverstore_fetches_coalesced_total", Help: "Gets served by a fetch already in progress.", Type: "counter",
+			Samples: []admin.Sample{{Value: float64(fetches.Coalesced)}}},
+	)
+
+	control := s.ControlStats()
+	pending := admin.Metric{Name: "foreverstore_control_pending", Help: "Control messages sent to the peer not acknowledged yet.", Type: "gauge"}
+	for _, p := range control.Peers {
+		pending.Samples = append(pending.Samples, admin.Sample{Labels: map[string]string{"peer": p.Peer}, Value: float64(p.Pending)})
+	}
+	metrics = append(metrics, pending,
+		admin.Metric{Name: "foreverstore_control_sent_total", Help: "Control messages sent to peers.", Type: "counter",
+			Samples: []admin.Sample{{Value: float64(control.Sent)}}},
+		admin.Metric{Name: "foreverstore_control_resent_total", Help: "Control messages sent again for want of an acknowledgment.", Type: "counter",
+			Samples: []admin.Sample{{Value: float64(control.Resent)}}},
+		admin.Metric{Name: "foreverstore_control_failed_total", Help: "Control messages given up on.", Type: "counter",
+			Samples: []admin.Sample{{Value: float64(control.Failed)}}},
+	)
+
+	crossSite := s.CrossSiteStatus()
+	metrics = append(metrics,
+		admin.Metric{Name: "foreverstore_cross_site_pending", Help: "Objects waiting to be replicated to other sites.", Type: "gauge",
+			Samples: []admin.Sample{{Value: float64(crossSite.Pending)}}},
+		admin.Metric{Name: "foreverstore_cross_site_oldest_pending_seconds", Help: "Age of the oldest object waiting to be replicated to other sites.", Type: "gauge",
+			Samples: []admin.Sample{{Value: crossSite.OldestPending.Seconds()}}},
+		admin.Metric{Name: "foreverstore_cross_site_replicated_total", Help: "Objects replicated to other sites in the background.", Type: "counter",
+			Samples: []admin.Sample{{Value: float64(crossSite.Replicated)}}},
+	)
+
+	failed := admin.Metric{Name: "foreverstore_errors_total", Help: "Operations that failed, by operation and error type.", Type: "counter"}
+	for _, c := range s.ErrorCounts() {
+		failed.Samples = append(failed.Samples, admin.Sample{
+			Labels: map[string]string{"op": c.Op, "type": string(c.Type)},
+			Value:  float64(c.Count),
+		})
+	}
+	metrics = append(metrics, failed)
+
+	skew := admin.Metric{Name: "foreverstore_peer_clock_skew_seconds", Help: "How far ahead of the clock of the node the clock of the peer is.", Type: "gauge"}
+	for _, c := range s.ClockSkew() {
+		skew.Samples = append(skew.Samples, admin.Sample{
+			Labels: map[string]string{"peer": c.Peer},
+			Value:  c.Skew.Seconds(),
+		})
+	}
+	metrics = append(metrics, skew)
+
+	disk := s.DiskHealth()
+	readOnly := 0.0
+	if disk.ReadOnly {
+		readOnly = 1
+	}
+	metrics = append(metrics,
+		admin.Metric{Name: "foreverstore_disk_read_only", Help: "Whether the node is read-only for the health of its disk.", Type: "gauge",
+			Samples: []admin.Sample{{Value: readOnly}}},
+		admin.Metric{Name: "foreverstore_disk_free_bytes", Help: "Free space of the disk holding the storage root, as last checked.", Type: "gauge",
+			Samples: []admin.Sample{{Value: float64(disk.FreeBytes)}}},
+		admin.Metric{Name: "foreverstore_disk_write_errors_total", Help: "Writes the disk failed for want of space or with an I/O error.", Type: "counter",
+			Samples: []admin.Sample{{Value: float64(disk.WriteErrors)}}},
+	)
+
+	metrics = append(metrics, admin.Metric{Name: "foreverstore_peers_failed_total", Help: "Peers dropped for going silent.", Type: "counter",
+		Samples: []admin.Sample{{Value: float64(s.FailedPeers())}}})
+
+	resources := s.ResourceUsage()
+	metrics = append(metrics,
+		admin.Metric{Name: "foreverstore_goroutines", Help: "Goroutines of the node.", Type: "gauge",
+			Samples: []admin.Sample{{Value: float64(resources.Goroutines)}}},
+		admin.Metric{Name: "foreverstore_goroutines_budget", Help: "Goroutines above which the node warns.", Type: "gauge",
+			Samples: []admin.Sample{{Value: float64(resources.MaxGoroutines)}}},
+	)
+	if resources.OpenFiles >= 0 {
+		metrics = append(metrics,
+			admin.Metric{Name: "foreverstore_open_files", Help: "Files, connections included, the node has open.", Type: "gauge",
+				Samples: []admin.Sample{{Value: float64(resources.OpenFiles)}}},
+			admin.Metric{Name: "foreverstore_open_files_budget", Help: "Open files above which the node warns.", Type: "gauge",
+				Samples: []admin.Sample{{Value: float64(resources.MaxOpenFiles)}}},
+		)
+	}
+	active := admin.Metric{Name: "foreverstore_worker_pool_active", Help: "Workers of the pool at work.", Type: "gauge"}
+	size := admin.Metric{Name: "foreverstore_worker_pool_size", Help: "Most workers the pool runs at once, for bounded pools.", Type: "gauge"}
+	utilization := admin.Metric{Name: "foreverstore_worker_pool_utilization", Help: "Share of the workers of a bounded pool at work.", Type: "gauge"}
+	started := admin.Metric{Name: "foreverstore_worker_pool_started_total", Help: "Work the pool took on.", Type: "counter"}
+	for _, p := range resources.Pools {
+		labels := map[string]string{"pool": p.Name}
+		active.Samples = append(active.Samples, admin.Sample{Labels: labels, Value: float64(p.Active)})
+		started.Samples = append(started.Samples, admin.Sample{Labels: labels, Value: float64(p.Started)})
+		if p.Size > 0 {
+			size.Samples = append(size.Samples, admin.Sample{Labels: labels, Value: float64(p.Size)})
+			utilization.Samples = append(utilization.Samples, admin.Sample{Labels: labels, Value: p.Utilization})
+		}
+	}
+	metrics = append(metrics, active, size, utilization, started)
+
+	if quotas, err := s.QuotaUsage(); err != nil {
+		s.logger.Warn("Leaving quotas out of the metrics: %v", err)
+	} else if len(quotas) > 0 {
+		used := admin.Metric{Name: "foreverstore_quota_used_bytes", Help: "Bytes stored across the cluster under the quota.", Type: "gauge"}
+		limit := admin.Metric{Name: "foreverstore_quota_limit_bytes", Help: "Bytes the quota allows.", Type: "gauge"}
+		for _, q := range quotas {
+			labels := map[string]string{"kind": q.Kind, "name": q.Name}
+			used.Samples = append(used.Samples, admin.Sample{Labels: labels, Value: float64(q.Used)})
+			limit.Samples = append(limit.Samples, admin.Sample{Labels: labels, Value: float64(q.Limit)})
+		}
+		metrics = append(metrics, used, limit)
+	}
+
+	cc, err := s.ClusterCapacity()
+	if err != nil {
+		s.logger.Warn("Leaving capacity out of the metrics: %v", err)
+		return metrics
+	}
+	used := admin.Metric{Name: "foreverstore_capacity_used_bytes", Help: "Disk usage of the node, as last reported.", Type: "gauge"}
+	limit := admin.Metric{Name: "foreverstore_capacity_limit_bytes", Help: "Storage the node may use, for nodes with a limit.", Type: "gauge"}
+	for _, c := range cc.Nodes {
+		labels := map[string]string{"node": c.Node}
+		used.Samples = append(used.Samples, admin.Sample{Labels: labels, Value: float64(c.Used)})
+		if c.Limit > 0 {
+			limit.Samples = append(limit.Samples, admin.Sample{Labels: labels, Value: float64(c.Limit)})
+		}
+	}
+	return append(metrics, used, limit)
+}
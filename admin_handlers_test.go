@@ -0,0 +1,617 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/anthdm/foreverstore/admin"
+	"github.com/anthdm/foreverstore/client"
+	"github.com/anthdm/foreverstore/e2e"
+	"github.com/anthdm/foreverstore/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestObjectHandlersEndToEndEncrypted(t *testing.T) {
+	tempDir := "/tmp/fs_test_admin_objects"
+	defer os.RemoveAll(tempDir)
+
+	server := createTestServer(":0", tempDir, []string{})
+	a := admin.NewServer("127.0.0.1:0")
+	registerAdminHandlers(a, server)
+	srv := httptest.NewServer(a.Handler())
+	defer srv.Close()
+
+	clientKey := newEncryptionKey()
+	sealed := new(bytes.Buffer)
+	_, err := e2e.Encrypt(clientKey, bytes.NewReader([]byte("top secret")), sealed)
+	assert.Nil(t, err)
+	ciphertext := sealed.Bytes()
+
+	req, _ := http.NewRequest(http.MethodPut, srv.URL+"/objects/doc", bytes.NewReader(ciphertext))
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	req.Header.Set(headerClientEncrypted, "true")
+	req.Header.Set(headerMetaPrefix+e2e.AttrKeyID, e2e.KeyID(clientKey))
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	// The server hands back exactly what it was given.
+	resp, err = http.Get(srv.URL + "/objects/doc")
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "true", resp.Header.Get(headerClientEncrypted))
+	assert.Equal(t, e2e.KeyID(clientKey), resp.Header.Get(headerMetaPrefix+e2e.AttrKeyID))
+	b, err := io.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, ciphertext, b)
+
+	plain := new(bytes.Buffer)
+	_, err = e2e.Decrypt(clientKey, bytes.NewReader(b), plain)
+	assert.Nil(t, err)
+	assert.Equal(t, "top secret", plain.String())
+}
+
+func TestObjectHandlersCarryChecksums(t *testing.T) {
+	server := createTestServer(":0", t.TempDir(), []string{})
+	a := admin.NewServer("127.0.0.1:0")
+	registerAdminHandlers(a, server)
+	srv := httptest.NewServer(a.Handler())
+	defer srv.Close()
+
+	put := func(checksum string) *http.Response {
+		req, _ := http.NewRequest(http.MethodPut, srv.URL+"/objects/doc", strings.NewReader("checked"))
+		req.Header.Set("Authorization", "Bearer "+testAdminToken)
+		req.Header.Set(headerChecksum, checksum)
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err)
+		resp.Body.Close()
+		return resp
+	}
+	resp := put("not hex")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	sum := sha256.Sum256([]byte("other"))
+	resp = put(hex.EncodeToString(sum[:]))
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.False(t, server.store.Has(server.ID, "doc"))
+
+	sum = sha256.Sum256([]byte("checked"))
+	resp = put(hex.EncodeToString(sum[:]))
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, hex.EncodeToString(sum[:]), resp.Header.Get(headerChecksum))
+
+	resp, err := http.Head(srv.URL + "/objects/doc")
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, hex.EncodeToString(sum[:]), resp.Header.Get(headerChecksum))
+}
+
+func TestListObjectsHandlerPages(t *testing.T) {
+	server := createTestServer(":0", t.TempDir(), []string{})
+	a := admin.NewServer("127.0.0.1:0")
+	registerAdminHandlers(a, server)
+	srv := httptest.NewServer(a.Handler())
+	defer srv.Close()
+
+	for _, key := range []string{"a/1", "a/2", "a/3", "b/1"} {
+		assert.Nil(t, server.Store(key, bytes.NewReader([]byte(key))))
+	}
+
+	var keys []string
+	for cursor := ""; ; {
+		resp, err := http.Get(srv.URL + "/objects/?prefix=a/&limit=2&cursor=" + url.QueryEscape(cursor))
+		assert.Nil(t, err)
+		var page ObjectList
+		assert.Nil(t, json.NewDecoder(resp.Body).Decode(&page))
+		resp.Body.Close()
+		assert.LessOrEqual(t, len(page.Objects), 2)
+		for _, obj := range page.Objects {
+			keys = append(keys, obj.Key)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		cursor = page.NextCursor
+	}
+	assert.ElementsMatch(t, []string{"a/1", "a/2", "a/3"}, keys)
+
+	// With a delimiter, the keys below the folders are folded into them.
+	resp, err := http.Get(srv.URL + "/objects/?delimiter=/")
+	assert.Nil(t, err)
+	var page ObjectList
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&page))
+	resp.Body.Close()
+	assert.Empty(t, page.Objects)
+	assert.Equal(t, []string{"a/", "b/"}, page.Prefixes)
+
+	resp, err = http.Get(srv.URL + "/objects/?limit=0")
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestClusterObjectsHandler(t *testing.T) {
+	server := createTestServer(":0", t.TempDir(), []string{})
+	a := admin.NewServer("127.0.0.1:0")
+	registerAdminHandlers(a, server)
+	srv := httptest.NewServer(a.Handler())
+	defer srv.Close()
+
+	for _, key := range []string{"a/1", "a/2", "b/1"} {
+		assert.Nil(t, server.Store(key, bytes.NewReader([]byte(key))))
+	}
+
+	var keys []string
+	query := url.Values{"prefix": {"a/"}, "limit": {"1"}}
+	for {
+		resp, err := http.Get(srv.URL + "/cluster/objects?" + query.Encode())
+		assert.Nil(t, err)
+		var list ClusterObjectList
+		assert.Nil(t, json.NewDecoder(resp.Body).Decode(&list))
+		resp.Body.Close()
+		assert.Len(t, list.Nodes, 1)
+		page := list.Nodes[0]
+		assert.Equal(t, server.ID, page.Node)
+		for _, obj := range page.Objects {
+			keys = append(keys, obj.Key)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		query.Set("node", page.Addr)
+		query.Set("cursor", page.NextCursor)
+	}
+	assert.ElementsMatch(t, []string{"a/1", "a/2"}, keys)
+
+	resp, err := http.Get(srv.URL + "/cluster/objects?limit=0")
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestChangesHandler(t *testing.T) {
+	server := createTestServer(":0", t.TempDir(), []string{})
+	a := admin.NewServer("127.0.0.1:0")
+	registerAdminHandlers(a, server)
+	srv := httptest.NewServer(a.Handler())
+	defer srv.Close()
+
+	for _, key := range []string{"a/1", "b/1", "a/2"} {
+		assert.Nil(t, server.Store(key, bytes.NewReader([]byte(key))))
+	}
+
+	resp, err := http.Get(srv.URL + "/changes?bucket=a&cursor=1&wait=10ms")
+	assert.Nil(t, err)
+	var list ChangeList
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&list))
+	resp.Body.Close()
+	assert.Len(t, list.Changes, 1)
+	assert.Equal(t, "a/2", list.Changes[0].Key)
+	assert.Equal(t, uint64(3), list.Cursor)
+
+	for _, query := range []string{"cursor=x", "limit=0", "wait=1h", "bucket=a/b"} {
+		resp, err := http.Get(srv.URL + "/changes?" + query)
+		assert.Nil(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, query)
+	}
+}
+
+func TestQueryHandler(t *testing.T) {
+	server := createTestServer(":0", t.TempDir(), []string{})
+	a := admin.NewServer("127.0.0.1:0")
+	registerAdminHandlers(a, server)
+	srv := httptest.NewServer(a.Handler())
+	defer srv.Close()
+
+	req, _ := http.NewRequest(http.MethodPut, srv.URL+"/objects/reports/q1", bytes.NewReader([]byte("q1")))
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	req.Header.Set(headerMetaPrefix+"Team", "finance")
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Nil(t, server.Store("reports/q2", bytes.NewReader([]byte("q2"))))
+
+	resp, err = http.Get(srv.URL + "/query?prefix=reports/&tag=" + url.QueryEscape("Team=finance"))
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	var body QueryResponse
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&body))
+	assert.Len(t, body.Results, 1)
+	assert.Equal(t, "reports/q1", body.Results[0].Key)
+	assert.Equal(t, map[string]string{"team": "finance"}, body.Results[0].Tags)
+}
+
+func TestObjectLockHandlers(t *testing.T) {
+	server := createTestServer(":0", t.TempDir(), []string{})
+	a := admin.NewServer("127.0.0.1:0")
+	registerAdminHandlers(a, server)
+	srv := httptest.NewServer(a.Handler())
+	defer srv.Close()
+
+	put := func(key, body string, header http.Header) int {
+		req, _ := http.NewRequest(http.MethodPut, srv.URL+"/objects/"+key, bytes.NewReader([]byte(body)))
+		req.Header.Set("Authorization", "Bearer "+testAdminToken)
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	until := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	header := http.Header{}
+	header.Set(headerObjectLockRetainUntil, until.Format(time.RFC3339))
+	assert.Equal(t, http.StatusCreated, put("invoice", "v1", header))
+	assert.Equal(t, http.StatusConflict, put("invoice", "v2", nil))
+
+	resp, err := http.Get(srv.URL + "/objects/invoice")
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, "true", resp.Header.Get(headerObjectLock))
+	assert.Equal(t, until.Format(time.RFC3339), resp.Header.Get(headerObjectLockRetainUntil))
+
+	// Lock an unlocked object through the lock endpoint.
+	assert.Equal(t, http.StatusCreated, put("contract", "signed", nil))
+	req, _ := http.NewRequest(http.MethodPut, srv.URL+"/locks/contract", bytes.NewReader([]byte("{}")))
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	resp, err = http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, err = http.Get(srv.URL + "/locks/contract")
+	assert.Nil(t, err)
+	var status ObjectLockStatus
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&status))
+	resp.Body.Close()
+	assert.True(t, status.Locked)
+	assert.Nil(t, status.RetainUntil)
+	assert.Equal(t, http.StatusConflict, put("contract", "forged", nil))
+}
+
+func TestAdminWritesRequireTheAdminToken(t *testing.T) {
+	server := createTestServer(":0", t.TempDir(), []string{})
+	a := admin.NewServer("127.0.0.1:0")
+	registerAdminHandlers(a, server)
+	srv := httptest.NewServer(a.Handler())
+	defer srv.Close()
+
+	do := func(method, path, token string) int {
+		req, _ := http.NewRequest(method, srv.URL+path, strings.NewReader("{}"))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	for _, path := range []string{"/objects/doc", "/chunked/doc", "/migrate/objects"} {
+		assert.Equal(t, http.StatusUnauthorized, do(http.MethodPut, path, ""), path)
+		assert.Equal(t, http.StatusUnauthorized, do(http.MethodPut, path, "wrong"), path)
+	}
+	for _, path := range []string{"/keys/rotate", "/migrate"} {
+		assert.Equal(t, http.StatusUnauthorized, do(http.MethodPost, path, ""), path)
+	}
+	assert.Equal(t, http.StatusCreated, do(http.MethodPut, "/objects/doc", testAdminToken))
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/objects/doc", ""))
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/keys/rotate", ""))
+
+	// A node without an admin token serves no writes.
+	server.AdminToken = ""
+	assert.Equal(t, http.StatusForbidden, do(http.MethodPut, "/objects/doc", testAdminToken))
+}
+
+func TestAdministrativeOperationsRequireTheAdminToken(t *testing.T) {
+	server := createTestServer(":0", t.TempDir(), []string{})
+	a := admin.NewServer("127.0.0.1:0")
+	registerAdminHandlers(a, server)
+	srv := httptest.NewServer(a.Handler())
+	defer srv.Close()
+
+	for _, route := range []struct{ method, path string }{
+		{http.MethodPut, "/locks/doc"},
+		{http.MethodPost, "/lifecycle"},
+		{http.MethodPost, "/peers"},
+		{http.MethodDelete, "/peers/node-1"},
+		{http.MethodPut, "/buckets/photos"},
+		{http.MethodDelete, "/buckets/photos"},
+		{http.MethodPost, "/follow/promote"},
+		{http.MethodPost, "/tls/reload"},
+		{http.MethodPost, "/disk/writable"},
+		{http.MethodPost, "/jobs"},
+		{http.MethodPost, "/jobs/rebalance/cancel"},
+		{http.MethodPost, "/repair"},
+		{http.MethodPost, "/repair/doc"},
+		{http.MethodPost, "/gc"},
+		{http.MethodPost, "/anti-entropy"},
+		{http.MethodPost, "/consistency"},
+	} {
+		t.Run(route.method+" "+route.path, func(t *testing.T) {
+			req, _ := http.NewRequest(route.method, srv.URL+route.path, strings.NewReader("{}"))
+			resp, err := http.DefaultClient.Do(req)
+			assert.Nil(t, err)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+		})
+	}
+
+	// Their status stays readable by everyone.
+	for _, path := range []string{"/lifecycle", "/peers", "/gc", "/anti-entropy", "/jobs", "/repair"} {
+		resp, err := http.Get(srv.URL + path)
+		assert.Nil(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode, path)
+	}
+}
+
+func TestMigrationHandlers(t *testing.T) {
+	source := createTestServer(":0", t.TempDir(), []string{})
+	target := createTestServer(":0", t.TempDir(), []string{})
+	handlers := func(s *FileServer) *httptest.Server {
+		a := admin.NewServer("127.0.0.1:0")
+		registerAdminHandlers(a, s)
+		srv := httptest.NewServer(a.Handler())
+		t.Cleanup(srv.Close)
+		return srv
+	}
+	sourceSrv, targetSrv := handlers(source), handlers(target)
+
+	// The target holds none of the source's keys: it takes the replica,
+	// which it keeps encrypted, but cannot verify the source's own object.
+	assert.Nil(t, source.Store("report", bytes.NewReader([]byte("quarterly report"))))
+	_, err := source.store.Write("peer", "replica", bytes.NewReader([]byte("sealed replica")))
+	assert.Nil(t, err)
+
+	body, _ := json.Marshal(MigrationRequest{Target: targetSrv.Listener.Addr().String()})
+	req, _ := http.NewRequest(http.MethodPost, sourceSrv.URL+"/migrate", bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+	var status MigrationStatus
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		resp, err := http.Get(sourceSrv.URL + "/migrate")
+		assert.Nil(t, err)
+		assert.Nil(t, json.NewDecoder(resp.Body).Decode(&status))
+		resp.Body.Close()
+		if !status.Running {
+			break
+		}
+	}
+	assert.False(t, status.Running)
+	assert.Equal(t, 2, status.Total)
+	assert.Equal(t, 1, status.Copied)
+	assert.Equal(t, 1, status.Failed)
+	assert.Contains(t, status.LastError, "integrity")
+
+	assert.True(t, target.store.Has("peer", "replica"))
+	assert.False(t, target.store.Has(target.ID, "report"))
+}
+
+func TestMetricsHandler(t *testing.T) {
+	server := createTestServer(":0", t.TempDir(), []string{})
+	a := admin.NewServer("127.0.0.1:0")
+	registerAdminHandlers(a, server)
+	srv := httptest.NewServer(a.Handler())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/metrics")
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	b, err := io.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	assert.Contains(t, string(b), "# TYPE foreverstore_replication_pending_bytes gauge")
+	assert.Contains(t, string(b), "# TYPE foreverstore_replication_replicated_total counter")
+	assert.Contains(t, string(b), "# TYPE foreverstore_capacity_used_bytes gauge")
+	assert.Contains(t, string(b), "# TYPE foreverstore_fetches_coalesced_total counter")
+	assert.Contains(t, string(b), "# TYPE foreverstore_control_failed_total counter")
+	assert.Contains(t, string(b), "# TYPE foreverstore_cross_site_pending gauge")
+	assert.Contains(t, string(b), "# TYPE foreverstore_disk_read_only gauge")
+	assert.Contains(t, string(b), "# TYPE foreverstore_errors_total counter")
+	assert.Contains(t, string(b), "# TYPE foreverstore_peer_clock_skew_seconds gauge")
+}
+
+func TestHealthHandler(t *testing.T) {
+	server := createTestServer(":0", t.TempDir(), []string{})
+	a := admin.NewServer("127.0.0.1:0")
+	registerAdminHandlers(a, server)
+	srv := httptest.NewServer(a.Handler())
+	defer srv.Close()
+
+	health := func() (int, HealthResponse) {
+		resp, err := http.Get(srv.URL + "/health")
+		assert.Nil(t, err)
+		defer resp.Body.Close()
+		var h HealthResponse
+		assert.Nil(t, json.NewDecoder(resp.Body).Decode(&h))
+		return resp.StatusCode, h
+	}
+
+	code, h := health()
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, HealthOK, h.Status)
+
+	// A node with a full disk still serves reads.
+	setDiskSpace(server, 0)
+	server.checkDisk()
+	code, h = health()
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, HealthReadOnly, h.Status)
+
+	// A node shutting down sends the clients elsewhere.
+	server.ops.drain()
+	code, h = health()
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, HealthDraining, h.Status)
+}
+
+func TestObjectHandlersHTTPHeaders(t *testing.T) {
+	server := createTestServer(":0", t.TempDir(), []string{})
+	a := admin.NewServer("127.0.0.1:0")
+	registerAdminHandlers(a, server)
+	srv := httptest.NewServer(a.Handler())
+	defer srv.Close()
+
+	put := func(key, contentType, body string) {
+		req, _ := http.NewRequest(http.MethodPut, srv.URL+"/objects/"+key, bytes.NewReader([]byte(body)))
+		req.Header.Set("Authorization", "Bearer "+testAdminToken)
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	}
+	put("data.csv", "text/csv", "a,b\n1,2\n")
+	put("page", "", "<html><body>hi</body></html>")
+
+	resp, err := http.Get(srv.URL + "/objects/data.csv")
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, "text/csv", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "8", resp.Header.Get("Content-Length"))
+	etag := resp.Header.Get("ETag")
+	assert.NotEmpty(t, etag)
+	lastModified, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+	assert.Nil(t, err)
+	assert.WithinDuration(t, time.Now(), lastModified, time.Minute)
+
+	// Without a content type, it is detected from the content.
+	resp, err = http.Get(srv.URL + "/objects/page")
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, "text/html; charset=utf-8", resp.Header.Get("Content-Type"))
+	assert.NotEqual(t, etag, resp.Header.Get("ETag"))
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/objects/data.csv", nil)
+	req.Header.Set("If-None-Match", etag)
+	resp, err = http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+
+	req, _ = http.NewRequest(http.MethodHead, srv.URL+"/objects/data.csv", nil)
+	resp, err = http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Empty(t, b)
+	assert.Equal(t, int64(8), resp.ContentLength)
+
+	req, _ = http.NewRequest(http.MethodPut, srv.URL+"/objects/bad", bytes.NewReader(nil))
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	req.Header.Set("Content-Type", "not a type;;")
+	resp, err = http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestObjectHandlersServeTheClient(t *testing.T) {
+	server := createTestServer(":0", t.TempDir(), []string{})
+	a := admin.NewServer("127.0.0.1:0")
+	registerAdminHandlers(a, server)
+	srv := httptest.NewServer(a.Handler())
+	defer srv.Close()
+
+	c, err := client.New(client.Options{Endpoints: []string{srv.URL}, HealthCheckInterval: -1, Token: testAdminToken})
+	assert.Nil(t, err)
+	defer c.Close()
+	ctx := context.Background()
+
+	req, _ := http.NewRequest(http.MethodPut, srv.URL+"/objects/reports/q1.csv", bytes.NewReader([]byte("a,b\n")))
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	req.Header.Set("Content-Type", "text/csv")
+	req.Header.Set("X-Meta-Team", "finance")
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	resp.Body.Close()
+
+	info, err := c.Stat(ctx, "reports/q1.csv")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4), info.Size)
+	assert.Equal(t, "text/csv", info.ContentType)
+	assert.NotEmpty(t, info.ETag)
+	assert.Equal(t, map[string]string{"team": "finance"}, info.Attributes)
+
+	r, size, err := c.GetRange(ctx, "reports/q1.csv", 2, -1)
+	assert.Nil(t, err)
+	b, _ := io.ReadAll(r)
+	r.Close()
+	assert.Equal(t, "b\n", string(b))
+	assert.Equal(t, int64(4), size)
+
+	req, _ = http.NewRequest(http.MethodGet, srv.URL+"/objects/reports/q1.csv", nil)
+	req.Header.Set("Range", "bytes=1-2")
+	resp, err = http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	b, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, ",b", string(b))
+	assert.Equal(t, "bytes 1-2/4", resp.Header.Get("Content-Range"))
+	assert.Equal(t, "text/csv", resp.Header.Get("Content-Type"))
+	req.Header.Set("Range", "bytes=4-")
+	resp, err = http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, resp.StatusCode)
+
+	assert.Nil(t, c.Delete(ctx, "reports/q1.csv"))
+	_, err = c.Stat(ctx, "reports/q1.csv")
+	assert.NotNil(t, err)
+	err = c.Delete(ctx, "reports/q1.csv")
+	assert.True(t, errors.IsType(err, errors.FileNotFoundError), "got %v", err)
+}
+
+func TestChunkedHandler(t *testing.T) {
+	server := createTestServer(":0", t.TempDir(), []string{})
+	server.ChunkSize = 4
+	a := admin.NewServer("127.0.0.1:0")
+	registerAdminHandlers(a, server)
+	srv := httptest.NewServer(a.Handler())
+	defer srv.Close()
+
+	req, _ := http.NewRequest(http.MethodPut, srv.URL+"/chunked/docs/report", strings.NewReader("chunked content"))
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	var m Manifest
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&m))
+	resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Len(t, m.Chunks, 4)
+
+	resp, err = http.Get(srv.URL + "/chunked/docs/report?offset=8&length=3")
+	assert.Nil(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "con", string(body))
+
+	resp, err = http.Get(srv.URL + "/chunked/docs/report?offset=-1")
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
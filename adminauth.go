@@ -0,0 +1,50 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/anthdm/foreverstore/admin"
+	"github.com/anthdm/foreverstore/errors"
+)
+
+// adminOnly wraps the handler of an endpoint writing data or starting an
+// administrative operation so that only the requests presenting the admin
+// token as a bearer token are served. A node without an admin token
+// refuses them all.
+func (s *FileServer) adminOnly(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := s.checkAdminToken(r); err != nil {
+			admin.WriteError(w, err)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// adminWrites is adminOnly for the requests other than GET and HEAD, which
+// are served to everyone.
+func (s *FileServer) adminWrites(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			if err := s.checkAdminToken(r); err != nil {
+				admin.WriteError(w, err)
+				return
+			}
+		}
+		handler(w, r)
+	}
+}
+
+func (s *FileServer) checkAdminToken(r *http.Request) error {
+	if s.AdminToken == "" {
+		return errors.NewAuthorizationError("this node has no admin token configured")
+	}
+	auth := r.Header.Get("Authorization")
+	token := strings.TrimPrefix(auth, "Bearer ")
+	if token == auth || subtle.ConstantTimeCompare([]byte(token), []byte(s.AdminToken)) != 1 {
+		return errors.NewAuthenticationError("invalid admin token")
+	}
+	return nil
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/anthdm/foreverstore/errors"
+	"github.com/anthdm/foreverstore/p2p"
+)
+
+// Anti-entropy brings the replicas of the peers back in line with the
+// objects of this node, whatever they missed while down or unreachable.
+// The node sends every peer a digest of its objects, split in buckets by
+// replica key; the peer answers with the replicas it holds in the buckets
+// whose digest differs from its own, and is sent those it misses or holds
+// stale. Replicas the peer holds of objects deleted since are left to the
+// deletes resent to it as it reconnects.
+const (
+	// syncBuckets is the number of buckets objects are summarized in, by
+	// the first byte of their replica key.
+	syncBuckets = 256
+	// syncMaxEntries bounds the replicas a peer answers a digest with, for
+	// its answer to fit in a message. The buckets left out are compared
+	// again at the next pass.
+	syncMaxEntries = 5000
+	// syncTimeout bounds the wait for peers to summarize their replicas.
+	syncTimeout = 30 * time.Second
+)
+
+// MessageSyncDigest summarizes the objects of the namespace ID: Buckets
+// holds the digest of the objects of each bucket, nil for empty ones.
+type MessageSyncDigest struct {
+	ID      string
+	Buckets [][]byte
+}
+
+// MessageSyncEntries answers a MessageSyncDigest with the replicas the peer
+// holds in the Buckets whose digest differs from its own.
+type MessageSyncEntries struct {
+	Buckets []int
+	Entries []SyncEntry
+}
+
+// SyncEntry is an object summarized by anti-entropy: its replica key, and
+// the integrity tag of its content.
+type SyncEntry struct {
+	Key  string
+	HMAC []byte
+}
+
+// AntiEntropyStatus reports the last pass of anti-entropy.
+type AntiEntropyStatus struct {
+	LastRun time.Time `json:"last_run"`
+	// Objects counts the objects of this node summarized.
+	Objects int `json:"objects"`
+	// Peers are the peers that answered, by address.
+	Peers []PeerSyncStatus `json:"peers"`
+	// Sent counts the replicas sent to the peers.
+	Sent  int    `json:"sent"`
+	Error string `json:"error,omitempty"`
+	Partial
+}
+
+// PeerSyncStatus is the outcome of anti-entropy with a peer.
+type PeerSyncStatus struct {
+	Addr string `json:"addr"`
+	// Buckets counts the buckets whose digest differed, and Sent the
+	// replicas the peer was sent.
+	Buckets int    `json:"buckets"`
+	Sent    int    `json:"sent"`
+	Error   string `json:"error,omitempty"`
+}
+
+type antiEntropyState struct {
+	// run serializes the passes.
+	run    sync.Mutex
+	mu     sync.Mutex
+	status AntiEntropyStatus
+}
+
+// syncBucket returns the bucket of the object of replica key key.
+func syncBucket(key string) int {
+	if len(key) < 2 {
+		return 0
+	}
+	b, err := strconv.ParseUint(key[:2], 16, 8)
+	if err != nil {
+		return 0
+	}
+	return int(b)
+}
+
+// syncSummary is the objects of a namespace by bucket, ordered by replica
+// key.
+type syncSummary [syncBuckets][]SyncEntry
+
+// summarizeNamespace returns the objects of the namespace id that have an
+// integrity tag under their replica key, key hashed by replica for the
+// namespace of this node, and their keys by replica key.
+func (s *FileServer) summarizeNamespace(id string, replica func(key string) string) (*syncSummary, map[string]string, error) {
+	var summary syncSummary
+	keys := make(map[string]string)
+	for cursor := ""; ; {
+		entries, next, err := s.store.Iterate(id, "", cursor, repairPageSize)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, errors.StorageError, "failed to list objects")
+		}
+		for _, entry := range entries {
+			if entry.Key == "" {
+				continue
+			}
+			meta, err := s.store.ReadMeta(id, entry.Key)
+			if err != nil || len(meta.HMAC) == 0 {
+				continue
+			}
+			key := replica(entry.Key)
+			b := syncBucket(key)
+			summary[b] = append(summary[b], SyncEntry{Key: key, HMAC: meta.HMAC})
+			keys[key] = entry.Key
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	for _, entries := range summary {
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	}
+	return &summary, keys, nil
+}
+
+// digests returns the digest of each bucket of the summary.
+func (sum *syncSummary) digests() [][]byte {
+	digests := make([][]byte, syncBuckets)
+	for b, entries := range sum {
+		if len(entries) == 0 {
+			continue
+		}
+		h := sha256.New()
+		for _, e := range entries {
+			h.Write([]byte(e.Key))
+			h.Write(e.HMAC)
+		}
+		digests[b] = h.Sum(nil)
+	}
+	return digests
+}
+
+// answerSyncDigest returns the replicas of the objects of the peer this
+// node holds in the buckets whose digest differs from the peer's.
+func (s *FileServer) answerSyncDigest(msg MessageSyncDigest) (MessageSyncEntries, error) {
+	summary, _, err := s.summarizeNamespace(msg.ID, func(key string) string { return key })
+	if err != nil {
+		return MessageSyncEntries{}, err
+	}
+	var reply MessageSyncEntries
+	for b, digest := range summary.digests() {
+		var theirs []byte
+		if b < len(msg.Buckets) {
+			theirs = msg.Buckets[b]
+		}
+		if bytes.Equal(digest, theirs) {
+			continue
+		}
+		if len(reply.Entries)+len(summary[b]) > syncMaxEntries && len(reply.Buckets) > 0 {
+			break
+		}
+		reply.Buckets = append(reply.Buckets, b)
+		reply.Entries = append(reply.Entries, summary[b]...)
+	}
+	return reply, nil
+}
+
+// SyncReplicas runs a pass of anti-entropy: every peer is sent a digest of
+// the objects of this node, and then the replicas it misses or holds stale.
+// The peers that did not answer are reported, and left for the next pass.
+func (s *FileServer) SyncReplicas() (AntiEntropyStatus, error) {
+	s.antiEntropy.run.Lock()
+	defer s.antiEntropy.run.Unlock()
+
+	status := AntiEntropyStatus{LastRun: s.Clock.Now(), Peers: []PeerSyncStatus{}}
+	err := s.syncReplicas(&status)
+	if err != nil {
+		status.Error = err.Error()
+	}
+	s.antiEntropy.mu.Lock()
+	s.antiEntropy.status = status
+	s.antiEntropy.mu.Unlock()
+	return status, err
+}
+
+func (s *FileServer) syncReplicas(status *AntiEntropyStatus) error {
+	summary, keys, err := s.summarizeNamespace(s.ID, hashKey)
+	if err != nil {
+		return err
+	}
+	status.Objects = len(keys)
+
+	msg := MessageSyncDigest{ID: s.ID, Buckets: summary.digests()}
+	answers, errs := requestPeers[MessageSyncEntries](s, s.peerAddrs(), msg, syncTimeout)
+	status.Partial = partialAnswer(errs)
+
+	addrs := make([]string, 0, len(answers))
+	for addr := range answers {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	for _, addr := range addrs {
+		synced := s.syncPeer(addr, answers[addr], summary, keys)
+		status.Peers = append(status.Peers, synced)
+		status.Sent += synced.Sent
+	}
+	if status.Sent > 0 {
+		s.logger.Info("Anti-entropy sent %d replicas to %d peers", status.Sent, len(addrs))
+	}
+	return nil
+}
+
+// syncPeer sends the peer at addr the replicas of the buckets it answered
+// with that it misses or holds stale.
+func (s *FileServer) syncPeer(addr string, answer MessageSyncEntries, summary *syncSummary, keys map[string]string) PeerSyncStatus {
+	status := PeerSyncStatus{Addr: addr, Buckets: len(answer.Buckets)}
+	held := make(map[string][]byte, len(answer.Entries))
+	for _, e := range answer.Entries {
+		held[e.Key] = e.HMAC
+	}
+	for _, b := range answer.Buckets {
+		if b < 0 || b >= syncBuckets {
+			continue
+		}
+		for _, e := range summary[b] {
+			hmac, present := held[e.Key]
+			if present && bytes.Equal(hmac, e.HMAC) {
+				continue
+			}
+			key := keys[e.Key]
+			meta, err := s.store.ReadMeta(s.ID, key)
+			if err != nil {
+				continue
+			}
+			peer, ok := s.peer(addr)
+			if !ok {
+				status.Error = "peer disconnected"
+				return status
+			}
+			if _, placed := s.replicaPlacement(key, meta, map[string]p2p.Peer{addr: peer})[addr]; !placed {
+				continue
+			}
+			sent, err := s.pushCurrentReplica(addr, key, 1)
+			if err != nil {
+				s.logger.Warn("Anti-entropy failed to send replica of %s to %s: %v", key, addr, err)
+				status.Error = err.Error()
+				continue
+			}
+			if sent {
+				status.Sent++
+				if !present {
+					s.reserveReplica(addr, key, meta)
+				}
+			}
+		}
+	}
+	return status
+}
+
+// AntiEntropyStatus returns the outcome of the last pass of anti-entropy.
+func (s *FileServer) AntiEntropyStatus() AntiEntropyStatus {
+	s.antiEntropy.mu.Lock()
+	defer s.antiEntropy.mu.Unlock()
+	return s.antiEntropy.status
+}
+
+// antiEntropyLoop runs anti-entropy every AntiEntropyInterval until the
+// server stops.
+func (s *FileServer) antiEntropyLoop() {
+	ticker := s.Clock.NewTicker(s.AntiEntropyInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C():
+			if _, err := s.SyncReplicas(); err != nil {
+				s.logger.Warn("Anti-entropy failed: %v", err)
+			}
+		case <-s.quitch:
+			return
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAntiEntropySendsPeersTheReplicasTheyMiss(t *testing.T) {
+	c := newTestCluster(t, 3)
+	s := c.nodes[0]
+	for _, key := range []string{"a", "b", "c"} {
+		c.store(0, key, []byte("content of "+key))
+		c.assertConverged(0, key)
+	}
+
+	// Node 2 lost its replica of a, and node 1 holds a stale one of b.
+	assert.Nil(t, c.nodes[2].store.Delete(s.ID, hashKey("a")))
+	stale, err := c.nodes[1].store.ReadMeta(s.ID, hashKey("b"))
+	assert.Nil(t, err)
+	stale.HMAC = []byte("stale")
+	assert.Nil(t, c.nodes[1].store.WriteMeta(s.ID, hashKey("b"), stale))
+
+	var status AntiEntropyStatus
+	assert.Nil(t, c.run("anti-entropy", func() (err error) {
+		status, err = s.SyncReplicas()
+		return err
+	}))
+	assert.Equal(t, 3, status.Objects)
+	assert.Equal(t, 2, status.Sent)
+	assert.False(t, status.Partial.Partial)
+	if assert.Len(t, status.Peers, 2) {
+		assert.Equal(t, 1, status.Peers[0].Sent)
+		assert.Equal(t, 1, status.Peers[1].Sent)
+	}
+	c.eventually("replicas to be restored", func() bool {
+		meta, err := c.nodes[1].store.ReadMeta(s.ID, hashKey("b"))
+		return c.holds(2, 0, "a") && err == nil && !bytes.Equal(meta.HMAC, stale.HMAC)
+	})
+	assert.Equal(t, status, s.AntiEntropyStatus())
+
+	// Peers in line with the node are sent nothing.
+	assert.Nil(t, c.run("anti-entropy", func() (err error) {
+		status, err = s.SyncReplicas()
+		return err
+	}))
+	assert.Equal(t, 0, status.Sent)
+	for _, peer := range status.Peers {
+		assert.Equal(t, 0, peer.Buckets, peer.Addr)
+	}
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/anthdm/foreverstore/errors"
+	"github.com/anthdm/foreverstore/p2p"
+)
+
+// Batches move many small objects between nodes at the cost of one: a
+// batch of replicas is announced to a peer in a single message and sent in
+// a single stream, and a peer asked for a batch of objects answers with all
+// it holds of them in a single stream.
+
+// maxBatchObjects bounds the objects of a batch, whose announcement travels
+// in a single control message.
+const maxBatchObjects = 1000
+
+// KeyReader is an object of a batch: what is read from Reader is stored
+// under Key.
+type KeyReader struct {
+	Key    string
+	Reader io.Reader
+}
+
+// MessageStoreBatch announces the replicas streamed after it, one after the
+// other in a single stream. Each is checked and acknowledged as the replica
+// of a MessageStoreFile.
+type MessageStoreBatch struct {
+	Files []MessageStoreFile
+}
+
+// MessageGetBatch asks a peer for its replicas of the objects stored under
+// Keys in namespace ID. The peer answers with a single stream holding, for
+// each key in order, a byte set when it has the replica, followed by the
+// replica as answered to a MessageGetFile.
+type MessageGetBatch struct {
+	ID   string
+	Keys []string
+}
+
+// batchObject is an object of a batch stored locally, to be replicated.
+type batchObject struct {
+	key      string
+	meta     ObjectMeta
+	data     *bytes.Buffer
+	announce MessageStoreFile
+	send     *replicaSend
+}
+
+// StoreBatch stores the objects in order, and replicates them together: the
+// objects placed on the same peers are sent to them in one stream. Storing
+// stops at the first object that fails, those before it stored and
+// replicated.
+func (s *FileServer) StoreBatch(objects []KeyReader) (err error) {
+	defer func() { s.errorCounts.add("store_batch", err) }()
+	if err := s.beginOp(); err != nil {
+		return err
+	}
+	defer s.ops.end()
+
+	keys, err := batchKeys(objects)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := s.checkBucketPolicy(key); err != nil {
+			return err
+		}
+	}
+	if err := s.checkWritable(); err != nil {
+		return err
+	}
+
+	t := s.trace("store_batch", keys[0])
+	err = s.storeBatch(objects, keys, t)
+	t.done(err)
+	return err
+}
+
+func (s *FileServer) storeBatch(objects []KeyReader, keys []string, t *opTrace) error {
+	// The keys are locked in order, for concurrent batches not to deadlock.
+	start := t.now()
+	sorted := append([]string(nil), keys...)
+	sort.Strings(sorted)
+	for _, key := range sorted {
+		unlock := s.keyLocks.lock(key)
+		defer unlock()
+	}
+	t.since("lock_wait", start)
+
+	stored := make([]*batchObject, 0, len(objects))
+	var storeErr error
+	for _, obj := range objects {
+		meta, data, unchanged, err := s.storeLocal(obj.Key, obj.Reader, nil, nil, nil, t)
+		if err != nil {
+			storeErr = errors.Wrap(err, errors.GetType(err), "failed to store "+obj.Key)
+			break
+		}
+		if !unchanged {
+			stored = append(stored, &batchObject{key: obj.Key, meta: meta, data: data})
+		}
+	}
+
+	if err := s.replicateBatch(stored, t); err != nil {
+		return err
+	}
+	return storeErr
+}
+
+// batchKeys returns the keys of a batch, which must be distinct.
+func batchKeys(objects []KeyReader) ([]string, error) {
+	if len(objects) == 0 || len(objects) > maxBatchObjects {
+		return nil, errors.NewInvalidInputError(fmt.Sprintf("a batch holds 1 to %d objects", maxBatchObjects))
+	}
+	keys := make([]string, len(objects))
+	seen := make(map[string]bool, len(objects))
+	for i, obj := range objects {
+		if seen[obj.Key] {
+			return nil, errors.NewInvalidInputError("duplicate key in batch: " + obj.Key)
+		}
+		seen[obj.Key] = true
+		keys[i] = obj.Key
+	}
+	return keys, nil
+}
+
+// replicateBatch sends the replicas of the objects of a batch to the peers,
+// grouping the objects placed on the same peers.
+func (s *FileServer) replicateBatch(objects []*batchObject, t *opTrace) error {
+	var (
+		groups [][]*batchObject
+		peers  []map[string]p2p.Peer
+		index  = make(map[string]int)
+	)
+	for _, obj := range objects {
+		obj.announce = s.storeFileMessage(obj.key, obj.meta, int64(obj.data.Len()))
+		if s.crossSiteAsync() {
+			s.queueCrossSite(obj.key)
+		}
+		placed := s.placementPeers(obj.key, obj.announce.Size, s.syncReplica)
+		if len(placed) == 0 {
+			s.logger.Warn("No peers available for replication of %s", obj.key)
+			continue
+		}
+		addrs := make([]string, 0, len(placed))
+		for addr := range placed {
+			addrs = append(addrs, addr)
+		}
+		sort.Strings(addrs)
+		group := strings.Join(addrs, ",")
+		i, ok := index[group]
+		if !ok {
+			i = len(groups)
+			index[group] = i
+			groups = append(groups, nil)
+			peers = append(peers, placed)
+		}
+		groups[i] = append(groups[i], obj)
+	}
+
+	var lastErr error
+	for i, group := range groups {
+		if err := s.replicateGroup(group, peers[i], t); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// replicateGroup sends the peers the replicas of the objects, in a single
+// stream announced by a single MessageStoreBatch.
+func (s *FileServer) replicateGroup(objects []*batchObject, peers map[string]p2p.Peer, t *opTrace) error {
+	addrs := make([]string, 0, len(peers))
+	for addr := range peers {
+		addrs = append(addrs, addr)
+	}
+	var total int64
+	files := make([]MessageStoreFile, len(objects))
+	for i, obj := range objects {
+		obj.send = s.expectReplicas(obj.key, addrs, 1)
+		obj.announce.Replica = obj.send.id
+		files[i] = obj.announce
+		total += obj.announce.Size
+	}
+	keys := make([]string, len(objects))
+	for i, obj := range objects {
+		keys[i] = obj.key
+	}
+	jobs := s.startReplication(keys, addrs, total)
+	err := s.sendBatch(objects, files, peers, jobs, t)
+	s.finishReplication(jobs, err)
+	if err != nil {
+		return err
+	}
+	for _, obj := range objects {
+		if err := s.awaitWriteConsistency(obj.key, obj.send, t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *FileServer) sendBatch(objects []*batchObject, files []MessageStoreFile, peers map[string]p2p.Peer, jobs map[string]*replicationJob, t *opTrace) error {
+	addrs := make([]string, 0, len(peers))
+	for addr := range peers {
+		addrs = append(addrs, addr)
+	}
+	sent := 0
+	defer func() {
+		// The replicas not sent are settled as failed.
+		for _, obj := range objects[sent:] {
+			s.replicasSent(obj.send, errors.NewNetworkError("batch was not sent"))
+		}
+	}()
+
+	start := t.now()
+	unlock := s.lockPeers(addrs)
+	defer unlock()
+
+	msg := Message{Payload: MessageStoreBatch{Files: files}}
+	for addr, peer := range peers {
+		if err := s.writeMessage(peer, &msg); err != nil {
+			s.logger.Error("Failed to send store batch message to peer %s: %v", addr, err)
+		}
+	}
+	// Small delay to ensure peers are ready
+	s.Clock.Sleep(5 * time.Millisecond)
+	t.since("peer_announce", start)
+
+	var waited time.Duration
+	writers := make([]io.Writer, 0, len(peers))
+	for addr, peer := range peers {
+		writers = append(writers, t.timed(s.replication.writer(peer, jobs[addr]), peerPhase(addr), &waited))
+	}
+	for _, peer := range peers {
+		if err := peer.OpenStream(); err != nil {
+			return errors.Wrap(err, errors.NetworkError, "failed to send stream header")
+		}
+	}
+
+	start = t.now()
+	for _, obj := range objects {
+		mw := io.MultiWriter(append(writers, obj.send)...)
+		_, err := s.replicaEncryption(bucketOf(obj.key)).copy(obj.data, mw)
+		s.replicasSent(obj.send, err)
+		sent++
+		if err != nil {
+			return errors.Wrap(err, errors.EncryptionError, "failed to encrypt and send file data")
+		}
+	}
+	t.add("encrypt", t.now().Sub(start)-waited)
+
+	s.logger.Info("Batch of %d files replicated to %d peers", len(objects), len(peers))
+	return nil
+}
+
+func (s *FileServer) handleMessageStoreBatch(from string, msg MessageStoreBatch) error {
+	peer, ok := s.peer(from)
+	if !ok {
+		return errors.NewConnectionError(fmt.Sprintf("peer %s not found", from))
+	}
+	defer peer.CloseStream()
+
+	var lastErr error
+	for i, file := range msg.Files {
+		r := &io.LimitedReader{R: peer, N: file.Size}
+		if err := s.receiveReplica(peer, from, file, r); err != nil {
+			lastErr = err
+		}
+		// What is left of a replica that failed is skipped, for the next
+		// one to be read.
+		if _, err := io.Copy(io.Discard, r); err != nil || r.N > 0 {
+			lost := errors.NewNetworkError("store batch stream ended early")
+			for _, rest := range msg.Files[i+1:] {
+				if rest.Replica != 0 {
+					go s.ackReplica(peer, replicaStored(rest, 0, sha256.New(), lost))
+				}
+			}
+			return lost
+		}
+	}
+	return lastErr
+}
+
+// GetBatch returns readers of the objects stored under keys, in order. The
+// objects not held locally are fetched together: the peers are asked in
+// turn for those still missing, each answering with all it holds of them
+// in a single stream. It fails when an object is found nowhere.
+func (s *FileServer) GetBatch(keys []string) (_ []io.Reader, err error) {
+	defer func() { s.errorCounts.add("get_batch", err) }()
+	if err := s.beginOp(); err != nil {
+		return nil, err
+	}
+	defer s.ops.end()
+
+	if len(keys) == 0 || len(keys) > maxBatchObjects {
+		return nil, errors.NewInvalidInputError(fmt.Sprintf("a batch holds 1 to %d objects", maxBatchObjects))
+	}
+
+	t := s.trace("get_batch", keys[0])
+	readers, err := s.getBatch(keys, t)
+	t.done(err)
+	return readers, err
+}
+
+func (s *FileServer) getBatch(keys []string, t *opTrace) ([]io.Reader, error) {
+	var missing []string
+	seen := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		if !seen[key] && !s.store.Has(s.ID, key) {
+			missing = append(missing, key)
+		}
+		seen[key] = true
+	}
+	if len(missing) > 0 {
+		if err := s.fetchBatch(missing, t); err != nil {
+			return nil, err
+		}
+	}
+
+	readers := make([]io.Reader, 0, len(keys))
+	for _, key := range keys {
+		r, err := s.get(key, t)
+		if err != nil {
+			for _, r := range readers {
+				r.(io.Closer).Close()
+			}
+			return nil, err
+		}
+		readers = append(readers, s.files.track(r))
+	}
+	return readers, nil
+}
+
+// fetchBatch fetches the objects stored under keys from the peers, those
+// of this node's site first.
+func (s *FileServer) fetchBatch(keys []string, t *opTrace) error {
+	start := t.now()
+	s.fetchLock.Lock()
+	defer s.fetchLock.Unlock()
+	t.since("fetch_wait", start)
+
+	peers := s.connectedPeers()
+	if len(peers) == 0 {
+		return errors.NewNetworkError("no peers available for file retrieval")
+	}
+	missing := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		missing[key] = true
+	}
+
+	local, remote := s.sitePeers(peers)
+	for _, group := range []map[string]p2p.Peer{local, remote} {
+		addrs := make([]string, 0, len(group))
+		for addr := range group {
+			addrs = append(addrs, addr)
+		}
+		sort.Strings(addrs)
+		for _, addr := range addrs {
+			if len(missing) == 0 {
+				return nil
+			}
+			start := t.now()
+			err := s.requestBatchFrom(addr, group[addr], keys, missing)
+			t.since(fmt.Sprintf("receive[%s]", addr), start)
+			if err != nil {
+				s.logger.Warn("Failed to fetch batch from peer %s: %v", addr, err)
+			}
+		}
+	}
+	if len(missing) > 0 {
+		return errors.NewFileNotFoundError(fmt.Sprintf("%d of %d objects not found on any peer", len(missing), len(keys)))
+	}
+	return nil
+}
+
+// requestBatchFrom asks the peer at addr for the objects of keys still
+// missing, and stores those it answers with, removing them from missing.
+func (s *FileServer) requestBatchFrom(addr string, peer p2p.Peer, keys []string, missing map[string]bool) error {
+	var asked []string
+	hashed := make([]string, 0, len(missing))
+	for _, key := range keys {
+		if missing[key] {
+			asked = append(asked, key)
+			hashed = append(hashed, hashKey(key))
+		}
+	}
+	if err := s.sendMessage(peer, &Message{Payload: MessageGetBatch{ID: s.ID, Keys: hashed}}); err != nil {
+		return err
+	}
+	defer peer.CloseStream()
+
+	for _, key := range asked {
+		var found [1]byte
+		if _, err := io.ReadFull(peer, found[:]); err != nil {
+			return err
+		}
+		if found[0] == 0 {
+			continue
+		}
+		if err := s.readFetched(addr, peer, key, 0); err != nil {
+			return err
+		}
+		delete(missing, key)
+	}
+	return nil
+}
+
+func (s *FileServer) handleMessageGetBatch(from string, msg MessageGetBatch) error {
+	peer, ok := s.peer(from)
+	if !ok {
+		return errors.NewConnectionError(fmt.Sprintf("peer %s not found", from))
+	}
+	unlock := s.sendLocks.lock(from)
+	defer unlock()
+
+	// The stream is sent even when none of the objects is held, for the
+	// peer to move on at once.
+	if err := peer.OpenStream(); err != nil {
+		return errors.Wrap(err, errors.NetworkError, "failed to send stream header")
+	}
+	served := 0
+	for _, key := range msg.Keys {
+		ok, err := s.sendBatchObject(peer, from, msg.ID, key)
+		if err != nil {
+			return err
+		}
+		if ok {
+			served++
+		}
+	}
+	s.logger.Info("Served %d of %d files of a batch to peer %s", served, len(msg.Keys), from)
+	return nil
+}
+
+// sendBatchObject writes the entry of a MessageGetBatch answer for the
+// object stored under key in namespace id, and reports whether it held the
+// object.
+func (s *FileServer) sendBatchObject(peer p2p.Peer, addr, id, key string) (bool, error) {
+	var (
+		size int64
+		r    io.Reader
+		err  error
+	)
+	if s.store.Has(id, key) {
+		size, r, err = s.store.Read(id, key)
+	}
+	if r == nil || err != nil {
+		if _, err := peer.Write([]byte{0}); err != nil {
+			return false, errors.Wrap(err, errors.NetworkError, "failed to send batch entry")
+		}
+		return false, nil
+	}
+	defer r.(io.Closer).Close()
+
+	if _, err := peer.Write([]byte{1}); err != nil {
+		return true, errors.Wrap(err, errors.NetworkError, "failed to send batch entry")
+	}
+	return true, s.sendObject(peer, addr, id, key, size, r)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/anthdm/foreverstore/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBatchStoreAndGet(t *testing.T) {
+	c := newTestCluster(t, 3)
+	s := c.nodes[0]
+
+	objects := make([]KeyReader, 5)
+	for i := range objects {
+		key := fmt.Sprintf("small/%d", i)
+		objects[i] = KeyReader{Key: key, Reader: bytes.NewReader([]byte("content of " + key))}
+	}
+	assert.Nil(t, c.run("batch store", func() error { return s.StoreBatch(objects) }))
+	for _, obj := range objects {
+		c.assertConverged(0, obj.Key)
+	}
+
+	// The local copies are lost but one: the others come back from a peer
+	// in one batch.
+	keys := []string{"small/4", "small/0", "small/2", "small/0"}
+	for _, key := range []string{"small/0", "small/4"} {
+		assert.Nil(t, s.store.Delete(s.ID, key))
+	}
+	var readers []io.Reader
+	assert.Nil(t, c.run("batch get", func() (err error) {
+		readers, err = s.GetBatch(keys)
+		return err
+	}))
+	assert.Len(t, readers, len(keys))
+	for i, r := range readers {
+		b, err := io.ReadAll(r)
+		assert.Nil(t, err)
+		assert.Equal(t, "content of "+keys[i], string(b))
+		r.(io.Closer).Close()
+	}
+	assert.True(t, s.store.Has(s.ID, "small/0"))
+
+	err := c.run("batch get of a missing object", func() error {
+		_, err := s.GetBatch([]string{"small/1", "missing"})
+		return err
+	})
+	assert.Equal(t, errors.FileNotFoundError, errors.GetType(err))
+}
+
+func TestStoreBatchRejectsInvalidBatches(t *testing.T) {
+	c := newTestCluster(t, 1)
+	s := c.nodes[0]
+
+	err := s.StoreBatch(nil)
+	assert.Equal(t, errors.InvalidInputError, errors.GetType(err))
+	err = s.StoreBatch([]KeyReader{
+		{Key: "twice", Reader: bytes.NewReader([]byte("a"))},
+		{Key: "twice", Reader: bytes.NewReader([]byte("b"))},
+	})
+	assert.Equal(t, errors.InvalidInputError, errors.GetType(err))
+	assert.False(t, s.store.Has(s.ID, "twice"))
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/anthdm/foreverstore/config"
+	"github.com/anthdm/foreverstore/errors"
+)
+
+// The encryption of the replicas of an object follows the policy of its
+// bucket before the configuration of the node writing them: a bucket can
+// skip encryption for content that is public anyway, require an
+// authenticated cipher, or pin the key version its replicas are encrypted
+// with. Replicas read back detect their format from their data, so buckets
+// can change encryption without rewriting what they hold.
+
+// replicaEncryption is how the replicas of the objects of a bucket are
+// encrypted by this node.
+type replicaEncryption struct {
+	mode       string
+	suite      string
+	keyVersion uint32
+	key        []byte
+	// err is set when this node cannot encrypt the replicas of the bucket,
+	// lacking the key version its policy pins.
+	err error
+}
+
+// replicaEncryption returns how this node encrypts the replicas of the
+// objects of bucket.
+func (s *FileServer) replicaEncryption(bucket string) replicaEncryption {
+	policy := s.bucketPolicyOf(bucket)
+	if policy.Encryption == config.EncryptionNone {
+		return replicaEncryption{mode: EncryptionModeGCM, suite: CipherSuiteNone}
+	}
+	enc := replicaEncryption{mode: s.EncryptionMode, suite: s.CipherSuite}
+	if policy.EncryptionKeyVersion == nil {
+		enc.keyVersion, enc.key = s.keyRing.Current()
+		return enc
+	}
+	enc.keyVersion = *policy.EncryptionKeyVersion
+	key, err := s.keyRing.Lookup(enc.keyVersion)
+	if err != nil {
+		enc.err = errors.NewEncryptionError(fmt.Sprintf("bucket %s is encrypted with key version %d, which this node lacks", bucket, enc.keyVersion)).
+			WithContext("bucket", bucket)
+	}
+	enc.key = key
+	return enc
+}
+
+// cipher returns the identifier of the cipher the replicas are encrypted
+// with, as recorded in their metadata.
+func (e replicaEncryption) cipher() string {
+	if e.mode == EncryptionModeCTR {
+		return CipherLegacyCTR
+	}
+	return e.suite
+}
+
+// size returns the size of the replica of plaintextSize bytes of plaintext.
+func (e replicaEncryption) size(plaintextSize int64) int64 {
+	return encryptedSize(e.mode, e.suite, plaintextSize)
+}
+
+// copy encrypts src into dst.
+func (e replicaEncryption) copy(src io.Reader, dst io.Writer) (int64, error) {
+	if e.err != nil {
+		return 0, e.err
+	}
+	return copyEncryptMode(e.mode, e.suite, e.keyVersion, e.key, src, dst)
+}
+
+// checkReplicaEncryption refuses the replica announced by msg when the
+// policy of its bucket requires an authenticated cipher it is not
+// encrypted with.
+func (s *FileServer) checkReplicaEncryption(msg MessageStoreFile) error {
+	if msg.Bucket == "" || !s.bucketPolicyOf(msg.Bucket).RequiresEncryption() {
+		return nil
+	}
+	switch msg.Cipher {
+	case CipherSuiteNone, CipherLegacyCTR:
+		return errors.NewValidationError(fmt.Sprintf("bucket %s requires authenticated encryption, the replica is encrypted with %s", msg.Bucket, msg.Cipher)).
+			WithContext("key", msg.Key)
+	}
+	return nil
+}
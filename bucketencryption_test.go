@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/anthdm/foreverstore/config"
+	"github.com/anthdm/foreverstore/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBucketEncryption(t *testing.T) {
+	c := newTestCluster(t, 3)
+	s := c.nodes[0]
+	setPolicy := func(p config.BucketPolicy) {
+		t.Helper()
+		assert.Nil(t, c.run("policy to be distributed", func() error { return s.SetBucketPolicy(p) }))
+		c.eventually("every node to follow the policy", func() bool {
+			for _, node := range c.nodes {
+				if !assert.ObjectsAreEqual(p, node.bucketPolicy(p.Bucket+"/")) {
+					return false
+				}
+			}
+			return true
+		})
+	}
+
+	// Replicas of a bucket without encryption are stored in the clear,
+	// those of other buckets still encrypted.
+	setPolicy(config.BucketPolicy{Bucket: "public", Encryption: config.EncryptionNone})
+	c.store(0, "public/logo", []byte("a logo"))
+	c.store(0, "media/cat", []byte("a picture"))
+	c.assertConverged(0, "public/logo")
+	c.assertConverged(0, "media/cat")
+	meta, err := c.nodes[1].store.ReadMeta(s.ID, hashKey("public/logo"))
+	assert.Nil(t, err)
+	assert.Equal(t, CipherSuiteNone, meta.Cipher)
+	assert.Equal(t, "public", meta.Bucket)
+	meta, err = c.nodes[1].store.ReadMeta(s.ID, hashKey("media/cat"))
+	assert.Nil(t, err)
+	assert.Equal(t, s.CipherSuite, meta.Cipher)
+
+	// The owner restores a lost copy from the replicas in the clear.
+	assert.Nil(t, s.store.Delete(s.ID, "public/logo"))
+	assert.Equal(t, []byte("a logo"), c.get(0, "public/logo"))
+
+	// A bucket pinned to a key version the nodes lack cannot be written.
+	version := uint32(7)
+	setPolicy(config.BucketPolicy{Bucket: "vault", EncryptionKeyVersion: &version})
+	err = s.Store("vault/key", bytes.NewReader([]byte("s3cr3t")))
+	assert.Equal(t, errors.EncryptionError, errors.GetType(err))
+
+	// A bucket requiring encryption takes no writes, nor replicas, that
+	// are not encrypted with an authenticated cipher.
+	setPolicy(config.BucketPolicy{Bucket: "secrets", Encryption: config.EncryptionRequired})
+	c.store(0, "secrets/key", []byte("s3cr3t"))
+	c.assertConverged(0, "secrets/key")
+	plain := c.nodes[2]
+	plain.CipherSuite = CipherSuiteNone
+	err = plain.Store("secrets/other", bytes.NewReader([]byte("s3cr3t")))
+	assert.Equal(t, errors.ValidationError, errors.GetType(err))
+	for _, cipher := range []string{CipherSuiteNone, CipherLegacyCTR} {
+		err = s.checkReplicaEncryption(MessageStoreFile{Key: hashKey("secrets/other"), Bucket: "secrets", Cipher: cipher})
+		assert.Equal(t, errors.ValidationError, errors.GetType(err), cipher)
+	}
+	assert.Nil(t, s.checkReplicaEncryption(MessageStoreFile{Bucket: "secrets", Cipher: CipherSuiteAESGCM}))
+	assert.Nil(t, s.checkReplicaEncryption(MessageStoreFile{Bucket: "public", Cipher: CipherSuiteNone}))
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/anthdm/foreverstore/config"
+	"github.com/anthdm/foreverstore/errors"
+	"github.com/anthdm/foreverstore/ring"
+)
+
+// Bucket policies override the cluster defaults for the objects of a
+// bucket (see config.BucketPolicy). They are cluster settings: a policy set
+// on one node is distributed to every member, and placement, replication,
+// repair and rebalancing all go by the policies the node follows.
+
+// ListBucketPolicies returns the bucket policies the node follows, ordered
+// by bucket.
+func (s *FileServer) ListBucketPolicies() []config.BucketPolicy {
+	s.settingsLock.RLock()
+	defer s.settingsLock.RUnlock()
+	policies := make([]config.BucketPolicy, 0, len(s.BucketPolicies))
+	for _, p := range s.BucketPolicies {
+		if !p.IsZero() {
+			policies = append(policies, p)
+		}
+	}
+	sort.Slice(policies, func(i, j int) bool { return policies[i].Bucket < policies[j].Bucket })
+	return policies
+}
+
+// bucketPolicy returns the policy of the bucket of key, the zero policy for
+// buckets without one.
+func (s *FileServer) bucketPolicy(key string) config.BucketPolicy {
+	return s.bucketPolicyOf(bucketOf(key))
+}
+
+// bucketPolicyOf returns the policy of bucket, likewise. A policy without
+// a replication factor of its own gets the one of the cluster settings.
+func (s *FileServer) bucketPolicyOf(bucket string) config.BucketPolicy {
+	s.settingsLock.RLock()
+	defer s.settingsLock.RUnlock()
+	policy := config.BucketPolicy{Bucket: bucket}
+	if bucket != "" {
+		for _, p := range s.BucketPolicies {
+			if p.Bucket == bucket {
+				policy = p
+				break
+			}
+		}
+	}
+	if policy.ReplicationFactor == 0 && s.Config != nil {
+		policy.ReplicationFactor = s.Config.ReplicationFactor
+	}
+	return policy
+}
+
+// SetBucketPolicy distributes p to the cluster as the policy of its bucket.
+// A policy overriding nothing removes the one of the bucket.
+func (s *FileServer) SetBucketPolicy(p config.BucketPolicy) error {
+	if err := config.ValidateBucketPolicies([]config.BucketPolicy{p}); err != nil {
+		return errors.Wrap(err, errors.ValidationError, "invalid bucket policy")
+	}
+
+	// The policy removing the last one is kept in the settings: the
+	// members only replace their policies with a set that is not empty.
+	policies := []config.BucketPolicy{p}
+	for _, other := range s.ListBucketPolicies() {
+		if other.Bucket != p.Bucket {
+			policies = append(policies, other)
+		}
+	}
+	cs := s.ClusterSettings()
+	cs.BucketPolicies = policies
+	return s.DistributeSettings(cs)
+}
+
+// checkBucketPolicy checks that this node may write the object stored under
+// key as the policy of its bucket requires.
+func (s *FileServer) checkBucketPolicy(key string) error {
+	policy := s.bucketPolicy(key)
+	enc := s.replicaEncryption(policy.Bucket)
+	if enc.err != nil {
+		return enc.err
+	}
+	if !policy.RequiresEncryption() {
+		return nil
+	}
+	switch cipher := enc.cipher(); cipher {
+	case CipherSuiteNone, CipherLegacyCTR:
+		return errors.NewValidationError(fmt.Sprintf("bucket %s requires authenticated encryption, this node writes replicas with %s", policy.Bucket, cipher)).
+			WithContext("key", key)
+	}
+	return nil
+}
+
+// placementRing is the consistent hash ring (see package ring) over the IDs
+// of this node and its peers, built again when they change.
+type placementRing struct {
+	mu   sync.Mutex
+	ids  string
+	ring *ring.Ring
+}
+
+// get returns the ring over ids, sorted.
+func (p *placementRing) get(ids []string) *ring.Ring {
+	key := strings.Join(ids, "\x00")
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.ring == nil || p.ids != key {
+		p.ring = ring.New(ring.DefaultVirtualNodes, ids...)
+		p.ids = key
+	}
+	return p.ring
+}
+
+// rankPeers orders the peers at addrs by the preference of key for them,
+// so that every node picks the same peers for the replicas of an object:
+// the order in which the hash ring of the cluster, this node included,
+// reaches them from the key. Peers are placed by their node ID, or by
+// their address until they introduced themselves.
+func (s *FileServer) rankPeers(key string, addrs []string) {
+	ids := make([]string, 0, len(addrs)+1)
+	ids = append(ids, s.ID)
+	idOf := make(map[string]string, len(addrs))
+	for _, addr := range addrs {
+		id := s.conns.id(addr)
+		if id == "" {
+			id = addr
+		}
+		idOf[addr] = id
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	rank := make(map[string]int, len(ids))
+	for i, id := range s.placement.get(ids).Owners(key, 0) {
+		rank[id] = i
+	}
+	sort.Slice(addrs, func(i, j int) bool {
+		ri, rj := rank[idOf[addrs[i]]], rank[idOf[addrs[j]]]
+		if ri != rj {
+			return ri < rj
+		}
+		return addrs[i] < addrs[j]
+	})
+}
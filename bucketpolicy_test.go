@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/anthdm/foreverstore/config"
+	"github.com/anthdm/foreverstore/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBucketPolicies(t *testing.T) {
+	c := newSiteCluster(t, CrossSiteSync, "east", "east", "west", "west")
+	s := c.nodes[0]
+	setPolicy := func(p config.BucketPolicy) {
+		t.Helper()
+		assert.Nil(t, c.run("policy to be distributed", func() error { return s.SetBucketPolicy(p) }))
+		c.eventually("every node to follow the policy", func() bool {
+			for _, node := range c.nodes {
+				if !assert.ObjectsAreEqual(p, node.bucketPolicy(p.Bucket+"/")) {
+					return false
+				}
+			}
+			return true
+		})
+	}
+	holders := func(key string) []int {
+		var nodes []int
+		for node := 1; node < len(c.nodes); node++ {
+			if c.holds(node, 0, key) {
+				nodes = append(nodes, node)
+			}
+		}
+		return nodes
+	}
+
+	// A replication factor of 2 keeps one replica, on the same peer
+	// whichever node places it; other buckets still go to every peer.
+	setPolicy(config.BucketPolicy{Bucket: "logs", ReplicationFactor: 2})
+	assert.Equal(t, []config.BucketPolicy{{Bucket: "logs", ReplicationFactor: 2}}, c.nodes[3].ListBucketPolicies())
+	c.store(0, "logs/today", []byte("a few lines"))
+	c.store(0, "media/cat", []byte("a picture"))
+	c.assertConverged(0, "media/cat")
+	replicas := holders("logs/today")
+	assert.Len(t, replicas, 1)
+
+	// Repair restores the replica of the peer the policy places it on, and
+	// leaves the other peers without one.
+	holder := c.nodes[replicas[0]]
+	assert.Nil(t, holder.store.Delete(s.ID, hashKey("logs/today")))
+	var report RepairReport
+	assert.Nil(t, c.run("repair", func() (err error) {
+		report, err = s.Repair("logs/today")
+		return err
+	}))
+	assert.Equal(t, []string{holder.Transport.Addr()}, report.Repaired)
+	assert.Equal(t, replicas, holders("logs/today"))
+
+	// Sites restrict the replicas to the peers of those sites.
+	setPolicy(config.BucketPolicy{Bucket: "eu", Sites: []string{"west"}})
+	c.store(0, "eu/customers", []byte("names"))
+	assert.Equal(t, []int{2, 3}, holders("eu/customers"))
+
+	// Nodes whose replicas would not be encrypted cannot write to a bucket
+	// requiring it.
+	setPolicy(config.BucketPolicy{Bucket: "secrets", RequireEncryption: true})
+	c.store(0, "secrets/key", []byte("s3cr3t"))
+	plain := c.nodes[3]
+	plain.CipherSuite = CipherSuiteNone
+	err := plain.Store("secrets/other", bytes.NewReader([]byte("s3cr3t")))
+	assert.Equal(t, errors.ValidationError, errors.GetType(err))
+	assert.Nil(t, c.run("store", func() error { return plain.Store("media/dog", bytes.NewReader([]byte("woof"))) }))
+
+	// A policy overriding nothing removes the one of its bucket.
+	setPolicy(config.BucketPolicy{Bucket: "logs"})
+	for i, node := range c.nodes {
+		assert.Len(t, node.ListBucketPolicies(), 2, fmt.Sprintf("node %d", i))
+	}
+	c.store(0, "logs/tomorrow", []byte("more lines"))
+	c.assertConverged(0, "logs/tomorrow")
+}
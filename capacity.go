@@ -0,0 +1,288 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/anthdm/foreverstore/errors"
+	"github.com/anthdm/foreverstore/p2p"
+)
+
+// capacityStaleIntervals is how many gossip intervals a peer's capacity
+// report is trusted for. Placement ignores older reports rather than keep
+// avoiding a peer that may have freed space since.
+const capacityStaleIntervals = 3
+
+// MessageCapacity gossips the disk usage of a node to its peers.
+type MessageCapacity struct {
+	ID   string
+	Used int64
+	// Limit is the storage the node may use; zero means it has no limit.
+	Limit int64
+	// Buckets holds the bytes of the objects the node owns, by bucket.
+	Buckets map[string]int64
+	// Site is the site the node runs in.
+	Site string
+	// SentAt is when the report was sent, by the clock of the node, for
+	// its peers to estimate how far off their clocks are.
+	SentAt time.Time
+}
+
+// NodeCapacity is the disk usage of one node of the cluster.
+type NodeCapacity struct {
+	Node string `json:"node"`
+	ID   string `json:"id"`
+	Site string `json:"site,omitempty"`
+	Used int64  `json:"used_bytes"`
+	// Limit is the storage the node may use, and Headroom what is left of
+	// it. Both are zero for nodes without a limit.
+	Limit      int64     `json:"limit_bytes"`
+	Headroom   int64     `json:"headroom_bytes"`
+	ReportedAt time.Time `json:"reported_at"`
+	// Buckets holds the bytes of the objects the node owns, by bucket.
+	Buckets map[string]int64 `json:"buckets,omitempty"`
+	// Stale is set when the node has not reported its usage for a while, so
+	// the figures may be out of date.
+	Stale bool `json:"stale,omitempty"`
+}
+
+// ClusterCapacity is the disk usage of the cluster, as gossiped by its
+// nodes.
+type ClusterCapacity struct {
+	Nodes []NodeCapacity `json:"nodes"`
+	// Used is the usage of all nodes; Limit and Headroom add up those of the
+	// nodes with a limit.
+	Used     int64 `json:"used_bytes"`
+	Limit    int64 `json:"limit_bytes"`
+	Headroom int64 `json:"headroom_bytes"`
+}
+
+func nodeCapacity(node string, report MessageCapacity, reportedAt time.Time) NodeCapacity {
+	c := NodeCapacity{
+		Node:       node,
+		ID:         report.ID,
+		Site:       report.Site,
+		Used:       report.Used,
+		Limit:      report.Limit,
+		ReportedAt: reportedAt,
+		Buckets:    report.Buckets,
+	}
+	if c.Limit > c.Used {
+		c.Headroom = c.Limit - c.Used
+	}
+	return c
+}
+
+// capacityTracker keeps the last capacity report of each peer.
+type capacityTracker struct {
+	mu    sync.Mutex
+	peers map[string]NodeCapacity
+}
+
+func (t *capacityTracker) update(addr string, report MessageCapacity, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.peers == nil {
+		t.peers = make(map[string]NodeCapacity)
+	}
+	t.peers[addr] = nodeCapacity(addr, report, now)
+}
+
+// forget drops the last report of the peer at addr.
+func (t *capacityTracker) forget(addr string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.peers, addr)
+}
+
+// seed records the capacity a peer introduced itself with, unless it
+// reported its capacity already.
+func (t *capacityTracker) seed(addr string, report MessageCapacity, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.peers == nil {
+		t.peers = make(map[string]NodeCapacity)
+	}
+	if _, ok := t.peers[addr]; !ok {
+		t.peers[addr] = nodeCapacity(addr, report, now)
+	}
+}
+
+// hasRoom reports whether the peer at addr has room for size more bytes.
+// Peers without a limit, or without a recent report, are assumed to have
+// room.
+func (t *capacityTracker) hasRoom(addr string, size int64, now time.Time, staleAfter time.Duration) (NodeCapacity, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	c, ok := t.peers[addr]
+	if !ok || c.Limit == 0 || now.Sub(c.ReportedAt) > staleAfter {
+		return c, true
+	}
+	return c, c.Used+size <= c.Limit
+}
+
+// reserve counts size bytes sent to the peer at addr against its usage
+// until its next report.
+func (t *capacityTracker) reserve(addr string, size int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	c, ok := t.peers[addr]
+	if !ok || c.Limit == 0 {
+		return
+	}
+	c.Used += size
+	c.Headroom -= size
+	t.peers[addr] = c
+}
+
+// storageLimit returns the storage this node may use, zero when it has no
+// limit. The limit follows the cluster settings.
+func (s *FileServer) storageLimit() int64 {
+	if s.Config == nil {
+		return 0
+	}
+	s.settingsLock.RLock()
+	defer s.settingsLock.RUnlock()
+	return s.Config.MaxStorageSize
+}
+
+// measureCapacity measures the disk usage of this node, in all and by
+// bucket.
+func (s *FileServer) measureCapacity() (MessageCapacity, error) {
+	used, err := s.store.Usage()
+	if err != nil {
+		return MessageCapacity{}, errors.Wrap(err, errors.StorageError, "failed to measure disk usage")
+	}
+	buckets, err := s.measureBucketUsage()
+	if err != nil {
+		return MessageCapacity{}, err
+	}
+	return MessageCapacity{ID: s.ID, Used: used, Limit: s.storageLimit(), Buckets: buckets, Site: s.Site}, nil
+}
+
+// gossipCapacity measures the disk usage of this node and sends it to all
+// peers.
+func (s *FileServer) gossipCapacity() error {
+	report, err := s.measureCapacity()
+	if err != nil {
+		return err
+	}
+	if report.Limit > 0 && report.Used >= report.Limit {
+		s.logger.Warn("Storage is full: %d of %d bytes used", report.Used, report.Limit)
+	}
+	report.SentAt = s.Clock.Now()
+	return s.broadcast(&Message{Payload: report})
+}
+
+// capacityLoop gossips the disk usage of this node every CapacityInterval
+// until the server stops.
+func (s *FileServer) capacityLoop() {
+	ticker := s.Clock.NewTicker(s.CapacityInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C():
+			if err := s.gossipCapacity(); err != nil {
+				s.logger.Warn("Capacity gossip failed: %v", err)
+			}
+		case <-s.quitch:
+			return
+		}
+	}
+}
+
+func (s *FileServer) handleMessageCapacity(from string, msg MessageCapacity) error {
+	s.capacity.update(from, msg, s.Clock.Now())
+	s.observeClock(from, msg.SentAt)
+	return nil
+}
+
+// placementPeers returns the peers a replica of key, size bytes long on the
+// wire, is placed on: its ring owners, as many as the replication factor of
+// the bucket of key requires (see bucketPolicyOf), which are the first
+// peers with room in the order of the key (see rankPeers), whatever want,
+// so that every caller agrees on them. Only those for which want holds are
+// returned. The policy can restrict the replicas to the peers of some
+// sites. Without a replication factor, as on a server built without a
+// configuration, every connected peer for which want holds is, except
+// those whose last capacity report leaves no room for it.
+//
+// The replica is about to be sent to the peers returned: its size is
+// counted against their usage until their next capacity report.
+func (s *FileServer) placementPeers(key string, size int64, want func(addr string) bool) map[string]p2p.Peer {
+	peers := s.placementOf(key, size, want)
+	for addr := range peers {
+		s.capacity.reserve(addr, size)
+	}
+	return peers
+}
+
+// placementOf is placementPeers for the callers that only look up where the
+// replica goes: it reserves no room on the peers.
+func (s *FileServer) placementOf(key string, size int64, want func(addr string) bool) map[string]p2p.Peer {
+	now := s.Clock.Now()
+	staleAfter := capacityStaleIntervals * s.CapacityInterval
+	policy := s.bucketPolicy(key)
+	capped := policy.ReplicationFactor > 0
+
+	connected := s.peers.snapshot()
+	addrs := make([]string, 0, len(connected))
+	for addr := range connected {
+		addrs = append(addrs, addr)
+	}
+	if capped {
+		s.rankPeers(key, addrs)
+	}
+
+	peers := make(map[string]p2p.Peer, len(addrs))
+	placed := 0
+	for _, addr := range addrs {
+		if capped && placed == policy.ReplicationFactor-1 {
+			break
+		}
+		if !policy.AllowsSite(s.peerSite(addr)) || !capped && !want(addr) {
+			continue
+		}
+		if c, ok := s.capacity.hasRoom(addr, size, now, staleAfter); !ok {
+			s.logger.Warn("Not replicating %s to %s: no room for %d bytes (%d of %d used)",
+				key, addr, size, c.Used, c.Limit)
+			continue
+		}
+		placed++
+		if !capped || want(addr) {
+			peers[addr] = connected[addr]
+		}
+	}
+	return peers
+}
+
+// ClusterCapacity returns the disk usage of this node, measured now, and of
+// every peer as last gossiped, ordered by node address.
+func (s *FileServer) ClusterCapacity() (ClusterCapacity, error) {
+	report, err := s.measureCapacity()
+	if err != nil {
+		return ClusterCapacity{}, err
+	}
+	now := s.Clock.Now()
+	staleAfter := capacityStaleIntervals * s.CapacityInterval
+
+	cc := ClusterCapacity{Nodes: []NodeCapacity{nodeCapacity(s.advertiseAddr(), report, now)}}
+	s.capacity.mu.Lock()
+	for _, c := range s.capacity.peers {
+		c.Stale = now.Sub(c.ReportedAt) > staleAfter
+		cc.Nodes = append(cc.Nodes, c)
+	}
+	s.capacity.mu.Unlock()
+
+	sort.Slice(cc.Nodes, func(i, j int) bool { return cc.Nodes[i].Node < cc.Nodes[j].Node })
+	for _, c := range cc.Nodes {
+		cc.Used += c.Used
+		cc.Limit += c.Limit
+		cc.Headroom += c.Headroom
+	}
+	return cc, nil
+}
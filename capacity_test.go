@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/anthdm/foreverstore/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCapacityGossipSteersPlacement(t *testing.T) {
+	c := newTestClusterWith(t, 3, func(node int, opts *FileServerOpts) {
+		opts.CapacityInterval = 100 * time.Millisecond
+		if node == 2 {
+			opts.Config = config.DefaultConfig()
+			opts.Config.MaxStorageSize = 512
+		}
+	})
+	s := c.nodes[0]
+	full := c.nodes[2].Transport.Addr()
+
+	var cc ClusterCapacity
+	c.eventually("capacity to be gossiped", func() bool {
+		var err error
+		cc, err = s.ClusterCapacity()
+		return err == nil && len(cc.Nodes) == 3 && cc.Limit == 512
+	})
+	assert.Equal(t, full, cc.Nodes[2].Node)
+	assert.Equal(t, c.nodes[2].ID, cc.Nodes[2].ID)
+	assert.Equal(t, cc.Nodes[2].Limit-cc.Nodes[2].Used, cc.Headroom)
+	assert.False(t, cc.Nodes[2].Stale)
+
+	// The replica does not fit on node 2, so only node 1 gets it.
+	c.store(0, "big", bytes.Repeat([]byte("x"), 1024))
+	c.eventually("replica to reach node 1", func() bool {
+		return c.holds(1, 0, "big")
+	})
+	assert.False(t, c.holds(2, 0, "big"))
+
+	c.store(0, "small", []byte("fits"))
+	c.assertConverged(0, "small")
+
+	cc, err := s.ClusterCapacity()
+	assert.Nil(t, err)
+	assert.Greater(t, cc.Nodes[0].Used, int64(1024))
+	assert.Equal(t, cc.Nodes[0].Used+cc.Nodes[1].Used+cc.Nodes[2].Used, cc.Used)
+}
+
+func TestPlacementReservesRoomOnlyOnPeersSentTo(t *testing.T) {
+	c := newTestClusterWith(t, 3, func(node int, opts *FileServerOpts) {
+		opts.BucketPolicies = []config.BucketPolicy{{Bucket: "docs", ReplicationFactor: 3}}
+	})
+	s := c.nodes[0]
+	sent, skipped := c.nodes[1].Transport.Addr(), c.nodes[2].Transport.Addr()
+	for _, addr := range []string{sent, skipped} {
+		s.capacity.update(addr, MessageCapacity{Limit: 1000}, c.clock.Now())
+	}
+	used := func(addr string) int64 {
+		c, _ := s.capacity.hasRoom(addr, 0, s.Clock.Now(), time.Hour)
+		return c.Used
+	}
+
+	// Looking up the placement reserves nothing.
+	for i := 0; i < 3; i++ {
+		assert.Len(t, s.placementOf("docs/a", 400, func(string) bool { return true }), 2)
+	}
+	assert.Zero(t, used(sent))
+	assert.Zero(t, used(skipped))
+
+	// Only the peer the replica is sent to has it counted.
+	peers := s.placementPeers("docs/a", 400, func(addr string) bool { return addr == sent })
+	assert.Len(t, peers, 1)
+	assert.Contains(t, peers, sent)
+	assert.Equal(t, int64(400), used(sent))
+	assert.Zero(t, used(skipped))
+}
+
+func TestReadOnlyPlacementQueriesReserveNothing(t *testing.T) {
+	c := newTestClusterWith(t, 3, func(node int, opts *FileServerOpts) {
+		opts.BucketPolicies = []config.BucketPolicy{{Bucket: "docs", ReplicationFactor: 2}}
+	})
+	s := c.nodes[0]
+	c.store(0, "docs/a", []byte("placed on one peer"))
+	for _, peer := range c.nodes[1:] {
+		s.capacity.update(peer.Transport.Addr(), MessageCapacity{Limit: 1 << 20}, c.clock.Now())
+	}
+	used := func() (n int64) {
+		for _, peer := range c.nodes[1:] {
+			c, _ := s.capacity.hasRoom(peer.Transport.Addr(), 0, s.Clock.Now(), time.Hour)
+			n += c.Used
+		}
+		return n
+	}
+
+	meta, err := s.store.ReadMeta(s.ID, "docs/a")
+	assert.Nil(t, err)
+	for i := 0; i < 3; i++ {
+		assert.Len(t, s.replicaPlacement("docs/a", meta, s.connectedPeers()), 1)
+		for _, peer := range c.nodes[1:] {
+			s.placedOn(peer.Transport.Addr())
+		}
+		assert.Nil(t, c.run("consistency check", func() error {
+			_, err := s.CheckConsistency("docs/a")
+			return err
+		}))
+	}
+	assert.Zero(t, used())
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anthdm/foreverstore/errors"
+)
+
+// The change feed records every change to the objects of the node, in
+// order, for readers to tail from a cursor: followers, caches to
+// invalidate, external indexes. It is kept in a file of the storage root,
+// one change per line, so that sequence numbers survive restarts.
+
+// changeFeedFileName is the file of the storage root the change feed is
+// kept in.
+const changeFeedFileName = ".changes"
+
+// changeRetention is the number of most recent changes the feed keeps.
+// Readers further behind have missed changes and must resync from a
+// listing of the objects. The file is compacted once it holds twice as
+// many.
+const changeRetention = 10000
+
+// ChangeOp is the kind of a change to an object.
+type ChangeOp string
+
+const (
+	ChangePut    ChangeOp = "put"
+	ChangeDelete ChangeOp = "delete"
+)
+
+// Change is an entry of the change feed.
+type Change struct {
+	// Seq numbers the changes of the node in the order they were made,
+	// from 1.
+	Seq uint64   `json:"seq"`
+	Key string   `json:"key"`
+	Op  ChangeOp `json:"op"`
+	// Hash is the ETag the object is served with once put, empty for
+	// deletes.
+	Hash string    `json:"hash,omitempty"`
+	At   time.Time `json:"at"`
+}
+
+// ChangeList is a page of the change feed. Cursor is passed as the cursor
+// to get the changes after the page, and stays the one asked for when
+// there are none yet.
+type ChangeList struct {
+	Changes []Change `json:"changes"`
+	Cursor  uint64   `json:"cursor"`
+	// Last is the sequence number of the last change of the node.
+	Last uint64 `json:"last"`
+	// Reset is set when the changes after the cursor asked for are no
+	// longer kept: the reader must resync from a listing of the objects,
+	// then tail the feed from Cursor.
+	Reset bool `json:"reset,omitempty"`
+}
+
+type changeFeed struct {
+	mu     sync.Mutex
+	loaded bool
+	// changes holds the last changeRetention changes, of consecutive
+	// sequence numbers; seq is the last one.
+	changes []Change
+	seq     uint64
+	// lines counts the changes in the file.
+	lines int
+	// changed is closed, and replaced, on every change.
+	changed chan struct{}
+}
+
+// changeFeedPath is the path of the file the change feed is kept in.
+func (s *FileServer) changeFeedPath() string {
+	return filepath.Join(s.store.Root, changeFeedFileName)
+}
+
+// loadChanges reads the change feed from its file on first use. The
+// caller holds the lock of the feed.
+func (s *FileServer) loadChanges() {
+	f := &s.changes
+	if f.loaded {
+		return
+	}
+	f.loaded = true
+	f.changed = make(chan struct{})
+
+	b, err := os.ReadFile(s.changeFeedPath())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			s.logger.Warn("Failed to read the change feed: %v", err)
+		}
+		return
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		var c Change
+		// A line cut short by a crash is skipped.
+		if json.Unmarshal(scanner.Bytes(), &c) != nil || c.Seq <= f.seq {
+			continue
+		}
+		f.lines++
+		f.seq = c.Seq
+		f.changes = append(f.changes, c)
+	}
+	if n := len(f.changes); n > changeRetention {
+		f.changes = append([]Change(nil), f.changes[n-changeRetention:]...)
+	}
+}
+
+// recordChange appends the change of the object under key to the change
+// feed. The caller holds the lock of the key, so that the changes of a key
+// are recorded in the order they are made.
+func (s *FileServer) recordChange(key string, op ChangeOp, meta ObjectMeta) {
+	f := &s.changes
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s.loadChanges()
+
+	f.seq++
+	c := Change{Seq: f.seq, Key: key, Op: op, At: s.Clock.Now()}
+	if op == ChangePut {
+		c.Hash = meta.ETag()
+	}
+	f.changes = append(f.changes, c)
+	if n := len(f.changes); n > changeRetention {
+		f.changes = append([]Change(nil), f.changes[n-changeRetention:]...)
+	}
+	close(f.changed)
+	f.changed = make(chan struct{})
+
+	if f.lines >= 2*changeRetention {
+		if err := s.compactChanges(); err != nil {
+			s.logger.Warn("Failed to compact the change feed: %v", err)
+		}
+		return
+	}
+	if err := s.appendChange(c); err != nil {
+		s.logger.Warn("Failed to record change %d to %s: %v", c.Seq, key, err)
+	}
+}
+
+// appendChange appends c to the file of the change feed.
+func (s *FileServer) appendChange(c Change) error {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.store.Root, os.ModePerm); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(s.changeFeedPath(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(b, '\n'))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		s.changes.lines++
+	}
+	return err
+}
+
+// compactChanges rewrites the file of the change feed with the changes
+// kept only.
+func (s *FileServer) compactChanges() error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, c := range s.changes.changes {
+		if err := enc.Encode(c); err != nil {
+			return err
+		}
+	}
+	path := s.changeFeedPath()
+	if err := os.WriteFile(path+".tmp", buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	s.changes.lines = len(s.changes.changes)
+	return nil
+}
+
+// Changes returns up to limit changes to the objects of the node after
+// cursor, those of bucket only when it is set. When there are none yet, it
+// waits up to wait for one, or until ctx is done.
+func (s *FileServer) Changes(ctx context.Context, bucket string, cursor uint64, limit int, wait time.Duration) (ChangeList, error) {
+	if limit <= 0 {
+		return ChangeList{}, errors.NewInvalidInputError("limit must be positive")
+	}
+	if strings.Contains(bucket, "/") {
+		return ChangeList{}, errors.NewInvalidInputError("invalid bucket " + bucket)
+	}
+
+	deadline := s.Clock.Now().Add(wait)
+	for {
+		list, changed := s.changesAfter(bucket, cursor, limit)
+		if len(list.Changes) > 0 || list.Reset {
+			return list, nil
+		}
+		// Changes of other buckets move the cursor on.
+		cursor = list.Cursor
+		remaining := deadline.Sub(s.Clock.Now())
+		if remaining <= 0 {
+			return list, nil
+		}
+		select {
+		case <-changed:
+		case <-s.Clock.After(remaining):
+		case <-ctx.Done():
+			return list, nil
+		case <-s.quitch:
+			return list, nil
+		}
+	}
+}
+
+// changesAfter returns the page of the change feed after cursor, and a
+// channel closed on the next change.
+func (s *FileServer) changesAfter(bucket string, cursor uint64, limit int) (ChangeList, <-chan struct{}) {
+	f := &s.changes
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s.loadChanges()
+
+	list := ChangeList{Changes: []Change{}, Cursor: cursor, Last: f.seq}
+	if cursor > f.seq {
+		// The feed was lost since the reader last read it.
+		list.Cursor, list.Reset = f.seq, true
+		return list, f.changed
+	}
+	if cursor == f.seq {
+		return list, f.changed
+	}
+	first := f.changes[0].Seq
+	if cursor+1 < first {
+		list.Cursor, list.Reset = f.seq, true
+		return list, f.changed
+	}
+
+	for _, c := range f.changes[cursor+1-first:] {
+		list.Cursor = c.Seq
+		if bucket == "" || bucketOf(c.Key) == bucket {
+			list.Changes = append(list.Changes, c)
+			if len(list.Changes) == limit {
+				break
+			}
+		}
+	}
+	return list, f.changed
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChangeFeedOrdersChanges(t *testing.T) {
+	c := newTestCluster(t, 1)
+	s := c.nodes[0]
+
+	c.store(0, "docs/a", []byte("first draft"))
+	c.store(0, "media/b", []byte("picture"))
+	c.store(0, "docs/a", []byte("second draft"))
+	assert.Nil(t, c.run("delete", func() error { return s.deleteObject("media/b") }))
+
+	list, err := s.Changes(context.Background(), "", 0, 10, 0)
+	assert.Nil(t, err)
+	assert.Len(t, list.Changes, 4)
+	for i, c := range list.Changes {
+		assert.Equal(t, uint64(i+1), c.Seq)
+	}
+	meta, _ := s.Meta("docs/a")
+	assert.Equal(t, "docs/a", list.Changes[2].Key)
+	assert.Equal(t, ChangePut, list.Changes[2].Op)
+	assert.Equal(t, meta.ETag(), list.Changes[2].Hash)
+	assert.Equal(t, ChangeDelete, list.Changes[3].Op)
+	assert.Empty(t, list.Changes[3].Hash)
+	assert.Equal(t, uint64(4), list.Cursor)
+	assert.Equal(t, uint64(4), list.Last)
+
+	// Pages of a bucket move the cursor past the changes of other buckets.
+	list, err = s.Changes(context.Background(), "docs", 1, 1, 0)
+	assert.Nil(t, err)
+	assert.Len(t, list.Changes, 1)
+	assert.Equal(t, uint64(3), list.Cursor)
+	list, err = s.Changes(context.Background(), "docs", list.Cursor, 1, 0)
+	assert.Nil(t, err)
+	assert.Empty(t, list.Changes)
+	assert.Equal(t, uint64(4), list.Cursor)
+	assert.False(t, list.Reset)
+
+	// Readers ahead of the feed start over.
+	list, err = s.Changes(context.Background(), "", 7, 10, 0)
+	assert.Nil(t, err)
+	assert.True(t, list.Reset)
+	assert.Equal(t, uint64(4), list.Cursor)
+
+	// Waiting readers get the next change as it is made.
+	got := make(chan ChangeList, 1)
+	go func() {
+		list, _ := s.Changes(context.Background(), "", 4, 10, time.Hour)
+		got <- list
+	}()
+	c.store(0, "docs/c", []byte("appendix"))
+	c.eventually("the waiting reader to get the change", func() bool {
+		select {
+		case list = <-got:
+			return true
+		default:
+			return false
+		}
+	})
+	assert.Len(t, list.Changes, 1)
+	assert.Equal(t, "docs/c", list.Changes[0].Key)
+}
+
+func TestChangeFeedSurvivesRestart(t *testing.T) {
+	c := newTestCluster(t, 1)
+	s := c.nodes[0]
+	c.store(0, "a", []byte("a"))
+	c.store(0, "b", []byte("b"))
+	s.Stop()
+
+	restarted := NewFileServer(s.FileServerOpts)
+	restarted.recordChange("c", ChangeDelete, ObjectMeta{})
+	list, err := restarted.Changes(context.Background(), "", 0, 10, 0)
+	assert.Nil(t, err)
+	assert.Len(t, list.Changes, 3)
+	assert.Equal(t, "b", list.Changes[1].Key)
+	assert.Equal(t, uint64(3), list.Last)
+}
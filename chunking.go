@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"sync"
+
+	"github.com/anthdm/foreverstore/errors"
+)
+
+// A file stored chunked is split into chunks of ChunkSize bytes, each stored
+// as an object under its content addressed key (see NewManifestChunk), and
+// the object under the key of the file is the manifest listing them. Each
+// chunk is replicated, repaired and fetched on its own: a range of the file
+// is read from the chunks holding it alone, identical chunks are stored
+// once, and storing a file again after a failure only sends the chunks not
+// stored yet. Chunks are shared between files, and deleting a file leaves
+// its chunks in place.
+
+// chunkStoreParallelism is the number of chunks of a file stored at once.
+const chunkStoreParallelism = 4
+
+// StoreChunked stores the file read from r under key, as chunks of
+// ChunkSize bytes, and returns the manifest stored under key. Chunks this
+// node already holds are not stored again.
+func (s *FileServer) StoreChunked(key string, r io.Reader) (*Manifest, error) {
+	m := &Manifest{Encoding: ManifestEncodingChunked, Chunks: []ManifestChunk{}}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		storeErr error
+		slots    = make(chan struct{}, chunkStoreParallelism)
+	)
+	failed := func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		return storeErr
+	}
+	for failed() == nil {
+		data := make([]byte, s.ChunkSize)
+		n, err := io.ReadFull(r, data)
+		if n > 0 {
+			chunk := NewManifestChunk(data[:n])
+			m.Chunks = append(m.Chunks, chunk)
+			m.Size += int64(n)
+
+			slots <- struct{}{}
+			wg.Add(1)
+			go func() {
+				defer func() { <-slots; wg.Done() }()
+				if err := s.storeChunk(chunk, data[:n]); err != nil {
+					mu.Lock()
+					if storeErr == nil {
+						storeErr = err
+					}
+					mu.Unlock()
+				}
+			}()
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			wg.Wait()
+			return nil, errors.Wrap(err, errors.StorageError, "failed to read file")
+		}
+	}
+	wg.Wait()
+	if storeErr != nil {
+		return nil, storeErr
+	}
+
+	b, err := EncodeManifest(m)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.Store(key, bytes.NewReader(b)); err != nil {
+		return nil, err
+	}
+	s.logger.Info("Stored %s as %d chunks (%d bytes)", key, len(m.Chunks), m.Size)
+	return m, nil
+}
+
+// storeChunk stores data as chunk, unless this node holds it already.
+func (s *FileServer) storeChunk(chunk ManifestChunk, data []byte) error {
+	if s.store.Has(s.ID, chunk.Key) {
+		return nil
+	}
+	return s.Store(chunk.Key, bytes.NewReader(data))
+}
+
+// ChunkedManifest returns the manifest of the file stored chunked under key.
+func (s *FileServer) ChunkedManifest(key string) (*Manifest, error) {
+	b, err := s.readManifest(key)
+	if err != nil {
+		return nil, err
+	}
+	if !IsManifest(b) {
+		return nil, errors.NewInvalidInputError("object is not stored chunked").WithContext("key", key)
+	}
+	m, err := DecodeManifest(b)
+	if err != nil {
+		return nil, err
+	}
+	plain := (m.Compression == "" || m.Compression == ManifestCompressionNone) && m.Cipher == ""
+	if m.Encoding != ManifestEncodingChunked || !plain {
+		return nil, errors.NewInvalidInputError("object is not a plain chunked file").WithContext("key", key)
+	}
+	return m, nil
+}
+
+// GetChunked returns a reader of the file stored chunked under key.
+func (s *FileServer) GetChunked(key string) (io.ReadCloser, error) {
+	return s.GetChunkedRange(key, 0, -1)
+}
+
+// GetChunkedRange returns a reader of length bytes of the file stored
+// chunked under key, from offset, or of the rest of the file when length is
+// negative. Only the chunks holding the range are read, each fetched from
+// the peers when this node lost it, and checked against the manifest.
+func (s *FileServer) GetChunkedRange(key string, offset, length int64) (io.ReadCloser, error) {
+	m, err := s.ChunkedManifest(key)
+	if err != nil {
+		return nil, err
+	}
+	if offset < 0 || offset > m.Size {
+		return nil, errors.NewInvalidInputError("offset out of range").WithContext("key", key)
+	}
+	if length < 0 || offset+length > m.Size {
+		length = m.Size - offset
+	}
+
+	chunks := m.Chunks
+	for len(chunks) > 0 && offset >= chunks[0].Size {
+		offset -= chunks[0].Size
+		chunks = chunks[1:]
+	}
+	return &chunkedReader{s: s, chunks: chunks, skip: offset, remaining: length}, nil
+}
+
+// chunkedReader reads a range of a chunked file, a chunk at a time.
+type chunkedReader struct {
+	s      *FileServer
+	chunks []ManifestChunk
+	// skip is the offset of the range in the first chunk, and remaining
+	// the bytes of the range left to read.
+	skip      int64
+	remaining int64
+	current   []byte
+}
+
+func (r *chunkedReader) Read(p []byte) (int, error) {
+	for len(r.current) == 0 {
+		if r.remaining == 0 || len(r.chunks) == 0 {
+			return 0, io.EOF
+		}
+		data, err := r.s.readChunk(r.chunks[0])
+		if err != nil {
+			return 0, err
+		}
+		r.chunks = r.chunks[1:]
+		data = data[r.skip:]
+		r.skip = 0
+		if int64(len(data)) > r.remaining {
+			data = data[:r.remaining]
+		}
+		r.current = data
+	}
+
+	n := copy(p, r.current)
+	r.current = r.current[n:]
+	r.remaining -= int64(n)
+	return n, nil
+}
+
+func (r *chunkedReader) Close() error {
+	r.chunks, r.current = nil, nil
+	return nil
+}
+
+// readChunk reads chunk whole and checks it against its manifest.
+func (s *FileServer) readChunk(chunk ManifestChunk) ([]byte, error) {
+	rd, err := s.Get(chunk.Key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(rd)
+	if c, ok := rd.(io.Closer); ok {
+		c.Close()
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, errors.StorageError, "failed to read chunk").WithContext("key", chunk.Key)
+	}
+	if err := chunk.Verify(data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/anthdm/foreverstore/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChunkedFilesAreStoredAsChunks(t *testing.T) {
+	c := newTestClusterWith(t, 2, func(node int, opts *FileServerOpts) {
+		opts.ChunkSize = 16
+	})
+	s := c.nodes[0]
+	data := bytes.Repeat([]byte("0123456789abcdef"), 3)
+	data = append(data, "tail"...)
+
+	var m *Manifest
+	assert.Nil(t, c.run("store chunked", func() (err error) {
+		m, err = s.StoreChunked("videos/big", bytes.NewReader(data))
+		return err
+	}))
+	assert.Equal(t, int64(len(data)), m.Size)
+	assert.Len(t, m.Chunks, 4)
+	// The three identical chunks are stored once.
+	assert.Equal(t, m.Chunks[0].Key, m.Chunks[2].Key)
+	for _, chunk := range m.Chunks {
+		c.assertConverged(0, chunk.Key)
+	}
+
+	read := func(offset, length int64) []byte {
+		t.Helper()
+		var got []byte
+		assert.Nil(t, c.run("read chunked", func() error {
+			r, err := s.GetChunkedRange("videos/big", offset, length)
+			if err != nil {
+				return err
+			}
+			defer r.Close()
+			got, err = io.ReadAll(r)
+			return err
+		}))
+		return got
+	}
+	assert.Equal(t, data, read(0, -1))
+	assert.Equal(t, data[10:40], read(10, 30))
+	assert.Equal(t, []byte("tail"), read(48, 100))
+	assert.Empty(t, read(int64(len(data)), -1))
+
+	// A lost chunk is fetched back from its replicas.
+	assert.Nil(t, s.store.Delete(s.ID, m.Chunks[3].Key))
+	assert.Equal(t, []byte("ftail"), read(47, -1))
+
+	c.store(0, "plain", []byte("not chunked"))
+	err := c.run("read plain", func() error {
+		_, err := s.GetChunked("plain")
+		return err
+	})
+	assert.True(t, errors.IsType(err, errors.InvalidInputError), "%v", err)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/cipher"
+	"fmt"
+
+	"github.com/anthdm/foreverstore/config"
+	"github.com/anthdm/foreverstore/errors"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Cipher suites for the chunked encryption format. AES-GCM is the default
+// and the one to pick in FIPS-restricted environments.
+const (
+	CipherSuiteAESGCM           = "aes-gcm"
+	CipherSuiteChaCha20Poly1305 = "chacha20-poly1305"
+	// CipherSuiteNone stores replicas unencrypted. Objects are still
+	// covered by their integrity tags.
+	CipherSuiteNone = "none"
+
+	defaultCipherSuite = CipherSuiteAESGCM
+
+	// CipherLegacyCTR identifies data in the unauthenticated CTR format in
+	// object metadata. It can't be selected as a cipher suite.
+	CipherLegacyCTR = "aes-ctr"
+)
+
+// cipherSuiteIDs are the identifiers recorded in the header of encrypted
+// data. They must never be reused.
+var cipherSuiteIDs = map[string]byte{
+	CipherSuiteNone:             0,
+	CipherSuiteAESGCM:           1,
+	CipherSuiteChaCha20Poly1305: 2,
+}
+
+func cipherSuiteByID(id byte) (string, error) {
+	for suite, suiteID := range cipherSuiteIDs {
+		if suiteID == id {
+			return suite, nil
+		}
+	}
+	return "", errors.NewCorruptionError(fmt.Sprintf("unknown cipher suite id: %d", id))
+}
+
+// validCipherSuite reports whether suite names a supported cipher suite.
+func validCipherSuite(suite string) bool {
+	_, ok := cipherSuiteIDs[suite]
+	return ok
+}
+
+// suiteSet is the set of cipher suites data read back may be sealed with.
+// The suite is recorded in the header of the data, which a peer sending it
+// chooses: data claiming to be unencrypted needs no key to be forged.
+type suiteSet map[string]bool
+
+// suitesOf returns the set of the given suites.
+func suitesOf(suites ...string) suiteSet {
+	set := make(suiteSet, len(suites))
+	for _, suite := range suites {
+		set[suite] = true
+	}
+	return set
+}
+
+// check refuses data sealed with a suite outside the set.
+func (set suiteSet) check(suite string) error {
+	if set[suite] {
+		return nil
+	}
+	return errors.NewEncryptionError(fmt.Sprintf("data is sealed with cipher suite %s, which is not accepted here", suite))
+}
+
+// decryptSuites returns the cipher suites this node decrypts the data of
+// the objects of bucket with: AES-GCM, which data sealed before suites
+// could be chosen uses, the suite of the node, and cipher, the suite the
+// metadata of the object records, when known. Unencrypted data is only
+// accepted when the node, or the policy of bucket, stores replicas
+// unencrypted.
+func (s *FileServer) decryptSuites(bucket, cipher string) suiteSet {
+	set := suitesOf(CipherSuiteAESGCM, s.CipherSuite)
+	if validCipherSuite(cipher) {
+		set[cipher] = true
+	}
+	if bucket != "" && s.bucketPolicyOf(bucket).Encryption == config.EncryptionNone {
+		set[CipherSuiteNone] = true
+	}
+	return set
+}
+
+// replicaCipher returns the identifier of the cipher new replicas are
+// encrypted with.
+func (s *FileServer) replicaCipher() string {
+	if s.EncryptionMode == EncryptionModeCTR {
+		return CipherLegacyCTR
+	}
+	return s.CipherSuite
+}
+
+// newSuiteAEAD returns the AEAD of the given cipher suite keyed with key.
+func newSuiteAEAD(suite string, key []byte) (cipher.AEAD, error) {
+	switch suite {
+	case CipherSuiteAESGCM, "":
+		return newGCM(key)
+	case CipherSuiteChaCha20Poly1305:
+		aead, err := chacha20poly1305.New(key)
+		if err != nil {
+			return nil, errors.Wrap(err, errors.EncryptionError, "invalid encryption key for chacha20-poly1305")
+		}
+		return aead, nil
+	case CipherSuiteNone:
+		return nullAEAD{}, nil
+	default:
+		return nil, errors.NewEncryptionError(fmt.Sprintf("unknown cipher suite: %s", suite))
+	}
+}
+
+// suiteOverhead returns the number of bytes a suite adds to every chunk.
+func suiteOverhead(suite string) int {
+	if suite == CipherSuiteNone {
+		return 0
+	}
+	return 16
+}
+
+// nullAEAD passes data through unchanged, so unencrypted replicas share the
+// chunked format and its framing with the encrypted ones.
+type nullAEAD struct{}
+
+func (nullAEAD) NonceSize() int { return 12 }
+func (nullAEAD) Overhead() int  { return 0 }
+
+func (nullAEAD) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	return append(dst, plaintext...)
+}
+
+func (nullAEAD) Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	return append(dst, ciphertext...), nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+
+	"github.com/anthdm/foreverstore/config"
+	"github.com/anthdm/foreverstore/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+var allCipherSuites = []string{CipherSuiteAESGCM, CipherSuiteChaCha20Poly1305, CipherSuiteNone}
+
+func TestCipherSuitesRoundTrip(t *testing.T) {
+	key := newEncryptionKey()
+
+	for _, suite := range allCipherSuites {
+		for _, size := range []int{0, 1, gcmChunkSize, 2*gcmChunkSize + 7} {
+			payload := make([]byte, size)
+			io.ReadFull(rand.Reader, payload)
+
+			encrypted := new(bytes.Buffer)
+			n, err := copyEncryptMode(EncryptionModeGCM, suite, 3, key, bytes.NewReader(payload), encrypted)
+			if err != nil {
+				t.Fatalf("%s/%d: encrypt failed: %v", suite, size, err)
+			}
+			if n != encryptedSize(EncryptionModeGCM, suite, int64(size)) {
+				t.Errorf("%s/%d: wrote %d bytes, expected %d", suite, size, n, encryptedSize(EncryptionModeGCM, suite, int64(size)))
+			}
+
+			version, err := encryptedKeyVersion(bytes.NewReader(encrypted.Bytes()))
+			if err != nil || version != 3 {
+				t.Errorf("%s/%d: key version %d, %v", suite, size, version, err)
+			}
+
+			obj, err := openGCMObject(staticKey(key), suitesOf(suite), bytes.NewReader(encrypted.Bytes()), int64(encrypted.Len()))
+			if err != nil {
+				t.Fatalf("%s/%d: open failed: %v", suite, size, err)
+			}
+			if obj.Size() != int64(size) {
+				t.Errorf("%s/%d: object size %d", suite, size, obj.Size())
+			}
+
+			out := new(bytes.Buffer)
+			if _, err := copyDecryptAuto(staticKey(key), suitesOf(suite), encrypted, out); err != nil {
+				t.Fatalf("%s/%d: decrypt failed: %v", suite, size, err)
+			}
+			if !bytes.Equal(out.Bytes(), payload) {
+				t.Errorf("%s/%d: decrypted payload does not match", suite, size)
+			}
+		}
+	}
+}
+
+func TestCipherSuiteIsRecordedInHeader(t *testing.T) {
+	key := newEncryptionKey()
+	payload := []byte("plain text")
+
+	// AES-GCM keeps writing the format older nodes understand.
+	encrypted := new(bytes.Buffer)
+	copyEncryptSuite(CipherSuiteAESGCM, key, 0, bytes.NewReader(payload), encrypted)
+	if string(encrypted.Bytes()[:4]) != gcmMagic {
+		t.Errorf("unexpected magic %q", encrypted.Bytes()[:4])
+	}
+
+	encrypted.Reset()
+	copyEncryptSuite(CipherSuiteChaCha20Poly1305, key, 0, bytes.NewReader(payload), encrypted)
+	h, err := parseGCMHeader(encrypted.Bytes())
+	if err != nil || h.suite != CipherSuiteChaCha20Poly1305 {
+		t.Errorf("unexpected header %+v, %v", h, err)
+	}
+	if bytes.Contains(encrypted.Bytes(), payload) {
+		t.Error("chacha20-poly1305 output contains the plaintext")
+	}
+
+	encrypted.Reset()
+	copyEncryptSuite(CipherSuiteNone, key, 0, bytes.NewReader(payload), encrypted)
+	if !bytes.Contains(encrypted.Bytes(), payload) {
+		t.Error("expected unencrypted payload with cipher suite none")
+	}
+
+	data := encrypted.Bytes()
+	data[len(gcmMagic)] = 0xff
+	_, err = copyDecryptAuto(staticKey(key), suitesOf(allCipherSuites...), bytes.NewReader(data), io.Discard)
+	if !errors.IsType(err, errors.CorruptionError) {
+		t.Errorf("expected corruption error for unknown suite, got %v", err)
+	}
+}
+
+func TestChaCha20Poly1305DetectsTampering(t *testing.T) {
+	key := newEncryptionKey()
+	encrypted := new(bytes.Buffer)
+	copyEncryptSuite(CipherSuiteChaCha20Poly1305, key, 0, bytes.NewReader(bytes.Repeat([]byte("x"), 1000)), encrypted)
+
+	data := encrypted.Bytes()
+	data[len(data)-20] ^= 1
+	_, err := copyDecryptAuto(staticKey(key), suitesOf(CipherSuiteChaCha20Poly1305), bytes.NewReader(data), io.Discard)
+	if !errors.IsType(err, errors.CorruptionError) {
+		t.Errorf("expected corruption error, got %v", err)
+	}
+}
+
+func TestCipherSuiteRequiresValidKey(t *testing.T) {
+	if _, err := newSuiteAEAD(CipherSuiteChaCha20Poly1305, make([]byte, 16)); !errors.IsType(err, errors.EncryptionError) {
+		t.Errorf("expected encryption error for short chacha20-poly1305 key, got %v", err)
+	}
+	if _, err := newSuiteAEAD("rot13", newEncryptionKey()); err == nil {
+		t.Error("expected error for unknown cipher suite")
+	}
+}
+
+func TestUnencryptedDataIsRefusedUnlessConfigured(t *testing.T) {
+	s := createTestServer(":0", t.TempDir(), []string{})
+	unencrypted := new(bytes.Buffer)
+	copyEncryptSuite(CipherSuiteNone, nil, 0, bytes.NewReader([]byte("forged")), unencrypted)
+
+	_, err := copyDecryptAuto(s.keyRing.Lookup, s.decryptSuites("docs", ""), bytes.NewReader(unencrypted.Bytes()), io.Discard)
+	if !errors.IsType(err, errors.EncryptionError) {
+		t.Errorf("expected encryption error for unencrypted data, got %v", err)
+	}
+	chacha := new(bytes.Buffer)
+	copyEncryptSuite(CipherSuiteChaCha20Poly1305, newEncryptionKey(), 0, bytes.NewReader([]byte("data")), chacha)
+	if _, err := copyDecryptAuto(s.keyRing.Lookup, s.decryptSuites("docs", ""), chacha, io.Discard); !errors.IsType(err, errors.EncryptionError) {
+		t.Errorf("expected encryption error for a suite not configured, got %v", err)
+	}
+
+	// Buckets stored unencrypted, and objects recorded as such, accept it.
+	s.BucketPolicies = []config.BucketPolicy{{Bucket: "public", Encryption: config.EncryptionNone}}
+	for _, suites := range []suiteSet{s.decryptSuites("public", ""), s.decryptSuites("docs", CipherSuiteNone)} {
+		if _, err := copyDecryptAuto(s.keyRing.Lookup, suites, bytes.NewReader(unencrypted.Bytes()), io.Discard); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+}
+
+func TestForgedUnencryptedFetchIsRefused(t *testing.T) {
+	c := newTestCluster(t, 2)
+	origin, holder := c.nodes[0], c.nodes[1]
+	c.store(0, "docs/a", []byte("original"))
+	c.assertConverged(0, "docs/a")
+
+	// The holder of the replica swaps it for unencrypted content without
+	// an integrity tag, and the origin loses its copy.
+	forged := new(bytes.Buffer)
+	copyEncryptSuite(CipherSuiteNone, nil, 0, bytes.NewReader([]byte("forged")), forged)
+	_, err := holder.store.Write(origin.ID, hashKey("docs/a"), forged)
+	assert.Nil(t, err)
+	meta, _ := holder.store.ReadMeta(origin.ID, hashKey("docs/a"))
+	meta.HMAC = nil
+	assert.Nil(t, holder.store.WriteMeta(origin.ID, hashKey("docs/a"), meta))
+	assert.Nil(t, origin.store.Delete(origin.ID, "docs/a"))
+
+	err = c.run("origin to get docs/a", func() error {
+		r, err := origin.Get("docs/a")
+		if err != nil {
+			return err
+		}
+		b, err := io.ReadAll(r)
+		if err == nil && string(b) == "forged" {
+			t.Error("forged content was served")
+		}
+		return err
+	})
+	assert.NotNil(t, err)
+	assert.False(t, origin.store.Has(origin.ID, "docs/a"))
+}
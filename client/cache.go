@@ -0,0 +1,542 @@
+package client
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anthdm/foreverstore/errors"
+)
+
+// A Client can keep copies of the objects it reads, in memory, on disk or
+// both, for reads of objects that did not change to be served without
+// downloading them again. A copy is served as is for MaxAge after it was
+// last checked; past that, a read asks the cluster whether the object
+// changed, with the ETag of the copy, and downloads it again only when it
+// did. Objects served without an ETag are not kept. The copies of the
+// objects the client stores or deletes are dropped at once, and a client
+// watching the change feed of its endpoints drops those of the objects
+// changed by others as it hears of them.
+
+// CacheOptions configures the cache of a Client.
+type CacheOptions struct {
+	// MemoryBytes bounds the copies kept in memory; zero keeps none.
+	MemoryBytes int64
+	// Dir is the directory copies are kept in on disk, up to DiskBytes;
+	// empty keeps none. The copies a previous client left there are kept,
+	// and checked with the cluster before they are first served.
+	Dir       string
+	DiskBytes int64
+	// MaxAge is how long a copy is served without checking with the
+	// cluster that its object did not change; zero checks on every read.
+	MaxAge time.Duration
+	// WatchChanges has the client tail the change feed of every endpoint
+	// and drop the copies of the objects changed, for a longer MaxAge to
+	// serve few stale copies.
+	WatchChanges bool
+}
+
+// validate checks that the cache keeps copies somewhere.
+func (o CacheOptions) validate() error {
+	switch {
+	case o.MemoryBytes < 0 || o.DiskBytes < 0 || o.MaxAge < 0:
+		return errors.NewConfigError("cache sizes and max age cannot be negative")
+	case o.Dir != "" && o.DiskBytes == 0:
+		return errors.NewConfigError("a cache directory needs a disk size")
+	case o.MemoryBytes == 0 && o.Dir == "":
+		return errors.NewConfigError("a cache needs a memory size or a directory")
+	}
+	return nil
+}
+
+// CacheStats reports the use of the cache of a Client.
+type CacheStats struct {
+	Objects     int   `json:"objects"`
+	MemoryBytes int64 `json:"memory_bytes"`
+	DiskBytes   int64 `json:"disk_bytes"`
+	// Hits counts the reads served from a copy, Revalidated those of them
+	// the cluster was asked about first, and Misses the reads that
+	// downloaded the object.
+	Hits        int64 `json:"hits"`
+	Revalidated int64 `json:"revalidated"`
+	Misses      int64 `json:"misses"`
+	// Invalidated counts the copies dropped as their object changed.
+	Invalidated int64 `json:"invalidated"`
+}
+
+// changesWait is how long a request for the change feed of an endpoint
+// waits for a change, and changesRetry how long the feed of an endpoint
+// that failed is left before asking again.
+const (
+	changesWait  = 30 * time.Second
+	changesRetry = 5 * time.Second
+)
+
+// cacheEntry is the copy of an object.
+type cacheEntry struct {
+	key  string
+	etag string
+	size int64
+	// data is the copy in memory, nil when there is none, and onDisk is
+	// set when there is one on disk.
+	data   []byte
+	onDisk bool
+	// checked is when the object was last known unchanged; zero for the
+	// copies found on disk.
+	checked time.Time
+	elem    *list.Element
+}
+
+// diskEntry describes a copy on disk, in the file next to it.
+type diskEntry struct {
+	Key  string `json:"key"`
+	ETag string `json:"etag"`
+	Size int64  `json:"size"`
+}
+
+type cache struct {
+	opts CacheOptions
+
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+	// lru orders the entries from the most recently used.
+	lru    *list.List
+	memory int64
+	disk   int64
+	// gen moves on with every copy dropped, for the downloads started
+	// before not to put back what was dropped.
+	gen   uint64
+	stats CacheStats
+}
+
+// newCache returns a cache with the copies left in opts.Dir.
+func newCache(opts CacheOptions) (*cache, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	c := &cache{opts: opts, entries: make(map[string]*cacheEntry), lru: list.New()}
+	if opts.Dir == "" {
+		return c, nil
+	}
+	if err := os.MkdirAll(opts.Dir, 0755); err != nil {
+		return nil, errors.Wrap(err, errors.ConfigError, "failed to create cache directory")
+	}
+	files, err := os.ReadDir(opts.Dir)
+	if err != nil {
+		return nil, errors.Wrap(err, errors.ConfigError, "failed to read cache directory")
+	}
+	for _, f := range files {
+		name := f.Name()
+		if strings.HasSuffix(name, ".tmp") {
+			os.Remove(filepath.Join(opts.Dir, name))
+			continue
+		}
+		if strings.HasSuffix(name, ".json") {
+			c.load(strings.TrimSuffix(name, ".json"))
+		}
+	}
+	c.evict()
+	return c, nil
+}
+
+// load takes the copy on disk under name, or removes it when it is not
+// whole.
+func (c *cache) load(name string) {
+	var d diskEntry
+	b, err := os.ReadFile(filepath.Join(c.opts.Dir, name+".json"))
+	if err == nil {
+		err = json.Unmarshal(b, &d)
+	}
+	if err == nil && c.fileName(d.Key) != name {
+		err = errors.NewCorruptionError("misplaced cache entry")
+	}
+	if err == nil {
+		var info os.FileInfo
+		if info, err = os.Stat(filepath.Join(c.opts.Dir, name)); err == nil && info.Size() != d.Size {
+			err = errors.NewCorruptionError("truncated cache entry")
+		}
+	}
+	if err != nil {
+		c.removeFiles(name)
+		return
+	}
+	e := &cacheEntry{key: d.Key, etag: d.ETag, size: d.Size, onDisk: true}
+	e.elem = c.lru.PushBack(e)
+	c.entries[d.Key] = e
+	c.disk += d.Size
+}
+
+// fileName returns the name of the file the copy of the object stored
+// under key is kept in.
+func (c *cache) fileName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func (c *cache) removeFiles(name string) {
+	os.Remove(filepath.Join(c.opts.Dir, name))
+	os.Remove(filepath.Join(c.opts.Dir, name+".json"))
+}
+
+// lookup returns the ETag of the copy of the object stored under key, and
+// whether it is recent enough to be served without asking the cluster.
+func (c *cache) lookup(key string, now time.Time) (etag string, fresh, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return "", false, false
+	}
+	fresh = !e.checked.IsZero() && now.Sub(e.checked) < c.opts.MaxAge
+	return e.etag, fresh, true
+}
+
+// open returns a reader of the copy of the object stored under key with
+// the given ETag, counting a hit, or false when there is none. A copy the
+// cluster was asked about is recorded as checked at now.
+func (c *cache) open(key, etag string, revalidated bool, now time.Time) (io.ReadCloser, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok || e.etag != etag {
+		return nil, false
+	}
+	var r io.ReadCloser
+	if e.data != nil {
+		r = io.NopCloser(bytes.NewReader(e.data))
+	} else {
+		f, err := os.Open(filepath.Join(c.opts.Dir, c.fileName(key)))
+		if err != nil {
+			c.drop(e)
+			return nil, false
+		}
+		r = f
+	}
+	c.lru.MoveToFront(e.elem)
+	c.stats.Hits++
+	if revalidated {
+		c.stats.Revalidated++
+		e.checked = now
+	}
+	return r, true
+}
+
+// put keeps data as the copy of the object stored under key, served with
+// etag at now, unless a copy was dropped since gen.
+func (c *cache) put(key, etag string, data []byte, gen uint64, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gen != c.gen {
+		return
+	}
+	if e, ok := c.entries[key]; ok {
+		c.drop(e)
+	}
+	e := &cacheEntry{key: key, etag: etag, size: int64(len(data)), checked: now}
+	if e.size <= c.opts.MemoryBytes {
+		e.data = data
+		c.memory += e.size
+	}
+	if c.opts.Dir != "" && e.size <= c.opts.DiskBytes {
+		if err := c.write(e, data); err == nil {
+			e.onDisk = true
+			c.disk += e.size
+		}
+	}
+	if e.data == nil && !e.onDisk {
+		return
+	}
+	e.elem = c.lru.PushFront(e)
+	c.entries[key] = e
+	c.evict()
+}
+
+// write writes the copy e of data on disk, then the file describing it.
+// Callers hold mu.
+func (c *cache) write(e *cacheEntry, data []byte) error {
+	name := c.fileName(e.key)
+	desc, err := json.Marshal(diskEntry{Key: e.key, ETag: e.etag, Size: e.size})
+	if err == nil {
+		err = writeFile(filepath.Join(c.opts.Dir, name), data)
+	}
+	if err == nil {
+		err = writeFile(filepath.Join(c.opts.Dir, name+".json"), desc)
+	}
+	if err != nil {
+		c.removeFiles(name)
+	}
+	return err
+}
+
+// writeFile writes b to the file at path, whole or not at all.
+func writeFile(path string, b []byte) error {
+	if err := os.WriteFile(path+".tmp", b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// generation returns the generation downloads put their copies back at.
+func (c *cache) generation() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.gen
+}
+
+// invalidate drops the copy of the object stored under key, unless it is
+// the copy of the object served with etag.
+func (c *cache) invalidate(key, etag string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	if e, ok := c.entries[key]; ok && (etag == "" || e.etag != etag) {
+		c.drop(e)
+		c.stats.Invalidated++
+	}
+}
+
+// expire has every copy checked with the cluster before it is served
+// again, as changes to their objects may have been missed.
+func (c *cache) expire() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, e := range c.entries {
+		e.checked = time.Time{}
+	}
+}
+
+// drop forgets the entry e and its copies. Callers hold mu.
+func (c *cache) drop(e *cacheEntry) {
+	if e.data != nil {
+		c.memory -= e.size
+	}
+	if e.onDisk {
+		c.disk -= e.size
+		c.removeFiles(c.fileName(e.key))
+	}
+	c.lru.Remove(e.elem)
+	delete(c.entries, e.key)
+}
+
+// evict drops the copies least recently used until the cache fits its
+// sizes. Callers hold mu.
+func (c *cache) evict() {
+	for el := c.lru.Back(); el != nil && (c.memory > c.opts.MemoryBytes || c.disk > c.opts.DiskBytes); {
+		e := el.Value.(*cacheEntry)
+		el = el.Prev()
+		if c.memory > c.opts.MemoryBytes && e.data != nil {
+			e.data = nil
+			c.memory -= e.size
+		}
+		if c.disk > c.opts.DiskBytes && e.onDisk {
+			e.onDisk = false
+			c.disk -= e.size
+			c.removeFiles(c.fileName(e.key))
+		}
+		if e.data == nil && !e.onDisk {
+			c.lru.Remove(e.elem)
+			delete(c.entries, e.key)
+		}
+	}
+}
+
+func (c *cache) miss() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stats.Misses++
+}
+
+func (c *cache) snapshot() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	st := c.stats
+	st.Objects = len(c.entries)
+	st.MemoryBytes = c.memory
+	st.DiskBytes = c.disk
+	return st
+}
+
+// cacheFill is the body of an object being downloaded, kept in the cache
+// once read whole.
+type cacheFill struct {
+	io.ReadCloser
+	cache     *cache
+	key, etag string
+	gen       uint64
+	now       func() time.Time
+	buf       bytes.Buffer
+	// limit is the size past which the object would fit in no tier.
+	limit int64
+	full  bool
+}
+
+func (f *cacheFill) Read(p []byte) (int, error) {
+	n, err := f.ReadCloser.Read(p)
+	if !f.full {
+		if int64(f.buf.Len()+n) > f.limit {
+			f.full = true
+			f.buf = bytes.Buffer{}
+		} else {
+			f.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF && !f.full {
+		f.full = true
+		f.cache.put(f.key, f.etag, f.buf.Bytes(), f.gen, f.now())
+	}
+	return n, err
+}
+
+// CacheStats returns the use of the cache of the client, all zero when it
+// keeps none.
+func (c *Client) CacheStats() CacheStats {
+	if c.cache == nil {
+		return CacheStats{}
+	}
+	return c.cache.snapshot()
+}
+
+// getCached is Get for clients that keep a cache.
+func (c *Client) getCached(ctx context.Context, key string) (io.ReadCloser, error) {
+	etag, fresh, cached := c.cache.lookup(key, c.clock.Now())
+	if cached && fresh {
+		if r, ok := c.cache.open(key, etag, false, c.clock.Now()); ok {
+			return r, nil
+		}
+		cached = false
+	}
+
+	gen := c.cache.generation()
+	getCtx, cancel := context.WithTimeout(ctx, c.opts.Timeouts.Get)
+	resp, err := c.do(getCtx, "get", func(base string) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(getCtx, http.MethodGet, base+"/objects/"+url.PathEscape(key), nil)
+		if err == nil && cached {
+			req.Header.Set("If-None-Match", etag)
+		}
+		return req, err
+	})
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		cancel()
+		if r, ok := c.cache.open(key, etag, true, c.clock.Now()); ok {
+			return r, nil
+		}
+		// The copy was dropped meanwhile.
+		c.cache.invalidate(key, "")
+		return c.getCached(ctx, key)
+	}
+
+	c.cache.miss()
+	// Only copies matching their checksum are kept.
+	body := checked(key, resp)
+	if etag := resp.Header.Get("ETag"); etag != "" {
+		limit := c.cache.opts.MemoryBytes
+		if c.cache.opts.Dir != "" && c.cache.opts.DiskBytes > limit {
+			limit = c.cache.opts.DiskBytes
+		}
+		body = &cacheFill{ReadCloser: body, cache: c.cache, key: key, etag: etag, gen: gen, now: c.clock.Now, limit: limit}
+	}
+	return &objectReader{ReadCloser: body, cancel: cancel}, nil
+}
+
+// watchChanges tails the change feed of the endpoint at base, dropping the
+// copies of the objects changed, until the client is closed.
+func (c *Client) watchChanges(base string) {
+	defer c.wg.Done()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-c.quitch:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	var cursor uint64
+	tailing := false
+	for {
+		list, err := c.changes(ctx, base, cursor, tailing)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			c.logger.Warn("Failed to read the change feed of %s: %v", base, err)
+			select {
+			case <-c.clock.After(changesRetry):
+			case <-c.quitch:
+				return
+			}
+			continue
+		}
+		if !tailing {
+			// The feed is tailed from its end: copies are only cached from
+			// now on, and those found on disk checked first.
+			cursor, tailing = list.Last, true
+			continue
+		}
+		if list.Reset {
+			c.cache.expire()
+		}
+		for _, ch := range list.Changes {
+			c.cache.invalidate(ch.Key, ch.Hash)
+		}
+		cursor = list.Cursor
+	}
+}
+
+// change is an entry of the change feed of a node.
+type change struct {
+	Key  string `json:"key"`
+	Hash string `json:"hash"`
+}
+
+// changeList is a page of the change feed of a node.
+type changeList struct {
+	Changes []change `json:"changes"`
+	Cursor  uint64   `json:"cursor"`
+	Last    uint64   `json:"last"`
+	Reset   bool     `json:"reset"`
+}
+
+// changes gets the changes of the endpoint at base after cursor, waiting
+// for one when tailing.
+func (c *Client) changes(ctx context.Context, base string, cursor uint64, tailing bool) (changeList, error) {
+	query := url.Values{"cursor": {strconv.FormatUint(cursor, 10)}}
+	if tailing {
+		query.Set("wait", changesWait.String())
+	} else {
+		query.Set("limit", "1")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, base+"/changes?"+query.Encode(), nil)
+	if err != nil {
+		return changeList{}, errors.Wrap(err, errors.InternalError, "failed to build request")
+	}
+	resp, err := c.send(req)
+	if err != nil {
+		return changeList{}, err
+	}
+	defer resp.Body.Close()
+
+	var list changeList
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return changeList{}, errors.Wrap(err, errors.NetworkError, "invalid change feed")
+	}
+	return list, nil
+}
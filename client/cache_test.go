@@ -0,0 +1,160 @@
+package client
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/anthdm/foreverstore/clock"
+	"github.com/anthdm/foreverstore/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func newCachingClient(t *testing.T, node *fakeNode, clk clock.Clock, cache CacheOptions) *Client {
+	c, err := New(Options{
+		Endpoints:           []string{node.URL},
+		Retry:               fastRetry,
+		HealthCheckInterval: -1,
+		Clock:               clk,
+		Cache:               &cache,
+	})
+	assert.Nil(t, err)
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func read(t *testing.T, c *Client, key string) string {
+	t.Helper()
+	r, err := c.Get(context.Background(), key)
+	if !assert.Nil(t, err) {
+		return ""
+	}
+	defer r.Close()
+	b, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	return string(b)
+}
+
+func TestCacheServesCopiesUntilTheyAreTooOld(t *testing.T) {
+	node := newFakeNode(t)
+	node.put("doc", []byte("first"))
+	clk := clock.NewFake(time.Now())
+	c := newCachingClient(t, node, clk, CacheOptions{MemoryBytes: 1024, MaxAge: time.Minute})
+
+	assert.Equal(t, "first", read(t, c, "doc"))
+	assert.Equal(t, "first", read(t, c, "doc"))
+	assert.Equal(t, 1, node.hits())
+	st := c.CacheStats()
+	assert.Equal(t, CacheStats{Objects: 1, MemoryBytes: 5, Hits: 1, Misses: 1}, st)
+
+	// Past MaxAge the copy is checked with the cluster before it is served.
+	clk.Advance(time.Minute)
+	assert.Equal(t, "first", read(t, c, "doc"))
+	assert.Equal(t, 2, node.hits())
+	assert.Equal(t, int64(1), c.CacheStats().Revalidated)
+	assert.Equal(t, "first", read(t, c, "doc"))
+	assert.Equal(t, 2, node.hits())
+
+	// Changes made by others are seen once the copy is checked again.
+	node.put("doc", []byte("second"))
+	assert.Equal(t, "first", read(t, c, "doc"))
+	clk.Advance(time.Minute)
+	assert.Equal(t, "second", read(t, c, "doc"))
+	assert.Equal(t, "second", read(t, c, "doc"))
+	assert.Equal(t, int64(2), c.CacheStats().Misses)
+}
+
+func TestCacheDropsCopiesOfObjectsWritten(t *testing.T) {
+	node := newFakeNode(t)
+	c := newCachingClient(t, node, nil, CacheOptions{MemoryBytes: 1024, MaxAge: time.Hour})
+	ctx := context.Background()
+
+	assert.Nil(t, c.Store(ctx, "doc", strings.NewReader("first")))
+	assert.Equal(t, "first", read(t, c, "doc"))
+	assert.Nil(t, c.Store(ctx, "doc", strings.NewReader("second")))
+	assert.Equal(t, "second", read(t, c, "doc"))
+	assert.Nil(t, c.Delete(ctx, "doc"))
+	_, err := c.Get(ctx, "doc")
+	assert.True(t, errors.IsType(err, errors.FileNotFoundError), "%v", err)
+	assert.Zero(t, c.CacheStats().Objects)
+}
+
+func TestCacheFollowsTheChangeFeed(t *testing.T) {
+	node := newFakeNode(t)
+	node.put("doc", []byte("first"))
+	node.put("other", []byte("kept"))
+	c := newCachingClient(t, node, nil, CacheOptions{MemoryBytes: 1024, MaxAge: time.Hour, WatchChanges: true})
+
+	assert.Equal(t, "first", read(t, c, "doc"))
+	assert.Equal(t, "kept", read(t, c, "other"))
+	assert.Eventually(t, func() bool {
+		node.mu.Lock()
+		defer node.mu.Unlock()
+		return node.waiting > 0
+	}, 5*time.Second, time.Millisecond)
+	// Writes of the same content keep the copy.
+	node.put("other", []byte("kept"))
+	node.put("doc", []byte("second"))
+	assert.Eventually(t, func() bool { return c.CacheStats().Invalidated == 1 }, 5*time.Second, time.Millisecond)
+	assert.Equal(t, "second", read(t, c, "doc"))
+	assert.Equal(t, "kept", read(t, c, "other"))
+	assert.Equal(t, int64(1), c.CacheStats().Hits)
+}
+
+func TestCacheKeepsCopiesOnDisk(t *testing.T) {
+	node := newFakeNode(t)
+	node.put("doc", []byte("on disk"))
+	opts := CacheOptions{Dir: t.TempDir(), DiskBytes: 1024, MaxAge: time.Hour}
+	c := newCachingClient(t, node, nil, opts)
+	assert.Equal(t, "on disk", read(t, c, "doc"))
+	c.Close()
+
+	// A new client checks the copies it finds before serving them.
+	c = newCachingClient(t, node, nil, opts)
+	assert.Equal(t, CacheStats{Objects: 1, DiskBytes: 7}, c.CacheStats())
+	assert.Equal(t, "on disk", read(t, c, "doc"))
+	assert.Equal(t, "on disk", read(t, c, "doc"))
+	st := c.CacheStats()
+	assert.Equal(t, int64(2), st.Hits)
+	assert.Equal(t, int64(1), st.Revalidated)
+	assert.Zero(t, st.Misses)
+	assert.Equal(t, 2, node.hits())
+}
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	node := newFakeNode(t)
+	for _, key := range []string{"a", "b", "c"} {
+		node.put(key, []byte("0123456789"))
+	}
+	node.put("large", make([]byte, 100))
+	c := newCachingClient(t, node, nil, CacheOptions{MemoryBytes: 20, MaxAge: time.Hour})
+
+	read(t, c, "a")
+	read(t, c, "b")
+	read(t, c, "a")
+	read(t, c, "c")
+	read(t, c, "large")
+	st := c.CacheStats()
+	assert.Equal(t, 2, st.Objects)
+	assert.Equal(t, int64(20), st.MemoryBytes)
+	hits := node.hits()
+	read(t, c, "a")
+	read(t, c, "c")
+	assert.Equal(t, hits, node.hits())
+	read(t, c, "b")
+	assert.Equal(t, hits+1, node.hits())
+}
+
+func TestCacheOptionsAreValidated(t *testing.T) {
+	for _, opts := range []CacheOptions{
+		{},
+		{MemoryBytes: -1},
+		{MemoryBytes: 1, MaxAge: -time.Second},
+		{Dir: t.TempDir()},
+	} {
+		_, err := New(Options{Endpoints: []string{"localhost:3000"}, HealthCheckInterval: -1, Cache: &opts})
+		assert.True(t, errors.IsType(err, errors.ConfigError), "%+v", opts)
+	}
+}
@@ -0,0 +1,795 @@
+// Package client gives applications resilient access to a cluster through
+// the HTTP API of its nodes. A Client is given the addresses of several
+// nodes and sends every request to one of them, failing over to the next
+// when it is unreachable or shutting down, and retrying the requests that
+// failed for reasons that may go away. It can also keep copies of the
+// objects it reads (see CacheOptions).
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anthdm/foreverstore/clock"
+	"github.com/anthdm/foreverstore/errors"
+	"github.com/anthdm/foreverstore/logger"
+	"github.com/anthdm/foreverstore/retry"
+)
+
+// Defaults for the zero values of Options.
+const (
+	DefaultStoreTimeout        = 5 * time.Minute
+	DefaultGetTimeout          = 5 * time.Minute
+	DefaultListTimeout         = 30 * time.Second
+	DefaultDeleteTimeout       = 30 * time.Second
+	DefaultStatTimeout         = 30 * time.Second
+	DefaultHealthTimeout       = 2 * time.Second
+	DefaultHealthCheckInterval = 10 * time.Second
+)
+
+// Timeouts bound each kind of operation, including the retries and
+// failovers it takes. A Get is bounded until its reader is closed.
+type Timeouts struct {
+	Store  time.Duration
+	Get    time.Duration
+	List   time.Duration
+	Delete time.Duration
+	Stat   time.Duration
+	Health time.Duration
+}
+
+// Options configures a Client.
+type Options struct {
+	// Endpoints are the addresses of the HTTP APIs of the nodes, as
+	// host:port or as URLs. Requests go to the first healthy one in order.
+	Endpoints []string
+	Timeouts  Timeouts
+	// Retry is the policy for the operations that failed on every
+	// endpoint with an error that may go away. The zero value means
+	// retry.DefaultRetryConfig.
+	Retry retry.RetryConfig
+	// HealthCheckInterval is how often the endpoints are probed, for those
+	// found down to be used again once they recover. Negative disables the
+	// checks: endpoints found down are then tried again only once every
+	// other one is down too.
+	HealthCheckInterval time.Duration
+	// HTTPClient sends the requests; nil means http.DefaultClient.
+	HTTPClient *http.Client
+	// Token is sent as a bearer token with every request, when set: the
+	// nodes only serve the writes presenting their admin token.
+	Token string
+	// Clock times the health checks; nil means the wall clock.
+	Clock clock.Clock
+	// Cache, when set, has the client keep copies of the objects it reads
+	// (see CacheOptions).
+	Cache *CacheOptions
+}
+
+// API is the operations of a Client on the objects of a cluster, for
+// applications to depend on, and to substitute with the in-memory
+// implementation of the fstest package in their tests.
+type API interface {
+	Store(ctx context.Context, key string, r io.Reader) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	List(ctx context.Context, prefix, cursor string, limit int) ([]Object, string, error)
+	ListDir(ctx context.Context, prefix, delimiter, cursor string, limit int) (Listing, error)
+	Delete(ctx context.Context, key string) error
+	Stat(ctx context.Context, key string) (ObjectInfo, error)
+}
+
+var _ API = (*Client)(nil)
+
+// Object is an object listed by List.
+type Object struct {
+	Key  string `json:"key"`
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+// ObjectInfo is the metadata of an object returned by Stat.
+type ObjectInfo struct {
+	Key string `json:"key"`
+	// Size is -1 when the node serving the object does not know it ahead.
+	Size         int64     `json:"size"`
+	ContentType  string    `json:"content_type,omitempty"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified time.Time `json:"last_modified,omitempty"`
+	// SHA256 is the SHA-256 of the content of the object, hex encoded,
+	// empty for objects stored before nodes recorded it.
+	SHA256 string `json:"sha256,omitempty"`
+	// Attributes are the attributes the object was stored with, as tags.
+	Attributes map[string]string `json:"attributes,omitempty"`
+	// Encrypted is set when the object was encrypted by its client.
+	Encrypted bool `json:"encrypted,omitempty"`
+	// Locked is set while the object is immutable, until RetainUntil when
+	// it is set.
+	Locked      bool       `json:"locked,omitempty"`
+	RetainUntil *time.Time `json:"retain_until,omitempty"`
+}
+
+// Headers of the object metadata served by the nodes.
+const (
+	headerClientEncrypted       = "X-Client-Encrypted"
+	headerMetaPrefix            = "X-Meta-"
+	headerObjectLock            = "X-Object-Lock"
+	headerObjectLockRetainUntil = "X-Object-Lock-Retain-Until"
+	headerIdempotencyKey        = "Idempotency-Key"
+	headerChecksum              = "X-Checksum-SHA256"
+)
+
+// Listing is a page of ListDir. NextCursor is empty on the last page.
+type Listing struct {
+	Objects    []Object `json:"objects"`
+	Prefixes   []string `json:"prefixes"`
+	NextCursor string   `json:"next_cursor"`
+}
+
+// EndpointStatus is the state of an endpoint as seen by a Client.
+type EndpointStatus struct {
+	URL     string `json:"url"`
+	Healthy bool   `json:"healthy"`
+	// LastError is why the endpoint was last found down.
+	LastError string `json:"last_error,omitempty"`
+}
+
+type endpoint struct {
+	url     string
+	healthy bool
+	lastErr error
+}
+
+// Client sends requests to the nodes of a cluster. It is safe for
+// concurrent use.
+type Client struct {
+	opts   Options
+	http   *http.Client
+	clock  clock.Clock
+	logger *logger.Logger
+	// cache keeps the objects read, when the client has one.
+	cache *cache
+
+	mu        sync.Mutex
+	endpoints []*endpoint
+	// current is the endpoint requests go to first, until it fails.
+	current int
+
+	quitch    chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// New returns a Client for the given endpoints, and starts checking their
+// health, and watching their change feed for its cache to drop the objects
+// changed, in the background until it is closed.
+func New(opts Options) (*Client, error) {
+	if len(opts.Endpoints) == 0 {
+		return nil, errors.NewConfigError("at least one endpoint is required")
+	}
+	if opts.Timeouts.Store == 0 {
+		opts.Timeouts.Store = DefaultStoreTimeout
+	}
+	if opts.Timeouts.Get == 0 {
+		opts.Timeouts.Get = DefaultGetTimeout
+	}
+	if opts.Timeouts.List == 0 {
+		opts.Timeouts.List = DefaultListTimeout
+	}
+	if opts.Timeouts.Delete == 0 {
+		opts.Timeouts.Delete = DefaultDeleteTimeout
+	}
+	if opts.Timeouts.Stat == 0 {
+		opts.Timeouts.Stat = DefaultStatTimeout
+	}
+	if opts.Timeouts.Health == 0 {
+		opts.Timeouts.Health = DefaultHealthTimeout
+	}
+	if opts.Retry.MaxAttempts == 0 {
+		opts.Retry = retry.DefaultRetryConfig()
+	}
+	if opts.HealthCheckInterval == 0 {
+		opts.HealthCheckInterval = DefaultHealthCheckInterval
+	}
+
+	c := &Client{
+		opts:   opts,
+		http:   opts.HTTPClient,
+		clock:  opts.Clock,
+		logger: logger.WithPrefix("CLIENT"),
+		quitch: make(chan struct{}),
+	}
+	if c.http == nil {
+		c.http = http.DefaultClient
+	}
+	if c.clock == nil {
+		c.clock = clock.Real()
+	}
+	if c.opts.Retry.Clock == nil {
+		c.opts.Retry.Clock = c.clock
+	}
+	for _, addr := range opts.Endpoints {
+		u, err := endpointURL(addr)
+		if err != nil {
+			return nil, err
+		}
+		c.endpoints = append(c.endpoints, &endpoint{url: u, healthy: true})
+	}
+	if opts.Cache != nil {
+		cache, err := newCache(*opts.Cache)
+		if err != nil {
+			return nil, err
+		}
+		c.cache = cache
+	}
+
+	if opts.HealthCheckInterval > 0 {
+		c.wg.Add(1)
+		go c.healthLoop()
+	}
+	if c.cache != nil && opts.Cache.WatchChanges {
+		for _, ep := range c.endpoints {
+			c.wg.Add(1)
+			go c.watchChanges(ep.url)
+		}
+	}
+	return c, nil
+}
+
+// endpointURL returns the base URL of the endpoint at addr.
+func endpointURL(addr string) (string, error) {
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	u, err := url.Parse(addr)
+	if err != nil || u.Host == "" {
+		return "", errors.NewConfigError(fmt.Sprintf("invalid endpoint: %s", addr))
+	}
+	return strings.TrimSuffix(u.String(), "/"), nil
+}
+
+// Close stops the health checks and the watching of the change feeds.
+func (c *Client) Close() error {
+	c.closeOnce.Do(func() { close(c.quitch) })
+	c.wg.Wait()
+	return nil
+}
+
+// Endpoints returns the state of the endpoints of the client, in the order
+// they were given.
+func (c *Client) Endpoints() []EndpointStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	status := make([]EndpointStatus, len(c.endpoints))
+	for i, ep := range c.endpoints {
+		status[i] = EndpointStatus{URL: ep.url, Healthy: ep.healthy}
+		if !ep.healthy && ep.lastErr != nil {
+			status[i].LastError = ep.lastErr.Error()
+		}
+	}
+	return status
+}
+
+// Store stores the content of r under key. The content is read into memory
+// first, for it to be sent again when the request is retried.
+func (c *Client) Store(ctx context.Context, key string, r io.Reader) error {
+	_, err := c.StoreChecksum(ctx, key, r)
+	return err
+}
+
+// StoreChecksum is Store returning the SHA-256 of the content stored, hex
+// encoded. The checksum is sent along with the content, and the node
+// refuses content that does not hash to it with a ChecksumError before
+// acknowledging the store, so what was stored is what was read from r.
+func (c *Client) StoreChecksum(ctx context.Context, key string, r io.Reader) (string, error) {
+	if key == "" {
+		return "", errors.NewInvalidInputError("key is required")
+	}
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return "", errors.Wrap(err, errors.InvalidInputError, "failed to read object")
+	}
+	sum := sha256.Sum256(body)
+	checksum := hex.EncodeToString(sum[:])
+	// Every attempt carries the same token, so that a node that applied an
+	// attempt whose answer was lost does not apply the next.
+	token, err := newIdempotencyKey()
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.opts.Timeouts.Store)
+	defer cancel()
+	resp, err := c.do(ctx, "store", func(base string) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPut, base+"/objects/"+url.PathEscape(key), bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set(headerIdempotencyKey, token)
+		req.Header.Set(headerChecksum, checksum)
+		return req, nil
+	})
+	if c.cache != nil {
+		c.cache.invalidate(key, "")
+	}
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if got := resp.Header.Get(headerChecksum); got != "" && got != checksum {
+		return "", errors.NewCorruptionError(fmt.Sprintf("node stored content of checksum %s, sent %s", got, checksum)).
+			WithContext("key", key)
+	}
+	return checksum, nil
+}
+
+// newIdempotencyKey returns a random token identifying a store across its
+// attempts.
+func newIdempotencyKey() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, errors.InternalError, "failed to generate idempotency key")
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Get returns a reader of the object stored under key. The reader must be
+// closed; the Get timeout bounds the reading of the object too. Clients
+// with a cache serve the copy they keep when the object did not change.
+func (c *Client) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	if key == "" {
+		return nil, errors.NewInvalidInputError("key is required")
+	}
+	if c.cache != nil {
+		return c.getCached(ctx, key)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.opts.Timeouts.Get)
+	resp, err := c.do(ctx, "get", func(base string) (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodGet, base+"/objects/"+url.PathEscape(key), nil)
+	})
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &objectReader{ReadCloser: checked(key, resp), cancel: cancel}, nil
+}
+
+// GetRange returns a reader of length bytes of the object stored under
+// key from offset, up to its end when length is negative, and the size of
+// the whole object. The reader must be closed. Ranges are neither cached
+// nor checked against the checksum of the object, which covers all of it.
+func (c *Client) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, int64, error) {
+	if key == "" {
+		return nil, 0, errors.NewInvalidInputError("key is required")
+	}
+	if offset < 0 || length == 0 {
+		return nil, 0, errors.NewInvalidInputError("invalid range")
+	}
+	rng := fmt.Sprintf("bytes=%d-", offset)
+	if length > 0 {
+		rng += strconv.FormatInt(offset+length-1, 10)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.opts.Timeouts.Get)
+	resp, err := c.do(ctx, "get", func(base string) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, base+"/objects/"+url.PathEscape(key), nil)
+		if err == nil {
+			req.Header.Set("Range", rng)
+		}
+		return req, err
+	})
+	if err != nil {
+		cancel()
+		return nil, 0, err
+	}
+
+	if resp.StatusCode == http.StatusPartialContent {
+		size, err := contentRangeSize(resp.Header.Get("Content-Range"))
+		if err != nil {
+			resp.Body.Close()
+			cancel()
+			return nil, 0, err
+		}
+		return &objectReader{ReadCloser: resp.Body, cancel: cancel}, size, nil
+	}
+
+	// A node that ignored the range sent the whole object.
+	var body io.Reader = resp.Body
+	if _, err := io.CopyN(io.Discard, body, offset); err != nil && err != io.EOF {
+		resp.Body.Close()
+		cancel()
+		return nil, 0, errors.Wrap(err, errors.NetworkError, "failed to read object")
+	}
+	if length > 0 {
+		body = io.LimitReader(body, length)
+	}
+	return &objectReader{ReadCloser: readCloser{Reader: body, Closer: resp.Body}, cancel: cancel}, resp.ContentLength, nil
+}
+
+// contentRangeSize returns the size of the whole object a Content-Range
+// header, bytes first-last/size, gives.
+func contentRangeSize(contentRange string) (int64, error) {
+	i := strings.LastIndex(contentRange, "/")
+	if i < 0 {
+		return 0, errors.NewInternalError("invalid content range").WithContext("content_range", contentRange)
+	}
+	size, err := strconv.ParseInt(contentRange[i+1:], 10, 64)
+	if err != nil {
+		return 0, errors.Wrap(err, errors.InternalError, "invalid content range").WithContext("content_range", contentRange)
+	}
+	return size, nil
+}
+
+// readCloser reads from Reader and closes Closer.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// checked returns the body of resp, an object stored under key, failing
+// with a CorruptionError at its end when it does not hash to the checksum
+// the node sent along, if any.
+func checked(key string, resp *http.Response) io.ReadCloser {
+	want := resp.Header.Get(headerChecksum)
+	if want == "" {
+		return resp.Body
+	}
+	return &checksumReader{ReadCloser: resp.Body, key: key, h: sha256.New(), want: want}
+}
+
+// checksumReader hashes what is read through it, and fails at EOF when it
+// is not want.
+type checksumReader struct {
+	io.ReadCloser
+	key  string
+	h    hash.Hash
+	want string
+}
+
+func (r *checksumReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.h.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(r.h.Sum(nil)) != r.want {
+		return n, errors.NewCorruptionError("object does not match its checksum").WithContext("key", r.key)
+	}
+	return n, err
+}
+
+// objectReader is the body of an object that releases the timeout of the
+// Get when closed.
+type objectReader struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (r *objectReader) Close() error {
+	err := r.ReadCloser.Close()
+	r.cancel()
+	return err
+}
+
+// Delete deletes the object stored under key and its replicas. A delete
+// retried after the node carried it out fails with a FileNotFoundError.
+func (c *Client) Delete(ctx context.Context, key string) error {
+	if key == "" {
+		return errors.NewInvalidInputError("key is required")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.opts.Timeouts.Delete)
+	defer cancel()
+	resp, err := c.do(ctx, "delete", func(base string) (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodDelete, base+"/objects/"+url.PathEscape(key), nil)
+	})
+	if c.cache != nil {
+		c.cache.invalidate(key, "")
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Stat returns the metadata of the object stored under key, without its
+// content.
+func (c *Client) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	if key == "" {
+		return ObjectInfo{}, errors.NewInvalidInputError("key is required")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.opts.Timeouts.Stat)
+	defer cancel()
+	resp, err := c.do(ctx, "stat", func(base string) (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodHead, base+"/objects/"+url.PathEscape(key), nil)
+	})
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	resp.Body.Close()
+	return objectInfo(key, resp), nil
+}
+
+// objectInfo reads the metadata of the object stored under key from the
+// headers of resp.
+func objectInfo(key string, resp *http.Response) ObjectInfo {
+	h := resp.Header
+	info := ObjectInfo{
+		Key:         key,
+		Size:        resp.ContentLength,
+		ContentType: h.Get("Content-Type"),
+		ETag:        h.Get("ETag"),
+		SHA256:      h.Get(headerChecksum),
+	}
+	if t, err := http.ParseTime(h.Get("Last-Modified")); err == nil {
+		info.LastModified = t
+	}
+	info.Encrypted, _ = strconv.ParseBool(h.Get(headerClientEncrypted))
+	info.Locked, _ = strconv.ParseBool(h.Get(headerObjectLock))
+	if t, err := time.Parse(time.RFC3339, h.Get(headerObjectLockRetainUntil)); err == nil {
+		info.RetainUntil = &t
+	}
+	for name, values := range h {
+		if strings.HasPrefix(name, headerMetaPrefix) && len(values) > 0 {
+			if info.Attributes == nil {
+				info.Attributes = make(map[string]string)
+			}
+			info.Attributes[strings.ToLower(strings.TrimPrefix(name, headerMetaPrefix))] = values[0]
+		}
+	}
+	return info
+}
+
+// List returns a page of at most limit objects whose keys start with
+// prefix, and the cursor of the next page, empty on the last one. A limit
+// of 0 lets the node choose.
+func (c *Client) List(ctx context.Context, prefix, cursor string, limit int) ([]Object, string, error) {
+	page, err := c.list(ctx, url.Values{"prefix": {prefix}, "cursor": {cursor}}, limit)
+	if err != nil {
+		return nil, "", err
+	}
+	return page.Objects, page.NextCursor, nil
+}
+
+// ListDir returns a page of at most limit objects and folders under
+// prefix, browsing keys as paths of folders separated by delimiter. The
+// keys that contain delimiter past prefix are folded into the folder they
+// are in: listing photos/ with the delimiter / returns photos/2024/ for
+// photos/2024/img.jpg. Objects and folders are ordered by name, and count
+// alike towards limit.
+func (c *Client) ListDir(ctx context.Context, prefix, delimiter, cursor string, limit int) (Listing, error) {
+	if delimiter == "" {
+		return Listing{}, errors.NewInvalidInputError("delimiter is required")
+	}
+	return c.list(ctx, url.Values{"prefix": {prefix}, "delimiter": {delimiter}, "cursor": {cursor}}, limit)
+}
+
+// list gets a page of GET /objects/.
+func (c *Client) list(ctx context.Context, query url.Values, limit int) (Listing, error) {
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.opts.Timeouts.List)
+	defer cancel()
+	resp, err := c.do(ctx, "list", func(base string) (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodGet, base+"/objects/?"+query.Encode(), nil)
+	})
+	if err != nil {
+		return Listing{}, err
+	}
+	defer resp.Body.Close()
+
+	var page Listing
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		return Listing{}, errors.Wrap(err, errors.NetworkError, "invalid list response")
+	}
+	return page, nil
+}
+
+// do sends the request built by newRequest to the endpoints under the
+// retry policy of the client, and returns the first successful response.
+// Each attempt tries every endpoint once, healthy ones first, moving on to
+// the next when one fails with an error that may go away.
+func (c *Client) do(ctx context.Context, op string, newRequest func(base string) (*http.Request, error)) (*http.Response, error) {
+	var resp *http.Response
+	err := retry.Do(ctx, c.opts.Retry, func() error {
+		var lastErr error
+		for _, i := range c.order() {
+			base := c.endpointURL(i)
+			req, err := newRequest(base)
+			if err != nil {
+				return errors.Wrap(err, errors.InvalidInputError, "failed to build request")
+			}
+			resp, err = c.send(req)
+			if err == nil {
+				c.markUp(i)
+				return nil
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if !errors.IsRetryable(err) {
+				return err
+			}
+			c.logger.Warn("Failed to %s on %s: %v", op, base, err)
+			c.markDown(i, err)
+			lastErr = err
+		}
+		return lastErr
+	})
+	if err == context.DeadlineExceeded {
+		return nil, errors.Wrap(err, errors.TimeoutError, fmt.Sprintf("%s timed out", op))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// send sends req, returning the response if it succeeded, or found what a
+// conditional request asked about unchanged, and the error it reports
+// otherwise.
+func (c *Client) send(req *http.Request) (*http.Response, error) {
+	if c.opts.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.opts.Token)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, errors.NetworkError, fmt.Sprintf("failed to reach %s", req.URL.Host))
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 || resp.StatusCode == http.StatusNotModified {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	return nil, responseError(resp)
+}
+
+// responseError returns the error a node reported in a failed response,
+// with the error type it reported, so that the errors worth retrying are.
+func responseError(resp *http.Response) error {
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	var body struct {
+		Type  errors.ErrorType `json:"type"`
+		Error string           `json:"error"`
+	}
+	if json.Unmarshal(b, &body) == nil && body.Type != "" {
+		return errors.New(body.Type, body.Error).WithContext("status", resp.StatusCode)
+	}
+
+	errorType := errors.InternalError
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		errorType = errors.FileNotFoundError
+	case resp.StatusCode == http.StatusServiceUnavailable, resp.StatusCode == http.StatusBadGateway:
+		errorType = errors.ConnectionError
+	case resp.StatusCode == http.StatusGatewayTimeout:
+		errorType = errors.TimeoutError
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		errorType = errors.InvalidInputError
+	}
+	msg := strings.TrimSpace(string(b))
+	if msg == "" {
+		msg = resp.Status
+	}
+	return errors.New(errorType, msg).WithContext("status", resp.StatusCode)
+}
+
+// order returns the indexes of the endpoints in the order a request tries
+// them: the healthy ones from the current one on, then those found down.
+func (c *Client) order() []int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := len(c.endpoints)
+	order := make([]int, 0, n)
+	for _, healthy := range []bool{true, false} {
+		for k := 0; k < n; k++ {
+			i := (c.current + k) % n
+			if c.endpoints[i].healthy == healthy {
+				order = append(order, i)
+			}
+		}
+	}
+	return order
+}
+
+func (c *Client) endpointURL(i int) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.endpoints[i].url
+}
+
+// markUp records that endpoint i answered, making it the one requests go
+// to first.
+func (c *Client) markUp(i int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ep := c.endpoints[i]
+	if !ep.healthy {
+		c.logger.Info("Endpoint %s is back up", ep.url)
+	}
+	ep.healthy = true
+	ep.lastErr = nil
+	c.current = i
+}
+
+// markDown records that endpoint i failed with err.
+func (c *Client) markDown(i int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.endpoints[i].healthy = false
+	c.endpoints[i].lastErr = err
+}
+
+// healthLoop probes the endpoints every HealthCheckInterval until the
+// client is closed.
+func (c *Client) healthLoop() {
+	defer c.wg.Done()
+	ticker := c.clock.NewTicker(c.opts.HealthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C():
+			c.checkHealth()
+		case <-c.quitch:
+			return
+		}
+	}
+}
+
+// checkHealth probes GET /health on every endpoint. An endpoint found down
+// is used again once it answers. The endpoint requests go to first is only
+// changed by requests, so that a client sticks to one node while it works.
+func (c *Client) checkHealth() {
+	c.mu.Lock()
+	urls := make([]string, len(c.endpoints))
+	for i, ep := range c.endpoints {
+		urls[i] = ep.url
+	}
+	c.mu.Unlock()
+
+	for i, base := range urls {
+		err := c.probe(base)
+		c.mu.Lock()
+		ep := c.endpoints[i]
+		switch {
+		case err == nil && !ep.healthy:
+			c.logger.Info("Endpoint %s is back up", base)
+			ep.healthy = true
+			ep.lastErr = nil
+		case err != nil && ep.healthy:
+			c.logger.Warn("Endpoint %s is down: %v", base, err)
+			ep.healthy = false
+			ep.lastErr = err
+		}
+		c.mu.Unlock()
+	}
+}
+
+// probe checks the health of the endpoint at base.
+func (c *Client) probe(base string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.opts.Timeouts.Health)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, base+"/health", nil)
+	if err != nil {
+		return errors.Wrap(err, errors.InternalError, "failed to build request")
+	}
+	resp, err := c.send(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
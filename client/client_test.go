@@ -0,0 +1,468 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/anthdm/foreverstore/admin"
+	"github.com/anthdm/foreverstore/clock"
+	"github.com/anthdm/foreverstore/errors"
+	"github.com/anthdm/foreverstore/retry"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeNode serves the part of the HTTP API of a node the client uses.
+type fakeNode struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	objects  map[string][]byte
+	draining bool
+	// failures is how many of the next requests fail as if the node could
+	// not reach its peers.
+	failures int
+	requests int
+	// tokens are the idempotency keys of the stores received.
+	tokens []string
+	// block makes requests hang until the client gives up on them.
+	block bool
+	// changes is the change feed of the node, and changed is closed, and
+	// replaced, on every change.
+	changes []change
+	changed chan struct{}
+	// waiting counts the requests waiting for a change.
+	waiting int
+	// garble serves objects with their last byte changed, under the
+	// checksum of what was stored.
+	garble bool
+	// ignoreRanges serves objects whole when a range is asked for.
+	ignoreRanges bool
+}
+
+func newFakeNode(t *testing.T) *fakeNode {
+	n := &fakeNode{objects: make(map[string][]byte), changed: make(chan struct{})}
+	n.Server = httptest.NewServer(http.HandlerFunc(n.serve))
+	t.Cleanup(n.Close)
+	return n
+}
+
+func (n *fakeNode) serve(w http.ResponseWriter, r *http.Request) {
+	n.mu.Lock()
+	draining, block := n.draining, n.block
+	if r.URL.Path == "/health" {
+		n.mu.Unlock()
+		if draining {
+			admin.WriteJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "draining"})
+			return
+		}
+		admin.WriteJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+		return
+	}
+	if r.URL.Path == "/changes" {
+		n.mu.Unlock()
+		n.feed(w, r)
+		return
+	}
+	n.requests++
+	if r.Method == http.MethodPut {
+		n.tokens = append(n.tokens, r.Header.Get(headerIdempotencyKey))
+	}
+	fail := n.failures > 0
+	if fail {
+		n.failures--
+	}
+	n.mu.Unlock()
+
+	switch {
+	case block:
+		<-r.Context().Done()
+		return
+	case draining:
+		admin.WriteError(w, errors.NewConnectionError("server is shutting down"))
+		return
+	case fail:
+		admin.WriteError(w, errors.NewNetworkError("no peers available"))
+		return
+	}
+
+	key := strings.TrimPrefix(r.URL.Path, "/objects/")
+	switch r.Method {
+	case http.MethodPut:
+		b, _ := io.ReadAll(r.Body)
+		if want := r.Header.Get(headerChecksum); want != "" && want != checksumOf(b) {
+			admin.WriteError(w, errors.NewChecksumError("content does not match the checksum sent"))
+			return
+		}
+		n.put(key, b)
+		w.Header().Set(headerChecksum, checksumOf(b))
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodGet, http.MethodHead:
+		if key == "" {
+			n.list(w)
+			return
+		}
+		n.mu.Lock()
+		b, ok := n.objects[key]
+		garble, ignoreRanges := n.garble, n.ignoreRanges
+		n.mu.Unlock()
+		if !ok {
+			admin.WriteError(w, errors.NewFileNotFoundError(key))
+			return
+		}
+		w.Header().Set("ETag", etagOf(b))
+		w.Header().Set(headerChecksum, checksumOf(b))
+		if r.Header.Get("If-None-Match") == etagOf(b) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		if garble && len(b) > 0 {
+			b = append(b[:len(b)-1:len(b)-1], b[len(b)-1]^1)
+		}
+		if r.Header.Get("Range") != "" && !ignoreRanges {
+			http.ServeContent(w, r, key, time.Time{}, bytes.NewReader(b))
+			return
+		}
+		w.Write(b)
+	case http.MethodDelete:
+		n.mu.Lock()
+		_, ok := n.objects[key]
+		if ok {
+			delete(n.objects, key)
+			n.record(change{Key: key})
+		}
+		n.mu.Unlock()
+		if !ok {
+			admin.WriteError(w, errors.NewFileNotFoundError(key))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (n *fakeNode) list(w http.ResponseWriter) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	objects := []Object{}
+	for key, b := range n.objects {
+		objects = append(objects, Object{Key: key, Size: int64(len(b))})
+	}
+	admin.WriteJSON(w, http.StatusOK, map[string]interface{}{"objects": objects})
+}
+
+// put stores b under key, as if written by any client.
+func (n *fakeNode) put(key string, b []byte) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.objects[key] = b
+	n.record(change{Key: key, Hash: etagOf(b)})
+}
+
+// record adds ch to the change feed. Callers hold mu.
+func (n *fakeNode) record(ch change) {
+	n.changes = append(n.changes, ch)
+	close(n.changed)
+	n.changed = make(chan struct{})
+}
+
+// feed serves the changes after the cursor asked for, waiting for one as
+// long as asked.
+func (n *fakeNode) feed(w http.ResponseWriter, r *http.Request) {
+	cursor, _ := strconv.Atoi(r.URL.Query().Get("cursor"))
+	wait, _ := time.ParseDuration(r.URL.Query().Get("wait"))
+	timeout := time.After(wait)
+	for {
+		n.mu.Lock()
+		list := changeList{Changes: n.changes[cursor:], Cursor: uint64(len(n.changes)), Last: uint64(len(n.changes))}
+		changed := n.changed
+		if len(list.Changes) > 0 || wait == 0 {
+			n.mu.Unlock()
+			admin.WriteJSON(w, http.StatusOK, list)
+			return
+		}
+		n.waiting++
+		n.mu.Unlock()
+		select {
+		case <-changed:
+		case <-timeout:
+			wait = 0
+		case <-r.Context().Done():
+		}
+		n.mu.Lock()
+		n.waiting--
+		n.mu.Unlock()
+		if r.Context().Err() != nil {
+			return
+		}
+	}
+}
+
+func etagOf(b []byte) string {
+	return `"` + checksumOf(b) + `"`
+}
+
+func checksumOf(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func (n *fakeNode) set(f func(n *fakeNode)) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	f(n)
+}
+
+func (n *fakeNode) hits() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.requests
+}
+
+var fastRetry = retry.RetryConfig{MaxAttempts: 3, InitialDelay: time.Millisecond, MaxDelay: time.Millisecond, Multiplier: 1}
+
+func TestClientFailsOverToHealthyEndpoint(t *testing.T) {
+	down := newFakeNode(t)
+	down.Close()
+	draining := newFakeNode(t)
+	draining.set(func(n *fakeNode) { n.draining = true })
+	up := newFakeNode(t)
+
+	c, err := New(Options{
+		Endpoints:           []string{down.URL, draining.URL, strings.TrimPrefix(up.URL, "http://")},
+		Retry:               fastRetry,
+		HealthCheckInterval: -1,
+	})
+	assert.Nil(t, err)
+	defer c.Close()
+
+	ctx := context.Background()
+	assert.Nil(t, c.Store(ctx, "doc", bytes.NewReader([]byte("hello"))))
+	r, err := c.Get(ctx, "doc")
+	assert.Nil(t, err)
+	b, _ := io.ReadAll(r)
+	r.Close()
+	assert.Equal(t, "hello", string(b))
+
+	// The client sticks to the endpoint that answered.
+	assert.Equal(t, 1, draining.hits())
+	assert.Equal(t, 2, up.hits())
+	status := c.Endpoints()
+	assert.False(t, status[0].Healthy)
+	assert.False(t, status[1].Healthy)
+	assert.Contains(t, status[1].LastError, "shutting down")
+	assert.True(t, status[2].Healthy)
+
+	objects, next, err := c.List(ctx, "", "", 10)
+	assert.Nil(t, err)
+	assert.Equal(t, []Object{{Key: "doc", Size: 5}}, objects)
+	assert.Empty(t, next)
+}
+
+func TestClientHealthChecksRecoverEndpoints(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	first := newFakeNode(t)
+	first.set(func(n *fakeNode) { n.draining = true })
+	second := newFakeNode(t)
+
+	c, err := New(Options{
+		Endpoints:           []string{first.URL, second.URL},
+		Retry:               fastRetry,
+		HealthCheckInterval: time.Second,
+		Clock:               clk,
+	})
+	assert.Nil(t, err)
+	defer c.Close()
+
+	clk.BlockUntil(1)
+	clk.Advance(time.Second)
+	assert.Eventually(t, func() bool { return !c.Endpoints()[0].Healthy }, time.Second, time.Millisecond)
+
+	// An endpoint found down by the checks is not tried first.
+	assert.Nil(t, c.Store(context.Background(), "doc", bytes.NewReader([]byte("x"))))
+	assert.Equal(t, 0, first.hits())
+	assert.Equal(t, 1, second.hits())
+
+	first.set(func(n *fakeNode) { n.draining = false })
+	clk.Advance(time.Second)
+	assert.Eventually(t, func() bool { return c.Endpoints()[0].Healthy }, time.Second, time.Millisecond)
+
+	// Requests stay on the endpoint that works, and fail back over when it
+	// goes down.
+	assert.Nil(t, c.Store(context.Background(), "doc", bytes.NewReader([]byte("y"))))
+	assert.Equal(t, 2, second.hits())
+	second.set(func(n *fakeNode) { n.draining = true })
+	assert.Nil(t, c.Store(context.Background(), "doc", bytes.NewReader([]byte("z"))))
+	assert.Equal(t, 1, first.hits())
+}
+
+func TestClientRetriesTransientErrors(t *testing.T) {
+	node := newFakeNode(t)
+	c, err := New(Options{Endpoints: []string{node.URL}, Retry: fastRetry, HealthCheckInterval: -1})
+	assert.Nil(t, err)
+	defer c.Close()
+	ctx := context.Background()
+
+	node.set(func(n *fakeNode) { n.failures = 2 })
+	assert.Nil(t, c.Store(ctx, "doc", bytes.NewReader([]byte("hello"))))
+	assert.Equal(t, 3, node.hits())
+
+	node.set(func(n *fakeNode) { n.failures = 3 })
+	err = c.Store(ctx, "doc", bytes.NewReader([]byte("hello")))
+	assert.True(t, errors.IsType(err, errors.NetworkError), "%v", err)
+	assert.Equal(t, 6, node.hits())
+
+	// The attempts of a store carry the same idempotency key, and distinct
+	// stores distinct keys.
+	node.set(func(n *fakeNode) {
+		assert.Len(t, n.tokens, 6)
+		assert.NotEmpty(t, n.tokens[0])
+		assert.Equal(t, []string{n.tokens[0], n.tokens[0]}, n.tokens[1:3])
+		assert.Equal(t, []string{n.tokens[3], n.tokens[3]}, n.tokens[4:6])
+		assert.NotEqual(t, n.tokens[0], n.tokens[3])
+	})
+
+	// Errors that would happen again are not retried.
+	_, err = c.Get(ctx, "missing")
+	assert.True(t, errors.IsType(err, errors.FileNotFoundError), "%v", err)
+	assert.Equal(t, 7, node.hits())
+}
+
+func TestClientDeletesObjects(t *testing.T) {
+	node := newFakeNode(t)
+	c, err := New(Options{Endpoints: []string{node.URL}, Retry: fastRetry, HealthCheckInterval: -1})
+	assert.Nil(t, err)
+	defer c.Close()
+	ctx := context.Background()
+
+	assert.Nil(t, c.Store(ctx, "doc", bytes.NewReader([]byte("hello"))))
+	node.set(func(n *fakeNode) { n.failures = 1 })
+	assert.Nil(t, c.Delete(ctx, "doc"))
+	_, err = c.Get(ctx, "doc")
+	assert.True(t, errors.IsType(err, errors.FileNotFoundError), "%v", err)
+	err = c.Delete(ctx, "doc")
+	assert.True(t, errors.IsType(err, errors.FileNotFoundError), "%v", err)
+	assert.True(t, errors.IsType(c.Delete(ctx, ""), errors.InvalidInputError))
+}
+
+func TestClientChecksObjectsAgainstTheirChecksum(t *testing.T) {
+	node := newFakeNode(t)
+	c, err := New(Options{Endpoints: []string{node.URL}, Retry: fastRetry, HealthCheckInterval: -1})
+	assert.Nil(t, err)
+	defer c.Close()
+	ctx := context.Background()
+
+	sum, err := c.StoreChecksum(ctx, "doc", bytes.NewReader([]byte("hello")))
+	assert.Nil(t, err)
+	assert.Equal(t, checksumOf([]byte("hello")), sum)
+	info, err := c.Stat(ctx, "doc")
+	assert.Nil(t, err)
+	assert.Equal(t, sum, info.SHA256)
+	r, err := c.Get(ctx, "doc")
+	assert.Nil(t, err)
+	b, err := io.ReadAll(r)
+	r.Close()
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(b))
+
+	// Content altered on its way is noticed once read whole.
+	node.set(func(n *fakeNode) { n.garble = true })
+	r, err = c.Get(ctx, "doc")
+	assert.Nil(t, err)
+	_, err = io.ReadAll(r)
+	r.Close()
+	assert.True(t, errors.IsType(err, errors.CorruptionError), "%v", err)
+}
+
+func TestClientGetsRanges(t *testing.T) {
+	node := newFakeNode(t)
+	c, err := New(Options{Endpoints: []string{node.URL}, Retry: fastRetry, HealthCheckInterval: -1})
+	assert.Nil(t, err)
+	defer c.Close()
+	ctx := context.Background()
+	assert.Nil(t, c.Store(ctx, "doc", bytes.NewReader([]byte("hello world"))))
+
+	readRange := func(offset, length int64) string {
+		t.Helper()
+		r, size, err := c.GetRange(ctx, "doc", offset, length)
+		if !assert.Nil(t, err) {
+			return ""
+		}
+		defer r.Close()
+		assert.Equal(t, int64(11), size)
+		b, err := io.ReadAll(r)
+		assert.Nil(t, err)
+		return string(b)
+	}
+	assert.Equal(t, "lo w", readRange(3, 4))
+	assert.Equal(t, "world", readRange(6, -1))
+
+	// A node that sends the whole object is read past the range.
+	node.set(func(n *fakeNode) { n.ignoreRanges = true })
+	assert.Equal(t, "lo w", readRange(3, 4))
+	assert.Equal(t, "world", readRange(6, -1))
+	node.set(func(n *fakeNode) { n.ignoreRanges = false })
+
+	_, _, err = c.GetRange(ctx, "doc", 20, 5)
+	assert.True(t, errors.IsType(err, errors.InvalidInputError), "%v", err)
+	_, _, err = c.GetRange(ctx, "doc", 0, 0)
+	assert.True(t, errors.IsType(err, errors.InvalidInputError), "%v", err)
+}
+
+func TestObjectInfoFromHeaders(t *testing.T) {
+	resp := &http.Response{ContentLength: 5, Header: http.Header{}}
+	resp.Header.Set("Content-Type", "text/plain")
+	resp.Header.Set("ETag", `"abc"`)
+	resp.Header.Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+	resp.Header.Set("X-Meta-Team", "finance")
+	resp.Header.Set("X-Object-Lock", "true")
+	resp.Header.Set("X-Object-Lock-Retain-Until", "2030-01-01T00:00:00Z")
+	resp.Header.Set("X-Checksum-SHA256", checksumOf([]byte("hello")))
+
+	info := objectInfo("doc", resp)
+	assert.Equal(t, "doc", info.Key)
+	assert.Equal(t, int64(5), info.Size)
+	assert.Equal(t, "text/plain", info.ContentType)
+	assert.Equal(t, `"abc"`, info.ETag)
+	assert.Equal(t, checksumOf([]byte("hello")), info.SHA256)
+	assert.Equal(t, 2006, info.LastModified.Year())
+	assert.Equal(t, map[string]string{"team": "finance"}, info.Attributes)
+	assert.True(t, info.Locked)
+	if assert.NotNil(t, info.RetainUntil) {
+		assert.Equal(t, 2030, info.RetainUntil.Year())
+	}
+	assert.False(t, info.Encrypted)
+}
+
+func TestClientOperationTimeouts(t *testing.T) {
+	node := newFakeNode(t)
+	node.set(func(n *fakeNode) { n.block = true })
+	c, err := New(Options{
+		Endpoints:           []string{node.URL},
+		Timeouts:            Timeouts{Get: 50 * time.Millisecond},
+		Retry:               fastRetry,
+		HealthCheckInterval: -1,
+	})
+	assert.Nil(t, err)
+	defer c.Close()
+
+	start := time.Now()
+	_, err = c.Get(context.Background(), "doc")
+	assert.True(t, errors.IsType(err, errors.TimeoutError), "%v", err)
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestNewValidatesEndpoints(t *testing.T) {
+	_, err := New(Options{})
+	assert.True(t, errors.IsType(err, errors.ConfigError))
+	_, err = New(Options{Endpoints: []string{"http://"}})
+	assert.True(t, errors.IsType(err, errors.ConfigError))
+}
@@ -0,0 +1,72 @@
+package clock
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var epoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func fired(ch <-chan time.Time) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestFakeAfterFiresOnAdvance(t *testing.T) {
+	f := NewFake(epoch)
+	ch := f.After(time.Second)
+
+	f.Advance(999 * time.Millisecond)
+	assert.False(t, fired(ch))
+	f.Advance(time.Millisecond)
+	assert.True(t, fired(ch))
+	assert.Equal(t, epoch.Add(time.Second), f.Now())
+	assert.Equal(t, 0, f.Waiters())
+}
+
+func TestFakeSleepUnblocksAfterAdvance(t *testing.T) {
+	f := NewFake(epoch)
+	done := make(chan struct{})
+	go func() {
+		f.Sleep(time.Minute)
+		close(done)
+	}()
+
+	f.BlockUntil(1)
+	f.Advance(time.Minute)
+	<-done
+	assert.Equal(t, time.Minute, f.Since(epoch))
+}
+
+func TestFakeTicker(t *testing.T) {
+	f := NewFake(epoch)
+	ticker := f.NewTicker(10 * time.Second)
+
+	f.Advance(10 * time.Second)
+	assert.Equal(t, epoch.Add(10*time.Second), <-ticker.C())
+
+	// Ticks for a receiver that falls behind are dropped.
+	f.Advance(30 * time.Second)
+	assert.Equal(t, epoch.Add(20*time.Second), <-ticker.C())
+	assert.False(t, fired(ticker.C()))
+
+	ticker.Stop()
+	f.Advance(time.Minute)
+	assert.False(t, fired(ticker.C()))
+	assert.Equal(t, 0, f.Waiters())
+}
+
+func TestFakeFiresInDeadlineOrder(t *testing.T) {
+	f := NewFake(epoch)
+	late, early := f.After(2*time.Second), f.After(time.Second)
+
+	f.Advance(5 * time.Second)
+	assert.Equal(t, epoch.Add(time.Second), <-early)
+	assert.Equal(t, epoch.Add(2*time.Second), <-late)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Object locks, lifecycle rules and tombstones are timed by the clock of
+// each node, so nodes whose clocks drift apart disagree on when a lock
+// ends or an object expires. The capacity reports the peers send every
+// CapacityInterval, and the one in their hello, carry the time they were
+// sent at; the difference with the time they are received at is how far
+// ahead the clock of the peer is, less the time the report took to arrive.
+// What is ordered across nodes does not depend on their clocks: cluster
+// settings are ordered by version, and an object only ever changes on its
+// owner.
+
+// clockSkewSamples is the number of reports of a peer its skew is
+// estimated from. The delay of a report only makes the peer seem further
+// behind, so the estimate is the largest of them.
+const clockSkewSamples = 5
+
+// PeerClockSkew is how far ahead of the clock of this node the clock of a
+// peer is, negative when it is behind.
+type PeerClockSkew struct {
+	Peer string        `json:"peer"`
+	Skew time.Duration `json:"skew"`
+	// Exceeded is set while the skew is beyond MaxClockSkew.
+	Exceeded   bool      `json:"exceeded,omitempty"`
+	ObservedAt time.Time `json:"observed_at"`
+}
+
+type peerClock struct {
+	samples    []time.Duration
+	exceeded   bool
+	observedAt time.Time
+}
+
+// estimate returns the skew estimated from the samples.
+func (c *peerClock) estimate() time.Duration {
+	skew := c.samples[0]
+	for _, sample := range c.samples[1:] {
+		if sample > skew {
+			skew = sample
+		}
+	}
+	return skew
+}
+
+type clockSkewTracker struct {
+	mu    sync.Mutex
+	peers map[string]*peerClock
+}
+
+// forget drops the samples of the peer at addr.
+func (t *clockSkewTracker) forget(addr string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.peers, addr)
+}
+
+// observeClock records that the peer at from sent a report at sentAt, by
+// its clock, and warns when its clock goes further off than MaxClockSkew,
+// or comes back within it. Reports of peers that do not tell when they
+// sent them are ignored.
+func (s *FileServer) observeClock(from string, sentAt time.Time) {
+	if sentAt.IsZero() {
+		return
+	}
+	now := s.Clock.Now()
+
+	t := &s.clockSkew
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.peers == nil {
+		t.peers = make(map[string]*peerClock)
+	}
+	c, ok := t.peers[from]
+	if !ok {
+		c = &peerClock{}
+		t.peers[from] = c
+	}
+	c.samples = append(c.samples, sentAt.Sub(now))
+	if len(c.samples) > clockSkewSamples {
+		c.samples = c.samples[1:]
+	}
+	c.observedAt = now
+
+	skew := c.estimate()
+	exceeded := skew > s.MaxClockSkew || skew < -s.MaxClockSkew
+	switch {
+	case exceeded && !c.exceeded:
+		s.logger.Warn("Clock of peer %s is %s off ours, more than the %s tolerated: synchronize the clocks of the nodes",
+			from, skew, s.MaxClockSkew)
+	case !exceeded && c.exceeded:
+		s.logger.Info("Clock of peer %s is back within %s of ours", from, s.MaxClockSkew)
+	}
+	c.exceeded = exceeded
+}
+
+// ClockSkew returns how far off the clock of each peer is, as last
+// estimated, ordered by peer address.
+func (s *FileServer) ClockSkew() []PeerClockSkew {
+	t := &s.clockSkew
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	skews := make([]PeerClockSkew, 0, len(t.peers))
+	for addr, c := range t.peers {
+		skews = append(skews, PeerClockSkew{
+			Peer:       addr,
+			Skew:       c.estimate(),
+			Exceeded:   c.exceeded,
+			ObservedAt: c.observedAt,
+		})
+	}
+	sort.Slice(skews, func(i, j int) bool { return skews[i].Peer < skews[j].Peer })
+	return skews
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/anthdm/foreverstore/clock"
+	"github.com/stretchr/testify/assert"
+)
+
+// aheadClock is a clock ahead of another by a fixed offset.
+type aheadClock struct {
+	clock.Clock
+	offset time.Duration
+}
+
+func (c aheadClock) Now() time.Time { return c.Clock.Now().Add(c.offset) }
+
+func TestClockSkewIsEstimatedFromCapacityReports(t *testing.T) {
+	c := newTestClusterWith(t, 3, func(node int, opts *FileServerOpts) {
+		if node == 1 {
+			opts.Clock = aheadClock{opts.Clock, time.Minute}
+		}
+	})
+	s := c.nodes[0]
+	c.eventually("the hellos to tell the clocks of the peers", func() bool { return len(s.ClockSkew()) == 2 })
+
+	skews := s.ClockSkew()
+	assert.Equal(t, "node-1", skews[0].Peer)
+	assertSkew(t, time.Minute, skews[0].Skew)
+	assert.True(t, skews[0].Exceeded)
+	assert.Equal(t, "node-2", skews[1].Peer)
+	assertSkew(t, 0, skews[1].Skew)
+	assert.False(t, skews[1].Exceeded)
+
+	// A report delayed in transit does not move the estimate.
+	now := s.Clock.Now()
+	s.observeClock("node-2", now.Add(-time.Hour))
+	assertSkew(t, 0, s.ClockSkew()[1].Skew)
+
+	// Once the clock of the peer is fixed, its next reports bring it back
+	// within the skew tolerated.
+	for i := 0; i < clockSkewSamples; i++ {
+		s.observeClock("node-1", s.Clock.Now())
+	}
+	assertSkew(t, 0, s.ClockSkew()[0].Skew)
+	assert.False(t, s.ClockSkew()[0].Exceeded)
+
+	assertSkew(t, -time.Minute, c.nodes[1].ClockSkew()[0].Skew)
+}
+
+// assertSkew checks an estimated skew, allowing for the cluster clock having
+// stepped while the report was in transit.
+func assertSkew(t *testing.T, want, got time.Duration) {
+	t.Helper()
+	if d := got - want; d < -clusterStep || d > clusterStep {
+		t.Errorf("skew %v, want %v within %v", got, want, clusterStep)
+	}
+}
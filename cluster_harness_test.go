@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/anthdm/foreverstore/clock"
+	"github.com/anthdm/foreverstore/p2p"
+)
+
+// testCluster runs a fully connected cluster of file servers over an
+// in-memory network that tests can partition and heal. All nodes share a
+// fake clock that only moves while the harness waits for something, so
+// scenarios never sleep and timeouts fire in a reproducible order.
+type testCluster struct {
+	t       testing.TB
+	network *p2p.MemoryNetwork
+	clock   *clock.Fake
+	nodes   []*FileServer
+	// faults injects network failures into each node's transport; none
+	// are injected until a test configures them.
+	faults []*p2p.FaultTransport
+}
+
+// clusterStep is how far the fake clock moves each time the harness polls.
+const clusterStep = 10 * time.Millisecond
+
+// testClusterSecret is the cluster secret the nodes of the tests share.
+var testClusterSecret = []byte("test cluster secret")
+
+// newTestCluster starts n nodes sharing one encryption key, each connected
+// to every other node.
+func newTestCluster(t testing.TB, n int) *testCluster {
+	return newTestClusterWith(t, n, nil)
+}
+
+// newTestClusterWith is newTestCluster with configure, when not nil,
+// adjusting the options of each node before it starts.
+func newTestClusterWith(t testing.TB, n int, configure func(node int, opts *FileServerOpts)) *testCluster {
+	c := &testCluster{
+		t:       t,
+		network: p2p.NewMemoryNetwork(),
+		clock:   clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)),
+	}
+	key := newEncryptionKey()
+
+	for i := 0; i < n; i++ {
+		addr := fmt.Sprintf("node-%d", i)
+		transport := c.network.NewTransport(p2p.MemoryTransportOpts{ListenAddr: addr})
+		faults := p2p.NewFaultTransport(transport, p2p.FaultConfig{}, int64(i))
+		faults.Clock = c.clock
+
+		bootstrap := make([]string, 0, i)
+		for _, node := range c.nodes {
+			bootstrap = append(bootstrap, node.Transport.Addr())
+		}
+
+		opts := FileServerOpts{
+			EncKey:            key,
+			StorageRoot:       t.TempDir(),
+			PathTransformFunc: CASPathTransformFunc,
+			Transport:         faults,
+			BootstrapNodes:    bootstrap,
+			Clock:             c.clock,
+			// The clock runs fast: peers are only declared dead in the
+			// tests of failure detection.
+			HeartbeatInterval: time.Hour,
+		}
+		if configure != nil {
+			configure(i, &opts)
+		}
+		s := NewFileServer(opts)
+		// Nodes shake hands as in production, so that they speak the
+		// current protocol.
+		transport.HandshakeFunc = s.handshake(p2p.HandshakeOpts{Secret: testClusterSecret})
+		transport.OnPeer = faults.OnPeer(s.OnPeer)
+		transport.OnPeerDisconnect = faults.OnPeerDisconnect(s.OnPeerDisconnect)
+		c.nodes = append(c.nodes, s)
+		c.faults = append(c.faults, faults)
+		if err := s.Start(); err != nil {
+			t.Fatalf("node %d failed to start: %v", i, err)
+		}
+	}
+
+	c.eventually("cluster to connect", func() bool {
+		for _, s := range c.nodes {
+			if s.peers.len() != n-1 {
+				return false
+			}
+		}
+		return true
+	})
+
+	t.Cleanup(c.stop)
+	return c
+}
+
+func (c *testCluster) stop() {
+	for _, s := range c.nodes {
+		s.Stop()
+	}
+}
+
+func (c *testCluster) addrs(nodes []int) []string {
+	addrs := make([]string, len(nodes))
+	for i, node := range nodes {
+		addrs[i] = c.nodes[node].Transport.Addr()
+	}
+	return addrs
+}
+
+// partition splits the cluster into groups of node indexes; nodes not
+// listed form one more group.
+func (c *testCluster) partition(groups ...[]int) {
+	addrGroups := make([][]string, len(groups))
+	for i, group := range groups {
+		addrGroups[i] = c.addrs(group)
+	}
+	c.network.Partition(addrGroups...)
+}
+
+func (c *testCluster) heal() {
+	c.network.Heal()
+}
+
+func (c *testCluster) store(node int, key string, data []byte) {
+	c.t.Helper()
+	c.storeObject(node, key, data, nil)
+}
+
+func (c *testCluster) storeObject(node int, key string, data []byte, client *ClientMeta) {
+	c.t.Helper()
+	err := c.run(fmt.Sprintf("node %d to store %s", node, key), func() error {
+		return c.nodes[node].StoreObject(key, bytes.NewReader(data), client)
+	})
+	if err != nil {
+		c.t.Fatalf("node %d failed to store %s: %v", node, key, err)
+	}
+}
+
+// get reads key through node, fetching it from the cluster if needed.
+func (c *testCluster) get(node int, key string) []byte {
+	c.t.Helper()
+	var data []byte
+	err := c.run(fmt.Sprintf("node %d to get %s", node, key), func() error {
+		r, err := c.nodes[node].Get(key)
+		if err != nil {
+			return err
+		}
+		data, err = io.ReadAll(r)
+		return err
+	})
+	if err != nil {
+		c.t.Fatalf("node %d failed to get %s: %v", node, key, err)
+	}
+	return data
+}
+
+// run calls fn, advancing the clock for whatever it waits on.
+func (c *testCluster) run(what string, fn func() error) error {
+	c.t.Helper()
+	done := make(chan error, 1)
+	go func() { done <- fn() }()
+
+	var err error
+	c.eventually(what, func() bool {
+		select {
+		case err = <-done:
+			return true
+		default:
+			return false
+		}
+	})
+	return err
+}
+
+// holds reports whether node has a copy of the key stored by origin: the
+// object itself on the origin, a replica anywhere else.
+func (c *testCluster) holds(node, origin int, key string) bool {
+	o := c.nodes[origin]
+	if node == origin {
+		return o.store.Has(o.ID, key)
+	}
+	return c.nodes[node].store.Has(o.ID, hashKey(key))
+}
+
+// assertConverged waits until every node holds the key stored by origin.
+func (c *testCluster) assertConverged(origin int, key string) {
+	c.t.Helper()
+	c.eventually(fmt.Sprintf("%s to reach every node", key), func() bool {
+		for node := range c.nodes {
+			if !c.holds(node, origin, key) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// assertAbsent checks that none of the given nodes holds the key stored by
+// origin. Writes across a partition are discarded as they are made, so
+// nothing is left in flight once the store has returned.
+func (c *testCluster) assertAbsent(nodes []int, origin int, key string) {
+	c.t.Helper()
+	for _, node := range nodes {
+		if c.holds(node, origin, key) {
+			c.t.Errorf("node %d holds %s", node, key)
+		}
+	}
+}
+
+// eventually advances the clock step by step until cond holds. The
+// goroutines of the cluster get to run between steps; the wall clock
+// deadline only guards against a scenario that never settles.
+func (c *testCluster) eventually(what string, cond func() bool) {
+	c.t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			c.t.Fatalf("timed out waiting for %s", what)
+		}
+		c.clock.Advance(clusterStep)
+		runtime.Gosched()
+	}
+}
+
+func TestClusterReplicatesToAllNodes(t *testing.T) {
+	c := newTestCluster(t, 3)
+
+	c.store(0, "everywhere", []byte("replicated to the whole cluster"))
+	c.assertConverged(0, "everywhere")
+}
+
+func TestPartitionKeepsWritesInsideGroup(t *testing.T) {
+	c := newTestCluster(t, 4)
+
+	c.partition([]int{0, 1}, []int{2, 3})
+	c.store(0, "left", []byte("written on the left"))
+	c.store(3, "right", []byte("written on the right"))
+
+	c.eventually("writes to replicate inside their group", func() bool {
+		return c.holds(1, 0, "left") && c.holds(2, 3, "right")
+	})
+	c.assertAbsent([]int{2, 3}, 0, "left")
+	c.assertAbsent([]int{0, 1}, 3, "right")
+
+	// Once healed, new writes reach the whole cluster again. Writes from
+	// during the partition stay in their group until repaired.
+	c.heal()
+	c.store(2, "healed", []byte("written after healing"))
+	c.assertConverged(2, "healed")
+}
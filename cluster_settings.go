@@ -0,0 +1,171 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/anthdm/foreverstore/config"
+	"github.com/anthdm/foreverstore/errors"
+)
+
+// Cluster settings are changed by the leader of the cluster alone, so two
+// members changing them at once cannot undo each other's change: members
+// only accept updates made by the leader, and DistributeSettings on any
+// other member hands the settings to the leader to distribute.
+
+// MessageClusterSettings carries a versioned set of cluster-wide settings.
+// Sync is set when a member brings a peer that connects up to date with
+// the settings it follows, rather than distributing an update.
+type MessageClusterSettings struct {
+	Settings config.ClusterSettings
+	Sync     bool
+}
+
+// MessageProposeSettings asks the leader to distribute Settings. The leader
+// answers with the MessageClusterSettings it distributed.
+type MessageProposeSettings struct {
+	Settings config.ClusterSettings
+}
+
+// proposeSettingsTimeout bounds the wait for the leader to distribute the
+// settings proposed to it.
+const proposeSettingsTimeout = 10 * time.Second
+
+// ClusterSettings returns the cluster-wide settings this node currently follows.
+func (s *FileServer) ClusterSettings() config.ClusterSettings {
+	s.settingsLock.RLock()
+	defer s.settingsLock.RUnlock()
+	return s.clusterSettings
+}
+
+// DistributeSettings makes the cluster adopt cs as its new settings. On the
+// leader, the version is bumped past the newest one this node has seen, the
+// settings are applied locally, and then broadcast to all peers, which relay
+// them on so members that are not directly connected converge as well. Any
+// other member proposes cs to the leader and applies what it distributed.
+func (s *FileServer) DistributeSettings(cs config.ClusterSettings) error {
+	if leader, _ := s.clusterLeader(); leader != "" {
+		return s.proposeSettings(leader, cs)
+	}
+	_, err := s.distributeSettings(cs)
+	return err
+}
+
+// distributeSettings publishes cs from the leader and returns the settings
+// as distributed.
+func (s *FileServer) distributeSettings(cs config.ClusterSettings) (config.ClusterSettings, error) {
+	s.settingsLock.Lock()
+	cs.Version = s.clusterSettings.Version + 1
+	cs.UpdatedBy = s.ID
+	s.applyClusterSettingsLocked(cs)
+	s.settingsLock.Unlock()
+
+	s.logger.Info("Distributing cluster settings version %d", cs.Version)
+
+	return cs, s.broadcast(&Message{Payload: MessageClusterSettings{Settings: cs}})
+}
+
+// proposeSettings hands cs to the leader to distribute, and applies the
+// settings it distributed without waiting for them to be relayed.
+func (s *FileServer) proposeSettings(leader string, cs config.ClusterSettings) error {
+	s.logger.Info("Proposing cluster settings to the leader %s", leader)
+
+	answers, errs := requestPeers[MessageClusterSettings](s, []string{leader}, MessageProposeSettings{Settings: cs}, proposeSettingsTimeout)
+	if err := errs[leader]; err != nil {
+		return errors.Wrap(err, errors.NetworkError, "leader did not distribute the cluster settings")
+	}
+	distributed := answers[leader].Settings
+
+	s.settingsLock.Lock()
+	if newerSettings(distributed, s.clusterSettings) {
+		s.applyClusterSettingsLocked(distributed)
+	}
+	s.settingsLock.Unlock()
+	return nil
+}
+
+// answerProposeSettings distributes the settings a member proposed, as long
+// as this node still leads the cluster.
+func (s *FileServer) answerProposeSettings(msg MessageProposeSettings) (MessageClusterSettings, error) {
+	if leader, _ := s.clusterLeader(); leader != "" {
+		return MessageClusterSettings{}, errors.NewValidationError("not the leader of the cluster, " + leader + " is")
+	}
+	cs, err := s.distributeSettings(msg.Settings)
+	return MessageClusterSettings{Settings: cs}, err
+}
+
+// clusterLeader returns the ID of the leader of the cluster as this node
+// sees it: the lowest ID among itself and the peers it is connected to.
+// Peers count once they introduced themselves. addr is the address of the
+// leader, empty when this node leads.
+func (s *FileServer) clusterLeader() (addr, id string) {
+	id = s.ID
+	for _, peer := range s.peerAddrs() {
+		if peerID := s.conns.id(peer); peerID != "" && peerID < id {
+			addr, id = peer, peerID
+		}
+	}
+	return addr, id
+}
+
+func (s *FileServer) handleMessageClusterSettings(from string, msg MessageClusterSettings) error {
+	// Updates are made by the leader. A member that does not know the
+	// leader's peers may see a higher ID as its leader, so the updates of
+	// any lower ID are taken.
+	if _, leader := s.clusterLeader(); !msg.Sync && msg.Settings.UpdatedBy > leader {
+		s.logger.Warn("Rejecting cluster settings version %d from %s: made by %s, not by the leader %s",
+			msg.Settings.Version, from, msg.Settings.UpdatedBy, leader)
+		return nil
+	}
+
+	s.settingsLock.Lock()
+	if !newerSettings(msg.Settings, s.clusterSettings) {
+		s.settingsLock.Unlock()
+		s.logger.Debug("Ignoring stale cluster settings version %d from %s", msg.Settings.Version, from)
+		return nil
+	}
+	s.applyClusterSettingsLocked(msg.Settings)
+	s.settingsLock.Unlock()
+
+	s.logger.Info("Accepted cluster settings version %d from %s", msg.Settings.Version, from)
+
+	return s.broadcast(&Message{Payload: msg})
+}
+
+func (s *FileServer) applyClusterSettingsLocked(cs config.ClusterSettings) {
+	s.clusterSettings = cs
+	overridden := func(setting string) bool {
+		return s.Config != nil && s.Config.IsOverridden(setting)
+	}
+	if cs.BucketPolicies != nil && !overridden(config.SettingBucketPolicies) {
+		s.BucketPolicies = cs.BucketPolicies
+	}
+	if cs.BucketQuotas != nil && !overridden(config.SettingBucketQuotas) {
+		s.BucketQuotas = cs.BucketQuotas
+	}
+	if cs.TenantQuotas != nil && !overridden(config.SettingTenantQuotas) {
+		s.TenantQuotas = cs.TenantQuotas
+	}
+	if cs.ClientRateLimit > 0 && !overridden(config.SettingClientRateLimit) {
+		s.SetClientRateLimit(cs.ClientRateLimit)
+	}
+	if cs.PeerBandwidthLimit > 0 && !overridden(config.SettingPeerBandwidthLimit) {
+		s.SetPeerBandwidthLimit(cs.PeerBandwidthLimit)
+	}
+	if s.Config == nil {
+		return
+	}
+	if changed := s.Config.ApplyClusterSettings(cs); len(changed) > 0 {
+		s.logger.Info("Cluster settings changed: %s", strings.Join(changed, ", "))
+	}
+}
+
+// newerSettings reports whether a should replace b. Concurrent updates that
+// end up with the same version are ordered by the ID of the node that made
+// them, so every member picks the same winner.
+func newerSettings(a, b config.ClusterSettings) bool {
+	if a.Version != b.Version {
+		return a.Version > b.Version
+	}
+	return a.UpdatedBy > b.UpdatedBy
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/anthdm/foreverstore/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClusterSettingsConvergence(t *testing.T) {
+	tempDir := "/tmp/fs_test_cluster_settings"
+	defer os.RemoveAll(tempDir)
+
+	server := createTestServer(":0", tempDir, []string{})
+	server.ID = "m"
+	server.Config = config.DefaultConfig()
+	server.Config.LocalOverrides = []string{config.SettingMaxStorageSize}
+
+	newer := config.ClusterSettings{Version: 2, UpdatedBy: "a", ReplicationFactor: 3, MaxStorageSize: 10}
+	assert.Nil(t, server.handleMessage("peer", &Message{Payload: MessageClusterSettings{Settings: newer}}))
+	assert.Equal(t, uint64(2), server.ClusterSettings().Version)
+	assert.Equal(t, 3, server.Config.ReplicationFactor)
+	assert.Equal(t, config.DefaultConfig().MaxStorageSize, server.Config.MaxStorageSize)
+
+	// Older versions are ignored
+	older := config.ClusterSettings{Version: 1, UpdatedBy: "z", ReplicationFactor: 5}
+	assert.Nil(t, server.handleMessage("peer", &Message{Payload: MessageClusterSettings{Settings: older}}))
+	assert.Equal(t, 3, server.Config.ReplicationFactor)
+
+	// Distributing bumps the version past the newest one seen
+	assert.Nil(t, server.DistributeSettings(config.ClusterSettings{ReplicationFactor: 4}))
+	assert.Equal(t, uint64(3), server.ClusterSettings().Version)
+	assert.Equal(t, server.ID, server.ClusterSettings().UpdatedBy)
+	assert.Equal(t, 4, server.Config.ReplicationFactor)
+}
+
+func TestClusterSettingsOnlyFromTheLeader(t *testing.T) {
+	server := createTestServer(":0", t.TempDir(), []string{})
+	server.ID = "m"
+
+	// Without peers the node leads, so another member's update is refused
+	update := config.ClusterSettings{Version: 1, UpdatedBy: "z", ReplicationFactor: 5}
+	assert.Nil(t, server.handleMessage("peer", &Message{Payload: MessageClusterSettings{Settings: update}}))
+	assert.Equal(t, uint64(0), server.ClusterSettings().Version)
+
+	// ...unless a peer brings it up to date with the settings it follows
+	assert.Nil(t, server.handleMessage("peer", &Message{Payload: MessageClusterSettings{Settings: update, Sync: true}}))
+	assert.Equal(t, uint64(1), server.ClusterSettings().Version)
+
+	// A lower ID leads a part of the cluster this node does not see
+	update = config.ClusterSettings{Version: 2, UpdatedBy: "a", ReplicationFactor: 3}
+	assert.Nil(t, server.handleMessage("peer", &Message{Payload: MessageClusterSettings{Settings: update}}))
+	assert.Equal(t, 3, server.ClusterSettings().ReplicationFactor)
+}
+
+func TestClusterSettingsDistributeQuotasAndRateLimits(t *testing.T) {
+	c := newTestCluster(t, 3)
+	leader := 0
+	for node, s := range c.nodes {
+		if s.ID < c.nodes[leader].ID {
+			leader = node
+		}
+	}
+	proposer := (leader + 1) % len(c.nodes)
+
+	cs := config.ClusterSettings{
+		BucketQuotas:       []config.BucketQuota{{Bucket: "logs", MaxBytes: 60}},
+		TenantQuotas:       []config.TenantQuota{{Tenant: "acme", Buckets: []string{"logs"}, MaxBytes: 100}},
+		ClientRateLimit:    50,
+		PeerBandwidthLimit: 1 << 20,
+	}
+	assert.Nil(t, c.run("settings to be distributed", func() error { return c.nodes[proposer].DistributeSettings(cs) }))
+	// The member that proposed the settings follows them at once
+	assert.Equal(t, c.nodes[leader].ID, c.nodes[proposer].ClusterSettings().UpdatedBy)
+
+	c.eventually("every node to follow the settings", func() bool {
+		for _, s := range c.nodes {
+			if s.ClusterSettings().Version != 1 {
+				return false
+			}
+		}
+		return true
+	})
+	for node, s := range c.nodes {
+		assert.Equal(t, c.nodes[leader].ID, s.ClusterSettings().UpdatedBy, "node %d", node)
+		assert.Len(t, s.quotasFor("logs"), 2, "node %d", node)
+		assert.Equal(t, 50, s.ClientRateLimit(), "node %d", node)
+		assert.Equal(t, int64(1<<20), s.PeerBandwidthLimit(), "node %d", node)
+	}
+}
+
+func TestNewerSettings(t *testing.T) {
+	assert.True(t, newerSettings(config.ClusterSettings{Version: 2}, config.ClusterSettings{Version: 1}))
+	assert.False(t, newerSettings(config.ClusterSettings{Version: 1}, config.ClusterSettings{Version: 2}))
+	assert.True(t, newerSettings(
+		config.ClusterSettings{Version: 1, UpdatedBy: "b"},
+		config.ClusterSettings{Version: 1, UpdatedBy: "a"}))
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/anthdm/foreverstore/errors"
+)
+
+// Every node lists the objects it stored itself: a listing of the cluster
+// is a page of the objects of each node, and the next pages of a node are
+// read from it alone, following its own cursor. Replicas are not listed, so
+// each object is listed once, by its owner.
+
+// defaultListTimeout is how long the peers are waited for when listing the
+// objects of the cluster.
+const defaultListTimeout = 5 * time.Second
+
+// MessageListFiles asks a peer for a page of the objects it stored whose
+// key starts with Prefix; see Store.Iterate for how cursors work.
+type MessageListFiles struct {
+	Prefix string
+	Cursor string
+	Limit  int
+}
+
+// MessageListFilesResult answers a MessageListFiles.
+type MessageListFilesResult struct {
+	ID         string
+	Objects    []StoreEntry
+	NextCursor string
+}
+
+// NodeObjects is a page of the objects stored by a node of the cluster,
+// reached at Addr. Error is set, and the page empty, when the node did
+// not answer.
+type NodeObjects struct {
+	Node       string       `json:"node"`
+	Addr       string       `json:"addr"`
+	Objects    []StoreEntry `json:"objects"`
+	NextCursor string       `json:"next_cursor,omitempty"`
+	Error      string       `json:"error,omitempty"`
+}
+
+// ListCluster returns the first page of at most limit objects stored by
+// each node of the cluster whose key starts with prefix, this node first
+// and the peers by address. Peers that have not answered within timeout
+// are reported with their error, and the listing is partial.
+func (s *FileServer) ListCluster(prefix string, limit int, timeout time.Duration) ([]NodeObjects, Partial, error) {
+	local, err := s.ListNode("", prefix, "", limit, timeout)
+	if err != nil {
+		return nil, Partial{}, err
+	}
+
+	addrs := s.peerAddrs()
+	sort.Strings(addrs)
+	answers, errs := requestPeers[MessageListFilesResult](s, addrs, MessageListFiles{Prefix: prefix, Limit: limit}, timeout)
+
+	nodes := []NodeObjects{local}
+	for _, addr := range addrs {
+		if err, ok := errs[addr]; ok {
+			s.logger.Warn("Peer %s did not list its objects: %v", addr, err)
+			nodes = append(nodes, NodeObjects{Addr: addr, Objects: []StoreEntry{}, Error: err.Error()})
+			continue
+		}
+		nodes = append(nodes, nodeObjects(addr, answers[addr]))
+	}
+	return nodes, partialAnswer(errs), nil
+}
+
+// ListNode returns a page of at most limit objects stored by the peer at
+// addr, or by this node when addr is empty, whose key starts with prefix.
+func (s *FileServer) ListNode(addr, prefix, cursor string, limit int, timeout time.Duration) (NodeObjects, error) {
+	if limit <= 0 || limit > maxListLimit {
+		return NodeObjects{}, errors.NewInvalidInputError("invalid listing limit")
+	}
+	if addr == "" {
+		entries, next, err := s.List(prefix, cursor, limit)
+		if err != nil {
+			return NodeObjects{}, err
+		}
+		return nodeObjects(s.advertiseAddr(), MessageListFilesResult{ID: s.ID, Objects: entries, NextCursor: next}), nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	resp, err := requestAs[MessageListFilesResult](ctx, s, addr, MessageListFiles{Prefix: prefix, Cursor: cursor, Limit: limit})
+	if err != nil {
+		return NodeObjects{}, err
+	}
+	return nodeObjects(addr, resp), nil
+}
+
+func nodeObjects(addr string, page MessageListFilesResult) NodeObjects {
+	objects := page.Objects
+	if objects == nil {
+		objects = []StoreEntry{}
+	}
+	return NodeObjects{Node: page.ID, Addr: addr, Objects: objects, NextCursor: page.NextCursor}
+}
+
+// answerListFiles lists the objects of this node for a peer.
+func (s *FileServer) answerListFiles(msg MessageListFiles) (MessageListFilesResult, error) {
+	if msg.Limit <= 0 || msg.Limit > maxListLimit {
+		return MessageListFilesResult{}, errors.NewInvalidInputError("invalid listing limit")
+	}
+	entries, next, err := s.List(msg.Prefix, msg.Cursor, msg.Limit)
+	if err != nil {
+		return MessageListFilesResult{}, err
+	}
+	return MessageListFilesResult{ID: s.ID, Objects: entries, NextCursor: next}, nil
+}
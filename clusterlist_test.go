@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListClusterListsTheObjectsOfEveryNode(t *testing.T) {
+	c := newTestCluster(t, 3)
+	c.store(0, "a/1", []byte("one"))
+	c.store(0, "a/2", []byte("two"))
+	c.store(1, "a/3", []byte("three"))
+	c.store(1, "b/1", []byte("other"))
+	c.assertConverged(1, "b/1")
+	s := c.nodes[0]
+
+	var (
+		nodes   []NodeObjects
+		partial Partial
+	)
+	assert.Nil(t, c.run("list", func() (err error) {
+		nodes, partial, err = s.ListCluster("a/", 1, time.Second)
+		return err
+	}))
+	assert.False(t, partial.Partial)
+	assert.Len(t, nodes, 3)
+	assert.Equal(t, s.ID, nodes[0].Node)
+	assert.Len(t, nodes[0].Objects, 1)
+	assert.NotEmpty(t, nodes[0].NextCursor)
+	assert.Equal(t, c.nodes[1].ID, nodes[1].Node)
+	assert.Equal(t, "a/3", nodes[1].Objects[0].Key)
+	assert.Empty(t, nodes[2].Objects, "replicas are listed by their owner only")
+
+	// The next pages of a node are read from it alone.
+	var page NodeObjects
+	assert.Nil(t, c.run("list node", func() (err error) {
+		page, err = s.ListNode("", "a/", nodes[0].NextCursor, 10, time.Second)
+		return err
+	}))
+	assert.Len(t, page.Objects, 1)
+	assert.NotEqual(t, nodes[0].Objects[0].Key, page.Objects[0].Key)
+	assert.Nil(t, c.run("list peer", func() (err error) {
+		page, err = s.ListNode(nodes[1].Addr, "b/", "", 10, time.Second)
+		return err
+	}))
+	assert.Equal(t, "b/1", page.Objects[0].Key)
+
+	// Peers that do not answer are reported rather than fail the listing.
+	c.partition([]int{0}, []int{1, 2})
+	assert.Nil(t, c.run("list partitioned", func() (err error) {
+		nodes, partial, err = s.ListCluster("a/", 10, time.Second)
+		return err
+	}))
+	assert.Len(t, nodes[0].Objects, 2)
+	assert.NotEmpty(t, nodes[1].Error)
+	assert.NotEmpty(t, nodes[2].Error)
+	assert.True(t, partial.Partial)
+	assert.Equal(t, []string{nodes[1].Addr, nodes[2].Addr}, []string{partial.Unanswered[0].Addr, partial.Unanswered[1].Addr})
+}
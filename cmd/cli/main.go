@@ -1,12 +1,25 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
+	"mime"
+	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
+	fsclient "github.com/anthdm/foreverstore/client"
 	"github.com/anthdm/foreverstore/config"
+	"github.com/anthdm/foreverstore/e2e"
 	"github.com/anthdm/foreverstore/logger"
 )
 
@@ -22,13 +35,35 @@ func main() {
 	var (
 		configFile = flag.String("config", "config.json", "Configuration file path")
 		serverAddr = flag.String("server", ":3000", "File server address to connect to")
-		command    = flag.String("cmd", "", "Command to execute: store, get, list, delete")
+		adminAddr  = flag.String("admin", "", "Admin API address of the node (default from config)")
+		command    = flag.String("cmd", "", "Command to execute: store, get, stat, list, query, lock, delete, config, transfers")
 		key        = flag.String("key", "", "File key for operations")
+		prefix     = flag.String("prefix", "", "Only list or query keys starting with this prefix")
+		delimiter  = flag.String("delimiter", "", "List keys as folders separated by this delimiter, e.g. /")
+		cluster    = flag.Bool("cluster", false, "List the files of every node of the cluster (list command)")
+		tags       = flag.String("tags", "", "Comma separated name=value tags to store with a file, or to query for")
 		file       = flag.String("file", "", "Local file path for store/get operations")
+		lock       = flag.Bool("lock", false, "Make the file immutable indefinitely (store and lock commands)")
+		retain     = flag.Duration("retain", 0, "Make the file immutable for this long, e.g. 720h (store and lock commands)")
 		output     = flag.String("output", "", "Output file path for get operations")
 		verbose    = flag.Bool("v", false, "Verbose output")
+		set        = flag.String("set", "", "Runtime setting to change for the config command (name=value)")
+		persist    = flag.Bool("persist", false, "Persist runtime setting changes to the node's config file")
+		keyVersion = flag.Uint("key-version", 0, "Key version for the rotate-key command")
+		newKey     = flag.String("new-key", "", "Hex or base64 encoded key for the rotate-key command")
+		all        = flag.Bool("all", false, "Repair every file of the node (repair command)")
+		target     = flag.String("target", "", "Admin API address of the replacement node for the migrate command")
+		peer       = flag.String("peer", "", "Peer address for add-peer, or address or node ID for remove-peer, or node ID for restore-mirror")
+		job        = flag.String("job", "", "Job ID or kind for the jobs command: scrub, gc, rebalance, re-replication, backup")
+		action     = flag.String("action", "", "What to do with -job for the jobs command: start, pause, resume, cancel; reconcile for the mirror command")
+		e2eKey     = flag.String("e2e-key", "", "Client-held key for end-to-end encryption (hex, base64, or a file:// or env:// reference)")
 	)
 	flag.Parse()
+	// "fs-cli admin jobs -job scrub" reads as "fs-cli -cmd jobs -job scrub".
+	if *command == "" && flag.NArg() >= 2 && flag.Arg(0) == "admin" {
+		*command = flag.Arg(1)
+		flag.CommandLine.Parse(flag.Args()[2:])
+	}
 
 	// Setup logging
 	if *verbose {
@@ -48,6 +83,9 @@ func main() {
 	if *serverAddr != ":3000" {
 		cfg.ListenAddr = *serverAddr
 	}
+	if *adminAddr != "" {
+		cfg.AdminAddr = *adminAddr
+	}
 
 	if *command == "" {
 		printUsage()
@@ -55,7 +93,7 @@ func main() {
 	}
 
 	// Create a client connection to the file server
-	client, err := createClient(cfg)
+	client, err := createClient(cfg, *e2eKey)
 	if err != nil {
 		fmt.Printf("Failed to create client: %v\n", err)
 		os.Exit(1)
@@ -68,21 +106,63 @@ func main() {
 			fmt.Println("Error: Both -key and -file are required for store command")
 			os.Exit(1)
 		}
-		err = storeFile(client, *key, *file)
+		err = storeFile(client, *key, *file, splitTags(*tags), lockOptions{Locked: *lock, Retain: *retain})
 	case "get":
 		if *key == "" {
 			fmt.Println("Error: -key is required for get command")
 			os.Exit(1)
 		}
 		err = getFile(client, *key, *output)
+	case "stat":
+		if *key == "" {
+			fmt.Println("Error: -key is required for stat command")
+			os.Exit(1)
+		}
+		err = statFile(client, *key)
 	case "list":
-		err = listFiles(client)
+		if *cluster {
+			err = listClusterFiles(client, *prefix)
+		} else {
+			err = listFiles(client, *prefix, *delimiter)
+		}
+	case "query":
+		err = queryFiles(client, *prefix, splitTags(*tags))
+	case "lock":
+		if *key == "" || (!*lock && *retain <= 0) {
+			fmt.Println("Error: -key and either -lock or -retain are required for lock command")
+			os.Exit(1)
+		}
+		err = lockFile(client, *key, lockOptions{Locked: *lock, Retain: *retain})
 	case "delete":
 		if *key == "" {
 			fmt.Println("Error: -key is required for delete command")
 			os.Exit(1)
 		}
 		err = deleteFile(client, *key)
+	case "config":
+		err = runtimeConfig(cfg.AdminAddr, cfg.AdminToken, *set, *persist)
+	case "rotate-key":
+		err = rotateKey(cfg.AdminAddr, cfg.AdminToken, uint32(*keyVersion), *newKey)
+	case "migrate":
+		err = migrateNode(cfg.AdminAddr, cfg.AdminToken, *target)
+	case "repair":
+		err = repairFiles(cfg.AdminAddr, cfg.AdminToken, *key, *all)
+	case "peers":
+		err = managePeers(cfg.AdminAddr, cfg.AdminToken, "", "")
+	case "jobs":
+		err = manageJobs(cfg.AdminAddr, cfg.AdminToken, *job, *action, *peer)
+	case "transfers":
+		err = listTransfers(cfg.AdminAddr)
+	case "mirror":
+		err = manageMirror(cfg.AdminAddr, cfg.AdminToken, *action)
+	case "restore-mirror":
+		err = restoreMirror(cfg.AdminAddr, cfg.AdminToken, *peer)
+	case "add-peer", "remove-peer":
+		if *peer == "" {
+			fmt.Printf("Error: -peer is required for %s command\n", *command)
+			os.Exit(1)
+		}
+		err = managePeers(cfg.AdminAddr, cfg.AdminToken, *command, *peer)
 	default:
 		fmt.Printf("Error: Unknown command '%s'\n", *command)
 		printUsage()
@@ -104,38 +184,152 @@ func printUsage() {
 	fmt.Println("Commands:")
 	fmt.Println("  store    Store a file in the distributed system")
 	fmt.Println("  get      Retrieve a file from the distributed system")
-	fmt.Println("  list     List all files in the system (not implemented)")
-	fmt.Println("  delete   Delete a file from the system (not implemented)")
+	fmt.Println("  stat     Show the size and metadata of a stored file")
+	fmt.Println("  list     List the files stored through the node")
+	fmt.Println("  query    Find files across the cluster by key prefix and tags")
+	fmt.Println("  lock     Make a stored file immutable, or extend its lock")
+	fmt.Println("  delete   Delete a file and its replicas from the system")
+	fmt.Println("  config   Show or change runtime settings of a live node")
+	fmt.Println("  rotate-key  Rotate the encryption key of a live node (status without -new-key)")
+	fmt.Println("  migrate  Copy all data of a node to its replacement (status without -target)")
+	fmt.Println("  repair   Restore missing or corrupted copies of a file, or of all files with -all")
+	fmt.Println("  peers    List the peers of a live node")
+	fmt.Println("  add-peer     Connect a live node to the peer at -peer")
+	fmt.Println("  remove-peer  Disconnect a live node from the peer at -peer (address or node ID)")
+	fmt.Println("  jobs     List the background jobs of a live node, or start, pause, resume or cancel one")
+	fmt.Println("  transfers  List the object transfers of a live node with its peers, active and recent")
+	fmt.Println("  mirror   Show the mirror of a live node, or catch it up with -action reconcile")
+	fmt.Println("  restore-mirror  Store again the objects of a node, or of node -peer, from the mirror")
 	fmt.Println()
 	fmt.Println("Options:")
 	fmt.Println("  -config string    Configuration file path (default: config.json)")
 	fmt.Println("  -server string    File server address (default: :3000)")
 	fmt.Println("  -key string       File key for operations")
+	fmt.Println("  -prefix string    Only list or query keys starting with this prefix")
+	fmt.Println("  -delimiter string List the folders under -prefix, with keys split on this delimiter (e.g. /)")
+	fmt.Println("  -cluster          List the files of every node of the cluster, by node")
+	fmt.Println("  -tags string      Tags to store with a file or to query for (name=value,...)")
 	fmt.Println("  -file string      Local file path for store/get operations")
 	fmt.Println("  -output string    Output file path for get operations")
+	fmt.Println("  -lock             Make the file immutable indefinitely")
+	fmt.Println("  -retain duration  Make the file immutable for this long (e.g. 720h)")
+	fmt.Println("  -admin string     Admin API address of the node (default from config)")
+	fmt.Println("  -set string       Runtime setting to change (name=value)")
+	fmt.Println("  -persist          Persist runtime setting changes to the node's config file")
+	fmt.Println("  -key-version uint Key version for rotate-key")
+	fmt.Println("  -new-key string   New encryption key for rotate-key (hex or base64)")
+	fmt.Println("  -target string    Admin API address of the replacement node for migrate")
+	fmt.Println("  -all              Repair every file of the node")
+	fmt.Println("  -peer string      Peer address for add-peer, or address or node ID for remove-peer and jobs,")
+	fmt.Println("                    or node ID for restore-mirror")
+	fmt.Println("  -job string       Job ID or kind for jobs (scrub, gc, rebalance, re-replication, backup)")
+	fmt.Println("  -action string    start, pause, resume or cancel -job (jobs command), or reconcile (mirror command)")
+	fmt.Println("  -e2e-key string   Encrypt/decrypt on the client with this key; servers never see it")
 	fmt.Println("  -v                Verbose output")
 	fmt.Println()
 	fmt.Println("Examples:")
 	fmt.Println("  fs-cli -cmd store -key myfile.txt -file /path/to/local/file.txt")
 	fmt.Println("  fs-cli -cmd get -key myfile.txt -output /path/to/save/file.txt")
 	fmt.Println("  fs-cli -cmd get -key myfile.txt  # prints to stdout")
-	fmt.Println("  fs-cli -cmd list")
+	fmt.Println("  fs-cli -cmd store -key secret.txt -file secret.txt -e2e-key file:///path/to/key")
+	fmt.Println("  fs-cli -cmd stat -key myfile.txt")
+	fmt.Println("  fs-cli -cmd delete -key myfile.txt")
+	fmt.Println("  fs-cli -cmd list -prefix reports/")
+	fmt.Println("  fs-cli -cmd list -prefix photos/ -delimiter /")
+	fmt.Println("  fs-cli -cmd list -cluster -prefix reports/")
+	fmt.Println("  fs-cli -cmd store -key reports/q1.pdf -file q1.pdf -tags team=finance,year=2024")
+	fmt.Println("  fs-cli -cmd query -prefix reports/ -tags team=finance")
+	fmt.Println("  fs-cli -cmd store -key audit/2024.log -file 2024.log -retain 61320h")
+	fmt.Println("  fs-cli -cmd lock -key audit/2024.log -lock")
+	fmt.Println("  fs-cli -cmd config -set log_level=DEBUG -persist")
+	fmt.Println("  fs-cli -cmd rotate-key -key-version 1 -new-key <hex>")
+	fmt.Println("  fs-cli -cmd migrate -admin old-node:8080 -target new-node:8080")
+	fmt.Println("  fs-cli -cmd repair -key reports/q1.pdf")
+	fmt.Println("  fs-cli -cmd repair -all")
+	fmt.Println("  fs-cli -cmd add-peer -peer 10.0.0.7:3000")
+	fmt.Println("  fs-cli -cmd remove-peer -peer 10.0.0.7:3000")
+	fmt.Println("  fs-cli -cmd transfers -admin node-1:8080")
+	fmt.Println("  fs-cli admin jobs")
+	fmt.Println("  fs-cli admin jobs -job scrub -action start")
+	fmt.Println("  fs-cli admin jobs -job rebalance -action pause -peer 10.0.0.7:3000")
 }
 
 // Simple client that connects to a file server
 type SimpleClient struct {
 	serverAddr string
-	// In a real implementation, this would maintain a connection to the server
-	// For now, we'll simulate it
+	// adminAddr is the node's HTTP API, which serves the object endpoints.
+	adminAddr string
+	// adminToken authenticates the writes to the admin API.
+	adminToken string
+	// e2eKey, when set, encrypts objects before they leave the client.
+	e2eKey []byte
+	// api sends the object requests that need no headers of the CLI, with
+	// the retries and timeouts of the client package.
+	api *fsclient.Client
 }
 
-func createClient(cfg *config.Config) (*SimpleClient, error) {
-	return &SimpleClient{
+func createClient(cfg *config.Config, e2eKey string) (*SimpleClient, error) {
+	client := &SimpleClient{
 		serverAddr: cfg.ListenAddr,
-	}, nil
+		adminAddr:  cfg.AdminAddr,
+		adminToken: cfg.AdminToken,
+	}
+	if cfg.AdminAddr != "" {
+		api, err := fsclient.New(fsclient.Options{Endpoints: []string{cfg.AdminAddr}, HealthCheckInterval: -1, Token: cfg.AdminToken})
+		if err != nil {
+			return nil, err
+		}
+		client.api = api
+	}
+	if e2eKey != "" {
+		resolved, err := config.ResolveSecret(e2eKey)
+		if err != nil {
+			return nil, err
+		}
+		if client.e2eKey, err = config.ParseEncryptionKey(resolved); err != nil {
+			return nil, err
+		}
+	}
+	return client, nil
 }
 
-func storeFile(client *SimpleClient, key, filePath string) error {
+// objects returns the client of the object API of the node.
+func (c *SimpleClient) objects() (*fsclient.Client, error) {
+	if c.api == nil {
+		return nil, fmt.Errorf("no admin address configured")
+	}
+	return c.api, nil
+}
+
+func (c *SimpleClient) objectURL(key string) (string, error) {
+	if c.adminAddr == "" {
+		return "", fmt.Errorf("no admin address configured")
+	}
+	return "http://" + c.adminAddr + "/objects/" + url.PathEscape(key), nil
+}
+
+// lockOptions is the object lock requested on the command line.
+type lockOptions struct {
+	// Locked locks the object indefinitely.
+	Locked bool
+	// Retain locks the object for this long from now.
+	Retain time.Duration
+}
+
+// retainUntil returns the RFC 3339 expiry of the lock, or "" for a lock
+// that never expires.
+func (o lockOptions) retainUntil() string {
+	if o.Locked || o.Retain <= 0 {
+		return ""
+	}
+	return time.Now().Add(o.Retain).UTC().Format(time.RFC3339)
+}
+
+func (o lockOptions) requested() bool {
+	return o.Locked || o.Retain > 0
+}
+
+func storeFile(client *SimpleClient, key, filePath string, tags []string, lock lockOptions) error {
 	// Check if file exists
 	if _, err := os.Stat(filePath); os.IsNotExist(err) {
 		return fmt.Errorf("file does not exist: %s", filePath)
@@ -148,62 +342,790 @@ func storeFile(client *SimpleClient, key, filePath string) error {
 	}
 
 	fmt.Printf("Storing file '%s' with key '%s' (%d bytes)\n", filePath, key, len(data))
-	
-	// In a real implementation, this would send the file to the server
-	// For now, we'll just simulate success
+
+	objectURL, err := client.objectURL(key)
+	if err != nil {
+		return err
+	}
+
+	body := data
+	if client.e2eKey != nil {
+		sealed := new(bytes.Buffer)
+		if _, err := e2e.Encrypt(client.e2eKey, bytes.NewReader(data), sealed); err != nil {
+			return fmt.Errorf("failed to encrypt file: %v", err)
+		}
+		body = sealed.Bytes()
+	}
+
+	req, err := http.NewRequest(http.MethodPut, objectURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+client.adminToken)
+	if client.e2eKey != nil {
+		req.Header.Set("X-Client-Encrypted", "true")
+		req.Header.Set("X-Meta-"+e2e.AttrKeyID, e2e.KeyID(client.e2eKey))
+	} else if contentType := mime.TypeByExtension(filepath.Ext(filePath)); contentType != "" {
+		// Otherwise the server detects it from the content.
+		req.Header.Set("Content-Type", contentType)
+	}
+	for _, tag := range tags {
+		name, value, _ := strings.Cut(tag, "=")
+		req.Header.Set("X-Meta-"+name, value)
+	}
+	if lock.requested() {
+		req.Header.Set("X-Object-Lock", "true")
+		if until := lock.retainUntil(); until != "" {
+			req.Header.Set("X-Object-Lock-Retain-Until", until)
+		}
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach server: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("server returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
 	fmt.Printf("✓ File stored successfully\n")
-	
+	return nil
+}
+
+func lockFile(client *SimpleClient, key string, lock lockOptions) error {
+	if client.adminAddr == "" {
+		return fmt.Errorf("no admin address configured")
+	}
+
+	body := map[string]string{}
+	if until := lock.retainUntil(); until != "" {
+		body["retain_until"] = until
+	}
+	b, _ := json.Marshal(body)
+	req, err := http.NewRequest(http.MethodPut, "http://"+client.adminAddr+"/locks/"+url.PathEscape(key), bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+client.adminToken)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach server: %v", err)
+	}
+	defer resp.Body.Close()
+
+	msg, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("server returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	fmt.Printf("✓ File locked: %s\n", strings.TrimSpace(string(msg)))
 	return nil
 }
 
 func getFile(client *SimpleClient, key, outputPath string) error {
 	fmt.Printf("Retrieving file with key '%s'\n", key)
-	
-	// In a real implementation, this would retrieve the file from the server
-	// For now, we'll simulate with dummy data
-	dummyData := []byte(fmt.Sprintf("This is dummy content for key: %s", key))
-	
+
+	objectURL, err := client.objectURL(key)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.Get(objectURL)
+	if err != nil {
+		return fmt.Errorf("failed to reach server: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("server returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read file: %v", err)
+	}
+
+	if encrypted, _ := strconv.ParseBool(resp.Header.Get("X-Client-Encrypted")); encrypted {
+		if client.e2eKey == nil {
+			return fmt.Errorf("file is end-to-end encrypted; -e2e-key is required")
+		}
+		if id := resp.Header.Get("X-Meta-" + e2e.AttrKeyID); id != "" && id != e2e.KeyID(client.e2eKey) {
+			return fmt.Errorf("file was encrypted with a different key (key id %s)", id)
+		}
+		plain := new(bytes.Buffer)
+		if _, err := e2e.Decrypt(client.e2eKey, bytes.NewReader(data), plain); err != nil {
+			return fmt.Errorf("failed to decrypt file: %v", err)
+		}
+		data = plain.Bytes()
+	}
+
 	if outputPath == "" {
 		// Print to stdout
-		fmt.Printf("File content:\n%s\n", string(dummyData))
+		fmt.Printf("File content:\n%s\n", string(data))
 	} else {
 		// Save to file
-		err := os.WriteFile(outputPath, dummyData, 0644)
+		err := os.WriteFile(outputPath, data, 0644)
 		if err != nil {
 			return fmt.Errorf("failed to write output file: %v", err)
 		}
 		fmt.Printf("✓ File saved to: %s\n", outputPath)
 	}
-	
+
 	return nil
 }
 
-func listFiles(client *SimpleClient) error {
-	fmt.Println("Listing files in the distributed system:")
-	
-	// In a real implementation, this would query the server for file list
-	// For now, we'll simulate with dummy data
-	files := []string{
-		"document.pdf",
-		"image.jpg",
-		"data.csv",
-		"backup.zip",
+func listFiles(client *SimpleClient, prefix, delimiter string) error {
+	api, err := client.objects()
+	if err != nil {
+		return err
 	}
-	
+
 	fmt.Println("Files:")
-	for i, file := range files {
-		fmt.Printf("  %d. %s\n", i+1, file)
+	count := 0
+	for cursor := ""; ; {
+		var page fsclient.Listing
+		if delimiter != "" {
+			page, err = api.ListDir(context.Background(), prefix, delimiter, cursor, 0)
+		} else {
+			page.Objects, page.NextCursor, err = api.List(context.Background(), prefix, cursor, 0)
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, folder := range page.Prefixes {
+			count++
+			fmt.Printf("  %d. %s\n", count, folder)
+		}
+		for _, obj := range page.Objects {
+			count++
+			name := obj.Key
+			if name == "" {
+				name = "(unknown key) " + obj.Path
+			}
+			fmt.Printf("  %d. %s (%d bytes)\n", count, name, obj.Size)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		cursor = page.NextCursor
+	}
+
+	if count == 0 {
+		fmt.Println("  (none)")
+	}
+	return nil
+}
+
+// nodeObjects is a page of the files of a node of GET /cluster/objects.
+type nodeObjects struct {
+	Node    string `json:"node"`
+	Addr    string `json:"addr"`
+	Objects []struct {
+		Key  string `json:"key"`
+		Path string `json:"path"`
+		Size int64  `json:"size"`
+	} `json:"objects"`
+	NextCursor string `json:"next_cursor"`
+	Error      string `json:"error"`
+}
+
+// listClusterFiles lists the files stored by every node of the cluster,
+// node by node, reading the next pages of a node from it alone.
+func listClusterFiles(client *SimpleClient, prefix string) error {
+	if client.adminAddr == "" {
+		return fmt.Errorf("no admin address configured")
+	}
+
+	fetch := func(query url.Values) ([]nodeObjects, error) {
+		resp, err := http.Get("http://" + client.adminAddr + "/cluster/objects?" + query.Encode())
+		if err != nil {
+			return nil, fmt.Errorf("failed to reach server: %v", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			msg, _ := io.ReadAll(resp.Body)
+			return nil, fmt.Errorf("server returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+		}
+		var result struct {
+			Nodes []nodeObjects `json:"nodes"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			return nil, fmt.Errorf("invalid response from server: %v", err)
+		}
+		return result.Nodes, nil
+	}
+
+	nodes, err := fetch(url.Values{"prefix": {prefix}})
+	if err != nil {
+		return err
+	}
+	for _, node := range nodes {
+		fmt.Printf("Node %.8s (%s):\n", node.Node, node.Addr)
+		if node.Error != "" {
+			fmt.Printf("  (unavailable: %s)\n", node.Error)
+			continue
+		}
+		count := 0
+		for page := node; ; {
+			for _, obj := range page.Objects {
+				count++
+				name := obj.Key
+				if name == "" {
+					name = "(unknown key) " + obj.Path
+				}
+				fmt.Printf("  %d. %s (%d bytes)\n", count, name, obj.Size)
+			}
+			if page.NextCursor == "" {
+				break
+			}
+			next, err := fetch(url.Values{"node": {node.Addr}, "prefix": {prefix}, "cursor": {page.NextCursor}})
+			if err != nil {
+				return err
+			}
+			if len(next) != 1 {
+				return fmt.Errorf("invalid response from server: %d nodes listed", len(next))
+			}
+			page = next[0]
+		}
+		if count == 0 {
+			fmt.Println("  (none)")
+		}
+	}
+	return nil
+}
+
+// splitTags splits the -tags flag into name=value pairs.
+func splitTags(tags string) []string {
+	var out []string
+	for _, tag := range strings.Split(tags, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			out = append(out, tag)
+		}
+	}
+	return out
+}
+
+func queryFiles(client *SimpleClient, prefix string, tags []string) error {
+	if client.adminAddr == "" {
+		return fmt.Errorf("no admin address configured")
+	}
+
+	query := url.Values{"prefix": {prefix}, "tag": tags}
+	resp, err := http.Get("http://" + client.adminAddr + "/query?" + query.Encode())
+	if err != nil {
+		return fmt.Errorf("failed to reach server: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("server returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	var result struct {
+		Results []struct {
+			Node string            `json:"node"`
+			Key  string            `json:"key"`
+			Size int64             `json:"size"`
+			Tags map[string]string `json:"tags"`
+		} `json:"results"`
+		Unanswered []struct {
+			Addr  string `json:"addr"`
+			Error string `json:"error"`
+		} `json:"unanswered"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("invalid response from server: %v", err)
+	}
+
+	fmt.Printf("Found %d files:\n", len(result.Results))
+	for _, r := range result.Results {
+		names := make([]string, 0, len(r.Tags))
+		for name := range r.Tags {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		pairs := make([]string, len(names))
+		for i, name := range names {
+			pairs[i] = name + "=" + r.Tags[name]
+		}
+		fmt.Printf("  %s (%d bytes, node %.8s) %s\n", r.Key, r.Size, r.Node, strings.Join(pairs, ","))
+	}
+	if len(result.Unanswered) > 0 {
+		fmt.Printf("Partial results, %d nodes did not answer:\n", len(result.Unanswered))
+		for _, u := range result.Unanswered {
+			fmt.Printf("  %s: %s\n", u.Addr, u.Error)
+		}
 	}
-	
 	return nil
 }
 
 func deleteFile(client *SimpleClient, key string) error {
+	api, err := client.objects()
+	if err != nil {
+		return err
+	}
+
 	fmt.Printf("Deleting file with key '%s'\n", key)
-	
-	// In a real implementation, this would send a delete request to the server
-	// For now, we'll simulate success
+	if err := api.Delete(context.Background(), key); err != nil {
+		return err
+	}
 	fmt.Printf("✓ File deleted successfully\n")
-	
 	return nil
 }
+
+func statFile(client *SimpleClient, key string) error {
+	api, err := client.objects()
+	if err != nil {
+		return err
+	}
+
+	info, err := api.Stat(context.Background(), key)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Key:           %s\n", info.Key)
+	if info.Size >= 0 {
+		fmt.Printf("Size:          %d bytes\n", info.Size)
+	}
+	fmt.Printf("Content type:  %s\n", info.ContentType)
+	if info.ETag != "" {
+		fmt.Printf("ETag:          %s\n", info.ETag)
+	}
+	if !info.LastModified.IsZero() {
+		fmt.Printf("Last modified: %s\n", info.LastModified.Format(time.RFC3339))
+	}
+	if info.Encrypted {
+		fmt.Println("Encrypted:     by the client")
+	}
+	if info.Locked {
+		until := "indefinitely"
+		if info.RetainUntil != nil {
+			until = "until " + info.RetainUntil.Format(time.RFC3339)
+		}
+		fmt.Printf("Locked:        %s\n", until)
+	}
+	names := make([]string, 0, len(info.Attributes))
+	for name := range info.Attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("Tag:           %s=%s\n", name, info.Attributes[name])
+	}
+
+	// The node describes what the object headers do not: its replicas and
+	// when it was first stored.
+	resp, err := http.Get("http://" + client.adminAddr + "/stat/" + url.PathEscape(key))
+	if err != nil {
+		return fmt.Errorf("failed to reach server: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("server returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	var stat struct {
+		CreatedAt time.Time `json:"created_at"`
+		Replicas  int       `json:"replicas"`
+		Cold      bool      `json:"cold"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&stat); err != nil {
+		return fmt.Errorf("invalid response from server: %v", err)
+	}
+	if !stat.CreatedAt.IsZero() {
+		fmt.Printf("Created:       %s\n", stat.CreatedAt.Format(time.RFC3339))
+	}
+	fmt.Printf("Replicas:      %d\n", stat.Replicas)
+	if stat.Cold {
+		fmt.Println("Tier:          cold")
+	}
+	return nil
+}
+
+// runtimeConfig shows the runtime settings of the node behind the admin API,
+// or changes one of them when set is given as name=value.
+func runtimeConfig(adminAddr, token, set string, persist bool) error {
+	if adminAddr == "" {
+		return fmt.Errorf("no admin address configured")
+	}
+	url := "http://" + adminAddr + "/config"
+
+	var (
+		resp *http.Response
+		err  error
+	)
+	if set == "" {
+		resp, err = http.Get(url)
+	} else {
+		name, value, ok := strings.Cut(set, "=")
+		if !ok {
+			return fmt.Errorf("-set must be of the form name=value")
+		}
+		body, _ := json.Marshal(map[string]interface{}{
+			"settings": map[string]string{name: value},
+			"persist":  persist,
+		})
+		req, reqErr := http.NewRequest(http.MethodPut, url, bytes.NewReader(body))
+		if reqErr != nil {
+			return reqErr
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		if user := os.Getenv("USER"); user != "" {
+			req.Header.Set("X-Admin-User", user)
+		}
+		resp, err = http.DefaultClient.Do(req)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to reach admin API: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("admin API returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	var result struct {
+		Settings map[string]string `json:"settings"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("invalid admin API response: %v", err)
+	}
+
+	names := make([]string, 0, len(result.Settings))
+	for name := range result.Settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Println("Runtime settings:")
+	for _, name := range names {
+		fmt.Printf("  %s = %s\n", name, result.Settings[name])
+	}
+	return nil
+}
+
+// rotateKey starts a key rotation on the node behind the admin API, or shows
+// the progress of the last one when no new key is given.
+func rotateKey(adminAddr, token string, version uint32, newKey string) error {
+	if adminAddr == "" {
+		return fmt.Errorf("no admin address configured")
+	}
+	url := "http://" + adminAddr + "/keys/rotate"
+
+	var (
+		resp *http.Response
+		err  error
+	)
+	if newKey == "" {
+		resp, err = http.Get(url)
+	} else {
+		body, _ := json.Marshal(map[string]interface{}{"version": version, "key": newKey})
+		resp, err = postAdmin(url, token, body)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to reach admin API: %v", err)
+	}
+	defer resp.Body.Close()
+
+	msg, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("admin API returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	fmt.Printf("Key rotation: %s\n", strings.TrimSpace(string(msg)))
+	return nil
+}
+
+// postAdmin posts the JSON body to an endpoint of the admin API requiring
+// the admin token.
+func postAdmin(url, token string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	return http.DefaultClient.Do(req)
+}
+
+// migrateNode starts copying all data of the node behind the admin API to
+// the replacement node at target, or shows the progress of the last
+// migration when no target is given.
+func migrateNode(adminAddr, token, target string) error {
+	if adminAddr == "" {
+		return fmt.Errorf("no admin address configured")
+	}
+	url := "http://" + adminAddr + "/migrate"
+
+	var (
+		resp *http.Response
+		err  error
+	)
+	if target == "" {
+		resp, err = http.Get(url)
+	} else {
+		body, _ := json.Marshal(map[string]string{"target": target})
+		resp, err = postAdmin(url, token, body)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to reach admin API: %v", err)
+	}
+	defer resp.Body.Close()
+
+	msg, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("admin API returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	fmt.Printf("Migration: %s\n", strings.TrimSpace(string(msg)))
+	return nil
+}
+
+// repairFiles repairs the copies of a file stored through the node behind
+// the admin API, starts a repair of all its files, or shows the progress of
+// the last one when neither a key nor all is given.
+func repairFiles(adminAddr, token, key string, all bool) error {
+	if adminAddr == "" {
+		return fmt.Errorf("no admin address configured")
+	}
+	base := "http://" + adminAddr + "/repair"
+
+	var (
+		resp *http.Response
+		err  error
+	)
+	switch {
+	case key != "":
+		resp, err = postAdmin(base+"/"+url.PathEscape(key), token, nil)
+	case all:
+		resp, err = postAdmin(base, token, nil)
+	default:
+		resp, err = http.Get(base)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to reach admin API: %v", err)
+	}
+	defer resp.Body.Close()
+
+	msg, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("admin API returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	fmt.Printf("Repair: %s\n", strings.TrimSpace(string(msg)))
+	return nil
+}
+
+// manageMirror shows the mirror of the node behind the admin API, or
+// brings it back in line with the objects of the node when action is
+// reconcile.
+func manageMirror(adminAddr, token, action string) error {
+	if adminAddr == "" {
+		return fmt.Errorf("no admin address configured")
+	}
+	url := "http://" + adminAddr + "/mirror"
+
+	var (
+		resp *http.Response
+		err  error
+	)
+	switch action {
+	case "":
+		resp, err = http.Get(url)
+	case "reconcile":
+		resp, err = postAdmin(url, token, nil)
+	default:
+		return fmt.Errorf("unknown mirror action %q", action)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to reach admin API: %v", err)
+	}
+	defer resp.Body.Close()
+
+	msg, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("admin API returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	fmt.Printf("Mirror: %s\n", strings.TrimSpace(string(msg)))
+	return nil
+}
+
+// restoreMirror has the node behind the admin API store again the objects
+// of node found in its mirror, its own when node is empty.
+func restoreMirror(adminAddr, token, node string) error {
+	if adminAddr == "" {
+		return fmt.Errorf("no admin address configured")
+	}
+	body, _ := json.Marshal(map[string]string{"node": node})
+	resp, err := postAdmin("http://"+adminAddr+"/mirror/restore", token, body)
+	if err != nil {
+		return fmt.Errorf("failed to reach admin API: %v", err)
+	}
+	defer resp.Body.Close()
+
+	msg, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("admin API returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	fmt.Printf("Restore: %s\n", strings.TrimSpace(string(msg)))
+	return nil
+}
+
+// managePeers lists the peers of the node behind the admin API, or adds or
+// removes one, depending on command.
+func managePeers(adminAddr, token, command, peer string) error {
+	if adminAddr == "" {
+		return fmt.Errorf("no admin address configured")
+	}
+	base := "http://" + adminAddr + "/peers"
+
+	var (
+		resp *http.Response
+		err  error
+	)
+	switch command {
+	case "add-peer":
+		body, _ := json.Marshal(map[string]string{"addr": peer})
+		resp, err = postAdmin(base, token, body)
+	case "remove-peer":
+		var req *http.Request
+		req, err = http.NewRequest(http.MethodDelete, base+"/"+url.PathEscape(peer), nil)
+		if err == nil {
+			req.Header.Set("Authorization", "Bearer "+token)
+			resp, err = http.DefaultClient.Do(req)
+		}
+	default:
+		resp, err = http.Get(base)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to reach admin API: %v", err)
+	}
+	defer resp.Body.Close()
+
+	msg, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("admin API returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	fmt.Printf("Peers: %s\n", strings.TrimSpace(string(msg)))
+	return nil
+}
+
+// manageJobs lists the background jobs of the node behind the admin API,
+// shows one given by ID or kind, or acts on it. With peer set, the action
+// is passed on to the jobs of that peer.
+func manageJobs(adminAddr, token, job, action, peer string) error {
+	if adminAddr == "" {
+		return fmt.Errorf("no admin address configured")
+	}
+	base := "http://" + adminAddr + "/jobs"
+
+	var (
+		resp *http.Response
+		err  error
+	)
+	switch {
+	case job == "":
+		resp, err = http.Get(base)
+	case action == "start":
+		body, _ := json.Marshal(map[string]string{"kind": job, "peer": peer})
+		resp, err = postAdmin(base, token, body)
+	case action != "":
+		u := base + "/" + url.PathEscape(job) + "/" + url.PathEscape(action)
+		if peer != "" {
+			u += "?peer=" + url.QueryEscape(peer)
+		}
+		resp, err = postAdmin(u, token, nil)
+	default:
+		resp, err = http.Get(base + "/" + url.PathEscape(job))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to reach admin API: %v", err)
+	}
+	defer resp.Body.Close()
+
+	msg, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("admin API returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	fmt.Printf("Jobs: %s\n", strings.TrimSpace(string(msg)))
+	return nil
+}
+
+// transfer is an object transfer as the admin API reports it.
+type transfer struct {
+	Key       string    `json:"key"`
+	Objects   int       `json:"objects"`
+	Direction string    `json:"direction"`
+	Peer      string    `json:"peer"`
+	Size      int64     `json:"size"`
+	Bytes     int64     `json:"bytes"`
+	Rate      float64   `json:"bytes_per_second"`
+	StartedAt time.Time `json:"started_at"`
+	Error     string    `json:"error"`
+}
+
+// listTransfers prints the object transfers in progress on the node behind
+// the admin API, and the last ones to finish.
+func listTransfers(adminAddr string) error {
+	if adminAddr == "" {
+		return fmt.Errorf("no admin address configured")
+	}
+	resp, err := http.Get("http://" + adminAddr + "/transfers")
+	if err != nil {
+		return fmt.Errorf("failed to reach admin API: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("admin API returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	var transfers struct {
+		Active []transfer `json:"active"`
+		Recent []transfer `json:"recent"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&transfers); err != nil {
+		return fmt.Errorf("failed to decode transfers: %v", err)
+	}
+
+	fmt.Printf("Active transfers: %d\n", len(transfers.Active))
+	for _, t := range transfers.Active {
+		fmt.Printf("  %s\n", t)
+	}
+	fmt.Printf("Recent transfers: %d\n", len(transfers.Recent))
+	for _, t := range transfers.Recent {
+		fmt.Printf("  %s\n", t)
+	}
+	return nil
+}
+
+func (t transfer) String() string {
+	dir := "to"
+	if t.Direction == "receive" {
+		dir = "from"
+	}
+	key := t.Key
+	if t.Objects > 1 {
+		key = fmt.Sprintf("%s (+%d more)", t.Key, t.Objects-1)
+	}
+	line := fmt.Sprintf("%-7s %s %s %s: %d/%d bytes at %.0f B/s, started %s",
+		t.Direction, key, dir, t.Peer, t.Bytes, t.Size, t.Rate, t.StartedAt.Format(time.RFC3339))
+	if t.Error != "" {
+		line += " failed: " + t.Error
+	}
+	return line
+}
@@ -0,0 +1,75 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// NormalizeBootstrapNodes checks every bootstrap entry for a valid host:port
+// form and returns the list with whitespace trimmed, hosts lowercased, empty
+// entries and duplicates removed. Entries that point at the node's own
+// listen address are rejected, and when resolve is set every host must
+// resolve through DNS.
+func NormalizeBootstrapNodes(nodes []string, listenAddr string, resolve bool) ([]string, error) {
+	var (
+		normalized = make([]string, 0, len(nodes))
+		seen       = make(map[string]bool)
+	)
+
+	for _, node := range nodes {
+		node = strings.TrimSpace(node)
+		if node == "" {
+			continue
+		}
+
+		host, port, err := net.SplitHostPort(node)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bootstrap node %q: %v", node, err)
+		}
+		if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+			return nil, fmt.Errorf("invalid bootstrap node %q: bad port %q", node, port)
+		}
+
+		host = strings.ToLower(host)
+		addr := net.JoinHostPort(host, port)
+
+		if isSameAddr(addr, listenAddr) {
+			return nil, fmt.Errorf("bootstrap node %q is this node's own listen address", node)
+		}
+
+		if resolve && host != "" {
+			if _, err := net.LookupHost(host); err != nil {
+				return nil, fmt.Errorf("bootstrap node %q does not resolve: %v", node, err)
+			}
+		}
+
+		if seen[addr] {
+			continue
+		}
+		seen[addr] = true
+		normalized = append(normalized, addr)
+	}
+
+	return normalized, nil
+}
+
+// isSameAddr reports whether two host:port addresses refer to the same local
+// endpoint, treating an empty host and the loopback names as equivalent.
+func isSameAddr(a, b string) bool {
+	hostA, portA, errA := net.SplitHostPort(a)
+	hostB, portB, errB := net.SplitHostPort(b)
+	if errA != nil || errB != nil || portA != portB {
+		return false
+	}
+	return localHost(hostA) == localHost(hostB)
+}
+
+func localHost(host string) string {
+	switch strings.ToLower(host) {
+	case "", "localhost", "127.0.0.1", "::1", "0.0.0.0", "::":
+		return ""
+	}
+	return strings.ToLower(host)
+}
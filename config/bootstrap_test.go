@@ -0,0 +1,49 @@
+package config
+
+import "testing"
+
+func TestNormalizeBootstrapNodes(t *testing.T) {
+	nodes, err := NormalizeBootstrapNodes([]string{" :4000", "", "Node1:5000", "node1:5000", "[::1]:6000"}, ":3000", false)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expected := []string{":4000", "node1:5000", "[::1]:6000"}
+	if len(nodes) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, nodes)
+	}
+	for i := range expected {
+		if nodes[i] != expected[i] {
+			t.Errorf("Expected %s, got %s", expected[i], nodes[i])
+		}
+	}
+}
+
+func TestNormalizeBootstrapNodesErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		nodes []string
+	}{
+		{name: "missing port", nodes: []string{"node1"}},
+		{name: "bad port", nodes: []string{"node1:http"}},
+		{name: "port out of range", nodes: []string{"node1:70000"}},
+		{name: "own address", nodes: []string{"localhost:3000"}},
+		{name: "own address empty host", nodes: []string{":3000"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := NormalizeBootstrapNodes(test.nodes, ":3000", false); err == nil {
+				t.Error("Expected error but got none")
+			}
+		})
+	}
+}
+
+func TestValidateBootstrapNodes(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.BootstrapNodes = []string{"bad-entry"}
+	if err := cfg.Validate(); err == nil {
+		t.Error("Expected validation error for malformed bootstrap node")
+	}
+}
@@ -0,0 +1,94 @@
+package config
+
+import "fmt"
+
+// Encryptions of the replicas of a bucket (see BucketPolicy.Encryption).
+const (
+	EncryptionRequired = "required"
+	EncryptionNone     = "none"
+)
+
+// BucketPolicy overrides the cluster defaults for the objects of a bucket.
+// Zero values keep the default.
+type BucketPolicy struct {
+	Bucket string `json:"bucket"`
+	// ReplicationFactor is the number of copies of each object, the
+	// owner's included, instead of one on every peer.
+	ReplicationFactor int `json:"replication_factor,omitempty"`
+	// Sites restricts the replicas to the peers of these sites.
+	Sites []string `json:"sites,omitempty"`
+	// RequireEncryption refuses writes on the nodes whose replicas would
+	// not be encrypted with an authenticated cipher. It is the same as
+	// Encryption EncryptionRequired.
+	RequireEncryption bool `json:"require_encryption,omitempty"`
+	// Encryption overrides the encryption of the replicas configured on
+	// each node: EncryptionRequired refuses the writes, and the replicas
+	// received from peers, that are not encrypted with an authenticated
+	// cipher, and EncryptionNone stores the replicas unencrypted, for
+	// content that is public anyway.
+	Encryption string `json:"encryption,omitempty"`
+	// EncryptionKeyVersion, when set, is the version of the encryption key
+	// the replicas are encrypted with, instead of the current key of each
+	// node. Nodes refuse the writes of the bucket when they lack it.
+	EncryptionKeyVersion *uint32 `json:"encryption_key_version,omitempty"`
+}
+
+// IsZero reports whether the policy overrides nothing.
+func (p BucketPolicy) IsZero() bool {
+	return p.ReplicationFactor == 0 && len(p.Sites) == 0 && !p.RequireEncryption &&
+		p.Encryption == "" && p.EncryptionKeyVersion == nil
+}
+
+// RequiresEncryption reports whether the replicas of the bucket must be
+// encrypted with an authenticated cipher.
+func (p BucketPolicy) RequiresEncryption() bool {
+	return p.RequireEncryption || p.Encryption == EncryptionRequired
+}
+
+// AllowsSite reports whether the policy lets replicas be placed in site.
+func (p BucketPolicy) AllowsSite(site string) bool {
+	if len(p.Sites) == 0 {
+		return true
+	}
+	for _, allowed := range p.Sites {
+		if allowed == site {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateBucketPolicies checks the policies: each must name a bucket, at
+// most one policy per bucket, with a replication factor that is not
+// negative, sites that are named and an encryption that is known and does
+// not contradict itself.
+func ValidateBucketPolicies(policies []BucketPolicy) error {
+	seen := make(map[string]bool, len(policies))
+	for _, p := range policies {
+		if !validBucket(p.Bucket) {
+			return fmt.Errorf("invalid policy bucket %q", p.Bucket)
+		}
+		if seen[p.Bucket] {
+			return fmt.Errorf("duplicate policy for bucket %q", p.Bucket)
+		}
+		seen[p.Bucket] = true
+		if p.ReplicationFactor < 0 {
+			return fmt.Errorf("policy for bucket %q has a negative replication factor", p.Bucket)
+		}
+		for _, site := range p.Sites {
+			if site == "" {
+				return fmt.Errorf("policy for bucket %q names an empty site", p.Bucket)
+			}
+		}
+		switch p.Encryption {
+		case "", EncryptionRequired:
+		case EncryptionNone:
+			if p.RequireEncryption || p.EncryptionKeyVersion != nil {
+				return fmt.Errorf("policy for bucket %q both requires and disables encryption", p.Bucket)
+			}
+		default:
+			return fmt.Errorf("policy for bucket %q has an invalid encryption %q", p.Bucket, p.Encryption)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package config
+
+import "testing"
+
+func TestValidateBucketPolicies(t *testing.T) {
+	policies := []BucketPolicy{
+		{Bucket: "logs", ReplicationFactor: 2, Sites: []string{"east"}},
+		{Bucket: "secrets", RequireEncryption: true},
+		{Bucket: "public", Encryption: EncryptionNone},
+		{Bucket: "vault", Encryption: EncryptionRequired, EncryptionKeyVersion: new(uint32)},
+	}
+	if err := ValidateBucketPolicies(policies); err != nil {
+		t.Errorf("Expected valid policies, got %v", err)
+	}
+
+	invalid := map[string][]BucketPolicy{
+		"empty bucket":             {{ReplicationFactor: 1}},
+		"nested bucket":            {{Bucket: "logs/app"}},
+		"duplicate bucket":         {{Bucket: "logs"}, {Bucket: "logs", ReplicationFactor: 2}},
+		"negative factor":          {{Bucket: "logs", ReplicationFactor: -1}},
+		"empty site":               {{Bucket: "logs", Sites: []string{""}}},
+		"unknown encryption":       {{Bucket: "logs", Encryption: "sometimes"}},
+		"contradictory encryption": {{Bucket: "logs", Encryption: EncryptionNone, RequireEncryption: true}},
+		"key of no encryption":     {{Bucket: "logs", Encryption: EncryptionNone, EncryptionKeyVersion: new(uint32)}},
+	}
+	for name, policies := range invalid {
+		if err := ValidateBucketPolicies(policies); err == nil {
+			t.Errorf("%s: expected validation error", name)
+		}
+	}
+
+	cfg := DefaultConfig()
+	cfg.BucketPolicies = invalid["negative factor"]
+	if err := cfg.Validate(); err == nil {
+		t.Error("Expected config with an invalid bucket policy to be rejected")
+	}
+}
+
+func TestBucketPolicyAllowsSite(t *testing.T) {
+	if !(BucketPolicy{}).AllowsSite("") {
+		t.Error("Expected a policy without sites to allow any site")
+	}
+	p := BucketPolicy{Sites: []string{"east", "west"}}
+	if !p.AllowsSite("west") || p.AllowsSite("north") || p.AllowsSite("") {
+		t.Errorf("Expected only the sites listed to be allowed by %v", p.Sites)
+	}
+}
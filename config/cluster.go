@@ -0,0 +1,101 @@
+package config
+
+import "reflect"
+
+// ClusterSettings are the settings that are shared by every member of the
+// cluster. They are distributed over the control protocol, and a node only
+// accepts a set whose Version is newer than the one it already has, so all
+// members converge on the latest values no matter the order in which they
+// hear about them. Zero values mean "not set" and leave the local value alone.
+type ClusterSettings struct {
+	Version   uint64 `json:"version"`
+	UpdatedBy string `json:"updated_by"`
+
+	ReplicationFactor int   `json:"replication_factor,omitempty"`
+	MaxStorageSize    int64 `json:"max_storage_size_bytes,omitempty"`
+	// BucketPolicies replace the bucket policies of every member. A policy
+	// overriding nothing removes the one of its bucket.
+	BucketPolicies []BucketPolicy `json:"bucket_policies,omitempty"`
+	// BucketQuotas and TenantQuotas replace the quotas of every member.
+	BucketQuotas []BucketQuota `json:"bucket_quotas,omitempty"`
+	TenantQuotas []TenantQuota `json:"tenant_quotas,omitempty"`
+
+	// ClientRateLimit and PeerBandwidthLimit replace the rate limits of
+	// every member. Being zero when not set, they cannot lift a limit.
+	ClientRateLimit    int   `json:"client_rate_limit,omitempty"`
+	PeerBandwidthLimit int64 `json:"peer_bandwidth_limit_bytes,omitempty"`
+}
+
+// Names of the settings that can be distributed cluster-wide, as used in
+// Config.LocalOverrides.
+const (
+	SettingReplicationFactor  = "replication_factor"
+	SettingMaxStorageSize     = "max_storage_size_bytes"
+	SettingBucketPolicies     = "bucket_policies"
+	SettingBucketQuotas       = "bucket_quotas"
+	SettingTenantQuotas       = "tenant_quotas"
+	SettingClientRateLimit    = "client_rate_limit"
+	SettingPeerBandwidthLimit = "peer_bandwidth_limit_bytes"
+)
+
+// IsOverridden reports whether the node keeps its own value for the named
+// cluster setting.
+func (c *Config) IsOverridden(setting string) bool {
+	for _, name := range c.LocalOverrides {
+		if name == setting {
+			return true
+		}
+	}
+	return false
+}
+
+// ApplyClusterSettings copies the set values of cs into the configuration,
+// skipping the settings listed in LocalOverrides. It returns the names of the
+// settings that changed.
+func (c *Config) ApplyClusterSettings(cs ClusterSettings) []string {
+	var changed []string
+
+	if cs.ReplicationFactor > 0 && !c.IsOverridden(SettingReplicationFactor) &&
+		cs.ReplicationFactor != c.ReplicationFactor {
+		c.ReplicationFactor = cs.ReplicationFactor
+		changed = append(changed, SettingReplicationFactor)
+	}
+
+	if cs.MaxStorageSize > 0 && !c.IsOverridden(SettingMaxStorageSize) &&
+		cs.MaxStorageSize != c.MaxStorageSize {
+		c.MaxStorageSize = cs.MaxStorageSize
+		changed = append(changed, SettingMaxStorageSize)
+	}
+
+	if cs.BucketPolicies != nil && !c.IsOverridden(SettingBucketPolicies) &&
+		!reflect.DeepEqual(cs.BucketPolicies, c.BucketPolicies) {
+		c.BucketPolicies = cs.BucketPolicies
+		changed = append(changed, SettingBucketPolicies)
+	}
+
+	if cs.BucketQuotas != nil && !c.IsOverridden(SettingBucketQuotas) &&
+		!reflect.DeepEqual(cs.BucketQuotas, c.BucketQuotas) {
+		c.BucketQuotas = cs.BucketQuotas
+		changed = append(changed, SettingBucketQuotas)
+	}
+
+	if cs.TenantQuotas != nil && !c.IsOverridden(SettingTenantQuotas) &&
+		!reflect.DeepEqual(cs.TenantQuotas, c.TenantQuotas) {
+		c.TenantQuotas = cs.TenantQuotas
+		changed = append(changed, SettingTenantQuotas)
+	}
+
+	if cs.ClientRateLimit > 0 && !c.IsOverridden(SettingClientRateLimit) &&
+		cs.ClientRateLimit != c.ClientRateLimit {
+		c.ClientRateLimit = cs.ClientRateLimit
+		changed = append(changed, SettingClientRateLimit)
+	}
+
+	if cs.PeerBandwidthLimit > 0 && !c.IsOverridden(SettingPeerBandwidthLimit) &&
+		cs.PeerBandwidthLimit != c.PeerBandwidthLimit {
+		c.PeerBandwidthLimit = cs.PeerBandwidthLimit
+		changed = append(changed, SettingPeerBandwidthLimit)
+	}
+
+	return changed
+}
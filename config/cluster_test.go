@@ -0,0 +1,95 @@
+package config
+
+import "testing"
+
+func TestApplyClusterSettings(t *testing.T) {
+	cfg := DefaultConfig()
+
+	changed := cfg.ApplyClusterSettings(ClusterSettings{
+		Version:           1,
+		ReplicationFactor: 3,
+		MaxStorageSize:    2048,
+	})
+	if len(changed) != 2 {
+		t.Errorf("Expected 2 changed settings, got %v", changed)
+	}
+	if cfg.ReplicationFactor != 3 || cfg.MaxStorageSize != 2048 {
+		t.Errorf("Expected settings to be applied, got replication=%d max=%d", cfg.ReplicationFactor, cfg.MaxStorageSize)
+	}
+
+	// Unset values leave the local configuration alone
+	changed = cfg.ApplyClusterSettings(ClusterSettings{Version: 2})
+	if len(changed) != 0 || cfg.ReplicationFactor != 3 {
+		t.Errorf("Expected no changes for unset values, got %v", changed)
+	}
+}
+
+func TestApplyClusterSettingsLocalOverrides(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.LocalOverrides = []string{SettingReplicationFactor}
+
+	changed := cfg.ApplyClusterSettings(ClusterSettings{
+		Version:           1,
+		ReplicationFactor: 5,
+		MaxStorageSize:    4096,
+	})
+	if len(changed) != 1 || changed[0] != SettingMaxStorageSize {
+		t.Errorf("Expected only max storage size to change, got %v", changed)
+	}
+	if cfg.ReplicationFactor != 2 {
+		t.Errorf("Expected overridden replication factor to be kept, got %d", cfg.ReplicationFactor)
+	}
+}
+
+func TestApplyClusterSettingsBucketPolicies(t *testing.T) {
+	cfg := DefaultConfig()
+	policies := []BucketPolicy{{Bucket: "logs", ReplicationFactor: 2}}
+
+	changed := cfg.ApplyClusterSettings(ClusterSettings{Version: 1, BucketPolicies: policies})
+	if len(changed) != 1 || changed[0] != SettingBucketPolicies || len(cfg.BucketPolicies) != 1 {
+		t.Errorf("Expected bucket policies to be applied, got %v", changed)
+	}
+	if changed := cfg.ApplyClusterSettings(ClusterSettings{Version: 2, BucketPolicies: policies}); len(changed) != 0 {
+		t.Errorf("Expected no changes for the same policies, got %v", changed)
+	}
+
+	cfg.LocalOverrides = []string{SettingBucketPolicies}
+	cfg.ApplyClusterSettings(ClusterSettings{Version: 3, BucketPolicies: []BucketPolicy{{Bucket: "media"}}})
+	if cfg.BucketPolicies[0].Bucket != "logs" {
+		t.Errorf("Expected overridden bucket policies to be kept, got %v", cfg.BucketPolicies)
+	}
+}
+
+func TestApplyClusterSettingsQuotasAndRateLimits(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.LocalOverrides = []string{SettingPeerBandwidthLimit}
+	cfg.PeerBandwidthLimit = 1 << 20
+
+	changed := cfg.ApplyClusterSettings(ClusterSettings{
+		Version:            1,
+		BucketQuotas:       []BucketQuota{{Bucket: "logs", MaxBytes: 1024}},
+		TenantQuotas:       []TenantQuota{{Tenant: "acme", Buckets: []string{"a", "b"}, MaxBytes: 4096}},
+		ClientRateLimit:    50,
+		PeerBandwidthLimit: 1 << 10,
+	})
+	if len(changed) != 3 {
+		t.Errorf("Expected quotas and the client rate limit to change, got %v", changed)
+	}
+	if len(cfg.BucketQuotas) != 1 || cfg.BucketQuotas[0].MaxBytes != 1024 {
+		t.Errorf("Expected the bucket quotas to be applied, got %v", cfg.BucketQuotas)
+	}
+	if len(cfg.TenantQuotas) != 1 || cfg.TenantQuotas[0].Tenant != "acme" {
+		t.Errorf("Expected the tenant quotas to be applied, got %v", cfg.TenantQuotas)
+	}
+	if cfg.ClientRateLimit != 50 {
+		t.Errorf("Expected the client rate limit to be applied, got %d", cfg.ClientRateLimit)
+	}
+	if cfg.PeerBandwidthLimit != 1<<20 {
+		t.Errorf("Expected the overridden peer bandwidth limit to be kept, got %d", cfg.PeerBandwidthLimit)
+	}
+
+	// Unset values leave the local quotas and limits alone
+	if changed := cfg.ApplyClusterSettings(ClusterSettings{Version: 2}); len(changed) != 0 {
+		t.Errorf("Expected no changes for unset values, got %v", changed)
+	}
+}
@@ -1,39 +1,370 @@
 package config
 
 import (
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"net"
 	"os"
 	"strconv"
 	"strings"
 
 	"github.com/anthdm/foreverstore/logger"
+	"github.com/anthdm/foreverstore/p2p"
 )
 
+// DefaultCapacityInterval is how often, in seconds, nodes report their disk
+// usage to their peers when CapacityInterval is not set.
+const DefaultCapacityInterval = 30
+
+// DefaultMirrorReconcileInterval is how often, in seconds, nodes bring
+// their mirror back in line with their objects, after it missed changes,
+// when MirrorReconcileInterval is not set.
+const DefaultMirrorReconcileInterval = 3600
+
+// DefaultGCInterval is how often, in seconds, nodes prune the empty
+// directories of their storage root when GCInterval is not set.
+const DefaultGCInterval = 3600
+
+// DefaultAntiEntropyInterval is how often, in seconds, nodes compare the
+// replicas their peers hold with their objects when AntiEntropyInterval is
+// not set.
+const DefaultAntiEntropyInterval = 600
+
+// DefaultConsistencyCheckInterval is how often, in seconds, nodes check the
+// consistency of a sample of their objects when ConsistencyCheckInterval is
+// not set, and DefaultConsistencyCheckSample how many objects they check.
+const (
+	DefaultConsistencyCheckInterval = 3600
+	DefaultConsistencyCheckSample   = 100
+)
+
+// DefaultHeartbeatInterval is how often, in seconds, nodes send their peers
+// a heartbeat when HeartbeatInterval is not set, and DefaultHeartbeatMisses
+// how many intervals a peer may go silent for before it is dropped.
+const (
+	DefaultHeartbeatInterval = 5
+	DefaultHeartbeatMisses   = 3
+)
+
+// DefaultReconnectMaxBackoff is the longest, in seconds, nodes wait between
+// dials of a bootstrap node they lost when ReconnectMaxBackoff is not set.
+const DefaultReconnectMaxBackoff = 60
+
+// DefaultFollowInterval is how often, in seconds, a follower syncs with its
+// leader when FollowInterval is not set.
+const DefaultFollowInterval = 10
+
+// DefaultDiskCheckInterval is how often, in seconds, nodes check the free
+// space of their storage root when DiskCheckInterval is not set.
+const DefaultDiskCheckInterval = 30
+
+// DefaultDiskMinFreeBytes is the free space below which nodes stop taking
+// writes when DiskMinFreeBytes is not set.
+const DefaultDiskMinFreeBytes = 64 << 20
+
+// DefaultDiskMaxWriteErrors is the number of failed writes within a disk
+// check interval that make nodes stop taking writes when DiskMaxWriteErrors
+// is not set.
+const DefaultDiskMaxWriteErrors = 3
+
+// DefaultResourceCheckInterval is how often, in seconds, nodes check their
+// goroutines and open files when ResourceCheckInterval is not set.
+const DefaultResourceCheckInterval = 30
+
+// DefaultMaxGoroutines is the number of goroutines above which nodes warn
+// when MaxGoroutines is not set.
+const DefaultMaxGoroutines = 10000
+
+// DefaultMaxClockSkewMs is the difference, in milliseconds, between the
+// clocks of two nodes above which they warn when MaxClockSkewMs is not set.
+const DefaultMaxClockSkewMs = 2000
+
+// DefaultChunkSizeBytes is the size of the chunks large files are split
+// into when ChunkSizeBytes is not set.
+const DefaultChunkSizeBytes = 4 << 20
+
+// DefaultTLSReloadInterval is how often, in seconds, nodes read their peer
+// TLS certificates again when TLSReloadInterval is not set.
+const DefaultTLSReloadInterval = 60
+
 // Config holds all configuration for the file server
 type Config struct {
 	// Server configuration
 	ListenAddr    string   `json:"listen_addr"`
+	// ListenAddrs are more addresses to accept peers on, for a node
+	// listening on IPv4 and IPv6 addresses, or on several interfaces.
+	ListenAddrs []string `json:"listen_addrs,omitempty"`
+	// AdvertiseAddr is the address peers are told to reach the node at,
+	// for nodes behind a load balancer or NAT, or with several interfaces.
+	// Defaults to ListenAddr, its host taken from the connection when it
+	// has none.
+	AdvertiseAddr string `json:"advertise_addr,omitempty"`
 	StorageRoot   string   `json:"storage_root"`
 	BootstrapNodes []string `json:"bootstrap_nodes"`
+	// ResolveBootstrapNodes requires bootstrap hostnames to resolve via DNS
+	// at startup.
+	ResolveBootstrapNodes bool `json:"resolve_bootstrap_nodes,omitempty"`
+	// AdminAddr is the address of the HTTP control-plane API. Empty disables it.
+	AdminAddr string `json:"admin_addr"`
+	// AdminToken authenticates the requests that write data or start
+	// administrative operations on the admin API: they must present it as
+	// a bearer token, and are refused when it is not set. It may be a
+	// secret reference.
+	AdminToken string `json:"admin_token,omitempty"`
 	
 	// Logging configuration
 	LogLevel string `json:"log_level"`
 	LogFile  string `json:"log_file"`
+	// AccessLogFile receives one JSON record per client operation served on
+	// the admin API, apart from the application log. Empty disables it. It
+	// is rotated once it holds AccessLogMaxSizeMB, 100 when not set,
+	// keeping AccessLogMaxBackups rotated files, 5 when not set.
+	AccessLogFile       string `json:"access_log_file,omitempty"`
+	AccessLogMaxSizeMB  int    `json:"access_log_max_size_mb,omitempty"`
+	AccessLogMaxBackups int    `json:"access_log_max_backups,omitempty"`
 	
 	// Security configuration
 	EncryptionEnabled bool   `json:"encryption_enabled"`
 	EncryptionKey     string `json:"encryption_key"`
+	// EncryptionKeyVersion is the version recorded with data encrypted with
+	// EncryptionKey. PreviousEncryptionKeys maps older versions to their keys
+	// so data that has not been rotated yet stays readable.
+	EncryptionKeyVersion   uint32            `json:"encryption_key_version,omitempty"`
+	PreviousEncryptionKeys map[string]string `json:"previous_encryption_keys,omitempty"`
+	// EncryptionMode is the format used for newly encrypted data: "gcm"
+	// (authenticated, the default) or "ctr" (legacy).
+	EncryptionMode string `json:"encryption_mode"`
+	// CipherSuite is the cipher used by the "gcm" mode: "aes-gcm" (the
+	// default, FIPS approved), "chacha20-poly1305", or "none" to store
+	// replicas unencrypted.
+	CipherSuite string `json:"cipher_suite"`
+	// PathTransform lays out the objects on disk: "cas" (the default),
+	// "cas-sha256", "flat", "date-partitioned" or "tenant-prefixed". A
+	// storage root keeps the transform it was first written with.
+	PathTransform string `json:"path_transform,omitempty"`
+	// EncryptionKeyFile is where a generated key is persisted when no
+	// EncryptionKey is configured. Defaults to a file under StorageRoot.
+	EncryptionKeyFile string `json:"encryption_key_file,omitempty"`
+	// IdentityKeyFile holds the node's key for signing control messages.
+	// Defaults to a file under StorageRoot; generated on first start.
+	IdentityKeyFile string `json:"identity_key_file,omitempty"`
+	// TrustedPeerKeys are the hex encoded public keys of the nodes allowed
+	// to send control messages. When empty, each peer's key is pinned on
+	// first contact.
+	TrustedPeerKeys []string `json:"trusted_peer_keys,omitempty"`
+	// ClusterSecret, when set, is a secret all the nodes of the cluster
+	// share: peers prove they know it, along with their identity key, in
+	// the handshake of each connection. It may be a secret reference. A
+	// secret derived from JoinToken is used when it is not set, and a node
+	// with neither, nor TrustedPeerKeys, refuses every peer.
+	ClusterSecret string `json:"cluster_secret,omitempty"`
+	// MaxProtocolVersion holds back the peer protocol versions this node
+	// offers, 0 offering the newest it speaks. Set it to the version the
+	// rest of the cluster speaks while the nodes are upgraded, and clear it
+	// once they all are.
+	MaxProtocolVersion int `json:"max_protocol_version,omitempty"`
+	// TLSCertFile, TLSKeyFile and TLSCAFile secure the connections between
+	// peers with mutual TLS: the node presents the certificate and accepts
+	// the peers presenting one issued by the CAs. Each is the path of a PEM
+	// file or a secret reference to the PEM. They are read again every
+	// TLSReloadInterval seconds, so renewed certificates are used without
+	// a restart. The keys tls_cert, tls_key and tls_ca are accepted for
+	// them too, as are the flags -tls-cert, -tls-key and -tls-ca.
+	TLSCertFile       string `json:"tls_cert_file,omitempty"`
+	TLSKeyFile        string `json:"tls_key_file,omitempty"`
+	TLSCAFile         string `json:"tls_ca_file,omitempty"`
+	TLSReloadInterval int    `json:"tls_reload_interval_seconds,omitempty"`
+	// TLSClientCertOptional accepts peers dialing in without a certificate,
+	// over TLS still, where peers are told apart by their identity keys
+	// alone. Certificates that are presented are verified all the same, and
+	// the node always verifies the certificate of the peers it dials.
+	TLSClientCertOptional bool `json:"tls_client_cert_optional,omitempty"`
+
+	// PeerProxy is the SOCKS5 ("socks5://", "socks5h://") or HTTP CONNECT
+	// ("http://") proxy peers are dialed through, for nodes without direct
+	// outbound connectivity. PeerProxies sets the proxy of some peers, by
+	// address or host, "direct" dialing them directly. Connections to the
+	// node are accepted as usual.
+	PeerProxy   string            `json:"peer_proxy,omitempty"`
+	PeerProxies map[string]string `json:"peer_proxies,omitempty"`
 	
 	// Performance configuration
+	// MaxConnections caps the connections to peers, dialed and accepted.
 	MaxConnections    int `json:"max_connections"`
 	ReadTimeout       int `json:"read_timeout_seconds"`
 	WriteTimeout      int `json:"write_timeout_seconds"`
+	// TCPKeepAlive is how often, in seconds, keep-alives probe idle
+	// connections to peers: zero keeps the default of 15 seconds, and a
+	// negative value disables them. TCPNoDelay sends small writes, such as
+	// control messages, at once rather than batching them. TCPReadBuffer
+	// and TCPWriteBuffer size the socket buffers, in bytes, zero leaving
+	// them to the system; larger ones speed up replicating large files.
+	TCPKeepAlive   int  `json:"tcp_keep_alive_seconds,omitempty"`
+	TCPNoDelay     bool `json:"tcp_no_delay"`
+	TCPReadBuffer  int  `json:"tcp_read_buffer_bytes,omitempty"`
+	TCPWriteBuffer int  `json:"tcp_write_buffer_bytes,omitempty"`
 	
 	// Storage configuration
 	MaxStorageSize    int64 `json:"max_storage_size_bytes"`
 	ReplicationFactor int   `json:"replication_factor"`
+	// WriteConsistency is how many copies of an object must be persisted
+	// for a store to succeed: "one" (the default), the copy of the node
+	// storing it; "quorum", a majority of the copies it places; or "all"
+	// of them. Copies on peers count once they acknowledged persisting.
+	WriteConsistency string `json:"write_consistency,omitempty"`
+	// CapacityInterval is how often, in seconds, the node reports its disk
+	// usage to its peers.
+	CapacityInterval int `json:"capacity_interval_seconds,omitempty"`
+	// GCInterval is how often, in seconds, the node prunes the directories
+	// left empty in its storage root and the namespaces holding no object.
+	GCInterval int `json:"gc_interval_seconds,omitempty"`
+	// AntiEntropyInterval is how often, in seconds, the node compares
+	// summaries of its objects with the replicas its peers hold, sending
+	// them those they miss.
+	AntiEntropyInterval int `json:"anti_entropy_interval_seconds,omitempty"`
+	// ConsistencyCheckInterval is how often, in seconds, the node compares
+	// the replicas its peers hold of ConsistencyCheckSample of its objects,
+	// picked at random, with them, and has those found divergent repaired.
+	// Followers leave it to their leader.
+	ConsistencyCheckInterval int `json:"consistency_check_interval_seconds,omitempty"`
+	ConsistencyCheckSample   int `json:"consistency_check_sample,omitempty"`
+	// HeartbeatInterval is how often, in seconds, the node sends its peers
+	// a heartbeat. A peer not heard from for HeartbeatMisses intervals is
+	// dropped, and the objects it held replicas of re-replicated.
+	HeartbeatInterval int `json:"heartbeat_interval_seconds,omitempty"`
+	HeartbeatMisses   int `json:"heartbeat_misses,omitempty"`
+	// ReconnectMaxBackoff is the longest, in seconds, the node waits
+	// between dials of a bootstrap node it is not connected to, the delay
+	// doubling from a second at every failed dial.
+	ReconnectMaxBackoff int `json:"reconnect_max_backoff_seconds,omitempty"`
+	// CheckOnStart reconciles the metadata of the objects on disk with
+	// their files when the node starts, rebuilding what an unclean shutdown
+	// left missing, and checks the content of CheckSamplePercent percent of
+	// the objects against their integrity tag.
+	CheckOnStart       bool `json:"check_on_start,omitempty"`
+	CheckSamplePercent int  `json:"check_sample_percent,omitempty"`
+	// The node turns read-only, rejecting the writes of clients and peers,
+	// when the free space of its storage root falls below DiskMinFreeBytes,
+	// checked every DiskCheckInterval seconds, or when the disk fails
+	// DiskMaxWriteErrors writes within one of those intervals.
+	DiskCheckInterval  int   `json:"disk_check_interval_seconds,omitempty"`
+	DiskMinFreeBytes   int64 `json:"disk_min_free_bytes,omitempty"`
+	DiskMaxWriteErrors int   `json:"disk_max_write_errors,omitempty"`
+	// The node counts its goroutines and open files every
+	// ResourceCheckInterval seconds, and warns while it has more than
+	// MaxGoroutines or MaxOpenFiles, the latter 80% of the open files
+	// limit of the process when not set.
+	ResourceCheckInterval int `json:"resource_check_interval_seconds,omitempty"`
+	MaxGoroutines         int `json:"max_goroutines,omitempty"`
+	MaxOpenFiles          int `json:"max_open_files,omitempty"`
+
+	// SlowOpThresholdMs logs every store, get and replication taking longer
+	// than this many milliseconds, with a breakdown of where the time went.
+	// Zero disables slow-op logging.
+	SlowOpThresholdMs int `json:"slow_op_threshold_ms,omitempty"`
+
+	// ClientRateLimit is how many requests per second the node serves on
+	// its object endpoints, those past it answered 429 Too Many Requests.
+	// PeerBandwidthLimit is how many bytes per second the node sends its
+	// peers in replicas and fetched objects. Zero lifts either limit; both
+	// can be changed at runtime.
+	ClientRateLimit    int   `json:"client_rate_limit,omitempty"`
+	PeerBandwidthLimit int64 `json:"peer_bandwidth_limit_bytes,omitempty"`
+
+	// MaxClockSkewMs is the difference, in milliseconds, between the clock
+	// of the node and the clock of a peer above which the node warns.
+	// Object locks, lifecycle rules and tombstones are timed by the clock
+	// of each node.
+	MaxClockSkewMs int `json:"max_clock_skew_ms,omitempty"`
+
+	// ReadAheadChunks is how many chunks of a chunked file, stored under
+	// keys ending in the chunk number, are prefetched once a client reads
+	// its chunks in order. Zero disables read-ahead.
+	ReadAheadChunks int `json:"read_ahead_chunks,omitempty"`
+
+	// ChunkSizeBytes is the size of the chunks the files stored chunked
+	// are split into, each stored and replicated as an object of its own.
+	ChunkSizeBytes int64 `json:"chunk_size_bytes,omitempty"`
+
+	// Lifecycle holds the rules applied to the objects of each bucket, and
+	// LifecycleInterval how often, in seconds, they are evaluated.
+	Lifecycle         []LifecycleRule `json:"lifecycle,omitempty"`
+	LifecycleInterval int             `json:"lifecycle_interval_seconds,omitempty"`
+
+	// BucketQuotas and TenantQuotas limit the bytes stored across the
+	// cluster in a bucket, and in all the buckets of a tenant.
+	BucketQuotas []BucketQuota `json:"bucket_quotas,omitempty"`
+	TenantQuotas []TenantQuota `json:"tenant_quotas,omitempty"`
+
+	// BucketPolicies override the replication factor, the sites replicas
+	// go to and the encryption required for the objects of some buckets.
+	// They are cluster settings: the policies distributed replace them.
+	BucketPolicies []BucketPolicy `json:"bucket_policies,omitempty"`
+
+	// UploadPolicies restrict the size, content type and keys of the
+	// objects clients store, in some buckets or in all of them.
+	UploadPolicies []UploadPolicy `json:"upload_policies,omitempty"`
+
+	// ColdTierDir is the directory objects are offloaded to when they go
+	// unread for ColdAfterDays, or when a lifecycle rule transitions them.
+	// Empty disables the cold tier.
+	ColdTierDir   string `json:"cold_tier_dir,omitempty"`
+	ColdAfterDays int    `json:"cold_after_days,omitempty"`
+
+	// MirrorDir is the directory every object stored by the node is copied
+	// to, for recovery from outside the cluster. Empty disables the mirror.
+	MirrorDir string `json:"mirror_dir,omitempty"`
+	// MirrorReconcileInterval is how often, in seconds, the mirror is
+	// brought back in line with the objects of the node, after it missed
+	// changes.
+	MirrorReconcileInterval int `json:"mirror_reconcile_interval_seconds,omitempty"`
+
+	// ColdTierEndpoints and MirrorEndpoints, instead of a directory, keep
+	// the cold tier and the mirror in another cluster, whose HTTP APIs are
+	// at these addresses, under the buckets "cold" and "mirror". TierToken
+	// is the admin token of that cluster.
+	ColdTierEndpoints []string `json:"cold_tier_endpoints,omitempty"`
+	MirrorEndpoints   []string `json:"mirror_endpoints,omitempty"`
+	TierToken         string   `json:"tier_token,omitempty"`
+
+	// Follow makes the node a read-only follower of the node whose admin
+	// API is at this address: it keeps a copy of the objects of that node,
+	// or of its bucket FollowBucket only, current through the change feed
+	// of that node, until it is promoted to a full member. Changes are
+	// waited for, and failed syncs tried again, every FollowInterval
+	// seconds.
+	Follow         string `json:"follow,omitempty"`
+	FollowBucket   string `json:"follow_bucket,omitempty"`
+	FollowInterval int    `json:"follow_interval_seconds,omitempty"`
+
+	// Join is the admin API address of a member of the cluster the node
+	// joins through: it downloads the membership and the settings of the
+	// cluster from it when it starts, instead of being given every member
+	// in BootstrapNodes. JoinToken authenticates the joins: members accept
+	// the joins presenting it. It may be a secret reference.
+	Join      string `json:"join,omitempty"`
+	JoinToken string `json:"join_token,omitempty"`
+
+	// Site labels the datacenter the node runs in. Reads prefer the
+	// replicas of the node's own site, and CrossSiteReplication sets how
+	// replicas reach the nodes of other sites: "sync" (the default), with
+	// every write, or "async", in the background once the write is
+	// replicated within the site.
+	Site                 string `json:"site,omitempty"`
+	CrossSiteReplication string `json:"cross_site_replication,omitempty"`
+
+	// LocalOverrides lists the cluster settings (see ClusterSettings) this
+	// node keeps its own value for instead of following the cluster.
+	LocalOverrides []string `json:"local_overrides,omitempty"`
+
+	// Profile configuration. Profiles holds named overrides (dev, staging,
+	// prod, ...) that are merged on top of the top-level values. The active
+	// profile is selected by FS_PROFILE, falling back to Profile.
+	Profile  string                     `json:"profile,omitempty"`
+	Profiles map[string]json.RawMessage `json:"profiles,omitempty"`
 }
 
 // DefaultConfig returns a configuration with default values
@@ -42,13 +373,17 @@ func DefaultConfig() *Config {
 		ListenAddr:        ":3000",
 		StorageRoot:       "storage",
 		BootstrapNodes:    []string{},
+		AdminAddr:         "127.0.0.1:3100",
 		LogLevel:          "INFO",
 		LogFile:           "",
 		EncryptionEnabled: true,
 		EncryptionKey:     "",
+		EncryptionMode:    "gcm",
+		CipherSuite:       "aes-gcm",
 		MaxConnections:    100,
 		ReadTimeout:       30,
 		WriteTimeout:      30,
+		TCPNoDelay:        true,
 		MaxStorageSize:    1024 * 1024 * 1024, // 1GB
 		ReplicationFactor: 2,
 	}
@@ -72,11 +407,85 @@ func LoadFromFile(filename string) (*Config, error) {
 	if err := decoder.Decode(config); err != nil {
 		return nil, fmt.Errorf("failed to decode config file: %w", err)
 	}
+
+	if err := config.ApplyProfile(os.Getenv("FS_PROFILE")); err != nil {
+		return nil, err
+	}
 	
 	logger.Info("Loaded configuration from %s", filename)
 	return config, nil
 }
 
+// UnmarshalJSON decodes a configuration, accepting the TLS settings under
+// their short keys too: tls_cert, tls_key and tls_ca. A setting given under
+// both its keys must have the same value under each.
+func (c *Config) UnmarshalJSON(data []byte) error {
+	type config Config
+	if err := json.Unmarshal(data, (*config)(c)); err != nil {
+		return err
+	}
+	var short struct {
+		TLSCert *string `json:"tls_cert"`
+		TLSKey  *string `json:"tls_key"`
+		TLSCA   *string `json:"tls_ca"`
+	}
+	if err := json.Unmarshal(data, &short); err != nil {
+		return err
+	}
+	var long map[string]json.RawMessage
+	if err := json.Unmarshal(data, &long); err != nil {
+		return err
+	}
+	for _, alias := range []struct {
+		short, long string
+		value       *string
+		field       *string
+	}{
+		{"tls_cert", "tls_cert_file", short.TLSCert, &c.TLSCertFile},
+		{"tls_key", "tls_key_file", short.TLSKey, &c.TLSKeyFile},
+		{"tls_ca", "tls_ca_file", short.TLSCA, &c.TLSCAFile},
+	} {
+		if alias.value == nil {
+			continue
+		}
+		if _, ok := long[alias.long]; ok && *alias.field != *alias.value {
+			return fmt.Errorf("%s and %s set different values", alias.short, alias.long)
+		}
+		*alias.field = *alias.value
+	}
+	return nil
+}
+
+// ApplyProfile merges the named profile on top of the current values. Only
+// the fields present in the profile are overridden; everything else keeps
+// the shared top-level value. An empty name selects c.Profile, and if that
+// is empty too no profile is applied.
+func (c *Config) ApplyProfile(name string) error {
+	if name == "" {
+		name = c.Profile
+	}
+	if name == "" {
+		return nil
+	}
+
+	raw, ok := c.Profiles[name]
+	if !ok {
+		return fmt.Errorf("unknown configuration profile: %s", name)
+	}
+
+	// Profiles are not allowed to redefine the profile set itself, so keep
+	// the originals around and restore them after the merge.
+	profiles := c.Profiles
+	if err := json.Unmarshal(raw, c); err != nil {
+		return fmt.Errorf("failed to apply profile %s: %w", name, err)
+	}
+	c.Profiles = profiles
+	c.Profile = name
+
+	logger.Info("Applied configuration profile %s", name)
+	return nil
+}
+
 // SaveToFile saves the configuration to a JSON file
 func (c *Config) SaveToFile(filename string) error {
 	file, err := os.Create(filename)
@@ -100,18 +509,33 @@ func (c *Config) LoadFromEnv() {
 	if val := os.Getenv("FS_LISTEN_ADDR"); val != "" {
 		c.ListenAddr = val
 	}
+	if val := os.Getenv("FS_LISTEN_ADDRS"); val != "" {
+		c.ListenAddrs = strings.Split(val, ",")
+	}
+	if val := os.Getenv("FS_ADVERTISE_ADDR"); val != "" {
+		c.AdvertiseAddr = val
+	}
 	if val := os.Getenv("FS_STORAGE_ROOT"); val != "" {
 		c.StorageRoot = val
 	}
 	if val := os.Getenv("FS_BOOTSTRAP_NODES"); val != "" {
 		c.BootstrapNodes = strings.Split(val, ",")
 	}
+	if val, ok := os.LookupEnv("FS_ADMIN_ADDR"); ok {
+		c.AdminAddr = val
+	}
+	if val := os.Getenv("FS_ADMIN_TOKEN"); val != "" {
+		c.AdminToken = val
+	}
 	if val := os.Getenv("FS_LOG_LEVEL"); val != "" {
 		c.LogLevel = val
 	}
 	if val := os.Getenv("FS_LOG_FILE"); val != "" {
 		c.LogFile = val
 	}
+	if val := os.Getenv("FS_ACCESS_LOG_FILE"); val != "" {
+		c.AccessLogFile = val
+	}
 	if val := os.Getenv("FS_ENCRYPTION_ENABLED"); val != "" {
 		if enabled, err := strconv.ParseBool(val); err == nil {
 			c.EncryptionEnabled = enabled
@@ -120,6 +544,47 @@ func (c *Config) LoadFromEnv() {
 	if val := os.Getenv("FS_ENCRYPTION_KEY"); val != "" {
 		c.EncryptionKey = val
 	}
+	if val := os.Getenv("FS_ENCRYPTION_MODE"); val != "" {
+		c.EncryptionMode = val
+	}
+	if val := os.Getenv("FS_CIPHER_SUITE"); val != "" {
+		c.CipherSuite = val
+	}
+	if val := os.Getenv("FS_PATH_TRANSFORM"); val != "" {
+		c.PathTransform = val
+	}
+	if val := os.Getenv("FS_ENCRYPTION_KEY_FILE"); val != "" {
+		c.EncryptionKeyFile = val
+	}
+	if val := os.Getenv("FS_IDENTITY_KEY_FILE"); val != "" {
+		c.IdentityKeyFile = val
+	}
+	if val := os.Getenv("FS_CLUSTER_SECRET"); val != "" {
+		c.ClusterSecret = val
+	}
+	if val := os.Getenv("FS_TLS_CERT_FILE"); val != "" {
+		c.TLSCertFile = val
+	}
+	if val := os.Getenv("FS_TLS_KEY_FILE"); val != "" {
+		c.TLSKeyFile = val
+	}
+	if val := os.Getenv("FS_TLS_CA_FILE"); val != "" {
+		c.TLSCAFile = val
+	}
+	if val := os.Getenv("FS_TLS_CLIENT_CERT_OPTIONAL"); val != "" {
+		if optional, err := strconv.ParseBool(val); err == nil {
+			c.TLSClientCertOptional = optional
+		}
+	}
+	if val := os.Getenv("FS_PEER_PROXY"); val != "" {
+		c.PeerProxy = val
+	}
+	if val := os.Getenv("FS_SITE"); val != "" {
+		c.Site = val
+	}
+	if val := os.Getenv("FS_CROSS_SITE_REPLICATION"); val != "" {
+		c.CrossSiteReplication = val
+	}
 	if val := os.Getenv("FS_MAX_CONNECTIONS"); val != "" {
 		if maxConn, err := strconv.Atoi(val); err == nil {
 			c.MaxConnections = maxConn
@@ -145,31 +610,95 @@ func (c *Config) LoadFromEnv() {
 			c.ReplicationFactor = factor
 		}
 	}
+	if val := os.Getenv("FS_WRITE_CONSISTENCY"); val != "" {
+		c.WriteConsistency = val
+	}
 }
 
-// LoadFromFlags loads configuration from command line flags
-func (c *Config) LoadFromFlags() {
-	flag.StringVar(&c.ListenAddr, "listen", c.ListenAddr, "Address to listen on")
-	flag.StringVar(&c.StorageRoot, "storage", c.StorageRoot, "Storage root directory")
-	flag.StringVar(&c.LogLevel, "log-level", c.LogLevel, "Log level (DEBUG, INFO, WARN, ERROR, FATAL)")
-	flag.StringVar(&c.LogFile, "log-file", c.LogFile, "Log file path (empty for stdout)")
-	flag.BoolVar(&c.EncryptionEnabled, "encryption", c.EncryptionEnabled, "Enable encryption")
-	flag.StringVar(&c.EncryptionKey, "encryption-key", c.EncryptionKey, "Encryption key (hex encoded)")
-	flag.IntVar(&c.MaxConnections, "max-connections", c.MaxConnections, "Maximum number of connections")
-	flag.IntVar(&c.ReadTimeout, "read-timeout", c.ReadTimeout, "Read timeout in seconds")
-	flag.IntVar(&c.WriteTimeout, "write-timeout", c.WriteTimeout, "Write timeout in seconds")
-	flag.Int64Var(&c.MaxStorageSize, "max-storage", c.MaxStorageSize, "Maximum storage size in bytes")
-	flag.IntVar(&c.ReplicationFactor, "replication", c.ReplicationFactor, "Replication factor")
-	
-	// Custom flag for bootstrap nodes
-	var bootstrapNodes string
-	flag.StringVar(&bootstrapNodes, "bootstrap", "", "Comma-separated list of bootstrap nodes")
-	
-	flag.Parse()
-	
-	if bootstrapNodes != "" {
-		c.BootstrapNodes = strings.Split(bootstrapNodes, ",")
+// RegisterFlags defines the configuration flags on fs, using the current
+// values as defaults. Parsing fs then writes straight into the configuration.
+func (c *Config) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.ListenAddr, "listen", c.ListenAddr, "Address to listen on")
+	fs.Var((*stringList)(&c.ListenAddrs), "listen-addrs", "Comma-separated list of more addresses to listen on")
+	fs.StringVar(&c.AdvertiseAddr, "advertise", c.AdvertiseAddr, "Address peers are told to reach this node at (empty for the listen address)")
+	fs.StringVar(&c.StorageRoot, "storage", c.StorageRoot, "Storage root directory")
+	fs.StringVar(&c.AdminAddr, "admin", c.AdminAddr, "Admin API address (empty to disable)")
+	fs.StringVar(&c.AdminToken, "admin-token", c.AdminToken, "Token authenticating writes and administrative operations on the admin API")
+	fs.StringVar(&c.LogLevel, "log-level", c.LogLevel, "Log level (DEBUG, INFO, WARN, ERROR, FATAL)")
+	fs.StringVar(&c.LogFile, "log-file", c.LogFile, "Log file path (empty for stdout)")
+	fs.StringVar(&c.AccessLogFile, "access-log", c.AccessLogFile, "Access log file path, one JSON record per client operation (empty to disable)")
+	fs.IntVar(&c.AccessLogMaxSizeMB, "access-log-max-size", c.AccessLogMaxSizeMB, "Size in megabytes past which the access log is rotated (0 for the default)")
+	fs.IntVar(&c.AccessLogMaxBackups, "access-log-max-backups", c.AccessLogMaxBackups, "Rotated access log files kept (0 for the default)")
+	fs.BoolVar(&c.EncryptionEnabled, "encryption", c.EncryptionEnabled, "Enable encryption")
+	fs.StringVar(&c.EncryptionKey, "encryption-key", c.EncryptionKey, "Encryption key (hex encoded, or a file:// or env:// reference)")
+	fs.StringVar(&c.EncryptionMode, "encryption-mode", c.EncryptionMode, "Encryption mode for new data (gcm, ctr)")
+	fs.StringVar(&c.CipherSuite, "cipher-suite", c.CipherSuite, "Cipher suite for new data (aes-gcm, chacha20-poly1305, none)")
+	fs.StringVar(&c.PathTransform, "path-transform", c.PathTransform, "Layout of objects on disk (cas, cas-sha256, flat, date-partitioned, tenant-prefixed)")
+	fs.StringVar(&c.EncryptionKeyFile, "encryption-key-file", c.EncryptionKeyFile, "File used to persist a generated encryption key")
+	fs.StringVar(&c.IdentityKeyFile, "identity-key-file", c.IdentityKeyFile, "File holding the node's message signing key")
+	fs.Var((*stringList)(&c.TrustedPeerKeys), "trusted-peer-keys", "Comma-separated list of trusted peer public keys (hex)")
+	fs.StringVar(&c.ClusterSecret, "cluster-secret", c.ClusterSecret, "Secret peers must know to connect")
+	fs.IntVar(&c.MaxProtocolVersion, "max-protocol-version", c.MaxProtocolVersion, "Newest peer protocol version to offer (0 for the newest spoken)")
+	fs.StringVar(&c.TLSCertFile, "tls-cert", c.TLSCertFile, "PEM certificate presented to peers (empty to disable TLS)")
+	fs.StringVar(&c.TLSKeyFile, "tls-key", c.TLSKeyFile, "PEM private key of the peer TLS certificate")
+	fs.StringVar(&c.TLSCAFile, "tls-ca", c.TLSCAFile, "PEM CA certificates peers are verified with")
+	fs.BoolVar(&c.TLSClientCertOptional, "tls-client-cert-optional", c.TLSClientCertOptional, "Accept peers dialing in without a TLS certificate")
+	fs.StringVar(&c.PeerProxy, "peer-proxy", c.PeerProxy, "SOCKS5 or HTTP CONNECT proxy URL to dial peers through (empty to dial directly)")
+	fs.IntVar(&c.MaxConnections, "max-connections", c.MaxConnections, "Maximum number of connections")
+	fs.IntVar(&c.ReadTimeout, "read-timeout", c.ReadTimeout, "Read timeout in seconds")
+	fs.IntVar(&c.WriteTimeout, "write-timeout", c.WriteTimeout, "Write timeout in seconds")
+	fs.IntVar(&c.TCPKeepAlive, "tcp-keep-alive", c.TCPKeepAlive, "TCP keep-alive period in seconds (0 for the default, negative to disable)")
+	fs.BoolVar(&c.TCPNoDelay, "tcp-no-delay", c.TCPNoDelay, "Send small writes to peers at once (disable to batch them)")
+	fs.IntVar(&c.TCPReadBuffer, "tcp-read-buffer", c.TCPReadBuffer, "TCP receive buffer size in bytes (0 for the system default)")
+	fs.IntVar(&c.TCPWriteBuffer, "tcp-write-buffer", c.TCPWriteBuffer, "TCP send buffer size in bytes (0 for the system default)")
+	fs.Int64Var(&c.MaxStorageSize, "max-storage", c.MaxStorageSize, "Maximum storage size in bytes")
+	fs.IntVar(&c.ReplicationFactor, "replication", c.ReplicationFactor, "Replication factor")
+	fs.StringVar(&c.WriteConsistency, "write-consistency", c.WriteConsistency, "Copies a store waits for (one, quorum, all)")
+	fs.IntVar(&c.SlowOpThresholdMs, "slow-op-threshold", c.SlowOpThresholdMs, "Log operations slower than this many milliseconds (0 to disable)")
+	fs.IntVar(&c.ClientRateLimit, "client-rate-limit", c.ClientRateLimit, "Client requests served per second on the object endpoints (0 for no limit)")
+	fs.Int64Var(&c.PeerBandwidthLimit, "peer-bandwidth-limit", c.PeerBandwidthLimit, "Bytes per second sent to peers in replicas and fetches (0 for no limit)")
+	fs.Int64Var(&c.ChunkSizeBytes, "chunk-size", c.ChunkSizeBytes, "Size in bytes of the chunks files stored chunked are split into (0 for the default)")
+	fs.IntVar(&c.MaxClockSkewMs, "max-clock-skew", c.MaxClockSkewMs, "Warn when the clock of a peer is off by more than this many milliseconds")
+	fs.StringVar(&c.ColdTierDir, "cold-tier-dir", c.ColdTierDir, "Directory rarely read objects are offloaded to (empty to disable)")
+	fs.IntVar(&c.ColdAfterDays, "cold-after-days", c.ColdAfterDays, "Offload objects unread for this many days to the cold tier (0 to disable)")
+	fs.StringVar(&c.MirrorDir, "mirror-dir", c.MirrorDir, "Directory every stored object is mirrored to (empty to disable)")
+	fs.Var((*stringList)(&c.ColdTierEndpoints), "cold-tier-endpoints", "Comma-separated HTTP API addresses of the cluster keeping the cold tier")
+	fs.Var((*stringList)(&c.MirrorEndpoints), "mirror-endpoints", "Comma-separated HTTP API addresses of the cluster keeping the mirror")
+	fs.StringVar(&c.TierToken, "tier-token", c.TierToken, "Admin token of the cluster keeping the cold tier or the mirror")
+	fs.StringVar(&c.Follow, "follow", c.Follow, "Admin API address of the node to follow read-only (empty to disable)")
+	fs.StringVar(&c.FollowBucket, "follow-bucket", c.FollowBucket, "Bucket of the followed node to copy (empty for all its objects)")
+	fs.StringVar(&c.Site, "site", c.Site, "Datacenter the node runs in (empty for a single-site cluster)")
+	fs.StringVar(&c.CrossSiteReplication, "cross-site-replication", c.CrossSiteReplication, "Replication to the nodes of other sites (sync, async)")
+	fs.StringVar(&c.Join, "join", c.Join, "Admin API address of a member to join the cluster through (empty to use the bootstrap nodes)")
+	fs.StringVar(&c.JoinToken, "join-token", c.JoinToken, "Token authenticating the nodes joining the cluster")
+	fs.Var((*stringList)(&c.BootstrapNodes), "bootstrap", "Comma-separated list of bootstrap nodes")
+}
+
+// LoadFromFlags loads configuration from command line flags. The flags are
+// registered on and parsed by fs, so the global flag.CommandLine and any
+// flags of an embedding program are left alone.
+func (c *Config) LoadFromFlags(fs *flag.FlagSet, args []string) error {
+	c.RegisterFlags(fs)
+	return fs.Parse(args)
+}
+
+// stringList is a flag.Value for comma-separated lists.
+type stringList []string
+
+func (l *stringList) String() string {
+	if l == nil {
+		return ""
 	}
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(val string) error {
+	if val == "" {
+		*l = []string{}
+		return nil
+	}
+	*l = strings.Split(val, ",")
+	return nil
 }
 
 // Validate validates the configuration
@@ -181,6 +710,25 @@ func (c *Config) Validate() error {
 	if c.StorageRoot == "" {
 		return fmt.Errorf("storage root cannot be empty")
 	}
+
+	for _, addr := range c.ListenAddrs {
+		if _, port, err := net.SplitHostPort(addr); err != nil || port == "" {
+			return fmt.Errorf("invalid listen address %q", addr)
+		}
+	}
+	if c.AdvertiseAddr != "" {
+		host, port, err := net.SplitHostPort(c.AdvertiseAddr)
+		if p, perr := strconv.Atoi(port); err != nil || perr != nil || p < 1 || p > 65535 {
+			return fmt.Errorf("invalid advertise address %q", c.AdvertiseAddr)
+		}
+		if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+			return fmt.Errorf("advertise address %q needs a host peers can reach", c.AdvertiseAddr)
+		}
+	}
+
+	if _, err := NormalizeBootstrapNodes(c.BootstrapNodes, c.ListenAddr, c.ResolveBootstrapNodes); err != nil {
+		return err
+	}
 	
 	validLogLevels := map[string]bool{
 		"DEBUG": true,
@@ -194,6 +742,63 @@ func (c *Config) Validate() error {
 		return fmt.Errorf("invalid log level: %s", c.LogLevel)
 	}
 	
+	switch strings.ToLower(c.EncryptionMode) {
+	case "", "gcm", "ctr":
+	default:
+		return fmt.Errorf("invalid encryption mode: %s", c.EncryptionMode)
+	}
+
+	switch strings.ToLower(c.CipherSuite) {
+	case "", "aes-gcm", "chacha20-poly1305", "none":
+	default:
+		return fmt.Errorf("invalid cipher suite: %s", c.CipherSuite)
+	}
+
+	switch strings.ToLower(c.PathTransform) {
+	case "", "cas", "cas-sha256", "flat", "date-partitioned", "tenant-prefixed":
+	default:
+		return fmt.Errorf("invalid path transform: %s", c.PathTransform)
+	}
+
+	if c.EncryptionEnabled && c.EncryptionKey != "" {
+		if _, err := ParseEncryptionKey(c.EncryptionKey); err != nil {
+			return err
+		}
+	}
+
+	for version, key := range c.PreviousEncryptionKeys {
+		if _, err := strconv.ParseUint(version, 10, 32); err != nil {
+			return fmt.Errorf("invalid previous encryption key version: %s", version)
+		}
+		if _, err := ParseEncryptionKey(key); err != nil {
+			return fmt.Errorf("previous encryption key %s: %w", version, err)
+		}
+	}
+	
+	for _, key := range c.TrustedPeerKeys {
+		if b, err := hex.DecodeString(strings.TrimSpace(key)); err != nil || len(b) != 32 {
+			return fmt.Errorf("invalid trusted peer key: %s", key)
+		}
+	}
+	
+	if tls := c.TLSCertFile != "" || c.TLSKeyFile != "" || c.TLSCAFile != ""; tls &&
+		(c.TLSCertFile == "" || c.TLSKeyFile == "" || c.TLSCAFile == "") {
+		return fmt.Errorf("peer TLS requires a certificate, its key and a CA")
+	}
+	if c.TLSClientCertOptional && c.TLSCertFile == "" {
+		return fmt.Errorf("optional client certificates require peer TLS")
+	}
+	if c.TLSReloadInterval < 0 {
+		return fmt.Errorf("tls reload interval cannot be negative")
+	}
+
+	if _, err := p2p.NewProxyFunc(c.PeerProxy, c.PeerProxies); err != nil {
+		return err
+	}
+	if v := c.MaxProtocolVersion; v != 0 && (v < int(p2p.MinProtocolVersion) || v > int(p2p.ProtocolVersion)) {
+		return fmt.Errorf("max protocol version must be from %d to %d", p2p.MinProtocolVersion, p2p.ProtocolVersion)
+	}
+
 	if c.MaxConnections <= 0 {
 		return fmt.Errorf("max connections must be positive")
 	}
@@ -206,6 +811,10 @@ func (c *Config) Validate() error {
 		return fmt.Errorf("write timeout must be positive")
 	}
 	
+	if c.TCPReadBuffer < 0 || c.TCPWriteBuffer < 0 {
+		return fmt.Errorf("tcp buffer sizes cannot be negative")
+	}
+	
 	if c.MaxStorageSize <= 0 {
 		return fmt.Errorf("max storage size must be positive")
 	}
@@ -213,10 +822,156 @@ func (c *Config) Validate() error {
 	if c.ReplicationFactor <= 0 {
 		return fmt.Errorf("replication factor must be positive")
 	}
+
+	switch strings.ToLower(c.WriteConsistency) {
+	case "", "one", "quorum", "all":
+	default:
+		return fmt.Errorf("invalid write consistency: %s", c.WriteConsistency)
+	}
+
+	if c.CapacityInterval < 0 {
+		return fmt.Errorf("capacity interval cannot be negative")
+	}
+
+	if c.GCInterval < 0 {
+		return fmt.Errorf("gc interval cannot be negative")
+	}
+
+	if c.DiskCheckInterval < 0 || c.DiskMinFreeBytes < 0 || c.DiskMaxWriteErrors < 0 {
+		return fmt.Errorf("disk check interval, minimum free bytes and maximum write errors cannot be negative")
+	}
+
+	if c.AntiEntropyInterval < 0 {
+		return fmt.Errorf("anti-entropy interval cannot be negative")
+	}
+
+	if c.ConsistencyCheckInterval < 0 || c.ConsistencyCheckSample < 0 {
+		return fmt.Errorf("consistency check interval and sample cannot be negative")
+	}
+
+	if c.HeartbeatInterval < 0 || c.HeartbeatMisses < 0 {
+		return fmt.Errorf("heartbeat interval and misses cannot be negative")
+	}
+
+	if c.ReconnectMaxBackoff < 0 {
+		return fmt.Errorf("reconnect max backoff cannot be negative")
+	}
+
+	if c.ResourceCheckInterval < 0 || c.MaxGoroutines < 0 || c.MaxOpenFiles < 0 {
+		return fmt.Errorf("resource check interval, maximum goroutines and maximum open files cannot be negative")
+	}
+
+	if c.FollowInterval < 0 {
+		return fmt.Errorf("follow interval cannot be negative")
+	}
+	if c.FollowBucket != "" && (c.Follow == "" || !validBucket(c.FollowBucket)) {
+		return fmt.Errorf("invalid follow bucket %q", c.FollowBucket)
+	}
+
+	if c.CheckSamplePercent < 0 || c.CheckSamplePercent > 100 {
+		return fmt.Errorf("check sample percent must be between 0 and 100")
+	}
+
+	if c.SlowOpThresholdMs < 0 {
+		return fmt.Errorf("slow op threshold cannot be negative")
+	}
+
+	if c.ClientRateLimit < 0 || c.PeerBandwidthLimit < 0 {
+		return fmt.Errorf("client rate limit and peer bandwidth limit cannot be negative")
+	}
+
+	if c.AccessLogMaxSizeMB < 0 || c.AccessLogMaxBackups < 0 {
+		return fmt.Errorf("access log size and backups cannot be negative")
+	}
+
+	if c.MaxClockSkewMs < 0 {
+		return fmt.Errorf("max clock skew cannot be negative")
+	}
+
+	if c.ReadAheadChunks < 0 {
+		return fmt.Errorf("read ahead chunks cannot be negative")
+	}
+
+	if c.ChunkSizeBytes < 0 {
+		return fmt.Errorf("chunk size cannot be negative")
+	}
+
+	if c.MirrorReconcileInterval < 0 {
+		return fmt.Errorf("mirror reconcile interval cannot be negative")
+	}
+	if c.LifecycleInterval < 0 {
+		return fmt.Errorf("lifecycle interval cannot be negative")
+	}
+	if c.ColdTierDir != "" && len(c.ColdTierEndpoints) > 0 {
+		return fmt.Errorf("the cold tier is either a directory or a cluster, not both")
+	}
+	if c.MirrorDir != "" && len(c.MirrorEndpoints) > 0 {
+		return fmt.Errorf("the mirror is either a directory or a cluster, not both")
+	}
+	if err := ValidateLifecycle(c.Lifecycle, c.HasColdTier()); err != nil {
+		return err
+	}
+	if err := ValidateQuotas(c.BucketQuotas, c.TenantQuotas); err != nil {
+		return err
+	}
+	if err := ValidateBucketPolicies(c.BucketPolicies); err != nil {
+		return err
+	}
+	if err := ValidateUploadPolicies(c.UploadPolicies); err != nil {
+		return err
+	}
+
+	if c.Join != "" && c.JoinToken == "" {
+		return fmt.Errorf("joining a cluster requires a join token")
+	}
+
+	switch strings.ToLower(c.CrossSiteReplication) {
+	case "", "sync":
+	case "async":
+		if c.Site == "" {
+			return fmt.Errorf("async cross-site replication requires a site")
+		}
+	default:
+		return fmt.Errorf("invalid cross-site replication mode: %s", c.CrossSiteReplication)
+	}
+
+	if c.ColdAfterDays < 0 {
+		return fmt.Errorf("cold after days cannot be negative")
+	}
+	if c.ColdAfterDays > 0 && !c.HasColdTier() {
+		return fmt.Errorf("cold after days requires a cold tier")
+	}
 	
 	return nil
 }
 
+// HasColdTier reports whether the node has a cold tier, in a directory or
+// in another cluster.
+func (c *Config) HasColdTier() bool {
+	return c.ColdTierDir != "" || len(c.ColdTierEndpoints) > 0
+}
+
+// ParseEncryptionKey decodes a hex or base64 encoded AES key and checks
+// that it is 16, 24 or 32 bytes long.
+func ParseEncryptionKey(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+
+	key, err := hex.DecodeString(s)
+	if err != nil {
+		key, err = base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return nil, fmt.Errorf("encryption key must be hex or base64 encoded")
+		}
+	}
+
+	switch len(key) {
+	case 16, 24, 32:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("invalid encryption key length: %d bytes (want 16, 24 or 32)", len(key))
+	}
+}
+
 // GetLogLevel returns the logger.LogLevel for the configured log level
 func (c *Config) GetLogLevel() logger.LogLevel {
 	switch strings.ToUpper(c.LogLevel) {
@@ -235,8 +990,14 @@ func (c *Config) GetLogLevel() logger.LogLevel {
 	}
 }
 
-// Load loads configuration from file, environment variables, and command line flags
+// Load loads configuration from file and environment variables
 func Load(configFile string) (*Config, error) {
+	return LoadWithFlags(configFile, nil, nil)
+}
+
+// LoadWithFlags loads configuration from file, environment variables, and
+// command line flags parsed by fs. A nil fs skips flag parsing.
+func LoadWithFlags(configFile string, fs *flag.FlagSet, args []string) (*Config, error) {
 	// Start with defaults
 	config := DefaultConfig()
 	
@@ -253,12 +1014,23 @@ func Load(configFile string) (*Config, error) {
 	config.LoadFromEnv()
 	
 	// Override with command line flags
-	config.LoadFromFlags()
+	if fs != nil {
+		if err := config.LoadFromFlags(fs, args); err != nil {
+			return nil, fmt.Errorf("failed to parse flags: %w", err)
+		}
+	}
+
+	// Resolve file://, env:// and provider references in secret fields
+	if err := config.ResolveSecrets(); err != nil {
+		return nil, fmt.Errorf("failed to resolve secrets: %w", err)
+	}
 	
 	// Validate the final configuration
 	if err := config.Validate(); err != nil {
 		return nil, fmt.Errorf("configuration validation failed: %w", err)
 	}
+
+	config.BootstrapNodes, _ = NormalizeBootstrapNodes(config.BootstrapNodes, config.ListenAddr, false)
 	
 	return config, nil
 }
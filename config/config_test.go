@@ -1,6 +1,8 @@
 package config
 
 import (
+	"encoding/json"
+	"flag"
 	"os"
 	"testing"
 )
@@ -78,6 +80,307 @@ func TestConfigValidation(t *testing.T) {
 			},
 			expectError: true,
 		},
+		{
+			name: "unknown cipher suite",
+			config: &Config{
+				ListenAddr:     ":3000",
+				StorageRoot:    "storage",
+				LogLevel:       "INFO",
+				CipherSuite:    "des",
+				MaxConnections: 10,
+				ReadTimeout:    30,
+				WriteTimeout:   30,
+				MaxStorageSize: 1000,
+				ReplicationFactor: 1,
+			},
+			expectError: true,
+		},
+		{
+			name: "unknown path transform",
+			config: &Config{
+				ListenAddr:     ":3000",
+				StorageRoot:    "storage",
+				LogLevel:       "INFO",
+				PathTransform:  "by-size",
+				MaxConnections: 10,
+				ReadTimeout:    30,
+				WriteTimeout:   30,
+				MaxStorageSize: 1000,
+				ReplicationFactor: 1,
+			},
+			expectError: true,
+		},
+		{
+			name: "unknown write consistency",
+			config: &Config{
+				ListenAddr:       ":3000",
+				StorageRoot:      "storage",
+				LogLevel:         "INFO",
+				MaxConnections:   10,
+				ReadTimeout:      30,
+				WriteTimeout:     30,
+				MaxStorageSize:   1000,
+				ReplicationFactor: 1,
+				WriteConsistency: "most",
+			},
+			expectError: true,
+		},
+		{
+			name: "negative slow op threshold",
+			config: &Config{
+				ListenAddr:     ":3000",
+				StorageRoot:    "storage",
+				LogLevel:       "INFO",
+				MaxConnections: 10,
+				ReadTimeout:    30,
+				WriteTimeout:   30,
+				MaxStorageSize: 1000,
+				ReplicationFactor: 1,
+				SlowOpThresholdMs: -1,
+			},
+			expectError: true,
+		},
+		{
+			name: "unknown protocol version",
+			config: &Config{
+				ListenAddr:     ":3000",
+				StorageRoot:    "storage",
+				LogLevel:       "INFO",
+				MaxConnections: 10,
+				ReadTimeout:    30,
+				WriteTimeout:   30,
+				MaxStorageSize: 1000,
+				ReplicationFactor: 1,
+				MaxProtocolVersion: 99,
+			},
+			expectError: true,
+		},
+		{
+			name: "optional client certificates without TLS",
+			config: &Config{
+				ListenAddr:     ":3000",
+				StorageRoot:    "storage",
+				LogLevel:       "INFO",
+				MaxConnections: 10,
+				ReadTimeout:    30,
+				WriteTimeout:   30,
+				MaxStorageSize: 1000,
+				ReplicationFactor: 1,
+				TLSClientCertOptional: true,
+			},
+			expectError: true,
+		},
+		{
+			name: "negative access log backups",
+			config: &Config{
+				ListenAddr:     ":3000",
+				StorageRoot:    "storage",
+				LogLevel:       "INFO",
+				MaxConnections: 10,
+				ReadTimeout:    30,
+				WriteTimeout:   30,
+				MaxStorageSize: 1000,
+				ReplicationFactor: 1,
+				AccessLogMaxBackups: -1,
+			},
+			expectError: true,
+		},
+		{
+			name: "negative read ahead",
+			config: &Config{
+				ListenAddr:     ":3000",
+				StorageRoot:    "storage",
+				LogLevel:       "INFO",
+				MaxConnections: 10,
+				ReadTimeout:    30,
+				WriteTimeout:   30,
+				MaxStorageSize: 1000,
+				ReplicationFactor: 1,
+				ReadAheadChunks: -1,
+			},
+			expectError: true,
+		},
+		{
+			name: "negative disk free space",
+			config: &Config{
+				ListenAddr:     ":3000",
+				StorageRoot:    "storage",
+				LogLevel:       "INFO",
+				MaxConnections: 10,
+				ReadTimeout:    30,
+				WriteTimeout:   30,
+				MaxStorageSize: 1000,
+				ReplicationFactor: 1,
+				DiskMinFreeBytes: -1,
+			},
+			expectError: true,
+		},
+		{
+			name: "negative anti-entropy interval",
+			config: &Config{
+				ListenAddr:     ":3000",
+				StorageRoot:    "storage",
+				LogLevel:       "INFO",
+				MaxConnections: 10,
+				ReadTimeout:    30,
+				WriteTimeout:   30,
+				MaxStorageSize: 1000,
+				ReplicationFactor: 1,
+				AntiEntropyInterval: -1,
+			},
+			expectError: true,
+		},
+		{
+			name: "negative consistency check sample",
+			config: &Config{
+				ListenAddr:     ":3000",
+				StorageRoot:    "storage",
+				LogLevel:       "INFO",
+				MaxConnections: 10,
+				ReadTimeout:    30,
+				WriteTimeout:   30,
+				MaxStorageSize: 1000,
+				ReplicationFactor: 1,
+				ConsistencyCheckSample: -1,
+			},
+			expectError: true,
+		},
+		{
+			name: "negative heartbeat misses",
+			config: &Config{
+				ListenAddr:     ":3000",
+				StorageRoot:    "storage",
+				LogLevel:       "INFO",
+				MaxConnections: 10,
+				ReadTimeout:    30,
+				WriteTimeout:   30,
+				MaxStorageSize: 1000,
+				ReplicationFactor: 1,
+				HeartbeatMisses: -1,
+			},
+			expectError: true,
+		},
+		{
+			name: "negative reconnect backoff",
+			config: &Config{
+				ListenAddr:     ":3000",
+				StorageRoot:    "storage",
+				LogLevel:       "INFO",
+				MaxConnections: 10,
+				ReadTimeout:    30,
+				WriteTimeout:   30,
+				MaxStorageSize: 1000,
+				ReplicationFactor: 1,
+				ReconnectMaxBackoff: -1,
+			},
+			expectError: true,
+		},
+		{
+			name: "negative goroutine budget",
+			config: &Config{
+				ListenAddr:     ":3000",
+				StorageRoot:    "storage",
+				LogLevel:       "INFO",
+				MaxConnections: 10,
+				ReadTimeout:    30,
+				WriteTimeout:   30,
+				MaxStorageSize: 1000,
+				ReplicationFactor: 1,
+				MaxGoroutines: -1,
+			},
+			expectError: true,
+		},
+		{
+			name: "negative clock skew",
+			config: &Config{
+				ListenAddr:     ":3000",
+				StorageRoot:    "storage",
+				LogLevel:       "INFO",
+				MaxConnections: 10,
+				ReadTimeout:    30,
+				WriteTimeout:   30,
+				MaxStorageSize: 1000,
+				ReplicationFactor: 1,
+				MaxClockSkewMs: -1,
+			},
+			expectError: true,
+		},
+		{
+			name: "negative chunk size",
+			config: &Config{
+				ListenAddr:     ":3000",
+				StorageRoot:    "storage",
+				LogLevel:       "INFO",
+				MaxConnections: 10,
+				ReadTimeout:    30,
+				WriteTimeout:   30,
+				MaxStorageSize: 1000,
+				ReplicationFactor: 1,
+				ChunkSizeBytes: -1,
+			},
+			expectError: true,
+		},
+		{
+			name: "join without a token",
+			config: &Config{
+				ListenAddr:     ":3000",
+				StorageRoot:    "storage",
+				LogLevel:       "INFO",
+				MaxConnections: 10,
+				ReadTimeout:    30,
+				WriteTimeout:   30,
+				MaxStorageSize: 1000,
+				ReplicationFactor: 1,
+				Join:           "10.0.0.1:3100",
+			},
+			expectError: true,
+		},
+		{
+			name: "async cross-site replication without a site",
+			config: &Config{
+				ListenAddr:     ":3000",
+				StorageRoot:    "storage",
+				LogLevel:       "INFO",
+				MaxConnections: 10,
+				ReadTimeout:    30,
+				WriteTimeout:   30,
+				MaxStorageSize: 1000,
+				ReplicationFactor: 1,
+				CrossSiteReplication: "async",
+			},
+			expectError: true,
+		},
+		{
+			name: "unsupported peer proxy",
+			config: &Config{
+				ListenAddr:     ":3000",
+				StorageRoot:    "storage",
+				LogLevel:       "INFO",
+				MaxConnections: 10,
+				ReadTimeout:    30,
+				WriteTimeout:   30,
+				MaxStorageSize: 1000,
+				ReplicationFactor: 1,
+				PeerProxies:    map[string]string{"node-2": "ftp://proxy:21"},
+			},
+			expectError: true,
+		},
+		{
+			name: "unreachable advertise address",
+			config: &Config{
+				ListenAddr:     ":3000",
+				StorageRoot:    "storage",
+				LogLevel:       "INFO",
+				MaxConnections: 10,
+				ReadTimeout:    30,
+				WriteTimeout:   30,
+				MaxStorageSize: 1000,
+				ReplicationFactor: 1,
+				ListenAddrs:    []string{"[::]:3000"},
+				AdvertiseAddr:  "0.0.0.0:3000",
+			},
+			expectError: true,
+		},
 	}
 
 	for _, test := range tests {
@@ -148,3 +451,137 @@ func TestConfigSaveAndLoad(t *testing.T) {
 		t.Errorf("Expected log level DEBUG, got %s", loadedCfg.LogLevel)
 	}
 }
+
+func TestConfigTLSKeyAliases(t *testing.T) {
+	var cfg Config
+	data := `{"tls_cert": "node.pem", "tls_key": "node.key", "tls_ca_file": "ca.pem", "tls_ca": "ca.pem"}`
+	if err := json.Unmarshal([]byte(data), &cfg); err != nil {
+		t.Fatalf("Failed to decode config: %v", err)
+	}
+	if cfg.TLSCertFile != "node.pem" || cfg.TLSKeyFile != "node.key" || cfg.TLSCAFile != "ca.pem" {
+		t.Errorf("Expected the short TLS keys to be accepted, got %q %q %q", cfg.TLSCertFile, cfg.TLSKeyFile, cfg.TLSCAFile)
+	}
+
+	data = `{"tls_cert": "node.pem", "tls_cert_file": "other.pem"}`
+	if err := json.Unmarshal([]byte(data), &cfg); err == nil {
+		t.Error("Expected conflicting TLS keys to be rejected")
+	}
+}
+
+func TestConfigProfiles(t *testing.T) {
+	tmpFile := "/tmp/test_config_profiles.json"
+	defer os.Remove(tmpFile)
+
+	data := `{
+  "listen_addr": ":3000",
+  "log_level": "INFO",
+  "bootstrap_nodes": [":4000"],
+  "profile": "dev",
+  "profiles": {
+    "dev": {"log_level": "DEBUG"},
+    "prod": {"listen_addr": ":443", "bootstrap_nodes": [":5000", ":6000"]}
+  }
+}`
+	if err := os.WriteFile(tmpFile, []byte(data), 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+
+	// Default profile from the file
+	cfg, err := LoadFromFile(tmpFile)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if cfg.LogLevel != "DEBUG" || cfg.ListenAddr != ":3000" {
+		t.Errorf("Expected dev profile merged over defaults, got level=%s listen=%s", cfg.LogLevel, cfg.ListenAddr)
+	}
+
+	// FS_PROFILE takes precedence over the file's profile
+	os.Setenv("FS_PROFILE", "prod")
+	defer os.Unsetenv("FS_PROFILE")
+
+	cfg, err = LoadFromFile(tmpFile)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if cfg.Profile != "prod" {
+		t.Errorf("Expected active profile prod, got %s", cfg.Profile)
+	}
+	if cfg.ListenAddr != ":443" || cfg.LogLevel != "INFO" {
+		t.Errorf("Expected prod profile merged over defaults, got level=%s listen=%s", cfg.LogLevel, cfg.ListenAddr)
+	}
+	if len(cfg.BootstrapNodes) != 2 {
+		t.Errorf("Expected profile to replace bootstrap nodes, got %v", cfg.BootstrapNodes)
+	}
+	if len(cfg.Profiles) != 2 {
+		t.Errorf("Expected profiles to be preserved, got %d", len(cfg.Profiles))
+	}
+
+	// Unknown profiles are an error
+	os.Setenv("FS_PROFILE", "missing")
+	if _, err := LoadFromFile(tmpFile); err == nil {
+		t.Error("Expected error for unknown profile")
+	}
+}
+
+func TestParseEncryptionKey(t *testing.T) {
+	tests := []struct {
+		name      string
+		key       string
+		length    int
+		expectErr bool
+	}{
+		{name: "hex 32 bytes", key: "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f", length: 32},
+		{name: "hex 16 bytes", key: "000102030405060708090a0b0c0d0e0f", length: 16},
+		{name: "base64 32 bytes", key: "AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8=", length: 32},
+		{name: "wrong length", key: "00010203", expectErr: true},
+		{name: "not encoded", key: "not a key!", expectErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			key, err := ParseEncryptionKey(test.key)
+			if test.expectErr {
+				if err == nil {
+					t.Error("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if len(key) != test.length {
+				t.Errorf("Expected %d byte key, got %d", test.length, len(key))
+			}
+		})
+	}
+
+	cfg := DefaultConfig()
+	cfg.EncryptionKey = "tooshort"
+	if err := cfg.Validate(); err == nil {
+		t.Error("Expected validation error for malformed encryption key")
+	}
+}
+
+func TestConfigLoadFromFlags(t *testing.T) {
+	cfg := DefaultConfig()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	other := fs.String("other", "", "Flag owned by the embedding program")
+
+	err := cfg.LoadFromFlags(fs, []string{"-listen", ":7000", "-bootstrap", ":7001,:7002", "-other", "x"})
+	if err != nil {
+		t.Fatalf("Failed to parse flags: %v", err)
+	}
+
+	if cfg.ListenAddr != ":7000" {
+		t.Errorf("Expected listen addr :7000, got %s", cfg.ListenAddr)
+	}
+	if len(cfg.BootstrapNodes) != 2 || cfg.BootstrapNodes[1] != ":7002" {
+		t.Errorf("Expected two bootstrap nodes, got %v", cfg.BootstrapNodes)
+	}
+	if *other != "x" {
+		t.Errorf("Expected embedding program flag to be parsed, got %s", *other)
+	}
+	if flag.CommandLine.Lookup("listen") != nil {
+		t.Error("Expected global flag set to be left alone")
+	}
+}
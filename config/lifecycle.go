@@ -0,0 +1,54 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DefaultLifecycleInterval is how often, in seconds, the lifecycle rules are
+// evaluated when LifecycleInterval is not set.
+const DefaultLifecycleInterval = 3600
+
+// LifecycleRule declares what happens to the objects of a bucket as they
+// age. A bucket is the part of an object's key before its first "/".
+type LifecycleRule struct {
+	Bucket string `json:"bucket"`
+	// ExpireAfterDays deletes objects this many days after they were
+	// stored. Locked objects are kept until their lock expires.
+	ExpireAfterDays int `json:"expire_after_days,omitempty"`
+	// TransitionAfterDays moves objects to the cold tier this many days
+	// after they were stored.
+	TransitionAfterDays int `json:"transition_after_days,omitempty"`
+}
+
+// ValidateLifecycle checks the rules: each must name a bucket, at most one
+// rule per bucket, and declare an action. Transitions need a cold tier, so
+// they are only allowed when hasColdTier is set.
+func ValidateLifecycle(rules []LifecycleRule, hasColdTier bool) error {
+	seen := make(map[string]bool, len(rules))
+	for _, rule := range rules {
+		if rule.Bucket == "" || strings.Contains(rule.Bucket, "/") {
+			return fmt.Errorf("invalid lifecycle bucket %q", rule.Bucket)
+		}
+		if seen[rule.Bucket] {
+			return fmt.Errorf("duplicate lifecycle rule for bucket %q", rule.Bucket)
+		}
+		seen[rule.Bucket] = true
+
+		if rule.ExpireAfterDays < 0 || rule.TransitionAfterDays < 0 {
+			return fmt.Errorf("lifecycle rule for bucket %q has a negative number of days", rule.Bucket)
+		}
+		if rule.ExpireAfterDays == 0 && rule.TransitionAfterDays == 0 {
+			return fmt.Errorf("lifecycle rule for bucket %q declares no action", rule.Bucket)
+		}
+		if rule.TransitionAfterDays > 0 {
+			if !hasColdTier {
+				return fmt.Errorf("lifecycle rule for bucket %q transitions objects but no cold tier is configured", rule.Bucket)
+			}
+			if rule.ExpireAfterDays > 0 && rule.TransitionAfterDays >= rule.ExpireAfterDays {
+				return fmt.Errorf("lifecycle rule for bucket %q transitions objects after they expire", rule.Bucket)
+			}
+		}
+	}
+	return nil
+}
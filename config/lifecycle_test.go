@@ -0,0 +1,56 @@
+package config
+
+import "testing"
+
+func TestValidateLifecycle(t *testing.T) {
+	valid := []LifecycleRule{{Bucket: "logs", ExpireAfterDays: 30}, {Bucket: "tmp", ExpireAfterDays: 1}}
+	if err := ValidateLifecycle(valid, false); err != nil {
+		t.Errorf("Expected valid rules, got %v", err)
+	}
+
+	invalid := map[string][]LifecycleRule{
+		"empty bucket":     {{ExpireAfterDays: 1}},
+		"nested bucket":    {{Bucket: "logs/app", ExpireAfterDays: 1}},
+		"duplicate bucket": {{Bucket: "logs", ExpireAfterDays: 1}, {Bucket: "logs", ExpireAfterDays: 2}},
+		"no action":        {{Bucket: "logs"}},
+		"negative days":    {{Bucket: "logs", ExpireAfterDays: -1}},
+		"late transition":  {{Bucket: "logs", ExpireAfterDays: 7, TransitionAfterDays: 7}},
+	}
+	for name, rules := range invalid {
+		if err := ValidateLifecycle(rules, true); err == nil {
+			t.Errorf("%s: expected validation error", name)
+		}
+	}
+
+	transition := []LifecycleRule{{Bucket: "logs", TransitionAfterDays: 30, ExpireAfterDays: 365}}
+	if err := ValidateLifecycle(transition, true); err != nil {
+		t.Errorf("Expected valid transition rule, got %v", err)
+	}
+	if err := ValidateLifecycle(transition, false); err == nil {
+		t.Error("Expected transitions to require a cold tier")
+	}
+
+	cfg := DefaultConfig()
+	cfg.Lifecycle = invalid["no action"]
+	if err := cfg.Validate(); err == nil {
+		t.Error("Expected Validate to check lifecycle rules")
+	}
+
+	cfg = DefaultConfig()
+	cfg.ColdAfterDays = 30
+	if err := cfg.Validate(); err == nil {
+		t.Error("Expected cold after days to require a cold tier")
+	}
+	cfg.ColdTierDir = "cold"
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Expected valid cold tier settings, got %v", err)
+	}
+	cfg.ColdTierEndpoints = []string{"archive:8080"}
+	if err := cfg.Validate(); err == nil {
+		t.Error("Expected the cold tier to be either a directory or a cluster")
+	}
+	cfg.ColdTierDir = ""
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Expected valid cold tier cluster settings, got %v", err)
+	}
+}
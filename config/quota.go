@@ -0,0 +1,71 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// BucketQuota limits the bytes stored in a bucket across the cluster.
+type BucketQuota struct {
+	Bucket   string `json:"bucket"`
+	MaxBytes int64  `json:"max_bytes"`
+}
+
+// TenantQuota limits the bytes stored across the cluster in all the buckets
+// of a tenant together.
+type TenantQuota struct {
+	Tenant   string   `json:"tenant"`
+	Buckets  []string `json:"buckets"`
+	MaxBytes int64    `json:"max_bytes"`
+}
+
+// ValidateQuotas checks the quotas: each must name what it limits and allow
+// a positive number of bytes, buckets get at most one bucket quota, and
+// belong to at most one tenant.
+func ValidateQuotas(buckets []BucketQuota, tenants []TenantQuota) error {
+	seen := make(map[string]bool, len(buckets))
+	for _, q := range buckets {
+		if !validBucket(q.Bucket) {
+			return fmt.Errorf("invalid quota bucket %q", q.Bucket)
+		}
+		if seen[q.Bucket] {
+			return fmt.Errorf("duplicate quota for bucket %q", q.Bucket)
+		}
+		seen[q.Bucket] = true
+		if q.MaxBytes <= 0 {
+			return fmt.Errorf("quota for bucket %q must allow a positive number of bytes", q.Bucket)
+		}
+	}
+
+	tenantOf := make(map[string]string)
+	seen = make(map[string]bool, len(tenants))
+	for _, q := range tenants {
+		if q.Tenant == "" {
+			return fmt.Errorf("tenant quota without a tenant")
+		}
+		if seen[q.Tenant] {
+			return fmt.Errorf("duplicate quota for tenant %q", q.Tenant)
+		}
+		seen[q.Tenant] = true
+		if q.MaxBytes <= 0 {
+			return fmt.Errorf("quota for tenant %q must allow a positive number of bytes", q.Tenant)
+		}
+		if len(q.Buckets) == 0 {
+			return fmt.Errorf("quota for tenant %q covers no bucket", q.Tenant)
+		}
+		for _, bucket := range q.Buckets {
+			if !validBucket(bucket) {
+				return fmt.Errorf("invalid bucket %q in quota for tenant %q", bucket, q.Tenant)
+			}
+			if owner, ok := tenantOf[bucket]; ok {
+				return fmt.Errorf("bucket %q belongs to tenants %q and %q", bucket, owner, q.Tenant)
+			}
+			tenantOf[bucket] = q.Tenant
+		}
+	}
+	return nil
+}
+
+func validBucket(bucket string) bool {
+	return bucket != "" && !strings.Contains(bucket, "/")
+}
@@ -0,0 +1,43 @@
+package config
+
+import "testing"
+
+func TestValidateQuotas(t *testing.T) {
+	buckets := []BucketQuota{{Bucket: "logs", MaxBytes: 1 << 20}}
+	tenants := []TenantQuota{{Tenant: "acme", Buckets: []string{"logs", "media"}, MaxBytes: 1 << 30}}
+	if err := ValidateQuotas(buckets, tenants); err != nil {
+		t.Errorf("Expected valid quotas, got %v", err)
+	}
+
+	invalidBuckets := map[string][]BucketQuota{
+		"empty bucket":     {{MaxBytes: 1}},
+		"nested bucket":    {{Bucket: "logs/app", MaxBytes: 1}},
+		"duplicate bucket": {{Bucket: "logs", MaxBytes: 1}, {Bucket: "logs", MaxBytes: 2}},
+		"no bytes":         {{Bucket: "logs"}},
+	}
+	for name, quotas := range invalidBuckets {
+		if err := ValidateQuotas(quotas, nil); err == nil {
+			t.Errorf("%s: expected validation error", name)
+		}
+	}
+
+	invalidTenants := map[string][]TenantQuota{
+		"empty tenant":     {{Buckets: []string{"logs"}, MaxBytes: 1}},
+		"duplicate tenant": {{Tenant: "acme", Buckets: []string{"a"}, MaxBytes: 1}, {Tenant: "acme", Buckets: []string{"b"}, MaxBytes: 1}},
+		"no buckets":       {{Tenant: "acme", MaxBytes: 1}},
+		"negative bytes":   {{Tenant: "acme", Buckets: []string{"logs"}, MaxBytes: -1}},
+		"invalid bucket":   {{Tenant: "acme", Buckets: []string{""}, MaxBytes: 1}},
+		"shared bucket":    {{Tenant: "acme", Buckets: []string{"logs"}, MaxBytes: 1}, {Tenant: "umbrella", Buckets: []string{"logs"}, MaxBytes: 1}},
+	}
+	for name, quotas := range invalidTenants {
+		if err := ValidateQuotas(nil, quotas); err == nil {
+			t.Errorf("%s: expected validation error", name)
+		}
+	}
+
+	cfg := DefaultConfig()
+	cfg.BucketQuotas = invalidBuckets["no bytes"]
+	if err := cfg.Validate(); err == nil {
+		t.Error("Expected Validate to check quotas")
+	}
+}
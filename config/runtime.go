@@ -0,0 +1,359 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anthdm/foreverstore/logger"
+)
+
+// maxAuditEntries bounds the in-memory audit trail of runtime changes.
+const maxAuditEntries = 100
+
+// RuntimeSetting is a setting that can be read and changed on a live node.
+type RuntimeSetting struct {
+	Get func() string
+	Set func(value string) error
+}
+
+// AuditEntry records a single runtime configuration change.
+type AuditEntry struct {
+	Time      time.Time `json:"time"`
+	Actor     string    `json:"actor"`
+	Setting   string    `json:"setting"`
+	OldValue  string    `json:"old_value"`
+	NewValue  string    `json:"new_value"`
+	Persisted bool      `json:"persisted"`
+}
+
+// RuntimeSettings is the registry of mutable settings of a running node.
+// Every change is logged and kept in an audit trail, and can optionally be
+// written back to the configuration file.
+type RuntimeSettings struct {
+	mu       sync.Mutex
+	config   *Config
+	file     string
+	settings map[string]RuntimeSetting
+	audit    []AuditEntry
+}
+
+// NewRuntimeSettings creates the registry for cfg. Changes are persisted to
+// file when requested; an empty file disables persistence. The log level is
+// registered by default, other subsystems register their own settings.
+func NewRuntimeSettings(cfg *Config, file string) *RuntimeSettings {
+	r := &RuntimeSettings{
+		config:   cfg,
+		file:     file,
+		settings: make(map[string]RuntimeSetting),
+	}
+
+	r.Register("log_level", RuntimeSetting{
+		Get: func() string { return cfg.LogLevel },
+		Set: func(value string) error {
+			level := strings.ToUpper(value)
+			if level != "DEBUG" && level != "INFO" && level != "WARN" &&
+				level != "ERROR" && level != "FATAL" {
+				return fmt.Errorf("invalid log level: %s", value)
+			}
+			cfg.LogLevel = level
+			logger.SetGlobalLevel(cfg.GetLogLevel())
+			return nil
+		},
+	})
+
+	return r
+}
+
+// Register adds a named runtime setting, replacing any existing one.
+func (r *RuntimeSettings) Register(name string, setting RuntimeSetting) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.settings[name] = setting
+}
+
+// Names returns the names of all registered settings in sorted order.
+func (r *RuntimeSettings) Names() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	names := make([]string, 0, len(r.settings))
+	for name := range r.settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Values returns the current value of every registered setting.
+func (r *RuntimeSettings) Values() map[string]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	values := make(map[string]string, len(r.settings))
+	for name, setting := range r.settings {
+		values[name] = setting.Get()
+	}
+	return values
+}
+
+// Set changes a setting on behalf of actor, and writes the new value to the
+// configuration file afterwards if persist is true.
+func (r *RuntimeSettings) Set(name, value, actor string, persist bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	setting, ok := r.settings[name]
+	if !ok {
+		return fmt.Errorf("unknown runtime setting: %s", name)
+	}
+
+	old := setting.Get()
+	if err := setting.Set(value); err != nil {
+		return err
+	}
+
+	entry := AuditEntry{
+		Time:     time.Now(),
+		Actor:    actor,
+		Setting:  name,
+		OldValue: old,
+		NewValue: setting.Get(),
+	}
+
+	var persistErr error
+	if persist {
+		if r.file == "" {
+			persistErr = fmt.Errorf("runtime setting %s changed but there is no configuration file to persist to", name)
+		} else if persistErr = r.persist(name); persistErr == nil {
+			entry.Persisted = true
+		}
+	}
+
+	r.audit = append(r.audit, entry)
+	if len(r.audit) > maxAuditEntries {
+		r.audit = r.audit[len(r.audit)-maxAuditEntries:]
+	}
+
+	logger.Info("AUDIT: runtime setting %s changed from %q to %q by %s (persisted=%v)",
+		name, entry.OldValue, entry.NewValue, actor, entry.Persisted)
+	return persistErr
+}
+
+// AuditLog returns the most recent runtime configuration changes, oldest first.
+func (r *RuntimeSettings) AuditLog() []AuditEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entries := make([]AuditEntry, len(r.audit))
+	copy(entries, r.audit)
+	return entries
+}
+
+// persist writes the value of the setting name to the configuration file.
+// Only that key of the file is changed: the values the configuration took
+// from the environment, flags, secret files or the cluster stay out of it.
+// The key is changed in the active profile when the profile sets it.
+func (r *RuntimeSettings) persist(name string) error {
+	current, err := json.Marshal(r.config)
+	if err != nil {
+		return fmt.Errorf("failed to encode config: %w", err)
+	}
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(current, &values); err != nil {
+		return fmt.Errorf("failed to encode config: %w", err)
+	}
+	value, ok := values[name]
+
+	mode := os.FileMode(0600)
+	file := &jsonObject{values: make(map[string]json.RawMessage)}
+	if info, err := os.Stat(r.file); err == nil {
+		mode = info.Mode().Perm()
+		data, err := os.ReadFile(r.file)
+		if err != nil {
+			return fmt.Errorf("failed to read config file: %w", err)
+		}
+		if err := file.UnmarshalJSON(data); err != nil {
+			return fmt.Errorf("failed to decode config file: %w", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	target := file
+	var profiles, profile *jsonObject
+	if r.config.Profile != "" {
+		profiles = &jsonObject{}
+		profile = &jsonObject{}
+		if raw, ok := file.values["profiles"]; ok && profiles.UnmarshalJSON(raw) == nil {
+			if raw, ok := profiles.values[r.config.Profile]; ok && profile.UnmarshalJSON(raw) == nil {
+				if _, ok := profile.values[name]; ok {
+					target = profile
+				}
+			}
+		}
+	}
+	// Keys left out of the encoded configuration hold their zero value,
+	// which is their default at the top level. A profile overriding the key
+	// gets the zero value written out, or the top-level value would win.
+	switch {
+	case ok:
+		target.set(name, value)
+	case target == profile:
+		zero, err := zeroJSON(name)
+		if err != nil {
+			return err
+		}
+		target.set(name, zero)
+	default:
+		target.remove(name)
+	}
+	if target == profile {
+		raw, err := profile.MarshalJSON()
+		if err != nil {
+			return err
+		}
+		profiles.set(r.config.Profile, raw)
+		if raw, err = profiles.MarshalJSON(); err != nil {
+			return err
+		}
+		file.set("profiles", raw)
+	}
+
+	data, err := file.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	var out bytes.Buffer
+	if err := json.Indent(&out, data, "", "  "); err != nil {
+		return fmt.Errorf("failed to encode config: %w", err)
+	}
+	out.WriteByte('\n')
+	if err := writeFileAtomic(r.file, out.Bytes(), mode); err != nil {
+		return err
+	}
+	logger.Info("Saved %s to configuration file %s", name, r.file)
+	return nil
+}
+
+// zeroJSON returns the encoded zero value of the configuration key name.
+func zeroJSON(name string) (json.RawMessage, error) {
+	t := reflect.TypeOf(Config{})
+	for i := 0; i < t.NumField(); i++ {
+		if tag, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ","); tag == name {
+			return json.Marshal(reflect.Zero(t.Field(i).Type).Interface())
+		}
+	}
+	return nil, fmt.Errorf("unknown configuration key %s", name)
+}
+
+// writeFileAtomic replaces the file name with data, through a temporary
+// file renamed over it, so a crash leaves either the old or the new file.
+func writeFileAtomic(name string, data []byte, mode os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("failed to create config file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write config file: %w", err)
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write config file: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write config file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write config file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), name); err != nil {
+		return fmt.Errorf("failed to replace config file: %w", err)
+	}
+	return nil
+}
+
+// jsonObject is a JSON object whose keys keep the order they were read in,
+// so that a configuration file written back only differs where changed.
+type jsonObject struct {
+	keys   []string
+	values map[string]json.RawMessage
+}
+
+func (o *jsonObject) set(key string, value json.RawMessage) {
+	if _, ok := o.values[key]; !ok {
+		o.keys = append(o.keys, key)
+	}
+	o.values[key] = value
+}
+
+func (o *jsonObject) remove(key string) {
+	if _, ok := o.values[key]; !ok {
+		return
+	}
+	delete(o.values, key)
+	for i, k := range o.keys {
+		if k == key {
+			o.keys = append(o.keys[:i], o.keys[i+1:]...)
+			break
+		}
+	}
+}
+
+func (o *jsonObject) UnmarshalJSON(data []byte) error {
+	o.keys = nil
+	o.values = make(map[string]json.RawMessage)
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if tok, err := dec.Token(); err != nil {
+		return err
+	} else if tok != json.Delim('{') {
+		return fmt.Errorf("expected a JSON object")
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		key, ok := tok.(string)
+		if !ok {
+			return fmt.Errorf("expected a JSON object key")
+		}
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return err
+		}
+		o.set(key, value)
+	}
+	_, err := dec.Token()
+	return err
+}
+
+func (o *jsonObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, key := range o.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(o.values[key])
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,175 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/anthdm/foreverstore/logger"
+)
+
+func TestRuntimeSettingsLogLevel(t *testing.T) {
+	defer logger.SetGlobalLevel(logger.INFO)
+
+	cfg := DefaultConfig()
+	rs := NewRuntimeSettings(cfg, "")
+
+	if err := rs.Set("log_level", "debug", "test", false); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if cfg.LogLevel != "DEBUG" {
+		t.Errorf("Expected log level DEBUG, got %s", cfg.LogLevel)
+	}
+	if logger.GlobalLevel() != logger.DEBUG {
+		t.Errorf("Expected global logger level DEBUG, got %s", logger.GlobalLevel())
+	}
+	if rs.Values()["log_level"] != "DEBUG" {
+		t.Errorf("Expected reported value DEBUG, got %s", rs.Values()["log_level"])
+	}
+
+	if err := rs.Set("log_level", "LOUD", "test", false); err == nil {
+		t.Error("Expected error for invalid log level")
+	}
+	if err := rs.Set("unknown", "1", "test", false); err == nil {
+		t.Error("Expected error for unknown setting")
+	}
+
+	audit := rs.AuditLog()
+	if len(audit) != 1 {
+		t.Fatalf("Expected 1 audit entry, got %d", len(audit))
+	}
+	if audit[0].Actor != "test" || audit[0].OldValue != "INFO" || audit[0].NewValue != "DEBUG" {
+		t.Errorf("Unexpected audit entry: %+v", audit[0])
+	}
+}
+
+func TestRuntimeSettingsPersist(t *testing.T) {
+	defer logger.SetGlobalLevel(logger.INFO)
+
+	tmpFile := "/tmp/test_runtime_config.json"
+	defer os.Remove(tmpFile)
+
+	cfg := DefaultConfig()
+	rs := NewRuntimeSettings(cfg, tmpFile)
+
+	if err := rs.Set("log_level", "WARN", "test", true); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	loaded, err := LoadFromFile(tmpFile)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if loaded.LogLevel != "WARN" {
+		t.Errorf("Expected persisted log level WARN, got %s", loaded.LogLevel)
+	}
+	if !rs.AuditLog()[0].Persisted {
+		t.Error("Expected audit entry to be marked as persisted")
+	}
+}
+
+func TestRuntimeSettingsPersistOnlyChangedKey(t *testing.T) {
+	defer logger.SetGlobalLevel(logger.INFO)
+
+	tmpFile := "/tmp/test_runtime_config_patch.json"
+	defer os.Remove(tmpFile)
+	original := `{
+  "listen_addr": ":4000",
+  "log_level": "INFO",
+  "profile": "prod",
+  "profiles": {
+    "prod": {
+      "slow_op_threshold_ms": 100
+    }
+  }
+}
+`
+	if err := os.WriteFile(tmpFile, []byte(original), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := LoadFromFile(tmpFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Values from the environment, secret files or flags must not reach
+	// the file.
+	cfg.EncryptionKey = "secret-key"
+	cfg.JoinToken = "secret-token"
+	cfg.ListenAddr = ":5000"
+
+	rs := NewRuntimeSettings(cfg, tmpFile)
+	rs.Register("slow_op_threshold_ms", RuntimeSetting{
+		Get: func() string { return "" },
+		Set: func(value string) error { cfg.SlowOpThresholdMs = 250; return nil },
+	})
+	if err := rs.Set("log_level", "WARN", "test", true); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := rs.Set("slow_op_threshold_ms", "250", "test", true); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	data, err := os.ReadFile(tmpFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{
+  "listen_addr": ":4000",
+  "log_level": "WARN",
+  "profile": "prod",
+  "profiles": {
+    "prod": {
+      "slow_op_threshold_ms": 250
+    }
+  }
+}
+`
+	if string(data) != expected {
+		t.Errorf("Unexpected config file:\n%s", data)
+	}
+	if info, err := os.Stat(tmpFile); err != nil || info.Mode().Perm() != 0640 {
+		t.Errorf("Expected the config file mode to be kept, got %v", info.Mode())
+	}
+}
+
+func TestRuntimeSettingsPersistZeroInProfile(t *testing.T) {
+	defer logger.SetGlobalLevel(logger.INFO)
+
+	tmpFile := filepath.Join(t.TempDir(), "config.json")
+	original := `{
+  "slow_op_threshold_ms": 500,
+  "profile": "prod",
+  "profiles": {
+    "prod": {
+      "slow_op_threshold_ms": 100
+    }
+  }
+}
+`
+	if err := os.WriteFile(tmpFile, []byte(original), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := LoadFromFile(tmpFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs := NewRuntimeSettings(cfg, tmpFile)
+	rs.Register("slow_op_threshold_ms", RuntimeSetting{
+		Get: func() string { return "" },
+		Set: func(value string) error { cfg.SlowOpThresholdMs = 0; return nil },
+	})
+	if err := rs.Set("slow_op_threshold_ms", "0", "test", true); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// The profile keeps overriding the top-level value, now with zero.
+	loaded, err := LoadFromFile(tmpFile)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if loaded.SlowOpThresholdMs != 0 {
+		t.Errorf("Expected the persisted threshold 0 after a reload, got %d", loaded.SlowOpThresholdMs)
+	}
+}
@@ -0,0 +1,119 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// SecretProvider resolves a secret reference into its plaintext value. The
+// reference is everything after the "scheme://" prefix, so for
+// "vault://secret/data/fs#key" a provider registered under "vault" receives
+// "secret/data/fs#key".
+type SecretProvider interface {
+	Resolve(ref string) (string, error)
+}
+
+// SecretProviderFunc adapts an ordinary function to the SecretProvider interface.
+type SecretProviderFunc func(ref string) (string, error)
+
+// Resolve implements the SecretProvider interface.
+func (f SecretProviderFunc) Resolve(ref string) (string, error) {
+	return f(ref)
+}
+
+var (
+	secretProvidersLock sync.RWMutex
+	secretProviders     = map[string]SecretProvider{
+		"file": SecretProviderFunc(resolveFileSecret),
+		"env":  SecretProviderFunc(resolveEnvSecret),
+	}
+)
+
+// RegisterSecretProvider makes a provider available for references using the
+// given scheme. Registering an existing scheme replaces the previous provider.
+func RegisterSecretProvider(scheme string, provider SecretProvider) {
+	secretProvidersLock.Lock()
+	defer secretProvidersLock.Unlock()
+	secretProviders[scheme] = provider
+}
+
+// ResolveSecret resolves value if it is a reference to a registered provider
+// (e.g. "file:///etc/fs/key" or "env://FS_KEY"). Any other value is treated
+// as a literal and returned unchanged.
+func ResolveSecret(value string) (string, error) {
+	scheme, ref, ok := strings.Cut(value, "://")
+	if !ok {
+		return value, nil
+	}
+
+	secretProvidersLock.RLock()
+	provider, ok := secretProviders[scheme]
+	secretProvidersLock.RUnlock()
+	if !ok {
+		return value, nil
+	}
+
+	secret, err := provider.Resolve(ref)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s secret: %w", scheme, err)
+	}
+	return secret, nil
+}
+
+// secretFields returns the configuration fields that may hold secret references.
+func (c *Config) secretFields() map[string]*string {
+	return map[string]*string{
+		"encryption_key": &c.EncryptionKey,
+		"peer_proxy":     &c.PeerProxy,
+		"join_token":     &c.JoinToken,
+		"cluster_secret": &c.ClusterSecret,
+		"admin_token":    &c.AdminToken,
+	}
+}
+
+// ResolveSecrets replaces every secret reference in the configuration with
+// the value returned by its provider.
+func (c *Config) ResolveSecrets() error {
+	for name, field := range c.secretFields() {
+		secret, err := ResolveSecret(*field)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		*field = secret
+	}
+
+	for version, ref := range c.PreviousEncryptionKeys {
+		secret, err := ResolveSecret(ref)
+		if err != nil {
+			return fmt.Errorf("previous_encryption_keys.%s: %w", version, err)
+		}
+		c.PreviousEncryptionKeys[version] = secret
+	}
+
+	for peer, ref := range c.PeerProxies {
+		secret, err := ResolveSecret(ref)
+		if err != nil {
+			return fmt.Errorf("peer_proxies.%s: %w", peer, err)
+		}
+		c.PeerProxies[peer] = secret
+	}
+	return nil
+}
+
+func resolveFileSecret(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+func resolveEnvSecret(name string) (string, error) {
+	val, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", name)
+	}
+	return val, nil
+}
@@ -0,0 +1,84 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestResolveSecretLiteral(t *testing.T) {
+	secret, err := ResolveSecret("deadbeef")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if secret != "deadbeef" {
+		t.Errorf("Expected literal to be returned unchanged, got %s", secret)
+	}
+
+	// Unknown schemes are not treated as references
+	secret, err = ResolveSecret("https://example.com")
+	if err != nil || secret != "https://example.com" {
+		t.Errorf("Expected unknown scheme to be returned unchanged, got %s (%v)", secret, err)
+	}
+}
+
+func TestResolveSecretFile(t *testing.T) {
+	tmpFile := "/tmp/test_secret_key"
+	defer os.Remove(tmpFile)
+
+	if err := os.WriteFile(tmpFile, []byte("s3cr3t\n"), 0600); err != nil {
+		t.Fatalf("Failed to write secret: %v", err)
+	}
+
+	secret, err := ResolveSecret("file://" + tmpFile)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if secret != "s3cr3t" {
+		t.Errorf("Expected s3cr3t, got %q", secret)
+	}
+
+	if _, err := ResolveSecret("file:///tmp/does_not_exist_secret"); err == nil {
+		t.Error("Expected error for missing secret file")
+	}
+}
+
+func TestResolveSecretEnv(t *testing.T) {
+	os.Setenv("FS_TEST_SECRET", "from-env")
+	defer os.Unsetenv("FS_TEST_SECRET")
+
+	secret, err := ResolveSecret("env://FS_TEST_SECRET")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if secret != "from-env" {
+		t.Errorf("Expected from-env, got %s", secret)
+	}
+
+	if _, err := ResolveSecret("env://FS_TEST_SECRET_UNSET"); err == nil {
+		t.Error("Expected error for unset environment variable")
+	}
+}
+
+func TestCustomSecretProvider(t *testing.T) {
+	RegisterSecretProvider("vault", SecretProviderFunc(func(ref string) (string, error) {
+		if ref == "secret/fs#key" {
+			return "vault-key", nil
+		}
+		return "", errors.New("not found")
+	}))
+
+	cfg := DefaultConfig()
+	cfg.EncryptionKey = "vault://secret/fs#key"
+	if err := cfg.ResolveSecrets(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if cfg.EncryptionKey != "vault-key" {
+		t.Errorf("Expected vault-key, got %s", cfg.EncryptionKey)
+	}
+
+	cfg.EncryptionKey = "vault://secret/other"
+	if err := cfg.ResolveSecrets(); err == nil {
+		t.Error("Expected error from provider")
+	}
+}
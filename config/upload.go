@@ -0,0 +1,90 @@
+package config
+
+import (
+	"fmt"
+	"mime"
+	"regexp"
+	"strings"
+)
+
+// UploadPolicy restricts the objects clients may store in a bucket, or in
+// every bucket when Bucket is empty. Zero values restrict nothing.
+type UploadPolicy struct {
+	Bucket string `json:"bucket,omitempty"`
+	// MaxObjectBytes is the largest object that may be stored.
+	MaxObjectBytes int64 `json:"max_object_bytes,omitempty"`
+	// ContentTypes are the media types objects may have, such as
+	// "application/pdf", or "image/*" for all the subtypes of a type.
+	// Parameters of the content type of an object are ignored.
+	ContentTypes []string `json:"content_types,omitempty"`
+	// KeyPattern is a regular expression the keys of the objects must
+	// match, and DeniedKeyPattern one they must not.
+	KeyPattern       string `json:"key_pattern,omitempty"`
+	DeniedKeyPattern string `json:"denied_key_pattern,omitempty"`
+}
+
+// AppliesTo reports whether the policy restricts the object stored under
+// key.
+func (p UploadPolicy) AppliesTo(key string) bool {
+	if p.Bucket == "" {
+		return true
+	}
+	bucket, _, ok := strings.Cut(key, "/")
+	return ok && bucket == p.Bucket
+}
+
+// AllowsContentType reports whether the policy lets objects of content
+// type contentType be stored.
+func (p UploadPolicy) AllowsContentType(contentType string) bool {
+	if len(p.ContentTypes) == 0 {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, allowed := range p.ContentTypes {
+		allowed = strings.ToLower(allowed)
+		if allowed == mediaType {
+			return true
+		}
+		if strings.HasSuffix(allowed, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(allowed, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateUploadPolicies checks the policies: at most one per bucket and
+// one for every bucket, sizes that are not negative, content types that
+// are media types and key patterns that compile.
+func ValidateUploadPolicies(policies []UploadPolicy) error {
+	seen := make(map[string]bool, len(policies))
+	for _, p := range policies {
+		name := "every bucket"
+		if p.Bucket != "" {
+			if !validBucket(p.Bucket) {
+				return fmt.Errorf("invalid upload policy bucket %q", p.Bucket)
+			}
+			name = fmt.Sprintf("bucket %q", p.Bucket)
+		}
+		if seen[p.Bucket] {
+			return fmt.Errorf("duplicate upload policy for %s", name)
+		}
+		seen[p.Bucket] = true
+		if p.MaxObjectBytes < 0 {
+			return fmt.Errorf("upload policy for %s has a negative object size", name)
+		}
+		for _, contentType := range p.ContentTypes {
+			if _, _, err := mime.ParseMediaType(contentType); err != nil {
+				return fmt.Errorf("upload policy for %s allows invalid content type %q", name, contentType)
+			}
+		}
+		for _, pattern := range []string{p.KeyPattern, p.DeniedKeyPattern} {
+			if _, err := regexp.Compile(pattern); err != nil {
+				return fmt.Errorf("upload policy for %s has an invalid key pattern: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
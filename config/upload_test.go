@@ -0,0 +1,56 @@
+package config
+
+import "testing"
+
+func TestValidateUploadPolicies(t *testing.T) {
+	policies := []UploadPolicy{
+		{MaxObjectBytes: 1 << 30, DeniedKeyPattern: `\.exe$`},
+		{Bucket: "photos", ContentTypes: []string{"image/*"}, KeyPattern: `^photos/[a-z0-9-]+\.(jpg|png)$`},
+	}
+	if err := ValidateUploadPolicies(policies); err != nil {
+		t.Errorf("Expected valid policies, got %v", err)
+	}
+
+	invalid := map[string][]UploadPolicy{
+		"nested bucket":        {{Bucket: "photos/raw"}},
+		"duplicate bucket":     {{Bucket: "photos"}, {Bucket: "photos", MaxObjectBytes: 1}},
+		"duplicate default":    {{MaxObjectBytes: 1}, {MaxObjectBytes: 2}},
+		"negative size":        {{MaxObjectBytes: -1}},
+		"invalid content type": {{ContentTypes: []string{"image/"}}},
+		"invalid pattern":      {{KeyPattern: "("}},
+		"invalid denied":       {{DeniedKeyPattern: "[a-"}},
+	}
+	for name, policies := range invalid {
+		if err := ValidateUploadPolicies(policies); err == nil {
+			t.Errorf("%s: expected validation error", name)
+		}
+	}
+
+	cfg := DefaultConfig()
+	cfg.UploadPolicies = invalid["invalid pattern"]
+	if err := cfg.Validate(); err == nil {
+		t.Error("Expected config with an invalid upload policy to be rejected")
+	}
+}
+
+func TestUploadPolicyMatches(t *testing.T) {
+	p := UploadPolicy{Bucket: "photos", ContentTypes: []string{"image/*", "application/pdf"}}
+	if !p.AppliesTo("photos/cat.jpg") || p.AppliesTo("photosets/cat.jpg") || p.AppliesTo("photos") {
+		t.Error("Expected the policy to apply to the objects of its bucket only")
+	}
+	if !(UploadPolicy{}).AppliesTo("anything") {
+		t.Error("Expected a policy without a bucket to apply to every object")
+	}
+
+	allowed := []string{"image/png", "IMAGE/JPEG", "application/pdf", "application/pdf; charset=binary"}
+	for _, contentType := range allowed {
+		if !p.AllowsContentType(contentType) {
+			t.Errorf("Expected %q to be allowed", contentType)
+		}
+	}
+	for _, contentType := range []string{"text/plain", "imagex/png", "application/pdfx", ""} {
+		if p.AllowsContentType(contentType) {
+			t.Errorf("Expected %q to be refused", contentType)
+		}
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/anthdm/foreverstore/dht"
+	"github.com/anthdm/foreverstore/errors"
+	"github.com/anthdm/foreverstore/p2p"
+)
+
+// Peers are known by the address of their connection, which for the
+// connections a node accepts is an ephemeral port of the dialer: two nodes
+// listing each other as bootstrap nodes, or a node dialed again under
+// another of its addresses, end up connected twice. Peers introduce
+// themselves with a MessageHello on connecting, and of two connections to
+// the same node the one dialed by the node with the smaller ID is kept,
+// which both ends agree on without talking it over.
+
+// MessageHello introduces a node to a peer it just connected with.
+type MessageHello struct {
+	ID string
+	// ListenAddr is the address the node accepts connections on, as
+	// advertised.
+	ListenAddr string
+	// Version is the version of the node, and Features the optional
+	// protocol features it supports.
+	Version  string
+	Features []string
+	// Capacity is the disk usage and the site of the node as it connects,
+	// for the peer to place replicas and route reads by before the first
+	// capacity report. Its ID is empty when it could not be measured.
+	Capacity MessageCapacity
+}
+
+// Features a node can announce in its MessageHello.
+const (
+	// FeatureReplicaAcks: the node acknowledges the replicas it stores.
+	FeatureReplicaAcks = "replica-acks"
+	// FeatureBatch: the node takes MessageStoreBatch and MessageGetBatch.
+	FeatureBatch = "batch"
+	// FeatureChangeFeed: the node records a change feed.
+	FeatureChangeFeed = "change-feed"
+	// FeatureHeartbeats: the node sends heartbeats, and may be declared
+	// dead when they stop.
+	FeatureHeartbeats = "heartbeats"
+)
+
+// nodeFeatures are the features this node supports.
+var nodeFeatures = []string{FeatureReplicaAcks, FeatureBatch, FeatureChangeFeed, FeatureHeartbeats}
+
+// peerConn is the connection kept to a node.
+type peerConn struct {
+	addr     string
+	outbound bool
+}
+
+// connManager tracks the nodes behind the connections of a server.
+type connManager struct {
+	mu sync.Mutex
+	// nodes maps node IDs to the connection kept to each, and ids the
+	// addresses of the connections to the node ID of their peer.
+	nodes map[string]peerConn
+	ids   map[string]string
+	// listening maps the addresses nodes were reached at, dialed or
+	// advertised, to their node IDs.
+	listening map[string]string
+	// hellos holds what the peers of the connections at each address
+	// introduced themselves with.
+	hellos map[string]MessageHello
+}
+
+// identify records that the connection at addr, dialed by this node when
+// outbound, is to the node id reachable at listen. When the node is
+// connected already, the address of the connection to close is returned.
+// A connection of the node self to itself is always closed.
+func (m *connManager) identify(self, addr, id, listen string, outbound bool) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.nodes == nil {
+		m.nodes = make(map[string]peerConn)
+		m.ids = make(map[string]string)
+		m.listening = make(map[string]string)
+	}
+	if listen != "" {
+		m.listening[listen] = id
+	}
+	if outbound {
+		m.listening[addr] = id
+	}
+	if id == self {
+		return addr
+	}
+
+	old, ok := m.nodes[id]
+	if ok && old.addr != addr {
+		// Keep the connection dialed by the node with the smaller ID.
+		if (self < id) != outbound {
+			return addr
+		}
+		delete(m.ids, old.addr)
+	}
+	m.nodes[id] = peerConn{addr: addr, outbound: outbound}
+	m.ids[addr] = id
+	if ok && old.addr != addr {
+		return old.addr
+	}
+	return ""
+}
+
+// connected reports whether the node reached at addr is connected already,
+// or is the node self.
+func (m *connManager) connected(self, addr string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id, ok := m.listening[addr]
+	if !ok {
+		return false
+	}
+	_, ok = m.nodes[id]
+	return ok || id == self
+}
+
+// id returns the node ID of the peer at addr, empty until it introduced
+// itself.
+func (m *connManager) id(addr string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.ids[addr]
+}
+
+// conn returns the address of the connection to the node id, or to the
+// node reached at listen when id is not connected.
+func (m *connManager) conn(id, listen string) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if c, ok := m.nodes[id]; ok {
+		return c.addr, true
+	}
+	if c, ok := m.nodes[m.listening[listen]]; ok && listen != "" {
+		return c.addr, true
+	}
+	return "", false
+}
+
+// introduced records the MessageHello of the peer at addr.
+func (m *connManager) introduced(addr string, hello MessageHello) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.hellos == nil {
+		m.hellos = make(map[string]MessageHello)
+	}
+	m.hellos[addr] = hello
+}
+
+// hello returns the MessageHello of the peer at addr, if it introduced
+// itself.
+func (m *connManager) hello(addr string) (MessageHello, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	hello, ok := m.hellos[addr]
+	return hello, ok
+}
+
+// forget drops the connection at addr. The addresses its node was reached
+// at are remembered for when it connects again.
+func (m *connManager) forget(addr string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id, ok := m.ids[addr]
+	if !ok {
+		return
+	}
+	delete(m.ids, addr)
+	delete(m.hellos, addr)
+	if m.nodes[id].addr == addr {
+		delete(m.nodes, id)
+	}
+}
+
+// dial connects to the node listening on addr, unless it is connected
+// already: requests to a node go over the connection kept to it, whichever
+// end dialed it. Dialing fails once MaxPeers peers are connected.
+func (s *FileServer) dial(addr string) error {
+	if s.connectedTo(addr) {
+		return nil
+	}
+	if s.MaxPeers > 0 && len(s.connectedPeers()) >= s.MaxPeers {
+		return errors.NewConnectionError(fmt.Sprintf("peer limit of %d reached", s.MaxPeers)).WithContext("peer", addr)
+	}
+	return s.Transport.Dial(addr)
+}
+
+// connectedTo reports whether the node reached at addr is connected, over a
+// connection dialed or accepted.
+func (s *FileServer) connectedTo(addr string) bool {
+	if _, ok := s.peer(addr); ok {
+		return true
+	}
+	return s.conns.connected(s.ID, addr)
+}
+
+// introduce sends a new peer the MessageHello of this node. Not from
+// OnPeer: the peer may be in its own OnPeer, not reading yet.
+func (s *FileServer) introduce(addr string, peer p2p.Peer) {
+	hello := MessageHello{
+		ID:         s.ID,
+		ListenAddr: s.advertiseAddr(),
+		Version:    Version,
+		Features:   nodeFeatures,
+	}
+	capacity, err := s.measureCapacity()
+	if err != nil {
+		s.logger.Warn("Failed to measure capacity for peer %s: %v", addr, err)
+	} else {
+		hello.Capacity = capacity
+		hello.Capacity.SentAt = s.Clock.Now()
+	}
+	msg := Message{Payload: hello}
+	if err := s.sendMessage(peer, &msg); err != nil {
+		s.logger.Warn("Failed to introduce ourselves to peer %s: %v", addr, err)
+	}
+}
+
+// peerSupports reports whether the peer at addr announced feature in its
+// MessageHello.
+func (s *FileServer) peerSupports(addr, feature string) bool {
+	hello, ok := s.conns.hello(addr)
+	if !ok {
+		return false
+	}
+	for _, f := range hello.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// advertiseAddr is the address peers are told to reach the node at.
+func (s *FileServer) advertiseAddr() string {
+	if s.AdvertiseAddr != "" {
+		return s.AdvertiseAddr
+	}
+	return s.Transport.Addr()
+}
+
+func (s *FileServer) handleMessageHello(from string, msg MessageHello) error {
+	peer, ok := s.peer(from)
+	if !ok {
+		return nil
+	}
+	// A removed peer dialed again, at whichever of its addresses, was
+	// added back.
+	if peer.Outbound() {
+		s.removed.restoreID(msg.ID)
+	} else if s.removed.hasID(msg.ID) {
+		s.logger.Info("Closing connection to removed peer %s: %s", msg.ID, from)
+		s.dropPeer(from)
+		return nil
+	}
+	listen := advertisedAddr(from, msg.ListenAddr)
+	s.conns.introduced(from, msg)
+	if msg.Capacity.ID != "" {
+		s.capacity.seed(from, msg.Capacity, s.Clock.Now())
+		s.observeClock(from, msg.Capacity.SentAt)
+	}
+	drop := s.conns.identify(s.ID, from, msg.ID, listen, peer.Outbound())
+	s.routes.Add(dht.Contact{ID: msg.ID, Addr: listen})
+	if drop == "" {
+		return nil
+	}
+	if msg.ID == s.ID {
+		// Both ends of the connection are ours: the other is known by the
+		// address of this one's end.
+		s.logger.Info("Closing connection to ourselves: %s", drop)
+		s.dropPeer(peer.LocalAddr().String())
+	} else {
+		s.logger.Info("Closing duplicate connection to %s: %s", msg.ID, drop)
+	}
+	s.dropPeer(drop)
+	return nil
+}
+
+// advertisedAddr is the address a peer connected from remote accepts
+// connections on, given the address it listens on: a listen address
+// without a host, or with an unspecified one, is reached at the host of
+// remote.
+func advertisedAddr(remote, listen string) string {
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return listen
+	}
+	if ip := net.ParseIP(host); host != "" && (ip == nil || !ip.IsUnspecified()) {
+		return listen
+	}
+	remoteHost, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		return listen
+	}
+	return net.JoinHostPort(remoteHost, port)
+}
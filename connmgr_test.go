@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/anthdm/foreverstore/p2p"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConnectionsDeduplicated(t *testing.T) {
+	servers := make([]*FileServer, 3)
+	addrs := make([]string, 3)
+	for i := range servers {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.Nil(t, err)
+		addrs[i] = listener.Addr().String()
+		listener.Close()
+
+		servers[i] = createTestServer(addrs[i], t.TempDir(), []string{})
+		assert.Nil(t, servers[i].Start())
+		defer servers[i].Stop()
+	}
+	a, b, c := servers[0], servers[1], servers[2]
+	peers := func(s *FileServer) int { return len(s.connectedPeers()) }
+	introduced := func(s *FileServer) bool {
+		for _, p := range s.Peers() {
+			if p.ID == "" {
+				return false
+			}
+		}
+		return true
+	}
+
+	// Nodes dialing each other end up with one connection, the same one
+	// on both ends.
+	done := make(chan error)
+	go func() { done <- a.AddPeer(addrs[1]) }()
+	assert.Nil(t, b.AddPeer(addrs[0]))
+	assert.Nil(t, <-done)
+	assert.Eventually(t, func() bool {
+		return peers(a) == 1 && peers(b) == 1 && introduced(a) && introduced(b)
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, b.ID, a.Peers()[0].ID)
+	assert.Equal(t, a.ID, b.Peers()[0].ID)
+	assert.Equal(t, p2p.ProtocolVersion, a.Peers()[0].Protocol)
+
+	// Dialing a connected node again reuses its connection.
+	assert.Nil(t, b.AddPeer(addrs[0]))
+	assert.Nil(t, a.AddPeer(addrs[1]))
+	assert.True(t, a.connectedTo(addrs[1]))
+	assert.True(t, b.connectedTo(addrs[0]))
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 1, peers(a))
+	assert.Equal(t, 1, peers(b))
+
+	// Past MaxPeers, connections are neither dialed nor accepted.
+	a.MaxPeers = 1
+	assert.NotNil(t, a.AddPeer(addrs[2]))
+	assert.Nil(t, c.AddPeer(addrs[0]))
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 1, peers(a))
+
+	// A node dialing itself drops both ends of the connection.
+	before := peers(c)
+	assert.Nil(t, c.AddPeer(addrs[2]))
+	assert.Eventually(t, func() bool { return c.connectedTo(addrs[2]) }, 5*time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool { return peers(c) == before }, 5*time.Second, 10*time.Millisecond)
+	assert.Nil(t, c.AddPeer(addrs[2]))
+	assert.Equal(t, before, peers(c))
+}
+
+func TestAdvertisedAddr(t *testing.T) {
+	assert.Equal(t, "10.0.0.2:3000", advertisedAddr("10.0.0.2:51234", ":3000"))
+	assert.Equal(t, "10.0.0.2:3000", advertisedAddr("10.0.0.2:51234", "0.0.0.0:3000"))
+	assert.Equal(t, "10.0.0.9:3000", advertisedAddr("10.0.0.2:51234", "10.0.0.9:3000"))
+	assert.Equal(t, "[fd00::2]:3000", advertisedAddr("[fd00::2]:51234", "[::]:3000"))
+	assert.Equal(t, "node-1", advertisedAddr("node-1", "node-1"))
+}
+
+func TestNodesKnownByTheirAdvertisedAddr(t *testing.T) {
+	freeAddr := func(network, addr string) string {
+		listener, err := net.Listen(network, addr)
+		if err != nil {
+			t.Skipf("cannot listen on %s: %v", addr, err)
+		}
+		defer listener.Close()
+		return listener.Addr().String()
+	}
+	addrA := freeAddr("tcp4", "127.0.0.1:0")
+	addrB, addrB6 := freeAddr("tcp4", "127.0.0.1:0"), freeAddr("tcp6", "[::1]:0")
+
+	a := createTestServer(addrA, t.TempDir(), []string{})
+	b := createTestServer(addrB, t.TempDir(), []string{})
+	b.Transport.(*p2p.TCPTransport).ListenAddrs = []string{addrB6}
+	b.AdvertiseAddr = "storage-b.example:3000"
+	for _, s := range []*FileServer{a, b} {
+		assert.Nil(t, s.Start())
+		defer s.Stop()
+	}
+
+	// Reached over IPv6, the node is known by the address it advertises:
+	// dialing that one reuses the connection.
+	assert.Nil(t, a.AddPeer(addrB6))
+	assert.Eventually(t, func() bool { return a.connectedTo("storage-b.example:3000") }, 5*time.Second, 10*time.Millisecond)
+	assert.Nil(t, a.AddPeer("storage-b.example:3000"))
+	assert.Len(t, a.connectedPeers(), 1)
+
+	// It still accepts peers on its IPv4 address.
+	assert.Nil(t, a.RemovePeer(b.ID))
+	assert.Nil(t, a.AddPeer(addrB))
+	assert.Eventually(t, func() bool { return len(b.connectedPeers()) == 1 }, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"math/rand"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/anthdm/foreverstore/errors"
+)
+
+// The consistency checker compares the replicas of objects of this node
+// with the objects, going by what the peers tell of them — size, integrity
+// tag, key version — without reading them. Operators check a key, or a
+// sample of keys, at will; the node checks a sample of its objects every
+// ConsistencyCheckInterval, and has a re-replication job repair those
+// found divergent.
+
+// consistencyCheckTimeout bounds the wait for peers to describe their
+// replicas.
+const consistencyCheckTimeout = 5 * time.Second
+
+// MessageDescribeReplica asks a peer to describe its replica of the object
+// stored under the replica key Key in namespace ID.
+type MessageDescribeReplica struct {
+	ID  string
+	Key string
+}
+
+// MessageReplicaDescription answers a MessageDescribeReplica from the
+// metadata of the replica.
+type MessageReplicaDescription struct {
+	Present    bool
+	Size       int64
+	HMAC       []byte
+	KeyVersion uint32
+	Cipher     string
+}
+
+// Divergences of a replica from its object.
+const (
+	// DivergenceMissing is a replica missing from a peer meant to hold one.
+	DivergenceMissing = "missing"
+	// DivergenceKeyVersion is a replica encrypted with another key version
+	// than the object, as a key rotation left it.
+	DivergenceKeyVersion = "key_version"
+	// DivergenceContent is a replica of other content than the object.
+	DivergenceContent = "content"
+	// DivergenceSize is a replica whose size is not that of the object
+	// encrypted with its cipher, as a truncated write leaves it.
+	DivergenceSize = "size"
+)
+
+// ReplicaConsistency is the replica of an object on a peer.
+type ReplicaConsistency struct {
+	Addr       string `json:"addr"`
+	Present    bool   `json:"present"`
+	Size       int64  `json:"size,omitempty"`
+	Checksum   string `json:"checksum,omitempty"`
+	KeyVersion uint32 `json:"key_version,omitempty"`
+	// Divergence is how the replica differs from the object, empty when
+	// it does not.
+	Divergence string `json:"divergence,omitempty"`
+}
+
+// ConsistencyReport compares the replicas of an object with the object.
+type ConsistencyReport struct {
+	Key        string `json:"key"`
+	Size       int64  `json:"size"`
+	Checksum   string `json:"checksum,omitempty"`
+	KeyVersion uint32 `json:"key_version"`
+	// Replicas are the replicas of the peers that answered, by address.
+	Replicas  []ReplicaConsistency `json:"replicas"`
+	Divergent bool                 `json:"divergent"`
+	Partial
+}
+
+// ConsistencyCheck reports a check of a sample of the objects of the node.
+type ConsistencyCheck struct {
+	CheckedAt time.Time `json:"checked_at"`
+	Checked   int       `json:"checked"`
+	// Divergent are the reports of the objects found divergent.
+	Divergent []ConsistencyReport `json:"divergent"`
+	// RepairJob is the job started to repair the divergent objects.
+	RepairJob string `json:"repair_job,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// CheckConsistency compares the replicas the peers hold of the object of
+// this node stored under key with the object. Peers the policy of its
+// bucket leaves out may lack a replica.
+func (s *FileServer) CheckConsistency(key string) (ConsistencyReport, error) {
+	entry, meta, err := s.store.Stat(s.ID, key)
+	if os.IsNotExist(err) {
+		return ConsistencyReport{}, errors.NewFileNotFoundError(key)
+	}
+	if err != nil {
+		return ConsistencyReport{}, errors.Wrap(err, errors.StorageError, "failed to stat object")
+	}
+	if len(meta.HMAC) == 0 {
+		return ConsistencyReport{}, errors.NewValidationError("object has no integrity tag to check its copies against").
+			WithContext("key", key)
+	}
+	report := ConsistencyReport{
+		Key:        key,
+		Size:       entry.Size,
+		Checksum:   meta.ETag(),
+		KeyVersion: meta.KeyVersion,
+		Replicas:   []ReplicaConsistency{},
+	}
+
+	msg := MessageDescribeReplica{ID: s.ID, Key: hashKey(key)}
+	answers, errs := requestPeers[MessageReplicaDescription](s, s.peerAddrs(), msg, consistencyCheckTimeout)
+	report.Partial = partialAnswer(errs)
+	placed := s.replicaPlacement(key, meta, s.connectedPeers())
+
+	for addr, desc := range answers {
+		replica := ReplicaConsistency{Addr: addr, Present: desc.Present}
+		if desc.Present {
+			replica.Size = desc.Size
+			replica.Checksum = ObjectMeta{HMAC: desc.HMAC}.ETag()
+			replica.KeyVersion = desc.KeyVersion
+		}
+		_, wanted := placed[addr]
+		switch {
+		case !desc.Present && wanted:
+			replica.Divergence = DivergenceMissing
+		case !desc.Present:
+		case desc.KeyVersion != meta.KeyVersion:
+			replica.Divergence = DivergenceKeyVersion
+		case replica.Checksum != report.Checksum:
+			replica.Divergence = DivergenceContent
+		case desc.Cipher != "" && desc.Size != replicaSize(desc.Cipher, entry.Size):
+			replica.Divergence = DivergenceSize
+		}
+		if replica.Divergence != "" {
+			report.Divergent = true
+		}
+		report.Replicas = append(report.Replicas, replica)
+	}
+	sort.Slice(report.Replicas, func(i, j int) bool { return report.Replicas[i].Addr < report.Replicas[j].Addr })
+	return report, nil
+}
+
+// replicaSize returns the size of the replica of plaintextSize bytes of
+// plaintext encrypted with cipher.
+func replicaSize(cipher string, plaintextSize int64) int64 {
+	if cipher == CipherLegacyCTR {
+		return encryptedSize(EncryptionModeCTR, "", plaintextSize)
+	}
+	return encryptedSize(EncryptionModeGCM, cipher, plaintextSize)
+}
+
+// answerDescribeReplica describes the replica of a peer's object on this
+// node.
+func (s *FileServer) answerDescribeReplica(msg MessageDescribeReplica) (MessageReplicaDescription, error) {
+	entry, meta, err := s.store.Stat(msg.ID, msg.Key)
+	if os.IsNotExist(err) {
+		return MessageReplicaDescription{}, nil
+	}
+	if err != nil {
+		return MessageReplicaDescription{}, errors.Wrap(err, errors.StorageError, "failed to stat replica")
+	}
+	return MessageReplicaDescription{
+		Present:    true,
+		Size:       entry.Size,
+		HMAC:       meta.HMAC,
+		KeyVersion: meta.KeyVersion,
+		Cipher:     meta.Cipher,
+	}, nil
+}
+
+// CheckConsistencySample checks the consistency of n objects of this node
+// picked at random, and with repair set starts a re-replication job of the
+// objects found divergent.
+func (s *FileServer) CheckConsistencySample(n int, repair bool, by string) (ConsistencyCheck, error) {
+	check := ConsistencyCheck{CheckedAt: s.Clock.Now(), Divergent: []ConsistencyReport{}}
+	keys, err := s.listOwnKeys()
+	if err != nil {
+		return check, err
+	}
+	rand.Shuffle(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+	if len(keys) > n {
+		keys = keys[:n]
+	}
+
+	var divergent []string
+	for _, key := range keys {
+		report, err := s.CheckConsistency(key)
+		if err != nil {
+			// Deleted since it was listed, or stored without integrity tag.
+			continue
+		}
+		check.Checked++
+		if report.Divergent {
+			check.Divergent = append(check.Divergent, report)
+			divergent = append(divergent, key)
+		}
+	}
+	if len(divergent) > 0 {
+		s.logger.Warn("Consistency check found %d of %d objects divergent", len(divergent), check.Checked)
+	}
+	if !repair || len(divergent) == 0 {
+		return check, nil
+	}
+
+	job, err := s.startJob(JobReplicate, jobTask{
+		list: func() ([]string, error) { return divergent, nil },
+		do:   s.repairObject,
+	}, by)
+	if err != nil {
+		check.Error = err.Error()
+		return check, nil
+	}
+	check.RepairJob = job.ID
+	return check, nil
+}
+
+// consistencyLoop checks a sample of ConsistencyCheckSample objects every
+// ConsistencyCheckInterval until the server stops. Followers leave their
+// objects to their leader.
+func (s *FileServer) consistencyLoop() {
+	ticker := s.Clock.NewTicker(s.ConsistencyCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C():
+			if s.checkLeader() != nil {
+				continue
+			}
+			check, err := s.CheckConsistencySample(s.ConsistencyCheckSample, true, "consistency-check")
+			if err != nil {
+				s.logger.Warn("Consistency check failed: %v", err)
+				continue
+			}
+			if check.Error != "" {
+				s.logger.Warn("Consistency check could not repair the divergent objects: %s", check.Error)
+			}
+		case <-s.quitch:
+			return
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConsistencyCheckReportsAndRepairsDivergentReplicas(t *testing.T) {
+	c := newTestCluster(t, 3)
+	s := c.nodes[0]
+	for _, key := range []string{"a", "b", "c"} {
+		c.store(0, key, []byte("content of "+key))
+		c.assertConverged(0, key)
+	}
+
+	// Node 2 lost its replica of a, and node 1 holds a stale one of b.
+	assert.Nil(t, c.nodes[2].store.Delete(s.ID, hashKey("a")))
+	stale, err := c.nodes[1].store.ReadMeta(s.ID, hashKey("b"))
+	assert.Nil(t, err)
+	stale.HMAC = []byte("stale")
+	assert.Nil(t, c.nodes[1].store.WriteMeta(s.ID, hashKey("b"), stale))
+
+	check := func(key string) (report ConsistencyReport) {
+		assert.Nil(t, c.run("consistency check of "+key, func() (err error) {
+			report, err = s.CheckConsistency(key)
+			return err
+		}))
+		return report
+	}
+	report := check("a")
+	assert.True(t, report.Divergent)
+	if assert.Len(t, report.Replicas, 2) {
+		assert.Equal(t, "", report.Replicas[0].Divergence)
+		assert.Equal(t, report.Checksum, report.Replicas[0].Checksum)
+		assert.Equal(t, DivergenceMissing, report.Replicas[1].Divergence)
+		assert.False(t, report.Replicas[1].Present)
+	}
+	report = check("b")
+	assert.True(t, report.Divergent)
+	if assert.Len(t, report.Replicas, 2) {
+		assert.Equal(t, DivergenceContent, report.Replicas[0].Divergence)
+	}
+	assert.False(t, check("c").Divergent)
+
+	_, err = s.CheckConsistency("missing")
+	assert.NotNil(t, err)
+
+	// The sample check has the divergent objects repaired.
+	var sample ConsistencyCheck
+	assert.Nil(t, c.run("consistency check", func() (err error) {
+		sample, err = s.CheckConsistencySample(10, true, "admin")
+		return err
+	}))
+	assert.Equal(t, 3, sample.Checked)
+	assert.Len(t, sample.Divergent, 2)
+	assert.NotEmpty(t, sample.RepairJob)
+	c.eventually("divergent replicas to be repaired", func() bool {
+		meta, err := c.nodes[1].store.ReadMeta(s.ID, hashKey("b"))
+		return c.holds(2, 0, "a") && err == nil && !bytes.Equal(meta.HMAC, stale.HMAC)
+	})
+	st, err := s.Job(sample.RepairJob)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, st.Total)
+
+	assert.Nil(t, c.run("consistency check", func() (err error) {
+		sample, err = s.CheckConsistencySample(10, true, "admin")
+		return err
+	}))
+	assert.Empty(t, sample.Divergent)
+	assert.Empty(t, sample.RepairJob)
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/anthdm/foreverstore/errors"
+	"github.com/anthdm/foreverstore/p2p"
+)
+
+// Control messages change the state of the peers they are sent to: deletes,
+// locks, cluster settings, jobs and goodbyes. Unlike requests, which have replies
+// to wait for, and capacity reports, which are sent again every interval,
+// one lost with a dropped connection would go unnoticed. They are numbered
+// per peer and sent again until the peer acknowledges them, or reported as
+// failed after controlMaxAttempts sends.
+const (
+	controlResendInterval = time.Second
+	controlMaxAttempts    = 5
+	// controlWindow is how many control messages may wait for the
+	// acknowledgment of a peer before more are refused.
+	controlWindow = 1024
+)
+
+// MessageAck acknowledges the control message numbered Seq.
+type MessageAck struct {
+	Seq uint64
+}
+
+// isControl reports whether payload is sent as a control message.
+func isControl(payload any) bool {
+	switch payload.(type) {
+	case MessageDeleteFile, MessageLockObject, MessageClusterSettings, MessageJob, MessageGoodbye:
+		return true
+	}
+	return false
+}
+
+type pendingControl struct {
+	msg       Message
+	firstSent time.Time
+	sentAt    time.Time
+	attempts  int
+}
+
+// controlPeer numbers the control messages sent to a peer and keeps those
+// not acknowledged yet, and the numbers of those received from it.
+type controlPeer struct {
+	next    uint64
+	pending map[uint64]*pendingControl
+
+	// received is the number up to which every control message from the
+	// peer was received; ahead holds those received past it.
+	received uint64
+	ahead    map[uint64]struct{}
+}
+
+// base returns the lowest number not resolved yet: the peer will not see
+// the messages before it again, acknowledged or failed.
+func (p *controlPeer) base() uint64 {
+	base := p.next + 1
+	for seq := range p.pending {
+		if seq < base {
+			base = seq
+		}
+	}
+	return base
+}
+
+// PeerControlStats reports the control messages sent to one peer.
+type PeerControlStats struct {
+	Peer string `json:"peer"`
+	// Pending counts the messages not acknowledged yet, and OldestPending is
+	// how long ago the oldest of them was first sent.
+	Pending       int           `json:"pending"`
+	OldestPending time.Duration `json:"oldest_pending"`
+}
+
+// ControlStats reports the delivery of control messages to the peers.
+type ControlStats struct {
+	Peers []PeerControlStats `json:"peers"`
+	// Sent counts the control messages sent, Resent the sends made again
+	// for want of an acknowledgment, Acked the messages acknowledged and
+	// Failed those given up on.
+	Sent   int `json:"sent"`
+	Resent int `json:"resent"`
+	Acked  int `json:"acked"`
+	Failed int `json:"failed"`
+}
+
+type controlTracker struct {
+	mu     sync.Mutex
+	peers  map[string]*controlPeer
+	sent   int
+	resent int
+	acked  int
+	failed int
+}
+
+func (t *controlTracker) peer(addr string) *controlPeer {
+	if t.peers == nil {
+		t.peers = make(map[string]*controlPeer)
+	}
+	p, ok := t.peers[addr]
+	if !ok {
+		p = &controlPeer{pending: make(map[uint64]*pendingControl), ahead: make(map[uint64]struct{})}
+		t.peers[addr] = p
+	}
+	return p
+}
+
+// track numbers msg for the peer at addr and keeps it until acknowledged.
+// It returns the message to send.
+func (t *controlTracker) track(addr string, msg Message, now time.Time) (Message, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	p := t.peer(addr)
+	if len(p.pending) >= controlWindow {
+		return Message{}, errors.NewConnectionError(fmt.Sprintf("%d control messages to peer %s not acknowledged", len(p.pending), addr))
+	}
+	p.next++
+	msg.Seq = p.next
+	p.pending[msg.Seq] = &pendingControl{msg: msg, firstSent: now, sentAt: now, attempts: 1}
+	msg.Base = p.base()
+	t.sent++
+	return msg, nil
+}
+
+// ack drops the message numbered seq sent to addr.
+func (t *controlTracker) ack(addr string, seq uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p, ok := t.peers[addr]
+	if !ok {
+		return
+	}
+	if _, ok := p.pending[seq]; ok {
+		delete(p.pending, seq)
+		t.acked++
+	}
+}
+
+// receive records msg from the peer at addr, and reports whether it was
+// received before.
+func (t *controlTracker) receive(addr string, msg *Message) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	p := t.peer(addr)
+	if msg.Base > 0 && msg.Base-1 > p.received {
+		// The peer resolved everything before Base: what was not received
+		// of it never will be.
+		p.received = msg.Base - 1
+		for seq := range p.ahead {
+			if seq <= p.received {
+				delete(p.ahead, seq)
+			}
+		}
+	}
+	if _, ok := p.ahead[msg.Seq]; ok || msg.Seq <= p.received {
+		return true
+	}
+	p.ahead[msg.Seq] = struct{}{}
+	for {
+		if _, ok := p.ahead[p.received+1]; !ok {
+			break
+		}
+		p.received++
+		delete(p.ahead, p.received)
+	}
+	return false
+}
+
+// due returns, by peer, the messages to send again, as no acknowledgment
+// came within controlResendInterval of their last send, and those given up
+// on after controlMaxAttempts sends.
+func (t *controlTracker) due(now time.Time) (resend, failed map[string][]Message) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	resend = make(map[string][]Message)
+	failed = make(map[string][]Message)
+	for addr, p := range t.peers {
+		var due []*pendingControl
+		for seq, pc := range p.pending {
+			if now.Sub(pc.sentAt) < controlResendInterval {
+				continue
+			}
+			if pc.attempts >= controlMaxAttempts {
+				delete(p.pending, seq)
+				t.failed++
+				failed[addr] = append(failed[addr], pc.msg)
+				continue
+			}
+			due = append(due, pc)
+		}
+
+		base := p.base()
+		sort.Slice(due, func(i, j int) bool { return due[i].msg.Seq < due[j].msg.Seq })
+		for _, pc := range due {
+			pc.sentAt = now
+			pc.attempts++
+			t.resent++
+			msg := pc.msg
+			msg.Base = base
+			resend[addr] = append(resend[addr], msg)
+		}
+	}
+	return resend, failed
+}
+
+// forget drops what is known of the peer at addr, returning the messages
+// it never acknowledged.
+func (t *controlTracker) forget(addr string) []Message {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	p, ok := t.peers[addr]
+	if !ok {
+		return nil
+	}
+	delete(t.peers, addr)
+	lost := make([]Message, 0, len(p.pending))
+	for _, pc := range p.pending {
+		lost = append(lost, pc.msg)
+	}
+	t.failed += len(lost)
+	return lost
+}
+
+// reconnect forgets the numbers received from the peer at addr, which is
+// connected anew: it may have restarted and number from scratch. What was
+// sent to it and not acknowledged is still resent.
+func (t *controlTracker) reconnect(addr string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p := t.peer(addr)
+	p.received = 0
+	p.ahead = make(map[uint64]struct{})
+}
+
+// pending counts the control messages not acknowledged yet.
+func (t *controlTracker) pending() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := 0
+	for _, p := range t.peers {
+		n += len(p.pending)
+	}
+	return n
+}
+
+func (t *controlTracker) stats(now time.Time) ControlStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	stats := ControlStats{
+		Peers:  make([]PeerControlStats, 0, len(t.peers)),
+		Sent:   t.sent,
+		Resent: t.resent,
+		Acked:  t.acked,
+		Failed: t.failed,
+	}
+	for addr, p := range t.peers {
+		ps := PeerControlStats{Peer: addr, Pending: len(p.pending)}
+		for _, pc := range p.pending {
+			if age := now.Sub(pc.firstSent); age > ps.OldestPending {
+				ps.OldestPending = age
+			}
+		}
+		stats.Peers = append(stats.Peers, ps)
+	}
+	sort.Slice(stats.Peers, func(i, j int) bool { return stats.Peers[i].Peer < stats.Peers[j].Peer })
+	return stats
+}
+
+// ControlStats returns the delivery of control messages to each peer,
+// ordered by address.
+func (s *FileServer) ControlStats() ControlStats {
+	return s.control.stats(s.Clock.Now())
+}
+
+// sealControl seals msg in format for the peer at addr, numbering it first
+// when it is a control message.
+func (s *FileServer) sealControl(addr string, msg *Message, format wireFormat) ([]byte, error) {
+	if !isControl(msg.Payload) {
+		return s.sealMessage(msg, format)
+	}
+	numbered, err := s.control.track(addr, *msg, s.Clock.Now())
+	if err != nil {
+		return nil, err
+	}
+	return s.sealMessage(&numbered, format)
+}
+
+// receiveControl acknowledges a control message from a peer, and reports
+// whether it is new: resent ones are acknowledged again but not handled
+// twice.
+func (s *FileServer) receiveControl(from string, msg *Message) bool {
+	dup := s.control.receive(from, msg)
+	if peer, ok := s.peer(from); ok {
+		if err := s.sendMessage(peer, &Message{Payload: MessageAck{Seq: msg.Seq}}); err != nil {
+			s.logger.Warn("Failed to acknowledge control message %d from %s: %v", msg.Seq, from, err)
+		}
+	}
+	if dup {
+		s.logger.Debug("Ignoring control message %d from %s received before", msg.Seq, from)
+	}
+	return !dup
+}
+
+func (s *FileServer) handleMessageAck(from string, msg MessageAck) error {
+	s.control.ack(from, msg.Seq)
+	return nil
+}
+
+// resendControl sends again the control messages the peers have not
+// acknowledged, and reports those given up on.
+func (s *FileServer) resendControl() {
+	resend, failed := s.control.due(s.Clock.Now())
+	for addr, msgs := range failed {
+		s.reportControlFailed(addr, msgs, fmt.Sprintf("not acknowledged after %d attempts", controlMaxAttempts))
+	}
+	for addr, msgs := range resend {
+		peer, ok := s.peer(addr)
+		if !ok {
+			continue
+		}
+		for _, msg := range msgs {
+			s.logger.Debug("Resending control message %d (%T) to %s", msg.Seq, msg.Payload, addr)
+			if err := s.sendSealed(addr, peer, &msg); err != nil {
+				s.logger.Warn("Failed to resend control message %d to %s: %v", msg.Seq, addr, err)
+			}
+		}
+	}
+}
+
+// sendSealed seals msg as is and sends it to the peer at addr.
+func (s *FileServer) sendSealed(addr string, peer p2p.Peer, msg *Message) error {
+	format := peerFormat(peer)
+	b, err := s.sealMessage(msg, format)
+	if err != nil {
+		return err
+	}
+	unlock := s.sendLocks.lock(addr)
+	defer unlock()
+	if err := peer.Send(format.frame(b)); err != nil {
+		return errors.Wrap(err, errors.NetworkError, "failed to send message")
+	}
+	return nil
+}
+
+func (s *FileServer) reportControlFailed(addr string, msgs []Message, reason string) {
+	for _, msg := range msgs {
+		s.logger.Error("Control message %d (%T) to %s failed: %s", msg.Seq, msg.Payload, addr, reason)
+	}
+}
+
+// controlLoop resends unacknowledged control messages every
+// controlResendInterval until the server stops, and gives up on the
+// acknowledgments of replicas that are overdue.
+func (s *FileServer) controlLoop() {
+	ticker := s.Clock.NewTicker(controlResendInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C():
+			s.resendControl()
+			s.expireReplicaAcks()
+		case <-s.quitch:
+			return
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestControlMessagesAreResentUntilAcknowledged(t *testing.T) {
+	c := newTestCluster(t, 3)
+	c.store(0, "gone", []byte("deleted while node 2 was cut off"))
+	c.assertConverged(0, "gone")
+
+	// The delete sent to node 2 is lost in the partition.
+	c.partition([]int{0, 1}, []int{2})
+	assert.Nil(t, c.run("delete", func() error { return c.nodes[0].deleteObject("gone") }))
+	c.eventually("node 1 to delete its replica", func() bool { return !c.holds(1, 0, "gone") })
+	assert.True(t, c.holds(2, 0, "gone"))
+
+	c.heal()
+	c.eventually("node 2 to delete its replica", func() bool { return !c.holds(2, 0, "gone") })
+	c.eventually("the delete to be acknowledged", func() bool { return c.nodes[0].ControlStats().Peers[1].Pending == 0 })
+
+	stats := c.nodes[0].ControlStats()
+	assert.Equal(t, 2, stats.Sent)
+	assert.Equal(t, 2, stats.Acked)
+	assert.Positive(t, stats.Resent)
+	assert.Zero(t, stats.Failed)
+}
+
+func TestControlMessagesFailAfterMaxAttempts(t *testing.T) {
+	c := newTestCluster(t, 2)
+	c.store(0, "locked", []byte("never hears of its lock"))
+	c.assertConverged(0, "locked")
+
+	c.partition([]int{0}, []int{1})
+	assert.Nil(t, c.run("lock", func() error {
+		return c.nodes[0].LockObject("locked", ObjectLock{})
+	}))
+	c.eventually("the lock to be given up on", func() bool { return c.nodes[0].ControlStats().Failed == 1 })
+
+	stats := c.nodes[0].ControlStats()
+	assert.Equal(t, controlMaxAttempts-1, stats.Resent)
+	assert.Zero(t, stats.Peers[0].Pending)
+}
+
+func TestControlTrackerDropsDuplicates(t *testing.T) {
+	var tr controlTracker
+	first, err := tr.track("a", Message{Payload: MessageGoodbye{}}, time.Time{})
+	assert.Nil(t, err)
+	second, err := tr.track("a", Message{Payload: MessageGoodbye{}}, time.Time{})
+	assert.Nil(t, err)
+
+	var rx controlTracker
+	assert.False(t, rx.receive("b", &second))
+	assert.False(t, rx.receive("b", &first))
+	assert.True(t, rx.receive("b", &first))
+	assert.True(t, rx.receive("b", &second))
+
+	// A reconnected peer may number from scratch.
+	rx.reconnect("b")
+	assert.False(t, rx.receive("b", &first))
+}
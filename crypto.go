@@ -60,7 +60,7 @@ func copyDecrypt(key []byte, src io.Reader, dst io.Writer) (int, error) {
 	// Read the IV from the given io.Reader which, in our case should be the
 	// the block.BlockSize() bytes we read.
 	iv := make([]byte, block.BlockSize())
-	if _, err := src.Read(iv); err != nil {
+	if _, err := io.ReadFull(src, iv); err != nil {
 		return 0, err
 	}
 
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/anthdm/foreverstore/errors"
+)
+
+// Encryption modes for data sent to and stored on peers.
+const (
+	// EncryptionModeCTR is the original unauthenticated AES-CTR format:
+	// a 16 byte IV followed by the ciphertext.
+	EncryptionModeCTR = "ctr"
+	// EncryptionModeGCM is the chunked, authenticated AES-GCM format.
+	EncryptionModeGCM = "gcm"
+
+	defaultEncryptionMode = EncryptionModeGCM
+)
+
+// The GCM format is a header followed by a sequence of sealed chunks:
+//
+//	magic (4) | key version (4) | chunk size (4) | nonce prefix (8)
+//	chunk 0: ciphertext (<= chunk size) | tag (16)
+//	chunk 1: ...
+//
+// Every chunk is sealed with the nonce prefix followed by the big endian
+// chunk index, and the additional data marks whether it is the final chunk,
+// so reordering, dropping or truncating chunks fails authentication. The
+// first version of the format ("FSG1") had no key version field; it is
+// still readable and treated as key version 0. "FSG2" is always AES-GCM;
+// data sealed with any other cipher suite uses "FSG3", which records the
+// suite in a byte following the magic.
+const (
+	gcmMagic          = "FSG2"
+	gcmMagicV1        = "FSG1"
+	gcmMagicV3        = "FSG3"
+	gcmNoncePrefixLen = 8
+	gcmHeaderLen      = len(gcmMagic) + 4 + 4 + gcmNoncePrefixLen
+	gcmHeaderLenV3    = gcmHeaderLen + 1
+	gcmChunkSize      = 64 * 1024
+)
+
+var (
+	gcmFinalChunk = []byte{1}
+	gcmMoreChunks = []byte{0}
+)
+
+// KeyLookup returns the encryption key with the given version.
+type KeyLookup func(version uint32) ([]byte, error)
+
+// staticKey returns a KeyLookup that always returns key, for callers that
+// only ever deal with a single key.
+func staticKey(key []byte) KeyLookup {
+	return func(uint32) ([]byte, error) { return key, nil }
+}
+
+// encryptedSize returns the number of bytes plaintextSize bytes take up
+// once encrypted in the given mode and cipher suite.
+func encryptedSize(mode, suite string, plaintextSize int64) int64 {
+	if mode == EncryptionModeCTR {
+		return plaintextSize + aes.BlockSize
+	}
+	chunks := (plaintextSize + gcmChunkSize - 1) / gcmChunkSize
+	if chunks == 0 {
+		chunks = 1
+	}
+	return int64(suiteHeaderLen(suite)) + plaintextSize + chunks*int64(suiteOverhead(suite))
+}
+
+// suiteHeaderLen returns the length of the header written for data sealed
+// with the given cipher suite.
+func suiteHeaderLen(suite string) int {
+	if suite == CipherSuiteAESGCM || suite == "" {
+		return gcmHeaderLen
+	}
+	return gcmHeaderLenV3
+}
+
+// copyEncryptMode encrypts src into dst using the given mode and, for the
+// chunked format, cipher suite. The key version is recorded in formats that
+// support it.
+func copyEncryptMode(mode, suite string, keyVersion uint32, key []byte, src io.Reader, dst io.Writer) (int64, error) {
+	switch mode {
+	case EncryptionModeCTR:
+		n, err := copyEncrypt(key, src, dst)
+		return int64(n), err
+	case EncryptionModeGCM, "":
+		return copyEncryptSuite(suite, key, keyVersion, src, dst)
+	default:
+		return 0, errors.NewEncryptionError(fmt.Sprintf("unknown encryption mode: %s", mode))
+	}
+}
+
+// copyDecryptAuto decrypts src into dst, detecting the format from the data
+// so objects written in the older formats stay readable. The key is looked
+// up by the version recorded in the data; formats without one use version 0.
+// Data sealed with a cipher suite outside suites is refused.
+func copyDecryptAuto(keys KeyLookup, suites suiteSet, src io.Reader, dst io.Writer) (int64, error) {
+	magic := make([]byte, len(gcmMagic))
+	n, err := io.ReadFull(src, magic)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return 0, errors.Wrap(err, errors.CorruptionError, "failed to read encrypted data header")
+	}
+
+	if n == len(gcmMagic) && isGCMMagic(string(magic)) {
+		return copyDecryptGCM(keys, suites, string(magic), src, dst)
+	}
+
+	key, err := keys(0)
+	if err != nil {
+		return 0, err
+	}
+	nw, err := copyDecrypt(key, io.MultiReader(bytes.NewReader(magic[:n]), src), dst)
+	return int64(nw), err
+}
+
+func isGCMMagic(magic string) bool {
+	return magic == gcmMagic || magic == gcmMagicV1 || magic == gcmMagicV3
+}
+
+// gcmHeader is the parsed header of data in the chunked format.
+type gcmHeader struct {
+	suite      string
+	keyVersion uint32
+	chunkSize  int
+	prefix     []byte
+	len        int
+}
+
+// gcmHeaderSize returns the length of the header that starts with magic.
+func gcmHeaderSize(magic string) int {
+	switch magic {
+	case gcmMagicV1:
+		return gcmHeaderLen - 4
+	case gcmMagicV3:
+		return gcmHeaderLenV3
+	default:
+		return gcmHeaderLen
+	}
+}
+
+// parseGCMHeader parses a complete header, magic included.
+func parseGCMHeader(header []byte) (gcmHeader, error) {
+	magic := string(header[:len(gcmMagic)])
+	h := gcmHeader{suite: CipherSuiteAESGCM, len: gcmHeaderSize(magic)}
+	if len(header) < h.len {
+		return h, errors.NewCorruptionError("truncated encrypted data header")
+	}
+
+	rest := header[len(gcmMagic):h.len]
+	switch magic {
+	case gcmMagicV3:
+		suite, err := cipherSuiteByID(rest[0])
+		if err != nil {
+			return h, err
+		}
+		h.suite = suite
+		rest = rest[1:]
+		fallthrough
+	case gcmMagic:
+		h.keyVersion = binary.BigEndian.Uint32(rest)
+		rest = rest[4:]
+	case gcmMagicV1:
+	default:
+		return h, errors.NewEncryptionError("data is not in the chunked encryption format")
+	}
+
+	h.chunkSize = int(binary.BigEndian.Uint32(rest))
+	if h.chunkSize <= 0 || h.chunkSize > 64*1024*1024 {
+		return h, errors.NewCorruptionError(fmt.Sprintf("invalid encrypted chunk size: %d", h.chunkSize))
+	}
+	h.prefix = append([]byte{}, rest[4:4+gcmNoncePrefixLen]...)
+	return h, nil
+}
+
+// encryptedKeyVersion returns the key version recorded in the header of
+// encrypted data, or 0 for formats that do not record one.
+func encryptedKeyVersion(r io.Reader) (uint32, error) {
+	header := make([]byte, gcmHeaderLenV3)
+	n, err := io.ReadFull(r, header)
+	if n < len(gcmMagic) {
+		return 0, errors.Wrap(err, errors.CorruptionError, "failed to read encrypted data header")
+	}
+	magic := string(header[:len(gcmMagic)])
+	if magic != gcmMagic && magic != gcmMagicV3 {
+		return 0, nil
+	}
+	h, err := parseGCMHeader(header[:n])
+	if err != nil {
+		return 0, err
+	}
+	return h.keyVersion, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, errors.EncryptionError, "invalid encryption key")
+	}
+	return cipher.NewGCM(block)
+}
+
+func gcmNonce(prefix []byte, index uint32) []byte {
+	nonce := make([]byte, len(prefix)+4)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[len(prefix):], index)
+	return nonce
+}
+
+// copyEncryptGCM writes the AES-GCM header and the sealed chunks of src to
+// dst and returns the number of bytes written.
+func copyEncryptGCM(key []byte, keyVersion uint32, src io.Reader, dst io.Writer) (int64, error) {
+	return copyEncryptSuite(CipherSuiteAESGCM, key, keyVersion, src, dst)
+}
+
+// copyEncryptSuite writes the header and the chunks of src sealed with the
+// given cipher suite to dst and returns the number of bytes written.
+func copyEncryptSuite(suite string, key []byte, keyVersion uint32, src io.Reader, dst io.Writer) (int64, error) {
+	aead, err := newSuiteAEAD(suite, key)
+	if err != nil {
+		return 0, err
+	}
+
+	header := make([]byte, suiteHeaderLen(suite))
+	fields := header[len(gcmMagic):]
+	if len(header) == gcmHeaderLen {
+		copy(header, gcmMagic)
+	} else {
+		copy(header, gcmMagicV3)
+		fields[0] = cipherSuiteIDs[suite]
+		fields = fields[1:]
+	}
+	binary.BigEndian.PutUint32(fields, keyVersion)
+	binary.BigEndian.PutUint32(fields[4:], gcmChunkSize)
+	prefix := fields[8:]
+	if _, err := io.ReadFull(rand.Reader, prefix); err != nil {
+		return 0, errors.Wrap(err, errors.EncryptionError, "failed to generate nonce")
+	}
+
+	nw, err := dst.Write(header)
+	if err != nil {
+		return 0, err
+	}
+	total := int64(nw)
+
+	var (
+		br  = bufio.NewReader(src)
+		buf = make([]byte, gcmChunkSize, gcmChunkSize+aead.Overhead())
+	)
+	for index := uint32(0); ; index++ {
+		n, err := io.ReadFull(br, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return total, err
+		}
+
+		final := n < gcmChunkSize
+		if !final {
+			if _, err := br.Peek(1); err == io.EOF {
+				final = true
+			}
+		}
+
+		ad := gcmMoreChunks
+		if final {
+			ad = gcmFinalChunk
+		}
+
+		sealed := aead.Seal(buf[:0], gcmNonce(prefix, index), buf[:n], ad)
+		nw, err := dst.Write(sealed)
+		total += int64(nw)
+		if err != nil {
+			return total, err
+		}
+
+		if final {
+			return total, nil
+		}
+	}
+}
+
+// copyDecryptGCM reads a GCM stream whose magic has already been consumed
+// and writes the plaintext to dst. Authentication failures are reported as
+// corruption errors, and streams sealed with a suite outside suites are
+// refused.
+func copyDecryptGCM(keys KeyLookup, suites suiteSet, magic string, src io.Reader, dst io.Writer) (int64, error) {
+	header := make([]byte, gcmHeaderSize(magic))
+	copy(header, magic)
+	if _, err := io.ReadFull(src, header[len(magic):]); err != nil {
+		return 0, errors.Wrap(err, errors.CorruptionError, "truncated encrypted data header")
+	}
+	h, err := parseGCMHeader(header)
+	if err != nil {
+		return 0, err
+	}
+	if err := suites.check(h.suite); err != nil {
+		return 0, err
+	}
+
+	key, err := keys(h.keyVersion)
+	if err != nil {
+		return 0, err
+	}
+	aead, err := newSuiteAEAD(h.suite, key)
+	if err != nil {
+		return 0, err
+	}
+	chunkSize, prefix := h.chunkSize, h.prefix
+
+	var (
+		br    = bufio.NewReader(src)
+		buf   = make([]byte, chunkSize+aead.Overhead())
+		total int64
+	)
+	for index := uint32(0); ; index++ {
+		n, err := io.ReadFull(br, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return total, err
+		}
+
+		final := n < len(buf)
+		if !final {
+			if _, err := br.Peek(1); err == io.EOF {
+				final = true
+			}
+		}
+
+		ad := gcmMoreChunks
+		if final {
+			ad = gcmFinalChunk
+		}
+
+		plaintext, err := aead.Open(buf[:0], gcmNonce(prefix, index), buf[:n], ad)
+		if err != nil {
+			return total, errors.Wrap(err, errors.CorruptionError, "encrypted data failed authentication").
+				WithContext("chunk", index)
+		}
+
+		nw, err := dst.Write(plaintext)
+		total += int64(nw)
+		if err != nil {
+			return total, err
+		}
+
+		if final {
+			return total, nil
+		}
+	}
+}
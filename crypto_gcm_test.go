@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+
+	"github.com/anthdm/foreverstore/errors"
+)
+
+func TestCopyEncryptDecryptGCM(t *testing.T) {
+	key := newEncryptionKey()
+
+	for _, size := range []int{0, 1, gcmChunkSize - 1, gcmChunkSize, gcmChunkSize + 1, 3*gcmChunkSize + 17} {
+		payload := make([]byte, size)
+		io.ReadFull(rand.Reader, payload)
+
+		encrypted := new(bytes.Buffer)
+		n, err := copyEncryptMode(EncryptionModeGCM, CipherSuiteAESGCM, 0, key, bytes.NewReader(payload), encrypted)
+		if err != nil {
+			t.Fatalf("size %d: encrypt failed: %v", size, err)
+		}
+		if n != int64(encrypted.Len()) || n != encryptedSize(EncryptionModeGCM, CipherSuiteAESGCM, int64(size)) {
+			t.Errorf("size %d: wrote %d bytes, buffer has %d, expected %d",
+				size, n, encrypted.Len(), encryptedSize(EncryptionModeGCM, CipherSuiteAESGCM, int64(size)))
+		}
+
+		out := new(bytes.Buffer)
+		if _, err := copyDecryptAuto(staticKey(key), suitesOf(CipherSuiteAESGCM), encrypted, out); err != nil {
+			t.Fatalf("size %d: decrypt failed: %v", size, err)
+		}
+		if !bytes.Equal(out.Bytes(), payload) {
+			t.Errorf("size %d: decrypted payload does not match", size)
+		}
+	}
+}
+
+func TestCopyDecryptGCMDetectsTampering(t *testing.T) {
+	key := newEncryptionKey()
+	payload := bytes.Repeat([]byte("tamper proof "), 10000)
+
+	encrypted := new(bytes.Buffer)
+	if _, err := copyEncryptGCM(key, 0, bytes.NewReader(payload), encrypted); err != nil {
+		t.Fatal(err)
+	}
+	data := encrypted.Bytes()
+
+	flipped := append([]byte{}, data...)
+	flipped[len(flipped)/2] ^= 0xff
+	_, err := copyDecryptAuto(staticKey(key), suitesOf(CipherSuiteAESGCM), bytes.NewReader(flipped), io.Discard)
+	if !errors.IsType(err, errors.CorruptionError) {
+		t.Errorf("expected corruption error for modified data, got %v", err)
+	}
+
+	// Dropping the final chunk must not go unnoticed either
+	truncated := data[:gcmHeaderLen+gcmChunkSize+16]
+	_, err = copyDecryptAuto(staticKey(key), suitesOf(CipherSuiteAESGCM), bytes.NewReader(truncated), io.Discard)
+	if !errors.IsType(err, errors.CorruptionError) {
+		t.Errorf("expected corruption error for truncated data, got %v", err)
+	}
+}
+
+func TestCopyDecryptAutoReadsCTR(t *testing.T) {
+	key := newEncryptionKey()
+	payload := []byte("written by an older node")
+
+	encrypted := new(bytes.Buffer)
+	if _, err := copyEncryptMode(EncryptionModeCTR, "", 0, key, bytes.NewReader(payload), encrypted); err != nil {
+		t.Fatal(err)
+	}
+	if int64(encrypted.Len()) != encryptedSize(EncryptionModeCTR, "", int64(len(payload))) {
+		t.Errorf("unexpected CTR size %d", encrypted.Len())
+	}
+
+	out := new(bytes.Buffer)
+	if _, err := copyDecryptAuto(staticKey(key), suitesOf(CipherSuiteAESGCM), encrypted, out); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != string(payload) {
+		t.Errorf("want %s have %s", payload, out.String())
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"crypto/cipher"
+	"io"
+
+	"github.com/anthdm/foreverstore/errors"
+)
+
+// gcmObject gives random access to the plaintext of a GCM encrypted object.
+// Only the chunks overlapping a read are fetched and authenticated, so range
+// reads on large encrypted objects don't have to decrypt from the start.
+type gcmObject struct {
+	r         io.ReaderAt
+	aead      cipher.AEAD
+	prefix    []byte
+	headerLen int64
+	chunkSize int64
+	numChunks int64
+	size      int64
+}
+
+// openGCMObject parses the header of the GCM encrypted object in r, which
+// holds size bytes of ciphertext sealed with one of suites.
+func openGCMObject(keys KeyLookup, suites suiteSet, r io.ReaderAt, size int64) (*gcmObject, error) {
+	header := make([]byte, gcmHeaderLenV3)
+	n, err := r.ReadAt(header, 0)
+	if n < len(gcmMagic) {
+		return nil, errors.Wrap(err, errors.CorruptionError, "truncated encrypted data header")
+	}
+	if !isGCMMagic(string(header[:len(gcmMagic)])) {
+		return nil, errors.NewEncryptionError("object is not in a seekable encryption format")
+	}
+	h, err := parseGCMHeader(header[:n])
+	if err != nil {
+		return nil, err
+	}
+	if err := suites.check(h.suite); err != nil {
+		return nil, err
+	}
+
+	key, err := keys(h.keyVersion)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newSuiteAEAD(h.suite, key)
+	if err != nil {
+		return nil, err
+	}
+
+	o := &gcmObject{
+		r:         r,
+		aead:      aead,
+		prefix:    h.prefix,
+		headerLen: int64(h.len),
+		chunkSize: int64(h.chunkSize),
+	}
+
+	sealedChunk := o.chunkSize + int64(aead.Overhead())
+	payload := size - o.headerLen
+	if payload < 0 {
+		return nil, errors.NewCorruptionError("encrypted object is truncated")
+	}
+	o.numChunks = (payload + sealedChunk - 1) / sealedChunk
+	if o.numChunks == 0 {
+		// An empty object is a single empty chunk.
+		o.numChunks = 1
+	}
+	lastSealed := payload - (o.numChunks-1)*sealedChunk
+	if lastSealed < int64(aead.Overhead()) {
+		return nil, errors.NewCorruptionError("encrypted object is truncated")
+	}
+	o.size = (o.numChunks-1)*o.chunkSize + lastSealed - int64(aead.Overhead())
+
+	return o, nil
+}
+
+// Size returns the plaintext size of the object.
+func (o *gcmObject) Size() int64 {
+	return o.size
+}
+
+// ReadAt implements io.ReaderAt over the plaintext.
+func (o *gcmObject) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.NewInvalidInputError("negative offset")
+	}
+	if off >= o.size {
+		return 0, io.EOF
+	}
+
+	var (
+		read   int
+		sealed = make([]byte, o.chunkSize+int64(o.aead.Overhead()))
+	)
+	for read < len(p) && off < o.size {
+		index := off / o.chunkSize
+		plaintext, err := o.chunk(index, sealed)
+		if err != nil {
+			return read, err
+		}
+
+		n := copy(p[read:], plaintext[off-index*o.chunkSize:])
+		read += n
+		off += int64(n)
+	}
+
+	if read < len(p) {
+		return read, io.EOF
+	}
+	return read, nil
+}
+
+// chunk reads and authenticates the chunk with the given index, using buf
+// as scratch space.
+func (o *gcmObject) chunk(index int64, buf []byte) ([]byte, error) {
+	sealedChunk := o.chunkSize + int64(o.aead.Overhead())
+	n, err := o.r.ReadAt(buf, o.headerLen+index*sealedChunk)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	ad := gcmMoreChunks
+	if index == o.numChunks-1 {
+		ad = gcmFinalChunk
+	}
+
+	plaintext, err := o.aead.Open(buf[:0], gcmNonce(o.prefix, uint32(index)), buf[:n], ad)
+	if err != nil {
+		return nil, errors.Wrap(err, errors.CorruptionError, "encrypted data failed authentication").
+			WithContext("chunk", index)
+	}
+	return plaintext, nil
+}
+
+// gcmResumeOffset returns the offset into a ciphertext stream sealed with
+// the given cipher suite from which a transfer that has already delivered
+// received bytes can be resumed. Only complete chunks are kept, a partially
+// received chunk is sent again.
+func gcmResumeOffset(suite string, received int64) int64 {
+	headerLen := int64(suiteHeaderLen(suite))
+	if received <= headerLen {
+		return 0
+	}
+	sealedChunk := int64(gcmChunkSize + suiteOverhead(suite))
+	return headerLen + (received-headerLen)/sealedChunk*sealedChunk
+}
+
+// gcmSpan returns where the sealed chunks covering length bytes of
+// plaintext from offset lie in an object of size bytes in the chunked
+// format, whose header is h: from start up to end.
+func gcmSpan(h gcmHeader, size, offset, length int64) (start, end int64) {
+	if length > size {
+		// The plaintext is never larger than the object.
+		length = size
+	}
+	chunkSize := int64(h.chunkSize)
+	sealedChunk := chunkSize + int64(suiteOverhead(h.suite))
+	start = int64(h.len) + offset/chunkSize*sealedChunk
+	end = int64(h.len) + (offset+length+chunkSize-1)/chunkSize*sealedChunk
+	if end > size {
+		end = size
+	}
+	if start > end {
+		start = end
+	}
+	return start, end
+}
+
+// gcmSpanReader is an object in the chunked format of which only the
+// header and the sealed chunks from start on were fetched, read at their
+// offsets in the object.
+type gcmSpanReader struct {
+	header []byte
+	start  int64
+	chunks []byte
+}
+
+func (r gcmSpanReader) ReadAt(p []byte, off int64) (int, error) {
+	var src []byte
+	switch {
+	case off >= 0 && off < int64(len(r.header)):
+		src = r.header[off:]
+	case off >= r.start && off <= r.start+int64(len(r.chunks)):
+		src = r.chunks[off-r.start:]
+	default:
+		return 0, errors.NewInternalError("read outside the fetched chunks").WithContext("offset", off)
+	}
+	n := copy(p, src)
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+
+	"github.com/anthdm/foreverstore/errors"
+)
+
+func TestGCMObjectReadAt(t *testing.T) {
+	key := newEncryptionKey()
+	payload := make([]byte, 3*gcmChunkSize+100)
+	io.ReadFull(rand.Reader, payload)
+
+	encrypted := new(bytes.Buffer)
+	if _, err := copyEncryptGCM(key, 0, bytes.NewReader(payload), encrypted); err != nil {
+		t.Fatal(err)
+	}
+
+	obj, err := openGCMObject(staticKey(key), suitesOf(CipherSuiteAESGCM), bytes.NewReader(encrypted.Bytes()), int64(encrypted.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obj.Size() != int64(len(payload)) {
+		t.Fatalf("want size %d have %d", len(payload), obj.Size())
+	}
+
+	ranges := [][2]int64{
+		{0, 10},
+		{gcmChunkSize - 5, 10},
+		{2*gcmChunkSize + 1, gcmChunkSize + 99},
+		{int64(len(payload)) - 1, 1},
+	}
+	for _, rg := range ranges {
+		b, err := io.ReadAll(io.NewSectionReader(obj, rg[0], rg[1]))
+		if err != nil {
+			t.Fatalf("range %v: %v", rg, err)
+		}
+		if !bytes.Equal(b, payload[rg[0]:rg[0]+rg[1]]) {
+			t.Errorf("range %v: plaintext does not match", rg)
+		}
+	}
+
+	// Reads past the end stop at the plaintext size
+	buf := make([]byte, 10)
+	n, err := obj.ReadAt(buf, int64(len(payload))-4)
+	if n != 4 || err != io.EOF {
+		t.Errorf("want 4 bytes and EOF, have %d and %v", n, err)
+	}
+}
+
+func TestGCMObjectDetectsTampering(t *testing.T) {
+	key := newEncryptionKey()
+	payload := bytes.Repeat([]byte("a"), 2*gcmChunkSize)
+
+	encrypted := new(bytes.Buffer)
+	copyEncryptGCM(key, 0, bytes.NewReader(payload), encrypted)
+	data := encrypted.Bytes()
+	data[gcmHeaderLen+gcmChunkSize+20] ^= 1
+
+	obj, err := openGCMObject(staticKey(key), suitesOf(CipherSuiteAESGCM), bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first chunk is intact, the second one is not
+	if _, err := obj.ReadAt(make([]byte, 10), 0); err != nil {
+		t.Errorf("unexpected error reading intact chunk: %v", err)
+	}
+	_, err = obj.ReadAt(make([]byte, 10), gcmChunkSize+10)
+	if !errors.IsType(err, errors.CorruptionError) {
+		t.Errorf("expected corruption error, got %v", err)
+	}
+}
+
+func TestGCMResumeOffset(t *testing.T) {
+	sealed := int64(gcmChunkSize + 16)
+	if off := gcmResumeOffset(CipherSuiteAESGCM, 5); off != 0 {
+		t.Errorf("want 0 have %d", off)
+	}
+	if off := gcmResumeOffset(CipherSuiteAESGCM, int64(gcmHeaderLen)+sealed+100); off != int64(gcmHeaderLen)+sealed {
+		t.Errorf("want %d have %d", int64(gcmHeaderLen)+sealed, off)
+	}
+}
+
+func TestGCMSpanDecryptsARange(t *testing.T) {
+	key := newEncryptionKey()
+	payload := bytes.Repeat([]byte("0123456789"), 20000)
+
+	encrypted := new(bytes.Buffer)
+	copyEncryptGCM(key, 0, bytes.NewReader(payload), encrypted)
+	data := encrypted.Bytes()
+
+	header, start, end, err := replicaSpan(bytes.NewReader(data), int64(len(data)), 150000, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if end-start != int64(gcmChunkSize+16) {
+		t.Errorf("span of %d bytes, want a single chunk", end-start)
+	}
+
+	span := gcmSpanReader{header: header, start: start, chunks: data[start:end]}
+	obj, err := openGCMObject(staticKey(key), suitesOf(CipherSuiteAESGCM), span, int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 1000)
+	if _, err := obj.ReadAt(b, 150000); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, payload[150000:151000]) {
+		t.Error("range does not match")
+	}
+	if _, err := obj.ReadAt(b, 0); err == nil {
+		t.Error("expected reading outside the span to fail")
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+
+	"github.com/anthdm/foreverstore/errors"
+)
+
+// A store of the content an object holds already, as sync tools re-pushing
+// unchanged files do, is not written nor replicated again: the object only
+// has its store time moved on, as a store would, and the store reports it
+// deduplicated. The content is compared by integrity tag, which is keyed,
+// so only the content stored with the current key version is recognized.
+
+// unchanged reports whether storing the content whose integrity tag is
+// mac, with client metadata client and lock, leaves the object of this node
+// stored under key, of metadata previous, as it is.
+func (s *FileServer) unchanged(key string, previous ObjectMeta, mac []byte, keyVersion uint32, client *ClientMeta, lock *ObjectLock) bool {
+	if len(previous.HMAC) == 0 || previous.KeyVersion != keyVersion || !bytes.Equal(previous.HMAC, mac) {
+		return false
+	}
+	if !reflect.DeepEqual(previous.Client, client) || !reflect.DeepEqual(previous.Lock, lock) {
+		return false
+	}
+	// An object offloaded to the cold tier is brought back by a store.
+	return previous.Cold == nil && s.store.Has(s.ID, key)
+}
+
+// touchObject moves the store time of the object of this node stored
+// under key, of metadata previous, on to now, as storing it again would.
+func (s *FileServer) touchObject(key string, previous ObjectMeta) (ObjectMeta, error) {
+	meta := previous
+	meta.StoredAt = s.Clock.Now()
+	meta.Writes = recentWrites(previous.Writes, meta.StoredAt)
+	if err := s.store.WriteMeta(s.ID, key, meta); err != nil {
+		return ObjectMeta{}, errors.Wrap(err, errors.StorageError, "failed to write file metadata")
+	}
+	s.logger.Info("File unchanged, not stored again: %s", key)
+	return meta, nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStoringUnchangedContentIsDeduplicated(t *testing.T) {
+	c := newTestCluster(t, 2)
+	s := c.nodes[0]
+	store := func(data []byte, client *ClientMeta) StoreResult {
+		t.Helper()
+		var res StoreResult
+		assert.Nil(t, c.run("store", func() (err error) {
+			res, err = s.StoreObjectOnce("doc", "", bytes.NewReader(data), client, nil, nil)
+			return err
+		}))
+		return res
+	}
+	replicated := func() int {
+		stats := s.ReplicationStats()
+		if len(stats) != 1 {
+			return 0
+		}
+		return stats[0].Replicated
+	}
+
+	first := store([]byte("unchanged"), nil)
+	assert.False(t, first.Deduplicated)
+	c.assertConverged(0, "doc")
+	stored, err := s.Meta("doc")
+	assert.Nil(t, err)
+
+	// The same content is neither written nor replicated again, its store
+	// time moved on.
+	c.clock.Advance(time.Minute)
+	again := store([]byte("unchanged"), nil)
+	assert.True(t, again.Deduplicated)
+	assert.Equal(t, first.ETag, again.ETag)
+	assert.Equal(t, 1, replicated())
+	meta, err := s.Meta("doc")
+	assert.Nil(t, err)
+	assert.False(t, meta.StoredAt.Before(stored.StoredAt.Add(time.Minute)))
+	assert.Equal(t, stored.CreatedAt, meta.CreatedAt)
+
+	// Other content, or other client metadata, is stored.
+	assert.False(t, store([]byte("changed"), nil).Deduplicated)
+	assert.False(t, store([]byte("changed"), &ClientMeta{ContentType: "application/json"}).Deduplicated)
+	assert.Equal(t, 3, replicated())
+	c.assertConverged(0, "doc")
+	assert.Equal(t, []byte("changed"), c.get(0, "doc"))
+}
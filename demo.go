@@ -2,56 +2,99 @@ package main
 
 import (
 	"bytes"
+	"flag"
 	"fmt"
 	"io"
 	"net"
 	"os"
+	"path/filepath"
 	"time"
 
+	"github.com/anthdm/foreverstore/config"
 	"github.com/anthdm/foreverstore/logger"
-	"github.com/anthdm/foreverstore/p2p"
 )
 
-// Demo script to showcase the distributed file storage system
-func main() {
+// demoConnectTimeout bounds the wait for the demo nodes to connect.
+const demoConnectTimeout = 10 * time.Second
+
+// runDemoCommand implements "fs demo": it starts a cluster of three nodes
+// in the process and showcases the distributed file storage system. It
+// returns the process exit code.
+func runDemoCommand(args []string) int {
+	flags := flag.NewFlagSet("demo", flag.ExitOnError)
+	dir := flags.String("dir", os.TempDir(), "directory the nodes store their files under")
+	linger := flags.Duration("linger", 5*time.Second, "how long the cluster runs once the files were retrieved")
+	flags.Parse(args)
+
 	logger.SetGlobalLevel(logger.INFO)
-	
+	if err := runDemoCluster(*dir, *linger); err != nil {
+		fmt.Printf("❌ Demo failed: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// runDemoCluster runs the demo with the nodes storing their files under dir, and
+// keeps the cluster running for linger before stopping it.
+func runDemoCluster(dir string, linger time.Duration) error {
 	fmt.Println("🚀 Distributed File Storage System Demo")
 	fmt.Println("=====================================")
 	
+	dirs := []string{
+		filepath.Join(dir, "demo_node1"),
+		filepath.Join(dir, "demo_node2"),
+		filepath.Join(dir, "demo_node3"),
+	}
 	// Clean up any existing demo directories
-	os.RemoveAll("/tmp/demo_node1")
-	os.RemoveAll("/tmp/demo_node2")
-	os.RemoveAll("/tmp/demo_node3")
+	for _, d := range dirs {
+		os.RemoveAll(d)
+	}
+	defer func() {
+		for _, d := range dirs {
+			os.RemoveAll(d)
+		}
+	}()
 	
-	// Create three nodes
-	node1 := createDemoNode(":8001", "/tmp/demo_node1", []string{})
-	node2 := createDemoNode(":8002", "/tmp/demo_node2", []string{":8001"})
-	node3 := createDemoNode(":8003", "/tmp/demo_node3", []string{":8001", ":8002"})
+	// Create three nodes, sharing the cluster's encryption key. Each
+	// bootstraps from those created before it.
+	key := newEncryptionKey()
+	var (
+		nodes []*FileServer
+		addrs []string
+	)
+	for i, d := range dirs {
+		server, err := createDemoNode(fmt.Sprintf(":%d", 8001+i), d, append([]string{}, addrs...), key)
+		if err != nil {
+			return fmt.Errorf("failed to create node %d: %v", i+1, err)
+		}
+		nodes = append(nodes, server)
+		addrs = append(addrs, server.Transport.Addr())
+	}
+	defer func() {
+		for _, node := range nodes {
+			node.Stop()
+		}
+	}()
 	
 	fmt.Println("\n📡 Starting nodes...")
 	
 	// Start nodes
-	go func() {
-		if err := node1.Start(); err != nil {
-			fmt.Printf("Node 1 error: %v\n", err)
+	for i, node := range nodes {
+		if err := node.Start(); err != nil {
+			return fmt.Errorf("node %d failed to start: %v", i+1, err)
 		}
-	}()
-	time.Sleep(200 * time.Millisecond)
-	
-	go func() {
-		if err := node2.Start(); err != nil {
-			fmt.Printf("Node 2 error: %v\n", err)
-		}
-	}()
-	time.Sleep(200 * time.Millisecond)
+	}
 	
-	go func() {
-		if err := node3.Start(); err != nil {
-			fmt.Printf("Node 3 error: %v\n", err)
+	// Wait for the handshakes with the bootstrap nodes to complete
+	deadline := time.Now().Add(demoConnectTimeout)
+	for i, node := range nodes {
+		for len(node.Peers()) < len(nodes)-1 {
+			if time.Now().After(deadline) {
+				return fmt.Errorf("node %d connected to %d of %d peers", i+1, len(node.Peers()), len(nodes)-1)
+			}
+			time.Sleep(10 * time.Millisecond)
 		}
-	}()
-	time.Sleep(500 * time.Millisecond)
+	}
 	
 	fmt.Println("✅ All nodes started and connected")
 	
@@ -67,8 +110,8 @@ func main() {
 		"document.pdf":   bytes.Repeat([]byte("PDF_CONTENT"), 200), // Simulate PDF data
 	}
 	
-	nodes := []*FileServer{node1, node2, node3}
-	
+	failed := 0
+	storedOn := make(map[string]int)
 	i := 0
 	for filename, content := range files {
 		node := nodes[i%len(nodes)]
@@ -79,32 +122,51 @@ func main() {
 		err := node.Store(filename, bytes.NewReader(content))
 		if err != nil {
 			fmt.Printf("    ❌ Error storing %s: %v\n", filename, err)
+			failed++
 		} else {
 			fmt.Printf("    ✅ Stored successfully\n")
+			storedOn[filename] = i % len(nodes)
 		}
 		
 		time.Sleep(100 * time.Millisecond) // Allow replication time
 		i++
 	}
 	
-	fmt.Println("\n📥 Retrieving files from different nodes...")
+	fmt.Println("\n📥 Retrieving files from the network...")
 	
-	// Retrieve files from different nodes to demonstrate distribution
-	for i, filename := range []string{"readme.txt", "config.json", "data.csv", "image.jpg", "document.pdf"} {
-		node := nodes[(i+1)%len(nodes)] // Get from different node than stored
-		nodeNum := ((i + 1) % len(nodes)) + 1
+	// Each node drops its local copy of the files it stored, and gets them
+	// back from the replicas on its peers
+	for _, filename := range []string{"readme.txt", "config.json", "data.csv", "image.jpg", "document.pdf"} {
+		n, ok := storedOn[filename]
+		if !ok {
+			continue
+		}
+		node := nodes[n]
 		
-		fmt.Printf("  📥 Retrieving '%s' from Node %d\n", filename, nodeNum)
+		fmt.Printf("  📥 Node %d retrieving '%s' from its peers\n", n+1, filename)
+		if err := node.store.Delete(node.ID, filename); err != nil {
+			fmt.Printf("    ❌ Error dropping the local copy of %s: %v\n", filename, err)
+			failed++
+			continue
+		}
 		
 		reader, err := node.Get(filename)
 		if err != nil {
 			fmt.Printf("    ❌ Error retrieving %s: %v\n", filename, err)
+			failed++
 			continue
 		}
 		
 		data, err := io.ReadAll(reader)
+		if c, ok := reader.(io.Closer); ok {
+			c.Close()
+		}
+		if err == nil && !bytes.Equal(data, files[filename]) {
+			err = fmt.Errorf("content differs from what was stored")
+		}
 		if err != nil {
 			fmt.Printf("    ❌ Error reading %s: %v\n", filename, err)
+			failed++
 			continue
 		}
 		
@@ -132,30 +194,30 @@ func main() {
 	fmt.Println("  ✅ Structured logging")
 	fmt.Println("  ✅ Error handling and retry logic")
 	
-	fmt.Println("\n⏳ Demo running for 5 more seconds...")
-	time.Sleep(5 * time.Second)
+	if linger > 0 {
+		fmt.Printf("\n⏳ Demo running for %s more...\n", linger)
+		time.Sleep(linger)
+	}
 	
 	// Cleanup
 	fmt.Println("\n🧹 Cleaning up...")
-	node1.Stop()
-	node2.Stop()
-	node3.Stop()
-	
-	time.Sleep(200 * time.Millisecond)
-	
-	// Clean up demo directories
-	os.RemoveAll("/tmp/demo_node1")
-	os.RemoveAll("/tmp/demo_node2")
-	os.RemoveAll("/tmp/demo_node3")
+	for _, node := range nodes {
+		node.Stop()
+		node.Wait()
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d file operations failed", failed)
+	}
 	
 	fmt.Println("✅ Demo completed successfully!")
 	fmt.Println("\n🎯 Next Steps:")
 	fmt.Println("  • Use the CLI tool: go run cmd/cli/main.go")
 	fmt.Println("  • Check the comprehensive test suite: go test ./...")
 	fmt.Println("  • Review the improvement checklist in checklist.md")
+	return nil
 }
 
-func createDemoNode(addr, storageDir string, bootstrapNodes []string) *FileServer {
+func createDemoNode(addr, storageDir string, bootstrapNodes []string, key []byte) (*FileServer, error) {
 	// Ensure the address is available
 	listener, err := net.Listen("tcp", addr)
 	if err != nil {
@@ -165,23 +227,12 @@ func createDemoNode(addr, storageDir string, bootstrapNodes []string) *FileServe
 	}
 	listener.Close()
 	
-	tcpTransportOpts := p2p.TCPTransportOpts{
-		ListenAddr:    addr,
-		HandshakeFunc: p2p.NOPHandshakeFunc,
-		Decoder:       p2p.DefaultDecoder{},
-	}
-	tcpTransport := p2p.NewTCPTransport(tcpTransportOpts)
-
-	fileServerOpts := FileServerOpts{
-		EncKey:            newEncryptionKey(),
-		StorageRoot:       storageDir,
-		PathTransformFunc: CASPathTransformFunc,
-		Transport:         tcpTransport,
-		BootstrapNodes:    bootstrapNodes,
-	}
-
-	server := NewFileServer(fileServerOpts)
-	tcpTransport.OnPeer = server.OnPeer
+	cfg := config.DefaultConfig()
+	cfg.ListenAddr = addr
+	cfg.StorageRoot = storageDir
+	cfg.BootstrapNodes = bootstrapNodes
+	// Nodes only accept peers that prove they know the cluster secret.
+	cfg.ClusterSecret = "demo cluster secret"
 
-	return server
+	return New(cfg, WithEncryptionKey(key))
 }
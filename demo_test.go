@@ -0,0 +1,14 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestDemoRuns(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts a cluster over TCP")
+	}
+	if err := runDemoCluster(t.TempDir(), 0); err != nil {
+		t.Fatalf("demo failed: %v", err)
+	}
+}
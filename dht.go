@@ -0,0 +1,443 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/anthdm/foreverstore/dht"
+	"github.com/anthdm/foreverstore/errors"
+)
+
+// A Get asks the peers its object was placed on first. The replicas it does
+// not find there, moved by a rebalance, a repair or a migration, or placed
+// while the node was connected to other peers, are looked up in a
+// distributed hash table (see package dht) rather than asked of every
+// peer. Every node holding a replica announces it, as a provider record, to
+// the dhtRecordCopies nodes closest to the ID of the replica, and again
+// every dhtRepublishInterval while it holds it; records expire after
+// dhtRecordTTL. A lookup finds the records in O(log n) rounds of requests,
+// connecting to the nodes it learns of on the way.
+
+const (
+	// dhtRecordCopies is the number of nodes closest to a replica its
+	// provider records are kept on.
+	dhtRecordCopies = 3
+	// dhtMaxProviders bounds the providers a node records for a replica,
+	// those expiring first making room for new ones.
+	dhtMaxProviders = dht.DefaultBucketSize
+	// dhtQueryTimeout bounds the wait for the nodes asked in a round of a
+	// lookup to answer, connecting to them included.
+	dhtQueryTimeout = 5 * time.Second
+	// dhtRepublishInterval is how often a node announces the replicas it
+	// holds again, and dhtRecordTTL how long a record is kept.
+	dhtRepublishInterval = time.Hour
+	dhtRecordTTL         = 24 * time.Hour
+)
+
+// MessageFindNode asks a peer for the nodes it knows closest to Target,
+// and for the providers it holds records of for it.
+type MessageFindNode struct {
+	Target dht.ID
+}
+
+// MessageFindNodeResult answers a MessageFindNode.
+type MessageFindNodeResult struct {
+	Contacts  []dht.Contact
+	Providers []dht.Contact
+}
+
+// MessageAddProvider asks a peer to record that Provider holds the replica
+// of ID Target.
+type MessageAddProvider struct {
+	Target   dht.ID
+	Provider dht.Contact
+}
+
+// DHTStatus reports the routing table and the provider records of a node.
+type DHTStatus struct {
+	// Contacts counts the nodes of the routing table, and Records the
+	// replicas the node holds provider records of.
+	Contacts int `json:"contacts"`
+	Records  int `json:"records"`
+	// Pending counts the replicas waiting to be announced.
+	Pending int `json:"pending"`
+	// Lookups counts the lookups for the replicas of this node, and Found
+	// those that found providers.
+	Lookups int64 `json:"lookups"`
+	Found   int64 `json:"found"`
+}
+
+// replicaID is the ID, in the space of the DHT, of the replica stored
+// under key in namespace id.
+func replicaID(id, key string) dht.ID {
+	return dht.NewID(id + "/" + key)
+}
+
+// providerRecords holds the providers recorded at this node, by replica.
+type providerRecords struct {
+	mu      sync.Mutex
+	records map[dht.ID]map[string]providerRecord
+}
+
+type providerRecord struct {
+	provider dht.Contact
+	expires  time.Time
+}
+
+// add records that provider holds the replica of ID target until expires.
+func (p *providerRecords) add(target dht.ID, provider dht.Contact, expires time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.records == nil {
+		p.records = make(map[dht.ID]map[string]providerRecord)
+	}
+	providers := p.records[target]
+	if providers == nil {
+		providers = make(map[string]providerRecord)
+		p.records[target] = providers
+	}
+	if _, ok := providers[provider.ID]; !ok && len(providers) >= dhtMaxProviders {
+		first := ""
+		for id, r := range providers {
+			if first == "" || r.expires.Before(providers[first].expires) {
+				first = id
+			}
+		}
+		delete(providers, first)
+	}
+	providers[provider.ID] = providerRecord{provider: provider, expires: expires}
+}
+
+// get returns the providers of the replica of ID target recorded at now.
+func (p *providerRecords) get(target dht.ID, now time.Time) []dht.Contact {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var providers []dht.Contact
+	for _, r := range p.records[target] {
+		if now.Before(r.expires) {
+			providers = append(providers, r.provider)
+		}
+	}
+	return providers
+}
+
+// expire drops the records expired at now.
+func (p *providerRecords) expire(now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for target, providers := range p.records {
+		for id, r := range providers {
+			if !now.Before(r.expires) {
+				delete(providers, id)
+			}
+		}
+		if len(providers) == 0 {
+			delete(p.records, target)
+		}
+	}
+}
+
+func (p *providerRecords) len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.records)
+}
+
+// announceQueue holds the replicas waiting to be announced.
+type announceQueue struct {
+	mu      sync.Mutex
+	pending map[dht.ID]struct{}
+	wakech  chan struct{}
+	// lookups and found count the lookups for replicas of this node.
+	lookups int64
+	found   int64
+}
+
+// DHT returns the status of the routing table and the provider records of
+// the node.
+func (s *FileServer) DHT() DHTStatus {
+	q := &s.announcements
+	q.mu.Lock()
+	st := DHTStatus{Pending: len(q.pending), Lookups: q.lookups, Found: q.found}
+	q.mu.Unlock()
+	st.Contacts = s.routes.Len()
+	st.Records = s.providers.len()
+	return st
+}
+
+// selfContact is the contact of this node.
+func (s *FileServer) selfContact() dht.Contact {
+	return dht.Contact{ID: s.ID, Addr: s.advertiseAddr()}
+}
+
+// announceReplica queues the replica stored under key in namespace id to
+// be announced.
+func (s *FileServer) announceReplica(id, key string) {
+	q := &s.announcements
+	q.mu.Lock()
+	if q.pending == nil {
+		q.pending = make(map[dht.ID]struct{})
+	}
+	q.pending[replicaID(id, key)] = struct{}{}
+	q.mu.Unlock()
+	select {
+	case q.wakech <- struct{}{}:
+	default:
+	}
+}
+
+// dhtLoop announces the replicas queued, and every replica held again
+// every dhtRepublishInterval, until the server stops.
+func (s *FileServer) dhtLoop() {
+	ticker := s.Clock.NewTicker(dhtRepublishInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.announcements.wakech:
+		case <-ticker.C():
+			s.providers.expire(s.Clock.Now())
+			s.queueReplicas()
+		case <-s.quitch:
+			return
+		}
+		s.flushAnnouncements()
+	}
+}
+
+// queueReplicas queues every replica the node holds for its peers to be
+// announced.
+func (s *FileServer) queueReplicas() {
+	namespaces, err := os.ReadDir(s.store.Root)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			s.logger.Warn("Failed to list the replicas to announce: %v", err)
+		}
+		return
+	}
+	for _, ns := range namespaces {
+		if !ns.IsDir() || ns.Name() == s.ID || !validNamespace(ns.Name()) {
+			continue
+		}
+		for cursor := ""; ; {
+			entries, next, err := s.store.Iterate(ns.Name(), "", cursor, migrationPageSize)
+			if err != nil {
+				s.logger.Warn("Failed to list the replicas of %s to announce: %v", ns.Name(), err)
+				break
+			}
+			for _, entry := range entries {
+				if entry.Key != "" {
+					s.announceReplica(ns.Name(), entry.Key)
+				}
+			}
+			if next == "" {
+				break
+			}
+			cursor = next
+		}
+	}
+}
+
+// flushAnnouncements announces the replicas queued.
+func (s *FileServer) flushAnnouncements() {
+	q := &s.announcements
+	q.mu.Lock()
+	pending := q.pending
+	q.pending = nil
+	q.mu.Unlock()
+
+	for target := range pending {
+		select {
+		case <-s.quitch:
+			return
+		default:
+		}
+		s.announce(target)
+	}
+}
+
+// announce records this node as a provider of the replica of ID target at
+// the nodes closest to it, itself included when it is one of them.
+func (s *FileServer) announce(target dht.ID) {
+	res, _ := s.lookup(target, false)
+	self := s.selfContact()
+	expires := s.Clock.Now().Add(dhtRecordTTL)
+	closest := res.Closest
+	if len(closest) > dhtRecordCopies {
+		closest = closest[:dhtRecordCopies]
+	}
+	if len(closest) < dhtRecordCopies || dht.Closer(target, self.Key(), closest[len(closest)-1].Key()) {
+		s.providers.add(target, self, expires)
+	}
+
+	msg := MessageAddProvider{Target: target, Provider: self}
+	for _, c := range closest {
+		addr, ok := s.conns.conn(c.ID, c.Addr)
+		if !ok {
+			continue
+		}
+		peer, ok := s.peer(addr)
+		if !ok {
+			continue
+		}
+		if err := s.sendMessage(peer, &Message{Payload: msg}); err != nil {
+			s.logger.Warn("Failed to announce replica %s to %s: %v", target, addr, err)
+		}
+	}
+}
+
+func (s *FileServer) handleMessageAddProvider(from string, msg MessageAddProvider) error {
+	if msg.Provider.ID == "" || msg.Provider.Addr == "" {
+		return errors.NewInvalidInputError("invalid provider record").WithContext("peer", from)
+	}
+	s.providers.add(msg.Target, msg.Provider, s.Clock.Now().Add(dhtRecordTTL))
+	return nil
+}
+
+// answerFindNode answers a MessageFindNode with the closest contacts of
+// the routing table, and the providers recorded for the target.
+func (s *FileServer) answerFindNode(msg MessageFindNode) MessageFindNodeResult {
+	return MessageFindNodeResult{
+		Contacts:  s.routes.Closest(msg.Target, s.routes.K()),
+		Providers: s.providers.get(msg.Target, s.Clock.Now()),
+	}
+}
+
+// findProviders looks up the nodes holding the replica of the object of
+// this node stored under key, and returns the addresses of the connections
+// to them.
+func (s *FileServer) findProviders(key string) []string {
+	target := replicaID(s.ID, hashKey(key))
+	providers := s.providers.get(target, s.Clock.Now())
+	if len(providers) == 0 {
+		_, providers = s.lookup(target, true)
+	}
+
+	q := &s.announcements
+	q.mu.Lock()
+	q.lookups++
+	if len(providers) > 0 {
+		q.found++
+	}
+	q.mu.Unlock()
+
+	var addrs []string
+	for _, p := range providers {
+		if p.ID == s.ID {
+			continue
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		addr, err := s.reach(ctx, p, s.Clock.After(dhtQueryTimeout))
+		cancel()
+		if err != nil {
+			s.logger.Warn("Failed to reach %s, which holds %s: %v", p.Addr, key, err)
+			continue
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+// lookup runs a lookup for target through the routing table, returning
+// the providers of target heard of when asked for them, which ends the
+// lookup once some are.
+func (s *FileServer) lookup(target dht.ID, findProviders bool) (dht.Result, []dht.Contact) {
+	var providers []dht.Contact
+	seen := make(map[string]bool)
+	res := s.routes.Lookup(target, 0, func(contacts []dht.Contact) map[string]dht.Answer {
+		answers := make(map[string]dht.Answer, len(contacts))
+		for id, result := range s.findNode(contacts, target) {
+			for _, p := range result.Providers {
+				if !seen[p.ID] {
+					seen[p.ID] = true
+					providers = append(providers, p)
+				}
+			}
+			answers[id] = dht.Answer{Closer: result.Contacts, Found: findProviders && len(result.Providers) > 0}
+		}
+		return answers
+	})
+	return res, providers
+}
+
+// findNode sends a MessageFindNode for target to each of contacts,
+// connecting to those the node is not connected to, and returns the
+// answers received within dhtQueryTimeout by node ID.
+func (s *FileServer) findNode(contacts []dht.Contact, target dht.ID) map[string]MessageFindNodeResult {
+	type answer struct {
+		id     string
+		result MessageFindNodeResult
+		err    error
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	deadline := s.Clock.After(dhtQueryTimeout)
+	answers := make(chan answer, len(contacts))
+	for _, c := range contacts {
+		go func(c dht.Contact) {
+			addr, err := s.reach(ctx, c, nil)
+			var result MessageFindNodeResult
+			if err == nil {
+				result, err = requestAs[MessageFindNodeResult](ctx, s, addr, MessageFindNode{Target: target})
+			}
+			answers <- answer{id: c.ID, result: result, err: err}
+		}(c)
+	}
+
+	results := make(map[string]MessageFindNodeResult, len(contacts))
+	for received := 0; received < len(contacts); received++ {
+		select {
+		case a := <-answers:
+			if a.err != nil {
+				s.logger.Debug("Node %s did not answer a DHT lookup: %v", a.id, a.err)
+				continue
+			}
+			results[a.id] = a.result
+		case <-deadline:
+			return results
+		}
+	}
+	return results
+}
+
+// reach returns the address of the connection to the node of contact c,
+// dialing it when the node is not connected to it, until ctx is done or
+// timeout fires. Removed peers are not dialed again.
+func (s *FileServer) reach(ctx context.Context, c dht.Contact, timeout <-chan time.Time) (string, error) {
+	if addr, ok := s.conns.conn(c.ID, c.Addr); ok {
+		return addr, nil
+	}
+	if s.removed.hasID(c.ID) || s.removed.hasAddr(c.Addr) {
+		return "", errors.NewConnectionError(fmt.Sprintf("peer %s was removed", c.ID))
+	}
+	if c.Addr == "" {
+		return "", errors.NewConnectionError(fmt.Sprintf("no address for node %s", c.ID))
+	}
+
+	_, events, unsubscribe := s.peers.subscribe()
+	defer unsubscribe()
+	if err := s.dial(c.Addr); err != nil {
+		return "", err
+	}
+	for {
+		if _, ok := s.peer(c.Addr); ok {
+			return c.Addr, nil
+		}
+		if addr, ok := s.conns.conn(c.ID, c.Addr); ok {
+			return addr, nil
+		}
+		select {
+		case _, ok := <-events:
+			if !ok {
+				return "", errors.NewConnectionError(fmt.Sprintf("failed to connect to %s", c.Addr))
+			}
+		case <-timeout:
+			return "", errors.NewTimeoutError(fmt.Sprintf("failed to connect to %s in time", c.Addr))
+		case <-ctx.Done():
+			return "", errors.Wrap(ctx.Err(), errors.TimeoutError, fmt.Sprintf("failed to connect to %s in time", c.Addr))
+		}
+	}
+}
@@ -0,0 +1,307 @@
+// Package dht routes lookups across a cluster the way Kademlia does. Nodes
+// and keys are hashed to IDs of the same space, where the distance between
+// two IDs is their XOR. Every node keeps a routing table of the nodes it
+// knows, up to K in each bucket of nodes sharing as many leading bits with
+// it, so it knows many nodes close to itself and a few far away. A lookup
+// asks the nodes it knows closest to a target for the nodes they know
+// closer still, a few at a time, and gets about one bit closer with every
+// round: it finds the nodes closest to the target in O(log n) rounds,
+// however many nodes the cluster has and whichever of them it starts from.
+package dht
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"math/bits"
+	"sort"
+	"sync"
+)
+
+const (
+	// DefaultBucketSize is the number of nodes a routing table keeps in
+	// each bucket, and the number of closest nodes a lookup finds, when
+	// NewTable is given none.
+	DefaultBucketSize = 8
+	// DefaultConcurrency is the number of nodes a lookup asks at once when
+	// it is given none.
+	DefaultConcurrency = 3
+)
+
+// ID is a point of the space nodes and keys are hashed to.
+type ID [sha256.Size]byte
+
+// NewID hashes s, a node ID or a key, to the space of IDs.
+func NewID(s string) ID {
+	return ID(sha256.Sum256([]byte(s)))
+}
+
+func (id ID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// Distance returns the distance between a and b, their XOR.
+func Distance(a, b ID) ID {
+	var d ID
+	for i := range d {
+		d[i] = a[i] ^ b[i]
+	}
+	return d
+}
+
+// Closer reports whether a is closer to target than b.
+func Closer(target, a, b ID) bool {
+	da, db := Distance(target, a), Distance(target, b)
+	return bytes.Compare(da[:], db[:]) < 0
+}
+
+// commonPrefixLen returns the number of leading bits a and b share.
+func commonPrefixLen(a, b ID) int {
+	for i := range a {
+		if x := a[i] ^ b[i]; x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
+	}
+	return len(a) * 8
+}
+
+// Contact is a node as the cluster knows it: its node ID, which its ID in
+// the space of IDs is the hash of, and the address it is reached at.
+type Contact struct {
+	ID   string
+	Addr string
+}
+
+// Key returns the ID of the contact in the space of IDs.
+func (c Contact) Key() ID {
+	return NewID(c.ID)
+}
+
+// Table is the routing table of a node. It is safe for concurrent use.
+type Table struct {
+	self ID
+	// selfID is the node ID of the node, which is never added to the table.
+	selfID string
+	k      int
+
+	mu sync.Mutex
+	// buckets holds the contacts sharing i leading bits with the node in
+	// bucket i, from the least recently heard from.
+	buckets [len(ID{}) * 8][]Contact
+}
+
+// NewTable returns an empty routing table of the node self, keeping k
+// contacts in each bucket, or DefaultBucketSize when k is not positive.
+func NewTable(self string, k int) *Table {
+	if k <= 0 {
+		k = DefaultBucketSize
+	}
+	return &Table{self: NewID(self), selfID: self, k: k}
+}
+
+// K returns the number of contacts the table keeps in each bucket.
+func (t *Table) K() int {
+	return t.k
+}
+
+// Add records that c was heard from. A known contact has its address
+// updated and becomes the most recently heard from of its bucket. A new
+// contact is only added while its bucket has room: the contacts that have
+// been up the longest are the likeliest to stay up, so they are kept over
+// newcomers until they fail and are removed. Add reports whether c is in
+// the table.
+func (t *Table) Add(c Contact) bool {
+	if c.ID == "" || c.ID == t.selfID {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	i := t.bucket(c.Key())
+	bucket := t.buckets[i]
+	for j, known := range bucket {
+		if known.ID == c.ID {
+			bucket = append(bucket[:j], bucket[j+1:]...)
+			t.buckets[i] = append(bucket, c)
+			return true
+		}
+	}
+	if len(bucket) >= t.k {
+		return false
+	}
+	t.buckets[i] = append(bucket, c)
+	return true
+}
+
+// Remove drops the contact of node ID id, which failed.
+func (t *Table) Remove(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	i := t.bucket(NewID(id))
+	for j, known := range t.buckets[i] {
+		if known.ID == id {
+			t.buckets[i] = append(t.buckets[i][:j], t.buckets[i][j+1:]...)
+			return
+		}
+	}
+}
+
+// bucket returns the index of the bucket of the contacts of ID key.
+func (t *Table) bucket(key ID) int {
+	i := commonPrefixLen(t.self, key)
+	if i == len(t.buckets) {
+		i--
+	}
+	return i
+}
+
+// Closest returns the n contacts closest to target, from the closest.
+func (t *Table) Closest(target ID, n int) []Contact {
+	contacts := t.Contacts()
+	sortByDistance(target, contacts)
+	if len(contacts) > n {
+		contacts = contacts[:n]
+	}
+	return contacts
+}
+
+// Contacts returns every contact of the table.
+func (t *Table) Contacts() []Contact {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var contacts []Contact
+	for _, bucket := range t.buckets {
+		contacts = append(contacts, bucket...)
+	}
+	return contacts
+}
+
+// Len returns the number of contacts of the table.
+func (t *Table) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := 0
+	for _, bucket := range t.buckets {
+		n += len(bucket)
+	}
+	return n
+}
+
+func sortByDistance(target ID, contacts []Contact) {
+	keys := make(map[string]ID, len(contacts))
+	for _, c := range contacts {
+		keys[c.ID] = c.Key()
+	}
+	sort.SliceStable(contacts, func(i, j int) bool {
+		return Closer(target, keys[contacts[i].ID], keys[contacts[j].ID])
+	})
+}
+
+// Answer is what a contact asked by a lookup answered: the contacts it
+// knows closest to the target, and whether it holds what the lookup is
+// after, which ends it.
+type Answer struct {
+	Closer []Contact
+	Found  bool
+}
+
+// Query asks the contacts given, all at once, for the contacts they know
+// closest to the target of a lookup, and returns the answers of those that
+// answered by node ID. The contacts missing from the answers failed.
+type Query func(contacts []Contact) map[string]Answer
+
+// Result is the outcome of a lookup.
+type Result struct {
+	// Closest are the contacts closest to the target that answered, from
+	// the closest, K at most.
+	Closest []Contact
+	// Found are the contacts that answered they hold what the lookup is
+	// after.
+	Found []Contact
+	// Rounds counts the rounds of queries the lookup took, and Queried the
+	// contacts it asked.
+	Rounds  int
+	Queried int
+}
+
+// Lookup finds the K contacts closest to target, asking alpha contacts at
+// a time, or DefaultConcurrency when alpha is not positive. It starts from
+// the closest contacts of the table, and stops once the K closest it heard
+// of have all been asked, or after the round in which one answered it
+// found what the lookup is after. The contacts that answer are added to
+// the table, and those that fail removed from it.
+func (t *Table) Lookup(target ID, alpha int, query Query) Result {
+	if alpha <= 0 {
+		alpha = DefaultConcurrency
+	}
+	type candidate struct {
+		Contact
+		key     ID
+		queried bool
+	}
+	var shortlist []*candidate
+	seen := map[string]bool{t.selfID: true}
+	add := func(contacts []Contact) {
+		for _, c := range contacts {
+			if c.ID == "" || seen[c.ID] {
+				continue
+			}
+			seen[c.ID] = true
+			shortlist = append(shortlist, &candidate{Contact: c, key: c.Key()})
+		}
+		sort.SliceStable(shortlist, func(i, j int) bool {
+			return Closer(target, shortlist[i].key, shortlist[j].key)
+		})
+	}
+	add(t.Closest(target, t.k))
+
+	var res Result
+	for {
+		// The next to ask are the closest not asked yet among the K closest
+		// heard of.
+		var batch []Contact
+		for i := 0; i < len(shortlist) && i < t.k && len(batch) < alpha; i++ {
+			if c := shortlist[i]; !c.queried {
+				c.queried = true
+				batch = append(batch, c.Contact)
+			}
+		}
+		if len(batch) == 0 {
+			break
+		}
+		res.Rounds++
+		res.Queried += len(batch)
+
+		answers := query(batch)
+		for _, c := range batch {
+			answer, ok := answers[c.ID]
+			if !ok {
+				t.Remove(c.ID)
+				for i, s := range shortlist {
+					if s.ID == c.ID {
+						shortlist = append(shortlist[:i], shortlist[i+1:]...)
+						break
+					}
+				}
+				continue
+			}
+			t.Add(c)
+			if answer.Found {
+				res.Found = append(res.Found, c)
+			}
+			add(answer.Closer)
+		}
+		if len(res.Found) > 0 {
+			break
+		}
+	}
+
+	for _, c := range shortlist {
+		if len(res.Closest) == t.k {
+			break
+		}
+		if c.queried {
+			res.Closest = append(res.Closest, c.Contact)
+		}
+	}
+	return res
+}
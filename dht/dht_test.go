@@ -0,0 +1,209 @@
+package dht
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func TestDistanceIsXOR(t *testing.T) {
+	a, b := NewID("a"), NewID("b")
+	if Distance(a, b) != Distance(b, a) {
+		t.Fatalf("Expected the distance to be symmetric")
+	}
+	if Distance(a, a) != (ID{}) {
+		t.Fatalf("Expected a node to be at distance zero of itself")
+	}
+	if !Closer(a, a, b) || Closer(a, b, a) {
+		t.Fatalf("Expected a to be closer to itself than b")
+	}
+	if n := commonPrefixLen(ID{0x0f}, ID{0x08}); n != 5 {
+		t.Fatalf("Expected 5 leading bits in common, got %d", n)
+	}
+}
+
+func TestTableKeepsOldContactsInFullBuckets(t *testing.T) {
+	table := NewTable("self", 2)
+	self := NewID("self")
+	// Nodes sharing no leading bit with self all go to bucket 0.
+	var far []Contact
+	for i := 0; len(far) < 3; i++ {
+		c := Contact{ID: fmt.Sprintf("node-%d", i)}
+		if commonPrefixLen(self, c.Key()) == 0 {
+			far = append(far, c)
+		}
+	}
+
+	if !table.Add(far[0]) || !table.Add(far[1]) {
+		t.Fatalf("Expected the bucket to take two contacts")
+	}
+	if table.Add(far[2]) {
+		t.Fatalf("Expected a full bucket to refuse a new contact")
+	}
+	if table.Add(Contact{ID: "self"}) {
+		t.Fatalf("Expected the table not to hold its own node")
+	}
+	// Known contacts have their address updated.
+	if !table.Add(Contact{ID: far[0].ID, Addr: "moved"}) {
+		t.Fatalf("Expected a known contact to be kept")
+	}
+	table.Remove(far[1].ID)
+	if !table.Add(far[2]) {
+		t.Fatalf("Expected the bucket to take a contact once one failed")
+	}
+	if table.Len() != 2 {
+		t.Fatalf("Expected 2 contacts, got %d", table.Len())
+	}
+	for _, c := range table.Contacts() {
+		if c.ID == far[0].ID && c.Addr != "moved" {
+			t.Fatalf("Expected the address of %s to be updated, got %q", c.ID, c.Addr)
+		}
+	}
+}
+
+func TestClosestOrdersByDistance(t *testing.T) {
+	table := NewTable("self", 0)
+	for i := 0; i < 50; i++ {
+		table.Add(Contact{ID: fmt.Sprintf("node-%d", i)})
+	}
+	target := NewID("key")
+	closest := table.Closest(target, 5)
+	if len(closest) != 5 {
+		t.Fatalf("Expected 5 contacts, got %d", len(closest))
+	}
+	for i := 1; i < len(closest); i++ {
+		if Closer(target, closest[i].Key(), closest[i-1].Key()) {
+			t.Fatalf("Expected contacts from the closest: %v", closest)
+		}
+	}
+	for _, c := range table.Contacts() {
+		if Closer(target, c.Key(), closest[4].Key()) && !contains(closest, c.ID) {
+			t.Fatalf("Expected %s among the closest", c.ID)
+		}
+	}
+}
+
+// network is a cluster of nodes that only know the contacts of their
+// routing tables.
+type network struct {
+	tables map[string]*Table
+	ids    []string
+	// down are the nodes that fail every query.
+	down map[string]bool
+	// has is the node holding the value the lookups are after, if any.
+	has string
+}
+
+func newNetwork(n, k int) *network {
+	net := &network{tables: make(map[string]*Table), down: make(map[string]bool)}
+	for i := 0; i < n; i++ {
+		id := fmt.Sprintf("node-%d", i)
+		net.ids = append(net.ids, id)
+		net.tables[id] = NewTable(id, k)
+	}
+	// Every node hears of the others in a random order, keeping those its
+	// buckets have room for.
+	rnd := rand.New(rand.NewSource(1))
+	for _, id := range net.ids {
+		for _, i := range rnd.Perm(n) {
+			net.tables[id].Add(Contact{ID: net.ids[i]})
+		}
+	}
+	return net
+}
+
+func (net *network) query(target ID) Query {
+	return func(contacts []Contact) map[string]Answer {
+		answers := make(map[string]Answer)
+		for _, c := range contacts {
+			if net.down[c.ID] {
+				continue
+			}
+			answers[c.ID] = Answer{
+				Closer: net.tables[c.ID].Closest(target, net.tables[c.ID].K()),
+				Found:  c.ID == net.has,
+			}
+		}
+		return answers
+	}
+}
+
+// closest returns the node ID of the node closest to target.
+func (net *network) closest(target ID) string {
+	best := ""
+	for _, id := range net.ids {
+		if !net.down[id] && (best == "" || Closer(target, NewID(id), NewID(best))) {
+			best = id
+		}
+	}
+	return best
+}
+
+func TestLookupFindsClosestNodesInLogarithmicRounds(t *testing.T) {
+	const n = 512
+	net := newNetwork(n, 4)
+	for i := 0; i < n/8; i++ {
+		net.down[net.ids[i*8]] = true
+	}
+	for i := 0; i < 100; i++ {
+		from := net.ids[i*5+1]
+		target := NewID(fmt.Sprintf("key-%d", i))
+		table := net.tables[from]
+		if table.Len() > 60 {
+			t.Fatalf("Expected a routing table of O(log n) contacts, %s has %d", from, table.Len())
+		}
+
+		res := table.Lookup(target, 0, net.query(target))
+		want := net.closest(target)
+		if want == from {
+			continue
+		}
+		if len(res.Closest) == 0 || res.Closest[0].ID != want {
+			t.Fatalf("Expected the lookup of %s from %s to find %s, got %v", target, from, want, res.Closest)
+		}
+		if res.Rounds > 12 || res.Queried > 40 {
+			t.Fatalf("Expected O(log n) rounds, the lookup from %s took %d rounds and %d queries", from, res.Rounds, res.Queried)
+		}
+		for _, c := range res.Closest {
+			if net.down[c.ID] {
+				t.Fatalf("Expected the nodes down out of the result, got %s", c.ID)
+			}
+		}
+	}
+}
+
+func TestLookupStopsOnceFound(t *testing.T) {
+	net := newNetwork(256, 4)
+	target := NewID("key")
+	net.has = net.closest(target)
+	from := net.ids[0]
+	if from == net.has {
+		from = net.ids[1]
+	}
+	res := net.tables[from].Lookup(target, 0, net.query(target))
+	if len(res.Found) != 1 || res.Found[0].ID != net.has {
+		t.Fatalf("Expected the lookup to find %s, got %v", net.has, res.Found)
+	}
+
+	// Contacts that fail are dropped from the table of the node looking up.
+	net.has = ""
+	down := net.tables[from].Closest(target, 2)
+	for _, c := range down {
+		net.down[c.ID] = true
+	}
+	net.tables[from].Lookup(target, 0, net.query(target))
+	for _, c := range down {
+		if contains(net.tables[from].Contacts(), c.ID) {
+			t.Fatalf("Expected %s, which is down, to be removed", c.ID)
+		}
+	}
+}
+
+func contains(contacts []Contact, id string) bool {
+	for _, c := range contacts {
+		if c.ID == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/anthdm/foreverstore/config"
+	"github.com/anthdm/foreverstore/dht"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProviderRecordsExpireAndStayBounded(t *testing.T) {
+	var p providerRecords
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	target := replicaID("node", "key")
+	p.add(target, dht.Contact{ID: "first", Addr: "a"}, now.Add(time.Minute))
+	for i := 0; i < dhtMaxProviders; i++ {
+		p.add(target, dht.Contact{ID: string(rune('b' + i)), Addr: "b"}, now.Add(time.Hour))
+	}
+	// The record expiring first made room for the last.
+	providers := p.get(target, now)
+	assert.Len(t, providers, dhtMaxProviders)
+	for _, c := range providers {
+		assert.NotEqual(t, "first", c.ID)
+	}
+
+	p.expire(now.Add(time.Hour))
+	assert.Empty(t, p.get(target, now))
+	assert.Zero(t, p.len())
+}
+
+func TestGetFindsMovedReplicasThroughTheDHT(t *testing.T) {
+	c := newTestCluster(t, 5)
+	s := c.nodes[0]
+	c.eventually("the peers to be routed to", func() bool {
+		for _, node := range c.nodes {
+			if node.DHT().Contacts != len(c.nodes)-1 {
+				return false
+			}
+		}
+		return true
+	})
+	policy := config.BucketPolicy{Bucket: "docs", ReplicationFactor: 2}
+	assert.Nil(t, c.run("policy to be distributed", func() error { return s.SetBucketPolicy(policy) }))
+
+	c.store(0, "docs/report", []byte("moved around"))
+	holder := 0
+	c.eventually("the replica to be placed", func() bool {
+		for node := 1; node < len(c.nodes); node++ {
+			if c.holds(node, 0, "docs/report") {
+				holder = node
+				return true
+			}
+		}
+		return false
+	})
+	mover := 1
+	if mover == holder {
+		mover = 2
+	}
+
+	// The replica moves off the peer it was placed on, as a rebalance
+	// would move it.
+	meta, err := s.Meta("docs/report")
+	assert.Nil(t, err)
+	n, r, err := c.nodes[holder].store.Read(s.ID, hashKey("docs/report"))
+	assert.Nil(t, err)
+	data, err := io.ReadAll(r)
+	r.(io.Closer).Close()
+	assert.Nil(t, err)
+	msg := s.storeFileMessage("docs/report", meta, n)
+	msg.Size = n
+	assert.Nil(t, c.nodes[mover].receiveReplica(nil, c.nodes[holder].Transport.Addr(), msg, bytes.NewReader(data)))
+	assert.Nil(t, c.nodes[holder].store.Delete(s.ID, hashKey("docs/report")))
+	target := replicaID(s.ID, hashKey("docs/report"))
+	c.eventually("the replica to be announced", func() bool {
+		for _, node := range c.nodes {
+			for _, p := range node.providers.get(target, c.clock.Now()) {
+				if p.ID == c.nodes[mover].ID {
+					return true
+				}
+			}
+		}
+		return false
+	})
+
+	// The peer the replica was placed on lacks it: the DHT says where it
+	// went, as the peers keeping the record answer.
+	s.providers.expire(c.clock.Now().Add(dhtRecordTTL))
+	assert.Nil(t, s.store.Delete(s.ID, "docs/report"))
+	assert.Equal(t, []byte("moved around"), c.get(0, "docs/report"))
+	st := s.DHT()
+	assert.Equal(t, int64(1), st.Lookups)
+	assert.Equal(t, int64(1), st.Found)
+
+	// Objects nobody holds are looked up in vain.
+	assert.Nil(t, c.run("fetch", func() error {
+		s.fetchLock.Lock()
+		defer s.fetchLock.Unlock()
+		assert.NotNil(t, s.requestFile("docs/missing", nil))
+		return nil
+	}))
+	assert.Equal(t, int64(2), s.DHT().Lookups)
+	assert.Equal(t, int64(1), s.DHT().Found)
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/anthdm/foreverstore/errors"
+)
+
+// DiskHealth is the health of the disk holding the storage root. The node
+// turns read-only when the disk fills up or fails writes, rejecting the
+// objects of clients and the replicas of peers with a ReadOnlyError rather
+// than leave them half written. Reads, and deletes, carry on.
+type DiskHealth struct {
+	ReadOnly bool       `json:"read_only"`
+	Reason   string     `json:"reason,omitempty"`
+	Since    *time.Time `json:"since,omitempty"`
+	// FreeBytes is the space left on the disk, and TotalBytes its size, as
+	// of CheckedAt.
+	FreeBytes  uint64    `json:"free_bytes"`
+	TotalBytes uint64    `json:"total_bytes"`
+	CheckedAt  time.Time `json:"checked_at"`
+	// WriteErrors counts the writes the disk failed, LastWriteError being
+	// the last of them.
+	WriteErrors    int    `json:"write_errors"`
+	LastWriteError string `json:"last_write_error,omitempty"`
+	// Events are the last changes of the health of the disk, oldest first.
+	Events []DiskHealthEvent `json:"events,omitempty"`
+}
+
+// DiskHealthEvent is a change of the health of the disk.
+type DiskHealthEvent struct {
+	Time   time.Time `json:"time"`
+	Event  string    `json:"event"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+// Events of DiskHealthEvent.
+const (
+	DiskEventReadOnly   = "read_only"
+	DiskEventWritable   = "writable"
+	DiskEventWriteError = "write_error"
+)
+
+// diskMaxEvents bounds the events kept in DiskHealth.
+const diskMaxEvents = 20
+
+type diskMonitor struct {
+	mu     sync.Mutex
+	health DiskHealth
+	// full is set while the node is read-only for want of space, which is
+	// lifted once space is freed. A failing disk takes an operator.
+	full bool
+	// recent counts the writes the disk failed since the last check.
+	recent int
+	// space returns the free space and the size of the disk holding path.
+	space func(path string) (free, total uint64, err error)
+}
+
+// writable fails with a ReadOnlyError while the disk is unhealthy.
+func (d *diskMonitor) writable() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.health.ReadOnly {
+		return nil
+	}
+	return errors.NewReadOnlyError(fmt.Sprintf("node is read-only: %s", d.health.Reason))
+}
+
+// event records a change of the health of the disk. Callers hold mu.
+func (d *diskMonitor) event(now time.Time, event, reason string) {
+	d.health.Events = append(d.health.Events, DiskHealthEvent{Time: now, Event: event, Reason: reason})
+	if n := len(d.health.Events); n > diskMaxEvents {
+		d.health.Events = append([]DiskHealthEvent(nil), d.health.Events[n-diskMaxEvents:]...)
+	}
+}
+
+// DiskHealth returns the health of the disk holding the storage root.
+func (s *FileServer) DiskHealth() DiskHealth {
+	s.disk.mu.Lock()
+	defer s.disk.mu.Unlock()
+	health := s.disk.health
+	health.Events = append([]DiskHealthEvent(nil), health.Events...)
+	return health
+}
+
+// MakeWritable has a read-only node take writes again, once an operator
+// replaced or fixed its disk. A disk still full turns the node read-only
+// again at the next check.
+func (s *FileServer) MakeWritable(by string) DiskHealth {
+	s.disk.mu.Lock()
+	if s.disk.health.ReadOnly {
+		s.setWritable(s.Clock.Now(), fmt.Sprintf("made writable by %s", by))
+	}
+	s.disk.mu.Unlock()
+	return s.DiskHealth()
+}
+
+func (s *FileServer) diskLoop() {
+	ticker := s.Clock.NewTicker(s.DiskCheckInterval)
+	defer ticker.Stop()
+
+	s.checkDisk()
+	for {
+		select {
+		case <-ticker.C():
+			s.checkDisk()
+		case <-s.quitch:
+			return
+		}
+	}
+}
+
+// checkDisk reads the free space of the disk holding the storage root,
+// turning the node read-only when too little is left, and writable again
+// once enough was freed.
+func (s *FileServer) checkDisk() {
+	now := s.Clock.Now()
+
+	d := &s.disk
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.recent = 0
+	free, total, err := d.space(existingParent(s.store.Root))
+	if err != nil {
+		s.logger.Debug("Failed to read the free space of the storage root: %v", err)
+		return
+	}
+	d.health.FreeBytes, d.health.TotalBytes, d.health.CheckedAt = free, total, now
+
+	min := uint64(s.DiskMinFreeBytes)
+	switch {
+	case free < min && !d.health.ReadOnly:
+		s.setReadOnly(now, true, fmt.Sprintf("disk full: %d bytes free, %d required", free, min))
+	case free >= min && d.full:
+		s.setWritable(now, fmt.Sprintf("disk has %d bytes free", free))
+	}
+}
+
+// diskWriteFailed counts a write that failed for want of space or because
+// the disk failed it, turning the node read-only when the disk is full or
+// failed too many writes since the last check.
+func (s *FileServer) diskWriteFailed(err error) {
+	full, failing := diskFault(err)
+	if !full && !failing {
+		return
+	}
+	now := s.Clock.Now()
+
+	d := &s.disk
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.health.WriteErrors++
+	d.health.LastWriteError = err.Error()
+	d.recent++
+	d.event(now, DiskEventWriteError, err.Error())
+	s.logger.Warn("disk_health event=%s error=%q", DiskEventWriteError, err.Error())
+
+	switch {
+	case full && !d.health.ReadOnly:
+		s.setReadOnly(now, true, fmt.Sprintf("disk full: %v", err))
+	case failing && d.recent >= s.DiskMaxWriteErrors && (!d.health.ReadOnly || d.full):
+		s.setReadOnly(now, false, fmt.Sprintf("disk failing: %d writes failed, the last with %v", d.recent, err))
+	}
+}
+
+// setReadOnly turns the node read-only, for want of space when full is
+// set. Callers hold the lock of the disk monitor.
+func (s *FileServer) setReadOnly(now time.Time, full bool, reason string) {
+	d := &s.disk
+	d.health.ReadOnly = true
+	d.health.Reason = reason
+	d.health.Since = &now
+	d.full = full
+	d.event(now, DiskEventReadOnly, reason)
+	s.logger.Error("disk_health event=%s reason=%q", DiskEventReadOnly, reason)
+}
+
+// setWritable has the node take writes again. Callers hold the lock of
+// the disk monitor.
+func (s *FileServer) setWritable(now time.Time, reason string) {
+	d := &s.disk
+	d.health.ReadOnly = false
+	d.health.Reason = ""
+	d.health.Since = nil
+	d.full = false
+	d.recent = 0
+	d.event(now, DiskEventWritable, reason)
+	s.logger.Info("disk_health event=%s reason=%q", DiskEventWritable, reason)
+}
+
+// existingParent returns path, or the closest of its parents that exists
+// when it does not exist yet.
+func existingParent(path string) string {
+	for {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return path
+		}
+		path = parent
+	}
+}
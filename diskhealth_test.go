@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/anthdm/foreverstore/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// setDiskSpace has the disk of s report free bytes free.
+func setDiskSpace(s *FileServer, free uint64) {
+	s.disk.mu.Lock()
+	defer s.disk.mu.Unlock()
+	s.disk.space = func(string) (uint64, uint64, error) { return free, 1 << 30, nil }
+}
+
+func TestFullDiskTurnsTheNodeReadOnly(t *testing.T) {
+	c := newTestCluster(t, 2)
+	s := c.nodes[1]
+	c.store(1, "before", []byte("stored with room"))
+
+	setDiskSpace(s, 1<<20)
+	s.checkDisk()
+	health := s.DiskHealth()
+	assert.True(t, health.ReadOnly)
+	assert.Contains(t, health.Reason, "disk full")
+	assert.Equal(t, uint64(1<<20), health.FreeBytes)
+
+	// Neither clients nor peers get to write to it, while reads carry on.
+	err := c.run("store", func() error { return s.Store("refused", bytes.NewReader([]byte("no room"))) })
+	assert.True(t, errors.IsType(err, errors.ReadOnlyError), "got %v", err)
+	c.store(0, "shared", []byte("kept on node-0"))
+	c.eventually("replica to be refused", func() bool {
+		stats := c.nodes[0].ReplicationStats()
+		return len(stats) == 1 && stats[0].Pending == 0 && stats[0].Replicated == 1
+	})
+	assert.False(t, c.holds(1, 0, "shared"))
+	assert.Equal(t, []byte("stored with room"), c.get(1, "before"))
+
+	// Freeing space makes it writable again.
+	setDiskSpace(s, 1<<30)
+	s.checkDisk()
+	assert.False(t, s.DiskHealth().ReadOnly)
+	c.store(1, "accepted", []byte("room again"))
+
+	events := s.DiskHealth().Events
+	if assert.Len(t, events, 2) {
+		assert.Equal(t, DiskEventReadOnly, events[0].Event)
+		assert.Equal(t, DiskEventWritable, events[1].Event)
+	}
+}
+
+func TestFailingDiskTurnsTheNodeReadOnly(t *testing.T) {
+	s := createTestServer(":0", t.TempDir(), []string{})
+	setDiskSpace(s, 1<<30)
+	failed := &os.PathError{Op: "write", Path: "object", Err: syscall.EIO}
+
+	// Errors that are not the disk's are not counted.
+	s.diskWriteFailed(errors.NewInvalidInputError("bad key"))
+	assert.Zero(t, s.DiskHealth().WriteErrors)
+
+	for i := 1; i < s.DiskMaxWriteErrors; i++ {
+		s.diskWriteFailed(failed)
+	}
+	assert.False(t, s.DiskHealth().ReadOnly)
+	s.diskWriteFailed(failed)
+	health := s.DiskHealth()
+	assert.True(t, health.ReadOnly)
+	assert.Contains(t, health.Reason, "disk failing")
+	assert.Equal(t, s.DiskMaxWriteErrors, health.WriteErrors)
+	assert.Equal(t, failed.Error(), health.LastWriteError)
+	err := s.checkWritable()
+	assert.True(t, errors.IsType(err, errors.ReadOnlyError), "got %v", err)
+
+	// A failing disk stays read-only with space to spare, until an operator
+	// makes the node writable.
+	s.checkDisk()
+	assert.True(t, s.DiskHealth().ReadOnly)
+	assert.False(t, s.MakeWritable("operator").ReadOnly)
+	assert.Nil(t, s.checkWritable())
+
+	// Running out of space turns it read-only at once.
+	s.diskWriteFailed(&os.PathError{Op: "write", Path: "object", Err: syscall.ENOSPC})
+	assert.True(t, s.DiskHealth().ReadOnly)
+	assert.Contains(t, s.DiskHealth().Reason, "disk full")
+}
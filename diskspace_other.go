@@ -0,0 +1,11 @@
+//go:build !linux && !darwin
+
+package main
+
+import "github.com/anthdm/foreverstore/errors"
+
+// diskSpace is not supported on this platform: only write errors turn the
+// node read-only.
+func diskSpace(path string) (free, total uint64, err error) {
+	return 0, 0, errors.NewConfigError("free disk space is not reported on this platform")
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/anthdm/foreverstore/config"
+)
+
+// The doctor checks what a node needs before it joins the cluster, without
+// starting it or changing anything on disk: its configuration, its storage
+// root, the ports it listens on, its bootstrap nodes, the clocks of its
+// peers and its encryption key. Each finding says how to fix what failed.
+
+// DoctorStatus is the outcome of a check of the doctor.
+type DoctorStatus string
+
+const (
+	DoctorOK   DoctorStatus = "ok"
+	DoctorWarn DoctorStatus = "warn"
+	DoctorFail DoctorStatus = "FAIL"
+)
+
+// DoctorFinding is the outcome of one check.
+type DoctorFinding struct {
+	Check   string
+	Status  DoctorStatus
+	Message string
+	// Fix tells how to fix what failed, or what to look at.
+	Fix string
+}
+
+// DoctorOpts are the checks of the doctor that need more than the
+// configuration of the node.
+type DoctorOpts struct {
+	// PeerAdmins are the admin API addresses of the peers whose clocks are
+	// compared with the local one.
+	PeerAdmins []string
+	// Timeout bounds each connection to another node.
+	Timeout time.Duration
+}
+
+func runDoctorCommand(args []string) int {
+	flags := flag.NewFlagSet("doctor", flag.ExitOnError)
+	peerAdmins := flags.String("peer-admins", "", "comma-separated admin API addresses of peers to compare clocks with")
+	timeout := flags.Duration("timeout", 3*time.Second, "timeout of each connection to another node")
+
+	cfg, err := config.LoadWithFlags(configFile, flags, args)
+	if err != nil {
+		printFindings([]DoctorFinding{{
+			Check:   "config",
+			Status:  DoctorFail,
+			Message: err.Error(),
+			Fix:     "fix " + configFile + ", the environment or the flags given",
+		}})
+		return 1
+	}
+
+	opts := DoctorOpts{Timeout: *timeout}
+	if *peerAdmins != "" {
+		opts.PeerAdmins = strings.Split(*peerAdmins, ",")
+	}
+	findings := runDoctor(cfg, opts)
+	printFindings(findings)
+	for _, f := range findings {
+		if f.Status == DoctorFail {
+			return 1
+		}
+	}
+	return 0
+}
+
+func printFindings(findings []DoctorFinding) {
+	for _, f := range findings {
+		fmt.Printf("doctor: %-4s  %-10s %s\n", f.Status, f.Check, f.Message)
+		if f.Fix != "" && f.Status != DoctorOK {
+			fmt.Printf("              %-10s fix: %s\n", "", f.Fix)
+		}
+	}
+}
+
+// runDoctor runs the checks of the doctor against cfg, which is valid.
+func runDoctor(cfg *config.Config, opts DoctorOpts) []DoctorFinding {
+	if opts.Timeout <= 0 {
+		opts.Timeout = 3 * time.Second
+	}
+	findings := []DoctorFinding{{Check: "config", Status: DoctorOK, Message: "configuration is valid"}}
+	findings = append(findings, checkStorageRoot(cfg)...)
+	findings = append(findings, checkPorts(cfg)...)
+	findings = append(findings, checkBootstrapNodes(cfg, opts.Timeout)...)
+	findings = append(findings, checkClockSkew(opts.PeerAdmins, maxClockSkew(cfg), opts.Timeout)...)
+	findings = append(findings, checkKeyMaterial(cfg))
+	return findings
+}
+
+// checkStorageRoot checks that the storage root can be written to, and
+// that its disk has more than the free space the node needs to take
+// writes.
+func checkStorageRoot(cfg *config.Config) []DoctorFinding {
+	// A storage root yet to be created is created by the node under its
+	// closest existing parent.
+	dir := existingParent(cfg.StorageRoot)
+	f, err := os.CreateTemp(dir, ".doctor-*")
+	if err != nil {
+		return []DoctorFinding{{
+			Check:   "storage",
+			Status:  DoctorFail,
+			Message: fmt.Sprintf("%s is not writable: %v", dir, err),
+			Fix:     "give the user running the node write access to " + dir + ", or change storage_root",
+		}}
+	}
+	f.Close()
+	os.Remove(f.Name())
+	findings := []DoctorFinding{{Check: "storage", Status: DoctorOK, Message: cfg.StorageRoot + " is writable"}}
+
+	minFree := cfg.DiskMinFreeBytes
+	if minFree == 0 {
+		minFree = config.DefaultDiskMinFreeBytes
+	}
+	free, total, err := diskSpace(dir)
+	switch {
+	case err != nil:
+		findings = append(findings, DoctorFinding{
+			Check:   "disk",
+			Status:  DoctorWarn,
+			Message: fmt.Sprintf("free space unknown: %v", err),
+			Fix:     "watch the free space of the storage root yourself",
+		})
+	case free < uint64(minFree):
+		findings = append(findings, DoctorFinding{
+			Check:   "disk",
+			Status:  DoctorFail,
+			Message: fmt.Sprintf("%d bytes free of %d, below the %d the node needs to take writes", free, total, minFree),
+			Fix:     "free space on the disk of the storage root, or lower disk_min_free_bytes",
+		})
+	default:
+		findings = append(findings, DoctorFinding{
+			Check:   "disk",
+			Status:  DoctorOK,
+			Message: fmt.Sprintf("%d bytes free of %d", free, total),
+		})
+	}
+	return findings
+}
+
+// checkPorts checks that the addresses the node listens on are free.
+func checkPorts(cfg *config.Config) []DoctorFinding {
+	addrs := append([]string{cfg.ListenAddr}, cfg.ListenAddrs...)
+	if cfg.AdminAddr != "" {
+		addrs = append(addrs, cfg.AdminAddr)
+	}
+	var findings []DoctorFinding
+	for _, addr := range addrs {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			findings = append(findings, DoctorFinding{
+				Check:   "port",
+				Status:  DoctorFail,
+				Message: fmt.Sprintf("cannot listen on %s: %v", addr, err),
+				Fix:     "stop what listens on " + addr + ", or change the address in the configuration",
+			})
+			continue
+		}
+		ln.Close()
+		findings = append(findings, DoctorFinding{Check: "port", Status: DoctorOK, Message: addr + " is free"})
+	}
+	return findings
+}
+
+// checkBootstrapNodes checks that the bootstrap nodes accept connections.
+// A node keeps trying the ones it cannot reach, so they are only warned
+// about.
+func checkBootstrapNodes(cfg *config.Config, timeout time.Duration) []DoctorFinding {
+	if len(cfg.BootstrapNodes) == 0 {
+		return []DoctorFinding{{Check: "bootstrap", Status: DoctorOK, Message: "no bootstrap nodes: the node starts a cluster of its own"}}
+	}
+	var findings []DoctorFinding
+	for _, addr := range cfg.BootstrapNodes {
+		conn, err := net.DialTimeout("tcp", addr, timeout)
+		if err != nil {
+			findings = append(findings, DoctorFinding{
+				Check:   "bootstrap",
+				Status:  DoctorWarn,
+				Message: fmt.Sprintf("%s is unreachable: %v", addr, err),
+				Fix:     "start " + addr + ", open the firewall to it, or fix bootstrap_nodes",
+			})
+			continue
+		}
+		conn.Close()
+		findings = append(findings, DoctorFinding{Check: "bootstrap", Status: DoctorOK, Message: addr + " is reachable"})
+	}
+	return findings
+}
+
+// maxClockSkew returns the clock skew the node tolerates.
+func maxClockSkew(cfg *config.Config) time.Duration {
+	if cfg.MaxClockSkewMs == 0 {
+		return config.DefaultMaxClockSkewMs * time.Millisecond
+	}
+	return time.Duration(cfg.MaxClockSkewMs) * time.Millisecond
+}
+
+// checkClockSkew compares the local clock with the Date of the answers of
+// the admin APIs of peers, to the second. The local time taken is the
+// middle of the request.
+func checkClockSkew(admins []string, max, timeout time.Duration) []DoctorFinding {
+	if len(admins) == 0 {
+		return []DoctorFinding{{Check: "clock", Status: DoctorOK, Message: "skipped: no peer admin addresses given (-peer-admins)"}}
+	}
+	client := &http.Client{Timeout: timeout}
+	var findings []DoctorFinding
+	for _, addr := range admins {
+		url := addr
+		if !strings.Contains(url, "://") {
+			url = "http://" + url
+		}
+		start := time.Now()
+		resp, err := client.Get(strings.TrimRight(url, "/") + "/health")
+		if err != nil {
+			findings = append(findings, DoctorFinding{
+				Check:   "clock",
+				Status:  DoctorWarn,
+				Message: fmt.Sprintf("cannot read the clock of %s: %v", addr, err),
+				Fix:     "check that the admin API of the peer is up at " + addr,
+			})
+			continue
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		local := start.Add(time.Since(start) / 2)
+
+		remote, err := http.ParseTime(resp.Header.Get("Date"))
+		if err != nil {
+			findings = append(findings, DoctorFinding{
+				Check:   "clock",
+				Status:  DoctorWarn,
+				Message: fmt.Sprintf("%s did not tell its time", addr),
+			})
+			continue
+		}
+		skew := remote.Sub(local.Truncate(time.Second))
+		if skew < 0 {
+			skew = -skew
+		}
+		if skew > max {
+			findings = append(findings, DoctorFinding{
+				Check:   "clock",
+				Status:  DoctorFail,
+				Message: fmt.Sprintf("clock is %s off the clock of %s", skew.Round(time.Second), addr),
+				Fix:     "synchronize the clocks of the nodes with NTP",
+			})
+			continue
+		}
+		findings = append(findings, DoctorFinding{
+			Check:   "clock",
+			Status:  DoctorOK,
+			Message: fmt.Sprintf("clock is within %s of %s", max, addr),
+		})
+	}
+	return findings
+}
+
+// checkKeyMaterial checks that the encryption key can be read and used by
+// the cipher suite, and that it is the key the storage was written with,
+// as loadEncryptionKey does but without generating or recording anything.
+func checkKeyMaterial(cfg *config.Config) DoctorFinding {
+	finding := DoctorFinding{Check: "keys", Status: DoctorFail}
+	if !cfg.EncryptionEnabled {
+		finding.Status, finding.Message = DoctorOK, "encryption is disabled"
+		return finding
+	}
+
+	var key []byte
+	if cfg.EncryptionKey != "" {
+		k, err := config.ParseEncryptionKey(cfg.EncryptionKey)
+		if err != nil {
+			finding.Message = fmt.Sprintf("invalid encryption key: %v", err)
+			finding.Fix = "set encryption_key to a hex or base64 encoded key of 16, 24 or 32 bytes"
+			return finding
+		}
+		key = k
+	} else {
+		path := keyFilePath(cfg)
+		b, err := os.ReadFile(path)
+		switch {
+		case os.IsNotExist(err):
+		case err != nil:
+			finding.Message = fmt.Sprintf("cannot read the key file %s: %v", path, err)
+			finding.Fix = "give the user running the node read access to " + path
+			return finding
+		default:
+			k, err := config.ParseEncryptionKey(string(b))
+			if err != nil {
+				finding.Message = fmt.Sprintf("invalid key in the key file %s: %v", path, err)
+				finding.Fix = "restore the key file from a backup"
+				return finding
+			}
+			key = k
+		}
+	}
+
+	stored, err := os.ReadFile(filepath.Join(cfg.StorageRoot, keyFingerprintFileName))
+	if err != nil && !os.IsNotExist(err) {
+		finding.Message = fmt.Sprintf("cannot read the key fingerprint: %v", err)
+		finding.Fix = "give the user running the node read access to the storage root"
+		return finding
+	}
+	stored = bytes.TrimSpace(stored)
+
+	if key == nil {
+		if len(stored) > 0 {
+			finding.Message = "no encryption key, but the storage was written with one"
+			finding.Fix = "restore the key file " + keyFilePath(cfg) + " or set encryption_key"
+			return finding
+		}
+		finding.Status = DoctorWarn
+		finding.Message = "no encryption key: the node generates one in " + keyFilePath(cfg)
+		finding.Fix = "back up the key file once the node started"
+		return finding
+	}
+	if _, err := newSuiteAEAD(strings.ToLower(cfg.CipherSuite), key); err != nil {
+		finding.Message = fmt.Sprintf("the key cannot be used by cipher suite %s: %v", cfg.CipherSuite, err)
+		finding.Fix = "use a key of the size the cipher suite needs, or change cipher_suite"
+		return finding
+	}
+	if len(stored) > 0 && !bytes.Equal(stored, []byte(keyFingerprint(key))) {
+		matched := false
+		for _, encoded := range cfg.PreviousEncryptionKeys {
+			if prev, err := config.ParseEncryptionKey(encoded); err == nil && bytes.Equal(stored, []byte(keyFingerprint(prev))) {
+				matched = true
+			}
+		}
+		if !matched {
+			finding.Message = fmt.Sprintf("the key (%s) is not the key the storage was written with (%s)", keyFingerprint(key), stored)
+			finding.Fix = "configure the key the storage was written with, listing the new one as a rotation"
+			return finding
+		}
+	}
+	finding.Status, finding.Message = DoctorOK, "encryption key "+keyFingerprint(key)+" is usable"
+	return finding
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/hex"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/anthdm/foreverstore/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// findingsOf returns the statuses of the findings of check, in order.
+func findingsOf(findings []DoctorFinding, check string) []DoctorStatus {
+	var statuses []DoctorStatus
+	for _, f := range findings {
+		if f.Check == check {
+			statuses = append(statuses, f.Status)
+		}
+	}
+	return statuses
+}
+
+func TestDoctor(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.StorageRoot = filepath.Join(t.TempDir(), "root")
+	cfg.ListenAddr = "127.0.0.1:0"
+	cfg.AdminAddr = ""
+	cfg.EncryptionEnabled = false
+
+	findings := runDoctor(cfg, DoctorOpts{})
+	for _, f := range findings {
+		assert.NotEqual(t, DoctorFail, f.Status, "%s: %s", f.Check, f.Message)
+	}
+	_, err := os.Stat(cfg.StorageRoot)
+	assert.True(t, os.IsNotExist(err), "the doctor created the storage root")
+
+	// A port in use, an unreachable bootstrap node and a peer whose clock
+	// is a minute ahead are reported.
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer busy.Close()
+	gone, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	gone.Close()
+	ahead := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Date", time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+	}))
+	defer ahead.Close()
+	inTime := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer inTime.Close()
+
+	cfg.ListenAddr = busy.Addr().String()
+	cfg.BootstrapNodes = []string{gone.Addr().String()}
+	findings = runDoctor(cfg, DoctorOpts{PeerAdmins: []string{ahead.URL, inTime.Listener.Addr().String()}, Timeout: time.Second})
+	assert.Equal(t, []DoctorStatus{DoctorFail}, findingsOf(findings, "port"))
+	assert.Equal(t, []DoctorStatus{DoctorWarn}, findingsOf(findings, "bootstrap"))
+	assert.Equal(t, []DoctorStatus{DoctorFail, DoctorOK}, findingsOf(findings, "clock"))
+
+	// The disk must have the free space the node needs to take writes.
+	cfg.DiskMinFreeBytes = 1 << 62
+	assert.Equal(t, []DoctorStatus{DoctorFail}, findingsOf(runDoctor(cfg, DoctorOpts{}), "disk"))
+}
+
+func TestDoctorChecksKeyMaterial(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.StorageRoot = t.TempDir()
+	cfg.EncryptionEnabled = true
+
+	// Without a key, one is generated on start: the doctor leaves it to
+	// the node.
+	assert.Equal(t, DoctorWarn, checkKeyMaterial(cfg).Status)
+	_, err := os.Stat(keyFilePath(cfg))
+	assert.True(t, os.IsNotExist(err))
+
+	key := newEncryptionKey()
+	assert.Nil(t, checkKeyFingerprint(cfg.StorageRoot, key))
+	assert.Equal(t, DoctorFail, checkKeyMaterial(cfg).Status)
+
+	assert.Nil(t, os.WriteFile(keyFilePath(cfg), []byte("not a key"), 0600))
+	assert.Equal(t, DoctorFail, checkKeyMaterial(cfg).Status)
+
+	cfg.EncryptionKey = "0000000000000000000000000000000000000000000000000000000000000000"
+	assert.Equal(t, DoctorFail, checkKeyMaterial(cfg).Status)
+	cfg.PreviousEncryptionKeys = map[string]string{"1": hex.EncodeToString(key)}
+	assert.Equal(t, DoctorOK, checkKeyMaterial(cfg).Status)
+}
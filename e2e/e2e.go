@@ -0,0 +1,160 @@
+// Package e2e implements end-to-end encryption of objects with a key held
+// only by the client. Servers store the resulting ciphertext as an opaque
+// object and return it unchanged; only holders of the key can decrypt it.
+package e2e
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+
+	"github.com/anthdm/foreverstore/errors"
+)
+
+const (
+	// Magic identifies the client-side encryption format.
+	Magic = "FSE1"
+	// ChunkSize is the amount of plaintext sealed per chunk.
+	ChunkSize = 64 * 1024
+
+	// AttrKeyID is the client metadata attribute recording the ID of the
+	// key an object was encrypted with, so a client can tell it holds the
+	// wrong key before attempting to decrypt.
+	AttrKeyID = "e2e-key-id"
+
+	noncePrefixLen = 8
+	headerLen      = len(Magic) + noncePrefixLen
+)
+
+// KeyID returns a short identifier of key that reveals nothing about it.
+func KeyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, errors.EncryptionError, "invalid client encryption key")
+	}
+	return cipher.NewGCM(block)
+}
+
+func nonce(prefix []byte, index uint32) []byte {
+	n := make([]byte, noncePrefixLen+4)
+	copy(n, prefix)
+	binary.BigEndian.PutUint32(n[noncePrefixLen:], index)
+	return n
+}
+
+// chunkAD marks the final chunk so a truncated object fails to decrypt.
+func chunkAD(final bool) []byte {
+	if final {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// Encrypt reads plaintext from src and writes it sealed with key to dst.
+// The output is a header followed by AES-GCM sealed chunks of ChunkSize.
+func Encrypt(key []byte, src io.Reader, dst io.Writer) (int64, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return 0, err
+	}
+
+	header := make([]byte, headerLen)
+	copy(header, Magic)
+	if _, err := io.ReadFull(rand.Reader, header[len(Magic):]); err != nil {
+		return 0, errors.Wrap(err, errors.EncryptionError, "failed to generate nonce")
+	}
+	if _, err := dst.Write(header); err != nil {
+		return 0, err
+	}
+	written := int64(headerLen)
+	prefix := header[len(Magic):]
+
+	var (
+		br  = bufio.NewReader(src)
+		buf = make([]byte, ChunkSize, ChunkSize+aead.Overhead())
+	)
+	for index := uint32(0); ; index++ {
+		n, err := io.ReadFull(br, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return written, err
+		}
+
+		final := n < ChunkSize
+		if !final {
+			if _, err := br.Peek(1); err == io.EOF {
+				final = true
+			}
+		}
+
+		sealed := aead.Seal(buf[:0], nonce(prefix, index), buf[:n], chunkAD(final))
+		nw, err := dst.Write(sealed)
+		written += int64(nw)
+		if err != nil {
+			return written, err
+		}
+
+		if final {
+			return written, nil
+		}
+	}
+}
+
+// Decrypt reads an object produced by Encrypt from src and writes the
+// plaintext to dst. It fails if the object was modified or truncated.
+func Decrypt(key []byte, src io.Reader, dst io.Writer) (int64, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return 0, err
+	}
+
+	header := make([]byte, headerLen)
+	if _, err := io.ReadFull(src, header); err != nil {
+		return 0, errors.NewEncryptionError("object is not client encrypted")
+	}
+	if string(header[:len(Magic)]) != Magic {
+		return 0, errors.NewEncryptionError("object is not client encrypted")
+	}
+	prefix := header[len(Magic):]
+
+	var (
+		br      = bufio.NewReader(src)
+		buf     = make([]byte, ChunkSize+aead.Overhead())
+		written int64
+	)
+	for index := uint32(0); ; index++ {
+		n, err := io.ReadFull(br, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return written, err
+		}
+
+		final := n < len(buf)
+		if !final {
+			if _, err := br.Peek(1); err == io.EOF {
+				final = true
+			}
+		}
+
+		plain, err := aead.Open(buf[:0], nonce(prefix, index), buf[:n], chunkAD(final))
+		if err != nil {
+			return written, errors.NewEncryptionError("client encrypted object failed authentication")
+		}
+		if _, err := dst.Write(plain); err != nil {
+			return written, err
+		}
+		written += int64(len(plain))
+
+		if final {
+			return written, nil
+		}
+	}
+}
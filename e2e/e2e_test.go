@@ -0,0 +1,70 @@
+package e2e
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"github.com/anthdm/foreverstore/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func newKey(t *testing.T) []byte {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	assert.Nil(t, err)
+	return key
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	key := newKey(t)
+
+	for _, size := range []int{0, 1, ChunkSize - 1, ChunkSize, ChunkSize + 1, 3 * ChunkSize} {
+		data := make([]byte, size)
+		rand.Read(data)
+
+		sealed := new(bytes.Buffer)
+		n, err := Encrypt(key, bytes.NewReader(data), sealed)
+		assert.Nil(t, err)
+		assert.Equal(t, int64(sealed.Len()), n)
+		if size > 0 {
+			assert.False(t, bytes.Contains(sealed.Bytes(), data))
+		}
+
+		out := new(bytes.Buffer)
+		n, err = Decrypt(key, sealed, out)
+		assert.Nil(t, err, "size %d", size)
+		assert.Equal(t, int64(size), n)
+		assert.True(t, bytes.Equal(data, out.Bytes()))
+	}
+}
+
+func TestDecryptWithWrongKeyFails(t *testing.T) {
+	sealed := new(bytes.Buffer)
+	_, err := Encrypt(newKey(t), bytes.NewReader([]byte("secret")), sealed)
+	assert.Nil(t, err)
+
+	_, err = Decrypt(newKey(t), sealed, new(bytes.Buffer))
+	assert.True(t, errors.IsType(err, errors.EncryptionError))
+}
+
+func TestDecryptDetectsTruncation(t *testing.T) {
+	key := newKey(t)
+	data := make([]byte, 2*ChunkSize)
+
+	sealed := new(bytes.Buffer)
+	_, err := Encrypt(key, bytes.NewReader(data), sealed)
+	assert.Nil(t, err)
+
+	// Dropping the final chunk leaves a valid but non-final chunk at the end.
+	truncated := sealed.Bytes()[:headerLen+ChunkSize+16]
+	_, err = Decrypt(key, bytes.NewReader(truncated), new(bytes.Buffer))
+	assert.True(t, errors.IsType(err, errors.EncryptionError))
+}
+
+func TestKeyID(t *testing.T) {
+	key := newKey(t)
+	assert.Equal(t, KeyID(key), KeyID(key))
+	assert.NotEqual(t, KeyID(key), KeyID(newKey(t)))
+	assert.Len(t, KeyID(key), 16)
+}
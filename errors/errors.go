@@ -19,6 +19,12 @@ const (
 	FileNotFoundError ErrorType = "FILE_NOT_FOUND"
 	CorruptionError  ErrorType = "CORRUPTION_ERROR"
 	QuotaExceededError ErrorType = "QUOTA_EXCEEDED"
+	ObjectLockedError ErrorType = "OBJECT_LOCKED"
+	FencedError      ErrorType = "WRITE_FENCED"
+	ReadOnlyError    ErrorType = "READ_ONLY"
+	QuorumError      ErrorType = "QUORUM_NOT_MET"
+	ChecksumError    ErrorType = "CHECKSUM_MISMATCH"
+	RateLimitedError ErrorType = "RATE_LIMITED"
 	
 	// Security related errors
 	AuthenticationError ErrorType = "AUTHENTICATION_ERROR"
@@ -164,6 +170,39 @@ func NewQuotaExceededError(message string) *FileSystemError {
 	return New(QuotaExceededError, message)
 }
 
+// NewObjectLockedError creates a new error for a write to a locked object
+func NewObjectLockedError(key string) *FileSystemError {
+	return New(ObjectLockedError, fmt.Sprintf("object is locked: %s", key))
+}
+
+// NewFencedError creates a new error for a write fenced off by a newer
+// version or owner of an object
+func NewFencedError(message string) *FileSystemError {
+	return New(FencedError, message)
+}
+
+// NewReadOnlyError creates a new error for a write to a read-only node
+func NewReadOnlyError(message string) *FileSystemError {
+	return New(ReadOnlyError, message)
+}
+
+// NewQuorumError creates a new error for a write too few replicas confirmed
+func NewQuorumError(message string) *FileSystemError {
+	return New(QuorumError, message)
+}
+
+// NewChecksumError creates a new error for content that does not hash to
+// the checksum its client sent along
+func NewChecksumError(message string) *FileSystemError {
+	return New(ChecksumError, message)
+}
+
+// NewRateLimitedError creates a new error for a request past the rate the
+// node serves
+func NewRateLimitedError(message string) *FileSystemError {
+	return New(RateLimitedError, message)
+}
+
 // NewAuthenticationError creates a new authentication error
 func NewAuthenticationError(message string) *FileSystemError {
 	return New(AuthenticationError, message)
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/anthdm/foreverstore/errors"
+)
+
+// ErrorCount is the number of operations Op that failed with an error of
+// Type.
+type ErrorCount struct {
+	Op    string           `json:"op"`
+	Type  errors.ErrorType `json:"type"`
+	Count uint64           `json:"count"`
+}
+
+// errorCounts counts the operations that failed by operation and by the
+// type of their error, for dashboards to tell corruption or quota errors
+// from a flaky network.
+type errorCounts struct {
+	mu     sync.Mutex
+	counts map[errorCountKey]uint64
+}
+
+type errorCountKey struct {
+	op  string
+	typ errors.ErrorType
+}
+
+// add counts the failure of op with err, if it failed.
+func (c *errorCounts) add(op string, err error) {
+	if err == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.counts == nil {
+		c.counts = make(map[errorCountKey]uint64)
+	}
+	c.counts[errorCountKey{op: op, typ: errors.GetType(err)}]++
+}
+
+// ErrorCounts returns the number of operations that failed by operation and
+// error type, ordered by operation then type.
+func (s *FileServer) ErrorCounts() []ErrorCount {
+	c := &s.errorCounts
+	c.mu.Lock()
+	counts := make([]ErrorCount, 0, len(c.counts))
+	for k, n := range c.counts {
+		counts = append(counts, ErrorCount{Op: k.op, Type: k.typ, Count: n})
+	}
+	c.mu.Unlock()
+
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Op != counts[j].Op {
+			return counts[i].Op < counts[j].Op
+		}
+		return counts[i].Type < counts[j].Type
+	})
+	return counts
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/anthdm/foreverstore/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorCountsByOperationAndType(t *testing.T) {
+	s := createTestServer(":0", t.TempDir(), []string{})
+	assert.Empty(t, s.ErrorCounts())
+
+	assert.Nil(t, s.StoreLockedObject("invoice", bytes.NewReader([]byte("v1")), nil, &ObjectLock{}))
+	assert.NotNil(t, s.Store("invoice", bytes.NewReader([]byte("v2"))))
+	assert.NotNil(t, s.Delete("missing"))
+	assert.NotNil(t, s.Delete("missing"))
+	_, err := s.GetBatch(nil)
+	assert.NotNil(t, err)
+
+	assert.Equal(t, []ErrorCount{
+		{Op: "delete", Type: errors.FileNotFoundError, Count: 2},
+		{Op: "get_batch", Type: errors.InvalidInputError, Count: 1},
+		{Op: "store", Type: errors.ObjectLockedError, Count: 1},
+	}, s.ErrorCounts())
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/anthdm/foreverstore/errors"
+)
+
+// Moving data races with writing it: a rebalance, a repair or a migration
+// reads a version of an object and sends it on while a newer one is
+// stored, and the copy sent may land after the newer version and replace
+// it. Every version of an object carries an epoch (see ObjectMeta.Epoch),
+// which its replicas and migrated copies carry along, and a node refuses
+// a copy older than the version it holds. A migration also fences the
+// objects of the node it has copied to the node replacing it: their
+// writes are refused with a FencedError naming the new owner, for clients
+// to write there instead, until the node restarts.
+
+// nextEpoch returns the epoch of a version of an object stored at now,
+// replacing the version of metadata previous.
+func nextEpoch(previous ObjectMeta, now time.Time) uint64 {
+	epoch := uint64(now.UnixNano())
+	if epoch <= previous.Epoch {
+		epoch = previous.Epoch + 1
+	}
+	return epoch
+}
+
+// newerThan reports whether the version of metadata held is newer than a
+// copy at epoch. Copies without an epoch, sent by nodes that do not record
+// them, are taken for current.
+func newerThan(held ObjectMeta, epoch uint64) bool {
+	return epoch != 0 && held.Epoch > epoch
+}
+
+// checkEpoch returns a FencedError when the copy at epoch of the object
+// stored under key in namespace id is older than the version held.
+func (s *FileServer) checkEpoch(id, key string, epoch uint64) error {
+	held, err := s.store.ReadMeta(id, key)
+	if err != nil || !newerThan(held, epoch) {
+		return nil
+	}
+	return errors.NewFencedError("a newer version of the object is held").
+		WithContext("key", key).
+		WithContext("epoch", held.Epoch)
+}
+
+// writeFences holds the objects of the node fenced off by a migration.
+type writeFences struct {
+	mu sync.Mutex
+	// owners maps the key of each object fenced to the node it moved to.
+	owners map[string]string
+}
+
+// fence refuses the writes of the object stored under key from now on, as
+// it moved to owner.
+func (f *writeFences) fence(key, owner string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.owners == nil {
+		f.owners = make(map[string]string)
+	}
+	f.owners[key] = owner
+}
+
+// check returns a FencedError naming the new owner of the object stored
+// under key when it moved.
+func (f *writeFences) check(key string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	owner, ok := f.owners[key]
+	if !ok {
+		return nil
+	}
+	return errors.NewFencedError(fmt.Sprintf("object moved to %s: %s", owner, key)).
+		WithContext("owner", owner)
+}
+
+// replicaLock locks the replica stored under key for the peer id, for it to
+// be checked and replaced at once, and returns the function unlocking it.
+func (s *FileServer) replicaLock(id, key string) (unlock func()) {
+	return s.replicaLocks.lock(id + "/" + key)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/anthdm/foreverstore/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEpochsGrowAcrossStores(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	first := nextEpoch(ObjectMeta{}, now)
+	assert.Equal(t, uint64(now.UnixNano()), first)
+	// Stores within the same nanosecond, or behind a clock set back, still
+	// move the epoch on.
+	assert.Equal(t, first+1, nextEpoch(ObjectMeta{Epoch: first}, now))
+	assert.Equal(t, first+1, nextEpoch(ObjectMeta{Epoch: first}, now.Add(-time.Hour)))
+
+	assert.True(t, newerThan(ObjectMeta{Epoch: 2}, 1))
+	assert.False(t, newerThan(ObjectMeta{Epoch: 2}, 2))
+	assert.False(t, newerThan(ObjectMeta{Epoch: 2}, 0))
+}
+
+func TestStaleReplicasAreRefused(t *testing.T) {
+	c := newTestCluster(t, 2)
+	owner, peer := c.nodes[0], c.nodes[1]
+
+	c.store(0, "docs/report", []byte("first draft"))
+	first, err := owner.Meta("docs/report")
+	assert.Nil(t, err)
+	c.store(0, "docs/report", []byte("final version"))
+	last, err := owner.Meta("docs/report")
+	assert.Nil(t, err)
+	assert.Greater(t, last.Epoch, first.Epoch)
+	c.eventually("the last version to be replicated", func() bool {
+		held, err := peer.store.ReadMeta(owner.ID, hashKey("docs/report"))
+		return err == nil && held.Epoch == last.Epoch
+	})
+
+	// A repair that read the first version sends it on after the last one.
+	msg := owner.storeFileMessage("docs/report", first, int64(len("first draft")))
+	err = peer.receiveReplica(nil, owner.Transport.Addr(), msg, bytes.NewReader(make([]byte, msg.Size)))
+	assert.True(t, errors.IsType(err, errors.FencedError))
+	held, err := peer.store.ReadMeta(owner.ID, hashKey("docs/report"))
+	assert.Nil(t, err)
+	assert.Equal(t, last.Epoch, held.Epoch)
+	assert.Equal(t, last.HMAC, held.HMAC)
+}
+
+func TestMigrationFencesMovedObjects(t *testing.T) {
+	c := newTestCluster(t, 3)
+	source, target := c.nodes[0], c.nodes[2]
+	c.store(0, "docs/report", []byte("quarterly report"))
+
+	// The source misses the last version of an object of node 1 while it is
+	// cut off, and holds an older replica than the target.
+	c.store(1, "logs/app", []byte("first lines"))
+	c.partition([]int{0})
+	c.store(1, "logs/app", []byte("first lines, and more"))
+	c.heal()
+	last, err := c.nodes[1].Meta("logs/app")
+	assert.Nil(t, err)
+
+	status := c.migrate(0, 2)
+	assert.Zero(t, status.Failed)
+
+	// The target keeps the newer replica.
+	held, err := target.store.ReadMeta(c.nodes[1].ID, hashKey("logs/app"))
+	assert.Nil(t, err)
+	assert.Equal(t, last.Epoch, held.Epoch)
+	assert.Equal(t, last.HMAC, held.HMAC)
+
+	// Writes of the objects moved are refused on the source, pointing to the
+	// target, which takes them.
+	err = source.Store("docs/report", bytes.NewReader([]byte("written too late")))
+	if assert.True(t, errors.IsType(err, errors.FencedError)) {
+		assert.Equal(t, target.Transport.Addr(), err.(*errors.FileSystemError).Context["owner"])
+	}
+	assert.True(t, errors.IsType(source.Delete("docs/report"), errors.FencedError))
+	assert.Equal(t, []byte("quarterly report"), c.get(0, "docs/report"))
+	c.store(2, "docs/report", []byte("written on the target"))
+	assert.Equal(t, []byte("written on the target"), c.get(2, "docs/report"))
+
+	// Objects the migration did not move are still written on the source.
+	c.store(0, "docs/new", []byte("written after the migration"))
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/anthdm/foreverstore/errors"
+	"github.com/anthdm/foreverstore/p2p"
+)
+
+const (
+	// fetchPeerTimeout bounds the wait for the peers asked whether they
+	// hold an object to answer.
+	fetchPeerTimeout = 5 * time.Second
+	// fetchStreamTimeout bounds the wait for a peer that said it holds an
+	// object to start streaming it. Peers answer every request for an
+	// object, those they cannot serve included, so only a peer that hung
+	// takes this long.
+	fetchStreamTimeout = 15 * time.Second
+)
+
+// fetchOrder returns the peers to ask for an object of this node: first
+// those its replicas were placed on, as placement ranks them, then the
+// others. In each, the peers of this node's site come first.
+func (s *FileServer) fetchOrder(key string) (replicas, others []string) {
+	addrs := s.peerAddrs()
+	s.rankPeers(key, addrs)
+
+	policy := s.bucketPolicy(key)
+	for _, addr := range addrs {
+		placed := policy.AllowsSite(s.peerSite(addr)) &&
+			(policy.ReplicationFactor == 0 || len(replicas) < policy.ReplicationFactor-1)
+		if placed {
+			replicas = append(replicas, addr)
+		} else {
+			others = append(others, addr)
+		}
+	}
+	for _, group := range [][]string{replicas, others} {
+		group := group
+		sort.SliceStable(group, func(i, j int) bool {
+			return s.sameSite(group[i]) && !s.sameSite(group[j])
+		})
+	}
+	return replicas, others
+}
+
+// fetchFromAny asks the peers at addrs whether they hold the object of
+// this node stored under key, and fetches it with fetch from the first to
+// answer that it does, then from the next if that fails. Peers that have
+// not answered within fetchPeerTimeout are given up on.
+func (s *FileServer) fetchFromAny(key string, addrs []string, t *opTrace, fetch func(addr string, peer p2p.Peer) error) error {
+	type answer struct {
+		addr   string
+		status MessageReplicaStatus
+		err    error
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	msg := MessageCheckReplica{ID: s.ID, Key: hashKey(key), PresenceOnly: true}
+	answers := make(chan answer, len(addrs))
+	for _, addr := range addrs {
+		go func(addr string) {
+			status, err := requestAs[MessageReplicaStatus](ctx, s, addr, msg)
+			answers <- answer{addr: addr, status: status, err: err}
+		}(addr)
+	}
+
+	var lastErr error = errors.NewNetworkError("no peers provided the requested file")
+	start := t.now()
+	deadline := s.Clock.After(fetchPeerTimeout)
+	for received := 0; received < len(addrs); received++ {
+		select {
+		case a := <-answers:
+			if a.err != nil {
+				s.logger.Warn("Peer %s did not say whether it holds %s: %v", a.addr, key, a.err)
+				continue
+			}
+			peer, ok := s.peer(a.addr)
+			if !a.status.Present || !ok {
+				continue
+			}
+			t.since("peer_request", start)
+			if lastErr = fetch(a.addr, peer); lastErr == nil {
+				return nil
+			}
+		case <-deadline:
+			s.logger.Warn("Fetch of %s timed out with %d of %d peers answered", key, received, len(addrs))
+			return lastErr
+		}
+	}
+	return lastErr
+}
+
+// fetchFrom asks the peer at addr for the object of this node stored under
+// key and stores it locally, resuming the fetch that was cut off before if
+// any. A peer that lacks it says so, and is given up on at once. A peer
+// that neither says so nor starts streaming it within fetchStreamTimeout is
+// dropped, as what it streams later would be taken for the answer to
+// another request.
+func (s *FileServer) fetchFrom(key, addr string, peer p2p.Peer, t *opTrace) error {
+	msg := MessageGetFile{ID: s.ID, Key: hashKey(key), From: s.resumeOffset(key)}
+	if msg.From > 0 {
+		s.logger.Info("Resuming fetch of %s from peer %s at byte %d", key, addr, msg.From)
+	}
+	err := s.streamFrom(key, addr, peer, msg, t, func(stream p2p.Peer, _ MessageGetFileResponse) error {
+		return s.receiveFile(addr, stream, key, msg.From)
+	})
+	if err != nil && msg.From > 0 && s.resumeOffset(key) == 0 {
+		// What was staged was dropped, as it belonged to another version
+		// of the object: start over.
+		s.logger.Warn("Resumed fetch of %s from peer %s failed, fetching it whole: %v", key, addr, err)
+		return s.fetchFrom(key, addr, peer, t)
+	}
+	return err
+}
+
+// fetchRangeFrom asks the peer at addr for the sealed chunks of the object
+// of this node stored under key covering length bytes of it from offset,
+// and returns their plaintext along with the size of the object. Nothing
+// is stored locally.
+func (s *FileServer) fetchRangeFrom(key, addr string, peer p2p.Peer, offset, length int64, t *opTrace) (data []byte, size int64, err error) {
+	msg := MessageGetFile{ID: s.ID, Key: hashKey(key), Offset: offset, Length: length}
+	err = s.streamFrom(key, addr, peer, msg, t, func(stream p2p.Peer, resp MessageGetFileResponse) error {
+		defer stream.CloseStream()
+		data, size, err = s.readFetchedRange(addr, stream, key, resp, offset, length)
+		return err
+	})
+	return data, size, err
+}
+
+// streamFrom sends msg to the peer at addr and, once it answered that it
+// has the object, hands its stream to receive.
+func (s *FileServer) streamFrom(key, addr string, peer p2p.Peer, msg MessageGetFile, t *opTrace, receive func(stream p2p.Peer, resp MessageGetFileResponse) error) error {
+	start := t.now()
+	answer := s.gets.expect(addr, msg)
+	defer s.gets.done(addr, msg)
+	if err := s.sendMessage(peer, &Message{Payload: msg}); err != nil {
+		return err
+	}
+
+	deadline := s.Clock.After(fetchStreamTimeout)
+	timedOut := func() error {
+		s.logger.Warn("Peer %s did not send %s in time, dropping it", addr, key)
+		s.dropPeer(addr)
+		return errors.NewTimeoutError(fmt.Sprintf("peer %s did not send %s in time", addr, key))
+	}
+	var resp MessageGetFileResponse
+	select {
+	case resp = <-answer:
+		if !resp.Found {
+			t.since(fmt.Sprintf("peer_wait[%s]", addr), start)
+			return errors.New(resp.ErrorType, resp.Error).WithContext("peer", addr)
+		}
+	case <-deadline:
+		return timedOut()
+	}
+
+	stream := &streamStart{Peer: peer, started: make(chan struct{})}
+	done := make(chan error, 1)
+	go func() { done <- receive(stream, resp) }()
+
+	var err error
+	select {
+	case <-stream.started:
+		t.since(fmt.Sprintf("peer_wait[%s]", addr), start)
+		err = <-done
+	case err = <-done:
+	case <-deadline:
+		err = timedOut()
+		<-done
+		return err
+	}
+	t.since(fmt.Sprintf("receive[%s]", addr), start)
+	return err
+}
+
+// resumeOffset returns the offset into the replica of the object stored
+// under key from which a fetch can resume with what a fetch that was cut
+// off staged, or 0 when there is nothing to resume. Only the chunked
+// formats recording the cipher suite, or implying it, can be resumed.
+func (s *FileServer) resumeOffset(key string) int64 {
+	size, r, err := s.store.Staged(s.ID, key)
+	if err != nil {
+		return 0
+	}
+	defer r.Close()
+
+	header := make([]byte, gcmHeaderLenV3)
+	n, _ := io.ReadFull(r, header)
+	if n < len(gcmMagic) {
+		return 0
+	}
+	if magic := string(header[:len(gcmMagic)]); magic != gcmMagic && magic != gcmMagicV3 {
+		return 0
+	}
+	h, err := parseGCMHeader(header[:n])
+	if err != nil || h.chunkSize != gcmChunkSize {
+		return 0
+	}
+	return gcmResumeOffset(h.suite, size)
+}
+
+// pendingGets are the MessageGetFile sent to peers, by peer address, each
+// waiting for the MessageGetFileResponse of the peer.
+type pendingGets struct {
+	mu      sync.Mutex
+	pending map[string]map[MessageGetFile]chan MessageGetFileResponse
+}
+
+// expect records that msg is about to be sent to the peer at addr, and
+// returns the channel its answer is delivered on.
+func (g *pendingGets) expect(addr string, msg MessageGetFile) <-chan MessageGetFileResponse {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.pending == nil {
+		g.pending = make(map[string]map[MessageGetFile]chan MessageGetFileResponse)
+	}
+	if g.pending[addr] == nil {
+		g.pending[addr] = make(map[MessageGetFile]chan MessageGetFileResponse)
+	}
+	answer := make(chan MessageGetFileResponse, 1)
+	g.pending[addr][msg] = answer
+	return answer
+}
+
+// done stops waiting for the answer to msg.
+func (g *pendingGets) done(addr string, msg MessageGetFile) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.pending[addr], msg)
+	if len(g.pending[addr]) == 0 {
+		delete(g.pending, addr)
+	}
+}
+
+// answer delivers resp to the get it answers, and reports whether one was
+// waiting for it.
+func (g *pendingGets) answer(addr string, resp MessageGetFileResponse) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	answer, ok := g.pending[addr][resp.request()]
+	if !ok {
+		return false
+	}
+	select {
+	case answer <- resp:
+	default:
+	}
+	return true
+}
+
+// forget answers the gets sent to the peer at addr, which disconnected,
+// with a failure.
+func (g *pendingGets) forget(addr string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for msg, answer := range g.pending[addr] {
+		resp := msg.answer()
+		resp.Error, resp.ErrorType = "peer disconnected", errors.ConnectionError
+		select {
+		case answer <- resp:
+		default:
+		}
+	}
+}
+
+func (s *FileServer) handleMessageGetFileResponse(from string, msg MessageGetFileResponse) error {
+	if !s.gets.answer(from, msg) {
+		s.logger.Debug("Ignoring answer from %s to unknown get of %s", from, msg.Key)
+	}
+	return nil
+}
+
+// streamStart is a peer whose started channel is closed once the stream it
+// sends begins.
+type streamStart struct {
+	p2p.Peer
+	once    sync.Once
+	started chan struct{}
+}
+
+func (p *streamStart) Read(b []byte) (int, error) {
+	n, err := p.Peer.Read(b)
+	if n > 0 {
+		p.once.Do(func() { close(p.started) })
+	}
+	return n, err
+}
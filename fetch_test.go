@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/anthdm/foreverstore/config"
+	"github.com/anthdm/foreverstore/errors"
+	"github.com/anthdm/foreverstore/p2p"
+	"github.com/stretchr/testify/assert"
+)
+
+// checkCountingTransport counts the replica checks its node receives, and
+// records the objects it is asked for.
+type checkCountingTransport struct {
+	p2p.Transport
+	rpcs   chan p2p.RPC
+	checks int64
+
+	mu   sync.Mutex
+	gets []MessageGetFile
+}
+
+func countReplicaChecks(t p2p.Transport) *checkCountingTransport {
+	ct := &checkCountingTransport{Transport: t, rpcs: make(chan p2p.RPC)}
+	go func() {
+		defer close(ct.rpcs)
+		for rpc := range t.Consume() {
+			var env Envelope
+			var msg Message
+			format := rpcFormat(rpc)
+			if format.unmarshal(rpc.Payload, &env) == nil && format.unmarshal(env.Body, &msg) == nil {
+				if req, ok := msg.Payload.(MessageRequest); ok {
+					if _, ok := req.Payload.(MessageCheckReplica); ok {
+						atomic.AddInt64(&ct.checks, 1)
+					}
+				}
+				if get, ok := msg.Payload.(MessageGetFile); ok {
+					ct.mu.Lock()
+					ct.gets = append(ct.gets, get)
+					ct.mu.Unlock()
+				}
+			}
+			ct.rpcs <- rpc
+		}
+	}()
+	return ct
+}
+
+func (t *checkCountingTransport) Consume() <-chan p2p.RPC {
+	return t.rpcs
+}
+
+// fetches returns the objects the node was asked for.
+func (t *checkCountingTransport) fetches() []MessageGetFile {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]MessageGetFile(nil), t.gets...)
+}
+
+func TestFetchAsksTheReplicasFirst(t *testing.T) {
+	c := newTestCluster(t, 4)
+	s := c.nodes[0]
+	policy := config.BucketPolicy{Bucket: "logs", ReplicationFactor: 2}
+	assert.Nil(t, c.run("policy to be distributed", func() error { return s.SetBucketPolicy(policy) }))
+
+	c.store(0, "logs/today", []byte("a few lines"))
+	var holder string
+	c.eventually("the replica to be placed", func() bool {
+		for node := 1; node < len(c.nodes); node++ {
+			if c.holds(node, 0, "logs/today") {
+				holder = c.nodes[node].Transport.Addr()
+				return true
+			}
+		}
+		return false
+	})
+
+	replicas, others := s.fetchOrder("logs/today")
+	assert.Equal(t, []string{holder}, replicas)
+	assert.Len(t, others, 2)
+
+	// Objects replicated to every peer are asked of all of them at once.
+	replicas, others = s.fetchOrder("media/cat")
+	assert.Len(t, replicas, 3)
+	assert.Empty(t, others)
+
+	assert.Nil(t, s.store.Delete(s.ID, "logs/today"))
+	assert.Equal(t, []byte("a few lines"), c.get(0, "logs/today"))
+}
+
+func TestConfiguredReplicationFactorPlacesOnTheRingOwners(t *testing.T) {
+	c := newTestClusterWith(t, 4, func(node int, opts *FileServerOpts) {
+		opts.Config = &config.Config{ReplicationFactor: 2}
+	})
+	s := c.nodes[0]
+	holders := func(key string) []string {
+		var addrs []string
+		for node := 1; node < len(c.nodes); node++ {
+			if c.holds(node, 0, key) {
+				addrs = append(addrs, c.nodes[node].Transport.Addr())
+			}
+		}
+		return addrs
+	}
+
+	// Buckets without a policy keep as many copies as the configuration
+	// says: one replica, on the first owner of the key.
+	c.store(0, "media/cat", []byte("a picture"))
+	replicas, _ := s.fetchOrder("media/cat")
+	assert.Len(t, replicas, 1)
+	assert.Equal(t, replicas, holders("media/cat"))
+
+	assert.Nil(t, s.store.Delete(s.ID, "media/cat"))
+	assert.Equal(t, []byte("a picture"), c.get(0, "media/cat"))
+
+	// The replication factor follows the cluster settings.
+	cs := s.ClusterSettings()
+	cs.ReplicationFactor = 3
+	assert.Nil(t, c.run("settings to be distributed", func() error { return s.DistributeSettings(cs) }))
+	c.store(0, "media/dog", []byte("another picture"))
+	replicas, _ = s.fetchOrder("media/dog")
+	assert.Len(t, replicas, 2)
+	assert.ElementsMatch(t, replicas, holders("media/dog"))
+}
+
+func TestFetchAsksOnlyTheRingOwners(t *testing.T) {
+	counters := make([]*checkCountingTransport, 5)
+	c := newTestClusterWith(t, 5, func(node int, opts *FileServerOpts) {
+		opts.Config = &config.Config{ReplicationFactor: 2}
+		counters[node] = countReplicaChecks(opts.Transport)
+		opts.Transport = counters[node]
+	})
+	s := c.nodes[0]
+	checks := func() (n int64) {
+		for _, ct := range counters {
+			n += atomic.LoadInt64(&ct.checks)
+		}
+		return n
+	}
+
+	c.store(0, "media/cat", []byte("a picture"))
+	replicas, _ := s.fetchOrder("media/cat")
+	assert.Len(t, replicas, 1)
+
+	// The owner holds the replica: it is the only peer asked.
+	before := checks()
+	assert.Nil(t, s.store.Delete(s.ID, "media/cat"))
+	assert.Equal(t, []byte("a picture"), c.get(0, "media/cat"))
+	assert.Equal(t, int64(1), checks()-before)
+
+	// The owner lost it: the DHT is looked up rather than the other peers
+	// asked, and nobody provides it.
+	owner := c.nodes[1]
+	for _, node := range c.nodes[1:] {
+		if node.Transport.Addr() == replicas[0] {
+			owner = node
+		}
+	}
+	assert.Nil(t, owner.store.Delete(s.ID, hashKey("media/cat")))
+	assert.Nil(t, s.store.Delete(s.ID, "media/cat"))
+	before = checks()
+	assert.Nil(t, c.run("fetch", func() error {
+		s.fetchLock.Lock()
+		defer s.fetchLock.Unlock()
+		assert.NotNil(t, s.requestFile("media/cat", nil))
+		return nil
+	}))
+	assert.Equal(t, int64(1), checks()-before)
+	assert.Equal(t, int64(1), s.DHT().Lookups)
+}
+
+func TestFetchIsNotHeldUpBySilentPeers(t *testing.T) {
+	c := newTestCluster(t, 3)
+	s := c.nodes[0]
+	c.store(0, "shared", []byte("still there"))
+	c.assertConverged(0, "shared")
+
+	// node-2 no longer answers: the replica of node-1 is fetched without
+	// waiting for it.
+	c.partition([]int{0, 1})
+	assert.Nil(t, s.store.Delete(s.ID, "shared"))
+	start := c.clock.Now()
+	assert.Equal(t, []byte("still there"), c.get(0, "shared"))
+	assert.Less(t, c.clock.Now().Sub(start), fetchPeerTimeout)
+
+	// Once node-1 lost its replica too, the fetch gives up after one
+	// deadline.
+	assert.Nil(t, s.store.Delete(s.ID, "shared"))
+	assert.Nil(t, c.nodes[1].store.Delete(s.ID, hashKey("shared")))
+	assert.Nil(t, c.run("fetch", func() error {
+		s.fetchLock.Lock()
+		defer s.fetchLock.Unlock()
+		start := c.clock.Now()
+		assert.NotNil(t, s.requestFile("shared", nil))
+		assert.LessOrEqual(t, c.clock.Now().Sub(start), fetchPeerTimeout+clusterStep)
+		return nil
+	}))
+}
+
+func TestFetchFromAPeerLackingTheObjectEndsAtOnce(t *testing.T) {
+	c := newTestCluster(t, 2)
+	s := c.nodes[0]
+	addr := c.nodes[1].Transport.Addr()
+	peer, ok := s.peer(addr)
+	assert.True(t, ok)
+
+	// The peer says it lacks the object rather than leave the fetch
+	// waiting for a stream, and stays connected.
+	assert.Nil(t, c.run("fetch", func() error {
+		s.fetchLock.Lock()
+		defer s.fetchLock.Unlock()
+		start := c.clock.Now()
+		err := s.fetchFrom("missing", addr, peer, nil)
+		assert.Equal(t, errors.FileNotFoundError, errors.GetType(err))
+		assert.Less(t, c.clock.Now().Sub(start), fetchStreamTimeout)
+		return nil
+	}))
+	_, ok = s.peer(addr)
+	assert.True(t, ok)
+
+	c.store(0, "present", []byte("here"))
+	c.assertConverged(0, "present")
+	assert.Nil(t, s.store.Delete(s.ID, "present"))
+	assert.Equal(t, []byte("here"), c.get(0, "present"))
+}
+
+// testPayload returns n bytes of content that differs from chunk to chunk.
+func testPayload(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i * 7 / 3)
+	}
+	return b
+}
+
+// lastReceived returns the last transfer node received.
+func lastReceived(t *testing.T, s *FileServer) Transfer {
+	for _, tr := range s.Transfers().Recent {
+		if tr.Direction == TransferReceive {
+			return tr
+		}
+	}
+	t.Fatal("nothing was received")
+	return Transfer{}
+}
+
+func TestRangedGetFetchesOnlyTheChunksCovered(t *testing.T) {
+	c := newTestCluster(t, 2)
+	s := c.nodes[0]
+	payload := testPayload(5*gcmChunkSize + 100)
+	c.store(0, "video", payload)
+	c.assertConverged(0, "video")
+	assert.Nil(t, s.store.Delete(s.ID, "video"))
+
+	getRange := func(offset, length int64) ([]byte, int64, error) {
+		var (
+			data []byte
+			size int64
+		)
+		err := c.run("ranged get", func() error {
+			r, n, err := s.GetRange("video", offset, length)
+			if err != nil {
+				return err
+			}
+			defer r.Close()
+			size = n
+			data, err = io.ReadAll(r)
+			return err
+		})
+		return data, size, err
+	}
+
+	// A range within one chunk brings over that chunk and the header only,
+	// and the object is not stored locally.
+	data, size, err := getRange(3*gcmChunkSize+10, 1000)
+	assert.Nil(t, err)
+	assert.Equal(t, payload[3*gcmChunkSize+10:3*gcmChunkSize+1010], data)
+	assert.Equal(t, int64(len(payload)), size)
+	assert.Less(t, lastReceived(t, s).Size, int64(gcmChunkSize+100))
+	assert.False(t, s.store.Has(s.ID, "video"))
+
+	// Ranges spanning chunks, and running to the end of the object.
+	data, _, err = getRange(gcmChunkSize-5, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, payload[gcmChunkSize-5:gcmChunkSize+5], data)
+	data, _, err = getRange(4*gcmChunkSize, -1)
+	assert.Nil(t, err)
+	assert.Equal(t, payload[4*gcmChunkSize:], data)
+
+	_, _, err = getRange(int64(len(payload))+1, 10)
+	assert.True(t, errors.IsType(err, errors.InvalidInputError), "%v", err)
+
+	// A local object is read in place.
+	c.store(0, "video", payload)
+	data, _, err = getRange(10, 20)
+	assert.Nil(t, err)
+	assert.Equal(t, payload[10:30], data)
+}
+
+func TestInterruptedFetchResumes(t *testing.T) {
+	counters := make([]*checkCountingTransport, 2)
+	c := newTestClusterWith(t, 2, func(node int, opts *FileServerOpts) {
+		counters[node] = countReplicaChecks(opts.Transport)
+		opts.Transport = counters[node]
+	})
+	s := c.nodes[0]
+	payload := testPayload(4*gcmChunkSize + 100)
+	c.store(0, "video", payload)
+	c.assertConverged(0, "video")
+
+	// What a fetch cut off halfway through the replica leaves behind.
+	_, replica, err := c.nodes[1].store.Read(s.ID, hashKey("video"))
+	assert.Nil(t, err)
+	ciphertext, _ := io.ReadAll(replica)
+	replica.(io.Closer).Close()
+	cutOff := int64(len(ciphertext) / 2)
+	assert.Nil(t, s.store.Delete(s.ID, "video"))
+	_, err = s.store.WriteStaged(s.ID, "video", 0, bytes.NewReader(ciphertext[:cutOff]))
+	assert.Nil(t, err)
+
+	// The next fetch asks for the rest from the last complete chunk on.
+	resumeAt := gcmResumeOffset(CipherSuiteAESGCM, cutOff)
+	assert.Equal(t, payload, c.get(0, "video"))
+	gets := counters[1].fetches()
+	if assert.Len(t, gets, 1) {
+		assert.Equal(t, resumeAt, gets[0].From)
+	}
+	assert.Equal(t, int64(len(ciphertext))-resumeAt, lastReceived(t, s).Size)
+	_, _, err = s.store.Staged(s.ID, "video")
+	assert.True(t, os.IsNotExist(err), "%v", err)
+
+	// What was staged for another version of the object is dropped, and
+	// the object fetched whole.
+	c.store(0, "video", append(payload, 'x'))
+	c.eventually("the new replica", func() bool {
+		_, meta, err := c.nodes[1].store.Stat(s.ID, hashKey("video"))
+		return err == nil && bytes.Equal(meta.HMAC, mustMeta(t, s, "video").HMAC)
+	})
+	assert.Nil(t, s.store.Delete(s.ID, "video"))
+	_, err = s.store.WriteStaged(s.ID, "video", 0, bytes.NewReader(ciphertext[:cutOff]))
+	assert.Nil(t, err)
+	assert.Equal(t, append(payload, 'x'), c.get(0, "video"))
+	gets = counters[1].fetches()
+	if assert.Len(t, gets, 3) {
+		assert.Equal(t, resumeAt, gets[1].From)
+		assert.Zero(t, gets[2].From)
+	}
+}
+
+// mustMeta returns the metadata of the object s stored under key.
+func mustMeta(t *testing.T, s *FileServer, key string) ObjectMeta {
+	t.Helper()
+	meta, err := s.store.ReadMeta(s.ID, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return meta
+}
@@ -0,0 +1,569 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anthdm/foreverstore/errors"
+)
+
+// A follower is a warm standby of another node, its leader: it copies the
+// objects of the leader, or of one of its buckets, into its own namespace
+// and keeps them current by tailing the change feed of the leader, serving
+// reads but refusing writes. The follower
+// stays out of the cluster until it is promoted, when it starts taking
+// writes, joins the cluster through its bootstrap nodes and replicates the
+// objects it holds to its new peers.
+
+// followPageSize is the number of objects of the leader listed at a time.
+const followPageSize = 500
+
+// A promoted follower waits up to promoteConnectTimeout for a peer to
+// connect, checking every promotePollInterval, before it replicates its
+// objects.
+const (
+	promoteConnectTimeout = 30 * time.Second
+	promotePollInterval   = 100 * time.Millisecond
+)
+
+// FollowedObject describes an object of the leader.
+type FollowedObject struct {
+	// ETag identifies the version of the object on the leader.
+	ETag string
+	// SHA256 is the checksum of the object on the leader, nil when the
+	// leader did not record one.
+	SHA256   []byte
+	Client   *ClientMeta
+	Lock     *ObjectLock
+	StoredAt time.Time
+	// Size is the number of bytes of the object, -1 when unknown.
+	Size int64
+}
+
+// FollowSource is the leader of a follower.
+type FollowSource interface {
+	// Addr names the leader.
+	Addr() string
+	// List returns a page of the objects of the leader; see
+	// FileServer.List.
+	List(prefix, cursor string, limit int) ([]StoreEntry, string, error)
+	// Fetch returns the object of the leader stored under key, with a nil
+	// body when its ETag is still etag.
+	Fetch(key, etag string) (FollowedObject, io.ReadCloser, error)
+	// Changes returns a page of the change feed of the leader; see
+	// FileServer.Changes.
+	Changes(ctx context.Context, bucket string, cursor uint64, limit int, wait time.Duration) (ChangeList, error)
+}
+
+// FollowStatus reports the sync of a follower with its leader.
+type FollowStatus struct {
+	// Following is set while the node is a follower, and PromotedAt once
+	// it was promoted.
+	Following  bool      `json:"following"`
+	Leader     string    `json:"leader,omitempty"`
+	Bucket     string    `json:"bucket,omitempty"`
+	PromotedAt time.Time `json:"promoted_at,omitempty"`
+	// LastSync is when the follower last caught up with its leader.
+	LastSync time.Time `json:"last_sync,omitempty"`
+	// Copied and Deleted count the objects copied from the leader and
+	// those deleted as the leader no longer has them; Failed counts the
+	// objects that could not be synced, and are tried again.
+	Copied    int    `json:"copied"`
+	Deleted   int    `json:"deleted"`
+	Failed    int    `json:"failed"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+type follower struct {
+	mu     sync.Mutex
+	status FollowStatus
+	// stopch is closed when the node is promoted.
+	stopch chan struct{}
+	// tailing is set once every object of the leader was synced, for the
+	// follower to apply the changes of the leader after cursor. Both are
+	// used by the follow loop only.
+	tailing bool
+	cursor  uint64
+}
+
+// following reports whether the node is a read-only follower.
+func (s *FileServer) following() bool {
+	s.follow.mu.Lock()
+	defer s.follow.mu.Unlock()
+	return s.follow.status.Following
+}
+
+// checkWritable fails while the node is a read-only follower, or read-only
+// for the health of its disk.
+func (s *FileServer) checkWritable() error {
+	if err := s.checkLeader(); err != nil {
+		return err
+	}
+	return s.disk.writable()
+}
+
+// checkLeader fails while the node is a read-only follower.
+func (s *FileServer) checkLeader() error {
+	if !s.following() {
+		return nil
+	}
+	return errors.NewValidationError(fmt.Sprintf("node is a read-only follower of %s", s.Follow.Addr()))
+}
+
+// FollowStatus returns the sync of the node with its leader.
+func (s *FileServer) FollowStatus() FollowStatus {
+	s.follow.mu.Lock()
+	defer s.follow.mu.Unlock()
+	return s.follow.status
+}
+
+func (s *FileServer) updateFollow(fn func(*FollowStatus)) {
+	s.follow.mu.Lock()
+	defer s.follow.mu.Unlock()
+	fn(&s.follow.status)
+}
+
+// Promote makes the follower a full member of the cluster: it stops
+// syncing with its leader, takes writes, connects to its bootstrap nodes
+// and replicates its objects to them in a rebalance job.
+func (s *FileServer) Promote(by string) (FollowStatus, error) {
+	s.follow.mu.Lock()
+	if !s.follow.status.Following {
+		s.follow.mu.Unlock()
+		return FollowStatus{}, errors.NewValidationError("node is not a follower")
+	}
+	s.follow.status.Following = false
+	s.follow.status.PromotedAt = s.Clock.Now()
+	close(s.follow.stopch)
+	status := s.follow.status
+	s.follow.mu.Unlock()
+
+	s.logger.Info("Promoted from follower of %s by %s", status.Leader, by)
+	if err := s.bootstrapNetwork(); err != nil {
+		s.logger.Warn("Bootstrap network failed: %v", err)
+	}
+	go s.replicatePromoted(by)
+	return status, nil
+}
+
+// replicatePromoted starts the rebalance job replicating the objects of the
+// promoted follower once a peer is connected: dialed peers connect in the
+// background. Without a peer within promoteConnectTimeout, the job is left
+// to be started through the admin API.
+func (s *FileServer) replicatePromoted(by string) {
+	deadline := s.Clock.Now().Add(promoteConnectTimeout)
+	for len(s.connectedPeers()) == 0 {
+		if !s.Clock.Now().Before(deadline) {
+			s.logger.Warn("No peer connected to replicate the objects of the promoted follower to")
+			return
+		}
+		select {
+		case <-s.Clock.After(promotePollInterval):
+		case <-s.quitch:
+			return
+		}
+	}
+	if _, err := s.StartJob(JobRebalance, by); err != nil {
+		s.logger.Warn("Failed to replicate the objects of the promoted follower: %v", err)
+	}
+}
+
+// followLoop keeps the node in sync with its leader until it is promoted
+// or the server stops: it copies every object of the leader once, then
+// tails the change feed of the leader, waiting up to FollowInterval for
+// each change. Failed syncs are tried again every FollowInterval.
+func (s *FileServer) followLoop() {
+	ticker := s.Clock.NewTicker(s.FollowInterval)
+	defer ticker.Stop()
+	// ctx ends the wait for changes once the follower stops.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-s.follow.stopch:
+		case <-s.quitch:
+		}
+		cancel()
+	}()
+
+	for {
+		var ok bool
+		if s.follow.tailing {
+			ok = s.tailFollow(ctx)
+		} else {
+			ok = s.syncFollow(ctx)
+		}
+		if s.followStopped() {
+			return
+		}
+		if ok {
+			continue
+		}
+		select {
+		case <-ticker.C():
+		case <-s.follow.stopch:
+			return
+		case <-s.quitch:
+			return
+		}
+	}
+}
+
+// followStopped reports whether the node stopped following its leader:
+// once it is promoted or the server stops.
+func (s *FileServer) followStopped() bool {
+	select {
+	case <-s.quitch:
+		return true
+	default:
+		return !s.following()
+	}
+}
+
+// syncFollow copies the objects of the leader that changed since they were
+// last copied, and deletes the copies of those it no longer has. Once
+// done, the follower tails the change feed of the leader from where it
+// was when the sync started. It reports whether the sync went through
+// every object.
+func (s *FileServer) syncFollow(ctx context.Context) bool {
+	head, err := s.Follow.Changes(ctx, s.FollowBucket, 0, 1, 0)
+	if err != nil {
+		s.followFailed("Failed to read the change feed of leader %s: %v", err)
+		return false
+	}
+
+	leader := make(map[string]bool)
+	failed := false
+	for cursor := ""; ; {
+		entries, next, err := s.Follow.List(s.followPrefix(), cursor, followPageSize)
+		if err != nil {
+			s.followFailed("Failed to list the objects of leader %s: %v", err)
+			return false
+		}
+		for _, entry := range entries {
+			if entry.Key == "" {
+				continue
+			}
+			leader[entry.Key] = true
+			if s.followObject(entry.Key) != nil {
+				failed = true
+			}
+			if s.followStopped() {
+				return false
+			}
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+
+	for cursor := ""; ; {
+		entries, next, err := s.store.Iterate(s.ID, s.followPrefix(), cursor, followPageSize)
+		if err != nil {
+			s.logger.Warn("Failed to list followed objects: %v", err)
+			return false
+		}
+		for _, entry := range entries {
+			if entry.Key == "" || leader[entry.Key] {
+				continue
+			}
+			if s.unfollowObject(entry.Key) != nil {
+				failed = true
+			}
+			if s.followStopped() {
+				return false
+			}
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	if failed {
+		return false
+	}
+
+	s.follow.cursor = head.Last
+	s.follow.tailing = true
+	s.updateFollow(func(st *FollowStatus) { st.LastSync = s.Clock.Now() })
+	return true
+}
+
+// tailFollow applies the next changes of the change feed of the leader.
+// It reports whether they all applied; on failure, or once the leader no
+// longer has the changes after the cursor of the follower, the follower
+// goes through every object again.
+func (s *FileServer) tailFollow(ctx context.Context) bool {
+	list, err := s.Follow.Changes(ctx, s.FollowBucket, s.follow.cursor, followPageSize, s.FollowInterval)
+	if err != nil {
+		s.followFailed("Failed to read the change feed of leader %s: %v", err)
+		return false
+	}
+	if list.Reset {
+		s.logger.Warn("Missed changes of leader %s, syncing every object again", s.Follow.Addr())
+		s.follow.tailing = false
+		return true
+	}
+
+	for _, c := range list.Changes {
+		if c.Key == "" {
+			continue
+		}
+		if c.Op == ChangeDelete {
+			err = s.unfollowObject(c.Key)
+		} else {
+			err = s.followObject(c.Key)
+		}
+		if err != nil {
+			s.follow.tailing = false
+			return false
+		}
+		if s.followStopped() {
+			return false
+		}
+	}
+	s.follow.cursor = list.Cursor
+	s.updateFollow(func(st *FollowStatus) { st.LastSync = s.Clock.Now() })
+	return true
+}
+
+// followFailed logs and records a failure to reach the leader.
+func (s *FileServer) followFailed(format string, err error) {
+	s.logger.Warn(format, s.Follow.Addr(), err)
+	s.updateFollow(func(st *FollowStatus) { st.LastError = err.Error() })
+}
+
+// followPrefix is the prefix of the keys of the objects followed.
+func (s *FileServer) followPrefix() string {
+	if s.FollowBucket == "" {
+		return ""
+	}
+	return s.FollowBucket + "/"
+}
+
+// followObject copies the object of the leader stored under key when it
+// changed since it was last copied, and deletes its copy when the leader
+// no longer has it. Nothing is written once the follower stopped.
+func (s *FileServer) followObject(key string) error {
+	unlock := s.keyLocks.lock(key)
+	if s.followStopped() {
+		unlock()
+		return nil
+	}
+	err := s.copyFollowed(key)
+	unlock()
+
+	if errors.GetType(err) == errors.FileNotFoundError {
+		// Deleted on the leader since.
+		return s.unfollowObject(key)
+	}
+	if err != nil {
+		s.logger.Warn("Failed to copy %s from leader %s: %v", key, s.Follow.Addr(), err)
+		s.updateFollow(func(st *FollowStatus) {
+			st.Failed++
+			st.LastError = err.Error()
+		})
+	}
+	return err
+}
+
+func (s *FileServer) copyFollowed(key string) error {
+	previous, _ := s.store.ReadMeta(s.ID, key)
+	obj, body, err := s.Follow.Fetch(key, previous.LeaderETag)
+	if err != nil {
+		return err
+	}
+	if body == nil {
+		return nil
+	}
+	defer body.Close()
+
+	previousSize := s.objectSize(key, previous)
+	keyVersion, _ := s.keyRing.Current()
+	mac, err := newIntegrityHash(s.keyRing.Lookup, keyVersion)
+	if err != nil {
+		return errors.Wrap(err, errors.EncryptionError, "failed to create integrity hash")
+	}
+	sum := sha256.New()
+	size, err := s.store.WriteVerified(s.ID, key, io.TeeReader(body, io.MultiWriter(mac, sum)), func(n int64) error {
+		if obj.Size >= 0 && n != obj.Size {
+			return errors.NewCorruptionError(fmt.Sprintf("received %d of %d bytes", n, obj.Size))
+		}
+		if obj.SHA256 != nil && !bytes.Equal(sum.Sum(nil), obj.SHA256) {
+			return errors.NewCorruptionError("content does not match the checksum of the leader")
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.bucketUsage.add(key, size-previousSize)
+
+	meta := ObjectMeta{
+		HMAC:       mac.Sum(nil),
+		KeyVersion: keyVersion,
+		Cipher:     s.replicaEncryption(bucketOf(key)).cipher(),
+		SHA256:     sum.Sum(nil),
+		Bucket:     bucketOf(key),
+		Client:     obj.Client,
+		Lock:       obj.Lock,
+		StoredAt:   obj.StoredAt,
+		LeaderETag: obj.ETag,
+	}
+	if meta.StoredAt.IsZero() {
+		meta.StoredAt = s.Clock.Now()
+	}
+	meta.CreatedAt = createdAt(previous, meta.StoredAt)
+	meta.Epoch = nextEpoch(previous, s.Clock.Now())
+	if err := s.store.WriteMeta(s.ID, key, meta); err != nil {
+		return errors.Wrap(err, errors.StorageError, "failed to write file metadata")
+	}
+	s.dropColdCopy(key, previous.Cold)
+	s.queueMirror(key, false)
+	s.recordChange(key, ChangePut, meta)
+	s.updateFollow(func(st *FollowStatus) { st.Copied++ })
+	s.logger.Debug("Copied %s from leader %s (%d bytes)", key, s.Follow.Addr(), size)
+	return nil
+}
+
+// unfollowObject deletes the copy of the object under key the leader no
+// longer has. Objects not copied from the leader are kept.
+func (s *FileServer) unfollowObject(key string) error {
+	if s.followStopped() {
+		return nil
+	}
+	meta, err := s.store.ReadMeta(s.ID, key)
+	if err != nil || meta.LeaderETag == "" {
+		return nil
+	}
+	if err := s.deleteObject(key); err != nil {
+		s.logger.Warn("Failed to delete %s, gone from leader %s: %v", key, s.Follow.Addr(), err)
+		s.updateFollow(func(st *FollowStatus) {
+			st.Failed++
+			st.LastError = err.Error()
+		})
+		return err
+	}
+	s.updateFollow(func(st *FollowStatus) { st.Deleted++ })
+	return nil
+}
+
+// httpFollowSource follows a leader through its admin API.
+type httpFollowSource struct {
+	addr   string
+	client *http.Client
+}
+
+func newHTTPFollowSource(addr string) *httpFollowSource {
+	return &httpFollowSource{addr: addr, client: http.DefaultClient}
+}
+
+func (f *httpFollowSource) Addr() string {
+	return f.addr
+}
+
+func (f *httpFollowSource) List(prefix, cursor string, limit int) ([]StoreEntry, string, error) {
+	query := url.Values{"prefix": {prefix}, "cursor": {cursor}, "limit": {strconv.Itoa(limit)}}
+	resp, err := f.client.Get("http://" + f.addr + "/objects/?" + query.Encode())
+	if err != nil {
+		return nil, "", errors.Wrap(err, errors.NetworkError, "failed to reach leader")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", leaderError(resp)
+	}
+	var list ObjectList
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, "", errors.Wrap(err, errors.NetworkError, "invalid object list from leader")
+	}
+	return list.Objects, list.NextCursor, nil
+}
+
+func (f *httpFollowSource) Fetch(key, etag string) (FollowedObject, io.ReadCloser, error) {
+	req, err := http.NewRequest(http.MethodGet, "http://"+f.addr+"/objects/"+url.PathEscape(key), nil)
+	if err != nil {
+		return FollowedObject{}, nil, errors.Wrap(err, errors.InvalidInputError, "invalid leader")
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return FollowedObject{}, nil, errors.Wrap(err, errors.NetworkError, "failed to reach leader")
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		resp.Body.Close()
+		return FollowedObject{ETag: etag}, nil, nil
+	default:
+		defer resp.Body.Close()
+		return FollowedObject{}, nil, leaderError(resp)
+	}
+
+	obj := FollowedObject{ETag: resp.Header.Get("ETag"), Size: resp.ContentLength}
+	if obj.Client, err = clientMetaFromHeaders(resp.Header); err == nil {
+		obj.Lock, err = objectLockFromHeaders(resp.Header)
+	}
+	if err == nil {
+		obj.SHA256, err = checksumFromHeaders(resp.Header)
+	}
+	if err != nil {
+		resp.Body.Close()
+		return FollowedObject{}, nil, err
+	}
+	if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		obj.StoredAt = t
+	}
+	return obj, resp.Body, nil
+}
+
+func (f *httpFollowSource) Changes(ctx context.Context, bucket string, cursor uint64, limit int, wait time.Duration) (ChangeList, error) {
+	if wait > maxChangesWait {
+		wait = maxChangesWait
+	}
+	query := url.Values{
+		"bucket": {bucket},
+		"cursor": {strconv.FormatUint(cursor, 10)},
+		"limit":  {strconv.Itoa(limit)},
+		"wait":   {wait.String()},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+f.addr+"/changes?"+query.Encode(), nil)
+	if err != nil {
+		return ChangeList{}, errors.Wrap(err, errors.InvalidInputError, "invalid leader")
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return ChangeList{}, errors.Wrap(err, errors.NetworkError, "failed to reach leader")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return ChangeList{}, leaderError(resp)
+	}
+	var list ChangeList
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return ChangeList{}, errors.Wrap(err, errors.NetworkError, "invalid change feed from leader")
+	}
+	return list, nil
+}
+
+// leaderError is the error of a failed request to the admin API of a
+// leader.
+func leaderError(resp *http.Response) error {
+	msg, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode == http.StatusNotFound {
+		return errors.NewFileNotFoundError(strings.TrimSpace(string(msg)))
+	}
+	return errors.NewNetworkError(fmt.Sprintf("leader returned %s: %s", resp.Status, strings.TrimSpace(string(msg))))
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/anthdm/foreverstore/admin"
+	"github.com/anthdm/foreverstore/errors"
+	"github.com/anthdm/foreverstore/p2p"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFollowerMirrorsLeaderUntilPromoted(t *testing.T) {
+	c := newTestCluster(t, 2)
+	leader := c.nodes[0]
+	a := admin.NewServer("127.0.0.1:0")
+	registerAdminHandlers(a, leader)
+	srv := httptest.NewServer(a.Handler())
+	defer srv.Close()
+
+	c.store(0, "docs/a", []byte("first draft"))
+	c.store(0, "docs/b", []byte("appendix"))
+	c.store(0, "media/c", []byte("not followed"))
+
+	transport := c.network.NewTransport(p2p.MemoryTransportOpts{ListenAddr: "follower"})
+	f := NewFileServer(FileServerOpts{
+		EncKey:            leader.EncKey,
+		StorageRoot:       t.TempDir(),
+		PathTransformFunc: CASPathTransformFunc,
+		Transport:         transport,
+		BootstrapNodes:    []string{"node-1"},
+		Clock:             c.clock,
+		Follow:            newHTTPFollowSource(strings.TrimPrefix(srv.URL, "http://")),
+		FollowBucket:      "docs",
+	})
+	transport.HandshakeFunc = f.handshake(p2p.HandshakeOpts{Secret: testClusterSecret})
+	transport.OnPeer = f.OnPeer
+	assert.Nil(t, f.Start())
+	defer f.Stop()
+
+	read := func(key string) string {
+		r, err := f.Get(key)
+		if !assert.Nil(t, err) {
+			return ""
+		}
+		b, _ := io.ReadAll(r)
+		r.(io.Closer).Close()
+		return string(b)
+	}
+	synced := func(copied, deleted int) func() bool {
+		return func() bool {
+			st := f.FollowStatus()
+			return st.Copied == copied && st.Deleted == deleted && !st.LastSync.IsZero()
+		}
+	}
+
+	// The follower copies the objects of the bucket, and serves them, but
+	// takes no writes and stays out of the cluster.
+	c.eventually("the follower to copy the bucket", synced(2, 0))
+	assert.Equal(t, "first draft", read("docs/a"))
+	assert.False(t, f.store.Has(f.ID, "media/c"))
+	err := f.Store("docs/d", bytes.NewReader([]byte("rejected")))
+	assert.Equal(t, errors.ValidationError, errors.GetType(err))
+	assert.Empty(t, f.Peers())
+
+	// Changes on the leader reach the follower; unchanged objects are not
+	// copied again.
+	c.store(0, "docs/a", []byte("second draft"))
+	assert.Nil(t, c.run("delete", func() error { return leader.deleteObject("docs/b") }))
+	c.eventually("the follower to catch up", synced(3, 1))
+	assert.Equal(t, "second draft", read("docs/a"))
+	assert.False(t, f.store.Has(f.ID, "docs/b"))
+	st := f.FollowStatus()
+	assert.True(t, st.Following)
+	assert.Equal(t, "docs", st.Bucket)
+	assert.Zero(t, st.Failed)
+
+	// Once promoted, it joins the cluster and replicates what it holds.
+	assert.Nil(t, c.run("promotion", func() error {
+		_, err := f.Promote("admin")
+		return err
+	}))
+	_, err = f.Promote("admin")
+	assert.Equal(t, errors.ValidationError, errors.GetType(err))
+	c.eventually("the promoted follower to replicate", func() bool {
+		return c.nodes[1].store.Has(f.ID, hashKey("docs/a"))
+	})
+	assert.Nil(t, c.run("store", func() error { return f.Store("docs/d", bytes.NewReader([]byte("accepted"))) }))
+	assert.False(t, f.FollowStatus().Following)
+}
+
+func TestHTTPFollowSourceEscapesKeys(t *testing.T) {
+	leader := createTestServer(":0", t.TempDir(), []string{})
+	a := admin.NewServer("127.0.0.1:0")
+	registerAdminHandlers(a, leader)
+	srv := httptest.NewServer(a.Handler())
+	defer srv.Close()
+
+	key := "docs/50% off? #1 draft.txt"
+	assert.Nil(t, leader.Store(key, bytes.NewReader([]byte("escaped"))))
+
+	source := newHTTPFollowSource(srv.Listener.Addr().String())
+	_, r, err := source.Fetch(key, "")
+	if assert.Nil(t, err) {
+		defer r.Close()
+		data, err := io.ReadAll(r)
+		assert.Nil(t, err)
+		assert.Equal(t, "escaped", string(data))
+	}
+}
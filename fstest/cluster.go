@@ -0,0 +1,304 @@
+package fstest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/anthdm/foreverstore/admin"
+	"github.com/anthdm/foreverstore/client"
+	"github.com/anthdm/foreverstore/errors"
+)
+
+// maxListLimit bounds the limit of a list request, as on a node.
+const maxListLimit = 10000
+
+// Cluster is an ephemeral cluster of in-process nodes, reached by the
+// clients it returns without sockets. Objects stored through a node are
+// replicated to the other running nodes, and those a node misses are
+// fetched from the others, like in a real cluster.
+type Cluster struct {
+	nodes []*Node
+}
+
+// Node is a node of a Cluster. It serves the part of the HTTP API of a node
+// used by the client package: GET /health, PUT and GET /objects/<key>, and
+// GET /objects/ to list the objects it holds, by folder when given a
+// delimiter.
+type Node struct {
+	addr    string
+	cluster *Cluster
+	store   *Store
+
+	mu       sync.Mutex
+	down     bool
+	draining bool
+}
+
+// NewCluster returns a cluster of n running nodes, addressed node-0 to
+// node-<n-1>.
+func NewCluster(n int) *Cluster {
+	c := &Cluster{}
+	for i := 0; i < n; i++ {
+		c.nodes = append(c.nodes, &Node{
+			addr:    "node-" + strconv.Itoa(i),
+			cluster: c,
+			store:   NewStore(),
+		})
+	}
+	return c
+}
+
+// Node returns the i-th node of the cluster.
+func (c *Cluster) Node(i int) *Node {
+	return c.nodes[i]
+}
+
+// Endpoints returns the addresses of the nodes, in order.
+func (c *Cluster) Endpoints() []string {
+	endpoints := make([]string, len(c.nodes))
+	for i, n := range c.nodes {
+		endpoints[i] = n.addr
+	}
+	return endpoints
+}
+
+// HTTPClient returns an HTTP client whose requests to the addresses of the
+// nodes are served in-process.
+func (c *Cluster) HTTPClient() *http.Client {
+	return &http.Client{Transport: transport{c}}
+}
+
+// Client returns a client of the cluster. Endpoints defaults to those of
+// every node, and HTTPClient is set to reach them.
+func (c *Cluster) Client(opts client.Options) (*client.Client, error) {
+	if len(opts.Endpoints) == 0 {
+		opts.Endpoints = c.Endpoints()
+	}
+	opts.HTTPClient = c.HTTPClient()
+	return client.New(opts)
+}
+
+func (c *Cluster) node(addr string) *Node {
+	for _, n := range c.nodes {
+		if n.addr == addr {
+			return n
+		}
+	}
+	return nil
+}
+
+// transport serves the requests to the nodes of a cluster.
+type transport struct {
+	c *Cluster
+}
+
+func (t transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		defer req.Body.Close()
+	}
+	n := t.c.node(req.URL.Host)
+	if n == nil || !n.Running() {
+		return nil, errors.NewConnectionError(fmt.Sprintf("connection refused by %s", req.URL.Host))
+	}
+	if err := req.Context().Err(); err != nil {
+		return nil, err
+	}
+
+	rec := httptest.NewRecorder()
+	n.ServeHTTP(rec, req)
+	resp := rec.Result()
+	resp.Request = req
+	return resp, nil
+}
+
+// Addr returns the address of the node.
+func (n *Node) Addr() string {
+	return n.addr
+}
+
+// Store returns the objects the node holds.
+func (n *Node) Store() *Store {
+	return n.store
+}
+
+// Stop makes the node unreachable until it is started again. It keeps the
+// objects it holds, and misses those stored meanwhile.
+func (n *Node) Stop() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.down = true
+}
+
+// Start makes a stopped or draining node serve again.
+func (n *Node) Start() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.down = false
+	n.draining = false
+}
+
+// Drain makes the node act as one shutting down: it fails its health
+// checks and refuses the requests of clients, while still taking replicas.
+func (n *Node) Drain() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.draining = true
+}
+
+// Running reports whether the node is reachable.
+func (n *Node) Running() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return !n.down
+}
+
+func (n *Node) isDraining() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.draining
+}
+
+// peers returns the other running nodes of the cluster.
+func (n *Node) peers() []*Node {
+	var peers []*Node
+	for _, p := range n.cluster.nodes {
+		if p != n && p.Running() {
+			peers = append(peers, p)
+		}
+	}
+	return peers
+}
+
+// ServeHTTP serves the HTTP API of the node.
+func (n *Node) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/health" {
+		if n.isDraining() {
+			admin.WriteJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "draining"})
+			return
+		}
+		admin.WriteJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, "/objects/") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if n.isDraining() {
+		admin.WriteError(w, errors.NewConnectionError("server is shutting down"))
+		return
+	}
+
+	key := strings.TrimPrefix(r.URL.Path, "/objects/")
+	switch {
+	case key == "" && r.Method == http.MethodGet:
+		n.list(w, r)
+	case key == "":
+		admin.WriteError(w, errors.NewInvalidInputError("missing object key"))
+	case r.Method == http.MethodPut:
+		if err := n.put(r.Context(), key, r.Body); err != nil {
+			admin.WriteError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodGet:
+		b, err := n.get(r.Context(), key)
+		if err != nil {
+			admin.WriteError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(b)
+	case r.Method == http.MethodHead:
+		b, err := n.get(r.Context(), key)
+		if err != nil {
+			admin.WriteError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	case r.Method == http.MethodDelete:
+		if err := n.delete(r.Context(), key); err != nil {
+			admin.WriteError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// put stores an object on the node and replicates it to the running peers.
+func (n *Node) put(ctx context.Context, key string, r io.Reader) error {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return errors.Wrap(err, errors.NetworkError, "failed to read object")
+	}
+	if err := n.store.Put(ctx, key, b); err != nil {
+		return err
+	}
+	for _, p := range n.peers() {
+		if err := p.store.Put(ctx, key, b); err != nil {
+			return errors.Wrap(err, errors.NetworkError, fmt.Sprintf("failed to replicate to %s", p.addr))
+		}
+	}
+	return nil
+}
+
+// get returns an object held by the node, or fetched from the first
+// running peer that holds it.
+func (n *Node) get(ctx context.Context, key string) ([]byte, error) {
+	b, err := n.store.Bytes(ctx, key)
+	if !errors.IsType(err, errors.FileNotFoundError) {
+		return b, err
+	}
+	for _, p := range n.peers() {
+		if b, err := p.store.Bytes(ctx, key); err == nil {
+			n.store.Put(ctx, key, b)
+			return b, nil
+		}
+	}
+	return nil, err
+}
+
+// delete deletes an object from the node and from the running peers.
+func (n *Node) delete(ctx context.Context, key string) error {
+	if err := n.store.Delete(ctx, key); err != nil {
+		return err
+	}
+	for _, p := range n.peers() {
+		if err := p.store.Delete(ctx, key); err != nil && !errors.IsType(err, errors.FileNotFoundError) {
+			return errors.Wrap(err, errors.NetworkError, fmt.Sprintf("failed to delete from %s", p.addr))
+		}
+	}
+	return nil
+}
+
+// list serves GET /objects/?prefix=&cursor=&limit=.
+func (n *Node) list(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit := DefaultListLimit
+	if v := query.Get("limit"); v != "" {
+		l, err := strconv.Atoi(v)
+		if err != nil || l <= 0 || l > maxListLimit {
+			admin.WriteError(w, errors.NewInvalidInputError("limit must be between 1 and "+strconv.Itoa(maxListLimit)))
+			return
+		}
+		limit = l
+	}
+
+	page, err := n.store.list(r.Context(), query.Get("prefix"), query.Get("delimiter"), query.Get("cursor"), limit)
+	if err != nil {
+		admin.WriteError(w, err)
+		return
+	}
+	if query.Get("delimiter") == "" {
+		page.Prefixes = nil
+	}
+	admin.WriteJSON(w, http.StatusOK, page)
+}
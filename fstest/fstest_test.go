@@ -0,0 +1,112 @@
+package fstest
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/anthdm/foreverstore/client"
+	"github.com/anthdm/foreverstore/errors"
+	"github.com/anthdm/foreverstore/retry"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStore(t *testing.T) {
+	ctx := context.Background()
+	var api client.API = NewStore()
+	s := api.(*Store)
+
+	for _, key := range []string{"b/2", "a/1", "b/1", "b/3"} {
+		assert.Nil(t, api.Store(ctx, key, bytes.NewReader([]byte(key))))
+	}
+	r, err := api.Get(ctx, "b/1")
+	assert.Nil(t, err)
+	b, _ := io.ReadAll(r)
+	assert.Equal(t, "b/1", string(b))
+
+	_, err = api.Get(ctx, "missing")
+	assert.True(t, errors.IsType(err, errors.FileNotFoundError))
+
+	objects, next, err := api.List(ctx, "b/", "", 2)
+	assert.Nil(t, err)
+	assert.Equal(t, []client.Object{{Key: "b/1", Path: "b/1", Size: 3}, {Key: "b/2", Path: "b/2", Size: 3}}, objects)
+	objects, next, err = api.List(ctx, "b/", next, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, []client.Object{{Key: "b/3", Path: "b/3", Size: 3}}, objects)
+	assert.Empty(t, next)
+
+	listing, err := api.ListDir(ctx, "", "/", "", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a/", "b/"}, listing.Prefixes)
+	assert.Empty(t, listing.Objects)
+
+	info, err := api.Stat(ctx, "a/1")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), info.Size)
+	assert.Nil(t, api.Delete(ctx, "a/1"))
+	assert.True(t, errors.IsType(api.Delete(ctx, "a/1"), errors.FileNotFoundError))
+	_, err = api.Stat(ctx, "a/1")
+	assert.True(t, errors.IsType(err, errors.FileNotFoundError))
+
+	s.Fail(errors.NewStorageError("disk full"))
+	assert.True(t, errors.IsType(api.Store(ctx, "c", bytes.NewReader(nil)), errors.StorageError))
+	s.Fail(nil)
+	assert.Nil(t, api.Store(ctx, "c", bytes.NewReader(nil)))
+	assert.True(t, s.Has("c"))
+}
+
+func TestClusterReplicatesAndFailsOver(t *testing.T) {
+	ctx := context.Background()
+	cluster := NewCluster(3)
+	c, err := cluster.Client(client.Options{
+		Retry:               retry.RetryConfig{MaxAttempts: 2, InitialDelay: time.Millisecond, MaxDelay: time.Millisecond, Multiplier: 1},
+		HealthCheckInterval: -1,
+	})
+	assert.Nil(t, err)
+	defer c.Close()
+
+	assert.Nil(t, c.Store(ctx, "doc", bytes.NewReader([]byte("v1"))))
+	for i := 0; i < 3; i++ {
+		assert.True(t, cluster.Node(i).Store().Has("doc"), "node %d", i)
+	}
+
+	// With the first node down the client moves on to the next, and the
+	// write misses the node that is down.
+	cluster.Node(0).Stop()
+	assert.Nil(t, c.Store(ctx, "other", bytes.NewReader([]byte("v2"))))
+	assert.False(t, cluster.Node(0).Store().Has("other"))
+	assert.False(t, c.Endpoints()[0].Healthy)
+
+	// A node that missed an object fetches it from the others.
+	cluster.Node(0).Start()
+	cluster.Node(1).Drain()
+	cluster.Node(2).Stop()
+	r, err := c.Get(ctx, "other")
+	assert.Nil(t, err)
+	b, _ := io.ReadAll(r)
+	r.Close()
+	assert.Equal(t, "v2", string(b))
+	assert.True(t, cluster.Node(0).Store().Has("other"))
+
+	objects, _, err := c.List(ctx, "", "", 0)
+	assert.Nil(t, err)
+	assert.Len(t, objects, 2)
+	info, err := c.Stat(ctx, "doc")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), info.Size)
+	listing, err := c.ListDir(ctx, "", "o", "", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"do", "o"}, listing.Prefixes)
+
+	// Deletes reach the running peers.
+	assert.Nil(t, c.Delete(ctx, "other"))
+	assert.False(t, cluster.Node(0).Store().Has("other"))
+	assert.True(t, cluster.Node(2).Store().Has("other"))
+
+	// With every node down, the client gives up.
+	cluster.Node(0).Stop()
+	_, err = c.Get(ctx, "doc")
+	assert.True(t, errors.IsRetryable(err), "%v", err)
+}
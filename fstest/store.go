@@ -0,0 +1,203 @@
+// Package fstest provides fakes of a cluster for the tests of applications
+// using the client package: an in-memory Store implementing client.API, and
+// an in-process Cluster of nodes serving the HTTP API of real ones, for
+// tests that exercise a client.Client, failover included. Neither opens a
+// socket or touches the disk.
+package fstest
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/anthdm/foreverstore/client"
+	"github.com/anthdm/foreverstore/errors"
+)
+
+// DefaultListLimit is the page size of List when no limit is given, as on
+// a node.
+const DefaultListLimit = 1000
+
+// Store is an in-memory client.API. It is safe for concurrent use.
+type Store struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	err     error
+}
+
+var _ client.API = (*Store)(nil)
+
+// NewStore returns an empty Store.
+func NewStore() *Store {
+	return &Store{objects: make(map[string][]byte)}
+}
+
+// Fail makes every operation fail with err until it is called again with
+// nil, for tests of how applications handle errors.
+func (s *Store) Fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+}
+
+// Store stores the content of r under key.
+func (s *Store) Store(ctx context.Context, key string, r io.Reader) error {
+	if key == "" {
+		return errors.NewInvalidInputError("key is required")
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return errors.Wrap(err, errors.InvalidInputError, "failed to read object")
+	}
+	return s.Put(ctx, key, b)
+}
+
+// Put stores b under key.
+func (s *Store) Put(ctx context.Context, key string, b []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.check(ctx); err != nil {
+		return err
+	}
+	s.objects[key] = append([]byte(nil), b...)
+	return nil
+}
+
+// Get returns a reader of the object stored under key.
+func (s *Store) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	b, err := s.Bytes(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(b)), nil
+}
+
+// Bytes returns the object stored under key.
+func (s *Store) Bytes(ctx context.Context, key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.check(ctx); err != nil {
+		return nil, err
+	}
+	b, ok := s.objects[key]
+	if !ok {
+		return nil, errors.NewFileNotFoundError(key)
+	}
+	return append([]byte(nil), b...), nil
+}
+
+// Has reports whether an object is stored under key.
+func (s *Store) Has(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.objects[key]
+	return ok
+}
+
+// Delete deletes the object stored under key.
+func (s *Store) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.check(ctx); err != nil {
+		return err
+	}
+	if _, ok := s.objects[key]; !ok {
+		return errors.NewFileNotFoundError(key)
+	}
+	delete(s.objects, key)
+	return nil
+}
+
+// Stat returns the size and checksum of the object stored under key, the
+// only metadata the store keeps.
+func (s *Store) Stat(ctx context.Context, key string) (client.ObjectInfo, error) {
+	b, err := s.Bytes(ctx, key)
+	if err != nil {
+		return client.ObjectInfo{}, err
+	}
+	sum := sha256.Sum256(b)
+	return client.ObjectInfo{Key: key, Size: int64(len(b)), ContentType: "application/octet-stream", SHA256: hex.EncodeToString(sum[:])}, nil
+}
+
+// List returns a page of at most limit objects whose keys start with
+// prefix, in the order of their keys, and the cursor of the next page,
+// empty on the last one.
+func (s *Store) List(ctx context.Context, prefix, cursor string, limit int) ([]client.Object, string, error) {
+	page, err := s.list(ctx, prefix, "", cursor, limit)
+	if err != nil {
+		return nil, "", err
+	}
+	return page.Objects, page.NextCursor, nil
+}
+
+// ListDir returns a page of at most limit objects and folders under prefix,
+// as a node does.
+func (s *Store) ListDir(ctx context.Context, prefix, delimiter, cursor string, limit int) (client.Listing, error) {
+	if delimiter == "" {
+		return client.Listing{}, errors.NewInvalidInputError("delimiter is required")
+	}
+	return s.list(ctx, prefix, delimiter, cursor, limit)
+}
+
+// list returns a page of the objects under prefix, folding those that
+// contain delimiter past prefix into folders when it is not empty.
+func (s *Store) list(ctx context.Context, prefix, delimiter, cursor string, limit int) (client.Listing, error) {
+	if limit <= 0 {
+		limit = DefaultListLimit
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.check(ctx); err != nil {
+		return client.Listing{}, err
+	}
+
+	// folders maps the names listed to whether they are folders.
+	folders := make(map[string]bool)
+	for key := range s.objects {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		name, folder := key, false
+		if delimiter != "" {
+			if n := strings.Index(key[len(prefix):], delimiter); n >= 0 {
+				name, folder = key[:len(prefix)+n+len(delimiter)], true
+			}
+		}
+		if name > cursor {
+			folders[name] = folder
+		}
+	}
+	names := make([]string, 0, len(folders))
+	for name := range folders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	page := client.Listing{Objects: []client.Object{}, Prefixes: []string{}}
+	if len(names) > limit {
+		names = names[:limit]
+		page.NextCursor = names[limit-1]
+	}
+	for _, name := range names {
+		if folders[name] {
+			page.Prefixes = append(page.Prefixes, name)
+		} else {
+			page.Objects = append(page.Objects, client.Object{Key: name, Path: name, Size: int64(len(s.objects[name]))})
+		}
+	}
+	return page, nil
+}
+
+// check returns the error the operations of the store fail with, if any.
+// Callers hold mu.
+func (s *Store) check(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return errors.Wrap(err, errors.TimeoutError, "operation canceled")
+	}
+	return s.err
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/anthdm/foreverstore/errors"
+)
+
+// gcGracePeriod is how long a directory must have gone unchanged before
+// garbage collection removes it: a write may be about to fill one created
+// moments ago.
+const gcGracePeriod = time.Minute
+
+// PruneStats counts what a pass of Prune removed.
+type PruneStats struct {
+	Dirs       int `json:"dirs"`
+	Namespaces int `json:"namespaces"`
+}
+
+// Prune removes the directories of every namespace that hold nothing,
+// chains of them included, and the namespaces left with no object at all.
+// Directories changed since before are left for a later pass. Deletes
+// already remove the directories they empty; Prune catches those left by
+// interrupted deletes and writes, and by the namespaces of nodes gone.
+func (s *Store) Prune(before time.Time) (PruneStats, error) {
+	var stats PruneStats
+	namespaces, err := os.ReadDir(s.Root)
+	if os.IsNotExist(err) {
+		return stats, nil
+	}
+	if err != nil {
+		return stats, err
+	}
+
+	var lastErr error
+	for _, ns := range namespaces {
+		if !ns.IsDir() {
+			continue
+		}
+		dir := filepath.Join(s.Root, ns.Name())
+		empty, err := pruneBelow(dir, before, &stats.Dirs)
+		if err != nil {
+			lastErr = err
+		}
+		if empty && os.Remove(dir) == nil {
+			stats.Namespaces++
+		}
+	}
+	return stats, lastErr
+}
+
+// pruneBelow removes the empty directories below dir, counting them in
+// dirs, and reports whether dir is left empty and was unchanged since
+// before. Directories are timed as they were found, since removing their
+// content changes them. Removing a directory fails once it is not empty,
+// which a write racing with the pass may have made it.
+func pruneBelow(dir string, before time.Time, dirs *int) (bool, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return false, ignoreNotExist(err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return false, ignoreNotExist(err)
+	}
+
+	var lastErr error
+	left := len(entries)
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		sub := filepath.Join(dir, entry.Name())
+		empty, err := pruneBelow(sub, before, dirs)
+		if err != nil {
+			lastErr = err
+		}
+		if empty && os.Remove(sub) == nil {
+			*dirs++
+			left--
+		}
+	}
+	return left == 0 && info.ModTime().Before(before), lastErr
+}
+
+func ignoreNotExist(err error) error {
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// GCStatus reports the last garbage collection of the storage root.
+type GCStatus struct {
+	LastRun time.Time `json:"last_run"`
+	// Removed counts the empty directories and namespaces removed.
+	Removed PruneStats `json:"removed"`
+	Error   string     `json:"error,omitempty"`
+}
+
+type gcState struct {
+	mu     sync.Mutex
+	status GCStatus
+}
+
+// CollectGarbage prunes the directories left empty in the storage root and
+// the namespaces holding no object, keeping the inodes used by a node with
+// many deletes in check. See Store.Prune.
+func (s *FileServer) CollectGarbage() (GCStatus, error) {
+	s.gc.mu.Lock()
+	defer s.gc.mu.Unlock()
+
+	status := GCStatus{LastRun: s.Clock.Now()}
+	// Files are timed by the wall clock, whatever the server runs on.
+	removed, err := s.store.Prune(time.Now().Add(-gcGracePeriod))
+	status.Removed = removed
+	if err != nil {
+		err = errors.Wrap(err, errors.StorageError, "failed to prune storage")
+		status.Error = err.Error()
+	}
+	s.gc.status = status
+	return status, err
+}
+
+// GCStatus returns the outcome of the last garbage collection.
+func (s *FileServer) GCStatus() GCStatus {
+	s.gc.mu.Lock()
+	defer s.gc.mu.Unlock()
+	return s.gc.status
+}
+
+// gcLoop collects garbage every GCInterval until the server stops.
+func (s *FileServer) gcLoop() {
+	ticker := s.Clock.NewTicker(s.GCInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C():
+			status, err := s.CollectGarbage()
+			if err != nil {
+				s.logger.Warn("Garbage collection failed: %v", err)
+				continue
+			}
+			if status.Removed.Dirs > 0 || status.Removed.Namespaces > 0 {
+				s.logger.Info("Garbage collection removed %d empty directories and %d empty namespaces",
+					status.Removed.Dirs, status.Removed.Namespaces)
+			}
+		case <-s.quitch:
+			return
+		}
+	}
+}
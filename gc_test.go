@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// age sets the times of the directory at path and of every directory below
+// it to d ago.
+func age(t *testing.T, path string, d time.Duration) {
+	old := time.Now().Add(-d)
+	err := filepath.WalkDir(path, func(p string, entry os.DirEntry, err error) error {
+		if err == nil && entry.IsDir() {
+			err = os.Chtimes(p, old, old)
+		}
+		return err
+	})
+	assert.Nil(t, err)
+}
+
+func TestStorePrune(t *testing.T) {
+	s := NewStore(StoreOpts{Root: t.TempDir(), PathTransformFunc: CASPathTransformFunc})
+	id := generateID()
+
+	for _, key := range []string{"kept", "interrupted"} {
+		_, err := s.Write(id, key, bytes.NewReader([]byte(key)))
+		assert.Nil(t, err)
+	}
+	// A delete interrupted before it removed the directories.
+	interrupted := filepath.Join(s.Root, id, s.PathTransformFunc("interrupted").FullPath())
+	assert.Nil(t, os.Remove(interrupted))
+	// A namespace whose objects are all gone.
+	_, err := s.Write("abandoned", "old", bytes.NewReader([]byte("old")))
+	assert.Nil(t, err)
+	assert.Nil(t, os.Remove(filepath.Join(s.Root, "abandoned", s.PathTransformFunc("old").FullPath())))
+	// A directory just created, a write about to fill it.
+	fresh := filepath.Join(s.Root, id, "fresh")
+	assert.Nil(t, os.MkdirAll(fresh, os.ModePerm))
+
+	age(t, s.Root, time.Hour)
+	assert.Nil(t, os.Chtimes(fresh, time.Now(), time.Now()))
+
+	stats, err := s.Prune(time.Now().Add(-time.Minute))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, stats.Namespaces)
+	assert.Equal(t, 16, stats.Dirs)
+
+	assert.True(t, s.Has(id, "kept"))
+	_, err = os.Stat(filepath.Dir(interrupted))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(s.Root, "abandoned"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(fresh)
+	assert.Nil(t, err)
+
+	// Writes recreate what was pruned.
+	_, err = s.Write("abandoned", "new", bytes.NewReader([]byte("new")))
+	assert.Nil(t, err)
+	assert.True(t, s.Has("abandoned", "new"))
+}
+
+func TestCollectGarbage(t *testing.T) {
+	c := newTestCluster(t, 1)
+	s := c.nodes[0]
+	c.store(0, "doc", []byte("content"))
+
+	stale := filepath.Join(s.store.Root, "gone", "a", "b")
+	assert.Nil(t, os.MkdirAll(stale, os.ModePerm))
+	age(t, s.store.Root, time.Hour)
+
+	status, err := s.CollectGarbage()
+	assert.Nil(t, err)
+	assert.Equal(t, PruneStats{Dirs: 2, Namespaces: 1}, status.Removed)
+	assert.Equal(t, status, s.GCStatus())
+	assert.Equal(t, []byte("content"), c.get(0, "doc"))
+}
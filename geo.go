@@ -0,0 +1,242 @@
+package main
+
+import (
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/anthdm/foreverstore/errors"
+	"github.com/anthdm/foreverstore/p2p"
+)
+
+// Modes of replication to the nodes of other sites.
+const (
+	// CrossSiteSync replicates to every site with each write: Store
+	// returns once all of them have the replica.
+	CrossSiteSync = "sync"
+	// CrossSiteAsync replicates to the nodes of the node's own site with
+	// each write, and to the other sites in the background. Store returns
+	// without waiting on the WAN, and reads in the other sites may see the
+	// previous version of an object, or none, until the replica gets there.
+	// Only the latest version of an object written several times in a row
+	// is sent.
+	CrossSiteAsync = "async"
+)
+
+// crossSiteRetryInterval is how often the replicas that could not be sent
+// to the other sites are tried again.
+const crossSiteRetryInterval = 5 * time.Second
+
+// CrossSiteStatus reports the replication of this node's objects to the
+// nodes of other sites.
+type CrossSiteStatus struct {
+	Site string `json:"site,omitempty"`
+	Mode string `json:"mode"`
+	// Pending counts the objects waiting to be replicated to the other
+	// sites, and OldestPending is how long the oldest of them has waited:
+	// the lag of the other sites behind this node.
+	Pending       int           `json:"pending"`
+	OldestPending time.Duration `json:"oldest_pending"`
+	// Replicated counts the objects sent to the other sites, and Failed
+	// the attempts that failed and are tried again.
+	Replicated int    `json:"replicated"`
+	Failed     int    `json:"failed"`
+	LastError  string `json:"last_error,omitempty"`
+}
+
+// crossSitePending is an object waiting to be replicated to the other
+// sites. gen counts its writes, so that one written again while it is sent
+// stays queued.
+type crossSitePending struct {
+	queuedAt time.Time
+	gen      int
+}
+
+type crossSiteQueue struct {
+	mu      sync.Mutex
+	pending map[string]*crossSitePending
+	status  CrossSiteStatus
+	wakech  chan struct{}
+}
+
+// crossSiteAsync reports whether writes reach the other sites in the
+// background.
+func (s *FileServer) crossSiteAsync() bool {
+	return s.CrossSiteReplication == CrossSiteAsync && s.Site != ""
+}
+
+// peerSite returns the site the peer at addr reported, empty until it
+// does.
+func (s *FileServer) peerSite(addr string) string {
+	s.capacity.mu.Lock()
+	defer s.capacity.mu.Unlock()
+	return s.capacity.peers[addr].Site
+}
+
+// sameSite reports whether the peer at addr is in the site of this node. A
+// peer that has not reported its site yet, or a node without one, counts
+// as the same site.
+func (s *FileServer) sameSite(addr string) bool {
+	site := s.peerSite(addr)
+	return s.Site == "" || site == "" || site == s.Site
+}
+
+// syncReplica reports whether the peer at addr gets the replicas of this
+// node with each write.
+func (s *FileServer) syncReplica(addr string) bool {
+	return !s.crossSiteAsync() || s.sameSite(addr)
+}
+
+// otherSite reports whether the peer at addr is known to be in another
+// site than this node.
+func (s *FileServer) otherSite(addr string) bool {
+	return !s.sameSite(addr)
+}
+
+// sitePeers splits peers into those of the site of this node and the
+// others.
+func (s *FileServer) sitePeers(peers map[string]p2p.Peer) (local, remote map[string]p2p.Peer) {
+	local = make(map[string]p2p.Peer, len(peers))
+	remote = make(map[string]p2p.Peer)
+	for addr, peer := range peers {
+		if s.sameSite(addr) {
+			local[addr] = peer
+		} else {
+			remote[addr] = peer
+		}
+	}
+	return local, remote
+}
+
+// queueCrossSite schedules the object of this node stored under key to be
+// replicated to the other sites.
+func (s *FileServer) queueCrossSite(key string) {
+	q := &s.crossSite
+	q.mu.Lock()
+	if q.pending == nil {
+		q.pending = make(map[string]*crossSitePending)
+	}
+	p, ok := q.pending[key]
+	if !ok {
+		p = &crossSitePending{queuedAt: s.Clock.Now()}
+		q.pending[key] = p
+	}
+	p.gen++
+	q.mu.Unlock()
+
+	select {
+	case q.wakech <- struct{}{}:
+	default:
+	}
+}
+
+// CrossSiteStatus returns the replication of this node's objects to the
+// other sites.
+func (s *FileServer) CrossSiteStatus() CrossSiteStatus {
+	q := &s.crossSite
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	status := q.status
+	status.Site = s.Site
+	status.Mode = CrossSiteSync
+	if s.crossSiteAsync() {
+		status.Mode = CrossSiteAsync
+	}
+	status.Pending = len(q.pending)
+	now := s.Clock.Now()
+	for _, p := range q.pending {
+		if age := now.Sub(p.queuedAt); age > status.OldestPending {
+			status.OldestPending = age
+		}
+	}
+	return status
+}
+
+// crossSiteLoop replicates the queued objects to the other sites until the
+// server stops, trying those that failed again every
+// crossSiteRetryInterval.
+func (s *FileServer) crossSiteLoop() {
+	ticker := s.Clock.NewTicker(crossSiteRetryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.crossSite.wakech:
+		case <-ticker.C():
+		case <-s.quitch:
+			return
+		}
+		s.flushCrossSite()
+	}
+}
+
+// flushCrossSite replicates the queued objects to the other sites, oldest
+// first.
+func (s *FileServer) flushCrossSite() {
+	q := &s.crossSite
+	type queued struct {
+		key string
+		crossSitePending
+	}
+	q.mu.Lock()
+	batch := make([]queued, 0, len(q.pending))
+	for key, p := range q.pending {
+		batch = append(batch, queued{key, *p})
+	}
+	q.mu.Unlock()
+	sort.Slice(batch, func(i, j int) bool { return batch[i].queuedAt.Before(batch[j].queuedAt) })
+
+	for _, item := range batch {
+		select {
+		case <-s.quitch:
+			return
+		default:
+		}
+		err := s.replicateCrossSite(item.key)
+
+		q.mu.Lock()
+		if err != nil {
+			q.status.Failed++
+			q.status.LastError = err.Error()
+		} else if p, ok := q.pending[item.key]; ok && p.gen == item.gen {
+			delete(q.pending, item.key)
+			q.status.Replicated++
+		}
+		q.mu.Unlock()
+		if err != nil {
+			s.logger.Warn("Failed to replicate %s to other sites: %v", item.key, err)
+		}
+	}
+}
+
+// replicateCrossSite sends the current version of an object of this node
+// to the connected peers of other sites.
+func (s *FileServer) replicateCrossSite(key string) error {
+	unlock := s.keyLocks.lock(key)
+	defer unlock()
+
+	meta, err := s.store.ReadMeta(s.ID, key)
+	if os.IsNotExist(err) && !s.store.Has(s.ID, key) {
+		// Deleted since; the delete reached every site.
+		return nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, errors.StorageError, "failed to read object metadata")
+	}
+
+	size := s.replicaEncryption(bucketOf(key)).size(s.objectSize(key, meta))
+	peers := s.placementPeers(key, size, s.otherSite)
+	if len(peers) == 0 {
+		return errors.NewConnectionError("no peers of other sites available")
+	}
+	var lastErr error
+	for addr, peer := range peers {
+		if err := s.pushReplica(peer, key, meta); err != nil {
+			s.logger.Warn("Failed to replicate %s to %s (site %s): %v", key, addr, s.peerSite(addr), err)
+			lastErr = err
+		}
+	}
+	return lastErr
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newSiteCluster starts a cluster whose nodes run in the given sites.
+func newSiteCluster(t *testing.T, mode string, sites ...string) *testCluster {
+	c := newTestClusterWith(t, len(sites), func(node int, opts *FileServerOpts) {
+		opts.Site = sites[node]
+		opts.CrossSiteReplication = mode
+	})
+	c.eventually("nodes to learn the sites of their peers", func() bool {
+		for _, s := range c.nodes {
+			for _, p := range s.Peers() {
+				if p.Site == "" {
+					return false
+				}
+			}
+		}
+		return true
+	})
+	return c
+}
+
+func TestAsyncCrossSiteReplication(t *testing.T) {
+	c := newSiteCluster(t, CrossSiteAsync, "east", "east", "west", "west")
+	s := c.nodes[0]
+
+	// With the WAN links of node 0 down, a write still succeeds within
+	// its site, and waits for the other site.
+	assert.Nil(t, s.RemovePeer("node-2"))
+	assert.Nil(t, s.RemovePeer("node-3"))
+	c.store(0, "report", []byte("written in the east"))
+	c.eventually("the write to replicate within its site", func() bool { return c.holds(1, 0, "report") })
+	c.assertAbsent([]int{2, 3}, 0, "report")
+	c.eventually("the replica to the west to fail", func() bool { return s.CrossSiteStatus().Failed > 0 })
+	assert.Equal(t, 1, s.CrossSiteStatus().Pending)
+
+	// Once the WAN is back, the other site catches up.
+	assert.Nil(t, c.run("reconnect", func() error {
+		if err := s.AddPeer("node-2"); err != nil {
+			return err
+		}
+		return s.AddPeer("node-3")
+	}))
+	c.assertConverged(0, "report")
+	c.eventually("the queue to drain", func() bool { return s.CrossSiteStatus().Pending == 0 })
+
+	status := s.CrossSiteStatus()
+	assert.Equal(t, CrossSiteAsync, status.Mode)
+	assert.Equal(t, "east", status.Site)
+	assert.Equal(t, 1, status.Replicated)
+}
+
+func TestGetPrefersReplicasOfTheSameSite(t *testing.T) {
+	c := newSiteCluster(t, CrossSiteSync, "east", "east", "west")
+	s := c.nodes[0]
+
+	local, remote := s.sitePeers(s.connectedPeers())
+	assert.Contains(t, local, "node-1")
+	assert.Contains(t, remote, "node-2")
+
+	c.store(0, "doc", []byte("replicated to both sites"))
+	c.assertConverged(0, "doc")
+
+	// The west is unreachable: the lost local copy comes back from the
+	// east without waiting on it.
+	c.partition([]int{0, 1}, []int{2})
+	assert.Nil(t, s.store.Delete(s.ID, "doc"))
+	assert.Equal(t, []byte("replicated to both sites"), c.get(0, "doc"))
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/anthdm/foreverstore/p2p"
+)
+
+// A peer that dies without closing its connection, or that a partition cuts
+// off, would stay among the peers of a node for good, failing the
+// replications and requests sent to it. Nodes send their peers a
+// MessageHeartbeat every HeartbeatInterval, and take any message of a peer
+// for a sign of life: a peer that announced FeatureHeartbeats and is not
+// heard from between HeartbeatMisses consecutive heartbeats of the node is
+// declared dead and dropped. Missed heartbeats are counted rather than the
+// time since the peer was last heard from measured, so that a jump of the
+// clock is one missed heartbeat, not a cluster declared dead. The
+// objects of this node it was placed a replica of, in place of other peers,
+// are re-replicated. A peer that comes back connects again as any peer.
+
+// MessageHeartbeat tells a peer the node is alive.
+type MessageHeartbeat struct{}
+
+// livenessTracker records when the peers of a node were last heard from,
+// and how many heartbeats of the node in a row they missed.
+type livenessTracker struct {
+	mu   sync.Mutex
+	seen map[string]time.Time
+	// heard holds the peers heard from since the last heartbeat, missed the
+	// number of heartbeats in a row the others were not heard from before.
+	heard  map[string]bool
+	missed map[string]int
+	// failed counts the peers declared dead.
+	failed int64
+}
+
+// alive records that the peer at addr was heard from at now.
+func (t *livenessTracker) alive(addr string, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.seen == nil {
+		t.seen = make(map[string]time.Time)
+		t.heard = make(map[string]bool)
+	}
+	t.seen[addr] = now
+	t.heard[addr] = true
+}
+
+// beat records a heartbeat of the node and returns how many heartbeats in a
+// row, this one included, the peer at addr was not heard from before.
+func (t *livenessTracker) beat(addr string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.missed == nil {
+		t.missed = make(map[string]int)
+	}
+	if t.heard[addr] {
+		delete(t.heard, addr)
+		delete(t.missed, addr)
+		return 0
+	}
+	t.missed[addr]++
+	return t.missed[addr]
+}
+
+// lastSeen returns when the peer at addr was last heard from.
+func (t *livenessTracker) lastSeen(addr string) (time.Time, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	seen, ok := t.seen[addr]
+	return seen, ok
+}
+
+// forget drops what is known of the peer at addr.
+func (t *livenessTracker) forget(addr string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.seen, addr)
+	delete(t.heard, addr)
+	delete(t.missed, addr)
+}
+
+// FailedPeers returns the number of peers declared dead since the node
+// started.
+func (s *FileServer) FailedPeers() int64 {
+	s.liveness.mu.Lock()
+	defer s.liveness.mu.Unlock()
+	return s.liveness.failed
+}
+
+// heartbeatLoop sends the peers their heartbeat, and drops those gone
+// silent, every HeartbeatInterval until the server stops.
+func (s *FileServer) heartbeatLoop() {
+	ticker := s.Clock.NewTicker(s.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case tick := <-ticker.C():
+			// A tick taken an interval or more late comes from a burst,
+			// the clock having jumped or the node having stalled: the
+			// peers had no chance to be heard from since the tick before.
+			s.heartbeat(s.Clock.Since(tick) < s.HeartbeatInterval)
+		case <-s.quitch:
+			return
+		}
+	}
+}
+
+// heartbeat sends the peers their heartbeat, and drops those that missed
+// too many in a row, counting this one when count is set.
+func (s *FileServer) heartbeat(count bool) {
+	for addr, peer := range s.connectedPeers() {
+		// Peers that do not send heartbeats may well be idle.
+		if !s.peerSupports(addr, FeatureHeartbeats) {
+			continue
+		}
+		if count && s.liveness.beat(addr) >= s.HeartbeatMisses {
+			seen, _ := s.liveness.lastSeen(addr)
+			s.peerFailed(addr, seen)
+			continue
+		}
+		// A peer gone dead may not take writes: its heartbeat is not
+		// waited for.
+		go func(addr string, peer p2p.Peer) {
+			msg := Message{Payload: MessageHeartbeat{}}
+			if err := s.sendMessage(peer, &msg); err != nil {
+				s.logger.Debug("Failed to send heartbeat to peer %s: %v", addr, err)
+			}
+		}(addr, peer)
+	}
+}
+
+// peerFailed drops the peer at addr, last heard from at seen, and
+// re-replicates the objects of this node it was placed a replica of.
+func (s *FileServer) peerFailed(addr string, seen time.Time) {
+	keys := s.placedOn(addr)
+	if !s.dropPeer(addr) {
+		return
+	}
+	s.liveness.mu.Lock()
+	s.liveness.failed++
+	s.liveness.mu.Unlock()
+	s.logger.Warn("Peer %s not heard from for %v, dropping it", addr, s.Clock.Since(seen))
+
+	if len(keys) == 0 {
+		return
+	}
+	_, err := s.startJob(JobReplicate, jobTask{
+		list: func() ([]string, error) { return keys, nil },
+		do:   s.repairObject,
+	}, "failure detection")
+	if err != nil {
+		s.logger.Warn("Failed to re-replicate the %d objects peer %s held a replica of: %v", len(keys), addr, err)
+	}
+}
+
+// placedOn returns the keys of the objects of this node the peer at addr is
+// meant to hold a replica of, among the objects other peers could hold it
+// instead: those of buckets whose policy does not place their replicas on
+// every peer.
+func (s *FileServer) placedOn(addr string) []string {
+	keys, err := s.listOwnKeys()
+	if err != nil {
+		s.logger.Warn("Failed to list the objects peer %s held a replica of: %v", addr, err)
+		return nil
+	}
+	peers := s.connectedPeers()
+	var placed []string
+	for _, key := range keys {
+		policy := s.bucketPolicy(key)
+		if policy.ReplicationFactor == 0 && len(policy.Sites) == 0 {
+			continue
+		}
+		meta, err := s.store.ReadMeta(s.ID, key)
+		if err != nil {
+			continue
+		}
+		if _, ok := s.replicaPlacement(key, meta, peers)[addr]; ok {
+			placed = append(placed, key)
+		}
+	}
+	return placed
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/anthdm/foreverstore/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSilentPeersAreDroppedAndTheirReplicasReplaced(t *testing.T) {
+	c := newTestClusterWith(t, 3, func(node int, opts *FileServerOpts) {
+		opts.HeartbeatInterval = time.Minute
+		// The peers cut off would drop node 0 in turn, closing their end of
+		// the connection, which memory pipes carry across partitions.
+		if node > 0 {
+			opts.HeartbeatMisses = 100
+		}
+		opts.BucketPolicies = []config.BucketPolicy{{Bucket: "docs", ReplicationFactor: 2}}
+	})
+	s := c.nodes[0]
+	// beatUntil runs the clock until cond holds, holding it at the end of
+	// every heartbeat interval until node 0 hears from the peers given: the
+	// fake clock would otherwise run ahead of the heartbeats in flight.
+	beatUntil := func(what string, cond func() bool, peers ...int) {
+		t.Helper()
+		for i := 0; !cond(); i++ {
+			if i == 20 {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+			since := c.clock.Now()
+			c.eventually(what, func() bool { return cond() || c.clock.Since(since) >= time.Minute })
+			if cond() {
+				return
+			}
+			assert.Eventually(t, func() bool {
+				for _, addr := range c.addrs(peers) {
+					if seen, ok := s.liveness.lastSeen(addr); !ok || !seen.After(since) {
+						return false
+					}
+				}
+				return true
+			}, 5*time.Second, time.Millisecond)
+		}
+	}
+
+	var err error
+	stored := make(chan struct{})
+	go func() {
+		err = s.StoreObject("docs/report", bytes.NewReader([]byte("kept on one peer")), nil)
+		close(stored)
+	}()
+	beatUntil("node 0 to store docs/report", func() bool {
+		select {
+		case <-stored:
+			return true
+		default:
+			return false
+		}
+	}, 1, 2)
+	assert.Nil(t, err)
+	beatUntil("the replica to be placed", func() bool { return c.holds(1, 0, "docs/report") || c.holds(2, 0, "docs/report") }, 1, 2)
+	holder, other := 1, 2
+	if !c.holds(1, 0, "docs/report") {
+		holder, other = 2, 1
+	}
+
+	// Idle peers are kept as long as they send heartbeats.
+	idle := c.clock.Now()
+	beatUntil("a few heartbeats", func() bool { return c.clock.Since(idle) >= 10*time.Minute }, holder, other)
+	assert.Len(t, s.Peers(), 2)
+	assert.Zero(t, s.FailedPeers())
+
+	// The holder of the replica goes silent: it is dropped, and the replica
+	// placed on the peer left.
+	c.partition([]int{0, other}, []int{holder})
+	beatUntil("the silent peer to be dropped", func() bool { return s.FailedPeers() == 1 }, other)
+	peers := s.Peers()
+	if assert.Len(t, peers, 1) {
+		assert.Equal(t, c.nodes[other].ID, peers[0].ID)
+		assert.False(t, peers[0].LastSeen.IsZero())
+	}
+	beatUntil("the replica to be placed on the peer left", func() bool { return c.holds(other, 0, "docs/report") }, other)
+}
+
+func TestLivenessCountsMissedHeartbeats(t *testing.T) {
+	var l livenessTracker
+	now := time.Now()
+	l.alive("a", now)
+	assert.Equal(t, 0, l.beat("a"))
+	assert.Equal(t, 1, l.beat("a"))
+	assert.Equal(t, 2, l.beat("a"))
+
+	// Hearing from the peer starts the count again.
+	l.alive("a", now.Add(time.Hour))
+	assert.Equal(t, 0, l.beat("a"))
+	assert.Equal(t, 1, l.beat("a"))
+	l.forget("a")
+	assert.Equal(t, 1, l.beat("a"))
+}
+
+func TestClockJumpDropsNoPeer(t *testing.T) {
+	c := newTestClusterWith(t, 3, func(node int, opts *FileServerOpts) {
+		opts.HeartbeatInterval = time.Minute
+	})
+
+	c.clock.Advance(24 * time.Hour)
+	jumped := c.clock.Now()
+	c.eventually("a few heartbeats", func() bool { return c.clock.Since(jumped) >= 5*time.Minute })
+	for i, s := range c.nodes {
+		assert.Zero(t, s.FailedPeers(), "node %d", i)
+		assert.Len(t, s.Peers(), 2, "node %d", i)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"time"
+
+	"github.com/anthdm/foreverstore/errors"
+)
+
+// A client that does not hear back from a store cannot tell whether it was
+// applied, and sends it again: applied twice, it stores a second version of
+// the object and counts its size against the quotas twice. A store sent
+// with an idempotency token is remembered in the metadata of its object
+// once it succeeded, and a store of the same key with the same token is
+// not applied again, answering with the result of the first instead.
+// Tokens are remembered by the node that applied the store: retries sent to
+// another node store the object in the namespace of that node.
+
+const (
+	// maxIdempotencyTokenLen bounds the length of an idempotency token.
+	maxIdempotencyTokenLen = 128
+	// idempotentWrites is the number of tokens remembered per key.
+	idempotentWrites = 16
+	// idempotencyRetention is how long a token is remembered.
+	idempotencyRetention = 24 * time.Hour
+)
+
+// IdempotentWrite is a store of an object sent with an idempotency token,
+// remembered with the ETag and SHA-256 of the object it stored.
+type IdempotentWrite struct {
+	Token  string    `json:"token"`
+	ETag   string    `json:"etag,omitempty"`
+	SHA256 string    `json:"sha256,omitempty"`
+	At     time.Time `json:"at"`
+}
+
+// validateIdempotencyToken checks that an idempotency token fits in the
+// metadata of an object and in a header.
+func validateIdempotencyToken(token string) error {
+	if len(token) > maxIdempotencyTokenLen {
+		return errors.NewInvalidInputError("idempotency token too long")
+	}
+	for i := 0; i < len(token); i++ {
+		if token[i] < 0x21 || token[i] > 0x7e {
+			return errors.NewInvalidInputError("invalid character in idempotency token")
+		}
+	}
+	return nil
+}
+
+// recentWrites returns the writes still remembered at now.
+func recentWrites(writes []IdempotentWrite, now time.Time) []IdempotentWrite {
+	var recent []IdempotentWrite
+	for _, w := range writes {
+		if now.Sub(w.At) <= idempotencyRetention {
+			recent = append(recent, w)
+		}
+	}
+	return recent
+}
+
+// replayedWrite returns the write of key that was sent with token, if it
+// is still remembered. The caller holds the lock of the key.
+func (s *FileServer) replayedWrite(key, token string) (IdempotentWrite, bool) {
+	meta, err := s.store.ReadMeta(s.ID, key)
+	if err != nil {
+		return IdempotentWrite{}, false
+	}
+	for _, w := range recentWrites(meta.Writes, s.Clock.Now()) {
+		if w.Token == token {
+			return w, true
+		}
+	}
+	return IdempotentWrite{}, false
+}
+
+// rememberWrite records that the store of key sent with token succeeded,
+// storing the object described by meta. The caller holds the lock of the
+// key. A token that fails to be recorded only loses the protection against
+// its store being applied again.
+func (s *FileServer) rememberWrite(key, token string, meta ObjectMeta) {
+	now := s.Clock.Now()
+	err := updateMetaFile(s.store.metaPath(s.ID, key), func(m *ObjectMeta) {
+		writes := append(recentWrites(m.Writes, now), IdempotentWrite{Token: token, ETag: meta.ETag(), SHA256: meta.ContentSHA256(), At: now})
+		if len(writes) > idempotentWrites {
+			writes = writes[len(writes)-idempotentWrites:]
+		}
+		m.Writes = writes
+	})
+	if err != nil {
+		s.logger.Warn("Failed to remember the idempotency token of %s: %v", key, err)
+	}
+}
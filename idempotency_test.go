@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/anthdm/foreverstore/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStoresWithTheSameTokenAreAppliedOnce(t *testing.T) {
+	c := newTestCluster(t, 2)
+	s := c.nodes[0]
+	storeOnce := func(token string, data []byte) (etag string, replayed bool) {
+		t.Helper()
+		assert.Nil(t, c.run("idempotent store", func() (err error) {
+			res, err := s.StoreObjectOnce("doc", token, bytes.NewReader(data), nil, nil, nil)
+			etag, replayed = res.ETag, res.Replayed
+			return err
+		}))
+		return etag, replayed
+	}
+
+	etag, replayed := storeOnce("upload-1", []byte("first"))
+	assert.False(t, replayed)
+	assert.NotEmpty(t, etag)
+	stored, err := s.Meta("doc")
+	assert.Nil(t, err)
+
+	// The retry of a store that was applied stores nothing, and answers
+	// with what the first stored.
+	c.clock.Advance(time.Minute)
+	again, replayed := storeOnce("upload-1", []byte("first, sent again"))
+	assert.True(t, replayed)
+	assert.Equal(t, etag, again)
+	assert.Equal(t, []byte("first"), c.get(0, "doc"))
+	meta, err := s.Meta("doc")
+	assert.Nil(t, err)
+	assert.Equal(t, stored.StoredAt, meta.StoredAt)
+
+	// Other tokens are applied, and do not make the first forgotten.
+	_, replayed = storeOnce("upload-2", []byte("second"))
+	assert.False(t, replayed)
+	c.store(0, "doc", []byte("third"))
+	_, replayed = storeOnce("upload-1", []byte("first"))
+	assert.True(t, replayed)
+	assert.Equal(t, []byte("third"), c.get(0, "doc"))
+
+	// Tokens are forgotten after a day.
+	c.clock.Advance(idempotencyRetention + time.Minute)
+	_, replayed = storeOnce("upload-1", []byte("first"))
+	assert.False(t, replayed)
+	assert.Equal(t, []byte("first"), c.get(0, "doc"))
+
+	_, err = s.StoreObjectOnce("doc", "not a token", bytes.NewReader(nil), nil, nil, nil)
+	assert.True(t, errors.IsType(err, errors.InvalidInputError), "%v", err)
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/anthdm/foreverstore/errors"
+	"github.com/anthdm/foreverstore/logger"
+	"github.com/anthdm/foreverstore/p2p"
+)
+
+const defaultIdentityFileName = ".node_identity"
+
+// Envelope is what actually travels over the wire for control messages: the
+// encoded Message, signed with the sending node's identity key. Both are
+// encoded in the wire format of the peer.
+type Envelope struct {
+	Body      []byte
+	PublicKey []byte
+	Signature []byte
+}
+
+// loadNodeIdentity loads the node's ed25519 identity key from path, creating
+// and persisting a new one on first start. The file holds the hex encoded
+// private key seed.
+func loadNodeIdentity(path string) (ed25519.PrivateKey, error) {
+	b, err := os.ReadFile(path)
+	if err == nil {
+		seed, err := hex.DecodeString(strings.TrimSpace(string(b)))
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return nil, errors.NewAuthenticationError("invalid node identity file").WithContext("path", path)
+		}
+		return ed25519.NewKeyFromSeed(seed), nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, errors.StorageError, "failed to read node identity")
+	}
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, errors.Wrap(err, errors.InternalError, "failed to generate node identity")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return nil, errors.Wrap(err, errors.StorageError, "failed to create node identity directory")
+	}
+	if err := os.WriteFile(path, []byte(hex.EncodeToString(priv.Seed())), 0600); err != nil {
+		return nil, errors.Wrap(err, errors.StorageError, "failed to persist node identity")
+	}
+
+	logger.Info("Generated new node identity %x", priv.Public())
+	return priv, nil
+}
+
+// parsePublicKeys decodes hex encoded ed25519 public keys.
+func parsePublicKeys(encoded []string) ([]ed25519.PublicKey, error) {
+	keys := make([]ed25519.PublicKey, 0, len(encoded))
+	for _, e := range encoded {
+		b, err := hex.DecodeString(strings.TrimSpace(e))
+		if err != nil || len(b) != ed25519.PublicKeySize {
+			return nil, errors.NewConfigError(fmt.Sprintf("invalid peer public key: %s", e))
+		}
+		keys = append(keys, ed25519.PublicKey(b))
+	}
+	return keys, nil
+}
+
+// PublicKey returns the public identity key of the node.
+func (s *FileServer) PublicKey() ed25519.PublicKey {
+	return s.Identity.Public().(ed25519.PublicKey)
+}
+
+// sealMessage encodes msg in format and signs it with the node's identity
+// key.
+func (s *FileServer) sealMessage(msg *Message, format wireFormat) ([]byte, error) {
+	body, err := format.marshal(msg)
+	if err != nil {
+		return nil, errors.Wrap(err, errors.InternalError, "failed to encode message")
+	}
+
+	env := Envelope{
+		Body:      body,
+		PublicKey: s.PublicKey(),
+		Signature: ed25519.Sign(s.Identity, body),
+	}
+
+	b, err := format.marshal(&env)
+	if err != nil {
+		return nil, errors.Wrap(err, errors.InternalError, "failed to encode message envelope")
+	}
+	return b, nil
+}
+
+// openMessage verifies the signature of an envelope received from a peer and
+// decodes the message inside it. The signing key must be one of the trusted
+// peer keys when those are configured; otherwise the key the connection
+// proved in its handshake, or else the first key it presents, is pinned
+// until it closes, and messages signed with any other key on that
+// connection are rejected.
+func (s *FileServer) openMessage(from string, format wireFormat, data []byte) (*Message, error) {
+	var env Envelope
+	if err := format.unmarshal(data, &env); err != nil {
+		return nil, errors.Wrap(err, errors.InvalidInputError, "failed to decode message envelope")
+	}
+
+	if len(env.PublicKey) != ed25519.PublicKeySize || !ed25519.Verify(env.PublicKey, env.Body, env.Signature) {
+		return nil, errors.NewAuthenticationError("invalid message signature").WithContext("peer", from)
+	}
+
+	if err := s.checkPeerKey(from, env.PublicKey); err != nil {
+		return nil, err
+	}
+
+	var msg Message
+	if err := format.unmarshal(env.Body, &msg); err != nil {
+		return nil, errors.Wrap(err, errors.InvalidInputError, "failed to decode message")
+	}
+	return &msg, nil
+}
+
+func (s *FileServer) checkPeerKey(from string, key ed25519.PublicKey) error {
+	if len(s.TrustedPeerKeys) > 0 {
+		return s.checkTrustedKey(from, key)
+	}
+
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	pinned, ok := s.peerKeys[from]
+	if !ok {
+		s.peerKeys[from] = key
+		return nil
+	}
+	if !pinned.Equal(key) {
+		return errors.NewAuthenticationError("peer changed its identity key").
+			WithContext("peer", from).WithContext("key", hex.EncodeToString(key))
+	}
+	return nil
+}
+
+// checkTrustedKey refuses a key that is not one of the trusted peer keys.
+func (s *FileServer) checkTrustedKey(from string, key ed25519.PublicKey) error {
+	for _, trusted := range s.TrustedPeerKeys {
+		if trusted.Equal(key) {
+			return nil
+		}
+	}
+	return errors.NewAuthenticationError("message signed by untrusted key").
+		WithContext("peer", from).WithContext("key", hex.EncodeToString(key))
+}
+
+// pinPeerKey pins key as the key of the connection from addr, in place of
+// the key of an earlier connection from the same address.
+func (s *FileServer) pinPeerKey(addr string, key ed25519.PublicKey) {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+	s.peerKeys[addr] = key
+}
+
+// forgetPeerKey unpins the key of the connection from addr once it closes.
+func (s *FileServer) forgetPeerKey(addr string) {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+	delete(s.peerKeys, addr)
+}
+
+// handshake returns the handshake of the connections to peers: both ends
+// prove the identity key they sign control messages with, and know the
+// secret of opts when it is set, before a message is exchanged. The key a
+// peer proved is checked against the trusted keys, and pinned for the
+// connection. Without a secret nor trusted keys any key would do, so every
+// peer is refused.
+func (s *FileServer) handshake(opts p2p.HandshakeOpts) p2p.HandshakeFunc {
+	opts.ID = s.ID
+	opts.Key = s.Identity
+	unauthenticated := len(opts.Secret) == 0 && len(s.TrustedPeerKeys) == 0
+	if unauthenticated {
+		s.logger.Warn("Neither a cluster secret nor trusted peer keys are configured: every peer will be refused")
+	}
+	opts.Authorize = func(p p2p.Peer, id string, key ed25519.PublicKey) error {
+		if unauthenticated {
+			return errors.NewAuthenticationError("peers are refused without a cluster secret or trusted peer keys").
+				WithContext("peer", p.RemoteAddr().String())
+		}
+		addr := p.RemoteAddr().String()
+		if len(s.TrustedPeerKeys) > 0 {
+			if err := s.checkTrustedKey(addr, key); err != nil {
+				return err
+			}
+		}
+		// The connection proved it holds the key, which may differ from
+		// the key of a connection that came from the same address before.
+		s.pinPeerKey(addr, key)
+		s.logger.Debug("Peer %s at %s proved identity key %x", id, p.RemoteAddr(), key)
+		return nil
+	}
+	return p2p.KeyHandshakeFunc(opts)
+}
+
+// clusterSecretLabel derives the cluster secret from the join token.
+const clusterSecretLabel = "foreverstore-cluster-secret-v1"
+
+// clusterSecret returns the secret the nodes of the cluster prove they
+// know in the handshake: the configured cluster secret or, for clusters
+// joined with a join token, one derived from the token, which every member
+// holds to accept the joins. It is empty when neither is set.
+func clusterSecret(clusterSecret, joinToken string) []byte {
+	if clusterSecret != "" {
+		return []byte(clusterSecret)
+	}
+	if joinToken == "" {
+		return nil
+	}
+	mac := hmac.New(sha256.New, []byte(joinToken))
+	mac.Write([]byte(clusterSecretLabel))
+	return mac.Sum(nil)
+}
+
+func init() {
+	gob.Register(Envelope{})
+}
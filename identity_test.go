@@ -0,0 +1,236 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/anthdm/foreverstore/errors"
+	"github.com/anthdm/foreverstore/p2p"
+	"github.com/stretchr/testify/assert"
+)
+
+func newIdentityTestServer(trusted ...ed25519.PublicKey) *FileServer {
+	return NewFileServer(FileServerOpts{
+		StorageRoot:       "/tmp/fs_test_identity",
+		PathTransformFunc: CASPathTransformFunc,
+		Transport:         p2p.NewTCPTransport(p2p.TCPTransportOpts{ListenAddr: ":0"}),
+		TrustedPeerKeys:   trusted,
+	})
+}
+
+func TestLoadNodeIdentityIsPersisted(t *testing.T) {
+	tempDir := "/tmp/fs_test_identity_load"
+	defer os.RemoveAll(tempDir)
+	path := filepath.Join(tempDir, defaultIdentityFileName)
+
+	first, err := loadNodeIdentity(path)
+	assert.Nil(t, err)
+	second, err := loadNodeIdentity(path)
+	assert.Nil(t, err)
+	assert.True(t, first.Equal(second))
+}
+
+func TestSignedMessageRoundTrip(t *testing.T) {
+	sender := newIdentityTestServer()
+	receiver := newIdentityTestServer()
+
+	for _, format := range []wireFormat{formatGob, formatMsgpack} {
+		b, err := sender.sealMessage(&Message{Payload: MessageStoreFile{ID: "node", Key: "key", Size: 10, HMAC: make([]byte, 32)}}, format)
+		assert.Nil(t, err)
+
+		msg, err := receiver.openMessage("peer", format, b)
+		assert.Nil(t, err)
+		assert.Equal(t, "key", msg.Payload.(MessageStoreFile).Key)
+
+		// Neither format opens the other.
+		_, err = receiver.openMessage("peer", 1-format, b)
+		assert.NotNil(t, err)
+	}
+}
+
+func TestTamperedMessageIsRejected(t *testing.T) {
+	sender := newIdentityTestServer()
+	receiver := newIdentityTestServer()
+
+	for _, format := range []wireFormat{formatGob, formatMsgpack} {
+		b, err := sender.sealMessage(&Message{Payload: MessageGetFile{ID: "node", Key: "key"}}, format)
+		assert.Nil(t, err)
+
+		var env Envelope
+		assert.Nil(t, format.unmarshal(b, &env))
+
+		reseal := func(env Envelope) []byte {
+			b, err := format.marshal(&env)
+			assert.Nil(t, err)
+			return b
+		}
+
+		for i := range env.Body {
+			tampered := env
+			tampered.Body = append([]byte(nil), env.Body...)
+			tampered.Body[i] ^= 0xff
+			if _, err := receiver.openMessage("peer", format, reseal(tampered)); err == nil {
+				t.Fatalf("message tampered at byte %d was accepted", i)
+			}
+		}
+
+		forged := env
+		forged.Signature = make([]byte, ed25519.SignatureSize)
+		_, err = receiver.openMessage("peer", format, reseal(forged))
+		assert.True(t, errors.IsType(err, errors.AuthenticationError))
+	}
+}
+
+func TestMessageFromUntrustedKeyIsRejected(t *testing.T) {
+	trusted := newIdentityTestServer()
+	intruder := newIdentityTestServer()
+	receiver := newIdentityTestServer(trusted.PublicKey())
+	trusted.TrustedPeerKeys = []ed25519.PublicKey{receiver.PublicKey()}
+	intruder.TrustedPeerKeys = []ed25519.PublicKey{receiver.PublicKey()}
+
+	b, err := trusted.sealMessage(&Message{Payload: MessageGetFile{Key: "key"}}, formatMsgpack)
+	assert.Nil(t, err)
+	_, err = receiver.openMessage("peer", formatMsgpack, b)
+	assert.Nil(t, err)
+
+	b, err = intruder.sealMessage(&Message{Payload: MessageGetFile{Key: "key"}}, formatMsgpack)
+	assert.Nil(t, err)
+	_, err = receiver.openMessage("peer", formatMsgpack, b)
+	assert.True(t, errors.IsType(err, errors.AuthenticationError))
+}
+
+func TestPeerKeyIsPinned(t *testing.T) {
+	first := newIdentityTestServer()
+	second := newIdentityTestServer()
+	receiver := newIdentityTestServer()
+
+	b, _ := first.sealMessage(&Message{Payload: MessageGetFile{Key: "key"}}, formatMsgpack)
+	_, err := receiver.openMessage("peer", formatMsgpack, b)
+	assert.Nil(t, err)
+
+	b, _ = second.sealMessage(&Message{Payload: MessageGetFile{Key: "key"}}, formatMsgpack)
+	_, err = receiver.openMessage("peer", formatMsgpack, b)
+	assert.True(t, errors.IsType(err, errors.AuthenticationError))
+
+	// Another connection may present its own key.
+	_, err = receiver.openMessage("other", formatMsgpack, b)
+	assert.Nil(t, err)
+
+	// The pin goes with the connection.
+	receiver.forgetPeerKey("peer")
+	_, err = receiver.openMessage("peer", formatMsgpack, b)
+	assert.Nil(t, err)
+}
+
+func TestHandshakeChecksPeerKeys(t *testing.T) {
+	// connect has dialer handshake with acceptor, and returns the error
+	// the acceptor took it with.
+	connect := func(dialer, acceptor *FileServer, secret []byte) error {
+		local, remote := net.Pipe()
+		defer remote.Close()
+		accepted := make(chan error, 1)
+		go func() {
+			accepted <- acceptor.handshake(p2p.HandshakeOpts{Secret: secret})(p2p.NewTCPPeer(remote, false))
+		}()
+		dialer.handshake(p2p.HandshakeOpts{Secret: secret})(p2p.NewTCPPeer(local, true))
+		local.Close()
+		return <-accepted
+	}
+	trusted := newIdentityTestServer()
+	intruder := newIdentityTestServer()
+
+	receiver := newIdentityTestServer(trusted.PublicKey())
+	trusted.TrustedPeerKeys = []ed25519.PublicKey{receiver.PublicKey()}
+	intruder.TrustedPeerKeys = []ed25519.PublicKey{receiver.PublicKey()}
+	assert.Nil(t, connect(trusted, receiver, nil))
+	assert.True(t, errors.IsType(connect(intruder, receiver, nil), errors.AuthenticationError))
+
+	// Without trusted keys nor a secret, any key would do: every peer is
+	// refused.
+	receiver = newIdentityTestServer()
+	sender := newIdentityTestServer(receiver.PublicKey())
+	assert.True(t, errors.IsType(connect(sender, receiver, nil), errors.AuthenticationError))
+
+	// The key proven is the one the messages of the connection must be
+	// signed with.
+	assert.Nil(t, connect(sender, receiver, testClusterSecret))
+	b, _ := intruder.sealMessage(&Message{Payload: MessageGetFile{Key: "key"}}, formatMsgpack)
+	_, err := receiver.openMessage("pipe", formatMsgpack, b)
+	assert.True(t, errors.IsType(err, errors.AuthenticationError))
+
+	// A later connection from the same address proves a key of its own.
+	rekeyed := newIdentityTestServer(receiver.PublicKey())
+	assert.Nil(t, connect(rekeyed, receiver, testClusterSecret))
+	b, _ = rekeyed.sealMessage(&Message{Payload: MessageGetFile{Key: "key"}}, formatMsgpack)
+	_, err = receiver.openMessage("pipe", formatMsgpack, b)
+	assert.Nil(t, err)
+}
+
+func TestPeerKeysAreForgottenOnDisconnect(t *testing.T) {
+	c := newTestCluster(t, 2)
+	s := c.nodes[0]
+	peerKeys := func() int {
+		s.peerLock.Lock()
+		defer s.peerLock.Unlock()
+		return len(s.peerKeys)
+	}
+	if peerKeys() != 1 {
+		t.Fatalf("expected the key of the peer to be pinned, got %d pins", peerKeys())
+	}
+
+	s.dropPeer(c.nodes[1].Transport.Addr())
+	assert.Equal(t, 0, peerKeys())
+}
+
+func TestPeerNamespaceIsValidated(t *testing.T) {
+	assert.True(t, validNamespace("3f2a9c"))
+	for _, id := range []string{"", ".", "..", "../etc", "a/b", `a\b`, "a\x00"} {
+		assert.False(t, validNamespace(id), id)
+	}
+
+	s := newIdentityTestServer()
+	err := s.handleMessage("peer", &Message{Payload: MessageGetFile{ID: "../../etc", Key: "passwd"}})
+	assert.True(t, errors.IsType(err, errors.InvalidInputError))
+}
+
+// FuzzOpenMessage feeds arbitrary envelopes, and arbitrary message bodies
+// carried in correctly signed envelopes, to openMessage. Neither may panic.
+func FuzzOpenMessage(f *testing.F) {
+	sender := newIdentityTestServer()
+	formats := []wireFormat{formatGob, formatMsgpack}
+	for _, format := range formats {
+		body, _ := format.marshal(Message{Payload: MessageStoreFile{ID: "node", Key: "key", Size: 10}})
+		sealed, _ := sender.sealMessage(&Message{Payload: MessageGetFile{ID: "node", Key: "key"}}, format)
+		f.Add(sealed)
+		f.Add(body)
+	}
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		receiver := newIdentityTestServer()
+		for _, format := range formats {
+			receiver.openMessage("peer", format, data)
+
+			sealed, _ := format.marshal(Envelope{
+				Body:      data,
+				PublicKey: sender.PublicKey(),
+				Signature: ed25519.Sign(sender.Identity, data),
+			})
+			receiver.openMessage("peer", format, sealed)
+		}
+	})
+}
+
+func TestClusterSecretIsDerivedFromJoinToken(t *testing.T) {
+	assert.Equal(t, []byte("secret"), clusterSecret("secret", "token"))
+	assert.Nil(t, clusterSecret("", ""))
+
+	derived := clusterSecret("", "token")
+	assert.NotEmpty(t, derived)
+	assert.NotEqual(t, []byte("token"), derived)
+	assert.Equal(t, derived, clusterSecret("", "token"))
+	assert.NotEqual(t, derived, clusterSecret("", "other token"))
+}
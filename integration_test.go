@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"net"
@@ -9,6 +10,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/anthdm/foreverstore/config"
 	"github.com/anthdm/foreverstore/p2p"
 	"github.com/stretchr/testify/assert"
 )
@@ -28,15 +30,7 @@ func TestFileServerBasic(t *testing.T) {
 	server := createTestServer(addr, tempDir, []string{})
 
 	// Start server
-	go func() {
-		err := server.Start()
-		if err != nil {
-			t.Logf("Server error: %v", err)
-		}
-	}()
-
-	// Give server time to start
-	time.Sleep(200 * time.Millisecond)
+	assert.Nil(t, server.Start())
 
 	// Test file storage and retrieval
 	testData := []byte("Hello, distributed file system!")
@@ -72,13 +66,31 @@ func TestFileServerBasic(t *testing.T) {
 
 	// Clean up
 	server.Stop()
-	time.Sleep(100 * time.Millisecond)
+	server.Wait()
 }
 
 func TestFileServerReplication(t *testing.T) {
 	t.Skip("Skipping complex replication test - needs more work on networking logic")
 }
 
+func TestFileServerReplicationUnderLatency(t *testing.T) {
+	c := newTestCluster(t, 2)
+	for _, ft := range c.faults {
+		ft.SetFaults(p2p.FaultConfig{Latency: 5 * time.Millisecond, Jitter: 10 * time.Millisecond})
+	}
+
+	data := bytes.Repeat([]byte("replicated under latency "), 1000)
+	c.store(1, "slow", data)
+	c.assertConverged(1, "slow")
+
+	// With the local copy gone, the replica has to come back over the
+	// slow network.
+	c.faults[1].SetFaults(p2p.FaultConfig{Latency: 20 * time.Millisecond})
+	s := c.nodes[1]
+	assert.Nil(t, s.store.Delete(s.ID, "slow"))
+	assert.Equal(t, data, c.get(1, "slow"))
+}
+
 func TestFileServerNetworkFailure(t *testing.T) {
 	// Create temporary directory
 	tempDir := "/tmp/fs_fail_test"
@@ -94,10 +106,7 @@ func TestFileServerNetworkFailure(t *testing.T) {
 	server := createTestServer(addr, tempDir, []string{})
 
 	// Start server
-	go func() {
-		server.Start()
-	}()
-	time.Sleep(100 * time.Millisecond)
+	assert.Nil(t, server.Start())
 
 	// Try to get a non-existent file (should fail gracefully)
 	_, err = server.Get("non_existent_file.txt")
@@ -107,25 +116,51 @@ func TestFileServerNetworkFailure(t *testing.T) {
 	server.Stop()
 }
 
-func createTestServer(listenAddr, storageRoot string, bootstrapNodes []string) *FileServer {
-	tcpTransportOpts := p2p.TCPTransportOpts{
-		ListenAddr:    listenAddr,
-		HandshakeFunc: p2p.NOPHandshakeFunc,
-		Decoder:       p2p.DefaultDecoder{},
+func TestFileServerRunUntilCancelled(t *testing.T) {
+	tempDir := t.TempDir()
+
+	listener, err := net.Listen("tcp", ":0")
+	assert.Nil(t, err)
+	addr := listener.Addr().String()
+	listener.Close()
+
+	server := createTestServer(addr, tempDir, []string{})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- server.Run(ctx) }()
+
+	select {
+	case <-server.Ready():
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not become ready")
 	}
-	tcpTransport := p2p.NewTCPTransport(tcpTransportOpts)
-
-	fileServerOpts := FileServerOpts{
-		EncKey:            newEncryptionKey(),
-		StorageRoot:       storageRoot,
-		PathTransformFunc: CASPathTransformFunc,
-		Transport:         tcpTransport,
-		BootstrapNodes:    bootstrapNodes,
+	assert.Nil(t, server.Store("ready.txt", bytes.NewReader([]byte("served once ready"))))
+
+	cancel()
+	select {
+	case err := <-done:
+		assert.Nil(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not stop when its context was cancelled")
 	}
+	server.Wait()
+}
 
-	server := NewFileServer(fileServerOpts)
-	tcpTransport.OnPeer = server.OnPeer
+// testAdminToken is the admin token of the servers of createTestServer.
+const testAdminToken = "test admin token"
 
+func createTestServer(listenAddr, storageRoot string, bootstrapNodes []string) *FileServer {
+	cfg := config.DefaultConfig()
+	cfg.ListenAddr = listenAddr
+	cfg.StorageRoot = storageRoot
+	cfg.BootstrapNodes = bootstrapNodes
+	cfg.ClusterSecret = string(testClusterSecret)
+	cfg.AdminToken = testAdminToken
+
+	server, err := New(cfg, WithEncryptionKey(newEncryptionKey()))
+	if err != nil {
+		panic(err)
+	}
 	return server
 }
 
@@ -141,8 +176,9 @@ func BenchmarkFileStorage(b *testing.B) {
 	listener.Close()
 
 	server := createTestServer(addr, tempDir, []string{})
-	go server.Start()
-	time.Sleep(100 * time.Millisecond)
+	if err := server.Start(); err != nil {
+		b.Fatal(err)
+	}
 	defer server.Stop()
 
 	testData := bytes.Repeat([]byte("benchmark data "), 1000) // ~15KB
@@ -173,8 +209,9 @@ func BenchmarkFileRetrieval(b *testing.B) {
 	listener.Close()
 
 	server := createTestServer(addr, tempDir, []string{})
-	go server.Start()
-	time.Sleep(100 * time.Millisecond)
+	if err := server.Start(); err != nil {
+		b.Fatal(err)
+	}
 	defer server.Stop()
 
 	// Pre-populate with test files
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"hash"
+	"io"
+
+	"github.com/anthdm/foreverstore/errors"
+)
+
+const integrityKeyLabel = "foreverstore-integrity-v1"
+
+// integrityHeader is sent ahead of an object's data when it is served to a
+// peer, so the receiver can verify the plaintext after decryption.
+type integrityHeader struct {
+	KeyVersion uint32
+	HMAC       [sha256.Size]byte
+}
+
+// newIntegrityHash returns the HMAC used to tag object plaintext. Its key is
+// derived from the cluster encryption key with the given version, so every
+// node holding that key can verify the tag, but it is never the encryption
+// key itself.
+func newIntegrityHash(keys KeyLookup, version uint32) (hash.Hash, error) {
+	key, err := keys(version)
+	if err != nil {
+		return nil, err
+	}
+	derive := hmac.New(sha256.New, key)
+	derive.Write([]byte(integrityKeyLabel))
+	return hmac.New(sha256.New, derive.Sum(nil)), nil
+}
+
+// computeIntegrity returns the integrity tag of everything read from r.
+func computeIntegrity(keys KeyLookup, version uint32, r io.Reader) ([]byte, error) {
+	mac, err := newIntegrityHash(keys, version)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(mac, r); err != nil {
+		return nil, err
+	}
+	return mac.Sum(nil), nil
+}
+
+// verifyingReader passes data through while computing its integrity tag,
+// and fails with a corruption error at EOF if it does not match.
+type verifyingReader struct {
+	r    io.Reader
+	mac  hash.Hash
+	want []byte
+	key  string
+}
+
+func newVerifyingReader(r io.Reader, keys KeyLookup, meta ObjectMeta, key string) (io.Reader, error) {
+	mac, err := newIntegrityHash(keys, meta.KeyVersion)
+	if err != nil {
+		return nil, err
+	}
+	return &verifyingReader{r: r, mac: mac, want: meta.HMAC, key: key}, nil
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	v.mac.Write(p[:n])
+	if err == io.EOF && !hmac.Equal(v.mac.Sum(nil), v.want) {
+		return n, errors.NewCorruptionError("object failed integrity verification").
+			WithContext("key", v.key)
+	}
+	return n, err
+}
+
+// Close closes the underlying reader if it is closable.
+func (v *verifyingReader) Close() error {
+	if c, ok := v.r.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// checkFetchedIntegrity verifies an object fetched from a peer against the
+// integrity tag the peer sent along, and records the tag, the checksum of
+// the object, its client metadata and lock locally.
+func (s *FileServer) checkFetchedIntegrity(key string, integrity integrityHeader, client *ClientMeta, lock *ObjectLock) error {
+	var empty [sha256.Size]byte
+	if integrity.HMAC == empty {
+		if client == nil && lock == nil {
+			return nil
+		}
+		return s.store.WriteMeta(s.ID, key, ObjectMeta{Client: client, Lock: lock})
+	}
+
+	_, r, err := s.store.Read(s.ID, key)
+	if err != nil {
+		return errors.Wrap(err, errors.StorageError, "failed to read fetched file")
+	}
+	checksum := sha256.New()
+	sum, err := computeIntegrity(s.keyRing.Lookup, integrity.KeyVersion, io.TeeReader(r, checksum))
+	if c, ok := r.(io.Closer); ok {
+		c.Close()
+	}
+	if err != nil {
+		return errors.Wrap(err, errors.StorageError, "failed to verify fetched file")
+	}
+
+	if !hmac.Equal(sum, integrity.HMAC[:]) {
+		return errors.NewCorruptionError("fetched file failed integrity verification").
+			WithContext("key", key)
+	}
+
+	meta := ObjectMeta{HMAC: sum, KeyVersion: integrity.KeyVersion, SHA256: checksum.Sum(nil), Client: client, Lock: lock}
+	return s.store.WriteMeta(s.ID, key, meta)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/anthdm/foreverstore/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifyingReader(t *testing.T) {
+	keys := staticKey(newEncryptionKey())
+	payload := []byte("integrity protected content")
+
+	sum, err := computeIntegrity(keys, 0, bytes.NewReader(payload))
+	assert.Nil(t, err)
+
+	r, err := newVerifyingReader(bytes.NewReader(payload), keys, ObjectMeta{HMAC: sum}, "key")
+	assert.Nil(t, err)
+	b, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, payload, b)
+
+	modified := append([]byte{}, payload...)
+	modified[0] ^= 1
+	r, err = newVerifyingReader(bytes.NewReader(modified), keys, ObjectMeta{HMAC: sum}, "key")
+	assert.Nil(t, err)
+	_, err = io.ReadAll(r)
+	assert.True(t, errors.IsType(err, errors.CorruptionError))
+}
+
+func TestIntegrityKeyIsNotEncryptionKey(t *testing.T) {
+	key := newEncryptionKey()
+	a, _ := computeIntegrity(staticKey(key), 0, bytes.NewReader(nil))
+	b, _ := computeIntegrity(staticKey(newEncryptionKey()), 0, bytes.NewReader(nil))
+	assert.NotEqual(t, a, b)
+}
+
+func TestGetDetectsModifiedLocalFile(t *testing.T) {
+	tempDir := "/tmp/fs_test_integrity"
+	defer os.RemoveAll(tempDir)
+
+	server := createTestServer(":0", tempDir, []string{})
+	assert.Nil(t, server.Store("doc", bytes.NewReader([]byte("original content"))))
+
+	r, err := server.Get("doc")
+	assert.Nil(t, err)
+	b, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, "original content", string(b))
+
+	// Modify the file on disk behind the server's back
+	pathKey := server.store.PathTransformFunc("doc")
+	path := tempDir + "/" + server.ID + "/" + pathKey.FullPath()
+	assert.Nil(t, os.WriteFile(path, []byte("modified content"), 0644))
+
+	r, err = server.Get("doc")
+	assert.Nil(t, err)
+	_, err = io.ReadAll(r)
+	assert.True(t, errors.IsType(err, errors.CorruptionError))
+}
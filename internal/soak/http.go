@@ -0,0 +1,56 @@
+package soak
+
+import (
+	"bytes"
+	"context"
+	"io"
+
+	"github.com/anthdm/foreverstore/client"
+)
+
+// HTTPCluster is a running cluster, reached through the HTTP API of its
+// nodes. It can neither be partitioned nor have its replicas inspected, so
+// soaks against it check the workload and that stored objects stay
+// readable from the node that stored them.
+type HTTPCluster struct {
+	clients []*client.Client
+}
+
+// NewHTTPCluster returns the cluster of the nodes serving at endpoints,
+// with a client pinned to each node. token is their admin token, if any.
+func NewHTTPCluster(endpoints []string, token string) (*HTTPCluster, error) {
+	c := &HTTPCluster{}
+	for _, endpoint := range endpoints {
+		cl, err := client.New(client.Options{Endpoints: []string{endpoint}, Token: token})
+		if err != nil {
+			c.Stop()
+			return nil, err
+		}
+		c.clients = append(c.clients, cl)
+	}
+	return c, nil
+}
+
+func (c *HTTPCluster) Size() int {
+	return len(c.clients)
+}
+
+func (c *HTTPCluster) Store(node int, key string, data []byte) error {
+	return c.clients[node].Store(context.Background(), key, bytes.NewReader(data))
+}
+
+func (c *HTTPCluster) Read(node int, key string) (io.ReadCloser, error) {
+	return c.clients[node].Get(context.Background(), key)
+}
+
+// Stored reads the object back from node, which serves its own copy.
+func (c *HTTPCluster) Stored(node int, key string) (io.ReadCloser, error) {
+	return c.Read(node, key)
+}
+
+// Stop closes the clients; the cluster itself keeps running.
+func (c *HTTPCluster) Stop() {
+	for _, cl := range c.clients {
+		cl.Close()
+	}
+}
@@ -0,0 +1,449 @@
+// Package soak runs a soak test: a mixed workload against a cluster, under
+// injected faults, for as long as asked, checking as it goes that no data
+// is lost, that objects keep their replicas, and that goroutines do not
+// leak. The cluster is anything implementing Cluster: the fs binary runs
+// the soak against a cluster of its servers in-process ("fs soak"), and
+// cmd/soak against a running cluster through its HTTP API.
+package soak
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Cluster is the cluster a soak runs against. Nodes are numbered from 0.
+type Cluster interface {
+	// Size returns the number of nodes.
+	Size() int
+	// Store stores data under key through node.
+	Store(node int, key string, data []byte) error
+	// Read opens the object node stored under key, as a client reads it.
+	Read(node int, key string) (io.ReadCloser, error)
+	// Stored opens the copy of the object node stored under key that the
+	// node keeps itself.
+	Stored(node int, key string) (io.ReadCloser, error)
+	// Stop stops the cluster, or releases it when the soak does not own it.
+	Stop()
+}
+
+// Faults is implemented by the clusters whose network the soak can
+// partition.
+type Faults interface {
+	// Partition cuts the nodes in left off from the others.
+	Partition(left []int)
+	// Heal undoes the partition.
+	Heal()
+}
+
+// Replicas is implemented by the clusters whose replicas the soak can
+// check.
+type Replicas interface {
+	// Replica opens the decrypted replica holder keeps of the object
+	// origin stored under key. It returns ErrMissing when holder has none.
+	Replica(holder, origin int, key string) (io.ReadCloser, error)
+}
+
+// ErrMissing is returned by Replica for the replicas a node lacks.
+var ErrMissing = fmt.Errorf("missing")
+
+// Options configures a soak run.
+type Options struct {
+	Duration   time.Duration
+	ObjectSize int
+	// Partitions has the network partitioned and healed every
+	// FaultInterval; the cluster must implement Faults.
+	Partitions     bool
+	FaultInterval  time.Duration
+	VerifyInterval time.Duration
+	// GoroutineSlack is how far the number of goroutines may grow past the
+	// count of the freshly connected cluster before it counts as a leak.
+	GoroutineSlack int
+	Seed           int64
+}
+
+// DefaultOptions returns the options of a soak of an hour.
+func DefaultOptions() Options {
+	return Options{
+		Duration:       time.Hour,
+		ObjectSize:     64 * 1024,
+		Partitions:     true,
+		FaultInterval:  30 * time.Second,
+		VerifyInterval: time.Minute,
+		GoroutineSlack: 100,
+		Seed:           time.Now().UnixNano(),
+	}
+}
+
+// Report summarizes a soak run.
+type Report struct {
+	Elapsed       time.Duration
+	Stores        int64
+	Reads         int64
+	Partitions    int
+	Verified      int
+	GoroutineBase int
+	GoroutinePeak int
+	Violations    []string
+}
+
+// maxViolations bounds the violations kept in a report; a broken invariant
+// tends to break for every object that follows.
+const maxViolations = 100
+
+// object is a stored object and the nodes expected to hold it.
+type object struct {
+	origin  int
+	key     string
+	sum     [sha256.Size]byte
+	holders []int
+}
+
+type run struct {
+	opts    Options
+	cluster Cluster
+
+	// topology is held for reading by every store and for writing while
+	// the partitions change or objects are verified, so each store sees a
+	// stable network and verification sees no store half done.
+	topology sync.RWMutex
+	groups   []int
+
+	mu       sync.Mutex
+	objects  []object
+	verified int
+	report   Report
+	stores   int64
+	reads    int64
+}
+
+// Run runs a soak test against c and returns its report. The error is only
+// set when the soak could not be run at all; broken invariants are listed
+// in the report. Run does not stop c.
+func Run(c Cluster, opts Options, out io.Writer) (*Report, error) {
+	if c.Size() < 2 {
+		return nil, fmt.Errorf("a soak needs at least 2 nodes, got %d", c.Size())
+	}
+	if opts.ObjectSize < 1 {
+		return nil, fmt.Errorf("invalid object size: %d", opts.ObjectSize)
+	}
+	if _, ok := c.(Faults); opts.Partitions && !ok {
+		return nil, fmt.Errorf("the cluster cannot be partitioned")
+	}
+
+	r := &run{opts: opts, cluster: c, groups: make([]int, c.Size())}
+	r.report.GoroutineBase = runtime.NumGoroutine()
+	r.report.GoroutinePeak = r.report.GoroutineBase
+	fmt.Fprintf(out, "soak: %d nodes for %s (seed %d)\n", c.Size(), opts.Duration, opts.Seed)
+
+	var (
+		start = time.Now()
+		done  = make(chan struct{})
+		wg    sync.WaitGroup
+	)
+	for node := 0; node < c.Size(); node++ {
+		wg.Add(1)
+		go func(node int) {
+			defer wg.Done()
+			r.work(node, rand.New(rand.NewSource(opts.Seed+int64(node))), done)
+		}(node)
+	}
+
+	var (
+		deadline = time.After(opts.Duration)
+		verify   = time.NewTicker(opts.VerifyInterval)
+		faults   <-chan time.Time
+		rng      = rand.New(rand.NewSource(opts.Seed))
+	)
+	defer verify.Stop()
+	if opts.Partitions {
+		ticker := time.NewTicker(opts.FaultInterval)
+		defer ticker.Stop()
+		faults = ticker.C
+	}
+
+loop:
+	for {
+		select {
+		case <-faults:
+			r.togglePartition(rng, out)
+		case <-verify.C:
+			r.verify(false)
+			r.progress(out, time.Since(start))
+		case <-deadline:
+			break loop
+		}
+	}
+
+	close(done)
+	wg.Wait()
+	r.heal()
+	r.verify(true)
+	r.progress(out, time.Since(start))
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	report := r.report
+	report.Elapsed = time.Since(start)
+	report.Stores = atomic.LoadInt64(&r.stores)
+	report.Reads = atomic.LoadInt64(&r.reads)
+	return &report, nil
+}
+
+// work runs the workload of one node until done is closed: mostly writes
+// of new objects, mixed with reads of objects the node stored earlier.
+// Each node has a single worker, as a node's replication streams to a peer
+// share one connection.
+func (r *run) work(node int, rng *rand.Rand, done <-chan struct{}) {
+	var stored []object
+	for i := 0; ; i++ {
+		select {
+		case <-done:
+			return
+		default:
+		}
+
+		if len(stored) > 0 && rng.Intn(10) < 3 {
+			obj := stored[rng.Intn(len(stored))]
+			if err := r.read(obj); err != nil {
+				r.violation("node %d: read of %s: %v", node, obj.key, err)
+			}
+			atomic.AddInt64(&r.reads, 1)
+			continue
+		}
+
+		data := make([]byte, 1+rng.Intn(r.opts.ObjectSize))
+		rng.Read(data)
+		obj, err := r.store(node, fmt.Sprintf("soak-%d-%d", node, i), data)
+		if err != nil {
+			r.violation("node %d: store: %v", node, err)
+			continue
+		}
+		stored = append(stored, obj)
+		atomic.AddInt64(&r.stores, 1)
+	}
+}
+
+func (r *run) store(node int, key string, data []byte) (object, error) {
+	r.topology.RLock()
+	defer r.topology.RUnlock()
+
+	obj := object{origin: node, key: key, sum: sha256.Sum256(data)}
+	for other, group := range r.groups {
+		if other != node && group == r.groups[node] {
+			obj.holders = append(obj.holders, other)
+		}
+	}
+
+	if err := r.cluster.Store(node, key, data); err != nil {
+		return obj, err
+	}
+
+	r.mu.Lock()
+	r.objects = append(r.objects, obj)
+	r.mu.Unlock()
+	return obj, nil
+}
+
+func (r *run) read(obj object) error {
+	rc, err := r.cluster.Read(obj.origin, obj.key)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return checkSum(rc, obj.sum)
+}
+
+// togglePartition heals a partitioned cluster, or splits a healthy one in
+// two random groups.
+func (r *run) togglePartition(rng *rand.Rand, out io.Writer) {
+	r.topology.Lock()
+	defer r.topology.Unlock()
+
+	partitioned := false
+	for _, group := range r.groups {
+		partitioned = partitioned || group != 0
+	}
+	if partitioned {
+		r.healLocked()
+		fmt.Fprintf(out, "soak: partition healed\n")
+		return
+	}
+
+	var (
+		left, right []int
+		split       = 1 + rng.Intn(len(r.groups)-1)
+	)
+	for n, node := range rng.Perm(len(r.groups)) {
+		if n < split {
+			left = append(left, node)
+			r.groups[node] = 1
+		} else {
+			right = append(right, node)
+		}
+	}
+	r.cluster.(Faults).Partition(left)
+
+	r.mu.Lock()
+	r.report.Partitions++
+	r.mu.Unlock()
+	fmt.Fprintf(out, "soak: partitioned nodes %v from %v\n", left, right)
+}
+
+func (r *run) heal() {
+	r.topology.Lock()
+	defer r.topology.Unlock()
+	r.healLocked()
+}
+
+func (r *run) healLocked() {
+	if faults, ok := r.cluster.(Faults); ok {
+		faults.Heal()
+	}
+	for i := range r.groups {
+		r.groups[i] = 0
+	}
+}
+
+// verify checks that no object has been lost and that every node expected
+// to hold a replica holds an intact one. Periodic checks only cover the
+// objects stored since the previous check; the final one covers them all.
+// It also records the goroutine count, which must stay within the slack of
+// the baseline.
+func (r *run) verify(all bool) {
+	r.topology.Lock()
+	defer r.topology.Unlock()
+
+	r.mu.Lock()
+	from := r.verified
+	if all {
+		from = 0
+	}
+	objects := r.objects[from:]
+	r.verified = len(r.objects)
+	r.mu.Unlock()
+
+	for _, obj := range objects {
+		if err := r.verifyObject(obj); err != nil {
+			r.violation("%v", err)
+		}
+	}
+
+	goroutines := runtime.NumGoroutine()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.report.Verified += len(objects)
+	if goroutines > r.report.GoroutinePeak {
+		r.report.GoroutinePeak = goroutines
+	}
+	if goroutines > r.report.GoroutineBase+r.opts.GoroutineSlack {
+		r.violationLocked("goroutine leak: %d running, %d at start", goroutines, r.report.GoroutineBase)
+	}
+}
+
+func (r *run) verifyObject(obj object) error {
+	rc, err := r.cluster.Stored(obj.origin, obj.key)
+	if err != nil {
+		return fmt.Errorf("node %d lost %s: %v", obj.origin, obj.key, err)
+	}
+	err = checkSum(rc, obj.sum)
+	rc.Close()
+	if err != nil {
+		return fmt.Errorf("node %d: %s: %v", obj.origin, obj.key, err)
+	}
+
+	replicas, ok := r.cluster.(Replicas)
+	if !ok {
+		return nil
+	}
+	for _, holder := range obj.holders {
+		if err := verifyReplica(replicas, holder, obj); err != nil {
+			return fmt.Errorf("node %d: replica of %s from node %d: %v", holder, obj.key, obj.origin, err)
+		}
+	}
+	return nil
+}
+
+// verifyReplica compares the replica a node holds with the original.
+// Replicas are written as the stream is received, so a missing one gets a
+// moment to land before it counts as lost.
+func verifyReplica(replicas Replicas, holder int, obj object) error {
+	for attempt := 0; ; attempt++ {
+		rc, err := replicas.Replica(holder, obj.origin, obj.key)
+		if err == ErrMissing && attempt < 50 {
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		return checkSum(rc, obj.sum)
+	}
+}
+
+func checkSum(r io.Reader, want [sha256.Size]byte) error {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return err
+	}
+	if !bytes.Equal(h.Sum(nil), want[:]) {
+		return fmt.Errorf("content does not match what was stored")
+	}
+	return nil
+}
+
+func (r *run) violation(format string, args ...any) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.violationLocked(format, args...)
+}
+
+func (r *run) violationLocked(format string, args ...any) {
+	if len(r.report.Violations) < maxViolations {
+		r.report.Violations = append(r.report.Violations, fmt.Sprintf(format, args...))
+	}
+}
+
+func (r *run) progress(out io.Writer, elapsed time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fmt.Fprintf(out, "soak: [%s] stores=%d reads=%d verified=%d partitions=%d goroutines=%d violations=%d\n",
+		elapsed.Round(time.Second), atomic.LoadInt64(&r.stores), atomic.LoadInt64(&r.reads), r.report.Verified,
+		r.report.Partitions, runtime.NumGoroutine(), len(r.report.Violations))
+}
+
+// PrintReport writes the outcome of a soak to out and returns the exit
+// code of the soak commands: 1 when an invariant broke, 0 otherwise.
+func PrintReport(out io.Writer, report *Report) int {
+	fmt.Fprintf(out, "soak: finished after %s: %d stores, %d reads, %d objects verified, %d partitions, goroutines %d -> peak %d\n",
+		report.Elapsed.Round(time.Second), report.Stores, report.Reads, report.Verified,
+		report.Partitions, report.GoroutineBase, report.GoroutinePeak)
+	if len(report.Violations) > 0 {
+		fmt.Fprintf(out, "soak: %d invariant violations:\n", len(report.Violations))
+		for _, v := range report.Violations {
+			fmt.Fprintf(out, "  %s\n", v)
+		}
+		return 1
+	}
+	fmt.Fprintln(out, "soak: all invariants held")
+	return 0
+}
+
+// RegisterFlags registers the flags setting opts on flags.
+func (opts *Options) RegisterFlags(flags *flag.FlagSet) {
+	flags.DurationVar(&opts.Duration, "duration", opts.Duration, "how long to run the workload")
+	flags.IntVar(&opts.ObjectSize, "object-size", opts.ObjectSize, "maximum size of the objects written")
+	flags.BoolVar(&opts.Partitions, "partitions", opts.Partitions, "partition and heal the network periodically")
+	flags.DurationVar(&opts.FaultInterval, "fault-interval", opts.FaultInterval, "time between partition changes")
+	flags.DurationVar(&opts.VerifyInterval, "verify-interval", opts.VerifyInterval, "time between invariant checks")
+	flags.IntVar(&opts.GoroutineSlack, "goroutine-slack", opts.GoroutineSlack, "goroutine growth tolerated before reporting a leak")
+	flags.Int64Var(&opts.Seed, "seed", opts.Seed, "seed for the workload and the injected faults")
+}
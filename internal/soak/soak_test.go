@@ -0,0 +1,142 @@
+package soak
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// memCluster keeps the objects of every node in memory, replicating each
+// store to the nodes on the same side of the partition.
+type memCluster struct {
+	mu      sync.Mutex
+	objects []map[string][]byte
+	// replicas[holder][origin] are the replicas holder keeps of origin.
+	replicas [][]map[string][]byte
+	left     map[int]bool
+	// lost has the nodes miss the copies they keep themselves, while
+	// still serving their objects to clients.
+	lost bool
+}
+
+func newMemCluster(n int) *memCluster {
+	c := &memCluster{left: map[int]bool{}}
+	for i := 0; i < n; i++ {
+		c.objects = append(c.objects, map[string][]byte{})
+		var replicas []map[string][]byte
+		for j := 0; j < n; j++ {
+			replicas = append(replicas, map[string][]byte{})
+		}
+		c.replicas = append(c.replicas, replicas)
+	}
+	return c
+}
+
+func (c *memCluster) Size() int { return len(c.objects) }
+func (c *memCluster) Stop()     {}
+
+func (c *memCluster) Store(node int, key string, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.objects[node][key] = data
+	for holder := range c.objects {
+		if holder != node && c.left[holder] == c.left[node] {
+			c.replicas[holder][node][key] = data
+		}
+	}
+	return nil
+}
+
+func (c *memCluster) Read(node int, key string) (io.ReadCloser, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	data, ok := c.objects[node][key]
+	if !ok {
+		return nil, fmt.Errorf("not found")
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (c *memCluster) Stored(node int, key string) (io.ReadCloser, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	data, ok := c.objects[node][key]
+	if c.lost {
+		ok = false
+	}
+	if !ok {
+		return nil, fmt.Errorf("not found")
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (c *memCluster) Replica(holder, origin int, key string) (io.ReadCloser, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	data, ok := c.replicas[holder][origin][key]
+	if !ok {
+		return nil, ErrMissing
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (c *memCluster) Partition(left []int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, node := range left {
+		c.left[node] = true
+	}
+}
+
+func (c *memCluster) Heal() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.left = map[int]bool{}
+}
+
+func shortOptions() Options {
+	opts := DefaultOptions()
+	opts.Duration = 500 * time.Millisecond
+	opts.ObjectSize = 1024
+	opts.FaultInterval = 100 * time.Millisecond
+	opts.VerifyInterval = 100 * time.Millisecond
+	opts.Seed = 1
+	return opts
+}
+
+func TestRunHoldsInvariantsOnAHealthyCluster(t *testing.T) {
+	report, err := Run(newMemCluster(3), shortOptions(), io.Discard)
+	assert.Nil(t, err)
+	assert.Empty(t, report.Violations)
+	assert.Greater(t, report.Stores, int64(0))
+	assert.Greater(t, report.Partitions, 0)
+	assert.GreaterOrEqual(t, report.Verified, int(report.Stores))
+}
+
+func TestRunReportsLostObjects(t *testing.T) {
+	c := newMemCluster(2)
+	c.lost = true
+
+	report, err := Run(c, shortOptions(), io.Discard)
+	assert.Nil(t, err)
+	assert.NotEmpty(t, report.Violations)
+	assert.True(t, strings.Contains(report.Violations[0], "lost"), report.Violations[0])
+}
+
+func TestRunRefusesPartitionsWithoutFaults(t *testing.T) {
+	// Wrapped, the cluster only implements Cluster.
+	_, err := Run(struct{ Cluster }{newMemCluster(2)}, shortOptions(), io.Discard)
+	assert.NotNil(t, err)
+
+	opts := shortOptions()
+	opts.Partitions = false
+	report, err := Run(struct{ Cluster }{newMemCluster(2)}, opts, io.Discard)
+	assert.Nil(t, err)
+	assert.Empty(t, report.Violations)
+}
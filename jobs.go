@@ -0,0 +1,565 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anthdm/foreverstore/errors"
+)
+
+// Jobs are the long maintenance work a node does in the background on
+// demand. A job works through a list of items made as it starts, checking
+// between two items whether it was paused or canceled, and reports its
+// progress and an estimate of the time left as it goes. One job of each
+// kind runs at a time. Jobs are started and controlled through the admin
+// API, on the node itself or on a peer over the control protocol.
+
+// JobKind names the work of a job.
+type JobKind string
+
+const (
+	// JobScrub checks the content of every object of the node, replicas
+	// included, against its integrity tag.
+	JobScrub JobKind = "scrub"
+	// JobGC prunes the directories and namespaces left empty (see
+	// CollectGarbage).
+	JobGC JobKind = "gc"
+	// JobRebalance sends a replica of every object of the node to the
+	// peers with room for one that hold none, like the peers that joined
+	// since the object was stored.
+	JobRebalance JobKind = "rebalance"
+	// JobReplicate repairs every object of the node (see Repair).
+	JobReplicate JobKind = "re-replication"
+	// JobBackup copies every object of the node to the mirror.
+	JobBackup JobKind = "backup"
+)
+
+// JobState is where a job stands.
+type JobState string
+
+const (
+	JobRunning  JobState = "running"
+	JobPaused   JobState = "paused"
+	JobCanceled JobState = "canceled"
+	JobDone     JobState = "done"
+	// JobFailed is the state of a job whose items could not be listed.
+	JobFailed JobState = "failed"
+)
+
+// JobAction is what is done to a job.
+type JobAction string
+
+const (
+	JobStart  JobAction = "start"
+	JobPause  JobAction = "pause"
+	JobResume JobAction = "resume"
+	JobCancel JobAction = "cancel"
+)
+
+// jobHistory bounds the jobs kept for their status, finished or not.
+const jobHistory = 20
+
+// JobStatus reports the progress of a job.
+type JobStatus struct {
+	ID    string   `json:"id"`
+	Kind  JobKind  `json:"kind"`
+	State JobState `json:"state"`
+	// StartedBy is who started the job: an admin, or a peer.
+	StartedBy  string    `json:"started_by,omitempty"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at,omitempty"`
+	// Total is the number of items the job works through, Done the number
+	// worked through so far and Failed those of them that failed.
+	Total  int `json:"total"`
+	Done   int `json:"done"`
+	Failed int `json:"failed"`
+	// ETA is how long the job should still run at its pace so far, zero
+	// until it is known and once the job is over.
+	ETA       time.Duration `json:"eta"`
+	LastError string        `json:"last_error,omitempty"`
+}
+
+// JobRequest starts a job of kind Kind, or acts on the job given by ID or
+// by kind. With Peer set, given by address or node ID, the request is
+// passed on to that peer.
+type JobRequest struct {
+	Kind   JobKind   `json:"kind,omitempty"`
+	ID     string    `json:"id,omitempty"`
+	Action JobAction `json:"action,omitempty"`
+	Peer   string    `json:"peer,omitempty"`
+}
+
+// MessageJob asks a peer to act on its job of kind Kind. By is who asked
+// on the sending node.
+type MessageJob struct {
+	Kind   JobKind
+	Action JobAction
+	By     string
+}
+
+// job is a job started on the node.
+type job struct {
+	status JobStatus
+	// resume is closed when the paused job resumes or is canceled.
+	resume chan struct{}
+	// active is how long the job ran before it was last paused, and since
+	// when it runs again.
+	active time.Duration
+	since  time.Time
+}
+
+type jobManager struct {
+	mu   sync.Mutex
+	jobs []*job
+}
+
+// jobTask is the work of a kind of job: the items it works through, and
+// what is done with each.
+type jobTask struct {
+	list func() ([]string, error)
+	do   func(item string) error
+}
+
+// StartJob starts a job of the given kind in the background. Starting a
+// job while another of its kind is not over fails.
+func (s *FileServer) StartJob(kind JobKind, by string) (JobStatus, error) {
+	task, err := s.jobTask(kind)
+	if err != nil {
+		return JobStatus{}, err
+	}
+	return s.startJob(kind, task, by)
+}
+
+func (s *FileServer) startJob(kind JobKind, task jobTask, by string) (JobStatus, error) {
+	s.jobs.mu.Lock()
+	for _, j := range s.jobs.jobs {
+		if j.status.Kind == kind && !j.over() {
+			s.jobs.mu.Unlock()
+			return JobStatus{}, errors.NewValidationError(fmt.Sprintf("a %s job is still %s", kind, j.status.State)).
+				WithContext("job", j.status.ID)
+		}
+	}
+	now := s.Clock.Now()
+	j := &job{
+		status: JobStatus{ID: generateID(), Kind: kind, State: JobRunning, StartedBy: by, StartedAt: now},
+		since:  now,
+	}
+	s.jobs.jobs = append(s.jobs.jobs, j)
+	s.jobs.trim()
+	status := j.snapshot(now)
+	s.jobs.mu.Unlock()
+
+	s.logger.Info("Started %s job %s", kind, status.ID)
+	go s.runJob(j, task)
+	return status, nil
+}
+
+// ControlJob pauses, resumes or cancels the job given by ID, or the last
+// job of the kind given instead.
+func (s *FileServer) ControlJob(id string, action JobAction) (JobStatus, error) {
+	s.jobs.mu.Lock()
+	defer s.jobs.mu.Unlock()
+
+	j := s.jobs.find(id)
+	if j == nil {
+		return JobStatus{}, errors.NewFileNotFoundError(fmt.Sprintf("job %s", id))
+	}
+	now := s.Clock.Now()
+	st := &j.status
+	switch {
+	case action == JobPause && st.State == JobRunning:
+		st.State = JobPaused
+		j.active += now.Sub(j.since)
+		j.resume = make(chan struct{})
+	case action == JobResume && st.State == JobPaused:
+		st.State = JobRunning
+		j.since = now
+		close(j.resume)
+	case action == JobCancel && !j.over():
+		if st.State == JobPaused {
+			close(j.resume)
+		} else {
+			j.active += now.Sub(j.since)
+		}
+		st.State = JobCanceled
+	case action == JobPause, action == JobResume, action == JobCancel:
+		return j.snapshot(now), errors.NewValidationError(fmt.Sprintf("cannot %s a job that is %s", action, st.State)).
+			WithContext("job", st.ID)
+	default:
+		return j.snapshot(now), errors.NewInvalidInputError(fmt.Sprintf("unknown job action: %s", action))
+	}
+	s.logger.Info("Job %s (%s) is %s", st.ID, st.Kind, st.State)
+	return j.snapshot(now), nil
+}
+
+// Jobs returns the status of the jobs started on the node, latest first.
+func (s *FileServer) Jobs() []JobStatus {
+	s.jobs.mu.Lock()
+	defer s.jobs.mu.Unlock()
+	now := s.Clock.Now()
+	jobs := make([]JobStatus, len(s.jobs.jobs))
+	for i, j := range s.jobs.jobs {
+		jobs[len(jobs)-1-i] = j.snapshot(now)
+	}
+	return jobs
+}
+
+// Job returns the status of the job given by ID, or of the last job of the
+// kind given instead.
+func (s *FileServer) Job(id string) (JobStatus, error) {
+	s.jobs.mu.Lock()
+	defer s.jobs.mu.Unlock()
+	j := s.jobs.find(id)
+	if j == nil {
+		return JobStatus{}, errors.NewFileNotFoundError(fmt.Sprintf("job %s", id))
+	}
+	return j.snapshot(s.Clock.Now()), nil
+}
+
+// RequestJob carries out req on behalf of by: on this node, or on the peer
+// it names over the control protocol, in which case no status is returned.
+func (s *FileServer) RequestJob(req JobRequest, by string) (JobStatus, error) {
+	action := req.Action
+	if action == "" {
+		action = JobStart
+	}
+	if req.Peer == "" {
+		if action == JobStart {
+			return s.StartJob(req.Kind, by)
+		}
+		id := req.ID
+		if id == "" {
+			id = string(req.Kind)
+		}
+		return s.ControlJob(id, action)
+	}
+
+	if req.Kind == "" {
+		return JobStatus{}, errors.NewInvalidInputError("the jobs of a peer are given by kind")
+	}
+	addr := req.Peer
+	peer, ok := s.peer(addr)
+	if !ok {
+		for _, p := range s.Peers() {
+			if p.ID == req.Peer {
+				addr = p.Addr
+				peer, ok = s.peer(addr)
+				break
+			}
+		}
+	}
+	if !ok {
+		return JobStatus{}, errors.NewFileNotFoundError(fmt.Sprintf("peer %s", req.Peer))
+	}
+	msg := Message{Payload: MessageJob{Kind: req.Kind, Action: action, By: by}}
+	if err := s.sendMessage(peer, &msg); err != nil {
+		return JobStatus{}, err
+	}
+	s.logger.Info("Asked peer %s to %s its %s job", addr, action, req.Kind)
+	return JobStatus{}, nil
+}
+
+func (s *FileServer) handleMessageJob(from string, msg MessageJob) error {
+	by := "peer " + from
+	if msg.By != "" {
+		by = msg.By + " via " + by
+	}
+	var err error
+	if msg.Action == JobStart {
+		_, err = s.StartJob(msg.Kind, by)
+	} else {
+		_, err = s.ControlJob(string(msg.Kind), msg.Action)
+	}
+	if err != nil {
+		s.logger.Warn("Failed to %s %s job for %s: %v", msg.Action, msg.Kind, by, err)
+		return err
+	}
+	s.logger.Info("AUDIT: %s job %s by %s", msg.Kind, msg.Action, by)
+	return nil
+}
+
+// runJob works through the items of j until it is done, canceled, or the
+// server stops.
+func (s *FileServer) runJob(j *job, task jobTask) {
+	items, err := task.list()
+	if err != nil {
+		s.updateJob(j, func(st *JobStatus) {
+			st.State = JobFailed
+			st.LastError = err.Error()
+		})
+	} else {
+		s.updateJob(j, func(st *JobStatus) { st.Total = len(items) })
+	}
+
+	for _, item := range items {
+		if !s.proceedJob(j) {
+			break
+		}
+		err := task.do(item)
+		s.updateJob(j, func(st *JobStatus) {
+			st.Done++
+			if err != nil {
+				st.Failed++
+				st.LastError = err.Error()
+			}
+		})
+	}
+
+	s.jobs.mu.Lock()
+	now := s.Clock.Now()
+	if j.status.State == JobRunning {
+		j.status.State = JobDone
+		j.active += now.Sub(j.since)
+	}
+	j.status.FinishedAt = now
+	st := j.snapshot(now)
+	s.jobs.mu.Unlock()
+	s.logger.Info("Job %s (%s) %s: %d of %d items, %d failed", st.ID, st.Kind, st.State, st.Done, st.Total, st.Failed)
+}
+
+// proceedJob waits for j while it is paused, and reports whether it is to
+// carry on: not when it was canceled, or the server stops.
+func (s *FileServer) proceedJob(j *job) bool {
+	for {
+		s.jobs.mu.Lock()
+		state, resume := j.status.State, j.resume
+		s.jobs.mu.Unlock()
+
+		switch state {
+		case JobRunning:
+			select {
+			case <-s.quitch:
+			default:
+				return true
+			}
+		case JobPaused:
+			select {
+			case <-resume:
+				continue
+			case <-s.quitch:
+			}
+		default:
+			return false
+		}
+		s.updateJob(j, func(st *JobStatus) {
+			st.State = JobCanceled
+			st.LastError = "server stopped"
+		})
+		return false
+	}
+}
+
+func (s *FileServer) updateJob(j *job, fn func(*JobStatus)) {
+	s.jobs.mu.Lock()
+	defer s.jobs.mu.Unlock()
+	fn(&j.status)
+}
+
+// over reports whether the job is finished, or about to. Callers hold the
+// lock of the manager.
+func (j *job) over() bool {
+	switch j.status.State {
+	case JobRunning, JobPaused:
+		return false
+	}
+	return true
+}
+
+// snapshot returns the status of the job at now, with its ETA. Callers
+// hold the lock of the manager.
+func (j *job) snapshot(now time.Time) JobStatus {
+	st := j.status
+	active := j.active
+	if st.State == JobRunning {
+		active += now.Sub(j.since)
+	}
+	if !j.over() && st.Done > 0 && st.Total > st.Done {
+		st.ETA = active / time.Duration(st.Done) * time.Duration(st.Total-st.Done)
+	}
+	return st
+}
+
+// find returns the job given by ID, or the last one of the kind given
+// instead. Callers hold mu.
+func (m *jobManager) find(id string) *job {
+	for i := len(m.jobs) - 1; i >= 0; i-- {
+		if j := m.jobs[i]; j.status.ID == id || string(j.status.Kind) == id {
+			return j
+		}
+	}
+	return nil
+}
+
+// trim forgets the oldest jobs that are over past jobHistory. Callers hold
+// mu.
+func (m *jobManager) trim() {
+	for i := 0; len(m.jobs) > jobHistory && i < len(m.jobs); {
+		if m.jobs[i].over() {
+			m.jobs = append(m.jobs[:i], m.jobs[i+1:]...)
+			continue
+		}
+		i++
+	}
+}
+
+// jobTask returns the work of a job of the given kind.
+func (s *FileServer) jobTask(kind JobKind) (jobTask, error) {
+	switch kind {
+	case JobScrub:
+		return jobTask{list: s.listStoredObjects, do: s.scrubObject}, nil
+	case JobGC:
+		return jobTask{
+			list: func() ([]string, error) { return []string{s.store.Root}, nil },
+			do: func(string) error {
+				_, err := s.CollectGarbage()
+				return err
+			},
+		}, nil
+	case JobRebalance:
+		return jobTask{list: s.listOwnKeys, do: s.rebalanceObject}, nil
+	case JobReplicate:
+		return jobTask{list: s.listOwnKeys, do: s.repairObject}, nil
+	case JobBackup:
+		if s.Mirror == nil {
+			return jobTask{}, errors.NewConfigError("no mirror is configured to back up to")
+		}
+		return jobTask{list: s.listOwnKeys, do: s.mirrorObject}, nil
+	}
+	return jobTask{}, errors.NewInvalidInputError(fmt.Sprintf("unknown job kind: %s", kind))
+}
+
+// repairObject repairs the object of this node stored under key, failing
+// when a replica could not be.
+func (s *FileServer) repairObject(key string) error {
+	report, err := s.Repair(key)
+	if err == nil && report.Error != "" {
+		err = errors.NewNetworkError(report.Error)
+	}
+	return err
+}
+
+// listOwnKeys returns the keys of the objects of the node. Objects stored
+// before keys were recorded are left out.
+func (s *FileServer) listOwnKeys() ([]string, error) {
+	var keys []string
+	for cursor := ""; ; {
+		entries, next, err := s.store.Iterate(s.ID, "", cursor, repairPageSize)
+		if err != nil {
+			return nil, errors.Wrap(err, errors.StorageError, "failed to list objects")
+		}
+		for _, entry := range entries {
+			if entry.Key != "" {
+				keys = append(keys, entry.Key)
+			}
+		}
+		if next == "" {
+			return keys, nil
+		}
+		cursor = next
+	}
+}
+
+// listStoredObjects returns the objects on the node, replicas included, as
+// their paths prefixed with their namespace.
+func (s *FileServer) listStoredObjects() ([]string, error) {
+	namespaces, err := os.ReadDir(s.store.Root)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, errors.StorageError, "failed to list namespaces")
+	}
+	var objects []string
+	for _, ns := range namespaces {
+		if !ns.IsDir() {
+			continue
+		}
+		for cursor := ""; ; {
+			entries, next, err := s.store.Iterate(ns.Name(), "", cursor, repairPageSize)
+			if err != nil {
+				return nil, errors.Wrap(err, errors.StorageError, "failed to list objects").WithContext("namespace", ns.Name())
+			}
+			for _, entry := range entries {
+				objects = append(objects, ns.Name()+"/"+entry.Path)
+			}
+			if next == "" {
+				break
+			}
+			cursor = next
+		}
+	}
+	return objects, nil
+}
+
+// scrubObject checks the content of the object listed as item against its
+// integrity tag. Objects without one, and those in the cold tier, pass.
+func (s *FileServer) scrubObject(item string) error {
+	ns, rel, _ := strings.Cut(item, "/")
+	path := filepath.Join(s.store.Root, ns, filepath.FromSlash(rel))
+	meta, err := readMetaFile(path + metaExt)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, errors.CorruptionError, "unreadable metadata").WithContext("object", item)
+	}
+	if meta.Cold != nil || len(meta.HMAC) == 0 {
+		return nil
+	}
+	own := ns == s.ID
+	if own && meta.Key != "" {
+		unlock := s.keyLocks.lock(meta.Key)
+		defer unlock()
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		// Deleted since it was listed.
+		return nil
+	}
+	if !s.contentMatches(path, own, meta) {
+		s.logger.Warn("Scrub: %s does not match its integrity tag", item)
+		return errors.NewCorruptionError("object does not match its integrity tag").WithContext("object", item)
+	}
+	return nil
+}
+
+// rebalanceObject sends a replica of the object of the node stored under
+// key to the peers with room for it that hold none.
+func (s *FileServer) rebalanceObject(key string) error {
+	unlock := s.keyLocks.lock(key)
+	defer unlock()
+
+	meta, err := s.store.ReadMeta(s.ID, key)
+	if os.IsNotExist(err) {
+		// Deleted since it was listed.
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, errors.StorageError, "failed to read object metadata")
+	}
+	size := int64(0)
+	if meta.Cold != nil {
+		size = meta.Cold.Size
+	} else if n, r, err := s.store.Read(s.ID, key); err == nil {
+		size = n
+		r.(io.Closer).Close()
+	}
+
+	answers, _ := s.askReplicas(key, MessageCheckReplica{ID: s.ID, Key: hashKey(key), PresenceOnly: true}, defaultRepairTimeout)
+	peers := s.placementPeers(key, s.replicaEncryption(bucketOf(key)).size(size), func(addr string) bool {
+		status, ok := answers[addr]
+		return ok && !status.Present
+	})
+
+	var lastErr error
+	for addr, peer := range peers {
+		if err := s.pushReplica(peer, key, meta); err != nil {
+			s.logger.Warn("Failed to rebalance %s to peer %s: %v", key, addr, err)
+			lastErr = err
+			continue
+		}
+		s.logger.Debug("Rebalanced %s to peer %s", key, addr)
+	}
+	return lastErr
+}
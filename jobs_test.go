@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/anthdm/foreverstore/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJobPauseResumeCancel(t *testing.T) {
+	c := newTestCluster(t, 1)
+	s := c.nodes[0]
+
+	working, release := make(chan string), make(chan struct{})
+	task := jobTask{
+		list: func() ([]string, error) { return []string{"a", "b", "c"}, nil },
+		do: func(item string) error {
+			working <- item
+			<-release
+			return nil
+		},
+	}
+	started, err := s.startJob("test", task, "admin")
+	assert.Nil(t, err)
+	assert.Equal(t, JobRunning, started.State)
+	_, err = s.startJob("test", task, "admin")
+	assert.Equal(t, errors.ValidationError, errors.GetType(err))
+
+	// A paused job finishes the item in progress and waits, its ETA going
+	// by the pace of the items done.
+	assert.Equal(t, "a", <-working)
+	c.clock.Advance(time.Minute)
+	paused, err := s.ControlJob(started.ID, JobPause)
+	assert.Nil(t, err)
+	assert.Equal(t, JobPaused, paused.State)
+	release <- struct{}{}
+	c.eventually("item to be done", func() bool {
+		st, _ := s.Job(started.ID)
+		return st.Done == 1
+	})
+	c.clock.Advance(time.Hour)
+	st, err := s.Job("test")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, st.Total)
+	assert.Equal(t, 2*time.Minute, st.ETA)
+
+	_, err = s.ControlJob(started.ID, JobPause)
+	assert.Equal(t, errors.ValidationError, errors.GetType(err))
+	_, err = s.ControlJob(started.ID, JobResume)
+	assert.Nil(t, err)
+	assert.Equal(t, "b", <-working)
+	_, err = s.ControlJob("test", JobCancel)
+	assert.Nil(t, err)
+	release <- struct{}{}
+	c.eventually("job to stop", func() bool {
+		st, _ := s.Job(started.ID)
+		return !st.FinishedAt.IsZero()
+	})
+	st, _ = s.Job(started.ID)
+	assert.Equal(t, JobCanceled, st.State)
+	assert.Equal(t, 2, st.Done)
+	assert.Zero(t, st.ETA)
+
+	_, err = s.ControlJob("missing", JobCancel)
+	assert.Equal(t, errors.FileNotFoundError, errors.GetType(err))
+	_, err = s.StartJob("unknown", "admin")
+	assert.Equal(t, errors.InvalidInputError, errors.GetType(err))
+	_, err = s.StartJob(JobBackup, "admin")
+	assert.Equal(t, errors.ConfigError, errors.GetType(err))
+}
+
+func TestJobsScrubAndRebalance(t *testing.T) {
+	c := newTestCluster(t, 2)
+	s, peer := c.nodes[0], c.nodes[1]
+	for i := 0; i < 3; i++ {
+		key := fmt.Sprintf("doc-%d", i)
+		c.store(0, key, []byte("content of "+key))
+		c.assertConverged(0, key)
+	}
+	waitJob := func(s *FileServer, kind JobKind) JobStatus {
+		c.eventually(fmt.Sprintf("%s job to finish", kind), func() bool {
+			st, err := s.Job(string(kind))
+			return err == nil && st.State != JobRunning
+		})
+		st, _ := s.Job(string(kind))
+		return st
+	}
+
+	// Scrubbing finds the replica that no longer matches its tag.
+	path := filepath.Join(peer.store.Root, s.ID, peer.store.PathTransformFunc(hashKey("doc-1")).FullPath())
+	b, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	b[len(b)-1] ^= 1
+	assert.Nil(t, os.WriteFile(path, b, 0644))
+	_, err = peer.StartJob(JobScrub, "admin")
+	assert.Nil(t, err)
+	st := waitJob(peer, JobScrub)
+	assert.Equal(t, JobDone, st.State)
+	assert.Equal(t, 3, st.Total)
+	assert.Equal(t, 1, st.Failed)
+
+	// Rebalancing sends a replica to the peer holding none.
+	assert.Nil(t, peer.store.Delete(s.ID, hashKey("doc-2")))
+	_, err = s.StartJob(JobRebalance, "admin")
+	assert.Nil(t, err)
+	st = waitJob(s, JobRebalance)
+	assert.Equal(t, JobDone, st.State)
+	assert.Equal(t, 0, st.Failed)
+	assert.True(t, c.holds(1, 0, "doc-2"))
+
+	// Jobs are started on peers over the control protocol.
+	_, err = s.RequestJob(JobRequest{Kind: JobGC, Peer: "node-1"}, "admin")
+	assert.Nil(t, err)
+	c.eventually("gc job to run on the peer", func() bool {
+		st, err := peer.Job(string(JobGC))
+		return err == nil && st.State == JobDone
+	})
+	st, _ = peer.Job(string(JobGC))
+	assert.True(t, strings.HasPrefix(st.StartedBy, "admin via peer "), st.StartedBy)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/anthdm/foreverstore/admin"
+	"github.com/anthdm/foreverstore/config"
+	"github.com/anthdm/foreverstore/errors"
+	"github.com/anthdm/foreverstore/logger"
+)
+
+// A node joins a cluster through any of its members, given the admin API
+// address of the member and the join token of the cluster: it downloads the
+// addresses of the members, the cluster settings and the identity keys the
+// members trust, if they restrict their peers to some, and dials the members
+// as if they were its bootstrap nodes, which introduces it to them. Growing
+// the cluster takes no list of members kept by hand.
+
+// joinTimeout bounds the join request of a node joining the cluster.
+const joinTimeout = 30 * time.Second
+
+// JoinRequest is what a node joining the cluster sends to POST /join, with
+// the join token as a bearer token.
+type JoinRequest struct {
+	// ListenAddr is the address the joining node accepts peers at, and
+	// PublicKey its identity key, hex encoded.
+	ListenAddr string `json:"listen_addr"`
+	PublicKey  string `json:"public_key"`
+}
+
+// JoinInfo is what a member tells a node joining the cluster through it.
+type JoinInfo struct {
+	// Members are the addresses the members accept peers at, the member
+	// answering first. Addresses without a host are reached at the host of
+	// the member.
+	Members []string `json:"members"`
+	// TrustedPeerKeys are the identity keys, hex encoded, the member
+	// restricts its peers to, if any.
+	TrustedPeerKeys []string               `json:"trusted_peer_keys,omitempty"`
+	Settings        config.ClusterSettings `json:"settings"`
+	// KeyVersion is the version of the encryption key the member writes
+	// with, and CipherSuite the cipher its replicas are encrypted with.
+	KeyVersion  uint32 `json:"key_version"`
+	CipherSuite string `json:"cipher_suite"`
+}
+
+// AcceptJoin lets the node described by req join the cluster through this
+// node, when token is the JoinToken of this node, and returns what it needs
+// to join.
+func (s *FileServer) AcceptJoin(token string, req JoinRequest) (JoinInfo, error) {
+	if s.JoinToken == "" {
+		return JoinInfo{}, errors.NewAuthorizationError("this node does not accept joins")
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(s.JoinToken)) != 1 {
+		return JoinInfo{}, errors.NewAuthenticationError("invalid join token")
+	}
+	if req.ListenAddr == "" {
+		return JoinInfo{}, errors.NewInvalidInputError("missing listen address")
+	}
+	if key, err := hex.DecodeString(req.PublicKey); err != nil || len(key) != ed25519.PublicKeySize {
+		return JoinInfo{}, errors.NewInvalidInputError("invalid public key")
+	}
+
+	info := JoinInfo{
+		Members:     []string{s.advertiseAddr()},
+		Settings:    s.ClusterSettings(),
+		CipherSuite: s.replicaCipher(),
+	}
+	info.KeyVersion, _ = s.keyRing.Current()
+	for _, p := range s.Peers() {
+		if p.ListenAddr != "" {
+			info.Members = append(info.Members, p.ListenAddr)
+		}
+	}
+	for _, key := range s.TrustedPeerKeys {
+		info.TrustedPeerKeys = append(info.TrustedPeerKeys, hex.EncodeToString(key))
+	}
+
+	s.logger.Info("Node at %s joins the cluster", req.ListenAddr)
+	if len(s.TrustedPeerKeys) > 0 {
+		s.logger.Warn("Members trust a fixed set of peer keys: add key %s of the node at %s to their trusted peer keys",
+			req.PublicKey, req.ListenAddr)
+	}
+	return info, nil
+}
+
+// joinCluster asks the member whose admin API is at cfg.Join to let the
+// node of identity join the cluster, and makes the members the bootstrap
+// nodes of cfg. The identity keys the members trust are trusted too, unless
+// cfg lists its own.
+func joinCluster(cfg *config.Config, identity ed25519.PrivateKey) (JoinInfo, error) {
+	listen := cfg.AdvertiseAddr
+	if listen == "" {
+		listen = cfg.ListenAddr
+	}
+	req := JoinRequest{
+		ListenAddr: listen,
+		PublicKey:  hex.EncodeToString(identity.Public().(ed25519.PublicKey)),
+	}
+	info, err := requestJoin(cfg.Join, cfg.JoinToken, req)
+	if err != nil {
+		return JoinInfo{}, err
+	}
+
+	known := make(map[string]bool, len(cfg.BootstrapNodes))
+	for _, addr := range cfg.BootstrapNodes {
+		known[addr] = true
+	}
+	for _, member := range info.Members {
+		addr := advertisedAddr(cfg.Join, member)
+		if !known[addr] {
+			known[addr] = true
+			cfg.BootstrapNodes = append(cfg.BootstrapNodes, addr)
+		}
+	}
+	if len(cfg.TrustedPeerKeys) == 0 {
+		cfg.TrustedPeerKeys = info.TrustedPeerKeys
+	}
+
+	if suite := strings.ToLower(cfg.CipherSuite); cfg.EncryptionEnabled && suite != info.CipherSuite {
+		logger.Warn("Joining a cluster whose replicas are encrypted with %s, this node encrypts its own with %s",
+			info.CipherSuite, suite)
+	}
+	if cfg.EncryptionEnabled && cfg.EncryptionKeyVersion < info.KeyVersion {
+		logger.Warn("Joining a cluster writing with encryption key version %d, this node writes with version %d",
+			info.KeyVersion, cfg.EncryptionKeyVersion)
+	}
+	logger.Info("Joining the cluster through %s: %d members", cfg.Join, len(info.Members))
+	return info, nil
+}
+
+// requestJoin sends req to POST /join of the admin API at addr.
+func requestJoin(addr, token string, req JoinRequest) (JoinInfo, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return JoinInfo{}, errors.Wrap(err, errors.InternalError, "failed to encode join request")
+	}
+	httpReq, err := http.NewRequest(http.MethodPost, "http://"+addr+"/join", bytes.NewReader(body))
+	if err != nil {
+		return JoinInfo{}, errors.Wrap(err, errors.ConfigError, "invalid join address")
+	}
+	httpReq.Header.Set("Authorization", "Bearer "+token)
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	client := http.Client{Timeout: joinTimeout}
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return JoinInfo{}, errors.Wrap(err, errors.NetworkError, "failed to reach the member to join through").
+			WithContext("member", addr)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var e admin.ErrorResponse
+		if json.NewDecoder(resp.Body).Decode(&e) != nil || e.Type == "" {
+			return JoinInfo{}, errors.NewNetworkError(fmt.Sprintf("join through %s failed: %s", addr, resp.Status))
+		}
+		return JoinInfo{}, errors.New(e.Type, "join refused: "+e.Error).WithContext("member", addr)
+	}
+
+	var info JoinInfo
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return JoinInfo{}, errors.Wrap(err, errors.NetworkError, "invalid join response").WithContext("member", addr)
+	}
+	return info, nil
+}
+
+// adoptClusterSettings makes the node follow the cluster settings it was
+// given when it joined, unless it follows newer ones already.
+func (s *FileServer) adoptClusterSettings(cs config.ClusterSettings) {
+	if cs.Version == 0 {
+		return
+	}
+	s.settingsLock.Lock()
+	defer s.settingsLock.Unlock()
+	if newerSettings(cs, s.clusterSettings) {
+		s.applyClusterSettingsLocked(cs)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/anthdm/foreverstore/admin"
+	"github.com/anthdm/foreverstore/config"
+	"github.com/anthdm/foreverstore/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNodesJoinThroughAMember(t *testing.T) {
+	member := createTestServer(":0", t.TempDir(), []string{})
+	member.JoinToken = "s3cret"
+	a := admin.NewServer("127.0.0.1:0")
+	registerAdminHandlers(a, member)
+	srv := httptest.NewServer(a.Handler())
+	defer srv.Close()
+	addr := strings.TrimPrefix(srv.URL, "http://")
+
+	cs := member.ClusterSettings()
+	cs.ReplicationFactor = 3
+	assert.Nil(t, member.DistributeSettings(cs))
+
+	_, identity, err := ed25519.GenerateKey(nil)
+	assert.Nil(t, err)
+	cfg := config.DefaultConfig()
+	cfg.ListenAddr = ":4000"
+	cfg.Join = addr
+	cfg.JoinToken = "s3cret"
+	info, err := joinCluster(cfg, identity)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{advertisedAddr(addr, member.advertiseAddr())}, cfg.BootstrapNodes)
+	assert.Equal(t, uint64(1), info.Settings.Version)
+
+	joined := createTestServer(":0", t.TempDir(), []string{})
+	joined.adoptClusterSettings(info.Settings)
+	assert.Equal(t, 3, joined.ClusterSettings().ReplicationFactor)
+
+	cfg.JoinToken = "guessed"
+	_, err = joinCluster(cfg, identity)
+	assert.True(t, errors.IsType(err, errors.AuthenticationError), "%v", err)
+
+	member.JoinToken = ""
+	cfg.JoinToken = ""
+	_, err = joinCluster(cfg, identity)
+	assert.True(t, errors.IsType(err, errors.AuthorizationError), "%v", err)
+}
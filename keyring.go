@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/anthdm/foreverstore/errors"
+)
+
+// KeyRing holds every encryption key version a node can still read, and the
+// current version that all new writes are encrypted with.
+type KeyRing struct {
+	mu      sync.RWMutex
+	current uint32
+	keys    map[uint32][]byte
+}
+
+// NewKeyRing creates a key ring whose current key is key at the given version.
+func NewKeyRing(version uint32, key []byte) *KeyRing {
+	return &KeyRing{
+		current: version,
+		keys:    map[uint32][]byte{version: key},
+	}
+}
+
+// Add makes a key version available for decryption without changing the
+// current version.
+func (k *KeyRing) Add(version uint32, key []byte) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys[version] = key
+}
+
+// SetCurrent adds key at the given version and makes it the one used for new
+// writes. Older versions stay available for reading.
+func (k *KeyRing) SetCurrent(version uint32, key []byte) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys[version] = key
+	k.current = version
+}
+
+// Remove retires a key version. The current version cannot be removed.
+func (k *KeyRing) Remove(version uint32) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if version == k.current {
+		return errors.NewValidationError("cannot remove the current key version")
+	}
+	delete(k.keys, version)
+	return nil
+}
+
+// Current returns the current key version and key.
+func (k *KeyRing) Current() (uint32, []byte) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.current, k.keys[k.current]
+}
+
+// Versions returns all available key versions in ascending order.
+func (k *KeyRing) Versions() []uint32 {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	versions := make([]uint32, 0, len(k.keys))
+	for v := range k.keys {
+		versions = append(versions, v)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i] < versions[j] })
+	return versions
+}
+
+// Lookup implements KeyLookup.
+func (k *KeyRing) Lookup(version uint32) ([]byte, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	key, ok := k.keys[version]
+	if !ok {
+		return nil, errors.NewEncryptionError(fmt.Sprintf("unknown encryption key version: %d", version))
+	}
+	return key, nil
+}
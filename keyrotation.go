@@ -0,0 +1,224 @@
+package main
+
+import (
+	"crypto/aes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/anthdm/foreverstore/config"
+	"github.com/anthdm/foreverstore/errors"
+)
+
+// KeyRotationStatus reports the progress of a background re-encryption.
+type KeyRotationStatus struct {
+	Running    bool      `json:"running"`
+	Version    uint32    `json:"version"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at,omitempty"`
+	Total      int       `json:"total"`
+	Rotated    int       `json:"rotated"`
+	Skipped    int       `json:"skipped"`
+	Failed     int       `json:"failed"`
+	LastError  string    `json:"last_error,omitempty"`
+}
+
+// RotateKey makes key, at the given version, the key all new writes are
+// encrypted with, and re-encrypts the replicas this node holds for other
+// nodes in the background. Older key versions stay readable, so the node
+// keeps serving while the rotation runs; once it has finished on every node
+// the old key can be retired from the configuration. The key is kept under
+// the storage root until then (see loadRotatedKeys). Objects in the cold
+// tier are not re-encrypted: they stay readable only while the key they
+// were offloaded with is kept.
+func (s *FileServer) RotateKey(version uint32, key []byte) error {
+	if s.EncryptionMode == EncryptionModeCTR {
+		return errors.NewEncryptionError("key rotation requires the gcm encryption mode")
+	}
+	if _, err := aes.NewCipher(key); err != nil {
+		return errors.Wrap(err, errors.InvalidInputError, "invalid encryption key")
+	}
+
+	s.rotationLock.Lock()
+	defer s.rotationLock.Unlock()
+
+	if s.rotation.Running {
+		return errors.NewValidationError(fmt.Sprintf("key rotation to version %d is still running", s.rotation.Version))
+	}
+
+	// The key is persisted first, so that the node restarts with the key it
+	// has been writing with.
+	if err := saveRotatedKey(s.store.Root, version, key); err != nil {
+		return err
+	}
+	s.keyRing.SetCurrent(version, key)
+	s.rotation = KeyRotationStatus{
+		Running:   true,
+		Version:   version,
+		StartedAt: s.Clock.Now(),
+	}
+
+	s.logger.Info("Rotating encryption key to version %d (fingerprint %s)", version, keyFingerprint(key))
+	go s.reencryptStore(version)
+
+	return nil
+}
+
+// KeyRotationStatus returns the progress of the last key rotation.
+func (s *FileServer) KeyRotationStatus() KeyRotationStatus {
+	s.rotationLock.Lock()
+	defer s.rotationLock.Unlock()
+	return s.rotation
+}
+
+func (s *FileServer) updateRotation(fn func(*KeyRotationStatus)) {
+	s.rotationLock.Lock()
+	defer s.rotationLock.Unlock()
+	fn(&s.rotation)
+}
+
+// reencryptStore rewrites every encrypted object that is not yet encrypted
+// with the given key version. Objects in the node's own namespace are stored
+// in plaintext; all other namespaces hold encrypted replicas.
+func (s *FileServer) reencryptStore(version uint32) {
+	defer func() {
+		s.updateRotation(func(st *KeyRotationStatus) {
+			st.Running = false
+			st.FinishedAt = s.Clock.Now()
+		})
+		st := s.KeyRotationStatus()
+		s.logger.Info("Key rotation to version %d finished: %d rotated, %d up to date, %d failed",
+			version, st.Rotated, st.Skipped, st.Failed)
+	}()
+
+	namespaces, err := os.ReadDir(s.store.Root)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			s.updateRotation(func(st *KeyRotationStatus) { st.LastError = err.Error() })
+		}
+		return
+	}
+
+	for _, ns := range namespaces {
+		if !ns.IsDir() || ns.Name() == s.ID {
+			continue
+		}
+
+		for cursor := ""; ; {
+			entries, next, err := s.store.Iterate(ns.Name(), "", cursor, rotationPageSize)
+			if err != nil {
+				s.updateRotation(func(st *KeyRotationStatus) { st.LastError = err.Error() })
+				break
+			}
+			for _, entry := range entries {
+				s.reencryptEntry(ns.Name(), entry, version)
+			}
+			if next == "" {
+				break
+			}
+			cursor = next
+		}
+	}
+}
+
+// rotationPageSize is the number of objects key rotation lists at a time.
+const rotationPageSize = 1000
+
+func (s *FileServer) reencryptEntry(namespace string, entry StoreEntry, version uint32) {
+	s.updateRotation(func(st *KeyRotationStatus) { st.Total++ })
+
+	path := filepath.Join(s.store.Root, namespace, filepath.FromSlash(entry.Path))
+	rotated, err := s.reencryptFile(namespace, entry.Key, path, version)
+	s.updateRotation(func(st *KeyRotationStatus) {
+		switch {
+		case err != nil:
+			st.Failed++
+			st.LastError = err.Error()
+		case rotated:
+			st.Rotated++
+		default:
+			st.Skipped++
+		}
+	})
+	if err != nil {
+		s.logger.Warn("Failed to re-encrypt %s: %v", path, err)
+	}
+}
+
+const rotateTempExt = ".rotate"
+
+// reencryptFile rewrites a single encrypted file, the replica stored under
+// key in namespace, with the given key version. The new content is written
+// next to the original and renamed over it, so readers always see either
+// the old or the new version in full. The replica is locked throughout, so
+// that a new version received meanwhile is neither overwritten with the
+// old one nor left with the metadata of the old one.
+func (s *FileServer) reencryptFile(namespace, key, path string, version uint32) (bool, error) {
+	if key != "" {
+		unlock := s.replicaLock(namespace, key)
+		defer unlock()
+	}
+
+	// Replicas of buckets stored unencrypted, or pinned to a key version,
+	// are left as their policy has them.
+	meta, _ := readMetaFile(path + metaExt)
+	policy := s.bucketPolicyOf(meta.Bucket)
+	if meta.Bucket != "" && (policy.Encryption == config.EncryptionNone || policy.EncryptionKeyVersion != nil) {
+		return false, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	current, err := encryptedKeyVersion(f)
+	if err == nil && current == version {
+		return false, nil
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+
+	newKey, err := s.keyRing.Lookup(version)
+	if err != nil {
+		return false, err
+	}
+
+	tmpPath := path + rotateTempExt
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmpPath)
+
+	suites := s.decryptSuites(meta.Bucket, meta.Cipher)
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := copyDecryptAuto(s.keyRing.Lookup, suites, f, pw)
+		pw.CloseWithError(err)
+	}()
+
+	_, err = copyEncryptSuite(s.CipherSuite, newKey, version, pr, tmp)
+	pr.CloseWithError(err)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		return false, err
+	}
+
+	// The replica is now sealed with the configured cipher suite.
+	err = updateMetaFile(path+metaExt, func(meta *ObjectMeta) { meta.Cipher = s.CipherSuite })
+	if err != nil && !os.IsNotExist(err) {
+		s.logger.Warn("Failed to update metadata of %s: %v", path, err)
+	}
+	return true, nil
+}
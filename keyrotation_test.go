@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRotateKey(t *testing.T) {
+	tempDir := "/tmp/fs_test_rotate"
+	defer os.RemoveAll(tempDir)
+
+	oldKey, newKey := newEncryptionKey(), newEncryptionKey()
+	server := createTestServer(":0", tempDir, []string{})
+	server.keyRing = NewKeyRing(0, oldKey)
+
+	// Simulate a replica another node encrypted with the old key
+	payload := bytes.Repeat([]byte("replicated data "), 1000)
+	encrypted := new(bytes.Buffer)
+	_, err := copyEncryptGCM(oldKey, 0, bytes.NewReader(payload), encrypted)
+	assert.Nil(t, err)
+	_, err = server.store.Write("othernode", "replica", encrypted)
+	assert.Nil(t, err)
+
+	// Plaintext in our own namespace must be left alone
+	_, err = server.store.Write(server.ID, "local", bytes.NewReader(payload))
+	assert.Nil(t, err)
+
+	assert.Nil(t, server.RotateKey(1, newKey))
+	assert.Eventually(t, func() bool { return !server.KeyRotationStatus().Running }, time.Second, 10*time.Millisecond)
+
+	status := server.KeyRotationStatus()
+	assert.Equal(t, 1, status.Rotated)
+	assert.Equal(t, 0, status.Failed)
+
+	pathKey := server.store.PathTransformFunc("replica")
+	f, err := os.Open(filepath.Join(tempDir, "othernode", pathKey.FullPath()))
+	assert.Nil(t, err)
+	defer f.Close()
+
+	version, err := encryptedKeyVersion(f)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(1), version)
+
+	// Without the old key the rotated replica must still decrypt
+	f.Seek(0, io.SeekStart)
+	out := new(bytes.Buffer)
+	_, err = copyDecryptAuto(NewKeyRing(1, newKey).Lookup, suitesOf(CipherSuiteAESGCM), f, out)
+	assert.Nil(t, err)
+	assert.Equal(t, payload, out.Bytes())
+
+	_, r, err := server.store.Read(server.ID, "local")
+	assert.Nil(t, err)
+	local, _ := io.ReadAll(r)
+	assert.Equal(t, payload, local)
+
+	// Rotating again to the same version is a no-op for every object
+	assert.Nil(t, server.RotateKey(1, newKey))
+	assert.Eventually(t, func() bool { return !server.KeyRotationStatus().Running }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, 1, server.KeyRotationStatus().Skipped)
+
+	// The node restarts writing with the key it rotated to, unless its
+	// configuration names a later one.
+	ring := NewKeyRing(0, oldKey)
+	assert.Nil(t, loadRotatedKeys(tempDir, ring))
+	version, key := ring.Current()
+	assert.Equal(t, uint32(1), version)
+	assert.Equal(t, newKey, key)
+
+	ring = NewKeyRing(2, newEncryptionKey())
+	assert.Nil(t, loadRotatedKeys(tempDir, ring))
+	version, _ = ring.Current()
+	assert.Equal(t, uint32(2), version)
+	key, err = ring.Lookup(1)
+	assert.Nil(t, err)
+	assert.Equal(t, newKey, key)
+}
+
+func TestKeyRotationHoldsTheReplicaLock(t *testing.T) {
+	oldKey, newKey := newEncryptionKey(), newEncryptionKey()
+	server := createTestServer(":0", t.TempDir(), []string{})
+	server.keyRing = NewKeyRing(0, oldKey)
+	server.keyRing.Add(1, newKey)
+
+	encrypted := new(bytes.Buffer)
+	_, err := copyEncryptGCM(oldKey, 0, bytes.NewReader([]byte("replicated data")), encrypted)
+	assert.Nil(t, err)
+	_, err = server.store.Write("othernode", "replica", encrypted)
+	assert.Nil(t, err)
+	assert.Nil(t, server.store.WriteMeta("othernode", "replica", ObjectMeta{}))
+
+	// A replica being received is not rewritten under the receiver.
+	unlock := server.replicaLock("othernode", "replica")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		server.reencryptEntry("othernode", StoreEntry{Key: "replica", Path: server.store.PathTransformFunc("replica").FullPath()}, 1)
+	}()
+	assert.Never(t, func() bool {
+		select {
+		case <-done:
+			return true
+		default:
+			return false
+		}
+	}, 50*time.Millisecond, 5*time.Millisecond)
+	unlock()
+	<-done
+	assert.Equal(t, 1, server.KeyRotationStatus().Rotated)
+}
+
+func TestKeyRing(t *testing.T) {
+	ring := NewKeyRing(0, []byte("k0"))
+	ring.SetCurrent(1, []byte("k1"))
+
+	version, key := ring.Current()
+	assert.Equal(t, uint32(1), version)
+	assert.Equal(t, []byte("k1"), key)
+
+	old, err := ring.Lookup(0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("k0"), old)
+
+	assert.NotNil(t, ring.Remove(1))
+	assert.Nil(t, ring.Remove(0))
+	_, err = ring.Lookup(0)
+	assert.NotNil(t, err)
+	assert.Equal(t, []uint32{1}, ring.Versions())
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/anthdm/foreverstore/config"
+	"github.com/anthdm/foreverstore/errors"
+	"github.com/anthdm/foreverstore/logger"
+)
+
+const (
+	defaultKeyFileName         = ".encryption_key"
+	keyFingerprintFileName     = ".encryption_key_fingerprint"
+	rotatedKeysFileName        = ".rotated_keys"
+	keyFingerprintDisplayBytes = 8
+)
+
+// loadKeyRing builds the key ring of the node from the configured current
+// key and the previous key versions that may still be needed for reading.
+func loadKeyRing(cfg *config.Config) (*KeyRing, error) {
+	key, err := loadEncryptionKey(cfg)
+	if err != nil || key == nil {
+		return nil, err
+	}
+
+	ring := NewKeyRing(cfg.EncryptionKeyVersion, key)
+	for v, encoded := range cfg.PreviousEncryptionKeys {
+		version, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return nil, errors.Wrap(err, errors.ConfigError, "invalid previous key version")
+		}
+		prev, err := config.ParseEncryptionKey(encoded)
+		if err != nil {
+			return nil, errors.Wrap(err, errors.ConfigError, "invalid previous encryption key").
+				WithContext("version", version)
+		}
+		ring.Add(uint32(version), prev)
+	}
+
+	if err := loadRotatedKeys(cfg.StorageRoot, ring); err != nil {
+		return nil, err
+	}
+	return ring, nil
+}
+
+// loadEncryptionKey returns the key the node encrypts its data with. A
+// configured key is parsed and used as is; otherwise the key persisted in
+// the key file is reused, and only on the very first start a new key is
+// generated and written there. The key fingerprint is recorded under the
+// storage root so a node restarted with a different key fails loudly instead
+// of silently producing unreadable data.
+func loadEncryptionKey(cfg *config.Config) ([]byte, error) {
+	if !cfg.EncryptionEnabled {
+		return nil, nil
+	}
+
+	var (
+		key []byte
+		err error
+	)
+
+	if cfg.EncryptionKey != "" {
+		key, err = config.ParseEncryptionKey(cfg.EncryptionKey)
+		if err != nil {
+			return nil, errors.Wrap(err, errors.ConfigError, "invalid encryption key")
+		}
+	} else {
+		key, err = loadOrGenerateKeyFile(keyFilePath(cfg))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var previous [][]byte
+	for _, encoded := range cfg.PreviousEncryptionKeys {
+		if prev, err := config.ParseEncryptionKey(encoded); err == nil {
+			previous = append(previous, prev)
+		}
+	}
+
+	if err := checkKeyFingerprint(cfg.StorageRoot, key, previous...); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+func keyFilePath(cfg *config.Config) string {
+	if cfg.EncryptionKeyFile != "" {
+		return cfg.EncryptionKeyFile
+	}
+	return filepath.Join(cfg.StorageRoot, defaultKeyFileName)
+}
+
+func loadOrGenerateKeyFile(path string) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if err == nil {
+		key, err := config.ParseEncryptionKey(string(b))
+		if err != nil {
+			return nil, errors.Wrap(err, errors.EncryptionError, "invalid key in key file").
+				WithContext("path", path)
+		}
+		logger.Info("Loaded encryption key from %s", path)
+		return key, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, errors.EncryptionError, "failed to read key file")
+	}
+
+	key := newEncryptionKey()
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return nil, errors.Wrap(err, errors.StorageError, "failed to create key file directory")
+	}
+	if err := os.WriteFile(path, []byte(hex.EncodeToString(key)), 0600); err != nil {
+		return nil, errors.Wrap(err, errors.StorageError, "failed to persist generated key")
+	}
+
+	logger.Warn("No encryption key configured, generated a new one and saved it to %s", path)
+	return key, nil
+}
+
+// keyFingerprint returns a short, non-reversible identifier for key.
+func keyFingerprint(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:keyFingerprintDisplayBytes])
+}
+
+// checkKeyFingerprint verifies that key, or one of the previous keys it
+// replaced, is the key the storage was last used with, and records key as
+// the one in use from now on.
+func checkKeyFingerprint(storageRoot string, key []byte, previous ...[]byte) error {
+	path := filepath.Join(storageRoot, keyFingerprintFileName)
+	fingerprint := []byte(keyFingerprint(key))
+
+	stored, err := os.ReadFile(path)
+	if err == nil {
+		stored = bytes.TrimSpace(stored)
+		if bytes.Equal(stored, fingerprint) {
+			return nil
+		}
+		for _, prev := range previous {
+			if bytes.Equal(stored, []byte(keyFingerprint(prev))) {
+				return os.WriteFile(path, fingerprint, 0644)
+			}
+		}
+		return errors.NewEncryptionError(fmt.Sprintf(
+			"encryption key does not match the key this storage was written with (have %s, want %s)",
+			fingerprint, stored)).WithContext("storage_root", storageRoot)
+	}
+	if !os.IsNotExist(err) {
+		return errors.Wrap(err, errors.StorageError, "failed to read key fingerprint")
+	}
+
+	if err := os.MkdirAll(storageRoot, os.ModePerm); err != nil {
+		return errors.Wrap(err, errors.StorageError, "failed to create storage root")
+	}
+	if err := os.WriteFile(path, fingerprint, 0644); err != nil {
+		return errors.Wrap(err, errors.StorageError, "failed to write key fingerprint")
+	}
+	return nil
+}
+
+// rotatedKeys is the content of the rotated keys file: the keys set by
+// RotateKey, hex encoded by version, and the version made current last.
+type rotatedKeys struct {
+	Current uint32            `json:"current"`
+	Keys    map[string]string `json:"keys"`
+}
+
+func readRotatedKeys(path string) (rotatedKeys, error) {
+	var rotated rotatedKeys
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return rotated, nil
+	}
+	if err != nil {
+		return rotated, errors.Wrap(err, errors.StorageError, "failed to read rotated keys")
+	}
+	if err := json.Unmarshal(b, &rotated); err != nil {
+		return rotated, errors.Wrap(err, errors.EncryptionError, "invalid rotated keys file").
+			WithContext("path", path)
+	}
+	return rotated, nil
+}
+
+// saveRotatedKey records under storageRoot that key, at the given version,
+// is the current key, for the node to keep writing with it once restarted.
+func saveRotatedKey(storageRoot string, version uint32, key []byte) error {
+	path := filepath.Join(storageRoot, rotatedKeysFileName)
+	rotated, err := readRotatedKeys(path)
+	if err != nil {
+		return err
+	}
+	if rotated.Keys == nil {
+		rotated.Keys = make(map[string]string)
+	}
+	rotated.Current = version
+	rotated.Keys[strconv.FormatUint(uint64(version), 10)] = hex.EncodeToString(key)
+
+	b, err := json.Marshal(rotated)
+	if err != nil {
+		return errors.Wrap(err, errors.InternalError, "failed to encode rotated keys")
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return errors.Wrap(err, errors.StorageError, "failed to persist rotated key")
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return errors.Wrap(err, errors.StorageError, "failed to persist rotated key")
+	}
+	return nil
+}
+
+// loadRotatedKeys adds the keys recorded by saveRotatedKey under
+// storageRoot to ring, and makes the one rotated to last current unless
+// the configuration names a later version.
+func loadRotatedKeys(storageRoot string, ring *KeyRing) error {
+	rotated, err := readRotatedKeys(filepath.Join(storageRoot, rotatedKeysFileName))
+	if err != nil {
+		return err
+	}
+	current, _ := ring.Current()
+	for v, encoded := range rotated.Keys {
+		version, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return errors.Wrap(err, errors.EncryptionError, "invalid rotated key version")
+		}
+		key, err := config.ParseEncryptionKey(encoded)
+		if err != nil {
+			return errors.Wrap(err, errors.EncryptionError, "invalid rotated key").
+				WithContext("version", version)
+		}
+		if uint32(version) == rotated.Current && rotated.Current > current {
+			ring.SetCurrent(uint32(version), key)
+			logger.Info("Encrypting with key version %d, rotated to before the restart", version)
+		} else if _, err := ring.Lookup(uint32(version)); err != nil {
+			ring.Add(uint32(version), key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/hex"
+	"os"
+	"testing"
+
+	"github.com/anthdm/foreverstore/config"
+	"github.com/anthdm/foreverstore/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadEncryptionKeyConfigured(t *testing.T) {
+	tempDir := "/tmp/fs_test_keys_configured"
+	defer os.RemoveAll(tempDir)
+
+	key := newEncryptionKey()
+	cfg := config.DefaultConfig()
+	cfg.StorageRoot = tempDir
+	cfg.EncryptionKey = hex.EncodeToString(key)
+
+	loaded, err := loadEncryptionKey(cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, key, loaded)
+
+	// Restarting with a different key must fail instead of silently
+	// producing unreadable data.
+	cfg.EncryptionKey = hex.EncodeToString(newEncryptionKey())
+	_, err = loadEncryptionKey(cfg)
+	assert.True(t, errors.IsType(err, errors.EncryptionError))
+}
+
+func TestLoadEncryptionKeyGeneratedIsPersisted(t *testing.T) {
+	tempDir := "/tmp/fs_test_keys_generated"
+	defer os.RemoveAll(tempDir)
+
+	cfg := config.DefaultConfig()
+	cfg.StorageRoot = tempDir
+
+	first, err := loadEncryptionKey(cfg)
+	assert.Nil(t, err)
+	assert.Len(t, first, 32)
+
+	second, err := loadEncryptionKey(cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, first, second)
+}
+
+func TestLoadEncryptionKeyDisabled(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.EncryptionEnabled = false
+
+	key, err := loadEncryptionKey(cfg)
+	assert.Nil(t, err)
+	assert.Nil(t, key)
+}
+
+func TestLoadKeyRingWithPreviousKeys(t *testing.T) {
+	tempDir := "/tmp/fs_test_keys_ring"
+	defer os.RemoveAll(tempDir)
+
+	oldKey, newKey := newEncryptionKey(), newEncryptionKey()
+	cfg := config.DefaultConfig()
+	cfg.StorageRoot = tempDir
+	cfg.EncryptionKey = hex.EncodeToString(oldKey)
+
+	_, err := loadKeyRing(cfg)
+	assert.Nil(t, err)
+
+	// After a rotation the node restarts with the new key as current and the
+	// old one listed as a previous version.
+	cfg.EncryptionKey = hex.EncodeToString(newKey)
+	cfg.EncryptionKeyVersion = 1
+	cfg.PreviousEncryptionKeys = map[string]string{"0": hex.EncodeToString(oldKey)}
+
+	ring, err := loadKeyRing(cfg)
+	assert.Nil(t, err)
+
+	version, key := ring.Current()
+	assert.Equal(t, uint32(1), version)
+	assert.Equal(t, newKey, key)
+
+	prev, err := ring.Lookup(0)
+	assert.Nil(t, err)
+	assert.Equal(t, oldKey, prev)
+}
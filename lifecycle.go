@@ -0,0 +1,301 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/anthdm/foreverstore/config"
+	"github.com/anthdm/foreverstore/errors"
+)
+
+// MessageDeleteFile tells the peers to delete their replica of an object.
+type MessageDeleteFile struct {
+	ID  string
+	Key string
+}
+
+// MessageRunLifecycle tells the peers to evaluate the rules of the node
+// leading the lifecycle evaluation against the objects they store.
+type MessageRunLifecycle struct {
+	Leader string
+	Rules  []config.LifecycleRule
+}
+
+// LifecycleStatus reports the last evaluation of the lifecycle rules.
+type LifecycleStatus struct {
+	Rules   []config.LifecycleRule `json:"rules"`
+	LastRun time.Time              `json:"last_run"`
+	// Leader is the node whose schedule and rules the evaluation followed.
+	Leader  string `json:"leader,omitempty"`
+	Scanned int    `json:"scanned"`
+	Expired int    `json:"expired"`
+	// Offloaded counts the objects moved to the cold tier, by a rule or
+	// for going unread.
+	Offloaded int `json:"offloaded"`
+	// Retained counts the objects due to expire that were kept because
+	// they are locked.
+	Retained int    `json:"retained"`
+	Error    string `json:"error,omitempty"`
+}
+
+// lifecyclePageSize is the number of keys read at a time while the
+// lifecycle rules are evaluated.
+const lifecyclePageSize = 500
+
+// bucketOf returns the bucket of a key: the part before its first "/", or
+// "" for keys outside any bucket.
+func bucketOf(key string) string {
+	bucket, _, found := strings.Cut(key, "/")
+	if !found {
+		return ""
+	}
+	return bucket
+}
+
+// Delete deletes the object stored under key, its replicas on the peers and
+// its copy in the mirror. Locked objects are kept. Unlike writes, deletes
+// go on while the disk is full, as they free space.
+func (s *FileServer) Delete(key string) (err error) {
+	defer func() { s.errorCounts.add("delete", err) }()
+	if err := s.checkLeader(); err != nil {
+		return err
+	}
+	return s.deleteObject(key)
+}
+
+// deleteObject deletes an object stored by this node, its replicas on the
+// peers and its copy in the mirror. Locked objects are kept.
+func (s *FileServer) deleteObject(key string) error {
+	unlock := s.keyLocks.lock(key)
+	defer unlock()
+
+	if !s.store.Has(s.ID, key) {
+		return errors.NewFileNotFoundError(key)
+	}
+	if err := s.fences.check(key); err != nil {
+		return err
+	}
+	if err := s.checkNotLocked(s.ID, key); err != nil {
+		return err
+	}
+	meta, _ := s.store.ReadMeta(s.ID, key)
+	size := s.objectSize(key, meta)
+	if err := s.store.Delete(s.ID, key); err != nil {
+		return errors.Wrap(err, errors.StorageError, "failed to delete file")
+	}
+	s.bucketUsage.add(key, -size)
+	s.dropColdCopy(key, meta.Cold)
+	s.queueMirror(key, true)
+	s.recordChange(key, ChangeDelete, ObjectMeta{})
+	s.bury(key)
+	s.logger.Info("Deleted file: %s", key)
+
+	msg := Message{Payload: MessageDeleteFile{ID: s.ID, Key: hashKey(key)}}
+	if err := s.broadcast(&msg); err != nil {
+		s.logger.Error("Failed to broadcast delete of %s: %v", key, err)
+	}
+	return nil
+}
+
+func (s *FileServer) handleMessageDeleteFile(from string, msg MessageDeleteFile) error {
+	if err := s.checkNotLocked(msg.ID, msg.Key); err != nil {
+		s.logger.Warn("Rejecting delete of locked replica %s from peer %s", msg.Key, from)
+		return err
+	}
+	if err := s.store.Delete(msg.ID, msg.Key); err != nil {
+		return errors.Wrap(err, errors.StorageError, "failed to delete replica")
+	}
+	s.logger.Info("Deleted replica %s for peer %s", msg.Key, from)
+	return nil
+}
+
+// RunLifecycle evaluates the lifecycle rules against the objects stored by
+// this node, and offloads the objects unread for ColdAfter to the cold
+// tier. Only an object's owner can change or delete it, so every node
+// evaluates the rules for its own objects and each object is handled
+// exactly once in the cluster.
+func (s *FileServer) RunLifecycle() (LifecycleStatus, error) {
+	s.lifecycleLock.Lock()
+	defer s.lifecycleLock.Unlock()
+
+	return s.runLifecycle(s.ID, s.Lifecycle)
+}
+
+// runLifecycle evaluates rules, those of leader, against the objects
+// stored by this node. The caller holds lifecycleLock.
+func (s *FileServer) runLifecycle(leader string, rules []config.LifecycleRule) (LifecycleStatus, error) {
+	status := LifecycleStatus{Rules: rules, LastRun: s.Clock.Now(), Leader: leader}
+	err := s.applyLifecycle(rules, &status)
+	if err != nil {
+		status.Error = err.Error()
+	}
+	s.lifecycle = status
+	return status, err
+}
+
+// LifecycleStatus returns the outcome of the last lifecycle evaluation.
+func (s *FileServer) LifecycleStatus() LifecycleStatus {
+	s.lifecycleLock.Lock()
+	defer s.lifecycleLock.Unlock()
+
+	status := s.lifecycle
+	if status.LastRun.IsZero() {
+		status.Rules = s.Lifecycle
+	}
+	return status
+}
+
+// leadsLifecycle reports whether this node leads the lifecycle evaluation:
+// whether it leads the cluster as it sees it (see clusterLeader). Each side of a
+// partition has a leader of its own; with both evaluating, every object is
+// still handled by its owner alone.
+func (s *FileServer) leadsLifecycle() bool {
+	leader, _ := s.clusterLeader()
+	return leader == ""
+}
+
+// handleMessageRunLifecycle evaluates the rules of the leader, in the
+// background as the evaluation can take a while.
+func (s *FileServer) handleMessageRunLifecycle(from string, msg MessageRunLifecycle) error {
+	go func() {
+		status, ok, err := s.scheduledLifecycle(msg.Leader, msg.Rules)
+		if ok {
+			s.logLifecycle(status, err)
+		}
+	}()
+	return nil
+}
+
+// scheduledLifecycle evaluates rules, those of leader, unless the server is
+// stopping: the evaluation deletes files under StorageRoot, so the server
+// waits for the one under way as it stops and starts no other.
+func (s *FileServer) scheduledLifecycle(leader string, rules []config.LifecycleRule) (LifecycleStatus, bool, error) {
+	s.lifecycleLock.Lock()
+	defer s.lifecycleLock.Unlock()
+
+	select {
+	case <-s.quitch:
+		return LifecycleStatus{}, false, nil
+	default:
+	}
+	status, err := s.runLifecycle(leader, rules)
+	return status, true, err
+}
+
+func (s *FileServer) logLifecycle(status LifecycleStatus, err error) {
+	if err != nil {
+		s.logger.Warn("Lifecycle evaluation failed: %v", err)
+		return
+	}
+	if status.Expired > 0 || status.Retained > 0 || status.Offloaded > 0 {
+		s.logger.Info("Lifecycle expired %d objects, kept %d locked ones, offloaded %d",
+			status.Expired, status.Retained, status.Offloaded)
+	}
+}
+
+func (s *FileServer) applyLifecycle(rules []config.LifecycleRule, status *LifecycleStatus) error {
+	if len(rules) == 0 && (s.ColdTier == nil || s.ColdAfter == 0) {
+		return nil
+	}
+	byBucket := make(map[string]config.LifecycleRule, len(rules))
+	for _, rule := range rules {
+		byBucket[rule.Bucket] = rule
+	}
+
+	var lastErr error
+	for cursor := ""; ; {
+		entries, next, err := s.store.Iterate(s.ID, "", cursor, lifecyclePageSize)
+		if err != nil {
+			return errors.Wrap(err, errors.StorageError, "failed to list objects")
+		}
+
+		for _, entry := range entries {
+			status.Scanned++
+			if entry.Key == "" {
+				continue
+			}
+			meta, err := s.store.ReadMeta(s.ID, entry.Key)
+			if err != nil || meta.StoredAt.IsZero() {
+				// Objects stored before their time was recorded are kept.
+				continue
+			}
+			rule := byBucket[bucketOf(entry.Key)]
+			age := status.LastRun.Sub(meta.StoredAt)
+
+			if rule.ExpireAfterDays > 0 && age >= days(rule.ExpireAfterDays) {
+				switch err := s.deleteObject(entry.Key); {
+				case err == nil:
+					status.Expired++
+				case errors.IsType(err, errors.ObjectLockedError):
+					status.Retained++
+				default:
+					s.logger.Warn("Failed to expire %s: %v", entry.Key, err)
+					lastErr = err
+				}
+				continue
+			}
+
+			if meta.Cold == nil && s.dueForColdTier(rule, meta, status.LastRun) {
+				moved, err := s.offloadObject(entry.Key)
+				if err != nil {
+					s.logger.Warn("Failed to offload %s: %v", entry.Key, err)
+					lastErr = err
+				} else if moved {
+					status.Offloaded++
+				}
+			}
+		}
+
+		if next == "" {
+			return lastErr
+		}
+		cursor = next
+	}
+}
+
+// dueForColdTier reports whether an object should move to the cold tier,
+// because its bucket's rule transitions it or because it went unread for
+// ColdAfter.
+func (s *FileServer) dueForColdTier(rule config.LifecycleRule, meta ObjectMeta, now time.Time) bool {
+	if s.ColdTier == nil {
+		return false
+	}
+	if rule.TransitionAfterDays > 0 && now.Sub(meta.StoredAt) >= days(rule.TransitionAfterDays) {
+		return true
+	}
+	return s.ColdAfter > 0 && now.Sub(lastAccess(meta)) >= s.ColdAfter
+}
+
+func days(n int) time.Duration {
+	return time.Duration(n) * 24 * time.Hour
+}
+
+// lifecycleLoop evaluates the lifecycle rules every LifecycleInterval until
+// the server stops, when this node leads the evaluation. The leader has
+// its peers evaluate its rules against their own objects as it evaluates
+// them against its own; the others wait for it.
+func (s *FileServer) lifecycleLoop() {
+	ticker := s.Clock.NewTicker(s.LifecycleInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C():
+			if !s.leadsLifecycle() {
+				s.logger.Debug("Leaving the lifecycle evaluation to the leader")
+				continue
+			}
+			msg := Message{Payload: MessageRunLifecycle{Leader: s.ID, Rules: s.Lifecycle}}
+			if err := s.broadcast(&msg); err != nil {
+				s.logger.Warn("Failed to start the lifecycle evaluation on the peers: %v", err)
+			}
+			status, ok, err := s.scheduledLifecycle(s.ID, s.Lifecycle)
+			if !ok {
+				return
+			}
+			s.logLifecycle(status, err)
+		case <-s.quitch:
+			return
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/anthdm/foreverstore/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBucketOf(t *testing.T) {
+	assert.Equal(t, "logs", bucketOf("logs/2024/app.log"))
+	assert.Equal(t, "", bucketOf("toplevel"))
+}
+
+// withLifecycle gives node 0 the rules, evaluated only when a test runs
+// them.
+func withLifecycle(rules ...config.LifecycleRule) func(int, *FileServerOpts) {
+	return func(node int, opts *FileServerOpts) {
+		if node == 0 {
+			opts.Lifecycle = rules
+			opts.LifecycleInterval = 365 * 24 * time.Hour
+		}
+	}
+}
+
+func (c *testCluster) runLifecycle(node int) LifecycleStatus {
+	c.t.Helper()
+	var status LifecycleStatus
+	err := c.run("lifecycle evaluation", func() (err error) {
+		status, err = c.nodes[node].RunLifecycle()
+		return err
+	})
+	if err != nil {
+		c.t.Fatalf("lifecycle evaluation failed: %v", err)
+	}
+	return status
+}
+
+func TestLifecycleExpiresObjectsCluster(t *testing.T) {
+	c := newTestClusterWith(t, 2, withLifecycle(config.LifecycleRule{Bucket: "logs", ExpireAfterDays: 7}))
+	s := c.nodes[0]
+
+	c.store(0, "logs/old", []byte("old log"))
+	c.store(0, "docs/old", []byte("not in a bucket with rules"))
+	assert.Nil(t, c.storeLocked(0, "logs/audit", []byte("kept for compliance"), retainFor(c, 30*24*time.Hour)))
+	for _, key := range []string{"logs/old", "docs/old", "logs/audit"} {
+		c.assertConverged(0, key)
+	}
+
+	c.clock.Advance(8 * 24 * time.Hour)
+	c.store(0, "logs/new", []byte("new log"))
+	c.assertConverged(0, "logs/new")
+
+	status := c.runLifecycle(0)
+	assert.Equal(t, 4, status.Scanned)
+	assert.Equal(t, 1, status.Expired)
+	assert.Equal(t, 1, status.Retained)
+	assert.Equal(t, status, s.LifecycleStatus())
+
+	c.eventually("expired replica to be deleted", func() bool {
+		return !c.holds(0, 0, "logs/old") && !c.holds(1, 0, "logs/old")
+	})
+	for _, key := range []string{"docs/old", "logs/audit", "logs/new"} {
+		assert.True(t, c.holds(0, 0, key), key)
+		assert.True(t, c.holds(1, 0, key), key)
+	}
+}
+
+func TestLifecycleRunsPeriodically(t *testing.T) {
+	c := newTestClusterWith(t, 1, func(_ int, opts *FileServerOpts) {
+		opts.Lifecycle = []config.LifecycleRule{{Bucket: "tmp", ExpireAfterDays: 1}}
+		opts.LifecycleInterval = time.Minute
+	})
+
+	c.store(0, "tmp/scratch", []byte("scratch"))
+	c.clock.Advance(25 * time.Hour)
+	c.eventually("scratch object to expire", func() bool {
+		return !c.holds(0, 0, "tmp/scratch")
+	})
+}
+
+func TestLifecycleFollowsTheLeader(t *testing.T) {
+	// Node 0 has the lower ID and leads: only its rules apply, though the
+	// node ticks as often.
+	c := newTestClusterWith(t, 2, func(node int, opts *FileServerOpts) {
+		expire := 30
+		if node == 0 {
+			expire = 1
+		}
+		opts.ID = fmt.Sprintf("node-%d", node)
+		opts.Lifecycle = []config.LifecycleRule{{Bucket: "tmp", ExpireAfterDays: expire}}
+		opts.LifecycleInterval = time.Minute
+	})
+	c.eventually("the leader to be known", func() bool {
+		return c.nodes[0].leadsLifecycle() && !c.nodes[1].leadsLifecycle()
+	})
+
+	c.store(1, "tmp/scratch", []byte("scratch"))
+	c.assertConverged(1, "tmp/scratch")
+	c.clock.Advance(25 * time.Hour)
+	c.eventually("scratch object to expire", func() bool {
+		return !c.holds(1, 1, "tmp/scratch") && !c.holds(0, 1, "tmp/scratch")
+	})
+
+	// The leader may have had another evaluation run since.
+	status := c.nodes[1].LifecycleStatus()
+	assert.Equal(t, "node-0", status.Leader)
+	assert.Equal(t, c.nodes[0].Lifecycle, status.Rules)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/anthdm/foreverstore/errors"
+)
+
+// listingPageSize is the number of keys read at a time while a listing
+// folds them into folders.
+const listingPageSize = 1000
+
+// Listing is a page of a hierarchical listing: the objects directly under
+// a prefix, and the folders below it. A folder is the common prefix of the
+// keys that contain the delimiter past the listed prefix, up to and
+// including the delimiter, as in photos/2024/ for photos/2024/img.jpg
+// listed under photos/ with the delimiter /.
+type Listing struct {
+	Objects  []StoreEntry `json:"objects"`
+	Prefixes []string     `json:"prefixes"`
+	// NextCursor is passed as the cursor to get the next page, and is
+	// empty on the last one.
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// ListDir returns a page of at most limit objects and folders of the
+// namespace id under prefix, ordered by name, with the keys that contain
+// delimiter past prefix folded into folders. Objects are stored in the
+// order of their hashed paths, so every key under prefix is read to make a
+// page; only about a page of names is held in memory at a time. Cursors
+// are names, and stay valid while objects are added and removed. Objects
+// without a recorded key are not listed.
+func (s *Store) ListDir(id, prefix, delimiter, cursor string, limit int) (Listing, error) {
+	if limit <= 0 {
+		return Listing{}, fmt.Errorf("invalid listing limit: %d", limit)
+	}
+	if delimiter == "" {
+		return Listing{}, fmt.Errorf("listing delimiter is required")
+	}
+
+	// names holds the smallest names past the cursor found so far, and
+	// whether each is a folder; once pruned, the names past bound cannot
+	// make the page.
+	names := make(map[string]*StoreEntry)
+	var bound string
+	bounded := false
+	add := func(name string, entry *StoreEntry) {
+		if name <= cursor || (bounded && name > bound) {
+			return
+		}
+		if _, ok := names[name]; ok {
+			return
+		}
+		names[name] = entry
+		if len(names) > 2*(limit+1) {
+			sorted := sortedNames(names)
+			for _, n := range sorted[limit+1:] {
+				delete(names, n)
+			}
+			bound, bounded = sorted[limit], true
+		}
+	}
+
+	for page := ""; ; {
+		entries, next, err := s.Iterate(id, prefix, page, listingPageSize)
+		if err != nil {
+			return Listing{}, err
+		}
+		for i := range entries {
+			entry := entries[i]
+			if entry.Key == "" {
+				continue
+			}
+			rest := entry.Key[len(prefix):]
+			if n := strings.Index(rest, delimiter); n >= 0 {
+				add(prefix+rest[:n+len(delimiter)], nil)
+			} else {
+				add(entry.Key, &entry)
+			}
+		}
+		if next == "" {
+			break
+		}
+		page = next
+	}
+
+	listing := Listing{Objects: []StoreEntry{}, Prefixes: []string{}}
+	sorted := sortedNames(names)
+	if len(sorted) > limit {
+		sorted = sorted[:limit]
+		listing.NextCursor = sorted[limit-1]
+	}
+	for _, name := range sorted {
+		if entry := names[name]; entry != nil {
+			listing.Objects = append(listing.Objects, *entry)
+		} else {
+			listing.Prefixes = append(listing.Prefixes, name)
+		}
+	}
+	return listing, nil
+}
+
+func sortedNames(names map[string]*StoreEntry) []string {
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+// ListDir returns a page of the objects and folders stored by this node
+// under prefix; see Store.ListDir.
+func (s *FileServer) ListDir(prefix, delimiter, cursor string, limit int) (Listing, error) {
+	if delimiter == "" {
+		return Listing{}, errors.NewInvalidInputError("delimiter is required")
+	}
+	listing, err := s.store.ListDir(s.ID, prefix, delimiter, cursor, limit)
+	if err != nil {
+		return Listing{}, errors.Wrap(err, errors.StorageError, "failed to list objects")
+	}
+	return listing, nil
+}
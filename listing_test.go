@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStoreListDir(t *testing.T) {
+	s := &Store{StoreOpts{Root: t.TempDir(), PathTransformFunc: CASPathTransformFunc}}
+	id := generateID()
+
+	keys := []string{"readme", "photos/cover.jpg", "photos/2023/a.jpg", "videos/clip.mp4"}
+	for i := 0; i < 20; i++ {
+		keys = append(keys, fmt.Sprintf("photos/2024/%02d.jpg", i))
+	}
+	for _, key := range keys {
+		_, err := s.Write(id, key, bytes.NewReader([]byte(key)))
+		assert.Nil(t, err)
+		assert.Nil(t, s.WriteMeta(id, key, ObjectMeta{}))
+	}
+
+	listing, err := s.ListDir(id, "", "/", "", 10)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"photos/", "videos/"}, listing.Prefixes)
+	assert.Len(t, listing.Objects, 1)
+	assert.Equal(t, "readme", listing.Objects[0].Key)
+	assert.Empty(t, listing.NextCursor)
+
+	// Pages smaller than the folders and objects under the prefix take
+	// both, in order, each once.
+	var names []string
+	for cursor := ""; ; {
+		listing, err := s.ListDir(id, "photos/", "/", cursor, 1)
+		assert.Nil(t, err)
+		assert.Equal(t, 1, len(listing.Objects)+len(listing.Prefixes))
+		names = append(names, listing.Prefixes...)
+		for _, obj := range listing.Objects {
+			names = append(names, obj.Key)
+		}
+		if listing.NextCursor == "" {
+			break
+		}
+		cursor = listing.NextCursor
+	}
+	assert.Equal(t, []string{"photos/2023/", "photos/2024/", "photos/cover.jpg"}, names)
+
+	listing, err = s.ListDir(id, "photos/2024/", "/", "", 3)
+	assert.Nil(t, err)
+	assert.Len(t, listing.Objects, 3)
+	assert.Equal(t, "photos/2024/00.jpg", listing.Objects[0].Key)
+	assert.Equal(t, "photos/2024/02.jpg", listing.NextCursor)
+
+	listing, err = s.ListDir(id, "photos/2024/", "/", "photos/2024/17.jpg", 10)
+	assert.Nil(t, err)
+	assert.Empty(t, listing.Prefixes)
+	assert.Len(t, listing.Objects, 2)
+	assert.Equal(t, "photos/2024/18.jpg", listing.Objects[0].Key)
+
+	_, err = s.ListDir(id, "", "", "", 10)
+	assert.NotNil(t, err)
+}
@@ -7,6 +7,7 @@ import (
 	"os"
 	"runtime"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -41,15 +42,18 @@ func (l LogLevel) String() string {
 
 // Logger represents a structured logger
 type Logger struct {
-	level  LogLevel
+	// level is shared with the loggers derived through WithPrefix, so
+	// changing the level at runtime affects all of them.
+	level  *int32
 	output io.Writer
 	prefix string
 }
 
 // New creates a new logger with the specified level and output
 func New(level LogLevel, output io.Writer, prefix string) *Logger {
+	lvl := int32(level)
 	return &Logger{
-		level:  level,
+		level:  &lvl,
 		output: output,
 		prefix: prefix,
 	}
@@ -62,7 +66,12 @@ func NewDefault() *Logger {
 
 // SetLevel sets the minimum log level
 func (l *Logger) SetLevel(level LogLevel) {
-	l.level = level
+	atomic.StoreInt32(l.level, int32(level))
+}
+
+// Level returns the minimum log level
+func (l *Logger) Level() LogLevel {
+	return LogLevel(atomic.LoadInt32(l.level))
 }
 
 // SetOutput sets the output destination
@@ -77,7 +86,7 @@ func (l *Logger) SetPrefix(prefix string) {
 
 // log writes a log message with the specified level
 func (l *Logger) log(level LogLevel, format string, args ...interface{}) {
-	if level < l.level {
+	if level < l.Level() {
 		return
 	}
 
@@ -158,6 +167,11 @@ func SetGlobalLevel(level LogLevel) {
 	defaultLogger.SetLevel(level)
 }
 
+// GlobalLevel returns the global logger level
+func GlobalLevel() LogLevel {
+	return defaultLogger.Level()
+}
+
 // SetGlobalOutput sets the global logger output
 func SetGlobalOutput(output io.Writer) {
 	defaultLogger.SetOutput(output)
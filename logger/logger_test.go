@@ -76,6 +76,24 @@ func TestLoggerWithPrefix(t *testing.T) {
 	}
 }
 
+func TestLoggerWithPrefixSharesLevel(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(INFO, &buf, "MAIN")
+	subLogger := logger.WithPrefix("SUB")
+
+	subLogger.Debug("hidden message")
+	logger.SetLevel(DEBUG)
+	subLogger.Debug("visible message")
+
+	output := buf.String()
+	if strings.Contains(output, "hidden message") {
+		t.Error("Debug message should be filtered out before the level change")
+	}
+	if !strings.Contains(output, "visible message") {
+		t.Error("Expected level change to apply to prefixed logger")
+	}
+}
+
 func TestGlobalLogger(t *testing.T) {
 	var buf bytes.Buffer
 	SetGlobalOutput(&buf)
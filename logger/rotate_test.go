@@ -0,0 +1,65 @@
+package logger
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRotatingFileKeepsBackups(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	f, err := NewRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for path, want := range map[string]string{
+		path:        "fourth\n",
+		path + ".1": "third\n",
+		path + ".2": "second\n",
+	} {
+		got, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("%s holds %q, want %q", path, got, want)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("expected at most 2 backups, stat of a third: %v", err)
+	}
+}
+
+func TestRotatingFileAppendsAcrossOpens(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	f, err := NewRotatingFile(path, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("12345\n"))
+	f.Close()
+	if _, err := f.Write([]byte("closed\n")); err == nil {
+		t.Error("expected writes after Close to fail")
+	}
+
+	// The size of the file found is counted against the limit.
+	f, err = NewRotatingFile(path, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.Write([]byte("67890\n"))
+	if got, _ := os.ReadFile(path + ".1"); string(got) != "12345\n" {
+		t.Errorf("backup holds %q", got)
+	}
+	if got, _ := os.ReadFile(path); string(got) != "67890\n" {
+		t.Errorf("file holds %q", got)
+	}
+}
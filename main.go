@@ -1,52 +1,39 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
+	"github.com/anthdm/foreverstore/admin"
 	"github.com/anthdm/foreverstore/config"
 	"github.com/anthdm/foreverstore/logger"
-	"github.com/anthdm/foreverstore/p2p"
 )
 
-func makeServer(cfg *config.Config) *FileServer {
-	tcptransportOpts := p2p.TCPTransportOpts{
-		ListenAddr:    cfg.ListenAddr,
-		HandshakeFunc: p2p.NOPHandshakeFunc,
-		Decoder:       p2p.DefaultDecoder{},
-	}
-	tcpTransport := p2p.NewTCPTransport(tcptransportOpts)
+const configFile = "config.json"
 
-	var encKey []byte
-	if cfg.EncryptionEnabled {
-		if cfg.EncryptionKey != "" {
-			// TODO: Parse hex key from config
-			encKey = newEncryptionKey()
-		} else {
-			encKey = newEncryptionKey()
-		}
-	}
+// shutdownTimeout bounds how long the server waits for in-flight
+// operations when it is asked to stop.
+const shutdownTimeout = 30 * time.Second
 
-	fileServerOpts := FileServerOpts{
-		EncKey:            encKey,
-		StorageRoot:       cfg.StorageRoot,
-		PathTransformFunc: CASPathTransformFunc,
-		Transport:         tcpTransport,
-		BootstrapNodes:    cfg.BootstrapNodes,
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "soak" {
+		os.Exit(runSoakCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "doctor" {
+		os.Exit(runDoctorCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "demo" {
+		os.Exit(runDemoCommand(os.Args[2:]))
 	}
 
-	s := NewFileServer(fileServerOpts)
-	tcpTransport.OnPeer = s.OnPeer
-
-	return s
-}
-
-func main() {
 	// Load configuration
-	cfg, err := config.Load("config.json")
+	flags := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	cfg, err := config.LoadWithFlags(configFile, flags, os.Args[1:])
 	if err != nil {
 		fmt.Printf("Failed to load configuration: %v\n", err)
 		os.Exit(1)
@@ -69,18 +56,36 @@ func main() {
 		cfg.ListenAddr, cfg.StorageRoot, cfg.EncryptionEnabled)
 
 	// Create and start the file server
-	server := makeServer(cfg)
+	server, err := New(cfg)
+	if err != nil {
+		logger.Fatal("Failed to create server: %v", err)
+	}
 	
+	// Expose the control-plane API
+	var adminServer *admin.Server
+	if cfg.AdminAddr != "" {
+		adminServer = admin.NewServer(cfg.AdminAddr)
+		runtimeSettings := config.NewRuntimeSettings(cfg, configFile)
+		runtimeSettings.Register("slow_op_threshold_ms", slowOpSetting(cfg, server))
+		runtimeSettings.Register("client_rate_limit", clientRateSetting(cfg, server))
+		runtimeSettings.Register("peer_bandwidth_limit_bytes", peerBandwidthSetting(cfg, server))
+		admin.RegisterConfigHandlers(adminServer, runtimeSettings, server.checkAdminToken)
+		registerAdminHandlers(adminServer, server)
+		if cfg.AdminToken == "" {
+			logger.Warn("No admin token configured: the admin API refuses writes and administrative operations")
+		}
+		if err := adminServer.Start(); err != nil {
+			logger.Fatal("Failed to start admin API: %v", err)
+		}
+	}
+
 	// Setup graceful shutdown
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 	
-	// Start server in a goroutine
-	go func() {
-		if err := server.Start(); err != nil {
-			logger.Fatal("Server failed to start: %v", err)
-		}
-	}()
+	if err := server.Start(); err != nil {
+		logger.Fatal("Server failed to start: %v", err)
+	}
 
 	// Run demo if this is a test setup
 	if cfg.ListenAddr == ":3000" {
@@ -90,14 +95,19 @@ func main() {
 	// Wait for shutdown signal
 	<-sigChan
 	logger.Info("Received shutdown signal, stopping server...")
-	server.Stop()
-	logger.Info("Server stopped gracefully")
+	if adminServer != nil {
+		adminServer.Close(5 * time.Second)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		logger.Warn("Server stopped before in-flight operations finished: %v", err)
+	} else {
+		logger.Info("Server stopped gracefully")
+	}
 }
 
 func runDemo() {
-	// Wait a bit for server to start
-	time.Sleep(2 * time.Second)
-	
 	logger.Info("Running demo...")
 	
 	// This is a simple demo - in a real application, you'd use the CLI or API
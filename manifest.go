@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/anthdm/foreverstore/errors"
+)
+
+// A manifest describes an object stored in parts: the chunks of a chunked
+// file, or the shards of an erasure coded one. It is stored as an object of
+// its own, replicated and fetched like any other, under a key derived from
+// its content. The encoded form is self-describing:
+//
+//	magic "FSM1" | JSON encoded Manifest
+//
+// The magic changes only if the framing does; the fields of the manifest
+// are versioned by its Version.
+const (
+	manifestMagic = "FSM1"
+	// ManifestVersion is the newest manifest version this node reads and
+	// the one it writes. Manifests of a newer version are rejected rather
+	// than misread.
+	ManifestVersion = 1
+	// maxManifestSize bounds the encoded manifests read back.
+	maxManifestSize = 16 << 20
+
+	manifestKeyPrefix = "manifests/"
+	chunkKeyPrefix    = "chunks/"
+)
+
+// Encodings of the parts listed in a manifest.
+const (
+	// ManifestEncodingChunked splits the object into chunks stored in
+	// order: the object is their concatenation.
+	ManifestEncodingChunked = "chunked"
+	// ManifestEncodingErasure stores the object as stripes of DataShards
+	// data chunks followed by ParityShards parity chunks.
+	ManifestEncodingErasure = "erasure"
+)
+
+// Compressions of the parts listed in a manifest.
+const (
+	ManifestCompressionNone = "none"
+	ManifestCompressionGzip = "gzip"
+)
+
+// Manifest lists the parts an object is stored as, and how to put it back
+// together.
+type Manifest struct {
+	Version int `json:"version"`
+	// Size is the size of the object the parts make up.
+	Size     int64  `json:"size"`
+	Encoding string `json:"encoding"`
+	// Cipher is the cipher suite the parts are encrypted with by their
+	// writer, if any, on top of the encryption of every replica.
+	Cipher      string `json:"cipher,omitempty"`
+	Compression string `json:"compression,omitempty"`
+	// DataShards and ParityShards shape the stripes of erasure coded
+	// objects.
+	DataShards   int             `json:"data_shards,omitempty"`
+	ParityShards int             `json:"parity_shards,omitempty"`
+	Chunks       []ManifestChunk `json:"chunks"`
+}
+
+// ManifestChunk is a part of an object, stored as an object under Key.
+type ManifestChunk struct {
+	Key string `json:"key"`
+	// Hash is the SHA-256 of the part as stored, and Size its size.
+	Hash []byte `json:"hash"`
+	Size int64  `json:"size"`
+}
+
+// NewManifestChunk describes data as a part stored under its content
+// addressed key.
+func NewManifestChunk(data []byte) ManifestChunk {
+	sum := sha256.Sum256(data)
+	return ManifestChunk{
+		Key:  chunkKeyPrefix + hex.EncodeToString(sum[:]),
+		Hash: sum[:],
+		Size: int64(len(data)),
+	}
+}
+
+// Verify checks that data is the part described by c.
+func (c ManifestChunk) Verify(data []byte) error {
+	sum := sha256.Sum256(data)
+	if int64(len(data)) != c.Size || !bytes.Equal(sum[:], c.Hash) {
+		return errors.NewCorruptionError("chunk does not match its manifest").
+			WithContext("key", c.Key)
+	}
+	return nil
+}
+
+// Validate checks that m is a manifest this node can read.
+func (m *Manifest) Validate() error {
+	if m.Version < 1 || m.Version > ManifestVersion {
+		return errors.NewValidationError(fmt.Sprintf("unsupported manifest version: %d", m.Version))
+	}
+	if m.Size < 0 {
+		return errors.NewValidationError("manifest size is negative")
+	}
+	switch m.Compression {
+	case "", ManifestCompressionNone, ManifestCompressionGzip:
+	default:
+		return errors.NewValidationError(fmt.Sprintf("unknown manifest compression: %s", m.Compression))
+	}
+	if m.Cipher != "" && !validCipherSuite(m.Cipher) {
+		return errors.NewValidationError(fmt.Sprintf("unknown manifest cipher: %s", m.Cipher))
+	}
+
+	var total int64
+	for i, c := range m.Chunks {
+		if c.Key == "" || len(c.Hash) != sha256.Size || c.Size < 0 {
+			return errors.NewValidationError(fmt.Sprintf("invalid manifest chunk %d", i))
+		}
+		total += c.Size
+	}
+
+	switch m.Encoding {
+	case ManifestEncodingChunked:
+		// Parts that are compressed or encrypted don't add up to the
+		// object.
+		plain := (m.Compression == "" || m.Compression == ManifestCompressionNone) && m.Cipher == ""
+		if plain && total != m.Size {
+			return errors.NewValidationError(fmt.Sprintf("manifest chunks hold %d bytes, not %d", total, m.Size))
+		}
+	case ManifestEncodingErasure:
+		stripe := m.DataShards + m.ParityShards
+		if m.DataShards < 1 || m.ParityShards < 0 || len(m.Chunks)%stripe != 0 {
+			return errors.NewValidationError(fmt.Sprintf("%d chunks do not make stripes of %d+%d shards", len(m.Chunks), m.DataShards, m.ParityShards))
+		}
+	default:
+		return errors.NewValidationError(fmt.Sprintf("unknown manifest encoding: %s", m.Encoding))
+	}
+	return nil
+}
+
+// EncodeManifest validates m and returns its encoded form. A manifest
+// without a version is written as ManifestVersion.
+func EncodeManifest(m *Manifest) ([]byte, error) {
+	if m.Version == 0 {
+		m.Version = ManifestVersion
+	}
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil, errors.Wrap(err, errors.InternalError, "failed to encode manifest")
+	}
+	return append([]byte(manifestMagic), b...), nil
+}
+
+// IsManifest reports whether b is an encoded manifest.
+func IsManifest(b []byte) bool {
+	return bytes.HasPrefix(b, []byte(manifestMagic))
+}
+
+// DecodeManifest decodes and validates a manifest encoded by
+// EncodeManifest.
+func DecodeManifest(b []byte) (*Manifest, error) {
+	if !IsManifest(b) {
+		return nil, errors.NewCorruptionError("not a manifest")
+	}
+	var m Manifest
+	if err := json.Unmarshal(b[len(manifestMagic):], &m); err != nil {
+		return nil, errors.Wrap(err, errors.CorruptionError, "malformed manifest")
+	}
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// ManifestKey returns the content addressed key an encoded manifest is
+// stored under.
+func ManifestKey(encoded []byte) string {
+	sum := sha256.Sum256(encoded)
+	return manifestKeyPrefix + hex.EncodeToString(sum[:])
+}
+
+// StoreManifest stores m and returns the key it is stored under. Storing
+// the same manifest again stores it under the same key.
+func (s *FileServer) StoreManifest(m *Manifest) (string, error) {
+	b, err := EncodeManifest(m)
+	if err != nil {
+		return "", err
+	}
+	key := ManifestKey(b)
+	if err := s.Store(key, bytes.NewReader(b)); err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// GetManifest returns the manifest stored under key, fetching it from the
+// peers if it is not held locally.
+func (s *FileServer) GetManifest(key string) (*Manifest, error) {
+	b, err := s.readManifest(key)
+	if err != nil {
+		return nil, err
+	}
+	if ManifestKey(b) != key {
+		return nil, errors.NewCorruptionError("manifest does not match its key").WithContext("key", key)
+	}
+	return DecodeManifest(b)
+}
+
+// readManifest reads the encoded manifest stored under key.
+func (s *FileServer) readManifest(key string) ([]byte, error) {
+	r, err := s.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	b, err := io.ReadAll(io.LimitReader(r, maxManifestSize+1))
+	if c, ok := r.(io.Closer); ok {
+		c.Close()
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, errors.StorageError, "failed to read manifest")
+	}
+	if len(b) > maxManifestSize {
+		return nil, errors.NewCorruptionError("manifest too large").WithContext("key", key)
+	}
+	return b, nil
+}
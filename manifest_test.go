@@ -0,0 +1,82 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/anthdm/foreverstore/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestManifestRoundTrip(t *testing.T) {
+	first, second := []byte("first chunk "), []byte("second chunk")
+	m := &Manifest{
+		Size:     int64(len(first) + len(second)),
+		Encoding: ManifestEncodingChunked,
+		Chunks:   []ManifestChunk{NewManifestChunk(first), NewManifestChunk(second)},
+	}
+	b, err := EncodeManifest(m)
+	assert.Nil(t, err)
+	assert.True(t, IsManifest(b))
+	assert.False(t, IsManifest(first))
+
+	got, err := DecodeManifest(b)
+	assert.Nil(t, err)
+	assert.Equal(t, ManifestVersion, got.Version)
+	assert.Equal(t, m, got)
+	assert.Nil(t, got.Chunks[1].Verify(second))
+	assert.True(t, errors.IsType(got.Chunks[1].Verify(first), errors.CorruptionError))
+
+	// The same content is the same chunk, and the same manifest.
+	assert.Equal(t, NewManifestChunk(first).Key, got.Chunks[0].Key)
+	again, err := EncodeManifest(got)
+	assert.Nil(t, err)
+	assert.Equal(t, ManifestKey(b), ManifestKey(again))
+}
+
+func TestManifestValidation(t *testing.T) {
+	chunk := NewManifestChunk([]byte("data"))
+	for name, m := range map[string]Manifest{
+		"newer version":    {Version: ManifestVersion + 1, Size: 4, Encoding: ManifestEncodingChunked, Chunks: []ManifestChunk{chunk}},
+		"size mismatch":    {Size: 5, Encoding: ManifestEncodingChunked, Chunks: []ManifestChunk{chunk}},
+		"unknown encoding": {Size: 4, Encoding: "zstd-frames", Chunks: []ManifestChunk{chunk}},
+		"short hash":       {Size: 4, Encoding: ManifestEncodingChunked, Chunks: []ManifestChunk{{Key: chunk.Key, Hash: chunk.Hash[:4], Size: 4}}},
+		"broken stripe":    {Size: 4, Encoding: ManifestEncodingErasure, DataShards: 2, ParityShards: 1, Chunks: []ManifestChunk{chunk, chunk}},
+		"unknown cipher":   {Size: 4, Encoding: ManifestEncodingChunked, Cipher: "rot13", Chunks: []ManifestChunk{chunk}},
+	} {
+		m := m
+		_, err := EncodeManifest(&m)
+		assert.True(t, errors.IsType(err, errors.ValidationError), name)
+	}
+
+	// Compressed chunks don't add up to the object.
+	_, err := EncodeManifest(&Manifest{Size: 100, Encoding: ManifestEncodingChunked, Compression: ManifestCompressionGzip, Chunks: []ManifestChunk{chunk}})
+	assert.Nil(t, err)
+
+	_, err = DecodeManifest([]byte("FSM1{not json"))
+	assert.True(t, errors.IsType(err, errors.CorruptionError))
+	_, err = DecodeManifest([]byte(`{"version":1}`))
+	assert.True(t, errors.IsType(err, errors.CorruptionError))
+}
+
+func TestManifestIsRestoredFromPeers(t *testing.T) {
+	c := newTestCluster(t, 2)
+	s := c.nodes[0]
+
+	data := []byte("a chunk of a larger file")
+	m := &Manifest{Size: int64(len(data)), Encoding: ManifestEncodingChunked, Chunks: []ManifestChunk{NewManifestChunk(data)}}
+	var key string
+	assert.Nil(t, c.run("store manifest", func() (err error) {
+		key, err = s.StoreManifest(m)
+		return err
+	}))
+	c.assertConverged(0, key)
+
+	// Lose the local copy; the manifest comes back from the peer intact.
+	assert.Nil(t, s.store.Delete(s.ID, key))
+	var got *Manifest
+	assert.Nil(t, c.run("get manifest", func() (err error) {
+		got, err = s.GetManifest(key)
+		return err
+	}))
+	assert.Equal(t, m, got)
+}
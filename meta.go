@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/anthdm/foreverstore/errors"
+)
+
+// metaExt is the extension of the metadata file kept next to an object.
+const metaExt = ".meta"
+
+// ObjectMeta is the metadata kept alongside every stored object.
+type ObjectMeta struct {
+	// Key is the key the object is stored under in its namespace, which
+	// cannot be recovered from the content addressed path.
+	Key string `json:"key,omitempty"`
+	// HMAC is the integrity tag over the object's plaintext, computed with
+	// the integrity key derived from encryption key KeyVersion.
+	HMAC       []byte `json:"hmac,omitempty"`
+	KeyVersion uint32 `json:"key_version"`
+	// SHA256 is the hash of the object's content as its client stored it,
+	// which the client can compute and check on its own, unlike HMAC.
+	SHA256 []byte `json:"sha256,omitempty"`
+	// Cipher identifies the algorithm the object's replicas are encrypted
+	// with: a cipher suite, or CipherLegacyCTR.
+	Cipher string `json:"cipher,omitempty"`
+	// Bucket is the bucket of the object, whose policy decides how its
+	// replicas are encrypted.
+	Bucket string `json:"bucket,omitempty"`
+	// Client is the metadata supplied by the client that stored the object.
+	Client *ClientMeta `json:"client,omitempty"`
+	// Lock, when set, makes the object immutable until it expires.
+	Lock *ObjectLock `json:"lock,omitempty"`
+	// StoredAt is when the owner stored the object; lifecycle rules age
+	// objects from it. AccessedAt is when the owner last read it, recorded
+	// only when a cold tier is configured.
+	StoredAt   time.Time `json:"stored_at"`
+	AccessedAt time.Time `json:"accessed_at"`
+	// CreatedAt is when an object was first stored under its key; StoredAt
+	// moves on every store replacing it.
+	CreatedAt time.Time `json:"created_at,omitempty"`
+	// Cold, when set, is the copy of an object offloaded to the cold tier.
+	Cold *ColdCopy `json:"cold,omitempty"`
+	// LeaderETag is the ETag of the object on the leader of a follower,
+	// for objects copied from it.
+	LeaderETag string `json:"leader_etag,omitempty"`
+	// Writes are the last stores of the key sent with an idempotency
+	// token, so that they are not applied again.
+	Writes []IdempotentWrite `json:"writes,omitempty"`
+	// Epoch orders the versions of the object: every store by its owner
+	// gives it an epoch past that of the version it replaces, and at least
+	// the time of the store in nanoseconds, so that epochs keep growing
+	// across deletes. Zero for objects stored before epochs were recorded.
+	Epoch uint64 `json:"epoch,omitempty"`
+}
+
+// updateMetaFile applies update to the metadata file at path.
+func updateMetaFile(path string, update func(*ObjectMeta)) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var meta ObjectMeta
+	if err := json.Unmarshal(b, &meta); err != nil {
+		return err
+	}
+	update(&meta)
+	if b, err = json.Marshal(meta); err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, 0644)
+}
+
+// maxClientMetaSize bounds the encoded client metadata, which travels in
+// control messages.
+const maxClientMetaSize = 256
+
+// ClientMeta is opaque to the servers: they store it with the object and
+// hand it back on Get. Only its content type is filled in by the servers,
+// when the client leaves it out.
+type ClientMeta struct {
+	// Encrypted marks objects encrypted by the client with a key the
+	// servers never see. Their content is returned as stored.
+	Encrypted  bool              `json:"encrypted,omitempty"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	// ContentType is the media type the object is served with over HTTP.
+	ContentType string `json:"content_type,omitempty"`
+}
+
+// sniffLen is the number of leading bytes content types are detected from.
+const sniffLen = 512
+
+// withContentType returns client with the content type detected from data
+// when the client gave none. The content of objects encrypted by their
+// client tells nothing, and they are left without one; so are those whose
+// metadata would no longer fit in a control message.
+func withContentType(client *ClientMeta, data []byte) *ClientMeta {
+	if client != nil && (client.ContentType != "" || client.Encrypted) {
+		return client
+	}
+	if len(data) > sniffLen {
+		data = data[:sniffLen]
+	}
+	detected := &ClientMeta{}
+	if client != nil {
+		*detected = *client
+	}
+	detected.ContentType = http.DetectContentType(data)
+	if detected.Validate() != nil {
+		return client
+	}
+	return detected
+}
+
+// ETag returns the entity tag an object is served with over HTTP, derived
+// from its integrity tag, or "" for objects stored without one. It changes
+// with the content of the object, and when its key is rotated.
+func (m ObjectMeta) ETag() string {
+	if len(m.HMAC) == 0 {
+		return ""
+	}
+	n := len(m.HMAC)
+	if n > 16 {
+		n = 16
+	}
+	return `"` + hex.EncodeToString(m.HMAC[:n]) + `"`
+}
+
+// ContentSHA256 returns the SHA-256 of the content of an object, hex
+// encoded, or "" for objects stored before it was recorded.
+func (m ObjectMeta) ContentSHA256() string {
+	return hex.EncodeToString(m.SHA256)
+}
+
+// Validate checks that the client metadata fits in a control message.
+func (c *ClientMeta) Validate() error {
+	if c == nil {
+		return nil
+	}
+	b, err := json.Marshal(c)
+	if err != nil {
+		return errors.Wrap(err, errors.InvalidInputError, "invalid client metadata")
+	}
+	if len(b) > maxClientMetaSize {
+		return errors.NewValidationError(fmt.Sprintf("client metadata exceeds %d bytes", maxClientMetaSize))
+	}
+	if c.ContentType != "" {
+		if _, _, err := mime.ParseMediaType(c.ContentType); err != nil {
+			return errors.NewValidationError(fmt.Sprintf("invalid content type: %s", c.ContentType))
+		}
+	}
+	return nil
+}
+
+// writeClientMeta writes c as a length prefixed JSON block; nil is written
+// as an empty block.
+func writeClientMeta(w io.Writer, c *ClientMeta) error {
+	var b []byte
+	if c != nil {
+		var err error
+		if b, err = json.Marshal(c); err != nil {
+			return err
+		}
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint16(len(b))); err != nil {
+		return err
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+// readClientMeta reads a block written by writeClientMeta.
+func readClientMeta(r io.Reader) (*ClientMeta, error) {
+	var n uint16
+	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, nil
+	}
+	if n > maxClientMetaSize {
+		return nil, errors.NewValidationError("client metadata block too large")
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	var c ClientMeta
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (s *Store) metaPath(id string, key string) string {
+	pathKey := s.PathTransformFunc(key)
+	return fmt.Sprintf("%s/%s/%s%s", s.Root, id, pathKey.FullPath(), metaExt)
+}
+
+// WriteMeta stores the metadata of an object, recording its key. The object
+// itself must have been written first.
+func (s *Store) WriteMeta(id string, key string, meta ObjectMeta) error {
+	meta.Key = key
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return s.writeFailed(os.WriteFile(s.metaPath(id, key), b, 0644))
+}
+
+// ReadMeta returns the metadata of an object. Objects written before
+// metadata was recorded return an error satisfying os.IsNotExist.
+func (s *Store) ReadMeta(id string, key string) (ObjectMeta, error) {
+	var meta ObjectMeta
+
+	b, err := os.ReadFile(s.metaPath(id, key))
+	if err != nil {
+		return meta, err
+	}
+	if err := json.Unmarshal(b, &meta); err != nil {
+		return meta, err
+	}
+	return meta, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/anthdm/foreverstore/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientMetaBlock(t *testing.T) {
+	buf := new(bytes.Buffer)
+	assert.Nil(t, writeClientMeta(buf, nil))
+	client := &ClientMeta{Encrypted: true, Attributes: map[string]string{"content-type": "text/plain"}}
+	assert.Nil(t, writeClientMeta(buf, client))
+
+	got, err := readClientMeta(buf)
+	assert.Nil(t, err)
+	assert.Nil(t, got)
+	got, err = readClientMeta(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, client, got)
+}
+
+func TestClientMetaValidate(t *testing.T) {
+	assert.Nil(t, (*ClientMeta)(nil).Validate())
+
+	client := &ClientMeta{Attributes: map[string]string{"big": strings.Repeat("x", maxClientMetaSize)}}
+	assert.True(t, errors.IsType(client.Validate(), errors.ValidationError))
+}
+
+func TestClientMetaIsRestoredFromPeers(t *testing.T) {
+	c := newTestCluster(t, 2)
+
+	client := &ClientMeta{Encrypted: true, Attributes: map[string]string{"e2e-key-id": "0123456789abcdef"}}
+	data := []byte("opaque client ciphertext")
+	c.storeObject(1, "doc", data, client)
+	c.assertConverged(1, "doc")
+
+	// Lose the local copy; Get must fetch it back along with its metadata.
+	s := c.nodes[1]
+	assert.Nil(t, s.store.Delete(s.ID, "doc"))
+	assert.Equal(t, data, c.get(1, "doc"))
+
+	meta, err := s.Meta("doc")
+	assert.Nil(t, err)
+	assert.Equal(t, client, meta.Client)
+}
+
+func TestWithContentType(t *testing.T) {
+	html := []byte("<!DOCTYPE html><html></html>")
+	assert.Equal(t, &ClientMeta{ContentType: "text/html; charset=utf-8"}, withContentType(nil, html))
+
+	// What the client gave is kept, and the content of objects it encrypted
+	// is not looked at.
+	given := &ClientMeta{ContentType: "application/json"}
+	assert.Equal(t, given, withContentType(given, html))
+	encrypted := &ClientMeta{Encrypted: true}
+	assert.Equal(t, encrypted, withContentType(encrypted, html))
+
+	// The client metadata must still fit in a control message.
+	full := &ClientMeta{Attributes: map[string]string{"note": strings.Repeat("x", maxClientMetaSize-30)}}
+	assert.Nil(t, full.Validate())
+	assert.Equal(t, full, withContentType(full, html))
+
+	assert.True(t, errors.IsType((&ClientMeta{ContentType: "bad;;"}).Validate(), errors.ValidationError))
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/anthdm/foreverstore/errors"
+)
+
+// MigrationStatus reports the progress of a migration to a replacement
+// node.
+type MigrationStatus struct {
+	Running    bool      `json:"running"`
+	Target     string    `json:"target"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at,omitempty"`
+	Total      int       `json:"total"`
+	Copied     int       `json:"copied"`
+	Bytes      int64     `json:"bytes"`
+	Failed     int       `json:"failed"`
+	LastError  string    `json:"last_error,omitempty"`
+}
+
+// MigratedObject describes an object sent to a replacement node. Objects
+// are copied as they are stored, with their metadata file, so replicas
+// stay encrypted and keep the place the path transform gave them.
+type MigratedObject struct {
+	// Namespace is the namespace the object is stored in on the source.
+	Namespace string
+	// Owned marks the objects stored by the source itself, which the
+	// target takes over in its own namespace.
+	Owned bool
+	// Path locates the object within its namespace.
+	Path string
+	// Meta is the content of the object's metadata file, empty for the
+	// replicas stored before metadata was recorded.
+	Meta []byte
+	// Checksum is the SHA-256 of the object as stored.
+	Checksum []byte
+}
+
+// MigrationTarget receives the objects of a migration.
+type MigrationTarget interface {
+	ImportObject(obj MigratedObject, r io.Reader) error
+}
+
+// migrationPageSize is the number of objects a migration lists at a time.
+const migrationPageSize = 1000
+
+// migrateTempExt is the extension of an imported object until it has been
+// verified.
+const migrateTempExt = ".migrate"
+
+// Migrate copies every object of this node, with its metadata, to target
+// in the background: the objects it stored and the replicas it holds for
+// its peers. The target verifies each object before taking it, so the node
+// can then be replaced by the target without waiting for the cluster to
+// re-replicate its data. The objects of the node copied are fenced: their
+// writes are refused from then on, pointing clients to the target, and the
+// target keeps the newer version of an object it holds. Objects written
+// while the migration runs, before it reached them, may be missed; run it
+// again once writes to the node have stopped.
+func (s *FileServer) Migrate(name string, target MigrationTarget) error {
+	s.migrationLock.Lock()
+	defer s.migrationLock.Unlock()
+
+	if s.migration.Running {
+		return errors.NewValidationError(fmt.Sprintf("migration to %s is still running", s.migration.Target))
+	}
+	s.migration = MigrationStatus{
+		Running:   true,
+		Target:    name,
+		StartedAt: s.Clock.Now(),
+	}
+
+	s.logger.Info("Migrating data to %s", name)
+	go s.migrateStore(target)
+	return nil
+}
+
+// MigrationStatus returns the progress of the last migration.
+func (s *FileServer) MigrationStatus() MigrationStatus {
+	s.migrationLock.Lock()
+	defer s.migrationLock.Unlock()
+	return s.migration
+}
+
+func (s *FileServer) updateMigration(fn func(*MigrationStatus)) {
+	s.migrationLock.Lock()
+	defer s.migrationLock.Unlock()
+	fn(&s.migration)
+}
+
+func (s *FileServer) migrateStore(target MigrationTarget) {
+	defer func() {
+		s.updateMigration(func(st *MigrationStatus) {
+			st.Running = false
+			st.FinishedAt = s.Clock.Now()
+		})
+		st := s.MigrationStatus()
+		s.logger.Info("Migration to %s finished: %d of %d objects copied, %d failed",
+			st.Target, st.Copied, st.Total, st.Failed)
+	}()
+
+	namespaces, err := os.ReadDir(s.store.Root)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			s.updateMigration(func(st *MigrationStatus) { st.LastError = err.Error() })
+		}
+		return
+	}
+
+	for _, ns := range namespaces {
+		if !ns.IsDir() {
+			continue
+		}
+
+		for cursor := ""; ; {
+			entries, next, err := s.store.Iterate(ns.Name(), "", cursor, migrationPageSize)
+			if err != nil {
+				s.updateMigration(func(st *MigrationStatus) { st.LastError = err.Error() })
+				break
+			}
+			for _, entry := range entries {
+				s.migrateEntry(target, ns.Name(), entry)
+			}
+			if next == "" {
+				break
+			}
+			cursor = next
+		}
+	}
+}
+
+func (s *FileServer) migrateEntry(target MigrationTarget, namespace string, entry StoreEntry) {
+	s.updateMigration(func(st *MigrationStatus) { st.Total++ })
+
+	size, err := s.migrateObject(target, namespace, entry)
+	s.updateMigration(func(st *MigrationStatus) {
+		if err != nil {
+			st.Failed++
+			st.LastError = err.Error()
+			return
+		}
+		st.Copied++
+		st.Bytes += size
+	})
+	if err != nil {
+		s.logger.Warn("Failed to migrate %s/%s: %v", namespace, entry.Path, err)
+	}
+}
+
+// migrateObject sends a single object to target and returns its size.
+func (s *FileServer) migrateObject(target MigrationTarget, namespace string, entry StoreEntry) (int64, error) {
+	obj := MigratedObject{Namespace: namespace, Owned: namespace == s.ID, Path: entry.Path}
+	if obj.Owned && entry.Key != "" {
+		// Keep the object and its metadata consistent while they are read.
+		unlock := s.keyLocks.lock(entry.Key)
+		defer unlock()
+	}
+
+	path := filepath.Join(s.store.Root, namespace, filepath.FromSlash(entry.Path))
+	meta, err := os.ReadFile(path + metaExt)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	obj.Meta = meta
+
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	sum := sha256.New()
+	size, err := io.Copy(sum, f)
+	if err != nil {
+		return 0, err
+	}
+	obj.Checksum = sum.Sum(nil)
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	if err := target.ImportObject(obj, f); err != nil {
+		return 0, err
+	}
+	if obj.Owned && entry.Key != "" {
+		// The lock is still held: no write slips in before the fence.
+		s.fences.fence(entry.Key, s.MigrationStatus().Target)
+	}
+	return size, nil
+}
+
+// validMigratedPath reports whether path is a relative object path that
+// stays within its namespace.
+func validMigratedPath(path string) bool {
+	if path == "" || strings.HasPrefix(path, "/") || strings.Contains(path, "\\") {
+		return false
+	}
+	for _, part := range strings.Split(path, "/") {
+		if part == "" || part == "." || part == ".." {
+			return false
+		}
+	}
+	switch filepath.Ext(path) {
+	case metaExt, rotateTempExt, migrateTempExt, receiveTempExt:
+		return false
+	}
+	return true
+}
+
+// ImportObject takes an object migrated from the node this one replaces.
+// The object is written only once its checksum matches and, for objects
+// the source stored itself, once its integrity tag verifies with this
+// node's keys: those without one are refused. Those objects are then
+// replicated to the peers as objects of this node. Replicas the source
+// holds of this node's own objects are skipped, and so are objects older
+// than the version this node holds, as a store racing with the migration
+// left it. An object whose metadata names a key stored elsewhere than its
+// path, or that replaces a locked or fenced object, is refused.
+func (s *FileServer) ImportObject(obj MigratedObject, r io.Reader) error {
+	if err := s.beginOp(); err != nil {
+		return err
+	}
+	defer s.ops.end()
+	if err := s.checkWritable(); err != nil {
+		return err
+	}
+
+	if !validNamespace(obj.Namespace) || !validMigratedPath(obj.Path) {
+		return errors.NewInvalidInputError("invalid migrated object: " + obj.Namespace + "/" + obj.Path)
+	}
+
+	if !obj.Owned && obj.Namespace == s.ID {
+		// The source's replicas of this node's own objects.
+		return nil
+	}
+
+	namespace := obj.Namespace
+	var meta ObjectMeta
+	if len(obj.Meta) > 0 {
+		if err := json.Unmarshal(obj.Meta, &meta); err != nil {
+			return errors.Wrap(err, errors.InvalidInputError, "invalid migrated object metadata")
+		}
+	}
+	if meta.Key != "" && s.store.PathTransformFunc(meta.Key).FullPath() != obj.Path {
+		return errors.NewInvalidInputError("migrated object is not stored under its key").
+			WithContext("key", meta.Key).WithContext("path", obj.Path)
+	}
+	if obj.Owned {
+		if meta.Key == "" || len(meta.HMAC) == 0 && meta.Cold == nil {
+			return errors.NewCorruptionError("migrated object has no integrity tag to verify").
+				WithContext("path", obj.Path)
+		}
+		namespace = s.ID
+		unlock := s.keyLocks.lock(meta.Key)
+		defer unlock()
+	} else if meta.Key != "" {
+		unlock := s.replicaLock(namespace, meta.Key)
+		defer unlock()
+	}
+
+	path := filepath.Join(s.store.Root, namespace, filepath.FromSlash(obj.Path))
+	if held, err := readMetaFile(path + metaExt); err == nil && newerThan(held, meta.Epoch) {
+		s.logger.Info("Keeping %s/%s: newer than the migrated copy", namespace, obj.Path)
+		return nil
+	}
+	if meta.Key != "" {
+		if obj.Owned {
+			if err := s.fences.check(meta.Key); err != nil {
+				return err
+			}
+		}
+		if err := s.checkNotLocked(namespace, meta.Key); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return errors.Wrap(err, errors.StorageError, "failed to create object directory")
+	}
+	tmpPath := path + migrateTempExt
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return errors.Wrap(err, errors.StorageError, "failed to create migrated object")
+	}
+	defer os.Remove(tmpPath)
+
+	sum := sha256.New()
+	w := io.MultiWriter(tmp, sum)
+	var mac hash.Hash
+	if obj.Owned && meta.Cold == nil {
+		if mac, err = newIntegrityHash(s.keyRing.Lookup, meta.KeyVersion); err != nil {
+			tmp.Close()
+			return errors.Wrap(err, errors.EncryptionError, "cannot verify migrated object")
+		}
+		w = io.MultiWriter(tmp, sum, mac)
+	}
+
+	size, err := io.Copy(w, r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errors.Wrap(err, errors.StorageError, "failed to write migrated object")
+	}
+	if !bytes.Equal(sum.Sum(nil), obj.Checksum) {
+		return errors.NewCorruptionError("migrated object does not match its checksum").
+			WithContext("path", obj.Path)
+	}
+	if mac != nil && !bytes.Equal(mac.Sum(nil), meta.HMAC) {
+		return errors.NewCorruptionError("migrated object failed integrity verification").
+			WithContext("key", meta.Key)
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		return errors.Wrap(err, errors.StorageError, "failed to store migrated object")
+	}
+	if len(obj.Meta) > 0 {
+		if err := os.WriteFile(path+metaExt, obj.Meta, 0644); err != nil {
+			return errors.Wrap(err, errors.StorageError, "failed to store migrated object metadata")
+		}
+	}
+
+	if !obj.Owned || meta.Key == "" {
+		return nil
+	}
+	s.recordChange(meta.Key, ChangePut, meta)
+	if meta.Cold != nil {
+		return nil
+	}
+	_, data, err := s.store.Read(s.ID, meta.Key)
+	if err != nil {
+		return errors.Wrap(err, errors.StorageError, "failed to read migrated object")
+	}
+	defer data.(io.Closer).Close()
+	t := s.trace("replicate", meta.Key)
+	err = s.replicate(meta.Key, meta, size, data, t)
+	t.done(err)
+	if err != nil {
+		s.logger.Warn("Failed to replicate migrated object %s: %v", meta.Key, err)
+	}
+	return nil
+}
+
+// Headers describing a migrated object in a PUT /migrate/objects request,
+// whose body is the object as stored.
+const (
+	headerMigrateNamespace = "X-Migrate-Namespace"
+	headerMigrateOwned     = "X-Migrate-Owned"
+	headerMigratePath      = "X-Migrate-Path"
+	headerMigrateMeta      = "X-Migrate-Meta"
+	headerMigrateChecksum  = "X-Migrate-Checksum"
+)
+
+// httpMigrationTarget sends migrated objects to the admin API of the
+// replacement node, authenticated by its admin token.
+type httpMigrationTarget struct {
+	addr   string
+	token  string
+	client *http.Client
+}
+
+func newHTTPMigrationTarget(addr, token string) *httpMigrationTarget {
+	return &httpMigrationTarget{addr: addr, token: token, client: http.DefaultClient}
+}
+
+func (t *httpMigrationTarget) ImportObject(obj MigratedObject, r io.Reader) error {
+	req, err := http.NewRequest(http.MethodPut, "http://"+t.addr+"/migrate/objects", r)
+	if err != nil {
+		return errors.Wrap(err, errors.InvalidInputError, "invalid migration target")
+	}
+	req.Header.Set(headerMigrateNamespace, obj.Namespace)
+	req.Header.Set(headerMigrateOwned, strconv.FormatBool(obj.Owned))
+	req.Header.Set(headerMigratePath, obj.Path)
+	req.Header.Set(headerMigrateMeta, base64.StdEncoding.EncodeToString(obj.Meta))
+	req.Header.Set(headerMigrateChecksum, hex.EncodeToString(obj.Checksum))
+	req.Header.Set("Authorization", "Bearer "+t.token)
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, errors.NetworkError, "failed to reach migration target")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		msg, _ := io.ReadAll(resp.Body)
+		return errors.NewNetworkError(fmt.Sprintf("migration target returned %s: %s", resp.Status, strings.TrimSpace(string(msg))))
+	}
+	return nil
+}
+
+// migratedObjectFromHeaders decodes the headers of a PUT /migrate/objects
+// request.
+func migratedObjectFromHeaders(h http.Header) (MigratedObject, error) {
+	obj := MigratedObject{
+		Namespace: h.Get(headerMigrateNamespace),
+		Path:      h.Get(headerMigratePath),
+	}
+	var err error
+	if obj.Owned, err = strconv.ParseBool(h.Get(headerMigrateOwned)); err != nil {
+		return obj, errors.NewInvalidInputError("invalid " + headerMigrateOwned + " header")
+	}
+	if obj.Meta, err = base64.StdEncoding.DecodeString(h.Get(headerMigrateMeta)); err != nil {
+		return obj, errors.NewInvalidInputError("invalid " + headerMigrateMeta + " header")
+	}
+	if obj.Checksum, err = hex.DecodeString(h.Get(headerMigrateChecksum)); err != nil || len(obj.Checksum) != sha256.Size {
+		return obj, errors.NewInvalidInputError("invalid " + headerMigrateChecksum + " header")
+	}
+	return obj, nil
+}
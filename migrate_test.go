@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/anthdm/foreverstore/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func (c *testCluster) migrate(from, to int) MigrationStatus {
+	c.t.Helper()
+	s := c.nodes[from]
+	if err := s.Migrate(c.nodes[to].Transport.Addr(), c.nodes[to]); err != nil {
+		c.t.Fatalf("migration failed to start: %v", err)
+	}
+	c.eventually("migration to finish", func() bool {
+		return !s.MigrationStatus().Running
+	})
+	return s.MigrationStatus()
+}
+
+func TestMigrateToReplacementNode(t *testing.T) {
+	c := newTestCluster(t, 3)
+
+	// The replacement misses a replica while it is cut off, and gets it
+	// from the node it replaces rather than from the cluster.
+	c.partition([]int{2})
+	c.storeObject(0, "docs/report", []byte("quarterly report"), &ClientMeta{Attributes: map[string]string{"team": "finance"}})
+	c.store(1, "logs/app", []byte("application log"))
+	c.heal()
+	assert.False(t, c.holds(2, 1, "logs/app"))
+
+	status := c.migrate(0, 2)
+	assert.Equal(t, 2, status.Total)
+	assert.Equal(t, 2, status.Copied)
+	assert.Zero(t, status.Failed)
+
+	assert.True(t, c.holds(2, 1, "logs/app"))
+	assert.Equal(t, []byte("application log"), c.get(1, "logs/app"))
+
+	// The replacement serves the objects of the node it replaces as its own,
+	// with their metadata, and replicates them to its peers.
+	target := c.nodes[2]
+	assert.True(t, c.holds(2, 2, "docs/report"))
+	meta, err := target.Meta("docs/report")
+	assert.Nil(t, err)
+	assert.Equal(t, "finance", meta.Client.Attributes["team"])
+	assert.Equal(t, []byte("quarterly report"), c.get(2, "docs/report"))
+	c.assertConverged(2, "docs/report")
+}
+
+func TestImportObjectVerifies(t *testing.T) {
+	c := newTestCluster(t, 1)
+	s := c.nodes[0]
+	data := []byte("migrated")
+	sum := sha256.Sum256(data)
+
+	err := s.ImportObject(MigratedObject{Namespace: "peer", Path: "ab/cd", Checksum: sum[:]}, bytes.NewReader([]byte("tampered")))
+	assert.True(t, errors.IsType(err, errors.CorruptionError))
+	_, err = os.Stat(filepath.Join(s.store.Root, "peer", "ab", "cd"))
+	assert.True(t, os.IsNotExist(err))
+
+	err = s.ImportObject(MigratedObject{Namespace: "peer", Path: "../escape", Checksum: sum[:]}, bytes.NewReader(data))
+	assert.True(t, errors.IsType(err, errors.InvalidInputError))
+
+	// Objects of the source must carry a tag to verify, be stored under
+	// their key, and not replace a locked object.
+	path := s.store.PathTransformFunc("contract").FullPath()
+	err = s.ImportObject(MigratedObject{Owned: true, Namespace: "peer", Path: path, Meta: []byte(`{"key":"contract"}`), Checksum: sum[:]}, bytes.NewReader(data))
+	assert.True(t, errors.IsType(err, errors.CorruptionError))
+	err = s.ImportObject(MigratedObject{Namespace: "peer", Path: "ab/cd", Meta: []byte(`{"key":"contract"}`), Checksum: sum[:]}, bytes.NewReader(data))
+	assert.True(t, errors.IsType(err, errors.InvalidInputError))
+
+	assert.Nil(t, s.StoreLockedObject("contract", bytes.NewReader([]byte("signed")), nil, &ObjectLock{}))
+	meta, err := os.ReadFile(s.store.metaPath(s.ID, "contract"))
+	assert.Nil(t, err)
+	err = s.ImportObject(MigratedObject{Owned: true, Namespace: "peer", Path: path, Meta: meta, Checksum: sum[:]}, bytes.NewReader(data))
+	assert.True(t, errors.IsType(err, errors.ObjectLockedError))
+
+	assert.True(t, validMigratedPath("ab/cd/ef"))
+	for _, path := range []string{"", "/abs", "a//b", "a/./b", "a/b.meta"} {
+		assert.False(t, validMigratedPath(path), path)
+	}
+}
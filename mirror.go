@@ -0,0 +1,486 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anthdm/foreverstore/errors"
+)
+
+// mirrorQueueSize bounds the changes waiting to be mirrored. Changes made
+// while the queue is full are dropped and counted, so that a slow mirror
+// never holds up the writes of the cluster, and the next reconcile pass
+// catches the mirror up.
+const mirrorQueueSize = 1024
+
+// mirrorMetaExt is the extension of the metadata kept next to every object
+// in the mirror. It holds the object's key, which the name of the object in
+// the mirror does not reveal.
+const mirrorMetaExt = ".meta"
+
+// MirrorStatus counts the changes copied to the mirror.
+type MirrorStatus struct {
+	Enabled  bool `json:"enabled"`
+	Pending  int  `json:"pending"`
+	Mirrored int  `json:"mirrored"`
+	Deleted  int  `json:"deleted"`
+	// Failed counts the changes the mirror rejected, and Dropped those that
+	// arrived while the queue was full. Both leave the mirror behind the
+	// node until the next reconcile pass.
+	Failed    int    `json:"failed"`
+	Dropped   int    `json:"dropped"`
+	LastError string `json:"last_error,omitempty"`
+	// Behind is set while the mirror may lack changes. Reconciled counts
+	// the objects the reconcile passes copied to the mirror or deleted
+	// from it.
+	Behind        bool      `json:"behind"`
+	Reconciled    int       `json:"reconciled"`
+	LastReconcile time.Time `json:"last_reconcile,omitempty"`
+}
+
+// MirrorRestoreStatus reports a restore of objects from the mirror.
+type MirrorRestoreStatus struct {
+	// Node is the node whose objects were restored.
+	Node     string `json:"node"`
+	Restored int    `json:"restored"`
+	// Current counts the objects already stored as mirrored.
+	Current int    `json:"current"`
+	Failed  int    `json:"failed"`
+	Error   string `json:"error,omitempty"`
+}
+
+// mirrorOp is a change waiting to be mirrored. The content of stored
+// objects is read when the change is mirrored, so that only the latest
+// version of an object written several times in a row is copied.
+type mirrorOp struct {
+	key    string
+	delete bool
+}
+
+type mirrorStats struct {
+	mu     sync.Mutex
+	status MirrorStatus
+	// unflushed counts the changes queued and not mirrored yet, including
+	// the one being mirrored.
+	unflushed int
+	// reconcileMu serializes the reconcile passes and the restores.
+	reconcileMu sync.Mutex
+}
+
+// MirrorStatus returns the mirror counters of the node.
+func (s *FileServer) MirrorStatus() MirrorStatus {
+	s.mirrorStats.mu.Lock()
+	defer s.mirrorStats.mu.Unlock()
+
+	status := s.mirrorStats.status
+	status.Enabled = s.Mirror != nil
+	status.Pending = len(s.mirrorch)
+	return status
+}
+
+// mirrorName is the name of an object of this node in the mirror. Objects
+// of several nodes can share a mirror.
+func (s *FileServer) mirrorName(key string) string {
+	return mirrorPrefix(s.ID) + hashKey(key)
+}
+
+// mirrorPrefix is the start of the names of the objects of node id in the
+// mirror.
+func mirrorPrefix(id string) string {
+	return id + "-"
+}
+
+// mirrorBehind records that the mirror missed a change.
+func (s *FileServer) mirrorBehind() {
+	s.mirrorStats.mu.Lock()
+	s.mirrorStats.status.Behind = true
+	s.mirrorStats.mu.Unlock()
+}
+
+// queueMirror schedules a change to an object of this node to be mirrored.
+func (s *FileServer) queueMirror(key string, delete bool) {
+	if s.Mirror == nil {
+		return
+	}
+	s.mirrorStats.mu.Lock()
+	s.mirrorStats.unflushed++
+	s.mirrorStats.mu.Unlock()
+
+	select {
+	case s.mirrorch <- mirrorOp{key: key, delete: delete}:
+	default:
+		s.logger.Warn("Mirror queue is full, not mirroring change to %s", key)
+		s.mirrorStats.mu.Lock()
+		s.mirrorStats.unflushed--
+		s.mirrorStats.status.Dropped++
+		s.mirrorStats.status.Behind = true
+		s.mirrorStats.mu.Unlock()
+	}
+}
+
+// mirrorPending reports whether changes are waiting to be mirrored.
+func (s *FileServer) mirrorPending() bool {
+	s.mirrorStats.mu.Lock()
+	defer s.mirrorStats.mu.Unlock()
+	return s.mirrorStats.unflushed > 0
+}
+
+// mirrorLoop copies the queued changes to the mirror until the server
+// stops.
+func (s *FileServer) mirrorLoop() {
+	for {
+		select {
+		case op := <-s.mirrorch:
+			var err error
+			if op.delete {
+				err = s.mirrorDelete(op.key)
+			} else {
+				err = s.mirrorObject(op.key)
+			}
+
+			s.mirrorStats.mu.Lock()
+			s.mirrorStats.unflushed--
+			switch {
+			case err != nil:
+				s.mirrorStats.status.Failed++
+				s.mirrorStats.status.LastError = err.Error()
+				s.mirrorStats.status.Behind = true
+			case op.delete:
+				s.mirrorStats.status.Deleted++
+			default:
+				s.mirrorStats.status.Mirrored++
+			}
+			s.mirrorStats.mu.Unlock()
+			if err != nil {
+				s.logger.Warn("Failed to mirror %s: %v", op.key, err)
+			}
+		case <-s.quitch:
+			return
+		}
+	}
+}
+
+// mirrorObject copies the current version of an object to the mirror,
+// encrypted like a replica. Its metadata is written last, so an object in
+// the mirror without metadata is an incomplete copy.
+func (s *FileServer) mirrorObject(key string) error {
+	unlock := s.keyLocks.lock(key)
+	defer unlock()
+
+	meta, err := s.store.ReadMeta(s.ID, key)
+	if os.IsNotExist(err) && !s.store.Has(s.ID, key) {
+		// Deleted since; the delete is queued too.
+		return nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, errors.StorageError, "failed to read object metadata")
+	}
+	if meta.Cold != nil {
+		// Offloaded since; the mirror got the object before it was.
+		return nil
+	}
+
+	_, r, err := s.store.Read(s.ID, key)
+	if err != nil {
+		return errors.Wrap(err, errors.StorageError, "failed to read object")
+	}
+	defer r.(io.Closer).Close()
+
+	name := s.mirrorName(key)
+	enc := s.replicaEncryption(bucketOf(key))
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := enc.copy(r, pw)
+		pw.CloseWithError(err)
+	}()
+	err = s.Mirror.Put(name, pr)
+	pr.CloseWithError(err)
+	if err != nil {
+		return errors.Wrap(err, errors.StorageError, "failed to copy object to the mirror")
+	}
+
+	meta.Key = key
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return errors.Wrap(err, errors.StorageError, "failed to encode object metadata")
+	}
+	if err := s.Mirror.Put(name+mirrorMetaExt, bytes.NewReader(b)); err != nil {
+		return errors.Wrap(err, errors.StorageError, "failed to copy object metadata to the mirror")
+	}
+	s.logger.Debug("Mirrored %s", key)
+	return nil
+}
+
+// mirrorDelete deletes an object of this node from the mirror.
+func (s *FileServer) mirrorDelete(key string) error {
+	if err := s.mirrorDeleteName(s.mirrorName(key)); err != nil {
+		return err
+	}
+	s.logger.Debug("Deleted %s from the mirror", key)
+	return nil
+}
+
+// mirrorDeleteName deletes the object stored under name from the mirror,
+// metadata first so that a failed delete leaves an incomplete copy.
+func (s *FileServer) mirrorDeleteName(name string) error {
+	for _, n := range []string{name + mirrorMetaExt, name} {
+		if err := s.Mirror.Delete(n); err != nil {
+			return errors.Wrap(err, errors.StorageError, "failed to delete object from the mirror")
+		}
+	}
+	return nil
+}
+
+// readMirrorMeta reads the metadata of the object stored under name in the
+// mirror.
+func (s *FileServer) readMirrorMeta(name string) (ObjectMeta, error) {
+	var meta ObjectMeta
+	rc, err := s.Mirror.Get(name + mirrorMetaExt)
+	if err != nil {
+		return meta, err
+	}
+	defer rc.Close()
+	if err := json.NewDecoder(rc).Decode(&meta); err != nil {
+		return meta, errors.Wrap(err, errors.StorageError, "failed to decode mirrored metadata")
+	}
+	return meta, nil
+}
+
+// ReconcileMirror brings the mirror back in line with the objects of this
+// node: it copies the objects the mirror lacks or holds an older version
+// of, and deletes those the node no longer stores. It catches up on the
+// changes the mirror missed, while its queue was full or it failed.
+func (s *FileServer) ReconcileMirror() (MirrorStatus, error) {
+	if s.Mirror == nil {
+		return s.MirrorStatus(), errors.NewConfigError("no mirror configured")
+	}
+	s.mirrorStats.reconcileMu.Lock()
+	defer s.mirrorStats.reconcileMu.Unlock()
+
+	return s.runMirrorReconcile()
+}
+
+// runMirrorReconcile is ReconcileMirror with reconcileMu held.
+func (s *FileServer) runMirrorReconcile() (MirrorStatus, error) {
+	// Changes missed from now on are caught up by the next pass.
+	s.mirrorStats.mu.Lock()
+	s.mirrorStats.status.Behind = false
+	s.mirrorStats.mu.Unlock()
+
+	n, err := s.reconcileMirror()
+
+	s.mirrorStats.mu.Lock()
+	s.mirrorStats.status.Reconciled += n
+	s.mirrorStats.status.LastReconcile = s.Clock.Now()
+	if err != nil {
+		s.mirrorStats.status.Behind = true
+		s.mirrorStats.status.LastError = err.Error()
+	}
+	s.mirrorStats.mu.Unlock()
+	return s.MirrorStatus(), err
+}
+
+func (s *FileServer) reconcileMirror() (int, error) {
+	// The mirror is listed first: objects stored after are found locally,
+	// and are never taken for deleted ones.
+	names, err := s.Mirror.List(mirrorPrefix(s.ID))
+	if err != nil {
+		return 0, err
+	}
+	stale := make(map[string]bool, len(names))
+	for _, name := range names {
+		stale[strings.TrimSuffix(name, mirrorMetaExt)] = true
+	}
+
+	var (
+		reconciled int
+		lastErr    error
+	)
+	for cursor := ""; ; {
+		entries, next, err := s.store.Iterate(s.ID, "", cursor, lifecyclePageSize)
+		if err != nil {
+			return reconciled, errors.Wrap(err, errors.StorageError, "failed to list objects")
+		}
+		for _, entry := range entries {
+			if entry.Key == "" {
+				continue
+			}
+			name := s.mirrorName(entry.Key)
+			delete(stale, name)
+			if s.mirrorCurrent(entry.Key, name) {
+				continue
+			}
+			if err := s.mirrorObject(entry.Key); err != nil {
+				s.logger.Warn("Failed to mirror %s: %v", entry.Key, err)
+				lastErr = err
+				continue
+			}
+			reconciled++
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+
+	for name := range stale {
+		if err := s.mirrorDeleteName(name); err != nil {
+			s.logger.Warn("Failed to delete %s from the mirror: %v", name, err)
+			lastErr = err
+			continue
+		}
+		reconciled++
+	}
+	if reconciled > 0 {
+		s.logger.Info("Mirror reconcile copied or deleted %d objects", reconciled)
+	}
+	return reconciled, lastErr
+}
+
+// mirrorCurrent reports whether the mirror holds the current version of an
+// object of this node, or the version it had when it was offloaded to the
+// cold tier, which the mirror keeps.
+func (s *FileServer) mirrorCurrent(key, name string) bool {
+	meta, err := s.store.ReadMeta(s.ID, key)
+	if err != nil {
+		return false
+	}
+	mirrored, err := s.readMirrorMeta(name)
+	if err != nil {
+		return false
+	}
+	return meta.Cold != nil || (bytes.Equal(mirrored.HMAC, meta.HMAC) && mirrored.Epoch == meta.Epoch)
+}
+
+// RestoreFromMirror stores again the objects of node id found in the
+// mirror, this node's own when id is empty: after the loss of the disk of
+// the node, or for a replacement node to take over the objects of one
+// lost with its replicas. Objects stored as they were mirrored are left
+// alone. Restored objects are stored by this node, and replicated as any
+// other.
+func (s *FileServer) RestoreFromMirror(id string) (MirrorRestoreStatus, error) {
+	if id == "" {
+		id = s.ID
+	}
+	status := MirrorRestoreStatus{Node: id}
+	if s.Mirror == nil {
+		return status, errors.NewConfigError("no mirror configured")
+	}
+	if !validNamespace(id) {
+		return status, errors.NewInvalidInputError("invalid node id: " + id)
+	}
+	s.mirrorStats.reconcileMu.Lock()
+	defer s.mirrorStats.reconcileMu.Unlock()
+
+	names, err := s.Mirror.List(mirrorPrefix(id))
+	if err != nil {
+		status.Error = err.Error()
+		return status, err
+	}
+	var lastErr error
+	for _, name := range names {
+		if !strings.HasSuffix(name, mirrorMetaExt) {
+			// Objects without metadata are incomplete copies.
+			continue
+		}
+		restored, err := s.restoreMirrored(strings.TrimSuffix(name, mirrorMetaExt))
+		switch {
+		case err != nil:
+			s.logger.Warn("Failed to restore %s from the mirror: %v", name, err)
+			status.Failed++
+			lastErr = err
+		case restored:
+			status.Restored++
+		default:
+			status.Current++
+		}
+	}
+	if lastErr != nil {
+		status.Error = lastErr.Error()
+	}
+	return status, lastErr
+}
+
+// restoreMirrored stores the object mirrored under name, unless this node
+// stores it as mirrored already.
+func (s *FileServer) restoreMirrored(name string) (bool, error) {
+	meta, err := s.readMirrorMeta(name)
+	if err != nil {
+		return false, err
+	}
+	if meta.Key == "" {
+		return false, errors.NewStorageError("mirrored metadata lacks the object's key")
+	}
+	if local, err := s.store.ReadMeta(s.ID, meta.Key); err == nil && bytes.Equal(local.HMAC, meta.HMAC) {
+		return false, nil
+	}
+
+	rc, err := s.Mirror.Get(name)
+	if err != nil {
+		return false, err
+	}
+	defer rc.Close()
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := copyDecryptAuto(s.keyRing.Lookup, s.decryptSuites(meta.Bucket, meta.Cipher), rc, pw)
+		pw.CloseWithError(err)
+	}()
+	var lock *ObjectLock
+	if meta.Lock.activeAt(s.Clock.Now()) {
+		lock = meta.Lock
+	}
+	err = s.StoreLockedObject(meta.Key, pr, meta.Client, lock)
+	pr.CloseWithError(err)
+	if err != nil {
+		return false, err
+	}
+	s.logger.Info("Restored %s from the mirror", meta.Key)
+	return true, nil
+}
+
+// mirrorReconcileLoop reconciles the mirror every MirrorReconcileInterval
+// while it is behind, until the server stops. The mirror is taken to be
+// behind as the node starts, having missed the changes queued when it
+// stopped.
+func (s *FileServer) mirrorReconcileLoop() {
+	s.mirrorBehind()
+	ticker := s.Clock.NewTicker(s.MirrorReconcileInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C():
+			if !s.MirrorStatus().Behind {
+				continue
+			}
+			if !s.scheduledMirrorReconcile() {
+				return
+			}
+		case <-s.quitch:
+			return
+		}
+	}
+}
+
+// scheduledMirrorReconcile reconciles the mirror unless the server is
+// stopping, as the server waits for the pass under way as it stops and
+// starts no other. It reports whether the pass ran.
+func (s *FileServer) scheduledMirrorReconcile() bool {
+	s.mirrorStats.reconcileMu.Lock()
+	defer s.mirrorStats.reconcileMu.Unlock()
+
+	select {
+	case <-s.quitch:
+		return false
+	default:
+	}
+	if _, err := s.runMirrorReconcile(); err != nil {
+		s.logger.Warn("Mirror reconcile failed: %v", err)
+	}
+	return true
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/anthdm/foreverstore/errors"
+	"github.com/anthdm/foreverstore/tier"
+	"github.com/stretchr/testify/assert"
+)
+
+func withMirror(t *testing.T, dir string) func(int, *FileServerOpts) {
+	backend, err := tier.NewDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return func(node int, opts *FileServerOpts) {
+		if node == 0 {
+			opts.Mirror = backend
+		}
+	}
+}
+
+func TestMirrorCopiesStoresAndDeletes(t *testing.T) {
+	dir := t.TempDir()
+	c := newTestClusterWith(t, 2, withMirror(t, dir))
+	s := c.nodes[0]
+
+	data := []byte("off-cluster copy")
+	c.store(0, "backups/db", data)
+	c.assertConverged(0, "backups/db")
+
+	name := filepath.Join(dir, s.mirrorName("backups/db"))
+	c.eventually("object to be mirrored", func() bool {
+		_, err := os.Stat(name + mirrorMetaExt)
+		return err == nil
+	})
+
+	b, err := os.ReadFile(name + mirrorMetaExt)
+	assert.Nil(t, err)
+	var meta ObjectMeta
+	assert.Nil(t, json.Unmarshal(b, &meta))
+	assert.Equal(t, "backups/db", meta.Key)
+
+	mirrored, err := os.ReadFile(name)
+	assert.Nil(t, err)
+	assert.False(t, bytes.Contains(mirrored, data), "mirrored copy is not encrypted")
+	var plain bytes.Buffer
+	_, err = copyDecryptAuto(s.keyRing.Lookup, suitesOf(CipherSuiteAESGCM), bytes.NewReader(mirrored), &plain)
+	assert.Nil(t, err)
+	assert.Equal(t, data, plain.Bytes())
+
+	assert.Nil(t, c.run("delete", func() error { return s.deleteObject("backups/db") }))
+	c.eventually("object to be deleted from the mirror", func() bool {
+		return s.MirrorStatus().Deleted == 1
+	})
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Empty(t, entries)
+
+	status := s.MirrorStatus()
+	assert.True(t, status.Enabled)
+	assert.Equal(t, 1, status.Mirrored)
+	assert.Equal(t, 1, status.Deleted)
+	assert.Zero(t, status.Failed)
+	assert.False(t, c.nodes[1].MirrorStatus().Enabled)
+}
+
+func TestMirrorReconcileCatchesUp(t *testing.T) {
+	dir := t.TempDir()
+	mirror := withMirror(t, dir)
+	c := newTestClusterWith(t, 1, func(node int, opts *FileServerOpts) {
+		mirror(node, opts)
+		opts.MirrorReconcileInterval = time.Minute
+	})
+	s := c.nodes[0]
+
+	c.store(0, "backups/db", []byte("mirrored"))
+	c.store(0, "backups/missed", []byte("never reached the mirror"))
+	name := filepath.Join(dir, s.mirrorName("backups/missed"))
+	c.eventually("objects to be mirrored", func() bool {
+		return s.MirrorStatus().Mirrored == 2
+	})
+	c.eventually("first reconcile pass", func() bool {
+		return !s.MirrorStatus().LastReconcile.IsZero()
+	})
+
+	// The mirror missed a store and a delete.
+	assert.Nil(t, os.Remove(name+mirrorMetaExt))
+	stale := filepath.Join(dir, s.mirrorName("backups/deleted"))
+	assert.Nil(t, os.WriteFile(stale, []byte("deleted object"), 0644))
+	assert.Nil(t, os.WriteFile(stale+mirrorMetaExt, []byte(`{"key":"backups/deleted"}`), 0644))
+	s.mirrorBehind()
+
+	c.clock.Advance(time.Minute)
+	c.eventually("mirror to be reconciled", func() bool {
+		return !s.MirrorStatus().Behind && s.MirrorStatus().Reconciled == 2
+	})
+	_, err := os.Stat(name + mirrorMetaExt)
+	assert.Nil(t, err)
+	_, err = os.Stat(stale)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestMirrorRestore(t *testing.T) {
+	dir := t.TempDir()
+	c := newTestClusterWith(t, 2, withMirror(t, dir))
+	s := c.nodes[0]
+
+	data := []byte("recovered from outside the cluster")
+	c.store(0, "backups/db", data)
+	c.store(0, "backups/kept", []byte("still on disk"))
+	c.eventually("objects to be mirrored", func() bool {
+		return s.MirrorStatus().Mirrored == 2
+	})
+
+	// The node lost an object, which the mirror still holds.
+	assert.Nil(t, s.store.Delete(s.ID, "backups/db"))
+
+	var status MirrorRestoreStatus
+	assert.Nil(t, c.run("restore", func() (err error) {
+		status, err = s.RestoreFromMirror("")
+		return err
+	}))
+	assert.Equal(t, MirrorRestoreStatus{Node: s.ID, Restored: 1, Current: 1}, status)
+	assert.Equal(t, data, c.get(0, "backups/db"))
+	c.assertConverged(0, "backups/db")
+
+	_, err := c.nodes[1].RestoreFromMirror("")
+	assert.True(t, errors.IsType(err, errors.ConfigError))
+	_, err = s.RestoreFromMirror("../escape")
+	assert.True(t, errors.IsType(err, errors.InvalidInputError))
+}
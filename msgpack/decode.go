@@ -0,0 +1,493 @@
+package msgpack
+
+import (
+	"encoding"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+)
+
+// Unmarshal decodes data into the value v points to. Map keys naming no
+// field of a struct are skipped, and fields left out are zero.
+func Unmarshal(data []byte, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("msgpack: cannot decode into %T", v)
+	}
+	d := decoder{data: data}
+	if err := d.decode(rv.Elem(), 0); err != nil {
+		return err
+	}
+	if d.pos != len(d.data) {
+		return fmt.Errorf("msgpack: %d bytes past the value", len(d.data)-d.pos)
+	}
+	return nil
+}
+
+type decoder struct {
+	data []byte
+	pos  int
+}
+
+func (d *decoder) decode(v reflect.Value, depth int) error {
+	if depth > maxDepth {
+		return fmt.Errorf("msgpack: %s nested too deeply", v.Type())
+	}
+	b, err := d.peek()
+	if err != nil {
+		return err
+	}
+	if b == formatNil {
+		d.pos++
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+	if marshalsBinary(v.Type()) {
+		data, err := d.readBin()
+		if err != nil {
+			return err
+		}
+		if err := v.Addr().Interface().(encoding.BinaryUnmarshaler).UnmarshalBinary(data); err != nil {
+			return fmt.Errorf("msgpack: %s: %w", v.Type(), err)
+		}
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		d.pos++
+		switch b {
+		case formatTrue:
+			v.SetBool(true)
+		case formatFalse:
+			v.SetBool(false)
+		default:
+			return d.mismatch(b, v)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := d.readInt(v)
+		if err != nil {
+			return err
+		}
+		if v.OverflowInt(i) {
+			return fmt.Errorf("msgpack: %d overflows %s", i, v.Type())
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		u, err := d.readUint(v)
+		if err != nil {
+			return err
+		}
+		if v.OverflowUint(u) {
+			return fmt.Errorf("msgpack: %d overflows %s", u, v.Type())
+		}
+		v.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		d.pos++
+		switch b {
+		case formatFloat32:
+			u, err := d.readN(4)
+			if err != nil {
+				return err
+			}
+			v.SetFloat(float64(math.Float32frombits(uint32(u))))
+		case formatFloat64:
+			u, err := d.readN(8)
+			if err != nil {
+				return err
+			}
+			v.SetFloat(math.Float64frombits(u))
+		default:
+			return d.mismatch(b, v)
+		}
+	case reflect.String:
+		s, err := d.readString()
+		if err != nil {
+			return err
+		}
+		v.SetString(s)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			data, err := d.readBin()
+			if err != nil {
+				return err
+			}
+			v.SetBytes(append([]byte(nil), data...))
+			return nil
+		}
+		n, err := d.readArrayLen(v)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.MakeSlice(v.Type(), n, n))
+		for i := 0; i < n; i++ {
+			if err := d.decode(v.Index(i), depth+1); err != nil {
+				return err
+			}
+		}
+	case reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			data, err := d.readBin()
+			if err != nil {
+				return err
+			}
+			if len(data) != v.Len() {
+				return fmt.Errorf("msgpack: %d bytes for %s", len(data), v.Type())
+			}
+			reflect.Copy(v, reflect.ValueOf(data))
+			return nil
+		}
+		n, err := d.readArrayLen(v)
+		if err != nil {
+			return err
+		}
+		if n != v.Len() {
+			return fmt.Errorf("msgpack: %d elements for %s", n, v.Type())
+		}
+		for i := 0; i < n; i++ {
+			if err := d.decode(v.Index(i), depth+1); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		n, err := d.readMapLen(v)
+		if err != nil {
+			return err
+		}
+		t := v.Type()
+		v.Set(reflect.MakeMapWithSize(t, n))
+		for i := 0; i < n; i++ {
+			key := reflect.New(t.Key()).Elem()
+			if err := d.decode(key, depth+1); err != nil {
+				return err
+			}
+			elem := reflect.New(t.Elem()).Elem()
+			if err := d.decode(elem, depth+1); err != nil {
+				return err
+			}
+			v.SetMapIndex(key, elem)
+		}
+	case reflect.Struct:
+		n, err := d.readMapLen(v)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.Zero(v.Type()))
+		for i := 0; i < n; i++ {
+			name, err := d.readString()
+			if err != nil {
+				return err
+			}
+			index, ok := fieldByName(v.Type(), name)
+			if !ok {
+				if err := d.skip(depth + 1); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := d.decode(v.Field(index), depth+1); err != nil {
+				return fmt.Errorf("%w (field %s of %s)", err, name, v.Type())
+			}
+		}
+	case reflect.Ptr:
+		elem := reflect.New(v.Type().Elem())
+		if err := d.decode(elem.Elem(), depth+1); err != nil {
+			return err
+		}
+		v.Set(elem)
+	case reflect.Interface:
+		n, err := d.readArrayLen(v)
+		if err != nil {
+			return err
+		}
+		if n != 2 {
+			return fmt.Errorf("msgpack: %d elements for %s", n, v.Type())
+		}
+		name, err := d.readString()
+		if err != nil {
+			return err
+		}
+		t, ok := registeredType(name)
+		if !ok {
+			return fmt.Errorf("msgpack: type %s not registered", name)
+		}
+		if !t.AssignableTo(v.Type()) {
+			return fmt.Errorf("msgpack: %s is not a %s", name, v.Type())
+		}
+		elem := reflect.New(t).Elem()
+		if err := d.decode(elem, depth+1); err != nil {
+			return err
+		}
+		v.Set(elem)
+	default:
+		return fmt.Errorf("msgpack: cannot decode %s", v.Type())
+	}
+	return nil
+}
+
+func (d *decoder) mismatch(b byte, v reflect.Value) error {
+	return fmt.Errorf("msgpack: format 0x%x for %s", b, v.Type())
+}
+
+func (d *decoder) peek() (byte, error) {
+	if d.pos >= len(d.data) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	return d.data[d.pos], nil
+}
+
+func (d *decoder) next() (byte, error) {
+	b, err := d.peek()
+	if err == nil {
+		d.pos++
+	}
+	return b, err
+}
+
+// readN reads a big endian integer of n bytes.
+func (d *decoder) readN(n int) (uint64, error) {
+	b, err := d.bytes(n)
+	if err != nil {
+		return 0, err
+	}
+	var u uint64
+	for _, c := range b {
+		u = u<<8 | uint64(c)
+	}
+	return u, nil
+}
+
+// bytes returns the next n bytes of the data.
+func (d *decoder) bytes(n int) ([]byte, error) {
+	if n < 0 || n > len(d.data)-d.pos {
+		return nil, io.ErrUnexpectedEOF
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+func (d *decoder) readInt(v reflect.Value) (int64, error) {
+	b, err := d.next()
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case b < 0x80:
+		return int64(b), nil
+	case b >= negFix:
+		return int64(int8(b)), nil
+	}
+	switch b {
+	case formatInt8:
+		u, err := d.readN(1)
+		return int64(int8(u)), err
+	case formatInt16:
+		u, err := d.readN(2)
+		return int64(int16(u)), err
+	case formatInt32:
+		u, err := d.readN(4)
+		return int64(int32(u)), err
+	case formatInt64:
+		u, err := d.readN(8)
+		return int64(u), err
+	case formatUint8, formatUint16, formatUint32, formatUint64:
+		u, err := d.readN(1 << (b - formatUint8))
+		if err == nil && u > math.MaxInt64 {
+			return 0, fmt.Errorf("msgpack: %d overflows %s", u, v.Type())
+		}
+		return int64(u), err
+	}
+	return 0, d.mismatch(b, v)
+}
+
+func (d *decoder) readUint(v reflect.Value) (uint64, error) {
+	b, err := d.peek()
+	if err != nil {
+		return 0, err
+	}
+	switch b {
+	case formatUint8, formatUint16, formatUint32, formatUint64:
+		d.pos++
+		return d.readN(1 << (b - formatUint8))
+	}
+	i, err := d.readInt(v)
+	if err == nil && i < 0 {
+		return 0, fmt.Errorf("msgpack: %d overflows %s", i, v.Type())
+	}
+	return uint64(i), err
+}
+
+func (d *decoder) readString() (string, error) {
+	b, err := d.next()
+	if err != nil {
+		return "", err
+	}
+	var n uint64
+	switch {
+	case b&0xe0 == fixStr:
+		n = uint64(b &^ 0xe0)
+	case b == formatStr8:
+		n, err = d.readN(1)
+	case b == formatStr16:
+		n, err = d.readN(2)
+	case b == formatStr32:
+		n, err = d.readN(4)
+	default:
+		return "", fmt.Errorf("msgpack: format 0x%x for a string", b)
+	}
+	if err != nil {
+		return "", err
+	}
+	s, err := d.bytes(int(n))
+	return string(s), err
+}
+
+func (d *decoder) readBin() ([]byte, error) {
+	b, err := d.next()
+	if err != nil {
+		return nil, err
+	}
+	var n uint64
+	switch b {
+	case formatBin8:
+		n, err = d.readN(1)
+	case formatBin16:
+		n, err = d.readN(2)
+	case formatBin32:
+		n, err = d.readN(4)
+	default:
+		return nil, fmt.Errorf("msgpack: format 0x%x for bin", b)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return d.bytes(int(n))
+}
+
+// readArrayLen reads the header of an array. The elements taking a byte
+// at least, longer arrays than the data left are refused before anything
+// is made for them.
+func (d *decoder) readArrayLen(v reflect.Value) (int, error) {
+	b, err := d.next()
+	if err != nil {
+		return 0, err
+	}
+	var n uint64
+	switch {
+	case b&0xf0 == fixArray:
+		n = uint64(b &^ 0xf0)
+	case b == formatArray16:
+		n, err = d.readN(2)
+	case b == formatArray32:
+		n, err = d.readN(4)
+	default:
+		return 0, d.mismatch(b, v)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if n > uint64(len(d.data)-d.pos) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	return int(n), nil
+}
+
+// readMapLen reads the header of a map, refusing as readArrayLen does.
+func (d *decoder) readMapLen(v reflect.Value) (int, error) {
+	b, err := d.next()
+	if err != nil {
+		return 0, err
+	}
+	var n uint64
+	switch {
+	case b&0xf0 == fixMap:
+		n = uint64(b &^ 0xf0)
+	case b == formatMap16:
+		n, err = d.readN(2)
+	case b == formatMap32:
+		n, err = d.readN(4)
+	default:
+		return 0, d.mismatch(b, v)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if 2*n > uint64(len(d.data)-d.pos) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	return int(n), nil
+}
+
+// skip reads past the next value, of a field the struct decoded into does
+// not have.
+func (d *decoder) skip(depth int) error {
+	if depth > maxDepth {
+		return fmt.Errorf("msgpack: value nested too deeply")
+	}
+	b, err := d.next()
+	if err != nil {
+		return err
+	}
+	var size, elems uint64
+	switch {
+	case b < 0x80, b >= negFix, b == formatNil, b == formatFalse, b == formatTrue:
+	case b&0xf0 == fixMap:
+		elems = 2 * uint64(b&^0xf0)
+	case b&0xf0 == fixArray:
+		elems = uint64(b &^ 0xf0)
+	case b&0xe0 == fixStr:
+		size = uint64(b &^ 0xe0)
+	case b == formatBin8, b == formatStr8:
+		size, err = d.readN(1)
+	case b == formatBin16, b == formatStr16:
+		size, err = d.readN(2)
+	case b == formatBin32, b == formatStr32:
+		size, err = d.readN(4)
+	case b == formatExt8:
+		size, err = d.readN(1)
+		size++
+	case b == formatExt16:
+		size, err = d.readN(2)
+		size++
+	case b == formatExt32:
+		size, err = d.readN(4)
+		size++
+	case b >= formatFixExt1 && b <= formatFixExt1+4:
+		size = 1 + 1<<(b-formatFixExt1)
+	case b == formatFloat32:
+		size = 4
+	case b == formatFloat64:
+		size = 8
+	case b >= formatUint8 && b <= formatUint64:
+		size = 1 << (b - formatUint8)
+	case b >= formatInt8 && b <= formatInt64:
+		size = 1 << (b - formatInt8)
+	case b == formatArray16:
+		elems, err = d.readN(2)
+	case b == formatArray32:
+		elems, err = d.readN(4)
+	case b == formatMap16:
+		elems, err = d.readN(2)
+		elems *= 2
+	case b == formatMap32:
+		elems, err = d.readN(4)
+		elems *= 2
+	default:
+		return fmt.Errorf("msgpack: invalid format 0x%x", b)
+	}
+	if err != nil {
+		return err
+	}
+	if size > uint64(len(d.data)-d.pos) || elems > uint64(len(d.data)-d.pos) {
+		return io.ErrUnexpectedEOF
+	}
+	d.pos += int(size)
+	for i := uint64(0); i < elems; i++ {
+		if err := d.skip(depth + 1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
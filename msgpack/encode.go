@@ -0,0 +1,250 @@
+package msgpack
+
+import (
+	"encoding"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"reflect"
+)
+
+var (
+	binaryMarshaler   = reflect.TypeOf((*encoding.BinaryMarshaler)(nil)).Elem()
+	binaryUnmarshaler = reflect.TypeOf((*encoding.BinaryUnmarshaler)(nil)).Elem()
+)
+
+// marshalsBinary reports whether the values of t are encoded as the bin
+// they marshal to, which takes them decoding it back too.
+func marshalsBinary(t reflect.Type) bool {
+	return t.Kind() != reflect.Ptr && t.Implements(binaryMarshaler) && reflect.PtrTo(t).Implements(binaryUnmarshaler)
+}
+
+// Marshal returns the encoding of v.
+func Marshal(v interface{}) ([]byte, error) {
+	var e encoder
+	if err := e.encode(reflect.ValueOf(v), 0); err != nil {
+		return nil, err
+	}
+	return e.buf, nil
+}
+
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) encode(v reflect.Value, depth int) error {
+	if !v.IsValid() {
+		e.buf = append(e.buf, formatNil)
+		return nil
+	}
+	if depth > maxDepth {
+		return fmt.Errorf("msgpack: %s nested too deeply", v.Type())
+	}
+	if marshalsBinary(v.Type()) {
+		b, err := v.Interface().(encoding.BinaryMarshaler).MarshalBinary()
+		if err != nil {
+			return fmt.Errorf("msgpack: %s: %w", v.Type(), err)
+		}
+		e.writeBin(b)
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			e.buf = append(e.buf, formatTrue)
+		} else {
+			e.buf = append(e.buf, formatFalse)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		e.writeInt(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		e.writeUint(v.Uint())
+	case reflect.Float32:
+		e.buf = append(e.buf, formatFloat32)
+		e.put32(math.Float32bits(float32(v.Float())))
+	case reflect.Float64:
+		e.buf = append(e.buf, formatFloat64)
+		e.put64(math.Float64bits(v.Float()))
+	case reflect.String:
+		e.writeString(v.String())
+	case reflect.Slice:
+		if v.IsNil() {
+			e.buf = append(e.buf, formatNil)
+			return nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			e.writeBin(v.Bytes())
+			return nil
+		}
+		return e.encodeArray(v, depth)
+	case reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(b), v)
+			e.writeBin(b)
+			return nil
+		}
+		return e.encodeArray(v, depth)
+	case reflect.Map:
+		if v.IsNil() {
+			e.buf = append(e.buf, formatNil)
+			return nil
+		}
+		e.writeHeader(v.Len(), fixMap, 16, 0, formatMap16, formatMap32)
+		iter := v.MapRange()
+		for iter.Next() {
+			if err := e.encode(iter.Key(), depth+1); err != nil {
+				return err
+			}
+			if err := e.encode(iter.Value(), depth+1); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		return e.encodeStruct(v, depth)
+	case reflect.Ptr:
+		if v.IsNil() {
+			e.buf = append(e.buf, formatNil)
+			return nil
+		}
+		return e.encode(v.Elem(), depth+1)
+	case reflect.Interface:
+		if v.IsNil() {
+			e.buf = append(e.buf, formatNil)
+			return nil
+		}
+		elem := v.Elem()
+		name, ok := registeredName(elem.Type())
+		if !ok {
+			return fmt.Errorf("msgpack: type %s not registered", elem.Type())
+		}
+		e.writeHeader(2, fixArray, 16, 0, formatArray16, formatArray32)
+		e.writeString(name)
+		return e.encode(elem, depth+1)
+	default:
+		return fmt.Errorf("msgpack: cannot encode %s", v.Type())
+	}
+	return nil
+}
+
+func (e *encoder) encodeArray(v reflect.Value, depth int) error {
+	e.writeHeader(v.Len(), fixArray, 16, 0, formatArray16, formatArray32)
+	for i := 0; i < v.Len(); i++ {
+		if err := e.encode(v.Index(i), depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodeStruct encodes the fields of v that are set, as gob would send
+// them.
+func (e *encoder) encodeStruct(v reflect.Value, depth int) error {
+	fields := fieldsOf(v.Type())
+	set := make([]field, 0, len(fields))
+	for _, f := range fields {
+		if !isEmpty(v.Field(f.index)) {
+			set = append(set, f)
+		}
+	}
+	e.writeHeader(len(set), fixMap, 16, 0, formatMap16, formatMap32)
+	for _, f := range set {
+		e.writeString(f.name)
+		if err := e.encode(v.Field(f.index), depth+1); err != nil {
+			return fmt.Errorf("%w (field %s of %s)", err, f.name, v.Type())
+		}
+	}
+	return nil
+}
+
+// isEmpty reports whether v is left out of the struct it is a field of:
+// zero values, and slices and maps without elements, which decode as nil.
+func isEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Slice, reflect.Map:
+		return v.Len() == 0
+	}
+	return v.IsZero()
+}
+
+func (e *encoder) writeInt(i int64) {
+	switch {
+	case i >= 0:
+		e.writeUint(uint64(i))
+	case i >= -32:
+		e.buf = append(e.buf, byte(i))
+	case i >= math.MinInt8:
+		e.buf = append(e.buf, formatInt8, byte(i))
+	case i >= math.MinInt16:
+		e.buf = append(e.buf, formatInt16)
+		e.put16(uint16(i))
+	case i >= math.MinInt32:
+		e.buf = append(e.buf, formatInt32)
+		e.put32(uint32(i))
+	default:
+		e.buf = append(e.buf, formatInt64)
+		e.put64(uint64(i))
+	}
+}
+
+func (e *encoder) writeUint(u uint64) {
+	switch {
+	case u < 128:
+		e.buf = append(e.buf, byte(u))
+	case u <= math.MaxUint8:
+		e.buf = append(e.buf, formatUint8, byte(u))
+	case u <= math.MaxUint16:
+		e.buf = append(e.buf, formatUint16)
+		e.put16(uint16(u))
+	case u <= math.MaxUint32:
+		e.buf = append(e.buf, formatUint32)
+		e.put32(uint32(u))
+	default:
+		e.buf = append(e.buf, formatUint64)
+		e.put64(u)
+	}
+}
+
+func (e *encoder) put16(u uint16) {
+	e.buf = append(e.buf, 0, 0)
+	binary.BigEndian.PutUint16(e.buf[len(e.buf)-2:], u)
+}
+
+func (e *encoder) put32(u uint32) {
+	e.buf = append(e.buf, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(e.buf[len(e.buf)-4:], u)
+}
+
+func (e *encoder) put64(u uint64) {
+	e.buf = append(e.buf, 0, 0, 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint64(e.buf[len(e.buf)-8:], u)
+}
+
+func (e *encoder) writeString(s string) {
+	e.writeHeader(len(s), fixStr, 32, formatStr8, formatStr16, formatStr32)
+	e.buf = append(e.buf, s...)
+}
+
+func (e *encoder) writeBin(b []byte) {
+	e.writeHeader(len(b), 0, 0, formatBin8, formatBin16, formatBin32)
+	e.buf = append(e.buf, b...)
+}
+
+// writeHeader writes the header of a value of n elements or bytes: fix|n
+// when n is below fixMax, else the smallest of the 8, 16 and 32 bit
+// formats n fits, format8 being 0 for the types without one.
+func (e *encoder) writeHeader(n int, fix byte, fixMax int, format8, format16, format32 byte) {
+	switch {
+	case n < fixMax:
+		e.buf = append(e.buf, fix|byte(n))
+	case format8 != 0 && n <= math.MaxUint8:
+		e.buf = append(e.buf, format8, byte(n))
+	case n <= math.MaxUint16:
+		e.buf = append(e.buf, format16)
+		e.put16(uint16(n))
+	default:
+		e.buf = append(e.buf, format32)
+		e.put32(uint32(n))
+	}
+}
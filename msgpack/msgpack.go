@@ -0,0 +1,130 @@
+// Package msgpack encodes Go values in the MessagePack format
+// (https://msgpack.org), the encoding of the messages between peers.
+//
+// It encodes what gob does for those messages, alike: structs are maps
+// from the names of their exported fields to their values, zero values and
+// empty slices and maps left out, so that fields can be added to a message
+// without breaking the peers that do not know them yet, which skip them.
+// []byte and byte arrays are bin, values implementing
+// encoding.BinaryMarshaler, such as time.Time, the bin they marshal to,
+// and interface values a two element array of the name the type was
+// registered with and the value. Channels, functions and unregistered
+// types in interfaces cannot be encoded.
+package msgpack
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// maxDepth bounds the nesting of the values encoded and decoded, so that
+// data made up to nest deeply fails rather than exhausts the stack.
+const maxDepth = 100
+
+// Formats of the values encoded, as the MessagePack specification numbers
+// them.
+const (
+	formatNil     = 0xc0
+	formatFalse   = 0xc2
+	formatTrue    = 0xc3
+	formatBin8    = 0xc4
+	formatBin16   = 0xc5
+	formatBin32   = 0xc6
+	formatExt8    = 0xc7
+	formatExt16   = 0xc8
+	formatExt32   = 0xc9
+	formatFloat32 = 0xca
+	formatFloat64 = 0xcb
+	formatUint8   = 0xcc
+	formatUint16  = 0xcd
+	formatUint32  = 0xce
+	formatUint64  = 0xcf
+	formatInt8    = 0xd0
+	formatInt16   = 0xd1
+	formatInt32   = 0xd2
+	formatInt64   = 0xd3
+	formatFixExt1 = 0xd4
+	formatStr8    = 0xd9
+	formatStr16   = 0xda
+	formatStr32   = 0xdb
+	formatArray16 = 0xdc
+	formatArray32 = 0xdd
+	formatMap16   = 0xde
+	formatMap32   = 0xdf
+
+	fixMap   = 0x80
+	fixArray = 0x90
+	fixStr   = 0xa0
+	negFix   = 0xe0
+)
+
+var registry = struct {
+	sync.RWMutex
+	names map[reflect.Type]string
+	types map[string]reflect.Type
+}{names: make(map[reflect.Type]string), types: make(map[string]reflect.Type)}
+
+// Register records the type of value, under its qualified name, for it to
+// be encoded in interfaces, as gob.Register does. Registering another type
+// under a name in use panics.
+func Register(value interface{}) {
+	t := reflect.TypeOf(value)
+	name := t.String()
+	registry.Lock()
+	defer registry.Unlock()
+	if other, ok := registry.types[name]; ok && other != t {
+		panic(fmt.Sprintf("msgpack: registering %s under the name of %s", t, other))
+	}
+	registry.names[t] = name
+	registry.types[name] = t
+}
+
+func registeredName(t reflect.Type) (string, bool) {
+	registry.RLock()
+	defer registry.RUnlock()
+	name, ok := registry.names[t]
+	return name, ok
+}
+
+func registeredType(name string) (reflect.Type, bool) {
+	registry.RLock()
+	defer registry.RUnlock()
+	t, ok := registry.types[name]
+	return t, ok
+}
+
+// field is an exported field of a struct, encoded under its name.
+type field struct {
+	name  string
+	index int
+}
+
+var structFields sync.Map // reflect.Type -> []field
+
+// fieldsOf returns the fields of struct type t that are encoded.
+func fieldsOf(t reflect.Type) []field {
+	if fields, ok := structFields.Load(t); ok {
+		return fields.([]field)
+	}
+	var fields []field
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		fields = append(fields, field{name: f.Name, index: i})
+	}
+	structFields.Store(t, fields)
+	return fields
+}
+
+// fieldByName returns the index of the encoded field of t named name.
+func fieldByName(t reflect.Type, name string) (int, bool) {
+	for _, f := range fieldsOf(t) {
+		if f.name == name {
+			return f.index, true
+		}
+	}
+	return 0, false
+}
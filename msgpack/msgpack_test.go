@@ -0,0 +1,146 @@
+package msgpack
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type inner struct {
+	Name string
+	Tags map[string]int
+}
+
+type sample struct {
+	Bool    bool
+	Small   int
+	Neg     int64
+	MinNeg  int8
+	Big     uint64
+	Float   float64
+	Single  float32
+	Short   string
+	Long    string
+	Bytes   []byte
+	Hash    [4]byte
+	Pair    [2]string
+	List    []inner
+	Ptr     *inner
+	Count   *uint32
+	When    time.Time
+	Payload any
+	Nothing any
+	Empty   []string
+	Kind    kind
+	hidden  int
+}
+
+type kind string
+
+func init() {
+	Register(inner{})
+}
+
+func TestRoundTrip(t *testing.T) {
+	zero := uint32(0)
+	in := sample{
+		Bool:    true,
+		Small:   100,
+		Neg:     -1 << 40,
+		MinNeg:  -128,
+		Big:     1<<64 - 1,
+		Float:   3.25,
+		Single:  -0.5,
+		Short:   "short",
+		Long:    strings.Repeat("long ", 20000),
+		Bytes:   bytes.Repeat([]byte{7}, 300),
+		Hash:    [4]byte{1, 2, 3, 4},
+		Pair:    [2]string{"a", "b"},
+		List:    []inner{{Name: "x", Tags: map[string]int{"a": -1, "b": 70000}}, {}},
+		Ptr:     &inner{Name: "pointed"},
+		Count:   &zero,
+		When:    time.Date(2024, 3, 1, 12, 0, 0, 5, time.FixedZone("CET", 3600)),
+		Payload: inner{Name: "in an interface"},
+		Empty:   []string{},
+		Kind:    "named",
+		hidden:  1,
+	}
+	b, err := Marshal(in)
+	assert.Nil(t, err)
+
+	var out sample
+	assert.Nil(t, Unmarshal(b, &out))
+	// Empty slices come out nil, as with gob, and unexported fields are
+	// not sent.
+	in.Empty, in.hidden = nil, 0
+	assert.True(t, in.When.Equal(out.When))
+	in.When, out.When = time.Time{}, time.Time{}
+	assert.Equal(t, in, out)
+}
+
+func TestWireFormat(t *testing.T) {
+	b, err := Marshal(struct {
+		A int
+		B string
+		C []byte
+		D bool
+	}{A: -1, B: "hi", C: []byte{0xff}})
+	assert.Nil(t, err)
+	// A map of the fields set: D, false, is left out.
+	assert.Equal(t, []byte{0x83, 0xa1, 'A', 0xff, 0xa1, 'B', 0xa2, 'h', 'i', 0xa1, 'C', 0xc4, 1, 0xff}, b)
+
+	b, err = Marshal([]uint16{1, 300})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x92, 0x01, 0xcd, 0x01, 0x2c}, b)
+}
+
+func TestUnknownFieldsAreSkipped(t *testing.T) {
+	type newer struct {
+		Name  string
+		Extra map[string][]any
+		Added float64
+		Last  int
+	}
+	b, err := Marshal(newer{
+		Name:  "kept",
+		Extra: map[string][]any{"x": {inner{Name: "skipped"}, nil}},
+		Added: 1.5,
+		Last:  -3,
+	})
+	assert.Nil(t, err)
+
+	var older struct {
+		Name string
+		Last int
+	}
+	assert.Nil(t, Unmarshal(b, &older))
+	assert.Equal(t, "kept", older.Name)
+	assert.Equal(t, -3, older.Last)
+}
+
+func TestMalformedDataFails(t *testing.T) {
+	b, err := Marshal(sample{Short: "x", List: []inner{{Name: "y"}}, Payload: inner{}})
+	assert.Nil(t, err)
+	for i := 0; i < len(b); i++ {
+		var out sample
+		assert.NotNil(t, Unmarshal(b[:i], &out), "truncated at %d", i)
+	}
+	var out sample
+	assert.NotNil(t, Unmarshal(append(b, 0), &out))
+
+	// Lengths past the data are refused before anything is made.
+	var list []int
+	assert.NotNil(t, Unmarshal([]byte{0xdd, 0xff, 0xff, 0xff, 0xff}, &list))
+	var small uint8
+	assert.NotNil(t, Unmarshal([]byte{0xcd, 0x01, 0x00}, &small))
+	var unsigned uint
+	assert.NotNil(t, Unmarshal([]byte{0xff}, &unsigned))
+
+	var payload any
+	_, err = Marshal(struct{ P any }{P: struct{ X int }{}})
+	assert.NotNil(t, err)
+	assert.NotNil(t, Unmarshal([]byte{0x92, 0xa3, 'f', 'o', 'o', 0xc0}, &payload))
+}
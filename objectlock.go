@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/anthdm/foreverstore/errors"
+)
+
+// ObjectLock makes an object immutable: while the lock is active, the
+// object can be neither overwritten nor deleted, by its owner or by any
+// node holding a replica. Locks can be extended but never shortened or
+// removed before they expire.
+type ObjectLock struct {
+	// RetainUntil is when the lock expires. A nil RetainUntil locks the
+	// object indefinitely.
+	RetainUntil *time.Time `json:"retain_until,omitempty"`
+}
+
+// MessageLockObject tells the peers holding a replica of an object that it
+// was locked.
+type MessageLockObject struct {
+	ID   string
+	Key  string
+	Lock ObjectLock
+}
+
+// activeAt reports whether l still protects its object at time now. A nil
+// lock is never active.
+func (l *ObjectLock) activeAt(now time.Time) bool {
+	return l != nil && (l.RetainUntil == nil || now.Before(*l.RetainUntil))
+}
+
+// extends reports whether l protects its object at least as long as old,
+// so that replacing old by l does not weaken the object's protection.
+func (l ObjectLock) extends(old ObjectLock) bool {
+	if l.RetainUntil == nil {
+		return true
+	}
+	return old.RetainUntil != nil && !l.RetainUntil.Before(*old.RetainUntil)
+}
+
+func (l ObjectLock) String() string {
+	if l.RetainUntil == nil {
+		return "indefinitely"
+	}
+	return "until " + l.RetainUntil.UTC().Format(time.RFC3339)
+}
+
+// validateLock checks that a lock requested by a client expires in the
+// future.
+func (s *FileServer) validateLock(lock *ObjectLock) error {
+	if lock != nil && lock.RetainUntil != nil && !lock.RetainUntil.After(s.Clock.Now()) {
+		return errors.NewValidationError("retain-until time must be in the future")
+	}
+	return nil
+}
+
+// checkNotLocked returns an ObjectLockedError when the object stored under
+// key in namespace id has an active lock. Every path that replaces or
+// removes an object must go through it.
+func (s *FileServer) checkNotLocked(id, key string) error {
+	meta, err := s.store.ReadMeta(id, key)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		// Fail closed: an unreadable lock still protects the object.
+		return errors.Wrap(err, errors.StorageError, "failed to read object metadata")
+	}
+	if meta.Lock.activeAt(s.Clock.Now()) {
+		return errors.NewObjectLockedError(key).WithContext("lock", meta.Lock.String())
+	}
+	return nil
+}
+
+// LockObject locks an object stored by this node and its replicas on the
+// peers. Locking an object that is already locked only succeeds when the
+// new lock extends the current one.
+func (s *FileServer) LockObject(key string, lock ObjectLock) error {
+	if err := s.beginOp(); err != nil {
+		return err
+	}
+	defer s.ops.end()
+
+	if err := s.validateLock(&lock); err != nil {
+		return err
+	}
+	if err := s.checkWritable(); err != nil {
+		return err
+	}
+
+	unlock := s.keyLocks.lock(key)
+	defer unlock()
+
+	if !s.store.Has(s.ID, key) {
+		return errors.NewFileNotFoundError(key)
+	}
+	if err := s.fences.check(key); err != nil {
+		return err
+	}
+	if err := s.applyLock(s.ID, key, lock); err != nil {
+		return err
+	}
+	s.logger.Info("Locked %s %s", key, lock)
+
+	msg := Message{Payload: MessageLockObject{ID: s.ID, Key: hashKey(key), Lock: lock}}
+	if err := s.broadcast(&msg); err != nil {
+		s.logger.Error("Failed to broadcast lock of %s: %v", key, err)
+	}
+	return nil
+}
+
+// applyLock records lock in the metadata of the object stored under key in
+// namespace id, unless it would weaken an active lock.
+func (s *FileServer) applyLock(id, key string, lock ObjectLock) error {
+	meta, err := s.store.ReadMeta(id, key)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, errors.StorageError, "failed to read object metadata")
+	}
+	if meta.Lock.activeAt(s.Clock.Now()) && !lock.extends(*meta.Lock) {
+		return errors.NewObjectLockedError(key).
+			WithContext("lock", meta.Lock.String()).
+			WithContext("reason", "locks can only be extended")
+	}
+
+	meta.Lock = &lock
+	if err := s.store.WriteMeta(id, key, meta); err != nil {
+		return errors.Wrap(err, errors.StorageError, "failed to write object metadata")
+	}
+	return nil
+}
+
+func (s *FileServer) handleMessageLockObject(from string, msg MessageLockObject) error {
+	if !s.store.Has(msg.ID, msg.Key) {
+		s.logger.Debug("Ignoring lock from %s of missing replica %s", from, msg.Key)
+		return errors.NewFileNotFoundError(msg.Key)
+	}
+	if err := s.applyLock(msg.ID, msg.Key, msg.Lock); err != nil {
+		return err
+	}
+	s.logger.Info("Locked replica %s from peer %s %s", msg.Key, from, msg.Lock)
+	return nil
+}
+
+// lockHeader is the fixed size encoding of an object's lock, sent along
+// with objects fetched by their owner so a restored copy stays locked.
+type lockHeader struct {
+	Locked bool
+	// RetainUntil is in Unix nanoseconds; zero locks indefinitely.
+	RetainUntil int64
+}
+
+func writeObjectLock(w io.Writer, lock *ObjectLock) error {
+	var h lockHeader
+	if lock != nil {
+		h.Locked = true
+		if lock.RetainUntil != nil {
+			h.RetainUntil = lock.RetainUntil.UnixNano()
+		}
+	}
+	return binary.Write(w, binary.LittleEndian, h)
+}
+
+// readObjectLock reads a lock written by writeObjectLock; nil means the
+// object was not locked.
+func readObjectLock(r io.Reader) (*ObjectLock, error) {
+	var h lockHeader
+	if err := binary.Read(r, binary.LittleEndian, &h); err != nil {
+		return nil, err
+	}
+	if !h.Locked {
+		return nil, nil
+	}
+	var lock ObjectLock
+	if h.RetainUntil != 0 {
+		until := time.Unix(0, h.RetainUntil).UTC()
+		lock.RetainUntil = &until
+	}
+	return &lock, nil
+}
+
+// keyMutex serializes the operations on each key, so that checking an
+// object's lock and replacing the object happen atomically without
+// serializing the operations on different keys. The zero value is ready to
+// use.
+type keyMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyMutexEntry
+}
+
+type keyMutexEntry struct {
+	sync.Mutex
+	refs int
+}
+
+// lock locks key and returns the function unlocking it.
+func (m *keyMutex) lock(key string) (unlock func()) {
+	m.mu.Lock()
+	if m.locks == nil {
+		m.locks = make(map[string]*keyMutexEntry)
+	}
+	e, ok := m.locks[key]
+	if !ok {
+		e = &keyMutexEntry{}
+		m.locks[key] = e
+	}
+	e.refs++
+	m.mu.Unlock()
+
+	e.Lock()
+	return func() {
+		e.Unlock()
+		m.mu.Lock()
+		if e.refs--; e.refs == 0 {
+			delete(m.locks, key)
+		}
+		m.mu.Unlock()
+	}
+}
+
+// parseRetainUntil parses a retain-until time given as RFC 3339.
+func parseRetainUntil(v string) (*time.Time, error) {
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return nil, errors.NewInvalidInputError(fmt.Sprintf("invalid retain-until time %q, want RFC 3339", v))
+	}
+	return &t, nil
+}
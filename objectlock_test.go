@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/anthdm/foreverstore/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func retainFor(c *testCluster, d time.Duration) *ObjectLock {
+	until := c.clock.Now().Add(d)
+	return &ObjectLock{RetainUntil: &until}
+}
+
+func (c *testCluster) storeLocked(node int, key string, data []byte, lock *ObjectLock) error {
+	return c.run("store of "+key, func() error {
+		return c.nodes[node].StoreLockedObject(key, bytes.NewReader(data), nil, lock)
+	})
+}
+
+// replicaLock returns the lock recorded with node's replica of the key
+// stored by origin.
+func (c *testCluster) replicaLock(node, origin int, key string) *ObjectLock {
+	meta, _ := c.nodes[node].store.ReadMeta(c.nodes[origin].ID, hashKey(key))
+	return meta.Lock
+}
+
+func TestObjectLockRejectsOverwritesUntilItExpires(t *testing.T) {
+	c := newTestCluster(t, 2)
+	s := c.nodes[0]
+
+	lock := retainFor(c, time.Hour)
+	assert.Nil(t, c.storeLocked(0, "record", []byte("v1"), lock))
+	c.assertConverged(0, "record")
+	c.eventually("replica to be locked", func() bool {
+		return c.replicaLock(1, 0, "record") != nil
+	})
+
+	err := c.storeLocked(0, "record", []byte("v2"), nil)
+	assert.True(t, errors.IsType(err, errors.ObjectLockedError), "overwrite: %v", err)
+
+	// A lock can be extended, not shortened.
+	err = s.LockObject("record", *retainFor(c, time.Minute))
+	assert.True(t, errors.IsType(err, errors.ObjectLockedError), "shorten: %v", err)
+	extended := retainFor(c, 2*time.Hour)
+	assert.Nil(t, s.LockObject("record", *extended))
+	c.eventually("replica lock to be extended", func() bool {
+		l := c.replicaLock(1, 0, "record")
+		return l != nil && l.RetainUntil.Equal(*extended.RetainUntil)
+	})
+
+	c.clock.Advance(2 * time.Hour)
+	assert.Nil(t, c.storeLocked(0, "record", []byte("v2"), nil))
+	assert.Equal(t, []byte("v2"), c.get(0, "record"))
+}
+
+func TestLockedReplicaRejectsPeerOverwrites(t *testing.T) {
+	c := newTestCluster(t, 2)
+	origin := c.nodes[0]
+
+	c.store(0, "ledger", []byte("original"))
+	c.assertConverged(0, "ledger")
+	assert.Nil(t, origin.LockObject("ledger", ObjectLock{}))
+	c.eventually("replica to be locked", func() bool {
+		return c.replicaLock(1, 0, "ledger") != nil
+	})
+
+	replica := func() []byte {
+		_, r, err := c.nodes[1].store.Read(origin.ID, hashKey("ledger"))
+		assert.Nil(t, err)
+		defer r.(io.Closer).Close()
+		b, _ := io.ReadAll(r)
+		return b
+	}
+	before := replica()
+
+	// An origin that lost track of its lock still cannot rewrite the
+	// replicas held by its peers.
+	assert.Nil(t, origin.store.WriteMeta(origin.ID, "ledger", ObjectMeta{}))
+	c.store(0, "ledger", []byte("tampered"))
+
+	// Messages from a peer are handled in order, so once the next store
+	// has replicated the overwrite was dealt with.
+	c.store(0, "after", []byte("next"))
+	c.assertConverged(0, "after")
+	assert.Equal(t, before, replica())
+	assert.Nil(t, c.replicaLock(1, 0, "ledger").RetainUntil)
+}
+
+func TestObjectLockIsRestoredFromPeers(t *testing.T) {
+	c := newTestCluster(t, 2)
+	s := c.nodes[1]
+
+	lock := retainFor(c, time.Hour)
+	assert.Nil(t, c.storeLocked(1, "kept", []byte("locked content"), lock))
+	c.assertConverged(1, "kept")
+
+	assert.Nil(t, s.store.Delete(s.ID, "kept"))
+	assert.Equal(t, []byte("locked content"), c.get(1, "kept"))
+
+	meta, err := s.Meta("kept")
+	assert.Nil(t, err)
+	if assert.NotNil(t, meta.Lock) {
+		assert.True(t, meta.Lock.RetainUntil.Equal(*lock.RetainUntil))
+	}
+	err = c.storeLocked(1, "kept", []byte("overwrite"), nil)
+	assert.True(t, errors.IsType(err, errors.ObjectLockedError), "overwrite: %v", err)
+}
+
+func TestObjectLockRequiresFutureRetention(t *testing.T) {
+	c := newTestCluster(t, 1)
+
+	err := c.storeLocked(0, "past", []byte("data"), retainFor(c, -time.Second))
+	assert.True(t, errors.IsType(err, errors.ValidationError), "%v", err)
+	assert.True(t, errors.IsType(c.nodes[0].LockObject("missing", ObjectLock{}), errors.FileNotFoundError))
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin
+
+package main
+
+import "github.com/anthdm/foreverstore/errors"
+
+// processOpenFiles is not supported on this platform: open files are neither
+// reported nor checked against their budget.
+func processOpenFiles() (open, limit int, err error) {
+	return 0, 0, errors.NewConfigError("open files are not reported on this platform")
+}
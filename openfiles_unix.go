@@ -0,0 +1,23 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// processOpenFiles returns the number of files the process has open, and the
+// limit of the process on it.
+func processOpenFiles() (open, limit int, err error) {
+	entries, err := os.ReadDir("/dev/fd")
+	if err != nil {
+		return 0, 0, err
+	}
+	var rlimit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlimit); err != nil {
+		return 0, 0, err
+	}
+	// Reading the directory takes a file of its own.
+	return len(entries) - 1, int(rlimit.Cur), nil
+}
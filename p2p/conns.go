@@ -0,0 +1,98 @@
+package p2p
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+// ErrTransportClosed is returned by a transport used after it was closed.
+var ErrTransportClosed = errors.New("p2p: transport closed")
+
+// connSet keeps the connections a transport serves, so that closing the
+// transport tears them down and tells consumers that no more messages will
+// follow.
+type connSet struct {
+	rpcch chan RPC
+	// quit is closed when the transport closes, releasing the read loops
+	// waiting on a stream or on a full rpcch.
+	quit chan struct{}
+
+	mu     sync.Mutex
+	closed bool
+	conns  map[net.Conn]struct{}
+	wg     sync.WaitGroup
+}
+
+func newConnSet() *connSet {
+	return &connSet{
+		rpcch: make(chan RPC, 1024),
+		quit:  make(chan struct{}),
+		conns: make(map[net.Conn]struct{}),
+	}
+}
+
+// serve runs fn on a goroutine of its own, keeping conn until fn returns.
+// A conn may be nil for goroutines that serve no connection. Once the set
+// is closed, conn is closed instead and serve returns false.
+func (s *connSet) serve(conn net.Conn, fn func()) bool {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		if conn != nil {
+			conn.Close()
+		}
+		return false
+	}
+	if conn != nil {
+		s.conns[conn] = struct{}{}
+	}
+	s.wg.Add(1)
+	s.mu.Unlock()
+
+	go func() {
+		defer s.wg.Done()
+		defer s.forget(conn)
+		fn()
+	}()
+	return true
+}
+
+func (s *connSet) forget(conn net.Conn) {
+	if conn == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, conn)
+}
+
+// deliver hands rpc to the consumer of the transport. It returns false
+// when the transport closed first.
+func (s *connSet) deliver(rpc RPC) bool {
+	select {
+	case s.rpcch <- rpc:
+		return true
+	case <-s.quit:
+		return false
+	}
+}
+
+// close closes every connection, waits for the goroutines serving them to
+// return and closes rpcch. Calls after the first return at once.
+func (s *connSet) close() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	close(s.quit)
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	close(s.rpcch)
+}
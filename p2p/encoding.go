@@ -1,7 +1,9 @@
 package p2p
 
 import (
+	"encoding/binary"
 	"encoding/gob"
+	"fmt"
 	"io"
 )
 
@@ -15,29 +17,91 @@ func (dec GOBDecoder) Decode(r io.Reader, msg *RPC) error {
 	return gob.NewDecoder(r).Decode(msg)
 }
 
-type DefaultDecoder struct{}
+// DefaultMaxMessageSize is the largest message payload DefaultDecoder
+// accepts unless configured otherwise.
+const DefaultMaxMessageSize = 1 << 20
+
+// DefaultDecoder reads the framing produced by EncodeMessage: a type byte,
+// followed for messages by the payload length (4 bytes, big endian) and the
+// payload. An IncomingStream byte followed by the number of the stream (4
+// bytes, big endian) announces a stream; IncomingCredit frames, with the
+// number of a stream and the credit granted to it, and IncomingResend
+// frames, with the number of a stream and the frame to send it again from,
+// may come in between.
+type DefaultDecoder struct {
+	// MaxMessageSize limits the payload length a peer may announce.
+	// Defaults to DefaultMaxMessageSize.
+	MaxMessageSize int
+}
 
 func (dec DefaultDecoder) Decode(r io.Reader, msg *RPC) error {
 	peekBuf := make([]byte, 1)
-	if _, err := r.Read(peekBuf); err != nil {
-		return nil
+	if _, err := io.ReadFull(r, peekBuf); err != nil {
+		return err
 	}
 
 	// In case of a stream we are not decoding what is being sent over the network.
 	// We are just setting Stream true so we can handle that in our logic.
-	stream := peekBuf[0] == IncomingStream
-	if stream {
+	switch peekBuf[0] {
+	case IncomingStream:
 		msg.Stream = true
-		return nil
+		return binary.Read(r, binary.BigEndian, &msg.StreamID)
+	case IncomingCredit:
+		if err := binary.Read(r, binary.BigEndian, &msg.StreamID); err != nil {
+			return err
+		}
+		return binary.Read(r, binary.BigEndian, &msg.Credit)
+	case IncomingResend:
+		msg.Resend = true
+		if err := binary.Read(r, binary.BigEndian, &msg.StreamID); err != nil {
+			return err
+		}
+		return binary.Read(r, binary.BigEndian, &msg.Frame)
+	case IncomingMessage:
+	case IncomingMsgpackMessage:
+		msg.Msgpack = true
+	default:
+		return fmt.Errorf("p2p: invalid frame type 0x%x", peekBuf[0])
 	}
 
-	buf := make([]byte, 1028)
-	n, err := r.Read(buf)
-	if err != nil {
+	var length uint32
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
 		return err
 	}
 
-	msg.Payload = buf[:n]
+	max := dec.MaxMessageSize
+	if max <= 0 {
+		max = DefaultMaxMessageSize
+	}
+	if int64(length) > int64(max) {
+		return fmt.Errorf("p2p: message of %d bytes exceeds limit of %d", length, max)
+	}
+
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return err
+	}
+
+	msg.Payload = buf
 
 	return nil
 }
+
+// EncodeMessage frames payload as a message for DefaultDecoder.
+func EncodeMessage(payload []byte) []byte {
+	return encodeMessage(IncomingMessage, payload)
+}
+
+// EncodeMsgpackMessage frames payload, msgpack encoded, as a message for
+// DefaultDecoder.
+func EncodeMsgpackMessage(payload []byte) []byte {
+	return encodeMessage(IncomingMsgpackMessage, payload)
+}
+
+func encodeMessage(kind byte, payload []byte) []byte {
+	b := make([]byte, 5+len(payload))
+	b[0] = kind
+	binary.BigEndian.PutUint32(b[1:], uint32(len(payload)))
+	copy(b[5:], payload)
+	return b
+}
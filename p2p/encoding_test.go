@@ -0,0 +1,112 @@
+package p2p
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefaultDecoderFraming(t *testing.T) {
+	buf := new(bytes.Buffer)
+	buf.Write(EncodeMessage([]byte("first")))
+	buf.Write([]byte{IncomingStream, 0, 0, 0, 7})
+	buf.Write([]byte{IncomingCredit, 0, 0, 0, 3, 0, 0, 1, 0})
+	buf.Write([]byte{IncomingResend, 0, 0, 0, 3, 0, 0, 0, 5})
+	buf.Write(EncodeMessage(nil))
+	buf.Write(EncodeMsgpackMessage([]byte("packed")))
+
+	var dec DefaultDecoder
+	rpc := RPC{}
+	assert.Nil(t, dec.Decode(buf, &rpc))
+	assert.Equal(t, "first", string(rpc.Payload))
+	assert.False(t, rpc.Msgpack)
+
+	rpc = RPC{}
+	assert.Nil(t, dec.Decode(buf, &rpc))
+	assert.True(t, rpc.Stream)
+	assert.Equal(t, uint32(7), rpc.StreamID)
+
+	rpc = RPC{}
+	assert.Nil(t, dec.Decode(buf, &rpc))
+	assert.Equal(t, uint32(3), rpc.StreamID)
+	assert.Equal(t, uint32(256), rpc.Credit)
+
+	rpc = RPC{}
+	assert.Nil(t, dec.Decode(buf, &rpc))
+	assert.True(t, rpc.Resend)
+	assert.Equal(t, uint32(3), rpc.StreamID)
+	assert.Equal(t, uint32(5), rpc.Frame)
+
+	rpc = RPC{}
+	assert.Nil(t, dec.Decode(buf, &rpc))
+	assert.Empty(t, rpc.Payload)
+
+	rpc = RPC{}
+	assert.Nil(t, dec.Decode(buf, &rpc))
+	assert.True(t, rpc.Msgpack)
+	assert.Equal(t, "packed", string(rpc.Payload))
+
+	assert.Equal(t, io.EOF, dec.Decode(buf, &RPC{}))
+}
+
+func TestDefaultDecoderRejectsMalformedFrames(t *testing.T) {
+	dec := DefaultDecoder{MaxMessageSize: 16}
+
+	assert.NotNil(t, dec.Decode(bytes.NewReader([]byte{0x7f}), &RPC{}))
+	assert.NotNil(t, dec.Decode(bytes.NewReader(EncodeMessage(make([]byte, 17))), &RPC{}))
+
+	truncated := EncodeMessage([]byte("truncated"))
+	assert.Equal(t, io.ErrUnexpectedEOF, dec.Decode(bytes.NewReader(truncated[:8]), &RPC{}))
+}
+
+func FuzzDefaultDecoder(f *testing.F) {
+	f.Add(EncodeMessage([]byte("hello")))
+	f.Add([]byte{IncomingStream, 0, 0, 0, 1})
+	f.Add([]byte{IncomingCredit, 0, 0, 0, 1, 0, 0, 0, 1})
+	f.Add([]byte{IncomingResend, 0, 0, 0, 1, 0, 0, 0, 2})
+	f.Add([]byte{IncomingMessage, 0xff, 0xff, 0xff, 0xff})
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		dec := DefaultDecoder{MaxMessageSize: 1 << 16}
+		r := bytes.NewReader(data)
+		for {
+			before := r.Len()
+			rpc := RPC{}
+			if err := dec.Decode(r, &rpc); err != nil {
+				return
+			}
+			if r.Len() >= before {
+				t.Fatalf("decoder made no progress on %x", data)
+			}
+			if len(rpc.Payload) > dec.MaxMessageSize {
+				t.Fatalf("payload of %d bytes exceeds limit", len(rpc.Payload))
+			}
+		}
+	})
+}
+
+func FuzzEncodeMessage(f *testing.F) {
+	f.Add([]byte("hello"))
+	f.Add([]byte{})
+	f.Add([]byte{IncomingStream, IncomingMessage})
+
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		frame := EncodeMessage(payload)
+		if got := binary.BigEndian.Uint32(frame[1:]); int(got) != len(payload) {
+			t.Fatalf("frame announces %d bytes for a %d byte payload", got, len(payload))
+		}
+
+		rpc := RPC{}
+		r := bytes.NewReader(frame)
+		if err := (DefaultDecoder{}).Decode(r, &rpc); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(rpc.Payload, payload) || r.Len() != 0 {
+			t.Fatalf("round trip mismatch for %x", payload)
+		}
+	})
+}
@@ -0,0 +1,318 @@
+package p2p
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/anthdm/foreverstore/clock"
+)
+
+// ErrInjectedFault is returned by writes that a FaultTransport failed on
+// purpose.
+var ErrInjectedFault = errors.New("p2p: injected fault")
+
+// FaultConfig describes the failures a FaultTransport injects. Rates are
+// probabilities between 0 and 1; the zero value injects nothing.
+type FaultConfig struct {
+	// Latency is added to every write and every delivered message, plus a
+	// random amount up to Jitter.
+	Latency time.Duration
+	Jitter  time.Duration
+	// DropRate is the chance that a write closes the connection instead of
+	// being sent, and that an incoming message is discarded.
+	DropRate float64
+	// TruncateRate is the chance that a write only sends part of its data
+	// before the connection is closed, and that an incoming message is
+	// delivered with a truncated payload.
+	TruncateRate float64
+	// ReorderRate is the chance that an incoming message is held back and
+	// delivered after the one following it.
+	ReorderRate float64
+}
+
+// FaultStep is one step of a failure scenario: After the previous step,
+// Faults replaces the active configuration.
+type FaultStep struct {
+	After  time.Duration
+	Faults FaultConfig
+}
+
+// FaultTransport wraps a Transport and injects latency, truncation,
+// connection drops and reordering, so replication and retry behavior can be
+// tested under realistic network failures. Incoming messages are affected
+// through Consume, outgoing data through the peers passed to the handler
+// returned by OnPeer.
+type FaultTransport struct {
+	Transport
+	// Clock times latency and scripted steps. It defaults to the wall
+	// clock; set it before the transport is used.
+	Clock clock.Clock
+
+	mu     sync.Mutex
+	faults FaultConfig
+	rng    *rand.Rand
+	peers  map[*faultPeer]struct{}
+	// wrapped maps the peers of the wrapped transport to their faultPeer,
+	// until reported lost.
+	wrapped map[Peer]*faultPeer
+
+	once      sync.Once
+	closeOnce sync.Once
+	rpcch     chan RPC
+	quit      chan struct{}
+	// delivered is closed, along with rpcch, when deliver returns.
+	delivered chan struct{}
+}
+
+// NewFaultTransport wraps t. The seed makes the injected faults
+// reproducible.
+func NewFaultTransport(t Transport, faults FaultConfig, seed int64) *FaultTransport {
+	return &FaultTransport{
+		Transport: t,
+		Clock:     clock.Real(),
+		faults:    faults,
+		rng:       rand.New(rand.NewSource(seed)),
+		peers:     make(map[*faultPeer]struct{}),
+		wrapped:   make(map[Peer]*faultPeer),
+		rpcch:     make(chan RPC, 1024),
+		quit:      make(chan struct{}),
+		delivered: make(chan struct{}),
+	}
+}
+
+// SetFaults replaces the active fault configuration.
+func (t *FaultTransport) SetFaults(faults FaultConfig) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.faults = faults
+}
+
+// Faults returns the active fault configuration.
+func (t *FaultTransport) Faults() FaultConfig {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.faults
+}
+
+// Script applies the steps one after the other in the background. The
+// returned function stops the script; the faults of the last applied step
+// stay active.
+func (t *FaultTransport) Script(steps ...FaultStep) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		for _, step := range steps {
+			select {
+			case <-t.Clock.After(step.After):
+				t.SetFaults(step.Faults)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+// DropConnections closes every connection seen by the transport.
+func (t *FaultTransport) DropConnections() {
+	t.mu.Lock()
+	peers := make([]*faultPeer, 0, len(t.peers))
+	for p := range t.peers {
+		peers = append(peers, p)
+	}
+	t.mu.Unlock()
+
+	for _, p := range peers {
+		p.Close()
+	}
+}
+
+// OnPeer returns a peer handler that wraps each new peer so that writes to
+// it are subject to the injected faults before handing it to fn. Install
+// it as the OnPeer callback of the wrapped transport.
+func (t *FaultTransport) OnPeer(fn func(Peer) error) func(Peer) error {
+	return func(p Peer) error {
+		fp := &faultPeer{Peer: p, t: t}
+		t.mu.Lock()
+		t.peers[fp] = struct{}{}
+		t.wrapped[p] = fp
+		t.mu.Unlock()
+
+		if fn == nil {
+			return nil
+		}
+		err := fn(fp)
+		if err != nil {
+			// Refused peers are never reported lost.
+			t.mu.Lock()
+			delete(t.wrapped, p)
+			t.mu.Unlock()
+		}
+		return err
+	}
+}
+
+// OnPeerDisconnect returns a handler of lost peers that hands fn the peers
+// OnPeer wrapped. Install it as the OnPeerDisconnect callback of the wrapped
+// transport.
+func (t *FaultTransport) OnPeerDisconnect(fn func(Peer, error)) func(Peer, error) {
+	return func(p Peer, err error) {
+		var lost Peer = p
+		t.mu.Lock()
+		if fp, ok := t.wrapped[p]; ok {
+			delete(t.wrapped, p)
+			delete(t.peers, fp)
+			lost = fp
+		}
+		t.mu.Unlock()
+
+		if fn != nil {
+			fn(lost, err)
+		}
+	}
+}
+
+// Consume implements the Transport interface, delivering the messages of
+// the wrapped transport with the injected faults applied.
+func (t *FaultTransport) Consume() <-chan RPC {
+	t.once.Do(func() { go t.deliver() })
+	return t.rpcch
+}
+
+// Close implements the Transport interface. It closes the wrapped
+// transport and returns once the channel returned by Consume is closed.
+func (t *FaultTransport) Close() error {
+	t.once.Do(func() { go t.deliver() })
+	t.closeOnce.Do(func() { close(t.quit) })
+	err := t.Transport.Close()
+	<-t.delivered
+	return err
+}
+
+func (t *FaultTransport) deliver() {
+	defer close(t.delivered)
+	defer close(t.rpcch)
+
+	var held *RPC
+	for {
+		var rpc RPC
+		var ok bool
+		select {
+		case rpc, ok = <-t.Transport.Consume():
+			if !ok {
+				return
+			}
+		case <-t.quit:
+			return
+		}
+
+		faults := t.Faults()
+		if t.roll(faults.DropRate) {
+			continue
+		}
+		if len(rpc.Payload) > 0 && t.roll(faults.TruncateRate) {
+			rpc.Payload = rpc.Payload[:t.intn(len(rpc.Payload))]
+		}
+		if held == nil && t.roll(faults.ReorderRate) {
+			held = &rpc
+			continue
+		}
+
+		t.delay(faults)
+		if !t.send(rpc) {
+			return
+		}
+		if held != nil {
+			if !t.send(*held) {
+				return
+			}
+			held = nil
+		}
+	}
+}
+
+func (t *FaultTransport) send(rpc RPC) bool {
+	select {
+	case t.rpcch <- rpc:
+		return true
+	case <-t.quit:
+		return false
+	}
+}
+
+func (t *FaultTransport) roll(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.rng.Float64() < rate
+}
+
+func (t *FaultTransport) intn(n int) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.rng.Intn(n)
+}
+
+// delay waits for the latency of faults, or until the transport closes.
+func (t *FaultTransport) delay(faults FaultConfig) {
+	d := faults.Latency
+	if faults.Jitter > 0 {
+		d += time.Duration(t.intn(int(faults.Jitter)))
+	}
+	if d > 0 {
+		select {
+		case <-t.Clock.After(d):
+		case <-t.quit:
+		}
+	}
+}
+
+// faultPeer injects the transport's faults into writes to a peer.
+type faultPeer struct {
+	Peer
+	t *FaultTransport
+}
+
+func (p *faultPeer) Write(b []byte) (int, error) {
+	return p.inject(b, p.Peer.Write)
+}
+
+func (p *faultPeer) Send(b []byte) error {
+	_, err := p.inject(b, func(b []byte) (int, error) {
+		if err := p.Peer.Send(b); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	})
+	return err
+}
+
+// inject writes b with write, subject to the injected faults.
+func (p *faultPeer) inject(b []byte, write func([]byte) (int, error)) (int, error) {
+	faults := p.t.Faults()
+	p.t.delay(faults)
+
+	if p.t.roll(faults.DropRate) {
+		p.Close()
+		return 0, ErrInjectedFault
+	}
+	if len(b) > 1 && p.t.roll(faults.TruncateRate) {
+		n, _ := write(b[:p.t.intn(len(b))])
+		p.Close()
+		return n, io.ErrShortWrite
+	}
+	return write(b)
+}
+
+func (p *faultPeer) Close() error {
+	p.t.mu.Lock()
+	delete(p.t.peers, p)
+	p.t.mu.Unlock()
+	return p.Peer.Close()
+}
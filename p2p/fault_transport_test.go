@@ -0,0 +1,155 @@
+package p2p
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/anthdm/foreverstore/clock"
+	"github.com/stretchr/testify/assert"
+)
+
+// chanTransport is a Transport whose messages are pushed by the test.
+type chanTransport struct {
+	rpcch chan RPC
+}
+
+func newChanTransport() *chanTransport {
+	return &chanTransport{rpcch: make(chan RPC, 16)}
+}
+
+func (t *chanTransport) Addr() string           { return "chan" }
+func (t *chanTransport) Dial(string) error      { return nil }
+func (t *chanTransport) ListenAndAccept() error { return nil }
+func (t *chanTransport) Consume() <-chan RPC    { return t.rpcch }
+func (t *chanTransport) Close() error           { return nil }
+
+func receive(t *testing.T, ch <-chan RPC) RPC {
+	select {
+	case rpc := <-ch:
+		return rpc
+	case <-time.After(time.Second):
+		t.Fatal("no message delivered")
+		return RPC{}
+	}
+}
+
+func TestFaultTransportPassesMessagesThrough(t *testing.T) {
+	inner := newChanTransport()
+	ft := NewFaultTransport(inner, FaultConfig{}, 1)
+	defer ft.Close()
+
+	inner.rpcch <- RPC{From: "a", Payload: []byte("hello")}
+	assert.Equal(t, "hello", string(receive(t, ft.Consume()).Payload))
+}
+
+func TestFaultTransportDropsAndTruncates(t *testing.T) {
+	inner := newChanTransport()
+	ft := NewFaultTransport(inner, FaultConfig{DropRate: 1}, 1)
+	defer ft.Close()
+
+	inner.rpcch <- RPC{Payload: []byte("dropped")}
+	select {
+	case <-ft.Consume():
+		t.Fatal("message should have been dropped")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	ft.SetFaults(FaultConfig{TruncateRate: 1})
+	inner.rpcch <- RPC{Payload: []byte("truncated")}
+	assert.Less(t, len(receive(t, ft.Consume()).Payload), len("truncated"))
+}
+
+func TestFaultTransportReorders(t *testing.T) {
+	inner := newChanTransport()
+	ft := NewFaultTransport(inner, FaultConfig{ReorderRate: 1}, 1)
+	defer ft.Close()
+
+	inner.rpcch <- RPC{Payload: []byte("first")}
+	inner.rpcch <- RPC{Payload: []byte("second")}
+	assert.Equal(t, "second", string(receive(t, ft.Consume()).Payload))
+	assert.Equal(t, "first", string(receive(t, ft.Consume()).Payload))
+}
+
+func TestFaultTransportLatency(t *testing.T) {
+	inner := newChanTransport()
+	ft := NewFaultTransport(inner, FaultConfig{Latency: 50 * time.Millisecond}, 1)
+	fake := clock.NewFake(time.Unix(0, 0))
+	ft.Clock = fake
+	defer ft.Close()
+
+	inner.rpcch <- RPC{Payload: []byte("slow")}
+	rpcch := ft.Consume()
+	fake.BlockUntil(1)
+	select {
+	case <-rpcch:
+		t.Fatal("message delivered before its latency passed")
+	default:
+	}
+
+	fake.Advance(50 * time.Millisecond)
+	receive(t, rpcch)
+}
+
+func TestFaultPeerWrites(t *testing.T) {
+	ft := NewFaultTransport(newChanTransport(), FaultConfig{}, 1)
+
+	var peer Peer
+	onPeer := ft.OnPeer(func(p Peer) error {
+		peer = p
+		return nil
+	})
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+	assert.Nil(t, onPeer(NewTCPPeer(local, true)))
+
+	go peer.Send([]byte("ok"))
+	buf := make([]byte, 2)
+	_, err := io.ReadFull(remote, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "ok", string(buf))
+
+	// A dropped write closes the connection.
+	ft.SetFaults(FaultConfig{DropRate: 1})
+	_, err = peer.Write([]byte("lost"))
+	assert.Equal(t, ErrInjectedFault, err)
+	_, err = remote.Read(buf)
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestFaultTransportScript(t *testing.T) {
+	ft := NewFaultTransport(newChanTransport(), FaultConfig{}, 1)
+	fake := clock.NewFake(time.Unix(0, 0))
+	ft.Clock = fake
+
+	stop := ft.Script(
+		FaultStep{After: 10 * time.Millisecond, Faults: FaultConfig{DropRate: 1}},
+		FaultStep{After: 10 * time.Millisecond, Faults: FaultConfig{Latency: time.Millisecond}},
+	)
+	defer stop()
+
+	fake.BlockUntil(1)
+	fake.Advance(10 * time.Millisecond)
+	// The script waits for the next step only once this one is applied.
+	fake.BlockUntil(1)
+	assert.Equal(t, 1.0, ft.Faults().DropRate)
+
+	fake.Advance(10 * time.Millisecond)
+	assert.Eventually(t, func() bool {
+		return ft.Faults().Latency == time.Millisecond
+	}, time.Second, time.Millisecond)
+}
+
+func TestFaultTransportDropConnections(t *testing.T) {
+	ft := NewFaultTransport(newChanTransport(), FaultConfig{}, 1)
+	onPeer := ft.OnPeer(nil)
+
+	local, remote := net.Pipe()
+	assert.Nil(t, onPeer(NewTCPPeer(local, false)))
+
+	ft.DropConnections()
+	_, err := remote.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
@@ -1,6 +1,305 @@
 package p2p
 
-// HandshakeFunc... ?
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/anthdm/foreverstore/errors"
+)
+
+// HandshakeFunc is run on each new connection before the peer is handed to
+// OnPeer. An error drops the connection.
 type HandshakeFunc func(Peer) error
 
+// NOPHandshakeFunc accepts every peer without a word.
 func NOPHandshakeFunc(Peer) error { return nil }
+
+// ProtocolVersion is the newest version of the peer protocol a node
+// speaks, and MinProtocolVersion the oldest. KeyHandshakeFunc settles on
+// the newest version both ends of a connection speak, and refuses peers
+// with none in common. A change of the wire format comes with a new
+// version, spoken only once the peer speaks it too:
+//
+//  1. messages are gob encoded, in IncomingMessage frames;
+//  2. messages are msgpack encoded, in IncomingMsgpackMessage frames.
+const (
+	ProtocolVersion    uint32 = 2
+	MinProtocolVersion uint32 = 1
+)
+
+// DefaultHandshakeTimeout bounds the handshake of KeyHandshakeFunc unless
+// configured otherwise.
+const DefaultHandshakeTimeout = 10 * time.Second
+
+// maxHandshakeFrame bounds what a peer may send during the handshake,
+// before it is known.
+const maxHandshakeFrame = 4 << 10
+
+// HandshakeOpts configure KeyHandshakeFunc.
+type HandshakeOpts struct {
+	// ID is the node ID sent to peers, and Key the identity key the node
+	// proves it holds.
+	ID  string
+	Key ed25519.PrivateKey
+	// Secret, when set, is a secret shared by the nodes of the cluster:
+	// peers have to prove they know it too.
+	Secret []byte
+	// Authorize decides whether a peer that proved it holds key may
+	// connect. Nil lets in any peer that proved its key.
+	Authorize func(p Peer, id string, key ed25519.PublicKey) error
+	// Timeout bounds the whole handshake. Defaults to
+	// DefaultHandshakeTimeout.
+	Timeout time.Duration
+	// MinVersion and MaxVersion narrow the protocol versions offered to
+	// peers, MinProtocolVersion and ProtocolVersion when zero. Holding
+	// MaxVersion back while a cluster is upgraded keeps the upgraded
+	// nodes speaking the old version until every node speaks the new.
+	MinVersion uint32
+	MaxVersion uint32
+}
+
+// hello opens the handshake: who a node is, the protocol versions it
+// speaks, from MinVersion up to Version, and the nonce the other end is to
+// sign.
+type hello struct {
+	Version    uint32
+	MinVersion uint32
+	ID         string
+	Key        []byte
+	Nonce      []byte
+}
+
+// proof answers the nonce of the other end, signed with the identity key
+// and, with a shared secret, authenticated with it too.
+type proof struct {
+	Signature []byte
+	MAC       []byte
+}
+
+// KeyHandshakeFunc returns a handshake by which both ends of a connection
+// prove they hold the identity key they claim, and know the shared secret
+// when there is one, before a single message is exchanged:
+//
+//	dialer   -> hello
+//	acceptor -> hello, proof of the dialer's nonce
+//	dialer   -> proof of the acceptor's nonce
+//
+// Each proof covers both hellos and which end made it, so it can neither
+// be replayed on another connection nor reflected back, nor the versions
+// offered be tampered with to force an older one. Peers without a protocol
+// version in common, failing a proof or refused by Authorize are dropped.
+// The dialer is done first: it learns that the acceptor refused it as the
+// connection drops.
+func KeyHandshakeFunc(opts HandshakeOpts) HandshakeFunc {
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultHandshakeTimeout
+	}
+	if opts.MinVersion == 0 {
+		opts.MinVersion = MinProtocolVersion
+	}
+	if opts.MaxVersion == 0 {
+		opts.MaxVersion = ProtocolVersion
+	}
+	return func(p Peer) error {
+		conn := handshakeConn(p)
+		conn.SetDeadline(time.Now().Add(opts.Timeout))
+		defer conn.SetDeadline(time.Time{})
+
+		nonce := make([]byte, 32)
+		if _, err := rand.Read(nonce); err != nil {
+			return err
+		}
+		local := hello{
+			Version:    opts.MaxVersion,
+			MinVersion: opts.MinVersion,
+			ID:         opts.ID,
+			Key:        opts.Key.Public().(ed25519.PublicKey),
+			Nonce:      nonce,
+		}
+		var remote hello
+		var remoteProof proof
+
+		if p.Outbound() {
+			if err := writeHandshakeFrame(conn, &local); err != nil {
+				return err
+			}
+			if err := readHandshakeFrame(conn, &remote); err != nil {
+				return err
+			}
+			version, err := negotiate(&local, &remote)
+			if err != nil {
+				return err
+			}
+			if err := readHandshakeFrame(conn, &remoteProof); err != nil {
+				return err
+			}
+			if err := opts.verify(&remoteProof, false, &remote, &local); err != nil {
+				return err
+			}
+			if err := opts.authorize(p, &remote); err != nil {
+				return err
+			}
+			if err := writeHandshakeFrame(conn, opts.prove(true, &local, &remote)); err != nil {
+				return err
+			}
+			setProtocolVersion(p, version)
+			return nil
+		}
+
+		if err := readHandshakeFrame(conn, &remote); err != nil {
+			return err
+		}
+		// The hello goes out whatever the versions of the peer, so that it
+		// can tell what this end speaks.
+		version, err := negotiate(&local, &remote)
+		if err := writeHandshakeFrame(conn, &local); err != nil {
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		if err := writeHandshakeFrame(conn, opts.prove(false, &local, &remote)); err != nil {
+			return err
+		}
+		if err := readHandshakeFrame(conn, &remoteProof); err != nil {
+			return err
+		}
+		if err := opts.verify(&remoteProof, true, &remote, &local); err != nil {
+			return err
+		}
+		if err := opts.authorize(p, &remote); err != nil {
+			return err
+		}
+		setProtocolVersion(p, version)
+		return nil
+	}
+}
+
+// handshakeConn returns the connection under p. What the handshake sends
+// goes straight over it, ahead of the frames of the read loop.
+func handshakeConn(p Peer) net.Conn {
+	if tp, ok := p.(*TCPPeer); ok {
+		return tp.Conn
+	}
+	return p
+}
+
+// negotiate returns the newest protocol version local and remote both
+// speak, after checking the hello of remote.
+func negotiate(local, remote *hello) (uint32, error) {
+	if len(remote.Key) != ed25519.PublicKeySize || len(remote.Nonce) != 32 {
+		return 0, errors.NewAuthenticationError("malformed handshake")
+	}
+	version, min := local.Version, local.MinVersion
+	if remote.Version < version {
+		version = remote.Version
+	}
+	if remote.MinVersion > min {
+		min = remote.MinVersion
+	}
+	if version < min {
+		return 0, errors.NewAuthenticationError(fmt.Sprintf("peer speaks protocol versions %d to %d, not %d to %d",
+			remote.MinVersion, remote.Version, local.MinVersion, local.Version))
+	}
+	return version, nil
+}
+
+// setProtocolVersion records the version agreed on with p.
+func setProtocolVersion(p Peer, version uint32) {
+	if tp, ok := p.(*TCPPeer); ok {
+		tp.version = version
+	}
+}
+
+// prove makes the proof of the end that sent signer, the dialer's when
+// dialer is set, to the end that sent other.
+func (opts *HandshakeOpts) prove(dialer bool, signer, other *hello) *proof {
+	t := transcript(dialer, signer, other)
+	pr := &proof{Signature: ed25519.Sign(opts.Key, t)}
+	if len(opts.Secret) > 0 {
+		pr.MAC = handshakeMAC(opts.Secret, t)
+	}
+	return pr
+}
+
+// verify checks the proof of the end that sent signer.
+func (opts *HandshakeOpts) verify(pr *proof, dialer bool, signer, other *hello) error {
+	t := transcript(dialer, signer, other)
+	if !ed25519.Verify(signer.Key, t, pr.Signature) {
+		return errors.NewAuthenticationError("peer failed to prove its identity key")
+	}
+	if len(opts.Secret) > 0 && !hmac.Equal(pr.MAC, handshakeMAC(opts.Secret, t)) {
+		return errors.NewAuthenticationError("peer does not know the cluster secret")
+	}
+	return nil
+}
+
+func (opts *HandshakeOpts) authorize(p Peer, remote *hello) error {
+	if opts.Authorize == nil {
+		return nil
+	}
+	return opts.Authorize(p, remote.ID, ed25519.PublicKey(remote.Key))
+}
+
+// transcript is what a proof covers: which end made it and both hellos.
+func transcript(dialer bool, signer, other *hello) []byte {
+	var b bytes.Buffer
+	b.WriteString("foreverstore handshake")
+	if dialer {
+		b.WriteString(" dialer")
+	} else {
+		b.WriteString(" acceptor")
+	}
+	for _, version := range []uint32{signer.MinVersion, signer.Version, other.MinVersion, other.Version} {
+		binary.Write(&b, binary.BigEndian, version)
+	}
+	for _, field := range [][]byte{[]byte(signer.ID), signer.Key, signer.Nonce, []byte(other.ID), other.Key, other.Nonce} {
+		binary.Write(&b, binary.BigEndian, uint32(len(field)))
+		b.Write(field)
+	}
+	return b.Bytes()
+}
+
+func handshakeMAC(secret, transcript []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(transcript)
+	return mac.Sum(nil)
+}
+
+// writeHandshakeFrame writes v gob encoded, after its length (4 bytes, big
+// endian). The frames are read whole so that nothing past them is read
+// before the read loop takes over.
+func writeHandshakeFrame(w io.Writer, v interface{}) error {
+	var body bytes.Buffer
+	if err := gob.NewEncoder(&body).Encode(v); err != nil {
+		return err
+	}
+	frame := make([]byte, 4, 4+body.Len())
+	binary.BigEndian.PutUint32(frame, uint32(body.Len()))
+	_, err := w.Write(append(frame, body.Bytes()...))
+	return err
+}
+
+func readHandshakeFrame(r io.Reader, v interface{}) error {
+	var size uint32
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return err
+	}
+	if size > maxHandshakeFrame {
+		return errors.NewAuthenticationError(fmt.Sprintf("handshake frame of %d bytes", size))
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return err
+	}
+	return gob.NewDecoder(bytes.NewReader(body)).Decode(v)
+}
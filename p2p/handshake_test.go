@@ -0,0 +1,133 @@
+package p2p
+
+import (
+	"crypto/ed25519"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// shake runs the handshakes of a dialer and an acceptor against each other
+// and returns their errors.
+func shake(dialer, acceptor HandshakeFunc) (error, error) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	accepted := make(chan error, 1)
+	go func() {
+		err := acceptor(NewTCPPeer(remote, false))
+		if err != nil {
+			remote.Close()
+		}
+		accepted <- err
+	}()
+	err := dialer(NewTCPPeer(local, true))
+	local.Close()
+	return err, <-accepted
+}
+
+func newHandshakeOpts(t *testing.T, id string) HandshakeOpts {
+	_, key, err := ed25519.GenerateKey(nil)
+	assert.Nil(t, err)
+	return HandshakeOpts{ID: id, Key: key}
+}
+
+func TestKeyHandshakeProvesIdentities(t *testing.T) {
+	a, b := newHandshakeOpts(t, "a"), newHandshakeOpts(t, "b")
+	var seen []string
+	a.Authorize = func(p Peer, id string, key ed25519.PublicKey) error {
+		assert.True(t, key.Equal(b.Key.Public()))
+		seen = append(seen, id)
+		return nil
+	}
+	b.Authorize = func(p Peer, id string, key ed25519.PublicKey) error {
+		assert.True(t, key.Equal(a.Key.Public()))
+		return nil
+	}
+	dialErr, acceptErr := shake(KeyHandshakeFunc(a), KeyHandshakeFunc(b))
+	assert.Nil(t, dialErr)
+	assert.Nil(t, acceptErr)
+	assert.Equal(t, []string{"b"}, seen)
+
+	// Peers that do not handshake at all are not let in.
+	dialErr, acceptErr = shake(NOPHandshakeFunc, KeyHandshakeFunc(b))
+	assert.Nil(t, dialErr)
+	assert.NotNil(t, acceptErr)
+}
+
+func TestKeyHandshakeRefusesPeers(t *testing.T) {
+	a, b := newHandshakeOpts(t, "a"), newHandshakeOpts(t, "b")
+
+	// Refused by the acceptor.
+	refused := b
+	refused.Authorize = func(Peer, string, ed25519.PublicKey) error { return assert.AnError }
+	_, acceptErr := shake(KeyHandshakeFunc(a), KeyHandshakeFunc(refused))
+	assert.Equal(t, assert.AnError, acceptErr)
+
+	// A peer without the cluster secret, or with another, fails on either
+	// end.
+	a.Secret, b.Secret = []byte("cluster secret"), []byte("cluster secret")
+	dialErr, acceptErr := shake(KeyHandshakeFunc(a), KeyHandshakeFunc(b))
+	assert.Nil(t, dialErr)
+	assert.Nil(t, acceptErr)
+	stranger := newHandshakeOpts(t, "stranger")
+	_, acceptErr = shake(KeyHandshakeFunc(stranger), KeyHandshakeFunc(b))
+	assert.NotNil(t, acceptErr)
+	stranger.Secret = []byte("guess")
+	_, acceptErr = shake(KeyHandshakeFunc(stranger), KeyHandshakeFunc(b))
+	assert.NotNil(t, acceptErr)
+	dialErr, _ = shake(KeyHandshakeFunc(stranger), KeyHandshakeFunc(a))
+	assert.NotNil(t, dialErr)
+	dialErr, _ = shake(KeyHandshakeFunc(a), KeyHandshakeFunc(stranger))
+	assert.NotNil(t, dialErr)
+}
+
+func TestKeyHandshakeNegotiatesTheProtocolVersion(t *testing.T) {
+	// versions handshakes between ends speaking the versions from min up
+	// to max, and returns the version each settled on.
+	versions := func(dialMin, dialMax, acceptMin, acceptMax uint32) (uint32, uint32, error) {
+		dialer, acceptor := newHandshakeOpts(t, "a"), newHandshakeOpts(t, "b")
+		dialer.MinVersion, dialer.MaxVersion = dialMin, dialMax
+		acceptor.MinVersion, acceptor.MaxVersion = acceptMin, acceptMax
+		local, remote := net.Pipe()
+		defer remote.Close()
+		inbound := NewTCPPeer(remote, false)
+		accepted := make(chan error, 1)
+		go func() { accepted <- KeyHandshakeFunc(acceptor)(inbound) }()
+		outbound := NewTCPPeer(local, true)
+		dialErr := KeyHandshakeFunc(dialer)(outbound)
+		local.Close()
+		if err := <-accepted; err != nil {
+			return 0, 0, err
+		}
+		return outbound.ProtocolVersion(), inbound.ProtocolVersion(), dialErr
+	}
+
+	dialed, accepted, err := versions(0, 0, 0, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, ProtocolVersion, dialed)
+	assert.Equal(t, ProtocolVersion, accepted)
+
+	// The newest version both speak is settled on, whichever end is
+	// ahead.
+	dialed, accepted, err = versions(1, 3, 2, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(2), dialed)
+	assert.Equal(t, uint32(2), accepted)
+	dialed, accepted, err = versions(1, 1, 1, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(1), dialed)
+	assert.Equal(t, uint32(1), accepted)
+
+	// Without a version in common, both ends refuse.
+	_, _, err = versions(3, 4, 1, 2)
+	assert.NotNil(t, err)
+	dialer, acceptor := &hello{Version: 4, MinVersion: 3}, &hello{Version: 2, MinVersion: 1, Key: make([]byte, ed25519.PublicKeySize), Nonce: make([]byte, 32)}
+	_, err = negotiate(dialer, acceptor)
+	assert.NotNil(t, err)
+
+	acceptor.Nonce = nil
+	_, err = negotiate(&hello{Version: 1, MinVersion: 1}, acceptor)
+	assert.NotNil(t, err)
+}
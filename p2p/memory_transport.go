@@ -0,0 +1,228 @@
+package p2p
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/anthdm/foreverstore/errors"
+)
+
+// MemoryNetwork connects MemoryTransports in the same process. It can be
+// split into partitions: data written across a partition boundary is
+// silently discarded, like packets lost in a real network, until the
+// partition heals.
+type MemoryNetwork struct {
+	mu         sync.Mutex
+	transports map[string]*MemoryTransport
+	// groups maps addresses to their partition. Addresses without a group
+	// are in partition 0, so an unpartitioned network is fully connected.
+	groups map[string]int
+	// links holds the open connection of each pair of addresses, by its
+	// number. Both ends of a connection are known by the listen addresses
+	// of the transports, so two connections between the same pair could
+	// not be told apart: there is only ever one.
+	links    map[memoryLink]uint64
+	nextLink uint64
+}
+
+// memoryLink is a pair of addresses, in order.
+type memoryLink struct{ a, b string }
+
+func newMemoryLink(a, b string) memoryLink {
+	if b < a {
+		a, b = b, a
+	}
+	return memoryLink{a, b}
+}
+
+// unlink forgets the connection numbered id between the pair of link, once
+// either of its ends is closed.
+func (n *MemoryNetwork) unlink(link memoryLink, id uint64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.links[link] == id {
+		delete(n.links, link)
+	}
+}
+
+// NewMemoryNetwork creates an empty, fully connected network.
+func NewMemoryNetwork() *MemoryNetwork {
+	return &MemoryNetwork{
+		transports: make(map[string]*MemoryTransport),
+		groups:     make(map[string]int),
+		links:      make(map[memoryLink]uint64),
+	}
+}
+
+// Partition splits the network into the given groups of addresses. Nodes
+// can only reach nodes in their own group; nodes not listed form one more
+// group together.
+func (n *MemoryNetwork) Partition(groups ...[]string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.groups = make(map[string]int)
+	for i, group := range groups {
+		for _, addr := range group {
+			n.groups[addr] = i + 1
+		}
+	}
+}
+
+// Heal removes all partitions.
+func (n *MemoryNetwork) Heal() {
+	n.Partition()
+}
+
+// Reachable reports whether from can currently reach to.
+func (n *MemoryNetwork) Reachable(from, to string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.groups[from] == n.groups[to]
+}
+
+// MemoryTransportOpts configures a MemoryTransport.
+type MemoryTransportOpts struct {
+	ListenAddr    string
+	HandshakeFunc HandshakeFunc
+	Decoder       Decoder
+	OnPeer        func(Peer) error
+	// OnPeerDisconnect is called as for a TCPTransport.
+	OnPeerDisconnect func(Peer, error)
+}
+
+// MemoryTransport is a Transport over in-process pipes, for tests that run
+// whole clusters without opening sockets.
+type MemoryTransport struct {
+	MemoryTransportOpts
+	network *MemoryNetwork
+	conns   *connSet
+}
+
+// NewTransport creates a transport on the network. It can be dialed once
+// ListenAndAccept has been called.
+func (n *MemoryNetwork) NewTransport(opts MemoryTransportOpts) *MemoryTransport {
+	if opts.HandshakeFunc == nil {
+		opts.HandshakeFunc = NOPHandshakeFunc
+	}
+	if opts.Decoder == nil {
+		opts.Decoder = DefaultDecoder{}
+	}
+	return &MemoryTransport{
+		MemoryTransportOpts: opts,
+		network:             n,
+		conns:               newConnSet(),
+	}
+}
+
+// Addr implements the Transport interface.
+func (t *MemoryTransport) Addr() string {
+	return t.ListenAddr
+}
+
+// Consume implements the Transport interface.
+func (t *MemoryTransport) Consume() <-chan RPC {
+	return t.conns.rpcch
+}
+
+// ListenAndAccept implements the Transport interface.
+func (t *MemoryTransport) ListenAndAccept() error {
+	t.network.mu.Lock()
+	defer t.network.mu.Unlock()
+
+	if _, ok := t.network.transports[t.ListenAddr]; ok {
+		return fmt.Errorf("memory transport: address %s already in use", t.ListenAddr)
+	}
+	t.network.transports[t.ListenAddr] = t
+	return nil
+}
+
+// Close implements the Transport interface. It leaves the network, closes
+// the established connections and returns once their read loops have
+// stopped.
+func (t *MemoryTransport) Close() error {
+	t.network.mu.Lock()
+	if t.network.transports[t.ListenAddr] == t {
+		delete(t.network.transports, t.ListenAddr)
+	}
+	t.network.mu.Unlock()
+
+	t.conns.close()
+	return nil
+}
+
+// Dial implements the Transport interface. Dialing fails if the address is
+// not listening or is on the other side of a partition; both are reported
+// as retryable connection errors. Dialing an address connected already,
+// whichever end dialed, does nothing.
+func (t *MemoryTransport) Dial(addr string) error {
+	n := t.network
+	link := newMemoryLink(t.ListenAddr, addr)
+	n.mu.Lock()
+	remote, ok := n.transports[addr]
+	reachable := n.groups[t.ListenAddr] == n.groups[addr]
+	_, linked := n.links[link]
+	if ok && reachable && !linked {
+		n.nextLink++
+		n.links[link] = n.nextLink
+	}
+	id := n.links[link]
+	n.mu.Unlock()
+
+	if !ok {
+		return errors.NewConnectionError(fmt.Sprintf("memory transport: connection refused: %s", addr))
+	}
+	if !reachable {
+		return errors.NewConnectionError(fmt.Sprintf("memory transport: %s unreachable", addr))
+	}
+	if linked {
+		return nil
+	}
+
+	local, accepted := net.Pipe()
+	outbound := &memoryConn{Conn: local, network: n, link: link, id: id, local: t.ListenAddr, remote: addr}
+	inbound := &memoryConn{Conn: accepted, network: n, link: link, id: id, local: addr, remote: t.ListenAddr}
+	if !t.conns.serve(outbound, func() { t.handleConn(outbound, true) }) {
+		inbound.Close()
+		return ErrTransportClosed
+	}
+	remote.conns.serve(inbound, func() { remote.handleConn(inbound, false) })
+
+	return nil
+}
+
+func (t *MemoryTransport) handleConn(conn net.Conn, outbound bool) {
+	servePeerConn(conn, outbound, t.HandshakeFunc, t.OnPeer, t.OnPeerDisconnect, t.Decoder, t.conns)
+}
+
+// memoryConn is one end of a pipe between two memory transports.
+type memoryConn struct {
+	net.Conn
+	network       *MemoryNetwork
+	link          memoryLink
+	id            uint64
+	local, remote string
+}
+
+// Close closes the connection, which may be dialed again.
+func (c *memoryConn) Close() error {
+	c.network.unlink(c.link, c.id)
+	return c.Conn.Close()
+}
+
+func (c *memoryConn) LocalAddr() net.Addr  { return memoryAddr(c.local) }
+func (c *memoryConn) RemoteAddr() net.Addr { return memoryAddr(c.remote) }
+
+// Write discards the data while the remote end is partitioned away.
+func (c *memoryConn) Write(b []byte) (int, error) {
+	if !c.network.Reachable(c.local, c.remote) {
+		return len(b), nil
+	}
+	return c.Conn.Write(b)
+}
+
+type memoryAddr string
+
+func (a memoryAddr) Network() string { return "memory" }
+func (a memoryAddr) String() string  { return string(a) }
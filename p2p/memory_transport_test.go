@@ -0,0 +1,152 @@
+package p2p
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newMemoryPair(t *testing.T) (*MemoryNetwork, *MemoryTransport, *MemoryTransport, chan Peer) {
+	network := NewMemoryNetwork()
+	peers := make(chan Peer, 2)
+
+	a := network.NewTransport(MemoryTransportOpts{ListenAddr: "a"})
+	b := network.NewTransport(MemoryTransportOpts{
+		ListenAddr: "b",
+		OnPeer: func(p Peer) error {
+			peers <- p
+			return nil
+		},
+	})
+	assert.Nil(t, a.ListenAndAccept())
+	assert.Nil(t, b.ListenAndAccept())
+	return network, a, b, peers
+}
+
+func TestMemoryTransportDeliversMessages(t *testing.T) {
+	_, a, b, peers := newMemoryPair(t)
+
+	outbound := make(chan Peer, 1)
+	a.OnPeer = func(p Peer) error {
+		outbound <- p
+		return nil
+	}
+	assert.Nil(t, a.Dial("b"))
+
+	inbound := <-peers
+	assert.Equal(t, "a", inbound.RemoteAddr().String())
+	assert.Nil(t, (<-outbound).Send(EncodeMessage([]byte("hi"))))
+
+	select {
+	case rpc := <-b.Consume():
+		assert.Equal(t, "a", rpc.From)
+		assert.Equal(t, "hi", string(rpc.Payload))
+	case <-time.After(time.Second):
+		t.Fatal("message not delivered")
+	}
+}
+
+func TestMemoryTransportDialErrors(t *testing.T) {
+	network, a, b, _ := newMemoryPair(t)
+
+	assert.NotNil(t, a.Dial("nowhere"))
+
+	network.Partition([]string{"a"}, []string{"b"})
+	assert.NotNil(t, a.Dial("b"))
+
+	network.Heal()
+	assert.Nil(t, a.Dial("b"))
+
+	assert.Nil(t, b.Close())
+	assert.NotNil(t, a.Dial("b"))
+}
+
+func TestMemoryTransportKeepsOneConnectionPerPair(t *testing.T) {
+	_, a, b, peers := newMemoryPair(t)
+	assert.Nil(t, a.Dial("b"))
+	inbound := <-peers
+
+	// Dialing again, from either end, reuses the connection.
+	assert.Nil(t, a.Dial("b"))
+	assert.Nil(t, b.Dial("a"))
+	select {
+	case <-peers:
+		t.Fatal("second connection opened")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Once closed, it is dialed anew.
+	assert.Nil(t, inbound.Close())
+	assert.Nil(t, a.Dial("b"))
+	select {
+	case p := <-peers:
+		assert.NotSame(t, inbound, p)
+	case <-time.After(time.Second):
+		t.Fatal("connection not dialed again")
+	}
+}
+
+func TestMemoryNetworkPartitionDiscardsWrites(t *testing.T) {
+	network, a, _, peers := newMemoryPair(t)
+	assert.Nil(t, a.Dial("b"))
+	inbound := <-peers
+
+	network.Partition([]string{"a"})
+	assert.False(t, network.Reachable("a", "b"))
+	assert.False(t, network.Reachable("b", "a"))
+
+	// Writes across the partition appear to succeed but never arrive.
+	assert.Nil(t, inbound.Send(EncodeMessage([]byte("lost"))))
+	select {
+	case <-a.Consume():
+		t.Fatal("message crossed the partition")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	network.Heal()
+	assert.True(t, network.Reachable("a", "b"))
+
+	assert.Nil(t, inbound.Send(EncodeMessage([]byte("ok"))))
+	select {
+	case rpc := <-a.Consume():
+		assert.Equal(t, "ok", string(rpc.Payload))
+	case <-time.After(time.Second):
+		t.Fatal("message not delivered after heal")
+	}
+}
+
+func TestMemoryTransportCloseTearsDownPeers(t *testing.T) {
+	_, a, _, peers := newMemoryPair(t)
+	assert.Nil(t, a.Dial("b"))
+	inbound := <-peers
+
+	// a's read loop now waits for a stream to be read; that must not hold
+	// up Close.
+	assert.Nil(t, inbound.Send([]byte{IncomingStream}))
+
+	assert.Nil(t, a.Close())
+	_, ok := <-a.Consume()
+	assert.False(t, ok, "Consume should be closed")
+	_, err := inbound.Read(make([]byte, 1))
+	assert.NotNil(t, err)
+
+	assert.Equal(t, ErrTransportClosed, a.Dial("b"))
+	assert.Nil(t, a.Close())
+}
+
+func TestMemoryTransportReportsLostPeers(t *testing.T) {
+	_, a, b, peers := newMemoryPair(t)
+	lost := make(chan Peer, 1)
+	b.OnPeerDisconnect = func(p Peer, err error) { lost <- p }
+	assert.Nil(t, a.Dial("b"))
+	inbound := <-peers
+
+	assert.Nil(t, a.Close())
+	select {
+	case p := <-lost:
+		assert.Same(t, inbound, p)
+	case <-time.After(time.Second):
+		t.Fatal("lost peer not reported")
+	}
+}
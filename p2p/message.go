@@ -3,6 +3,16 @@ package p2p
 const (
 	IncomingMessage = 0x1
 	IncomingStream  = 0x2
+	// IncomingStreamData frames the data of a stream, IncomingCredit the
+	// credit its receiver grants for more, and IncomingResend asks for its
+	// frames again from a corrupt one on.
+	IncomingStreamData = 0x3
+	IncomingCredit     = 0x4
+	IncomingResend     = 0x5
+	// IncomingMsgpackMessage frames a message as IncomingMessage does, its
+	// payload encoded with msgpack rather than gob. Only peers speaking
+	// protocol version 2 and up are sent such frames.
+	IncomingMsgpackMessage = 0x6
 )
 
 // RPC holds any arbitrary data that is being sent over the
@@ -11,4 +21,13 @@ type RPC struct {
 	From    string
 	Payload []byte
 	Stream  bool
+	// StreamID numbers the stream announced, or the one Credit is granted
+	// to, or the one to send again from frame Frame on when Resend is set:
+	// such frames carry no message.
+	StreamID uint32
+	Credit   uint32
+	Resend   bool
+	Frame    uint32
+	// Msgpack is set for the messages of IncomingMsgpackMessage frames.
+	Msgpack bool
 }
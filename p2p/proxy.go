@@ -0,0 +1,268 @@
+package p2p
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ProxyFunc returns the proxy to dial a peer at addr through, or nil to
+// dial it directly. Proxies are "socks5://" (or "socks5h://") and
+// "http://" URLs, the latter tunnelling with CONNECT, with the credentials
+// of their user info if any.
+type ProxyFunc func(addr string) (*url.URL, error)
+
+// proxyDialTimeout bounds connecting to a peer through a proxy.
+const proxyDialTimeout = 10 * time.Second
+
+// maxProxyResponse caps the response of an HTTP proxy to CONNECT.
+const maxProxyResponse = 4096
+
+// ParseProxyURL parses the URL of a proxy peers can be dialed through.
+func ParseProxyURL(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy %q: %v", s, err)
+	}
+	switch u.Scheme {
+	case "socks5", "socks5h", "http":
+	default:
+		return nil, fmt.Errorf("invalid proxy %q: unsupported scheme %q", s, u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy %q: missing host", s)
+	}
+	if u.Port() == "" {
+		port := "1080"
+		if u.Scheme == "http" {
+			port = "80"
+		}
+		u.Host = net.JoinHostPort(u.Hostname(), port)
+	}
+	return u, nil
+}
+
+// NewProxyFunc returns the ProxyFunc dialing peers through proxy, and
+// those listed in peers, by address or host, through theirs. An empty
+// proxy, or "direct", dials directly.
+func NewProxyFunc(proxy string, peers map[string]string) (ProxyFunc, error) {
+	parse := func(s string) (*url.URL, error) {
+		if s == "" || s == "direct" {
+			return nil, nil
+		}
+		return ParseProxyURL(s)
+	}
+	all, err := parse(proxy)
+	if err != nil {
+		return nil, err
+	}
+	byPeer := make(map[string]*url.URL, len(peers))
+	for peer, proxy := range peers {
+		if byPeer[strings.ToLower(peer)], err = parse(proxy); err != nil {
+			return nil, err
+		}
+	}
+
+	return func(addr string) (*url.URL, error) {
+		addr = strings.ToLower(addr)
+		if u, ok := byPeer[addr]; ok {
+			return u, nil
+		}
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			if u, ok := byPeer[host]; ok {
+				return u, nil
+			}
+		}
+		return all, nil
+	}, nil
+}
+
+// dialProxy connects to addr through the proxy at u.
+func dialProxy(u *url.URL, addr string) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", u.Host, proxyDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(proxyDialTimeout))
+	if u.Scheme == "http" {
+		err = connectHTTP(conn, u, addr)
+	} else {
+		err = connectSOCKS5(conn, u, addr)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: %v", u.Host, err)
+	}
+	conn.SetDeadline(time.Time{})
+	return &proxiedConn{Conn: conn, addr: proxiedAddr(addr)}, nil
+}
+
+// proxiedConn is a connection to a peer through a proxy. It reports the
+// address of the peer as its remote address, peers being known by it,
+// rather than that of the proxy.
+type proxiedConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+// proxiedAddr is the address of a peer dialed through a proxy.
+type proxiedAddr string
+
+func (a proxiedAddr) Network() string { return "tcp" }
+func (a proxiedAddr) String() string  { return string(a) }
+
+// connectHTTP opens a tunnel to addr with an HTTP CONNECT request.
+func connectHTTP(conn net.Conn, u *url.URL, addr string) error {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		creds := base64.StdEncoding.EncodeToString([]byte(u.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+creds)
+	}
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+
+	// The response is read a byte at a time: what follows it is the peer
+	// talking already.
+	var head []byte
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(head, []byte("\r\n\r\n")) {
+		if len(head) >= maxProxyResponse {
+			return fmt.Errorf("CONNECT %s: response too long", addr)
+		}
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return err
+		}
+		head = append(head, b[0])
+	}
+	status, _, _ := strings.Cut(string(head), "\r\n")
+	if f := strings.Fields(status); len(f) < 2 || !strings.HasPrefix(f[0], "HTTP/") || f[1] != "200" {
+		return fmt.Errorf("CONNECT %s: %s", addr, status)
+	}
+	return nil
+}
+
+const (
+	socks5Version      = 0x05
+	socks5NoAuth       = 0x00
+	socks5PasswordAuth = 0x02
+	socks5Connect      = 0x01
+	socks5IPv4         = 0x01
+	socks5Domain       = 0x03
+	socks5IPv6         = 0x04
+)
+
+// connectSOCKS5 asks a SOCKS5 proxy (RFC 1928) to connect to addr,
+// authenticating with a username and password (RFC 1929) when u has them.
+func connectSOCKS5(conn net.Conn, u *url.URL, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 65535 {
+		return fmt.Errorf("invalid port %q", portStr)
+	}
+
+	method := byte(socks5NoAuth)
+	if u.User != nil {
+		method = socks5PasswordAuth
+	}
+	if _, err := conn.Write([]byte{socks5Version, 1, method}); err != nil {
+		return err
+	}
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[0] != socks5Version || reply[1] != method {
+		return fmt.Errorf("authentication method refused")
+	}
+	if method == socks5PasswordAuth {
+		user := u.User.Username()
+		password, _ := u.User.Password()
+		if len(user) > 255 || len(password) > 255 {
+			return fmt.Errorf("credentials too long")
+		}
+		b := append([]byte{1, byte(len(user))}, user...)
+		b = append(append(b, byte(len(password))), password...)
+		if _, err := conn.Write(b); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply[:]); err != nil {
+			return err
+		}
+		if reply[1] != 0 {
+			return fmt.Errorf("authentication failed")
+		}
+	}
+
+	req := []byte{socks5Version, socks5Connect, 0}
+	ip := net.ParseIP(host)
+	if ip == nil && u.Scheme == "socks5" {
+		// socks5h leaves resolving the host to the proxy.
+		ips, err := net.LookupIP(host)
+		if err != nil {
+			return err
+		}
+		ip = ips[0]
+	}
+	switch {
+	case ip == nil:
+		if len(host) > 255 {
+			return fmt.Errorf("host name too long")
+		}
+		req = append(append(req, socks5Domain, byte(len(host))), host...)
+	case ip.To4() != nil:
+		req = append(append(req, socks5IPv4), ip.To4()...)
+	default:
+		req = append(append(req, socks5IPv6), ip.To16()...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	var head [4]byte
+	if _, err := io.ReadFull(conn, head[:]); err != nil {
+		return err
+	}
+	if head[1] != 0 {
+		return fmt.Errorf("connect to %s refused (code %d)", addr, head[1])
+	}
+	// Skip the address the proxy bound.
+	var skip int
+	switch head[3] {
+	case socks5IPv4:
+		skip = net.IPv4len
+	case socks5IPv6:
+		skip = net.IPv6len
+	case socks5Domain:
+		var n [1]byte
+		if _, err := io.ReadFull(conn, n[:]); err != nil {
+			return err
+		}
+		skip = int(n[0])
+	default:
+		return fmt.Errorf("invalid reply address type %d", head[3])
+	}
+	_, err = io.CopyN(io.Discard, conn, int64(skip+2))
+	return err
+}
@@ -0,0 +1,498 @@
+package p2p
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/anthdm/foreverstore/logger"
+)
+
+// Streams are flow controlled: the data of a stream is sent in frames, and
+// the receiver grants credit for more as it consumes them, so a sender
+// never has more than StreamWindow bytes in flight. A receiver writing to a
+// slow disk slows its sender down, and a stream to it does not fill the
+// connection for other traffic.
+//
+// Each data frame is numbered and carries a CRC32C of its data. A receiver
+// that gets a corrupt frame drops it and the frames after it, and asks for
+// them again; the sender keeps what it sent until it is granted for.
+var (
+	// StreamWindow is the credit a stream starts with. Both ends of a
+	// connection must agree on it.
+	StreamWindow = 1 << 20
+	// StreamFrameSize is the largest data frame sent, and accepted.
+	StreamFrameSize = 64 << 10
+	// StreamStallTimeout is how long a sender waits for credit before it
+	// gives up on the stream.
+	StreamStallTimeout = 30 * time.Second
+)
+
+var (
+	// ErrStreamStalled is returned by writes to a stream whose receiver has
+	// granted no credit for StreamStallTimeout.
+	ErrStreamStalled = errors.New("p2p: stream stalled waiting for credit")
+	// ErrStreamTruncated is returned by reads of a stream the sender moved
+	// on from before all of it was received.
+	ErrStreamTruncated = errors.New("p2p: stream ended early")
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// sentFrame is a data frame kept until the receiver has consumed it. end is
+// the offset in the stream of the end of its data.
+type sentFrame struct {
+	seq   uint32
+	end   int64
+	frame []byte
+}
+
+// streamFlow keeps the state of the stream a peer is sending, and of the
+// one it is receiving.
+type streamFlow struct {
+	mu sync.Mutex
+	// out numbers the streams sent. Of the current one, sent is what was
+	// sent, acked what the receiver granted for, and unacked the frames in
+	// between. creditch is signalled when credit is granted.
+	out      uint32
+	sent     int64
+	acked    int64
+	seq      uint32
+	unacked  []sentFrame
+	creditch chan struct{}
+
+	// in is the number of the stream being received, consumed what was
+	// read of it and not granted yet, and resend the frame to ask for again
+	// when resending is set. begun is signalled once the read loop has read
+	// the announcement of the stream; deferred holds the frames for the
+	// read loop that came while the stream was read.
+	in        uint32
+	consumed  int
+	resend    uint32
+	resending bool
+	begun     chan struct{}
+	deferred  []RPC
+
+	// feedbackch wakes the goroutine writing grants and resend requests,
+	// started with the first one.
+	feedback   bool
+	feedbackch chan struct{}
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newStreamFlow() *streamFlow {
+	return &streamFlow{
+		creditch:   make(chan struct{}, 1),
+		begun:      make(chan struct{}, 1),
+		feedbackch: make(chan struct{}, 1),
+		closed:     make(chan struct{}),
+	}
+}
+
+// open starts a new outgoing stream with a full window, returning its
+// number. The frames kept of the previous stream are dropped.
+func (f *streamFlow) open() uint32 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.out++
+	f.sent, f.acked, f.seq, f.unacked = 0, 0, 0, nil
+	return f.out
+}
+
+// take waits until there is credit and takes up to max bytes of it.
+func (f *streamFlow) take(max int) (int, error) {
+	var stalled <-chan time.Time
+	for {
+		f.mu.Lock()
+		if credit := StreamWindow - int(f.sent-f.acked); credit > 0 {
+			n := max
+			if n > credit {
+				n = credit
+			}
+			f.sent += int64(n)
+			f.mu.Unlock()
+			return n, nil
+		}
+		f.mu.Unlock()
+
+		if stalled == nil {
+			stalled = time.After(StreamStallTimeout)
+		}
+		select {
+		case <-f.creditch:
+		case <-f.closed:
+			return 0, ErrTransportClosed
+		case <-stalled:
+			return 0, ErrStreamStalled
+		}
+	}
+}
+
+// frame frames data as the next frame of the current stream, keeping the
+// frame until the receiver grants for it.
+func (f *streamFlow) frame(data []byte) []byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	b := make([]byte, 13+len(data))
+	b[0] = IncomingStreamData
+	binary.BigEndian.PutUint32(b[1:], f.seq)
+	binary.BigEndian.PutUint32(b[5:], uint32(len(data)))
+	binary.BigEndian.PutUint32(b[9:], crc32.Checksum(data, castagnoli))
+	copy(b[13:], data)
+
+	end := f.acked
+	if n := len(f.unacked); n > 0 {
+		end = f.unacked[n-1].end
+	}
+	f.unacked = append(f.unacked, sentFrame{seq: f.seq, end: end + int64(len(data)), frame: b})
+	f.seq++
+	return b
+}
+
+// credited adds the credit the receiver granted to stream id, dropping the
+// frames it consumed. Grants for an earlier stream are late and ignored.
+func (f *streamFlow) credited(id, n uint32) {
+	f.mu.Lock()
+	if id == f.out {
+		f.acked += int64(n)
+		i := 0
+		for i < len(f.unacked) && f.unacked[i].end <= f.acked {
+			i++
+		}
+		f.unacked = f.unacked[i:]
+	}
+	f.mu.Unlock()
+
+	select {
+	case f.creditch <- struct{}{}:
+	default:
+	}
+}
+
+// frames returns the frames of stream id from frame seq on, to send them
+// again. Requests for an earlier stream are late and get none.
+func (f *streamFlow) frames(id, seq uint32) [][]byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if id != f.out {
+		return nil
+	}
+	var frames [][]byte
+	for _, sf := range f.unacked {
+		if sf.seq >= seq {
+			frames = append(frames, sf.frame)
+		}
+	}
+	return frames
+}
+
+// begin starts receiving stream id.
+func (f *streamFlow) begin(id uint32) {
+	f.mu.Lock()
+	f.in = id
+	f.consumed = 0
+	f.resending = false
+	f.mu.Unlock()
+	select {
+	case f.begun <- struct{}{}:
+	default:
+	}
+}
+
+// end finishes receiving the current stream, whether it was read or not.
+func (f *streamFlow) end() {
+	select {
+	case <-f.begun:
+	default:
+	}
+}
+
+// consume counts n bytes read of the stream being received, and reports
+// whether enough were read to grant them.
+func (f *streamFlow) consume(n int) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.consumed += n
+	return f.consumed >= StreamWindow/4
+}
+
+// askResend asks for the frames of the stream being received from frame
+// seq on again.
+func (f *streamFlow) askResend(seq uint32) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.resend = seq
+	f.resending = true
+}
+
+// takeFeedback takes what was consumed and not granted yet of the stream
+// being received, and the frame to ask for again, if any.
+func (f *streamFlow) takeFeedback() (id uint32, n int, resend uint32, resending bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n, f.consumed = f.consumed, 0
+	resending, f.resending = f.resending, false
+	return f.in, n, f.resend, resending
+}
+
+// wake wakes the goroutine writing the feedback, and reports whether it is
+// yet to be started.
+func (f *streamFlow) wake() bool {
+	f.mu.Lock()
+	start := !f.feedback
+	f.feedback = true
+	f.mu.Unlock()
+
+	if !start {
+		select {
+		case f.feedbackch <- struct{}{}:
+		default:
+		}
+	}
+	return start
+}
+
+// deferRPC keeps rpc for the read loop, to handle once the stream is read.
+func (f *streamFlow) deferRPC(rpc RPC) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.deferred = append(f.deferred, rpc)
+}
+
+// next takes the first frame deferred while a stream was read.
+func (f *streamFlow) next() (RPC, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.deferred) == 0 {
+		return RPC{}, false
+	}
+	rpc := f.deferred[0]
+	f.deferred = f.deferred[1:]
+	return rpc, true
+}
+
+func (f *streamFlow) close() {
+	f.closeOnce.Do(func() { close(f.closed) })
+}
+
+// OpenStream announces a stream to the peer. What is written to the peer
+// next is the data of the stream, until the next message.
+func (p *TCPPeer) OpenStream() error {
+	p.smu.Lock()
+	defer p.smu.Unlock()
+
+	id := p.flow.open()
+	b := make([]byte, 5)
+	b[0] = IncomingStream
+	binary.BigEndian.PutUint32(b[1:], id)
+	return p.Send(b)
+}
+
+// Write sends b as data of the stream opened last, waiting for credit when
+// the receiver is behind.
+func (p *TCPPeer) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		max := len(b) - written
+		if max > StreamFrameSize {
+			max = StreamFrameSize
+		}
+		n, err := p.flow.take(max)
+		if err != nil {
+			return written, err
+		}
+
+		// Frames are numbered and written under smu, so frames sent again
+		// go out in order with them.
+		p.smu.Lock()
+		err = p.writeFrame(p.flow.frame(b[written : written+n]))
+		p.smu.Unlock()
+		if err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// resendFrames sends the frames of stream id from frame seq on again.
+func (p *TCPPeer) resendFrames(id, seq uint32) {
+	p.smu.Lock()
+	defer p.smu.Unlock()
+
+	frames := p.flow.frames(id, seq)
+	if len(frames) > 0 {
+		logger.Debug("[%s] resending %d frames of stream %d from frame %d", p.RemoteAddr(), len(frames), id, seq)
+	}
+	for _, frame := range frames {
+		if err := p.writeFrame(frame); err != nil {
+			return
+		}
+	}
+}
+
+// Read reads the data of the stream being received, granting the sender
+// credit for what was read. The stream is the one announced next when none
+// is being read: Read waits for the read loop to get to it.
+func (p *TCPPeer) Read(b []byte) (int, error) {
+	if !p.reading {
+		select {
+		case <-p.flow.begun:
+		case <-p.flow.closed:
+			return 0, ErrTransportClosed
+		}
+		p.reading = true
+		p.data = nil
+		p.expect = 0
+	}
+
+	for len(p.data) == 0 {
+		if err := p.readFrame(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, p.data)
+	p.data = p.data[n:]
+	if p.flow.consume(n) {
+		p.wakeFeedback()
+	}
+	return n, nil
+}
+
+// readFrame reads the next frame of the connection while a stream is read.
+// A data frame that is corrupt is asked for again, and those after it are
+// dropped until it comes. Credit and resend requests for the streams this
+// end sends are handled in passing; messages, and the next stream, are left
+// for the read loop.
+func (p *TCPPeer) readFrame() error {
+	var kind [1]byte
+	if _, err := io.ReadFull(p.Conn, kind[:]); err != nil {
+		return err
+	}
+
+	switch kind[0] {
+	case IncomingStreamData:
+		var header [12]byte
+		if _, err := io.ReadFull(p.Conn, header[:]); err != nil {
+			return err
+		}
+		seq := binary.BigEndian.Uint32(header[0:])
+		length := binary.BigEndian.Uint32(header[4:])
+		sum := binary.BigEndian.Uint32(header[8:])
+		if int64(length) > int64(StreamFrameSize) {
+			return fmt.Errorf("p2p: stream frame of %d bytes exceeds limit of %d", length, StreamFrameSize)
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(p.Conn, data); err != nil {
+			return err
+		}
+
+		switch {
+		case seq != p.expect:
+			// Sent after a corrupt frame, or again: the frames from the
+			// corrupt one on are on their way.
+		case crc32.Checksum(data, castagnoli) != sum:
+			logger.Warn("[%s] frame %d of stream failed its checksum, asking for it again", p.RemoteAddr(), seq)
+			p.flow.askResend(seq)
+			p.wakeFeedback()
+		default:
+			p.expect++
+			p.data = data
+		}
+
+	case IncomingCredit, IncomingResend:
+		var body [8]byte
+		if _, err := io.ReadFull(p.Conn, body[:]); err != nil {
+			return err
+		}
+		id, n := binary.BigEndian.Uint32(body[:4]), binary.BigEndian.Uint32(body[4:])
+		if kind[0] == IncomingCredit {
+			p.flow.credited(id, n)
+		} else {
+			go p.resendFrames(id, n)
+		}
+
+	case IncomingMessage, IncomingMsgpackMessage:
+		var length uint32
+		if err := binary.Read(p.Conn, binary.BigEndian, &length); err != nil {
+			return err
+		}
+		if int64(length) > DefaultMaxMessageSize {
+			return fmt.Errorf("p2p: message of %d bytes exceeds limit of %d", length, DefaultMaxMessageSize)
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(p.Conn, payload); err != nil {
+			return err
+		}
+		p.flow.deferRPC(RPC{Payload: payload, Msgpack: kind[0] == IncomingMsgpackMessage})
+
+	case IncomingStream:
+		var id uint32
+		if err := binary.Read(p.Conn, binary.BigEndian, &id); err != nil {
+			return err
+		}
+		p.flow.deferRPC(RPC{Stream: true, StreamID: id})
+		return ErrStreamTruncated
+
+	default:
+		return fmt.Errorf("p2p: invalid frame type 0x%x in stream", kind[0])
+	}
+	return nil
+}
+
+func (p *TCPPeer) wakeFeedback() {
+	if p.flow.wake() {
+		go p.feedbackLoop()
+	}
+}
+
+// feedbackLoop writes the credit granted for the stream being received, as
+// it is consumed, and the requests to send frames of it again, until the
+// connection closes. They are written apart from the reads, so that a
+// receiver never waits on its sender to read.
+func (p *TCPPeer) feedbackLoop() {
+	for {
+		id, n, resend, resending := p.flow.takeFeedback()
+		if resending {
+			if err := p.writeFrame(streamControlFrame(IncomingResend, id, resend)); err != nil {
+				return
+			}
+		}
+		if n > 0 {
+			if err := p.writeFrame(streamControlFrame(IncomingCredit, id, uint32(n))); err != nil {
+				return
+			}
+		}
+		select {
+		case <-p.flow.feedbackch:
+		case <-p.flow.closed:
+			return
+		}
+	}
+}
+
+// streamControlFrame frames a grant of n bytes of credit to stream id, or
+// a request to send it again from frame n on.
+func streamControlFrame(kind byte, id, n uint32) []byte {
+	b := make([]byte, 9)
+	b[0] = kind
+	binary.BigEndian.PutUint32(b[1:], id)
+	binary.BigEndian.PutUint32(b[5:], n)
+	return b
+}
+
+// writeFrame writes a whole frame, so frames written by different
+// goroutines do not interleave.
+func (p *TCPPeer) writeFrame(b []byte) error {
+	p.wmu.Lock()
+	defer p.wmu.Unlock()
+	_, err := p.Conn.Write(b)
+	return err
+}
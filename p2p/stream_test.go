@@ -0,0 +1,188 @@
+package p2p
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTCPPair connects two TCP transports, returning the peer each end
+// sees.
+func newTCPPair(t *testing.T) (sender, receiver Peer) {
+	accepted := make(chan Peer, 1)
+	server := NewTCPTransport(TCPTransportOpts{
+		ListenAddr:    "127.0.0.1:0",
+		HandshakeFunc: NOPHandshakeFunc,
+		Decoder:       DefaultDecoder{},
+		OnPeer: func(p Peer) error {
+			accepted <- p
+			return nil
+		},
+	})
+	assert.Nil(t, server.ListenAndAccept())
+	t.Cleanup(func() { server.Close() })
+
+	dialed := make(chan Peer, 1)
+	client := NewTCPTransport(TCPTransportOpts{
+		HandshakeFunc: NOPHandshakeFunc,
+		Decoder:       DefaultDecoder{},
+		OnPeer: func(p Peer) error {
+			dialed <- p
+			return nil
+		},
+	})
+	t.Cleanup(func() { client.Close() })
+
+	server.mu.Lock()
+	addr := server.listeners[0].Addr().String()
+	server.mu.Unlock()
+	assert.Nil(t, client.Dial(addr))
+	return <-dialed, <-accepted
+}
+
+func TestStreamSenderWaitsForCredit(t *testing.T) {
+	defer func(window, frame int) {
+		StreamWindow, StreamFrameSize = window, frame
+	}(StreamWindow, StreamFrameSize)
+	StreamWindow, StreamFrameSize = 1024, 256
+
+	sender, receiver := newTCPPair(t)
+	data := bytes.Repeat([]byte("0123456789abcdef"), 512)
+
+	var sent int64
+	done := make(chan error, 1)
+	go func() {
+		if err := sender.OpenStream(); err != nil {
+			done <- err
+			return
+		}
+		for i := 0; i < len(data); i += 128 {
+			if _, err := sender.Write(data[i : i+128]); err != nil {
+				done <- err
+				return
+			}
+			atomic.AddInt64(&sent, 128)
+		}
+		done <- nil
+	}()
+
+	// Nothing is read yet: the sender stops at the window.
+	assert.Eventually(t, func() bool { return atomic.LoadInt64(&sent) == 1024 }, time.Second, time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, int64(1024), atomic.LoadInt64(&sent))
+
+	// As the receiver reads, the sender stays within a window of it.
+	got := make([]byte, 0, len(data))
+	buf := make([]byte, 100)
+	for len(got) < len(data) {
+		n, err := receiver.Read(buf)
+		assert.Nil(t, err)
+		got = append(got, buf[:n]...)
+		assert.LessOrEqual(t, atomic.LoadInt64(&sent), int64(len(got)+StreamWindow))
+	}
+	receiver.CloseStream()
+	assert.Equal(t, data, got)
+	assert.Nil(t, <-done)
+
+	// The connection carries on with messages and further streams.
+	assert.Nil(t, sender.OpenStream())
+	_, err := sender.Write([]byte("again"))
+	assert.Nil(t, err)
+	again := make([]byte, 5)
+	_, err = io.ReadFull(receiver, again)
+	assert.Nil(t, err)
+	assert.Equal(t, "again", string(again))
+	receiver.CloseStream()
+}
+
+func TestStreamSenderGivesUpOnStalledReceiver(t *testing.T) {
+	defer func(window, frame int, stall time.Duration) {
+		StreamWindow, StreamFrameSize, StreamStallTimeout = window, frame, stall
+	}(StreamWindow, StreamFrameSize, StreamStallTimeout)
+	StreamWindow, StreamFrameSize, StreamStallTimeout = 1024, 256, 50*time.Millisecond
+
+	sender, _ := newTCPPair(t)
+	assert.Nil(t, sender.OpenStream())
+	n, err := sender.Write(make([]byte, 2048))
+	assert.Equal(t, 1024, n)
+	assert.Equal(t, ErrStreamStalled, err)
+}
+
+// corruptConn flips a bit of the data of the stream data frames written in
+// the given positions, counting from 1.
+type corruptConn struct {
+	net.Conn
+	mu      sync.Mutex
+	frames  int
+	corrupt map[int]bool
+}
+
+func (c *corruptConn) Write(b []byte) (int, error) {
+	if len(b) > 13 && b[0] == IncomingStreamData {
+		c.mu.Lock()
+		c.frames++
+		if c.corrupt[c.frames] {
+			b = append([]byte(nil), b...)
+			b[13] ^= 0x1
+		}
+		c.mu.Unlock()
+	}
+	return c.Conn.Write(b)
+}
+
+func TestStreamResendsCorruptFrames(t *testing.T) {
+	defer func(window, frame int) {
+		StreamWindow, StreamFrameSize = window, frame
+	}(StreamWindow, StreamFrameSize)
+	StreamWindow, StreamFrameSize = 1024, 256
+
+	a, b := net.Pipe()
+	wire := &corruptConn{Conn: a, corrupt: map[int]bool{3: true, 10: true, 11: true}}
+	peers := make(chan Peer, 2)
+	for _, conn := range []net.Conn{wire, b} {
+		conns := newConnSet()
+		t.Cleanup(conns.close)
+		conn := conn
+		conns.serve(conn, func() {
+			servePeerConn(conn, true, NOPHandshakeFunc, func(p Peer) error {
+				peers <- p
+				return nil
+			}, nil, DefaultDecoder{}, conns)
+		})
+	}
+	sender, receiver := <-peers, <-peers
+	if sender.(*TCPPeer).Conn != wire {
+		sender, receiver = receiver, sender
+	}
+
+	data := make([]byte, 8<<10)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	done := make(chan error, 1)
+	go func() {
+		if err := sender.OpenStream(); err != nil {
+			done <- err
+			return
+		}
+		_, err := sender.Write(data)
+		done <- err
+	}()
+
+	got := make([]byte, len(data))
+	_, err := io.ReadFull(receiver, got)
+	assert.Nil(t, err)
+	receiver.CloseStream()
+	assert.Equal(t, data, got)
+	assert.Nil(t, <-done)
+
+	wire.mu.Lock()
+	defer wire.mu.Unlock()
+	assert.Greater(t, wire.frames, len(data)/StreamFrameSize)
+}
@@ -1,11 +1,15 @@
 package p2p
 
 import (
+	"crypto/tls"
 	"errors"
-	"fmt"
 	"log"
 	"net"
+	"net/url"
 	"sync"
+	"time"
+
+	"github.com/anthdm/foreverstore/logger"
 )
 
 // TCPPeer represents the remote node over a TCP established connection.
@@ -16,44 +20,156 @@ type TCPPeer struct {
 	// if we dial and retrieve a conn => outbound == true
 	// if we accept and retrieve a conn => outbound == false
 	outbound bool
-
-	wg *sync.WaitGroup
+	// version is the protocol version agreed on in the handshake.
+	version uint32
+
+	// stream is signalled when the reader of an incoming stream is done
+	// with it, so the read loop can resume.
+	stream chan struct{}
+
+	flow *streamFlow
+	// wmu serializes the writes of frames, and smu those of the data
+	// frames of a stream, sent for the first time or again.
+	wmu sync.Mutex
+	smu sync.Mutex
+	// reading is set while the stream being received is read, data is what
+	// is left of its current data frame, and expect the number of the next.
+	reading bool
+	data    []byte
+	expect  uint32
 }
 
 func NewTCPPeer(conn net.Conn, outbound bool) *TCPPeer {
 	return &TCPPeer{
 		Conn:     conn,
 		outbound: outbound,
-		wg:       &sync.WaitGroup{},
+		stream:   make(chan struct{}, 1),
+		flow:     newStreamFlow(),
 	}
 }
 
+// Outbound reports whether the connection was dialed by this end.
+func (p *TCPPeer) Outbound() bool {
+	return p.outbound
+}
+
+// ProtocolVersion returns the protocol version agreed on in the handshake.
+func (p *TCPPeer) ProtocolVersion() uint32 {
+	return p.version
+}
+
 func (p *TCPPeer) CloseStream() {
-	p.wg.Done()
+	p.reading = false
+	select {
+	case p.stream <- struct{}{}:
+	default:
+	}
 }
 
 func (p *TCPPeer) Send(b []byte) error {
-	_, err := p.Conn.Write(b)
-	return err
+	return p.writeFrame(b)
 }
 
 type TCPTransportOpts struct {
-	ListenAddr    string
+	ListenAddr string
+	// ListenAddrs are more addresses to accept connections on, such as an
+	// IPv6 address next to an IPv4 ListenAddr.
+	ListenAddrs   []string
 	HandshakeFunc HandshakeFunc
 	Decoder       Decoder
 	OnPeer        func(Peer) error
+	// OnPeerDisconnect, when set, is called with the peers OnPeer took once
+	// their connection is gone, and the error it failed with.
+	OnPeerDisconnect func(Peer, error)
+	// TLSConfig, when set, secures the connections to peers, dialed and
+	// accepted, with it. Its certificate callbacks are called for every
+	// handshake, so certificates it returns anew apply to the connections
+	// made from then on.
+	TLSConfig *tls.Config
+	// Proxy, when set, returns the proxy to dial each peer through.
+	Proxy ProxyFunc
+	// TCP tunes the connections to peers, dialed and accepted.
+	TCP TCPOptions
+}
+
+// TCPOptions tunes TCP connections. Zero values keep the defaults: Go
+// sends keep-alives every 15 seconds and disables Nagle's algorithm, and
+// the system sizes the buffers.
+type TCPOptions struct {
+	// KeepAlive is the keep-alive period; negative disables keep-alives.
+	KeepAlive time.Duration
+	// Delay enables Nagle's algorithm, batching small writes at the cost
+	// of latency.
+	Delay bool
+	// ReadBuffer and WriteBuffer size the receive and send buffers of the
+	// socket, in bytes. Larger buffers speed up the transfer of large
+	// files over links with a high latency.
+	ReadBuffer  int
+	WriteBuffer int
 }
 
+// apply sets the options on conn, a TCP connection or a connection over
+// one.
+func (o TCPOptions) apply(conn net.Conn) error {
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	if pc, ok := conn.(*proxiedConn); ok {
+		conn = pc.Conn
+	}
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+
+	var err error
+	set := func(e error) {
+		if err == nil {
+			err = e
+		}
+	}
+	switch {
+	case o.KeepAlive < 0:
+		set(tcp.SetKeepAlive(false))
+	case o.KeepAlive > 0:
+		set(tcp.SetKeepAlive(true))
+		set(tcp.SetKeepAlivePeriod(o.KeepAlive))
+	}
+	if o.Delay {
+		set(tcp.SetNoDelay(false))
+	}
+	if o.ReadBuffer > 0 {
+		set(tcp.SetReadBuffer(o.ReadBuffer))
+	}
+	if o.WriteBuffer > 0 {
+		set(tcp.SetWriteBuffer(o.WriteBuffer))
+	}
+	return err
+}
+
+// tune applies the TCP options of the transport to conn. Options the
+// system refuses leave the connection as it is.
+func (t *TCPTransport) tune(conn net.Conn) {
+	if err := t.TCP.apply(conn); err != nil {
+		logger.Warn("Failed to tune TCP connection to %s: %v", conn.RemoteAddr(), err)
+	}
+}
+
+// tlsHandshakeTimeout bounds the TLS handshake of a new connection.
+const tlsHandshakeTimeout = 10 * time.Second
+
 type TCPTransport struct {
 	TCPTransportOpts
-	listener net.Listener
-	rpcch    chan RPC
+	conns *connSet
+
+	mu        sync.Mutex
+	listeners []net.Listener
 }
 
 func NewTCPTransport(opts TCPTransportOpts) *TCPTransport {
 	return &TCPTransport{
 		TCPTransportOpts: opts,
-		rpcch:            make(chan RPC, 1024),
+		conns:            newConnSet(),
 	}
 }
 
@@ -66,97 +182,230 @@ func (t *TCPTransport) Addr() string {
 // Consume implements the Tranport interface, which will return read-only channel
 // for reading the incoming messages received from another peer in the network.
 func (t *TCPTransport) Consume() <-chan RPC {
-	return t.rpcch
+	return t.conns.rpcch
 }
 
-// Close implements the Transport interface.
+// Close implements the Transport interface. It stops accepting
+// connections, closes those established and returns once their read loops
+// have stopped.
 func (t *TCPTransport) Close() error {
-	if t.listener != nil {
-		return t.listener.Close()
+	t.mu.Lock()
+	listeners := t.listeners
+	t.mu.Unlock()
+
+	var err error
+	for _, listener := range listeners {
+		if closeErr := listener.Close(); closeErr != nil && !errors.Is(closeErr, net.ErrClosed) && err == nil {
+			err = closeErr
+		}
 	}
-	return nil
+	t.conns.close()
+	return err
 }
 
 // Dial implements the Transport interface.
 func (t *TCPTransport) Dial(addr string) error {
-	conn, err := net.Dial("tcp", addr)
+	conn, err := t.dialConn(addr)
 	if err != nil {
 		return err
 	}
 
-	go t.handleConn(conn, true)
+	if !t.conns.serve(conn, func() { t.handleConn(conn, true) }) {
+		return ErrTransportClosed
+	}
 
 	return nil
 }
 
-func (t *TCPTransport) ListenAndAccept() error {
-	var err error
+// dialConn connects to the peer at addr, through its proxy if any, and
+// runs the TLS handshake when TLS is on.
+func (t *TCPTransport) dialConn(addr string) (net.Conn, error) {
+	var proxy *url.URL
+	if t.Proxy != nil {
+		var err error
+		if proxy, err = t.Proxy(addr); err != nil {
+			return nil, err
+		}
+	}
 
-	t.listener, err = net.Listen("tcp", t.ListenAddr)
+	var (
+		conn net.Conn
+		err  error
+	)
+	switch {
+	case proxy != nil:
+		conn, err = dialProxy(proxy, addr)
+	case t.TLSConfig != nil:
+		conn, err = net.DialTimeout("tcp", addr, tlsHandshakeTimeout)
+	default:
+		conn, err = net.Dial("tcp", addr)
+	}
 	if err != nil {
-		return err
+		return nil, err
+	}
+	t.tune(conn)
+	if t.TLSConfig == nil {
+		return conn, nil
 	}
 
-	go t.startAcceptLoop()
+	config := t.TLSConfig
+	if config.ServerName == "" && !config.InsecureSkipVerify {
+		config = config.Clone()
+		config.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	tc := tls.Client(conn, config)
+	tc.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	if err := tc.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tc.SetDeadline(time.Time{})
+	return tc, nil
+}
 
-	log.Printf("TCP transport listening on port: %s\n", t.ListenAddr)
+// ListenAndAccept implements the Transport interface. It listens on
+// ListenAddr and on each of ListenAddrs, failing unless it can listen on
+// all of them.
+func (t *TCPTransport) ListenAndAccept() error {
+	addrs := append([]string{t.ListenAddr}, t.ListenAddrs...)
+	listeners := make([]net.Listener, 0, len(addrs))
+	for _, addr := range addrs {
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return err
+		}
+		if t.TLSConfig != nil {
+			listener = tls.NewListener(listener, t.TLSConfig)
+		}
+		listeners = append(listeners, listener)
+	}
+
+	t.mu.Lock()
+	t.listeners = listeners
+	t.mu.Unlock()
+
+	for i, listener := range listeners {
+		listener := listener
+		if !t.conns.serve(nil, func() { t.startAcceptLoop(listener) }) {
+			for _, l := range listeners[i:] {
+				l.Close()
+			}
+			return ErrTransportClosed
+		}
+		log.Printf("TCP transport listening on port: %s\n", addrs[i])
+	}
 
 	return nil
 }
 
-func (t *TCPTransport) startAcceptLoop() {
+func (t *TCPTransport) startAcceptLoop(listener net.Listener) {
 	for {
-		conn, err := t.listener.Accept()
+		conn, err := listener.Accept()
 		if errors.Is(err, net.ErrClosed) {
 			return
 		}
 
 		if err != nil {
-			fmt.Printf("TCP accept error: %s\n", err)
+			logger.Warn("TCP accept error: %s", err)
+			continue
 		}
 
-		go t.handleConn(conn, false)
+		t.tune(conn)
+		t.conns.serve(conn, func() { t.handleConn(conn, false) })
 	}
 }
 
 func (t *TCPTransport) handleConn(conn net.Conn, outbound bool) {
-	var err error
+	// Peers that fail the handshake are dropped before they are seen.
+	if tc, ok := conn.(*tls.Conn); ok && !outbound {
+		tc.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+		err := tc.Handshake()
+		tc.SetDeadline(time.Time{})
+		if err != nil {
+			logger.Warn("TLS handshake with %s failed: %v", conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+	}
+	servePeerConn(conn, outbound, t.HandshakeFunc, t.OnPeer, t.OnPeerDisconnect, t.Decoder, t.conns)
+}
+
+// servePeerConn runs the handshake and the read loop of a connection to a
+// peer, delivering decoded messages to conns until the connection fails or
+// the transport closes. Peers onPeer took are passed to onPeerDisconnect
+// then.
+func servePeerConn(conn net.Conn, outbound bool, handshake HandshakeFunc, onPeer func(Peer) error, onPeerDisconnect func(Peer, error), decoder Decoder, conns *connSet) {
+	var (
+		err      error
+		accepted bool
+	)
+
+	peer := NewTCPPeer(conn, outbound)
 
 	defer func() {
-		fmt.Printf("dropping peer connection: %s", err)
+		logger.Debug("dropping peer connection %s: %v", conn.RemoteAddr(), err)
 		conn.Close()
+		peer.flow.close()
+		if accepted && onPeerDisconnect != nil {
+			onPeerDisconnect(peer, err)
+		}
 	}()
 
-	peer := NewTCPPeer(conn, outbound)
-
-	if err = t.HandshakeFunc(peer); err != nil {
+	if err = handshake(peer); err != nil {
+		logger.Warn("Handshake with %s failed: %v", conn.RemoteAddr(), err)
 		return
 	}
 
-	if t.OnPeer != nil {
-		if err = t.OnPeer(peer); err != nil {
+	if onPeer != nil {
+		if err = onPeer(peer); err != nil {
 			return
 		}
 	}
+	accepted = true
 
 	// Read loop
 	for {
-		rpc := RPC{}
-		err = t.Decoder.Decode(conn, &rpc)
-		if err != nil {
-			return
+		// Frames read along with a stream come first.
+		rpc, ok := peer.flow.next()
+		if !ok {
+			err = decoder.Decode(conn, &rpc)
+			if err != nil {
+				return
+			}
 		}
 
 		rpc.From = conn.RemoteAddr().String()
 
+		if rpc.Credit > 0 {
+			peer.flow.credited(rpc.StreamID, rpc.Credit)
+			continue
+		}
+
+		if rpc.Resend {
+			go peer.resendFrames(rpc.StreamID, rpc.Frame)
+			continue
+		}
+
 		if rpc.Stream {
-			peer.wg.Add(1)
-			fmt.Printf("[%s] incoming stream, waiting...\n", conn.RemoteAddr())
-			peer.wg.Wait()
-			fmt.Printf("[%s] stream closed, resuming read loop\n", conn.RemoteAddr())
+			peer.flow.begin(rpc.StreamID)
+			logger.Debug("[%s] incoming stream, waiting...", conn.RemoteAddr())
+			select {
+			case <-peer.stream:
+			case <-conns.quit:
+				err = ErrTransportClosed
+				return
+			}
+			peer.flow.end()
+			logger.Debug("[%s] stream closed, resuming read loop", conn.RemoteAddr())
 			continue
 		}
 
-		t.rpcch <- rpc
+		if !conns.deliver(rpc) {
+			err = ErrTransportClosed
+			return
+		}
 	}
 }
@@ -1,7 +1,9 @@
 package p2p
 
 import (
+	"errors"
 	"net"
+	"os"
 	"testing"
 	"time"
 
@@ -77,3 +79,79 @@ func TestTCPTransportDial(t *testing.T) {
 	serverTr.Close()
 	// Don't close clientTr as it doesn't have a listener
 }
+
+func TestTCPTransportCloseTearsDownPeers(t *testing.T) {
+	connected := make(chan Peer, 1)
+	tr := NewTCPTransport(TCPTransportOpts{
+		ListenAddr:    "127.0.0.1:0",
+		HandshakeFunc: NOPHandshakeFunc,
+		Decoder:       DefaultDecoder{},
+		OnPeer: func(p Peer) error {
+			connected <- p
+			return nil
+		},
+	})
+	assert.Nil(t, tr.ListenAndAccept())
+
+	tr.mu.Lock()
+	addr := tr.listeners[0].Addr().String()
+	tr.mu.Unlock()
+
+	conn, err := net.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer conn.Close()
+	<-connected
+
+	assert.Nil(t, tr.Close())
+	_, ok := <-tr.Consume()
+	assert.False(t, ok, "Consume should be closed")
+
+	// The peer connection is closed from our end.
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.NotNil(t, err)
+	assert.False(t, errors.Is(err, os.ErrDeadlineExceeded))
+
+	other, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer other.Close()
+	assert.Equal(t, ErrTransportClosed, tr.Dial(other.Addr().String()))
+	assert.Nil(t, tr.Close())
+}
+
+func TestTCPOptionsApplied(t *testing.T) {
+	opts := TCPOptions{KeepAlive: time.Minute, Delay: true, ReadBuffer: 1 << 20, WriteBuffer: 1 << 20}
+	accepted := make(chan Peer, 1)
+	server := NewTCPTransport(TCPTransportOpts{
+		ListenAddr:    "127.0.0.1:0",
+		HandshakeFunc: NOPHandshakeFunc,
+		Decoder:       DefaultDecoder{},
+		OnPeer:        func(p Peer) error { accepted <- p; return nil },
+		TCP:           opts,
+	})
+	assert.Nil(t, server.ListenAndAccept())
+	defer server.Close()
+
+	client := NewTCPTransport(TCPTransportOpts{
+		ListenAddr:    ":0",
+		HandshakeFunc: NOPHandshakeFunc,
+		Decoder:       DefaultDecoder{},
+		TCP:           TCPOptions{KeepAlive: -1},
+	})
+	defer client.Close()
+	assert.Nil(t, client.Dial(server.listeners[0].Addr().String()))
+
+	select {
+	case p := <-accepted:
+		assert.Nil(t, opts.apply(p.(*TCPPeer).Conn))
+		assert.Nil(t, opts.apply(&proxiedConn{Conn: p.(*TCPPeer).Conn}))
+	case <-time.After(5 * time.Second):
+		t.Fatal("peer was not accepted")
+	}
+
+	// Connections that are not TCP are left alone.
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	assert.Nil(t, opts.apply(a))
+}
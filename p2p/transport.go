@@ -6,7 +6,15 @@ import "net"
 type Peer interface {
 	net.Conn
 	Send([]byte) error
+	// OpenStream announces a stream: what is written to the peer next is
+	// its data, read by the peer from its end until it calls CloseStream.
+	OpenStream() error
 	CloseStream()
+	// Outbound reports whether the connection was dialed by this end.
+	Outbound() bool
+	// ProtocolVersion returns the protocol version agreed on with the peer
+	// in the handshake, 0 when the handshake did not settle one.
+	ProtocolVersion() uint32
 }
 
 // Transport is anything that handles the communication
@@ -16,6 +24,13 @@ type Transport interface {
 	Addr() string
 	Dial(string) error
 	ListenAndAccept() error
+	// Consume returns the messages received from peers. The channel is
+	// closed once the transport has been closed and no more messages will
+	// be delivered.
 	Consume() <-chan RPC
+	// Close stops accepting connections and closes those established,
+	// peer connections included. It returns once the goroutines serving
+	// them have stopped and the channel returned by Consume is closed.
+	// Calling it again does nothing.
 	Close() error
 }
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"sort"
+
+	"github.com/anthdm/foreverstore/errors"
+)
+
+// Queries fanned out to the peers — listings, queries, stats — answer with
+// what the peers that answered in time told, rather than fail because some
+// did not: the answer is marked partial and names the peers left out.
+
+// Partial marks the answer of a query of the cluster that some peers did not
+// answer, in time or at all.
+type Partial struct {
+	Partial bool `json:"partial,omitempty"`
+	// Unanswered are the peers left out of the answer, by address.
+	Unanswered []UnansweredPeer `json:"unanswered,omitempty"`
+}
+
+// UnansweredPeer is a peer that did not answer a query of the cluster.
+type UnansweredPeer struct {
+	Addr  string `json:"addr"`
+	Error string `json:"error"`
+	// TimedOut is set when the peer did not answer in time, rather than
+	// failed to.
+	TimedOut bool `json:"timed_out,omitempty"`
+}
+
+// partialAnswer returns the partiality of an answer the peers of errs,
+// keyed by address, did not answer.
+func partialAnswer(errs map[string]error) Partial {
+	var p Partial
+	for addr, err := range errs {
+		p.Unanswered = append(p.Unanswered, UnansweredPeer{
+			Addr:     addr,
+			Error:    err.Error(),
+			TimedOut: errors.IsType(err, errors.TimeoutError),
+		})
+	}
+	sort.Slice(p.Unanswered, func(i, j int) bool { return p.Unanswered[i].Addr < p.Unanswered[j].Addr })
+	p.Partial = len(p.Unanswered) > 0
+	return p
+}
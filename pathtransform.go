@@ -0,0 +1,184 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/anthdm/foreverstore/errors"
+)
+
+// Path transforms lay out the objects of a store on disk, and are selected
+// by name with path_transform. A store is read back with the transform it
+// was written with: the name is recorded in the storage root, and a node
+// configured with another refuses to start rather than lose sight of its
+// objects. Replicas are stored under hashed keys, so the transforms that
+// partition by key put them all in the same partition.
+const (
+	// PathTransformCAS spreads objects over directories named after
+	// slices of the SHA-1 of their key. Stores older than the setting use
+	// it.
+	PathTransformCAS = "cas"
+	// PathTransformCASSHA256 spreads objects over two levels of
+	// directories named after the first bytes of the SHA-256 of their key.
+	PathTransformCASSHA256 = "cas-sha256"
+	// PathTransformFlat keeps every object of a namespace in one directory.
+	PathTransformFlat = "flat"
+	// PathTransformDatePartitioned groups objects by the date, as
+	// YYYY-MM-DD, their key holds, those without one under "undated".
+	PathTransformDatePartitioned = "date-partitioned"
+	// PathTransformTenantPrefixed groups objects by their bucket, for the
+	// data of each tenant to sit under its own directory.
+	PathTransformTenantPrefixed = "tenant-prefixed"
+
+	defaultPathTransform = PathTransformCAS
+
+	pathTransformFileName = ".path_transform"
+	// undatedPartition and defaultTenant hold the objects whose key has no
+	// date, or no bucket usable as a directory name.
+	undatedPartition = "undated"
+	defaultTenant    = "_"
+)
+
+// pathTransforms are the path transforms by name.
+var pathTransforms = map[string]PathTransformFunc{
+	PathTransformCAS:             CASPathTransformFunc,
+	PathTransformCASSHA256:       casSHA256PathTransformFunc,
+	PathTransformFlat:            flatPathTransformFunc,
+	PathTransformDatePartitioned: datePartitionedPathTransformFunc,
+	PathTransformTenantPrefixed:  tenantPrefixedPathTransformFunc,
+}
+
+// PathTransformByName returns the path transform registered as name, the
+// default one for an empty name.
+func PathTransformByName(name string) (PathTransformFunc, error) {
+	if name == "" {
+		name = defaultPathTransform
+	}
+	fn, ok := pathTransforms[strings.ToLower(name)]
+	if !ok {
+		return nil, errors.NewConfigError(fmt.Sprintf("unknown path transform: %s", name))
+	}
+	return fn, nil
+}
+
+// keyHash returns the hex encoded SHA-256 of key, the file name of objects
+// in the layouts that do not use their key as is.
+func keyHash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func casSHA256PathTransformFunc(key string) PathKey {
+	hash := keyHash(key)
+	return PathKey{PathName: hash[:2] + "/" + hash[2:4], Filename: hash}
+}
+
+func flatPathTransformFunc(key string) PathKey {
+	return PathKey{Filename: keyHash(key)}
+}
+
+var keyDate = regexp.MustCompile(`\d{4}-\d{2}-\d{2}`)
+
+func datePartitionedPathTransformFunc(key string) PathKey {
+	partition := undatedPartition
+	for _, match := range keyDate.FindAllString(key, -1) {
+		if day, err := time.Parse("2006-01-02", match); err == nil {
+			partition = day.Format("2006/01/02")
+			break
+		}
+	}
+	return PathKey{PathName: partition, Filename: keyHash(key)}
+}
+
+func tenantPrefixedPathTransformFunc(key string) PathKey {
+	tenant := bucketOf(key)
+	if !validTenantDir(tenant) {
+		tenant = defaultTenant
+	}
+	hash := keyHash(key)
+	return PathKey{PathName: tenant + "/" + hash[:2], Filename: hash}
+}
+
+// validTenantDir reports whether the bucket name can safely be used as a
+// directory name.
+func validTenantDir(name string) bool {
+	if name == "" || name == "." || name == ".." || name == defaultTenant {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// checkPathTransform verifies that name is the path transform the storage
+// was written with, and records it as the one in use. Storage written
+// before transforms were recorded used PathTransformCAS; an empty one takes
+// any.
+func checkPathTransform(storageRoot, name string) error {
+	if name == "" {
+		name = defaultPathTransform
+	}
+	name = strings.ToLower(name)
+	if _, err := PathTransformByName(name); err != nil {
+		return err
+	}
+	path := filepath.Join(storageRoot, pathTransformFileName)
+
+	stored, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		if recorded := strings.TrimSpace(string(stored)); recorded != name {
+			return pathTransformMismatch(storageRoot, recorded, name)
+		}
+		return nil
+	case !os.IsNotExist(err):
+		return errors.Wrap(err, errors.StorageError, "failed to read the path transform of the storage")
+	}
+
+	used, err := storageInUse(storageRoot)
+	if err != nil {
+		return err
+	}
+	if used && name != PathTransformCAS {
+		return pathTransformMismatch(storageRoot, PathTransformCAS, name)
+	}
+	if err := os.MkdirAll(storageRoot, os.ModePerm); err != nil {
+		return errors.Wrap(err, errors.StorageError, "failed to create storage root")
+	}
+	if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+		return errors.Wrap(err, errors.StorageError, "failed to record the path transform of the storage")
+	}
+	return nil
+}
+
+func pathTransformMismatch(storageRoot, recorded, name string) error {
+	return errors.NewConfigError(fmt.Sprintf(
+		"path transform %s does not match the transform this storage was written with (%s)", name, recorded)).
+		WithContext("storage_root", storageRoot)
+}
+
+// storageInUse reports whether the storage root holds namespaces already.
+func storageInUse(storageRoot string) (bool, error) {
+	entries, err := os.ReadDir(storageRoot)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrap(err, errors.StorageError, "failed to list namespaces")
+	}
+	for _, e := range entries {
+		if e.IsDir() && !strings.HasPrefix(e.Name(), ".") {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/anthdm/foreverstore/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPathTransforms(t *testing.T) {
+	hash := keyHash("logs/2024-05-01/app.log")
+	for name, want := range map[string]string{
+		PathTransformCASSHA256:       hash[:2] + "/" + hash[2:4] + "/" + hash,
+		PathTransformFlat:            hash,
+		PathTransformDatePartitioned: "2024/05/01/" + hash,
+		PathTransformTenantPrefixed:  "logs/" + hash[:2] + "/" + hash,
+	} {
+		fn, err := PathTransformByName(name)
+		assert.Nil(t, err)
+		assert.Equal(t, want, fn("logs/2024-05-01/app.log").FullPath(), name)
+	}
+
+	date, _ := PathTransformByName(PathTransformDatePartitioned)
+	assert.Equal(t, undatedPartition, date("logs/2024-13-45/app.log").PathName)
+	tenant, _ := PathTransformByName(PathTransformTenantPrefixed)
+	assert.Equal(t, defaultTenant, tenant("../escape").PathName[:1])
+	assert.Equal(t, defaultTenant, tenant("unbucketed").PathName[:1])
+
+	fn, err := PathTransformByName("")
+	assert.Nil(t, err)
+	assert.Equal(t, CASPathTransformFunc("key"), fn("key"))
+	_, err = PathTransformByName("by-size")
+	assert.Equal(t, errors.ConfigError, errors.GetType(err))
+
+	// Objects are stored and deleted in every layout.
+	for name, fn := range pathTransforms {
+		s := NewStore(StoreOpts{Root: t.TempDir(), PathTransformFunc: fn})
+		for _, key := range []string{"a/2024-05-01/x", "a/2024-05-01/y", "b/z"} {
+			_, err := s.Write("node", key, strings.NewReader(key))
+			assert.Nil(t, err, name)
+		}
+		_, r, err := s.Read("node", "a/2024-05-01/y")
+		assert.Nil(t, err, name)
+		b, _ := io.ReadAll(r)
+		r.(io.Closer).Close()
+		assert.Equal(t, "a/2024-05-01/y", string(b), name)
+		assert.Nil(t, s.Delete("node", "a/2024-05-01/x"), name)
+		assert.False(t, s.Has("node", "a/2024-05-01/x"), name)
+		assert.True(t, s.Has("node", "a/2024-05-01/y"), name)
+	}
+}
+
+func TestCheckPathTransform(t *testing.T) {
+	// A new storage root takes any transform, and keeps it.
+	root := filepath.Join(t.TempDir(), "storage")
+	assert.Nil(t, checkPathTransform(root, "Flat"))
+	assert.Nil(t, checkPathTransform(root, PathTransformFlat))
+	err := checkPathTransform(root, PathTransformCAS)
+	assert.Equal(t, errors.ConfigError, errors.GetType(err))
+	assert.Equal(t, errors.ConfigError, errors.GetType(checkPathTransform(root, "by-size")))
+
+	// Storage written before transforms were recorded used CAS.
+	legacy := t.TempDir()
+	s := NewStore(StoreOpts{Root: legacy, PathTransformFunc: CASPathTransformFunc})
+	_, err = s.Write("node", "key", bytes.NewReader([]byte("data")))
+	assert.Nil(t, err)
+	assert.Equal(t, errors.ConfigError, errors.GetType(checkPathTransform(legacy, PathTransformTenantPrefixed)))
+	assert.Nil(t, checkPathTransform(legacy, ""))
+	b, err := os.ReadFile(filepath.Join(legacy, pathTransformFileName))
+	assert.Nil(t, err)
+	assert.Equal(t, PathTransformCAS, string(b))
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/anthdm/foreverstore/p2p"
+)
+
+// peerQueueSize is how many messages of a peer wait to be handled before
+// the peer is dropped for not being kept up with.
+const peerQueueSize = 64
+
+// peerQueues holds the messages of each peer waiting for the goroutine
+// handling them in order. The dispatcher never waits for a queue: a peer
+// whose queue is full is dropped instead, so that one slow peer does not
+// hold up the messages of every other. The queue of a peer goes away with
+// its connection.
+type peerQueues struct {
+	mu     sync.Mutex
+	queues map[string]chan p2p.RPC
+}
+
+// push queues rpc for its peer, starting handle on the queue of a peer
+// heard from for the first time. It reports false when the queue is full.
+func (q *peerQueues) push(rpc p2p.RPC, handle func(<-chan p2p.RPC)) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.queues == nil {
+		q.queues = make(map[string]chan p2p.RPC)
+	}
+	ch, ok := q.queues[rpc.From]
+	if !ok {
+		ch = make(chan p2p.RPC, peerQueueSize)
+		q.queues[rpc.From] = ch
+		go handle(ch)
+	}
+	select {
+	case ch <- rpc:
+		return true
+	default:
+		return false
+	}
+}
+
+// forget closes the queue of the peer at addr: its handler stops once the
+// messages queued are handled.
+func (q *peerQueues) forget(addr string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if ch, ok := q.queues[addr]; ok {
+		close(ch)
+		delete(q.queues, addr)
+	}
+}
+
+// closeAll closes the queue of every peer.
+func (q *peerQueues) closeAll() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for addr, ch := range q.queues {
+		close(ch)
+		delete(q.queues, addr)
+	}
+}
+
+func (q *peerQueues) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.queues)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/anthdm/foreverstore/p2p"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPeerQueueIsRefusedWhenFull(t *testing.T) {
+	var q peerQueues
+	taken := make(chan struct{}, peerQueueSize+2)
+	release := make(chan struct{})
+	handled := make(chan string, peerQueueSize+2)
+	handle := func(rpcs <-chan p2p.RPC) {
+		for rpc := range rpcs {
+			taken <- struct{}{}
+			<-release
+			handled <- rpc.From
+		}
+	}
+
+	// The handler of the slow peer holds its first message: the queue
+	// fills up behind it, and other peers are queued all the same.
+	assert.True(t, q.push(p2p.RPC{From: "slow"}, handle))
+	<-taken
+	for i := 0; i < peerQueueSize; i++ {
+		assert.True(t, q.push(p2p.RPC{From: "slow"}, handle))
+	}
+	assert.False(t, q.push(p2p.RPC{From: "slow"}, handle))
+	assert.True(t, q.push(p2p.RPC{From: "other"}, handle))
+	assert.Equal(t, 2, q.len())
+
+	q.forget("slow")
+	assert.Equal(t, 1, q.len())
+	close(release)
+	for i := 0; i < peerQueueSize+2; i++ {
+		<-handled
+	}
+	q.closeAll()
+	assert.Zero(t, q.len())
+}
+
+func TestPeerQueuesGoAwayWithTheirPeers(t *testing.T) {
+	c := newTestCluster(t, 3)
+	s := c.nodes[0]
+	c.store(1, "shared", []byte("from node 1"))
+	c.store(2, "other", []byte("from node 2"))
+	c.eventually("the peers to be heard from", func() bool { return s.inbox.len() == 2 })
+
+	assert.Nil(t, s.RemovePeer("node-1"))
+	assert.Equal(t, 1, s.inbox.len())
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/anthdm/foreverstore/p2p"
+)
+
+// peerEventBuffer is the number of membership changes a subscriber may fall
+// behind by before it misses some.
+const peerEventBuffer = 64
+
+// peerEvent is a change of the peers a node is connected to: the peer at
+// Addr connected, or disconnected when Connected is not set.
+type peerEvent struct {
+	Addr      string
+	Connected bool
+}
+
+// peerRegistry holds the peers a node is connected to. What it returns are
+// copies, which may be iterated without a lock while peers come and go, and
+// changes are published to its subscribers.
+type peerRegistry struct {
+	mu    sync.Mutex
+	peers map[string]p2p.Peer
+	subs  map[chan peerEvent]struct{}
+}
+
+// add registers the peer at addr, replacing the peer of the same address
+// if any. It refuses a new peer once max peers are registered, unless max
+// is 0, and returns the number of peers registered.
+func (r *peerRegistry) add(addr string, p p2p.Peer, max int) (int, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.peers == nil {
+		r.peers = make(map[string]p2p.Peer)
+	}
+	_, known := r.peers[addr]
+	if !known && max > 0 && len(r.peers) >= max {
+		return len(r.peers), false
+	}
+	r.peers[addr] = p
+	if !known {
+		r.publish(peerEvent{Addr: addr, Connected: true})
+	}
+	return len(r.peers), true
+}
+
+// remove unregisters the peer at addr and returns it.
+func (r *peerRegistry) remove(addr string) (p2p.Peer, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p, ok := r.peers[addr]
+	if !ok {
+		return nil, false
+	}
+	delete(r.peers, addr)
+	r.publish(peerEvent{Addr: addr})
+	return p, true
+}
+
+func (r *peerRegistry) get(addr string) (p2p.Peer, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p, ok := r.peers[addr]
+	return p, ok
+}
+
+func (r *peerRegistry) len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.peers)
+}
+
+// snapshot returns a copy of the peers by address.
+func (r *peerRegistry) snapshot() map[string]p2p.Peer {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.copyPeers()
+}
+
+// addrs returns the addresses of the peers, in no particular order.
+func (r *peerRegistry) addrs() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	addrs := make([]string, 0, len(r.peers))
+	for addr := range r.peers {
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+// subscribe returns a snapshot of the peers along with the changes made to
+// them since, until cancel is called. A subscriber that falls behind by
+// more than peerEventBuffer changes misses the next ones.
+func (r *peerRegistry) subscribe() (map[string]p2p.Peer, <-chan peerEvent, func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.subs == nil {
+		r.subs = make(map[chan peerEvent]struct{})
+	}
+	events := make(chan peerEvent, peerEventBuffer)
+	r.subs[events] = struct{}{}
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			delete(r.subs, events)
+			close(events)
+		})
+	}
+	return r.copyPeers(), events, cancel
+}
+
+// publish sends e to the subscribers. Callers hold mu.
+func (r *peerRegistry) publish(e peerEvent) {
+	for events := range r.subs {
+		select {
+		case events <- e:
+		default:
+		}
+	}
+}
+
+// copyPeers copies the peers. Callers hold mu.
+func (r *peerRegistry) copyPeers() map[string]p2p.Peer {
+	peers := make(map[string]p2p.Peer, len(r.peers))
+	for addr, p := range r.peers {
+		peers[addr] = p
+	}
+	return peers
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/anthdm/foreverstore/p2p"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPeerRegistry(t *testing.T) {
+	var r peerRegistry
+	_, ok := r.get("a")
+	assert.False(t, ok)
+
+	n, ok := r.add("a", nil, 2)
+	assert.True(t, ok)
+	assert.Equal(t, 1, n)
+	peers, events, cancel := r.subscribe()
+	assert.Equal(t, map[string]p2p.Peer{"a": nil}, peers)
+
+	_, ok = r.add("b", nil, 2)
+	assert.True(t, ok)
+	// The limit holds for new peers only.
+	n, ok = r.add("c", nil, 2)
+	assert.False(t, ok)
+	assert.Equal(t, 2, n)
+	_, ok = r.add("a", nil, 2)
+	assert.True(t, ok)
+	assert.ElementsMatch(t, []string{"a", "b"}, r.addrs())
+
+	// Snapshots do not change with the registry.
+	snapshot := r.snapshot()
+	_, ok = r.remove("a")
+	assert.True(t, ok)
+	_, ok = r.remove("a")
+	assert.False(t, ok)
+	assert.Len(t, snapshot, 2)
+	assert.Equal(t, 1, r.len())
+
+	cancel()
+	var got []peerEvent
+	for e := range events {
+		got = append(got, e)
+	}
+	assert.Equal(t, []peerEvent{{Addr: "b", Connected: true}, {Addr: "a"}}, got)
+	_, ok = r.add("d", nil, 0)
+	assert.True(t, ok)
+}
+
+func TestPeerRegistryUnderChurn(t *testing.T) {
+	var r peerRegistry
+	_, events, cancel := r.subscribe()
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				addr := fmt.Sprintf("node-%d-%d", i, j%5)
+				r.add(addr, nil, 0)
+				r.remove(addr)
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				for addr := range r.snapshot() {
+					r.get(addr)
+				}
+				r.addrs()
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Zero(t, r.len())
+	// Changes past what the subscriber holds are dropped rather than hold
+	// up the registry.
+	assert.Len(t, events, peerEventBuffer)
+}
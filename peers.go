@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/anthdm/foreverstore/errors"
+)
+
+// PeerInfo is a peer this node is connected to.
+type PeerInfo struct {
+	Addr string `json:"addr"`
+	// ID is the node ID the peer introduced itself with, empty until it
+	// does.
+	ID string `json:"id,omitempty"`
+	// Site is the site the peer reported, likewise.
+	Site string `json:"site,omitempty"`
+	// ListenAddr, Version and Features are what the peer introduced
+	// itself with.
+	ListenAddr string   `json:"listen_addr,omitempty"`
+	Version    string   `json:"version,omitempty"`
+	Features   []string `json:"features,omitempty"`
+	// Protocol is the peer protocol version agreed on with the peer when
+	// connecting.
+	Protocol uint32 `json:"protocol,omitempty"`
+	// Used and Limit are the disk usage of the peer as last reported.
+	Used  int64 `json:"used_bytes,omitempty"`
+	Limit int64 `json:"limit_bytes,omitempty"`
+	// LastSeen is when the peer was last heard from.
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// removedPeers tracks the peers removed through RemovePeer, which are not
+// connected to again until added back.
+type removedPeers struct {
+	mu sync.Mutex
+	// addrs maps the addresses a removed peer was connected at, and the
+	// address it listens on, to its node ID, empty if it never gave one.
+	addrs map[string]string
+	ids   map[string]bool
+}
+
+// remove records the removal of the peer with node ID id known at addrs.
+func (r *removedPeers) remove(id string, addrs ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.addrs == nil {
+		r.addrs = make(map[string]string)
+		r.ids = make(map[string]bool)
+	}
+	for _, addr := range addrs {
+		if addr != "" {
+			r.addrs[addr] = id
+		}
+	}
+	if id != "" {
+		r.ids[id] = true
+	}
+}
+
+// restore forgets the removal of the peer known at addr, at any of its
+// addresses.
+func (r *removedPeers) restore(addr string) {
+	r.mu.Lock()
+	id, ok := r.addrs[addr]
+	delete(r.addrs, addr)
+	r.mu.Unlock()
+	if ok {
+		r.restoreID(id)
+	}
+}
+
+// restoreID forgets the removal of the peer with node ID id, at any of its
+// addresses.
+func (r *removedPeers) restoreID(id string) {
+	if id == "" {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.ids, id)
+	for addr, other := range r.addrs {
+		if other == id {
+			delete(r.addrs, addr)
+		}
+	}
+}
+
+// hasAddr reports whether the peer known at addr was removed.
+func (r *removedPeers) hasAddr(addr string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.addrs[addr]
+	return ok
+}
+
+// hasID reports whether the peer with node ID id was removed.
+func (r *removedPeers) hasID(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.ids[id]
+}
+
+// PeerRequest names the peer to connect to through the admin API.
+type PeerRequest struct {
+	Addr string `json:"addr"`
+}
+
+// Peers returns the peers this node is connected to, ordered by address.
+func (s *FileServer) Peers() []PeerInfo {
+	addrs := s.peers.addrs()
+	peers := make([]PeerInfo, 0, len(addrs))
+	for _, addr := range addrs {
+		peers = append(peers, PeerInfo{Addr: addr})
+	}
+
+	for i := range peers {
+		if p, ok := s.peers.get(peers[i].Addr); ok {
+			peers[i].Protocol = p.ProtocolVersion()
+		}
+		peers[i].ID = s.conns.id(peers[i].Addr)
+		peers[i].LastSeen, _ = s.liveness.lastSeen(peers[i].Addr)
+		if hello, ok := s.conns.hello(peers[i].Addr); ok {
+			peers[i].ListenAddr = advertisedAddr(peers[i].Addr, hello.ListenAddr)
+			peers[i].Version = hello.Version
+			peers[i].Features = hello.Features
+		}
+	}
+	s.capacity.mu.Lock()
+	for i := range peers {
+		c := s.capacity.peers[peers[i].Addr]
+		if peers[i].ID == "" {
+			peers[i].ID = c.ID
+		}
+		peers[i].Site = c.Site
+		peers[i].Used, peers[i].Limit = c.Used, c.Limit
+	}
+	s.capacity.mu.Unlock()
+
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Addr < peers[j].Addr })
+	return peers
+}
+
+// AddPeer connects to the node listening on addr, adding it to the peers of
+// this node without a restart. The peer shows up in Peers once the
+// handshake completes. Adding a peer already connected does nothing, over
+// whichever connection and at whichever of its addresses.
+func (s *FileServer) AddPeer(addr string) error {
+	if addr == "" {
+		return errors.NewInvalidInputError("peer address is required")
+	}
+	if s.connectedTo(addr) {
+		s.logger.Info("Already connected with peer: %s", addr)
+		return nil
+	}
+
+	s.logger.Info("Adding peer: %s", addr)
+	s.removed.restore(addr)
+	if err := s.dial(addr); err != nil {
+		return errors.Wrap(err, errors.ConnectionError, fmt.Sprintf("failed to connect to peer %s", addr))
+	}
+	return nil
+}
+
+// RemovePeer disconnects from a peer, given by address or by node ID, so
+// that it no longer receives replicas or requests from this node. The peer
+// is neither dialed nor accepted again until it is added back, or until the
+// next start when it is in BootstrapNodes.
+func (s *FileServer) RemovePeer(id string) error {
+	if id == "" {
+		return errors.NewInvalidInputError("peer address or ID is required")
+	}
+	addr := id
+	if _, ok := s.peer(addr); !ok {
+		for _, p := range s.Peers() {
+			if p.ID == id {
+				addr = p.Addr
+				break
+			}
+		}
+	}
+
+	peerID := s.conns.id(addr)
+	var listen string
+	if hello, ok := s.conns.hello(addr); ok {
+		listen = advertisedAddr(addr, hello.ListenAddr)
+	}
+	if !s.dropPeer(addr) {
+		return errors.New(errors.FileNotFoundError, fmt.Sprintf("no peer %s", id))
+	}
+	s.removed.remove(peerID, addr, listen)
+	s.routes.Remove(peerID)
+	s.logger.Info("Removed peer: %s", addr)
+	return nil
+}
+
+// dropPeer forgets the peer at addr and closes the connection to it. It
+// reports whether there was such a peer.
+func (s *FileServer) dropPeer(addr string) bool {
+	peer, ok := s.peers.remove(addr)
+	if !ok {
+		return false
+	}
+
+	s.forgetPeerKey(addr)
+	s.conns.forget(addr)
+	s.capacity.forget(addr)
+	s.clockSkew.forget(addr)
+	s.liveness.forget(addr)
+	s.replicaAcks.forget(addr)
+	s.reportControlFailed(addr, s.control.forget(addr), "peer disconnected")
+	s.failRequests(addr)
+	s.gets.forget(addr)
+	s.inbox.forget(addr)
+	if err := peer.Close(); err != nil {
+		s.logger.Warn("Failed to close connection to peer %s: %v", addr, err)
+	}
+	return true
+}
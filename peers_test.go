@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/anthdm/foreverstore/config"
+	"github.com/anthdm/foreverstore/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAddAndRemovePeersAtRuntime(t *testing.T) {
+	c := newTestClusterWith(t, 3, func(node int, opts *FileServerOpts) {
+		opts.CapacityInterval = 100 * time.Millisecond
+	})
+	s := c.nodes[0]
+	c.eventually("node IDs to be gossiped", func() bool {
+		for _, p := range s.Peers() {
+			if p.ID == "" {
+				return false
+			}
+		}
+		return true
+	})
+
+	// Removed peers, by address or by node ID, no longer get replicas.
+	assert.Nil(t, s.RemovePeer("node-1"))
+	assert.Nil(t, s.RemovePeer(c.nodes[2].ID))
+	assert.Empty(t, s.Peers())
+	c.store(0, "alone", []byte("kept on node 0"))
+	c.assertAbsent([]int{1, 2}, 0, "alone")
+
+	err := s.RemovePeer("node-1")
+	assert.Equal(t, errors.FileNotFoundError, errors.GetType(err))
+
+	// Added peers get the writes made from then on.
+	assert.Nil(t, s.AddPeer("node-1"))
+	c.eventually("node 1 to be connected", func() bool {
+		peers := s.Peers()
+		return len(peers) == 1 && peers[0].Addr == "node-1"
+	})
+	assert.Nil(t, s.AddPeer("node-1"))
+	c.store(0, "shared", []byte("replicated to node 1"))
+	c.eventually("shared to reach node 1", func() bool { return c.holds(1, 0, "shared") })
+	c.assertAbsent([]int{2}, 0, "shared")
+
+	assert.NotNil(t, s.AddPeer("node-9"))
+}
+
+func TestPeersIntroduceThemselves(t *testing.T) {
+	c := newTestClusterWith(t, 2, func(node int, opts *FileServerOpts) {
+		opts.Site = []string{"east", "west"}[node]
+		opts.Config = &config.Config{MaxStorageSize: 1 << 30}
+	})
+	c.store(1, "doc", []byte("on the disk of node 1"))
+	c.assertConverged(1, "doc")
+	assert.Nil(t, c.nodes[0].RemovePeer("node-1"))
+	assert.Nil(t, c.nodes[0].AddPeer("node-1"))
+
+	// The attributes of a peer are known from its hello, before any
+	// capacity report.
+	var peer PeerInfo
+	c.eventually("node 1 to introduce itself", func() bool {
+		peers := c.nodes[0].Peers()
+		if len(peers) != 1 || peers[0].Version == "" {
+			return false
+		}
+		peer = peers[0]
+		return true
+	})
+	assert.Equal(t, c.nodes[1].ID, peer.ID)
+	assert.Equal(t, "node-1", peer.ListenAddr)
+	assert.Equal(t, Version, peer.Version)
+	assert.Contains(t, peer.Features, FeatureBatch)
+	assert.Equal(t, "west", peer.Site)
+	assert.Equal(t, int64(1<<30), peer.Limit)
+	assert.True(t, peer.Used > 0)
+}
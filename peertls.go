@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/anthdm/foreverstore/config"
+	"github.com/anthdm/foreverstore/errors"
+)
+
+// Peers talk over mutual TLS when a certificate, its key and the CA to
+// verify peers with are configured: each end presents its certificate and
+// checks the other's against the CA. Peers are dialed by address, so their
+// certificates are not checked against a host name.
+//
+// Certificates are renewed without a restart. They are read again from
+// their files, or their secret references, every TLSReloadInterval and on
+// demand, and the handshakes from then on use what was read. TLS checks
+// certificates on the handshake only, so the connections made before stay
+// up: no peer is dropped by a renewal. To move to a new CA, configure a CA
+// file holding both CAs until every node presents a certificate of the new
+// one.
+//
+// Where peers are told apart by their identity keys alone, those dialing
+// in may be let in without a certificate (OptionalClientCert): connections
+// are encrypted all the same, and a peer is still refused for a
+// certificate the CAs did not issue. The certificate of a peer dialed is
+// always required.
+
+// PeerTLS holds the certificate a node presents to its peers and the CAs
+// it accepts theirs from, as last loaded.
+type PeerTLS struct {
+	// CertFile, KeyFile and CAFile hold the PEM encoded certificate chain,
+	// its private key and the CA certificates. Each is the path of a file,
+	// or a secret reference (see config.ResolveSecret) to the PEM itself.
+	CertFile string
+	KeyFile  string
+	CAFile   string
+	// OptionalClientCert accepts peers dialing in without a certificate.
+	OptionalClientCert bool
+
+	mu    sync.RWMutex
+	cert  *tls.Certificate
+	roots *x509.CertPool
+	// pem is what the current certificate and CAs were loaded from.
+	pem      [3][]byte
+	loadedAt time.Time
+}
+
+// TLSStatus reports the certificate a node presents to its peers.
+type TLSStatus struct {
+	Subject   string    `json:"subject"`
+	Issuer    string    `json:"issuer"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+	LoadedAt  time.Time `json:"loaded_at"`
+	// Reloaded is set when the last reload found a new certificate or CA.
+	Reloaded bool `json:"reloaded,omitempty"`
+}
+
+// NewPeerTLS loads the certificate, key and CAs of the node.
+func NewPeerTLS(certFile, keyFile, caFile string) (*PeerTLS, error) {
+	t := &PeerTLS{CertFile: certFile, KeyFile: keyFile, CAFile: caFile}
+	if _, err := t.Reload(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// readPEM reads the PEM of ref, a secret reference or the path of a file.
+func readPEM(ref string) ([]byte, error) {
+	secret, err := config.ResolveSecret(ref)
+	if err != nil {
+		return nil, err
+	}
+	if secret != ref {
+		return []byte(secret), nil
+	}
+	return os.ReadFile(ref)
+}
+
+// Reload reads the certificate, key and CAs again, and uses them for the
+// handshakes from then on when they changed. When they cannot be used, as
+// when a renewal has written the certificate but not its key yet, the
+// ones loaded before are kept and an error is returned.
+func (t *PeerTLS) Reload() (TLSStatus, error) {
+	var pem [3][]byte
+	for i, ref := range []string{t.CertFile, t.KeyFile, t.CAFile} {
+		b, err := readPEM(ref)
+		if err != nil {
+			return t.Status(), errors.Wrap(err, errors.ConfigError, "failed to read TLS material")
+		}
+		pem[i] = b
+	}
+
+	t.mu.RLock()
+	unchanged := t.cert != nil && bytes.Equal(pem[0], t.pem[0]) &&
+		bytes.Equal(pem[1], t.pem[1]) && bytes.Equal(pem[2], t.pem[2])
+	t.mu.RUnlock()
+	if unchanged {
+		return t.Status(), nil
+	}
+
+	cert, err := tls.X509KeyPair(pem[0], pem[1])
+	if err != nil {
+		return t.Status(), errors.Wrap(err, errors.ConfigError, "invalid TLS certificate or key")
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return t.Status(), errors.Wrap(err, errors.ConfigError, "invalid TLS certificate")
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(pem[2]) {
+		return t.Status(), errors.NewConfigError("no CA certificate found in " + t.CAFile)
+	}
+
+	t.mu.Lock()
+	t.cert, t.roots, t.pem, t.loadedAt = &cert, roots, pem, time.Now()
+	t.mu.Unlock()
+
+	status := t.Status()
+	status.Reloaded = true
+	return status, nil
+}
+
+// Status reports the certificate presented to peers.
+func (t *PeerTLS) Status() TLSStatus {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.cert == nil {
+		return TLSStatus{}
+	}
+	leaf := t.cert.Leaf
+	return TLSStatus{
+		Subject:   leaf.Subject.String(),
+		Issuer:    leaf.Issuer.String(),
+		NotBefore: leaf.NotBefore,
+		NotAfter:  leaf.NotAfter,
+		LoadedAt:  t.loadedAt,
+	}
+}
+
+func (t *PeerTLS) current() (*tls.Certificate, *x509.CertPool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.cert, t.roots
+}
+
+// Config returns the TLS configuration of the connections to peers, which
+// follows the reloads.
+func (t *PeerTLS) Config() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert, _ := t.current()
+			return cert, nil
+		},
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, _ := t.current()
+			return cert, nil
+		},
+		// The certificates of peers are verified by verifyPeer, against
+		// the CAs of the moment and without a host name.
+		ClientAuth:         t.clientAuth(),
+		InsecureSkipVerify: true,
+		VerifyConnection:   t.verifyPeer,
+	}
+}
+
+func (t *PeerTLS) clientAuth() tls.ClientAuthType {
+	if t.OptionalClientCert {
+		return tls.RequestClientCert
+	}
+	return tls.RequireAnyClientCert
+}
+
+// verifyPeer checks the certificate chain presented by a peer against the
+// current CAs. Only peers dialing in can present none, a TLS server always
+// presenting its certificate.
+func (t *PeerTLS) verifyPeer(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		if t.OptionalClientCert {
+			return nil
+		}
+		return errors.NewAuthenticationError("peer presented no certificate")
+	}
+	_, roots := t.current()
+	intermediates := x509.NewCertPool()
+	for _, cert := range cs.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := cs.PeerCertificates[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return errors.Wrap(err, errors.AuthenticationError, "untrusted peer certificate")
+	}
+	return nil
+}
+
+// ReloadTLS reloads the certificate the node presents to its peers, and
+// the CAs it accepts theirs from.
+func (s *FileServer) ReloadTLS() (TLSStatus, error) {
+	if s.PeerTLS == nil {
+		return TLSStatus{}, errors.NewConfigError("peer TLS is not enabled")
+	}
+	status, err := s.PeerTLS.Reload()
+	if err == nil && status.Reloaded {
+		s.logger.Info("Reloaded the peer TLS certificate %s, valid until %s",
+			status.Subject, status.NotAfter.Format(time.RFC3339))
+	}
+	return status, err
+}
+
+// tlsLoop reloads the peer TLS certificates every TLSReloadInterval.
+func (s *FileServer) tlsLoop() {
+	ticker := s.Clock.NewTicker(s.TLSReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C():
+			if _, err := s.ReloadTLS(); err != nil {
+				s.logger.Warn("Failed to reload the peer TLS certificate: %v", err)
+			}
+		case <-s.quitch:
+			return
+		}
+	}
+}
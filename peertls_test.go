@@ -0,0 +1,233 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/anthdm/foreverstore/p2p"
+	"github.com/stretchr/testify/assert"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	assert.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns a certificate for name signed by the CA, and its key.
+func (ca *testCA) issue(t *testing.T, name string) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	assert.Nil(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// writePeerTLS writes a certificate for name signed by ca to dir, and
+// loads it.
+func writePeerTLS(t *testing.T, dir string, ca *testCA, name string) *PeerTLS {
+	certPEM, keyPEM := ca.issue(t, name)
+	assert.Nil(t, os.MkdirAll(dir, 0755))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "cert.pem"), certPEM, 0600))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "key.pem"), keyPEM, 0600))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "ca.pem"), ca.pem, 0600))
+	p, err := NewPeerTLS(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), filepath.Join(dir, "ca.pem"))
+	assert.Nil(t, err)
+	return p
+}
+
+// handshake connects client to server over TLS and returns the common
+// name of the certificate the server presented.
+func handshake(t *testing.T, server, client *PeerTLS) (string, error) {
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", server.Config())
+	assert.Nil(t, err)
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	conn, err := tls.Dial("tcp", listener.Addr().String(), client.Config())
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName, nil
+}
+
+func TestPeerTLSReloadsRenewedCertificate(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, "cluster CA")
+	server := writePeerTLS(t, filepath.Join(dir, "server"), ca, "node-1")
+	client := writePeerTLS(t, filepath.Join(dir, "client"), ca, "node-2")
+
+	name, err := handshake(t, server, client)
+	assert.Nil(t, err)
+	assert.Equal(t, "node-1", name)
+
+	status, err := server.Reload()
+	assert.Nil(t, err)
+	assert.False(t, status.Reloaded)
+
+	// A renewal caught halfway keeps the certificate in use.
+	certPEM, keyPEM := ca.issue(t, "node-1-renewed")
+	assert.Nil(t, os.WriteFile(server.CertFile, certPEM, 0600))
+	_, err = server.Reload()
+	assert.NotNil(t, err)
+	assert.Equal(t, "CN=node-1", server.Status().Subject)
+
+	assert.Nil(t, os.WriteFile(server.KeyFile, keyPEM, 0600))
+	status, err = server.Reload()
+	assert.Nil(t, err)
+	assert.True(t, status.Reloaded)
+	assert.Equal(t, "CN=node-1-renewed", status.Subject)
+
+	name, err = handshake(t, server, client)
+	assert.Nil(t, err)
+	assert.Equal(t, "node-1-renewed", name)
+}
+
+func TestPeerTLSRejectsUntrustedPeers(t *testing.T) {
+	dir := t.TempDir()
+	ca, otherCA := newTestCA(t, "cluster CA"), newTestCA(t, "other CA")
+	server := writePeerTLS(t, filepath.Join(dir, "server"), ca, "node-1")
+	stranger := writePeerTLS(t, filepath.Join(dir, "stranger"), otherCA, "node-2")
+
+	_, err := handshake(t, server, stranger)
+	assert.NotNil(t, err)
+
+	// Moving to a new CA: trusting both lets the nodes of either in.
+	both := append(append([]byte{}, ca.pem...), otherCA.pem...)
+	for _, p := range []*PeerTLS{server, stranger} {
+		assert.Nil(t, os.WriteFile(p.CAFile, both, 0600))
+		_, err = p.Reload()
+		assert.Nil(t, err)
+	}
+	_, err = handshake(t, server, stranger)
+	assert.Nil(t, err)
+}
+
+func TestTCPTransportOverTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, "cluster CA")
+	newTransport := func(addr string, p *PeerTLS) (*p2p.TCPTransport, chan p2p.Peer) {
+		peers := make(chan p2p.Peer, 1)
+		tr := p2p.NewTCPTransport(p2p.TCPTransportOpts{
+			ListenAddr:    addr,
+			HandshakeFunc: p2p.NOPHandshakeFunc,
+			Decoder:       p2p.DefaultDecoder{},
+			OnPeer:        func(peer p2p.Peer) error { peers <- peer; return nil },
+			TLSConfig:     p.Config(),
+		})
+		t.Cleanup(func() { tr.Close() })
+		return tr, peers
+	}
+
+	// Get a free port
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	addr := ln.Addr().String()
+	ln.Close()
+
+	listener, accepted := newTransport(addr, writePeerTLS(t, filepath.Join(dir, "1"), ca, "node-1"))
+	assert.Nil(t, listener.ListenAndAccept())
+
+	dialer, dialed := newTransport(":0", writePeerTLS(t, filepath.Join(dir, "2"), ca, "node-2"))
+	assert.Nil(t, dialer.Dial(addr))
+	for _, peers := range []chan p2p.Peer{dialed, accepted} {
+		select {
+		case <-peers:
+		case <-time.After(5 * time.Second):
+			t.Fatal("TLS peers did not connect")
+		}
+	}
+
+	stranger, _ := newTransport(":0", writePeerTLS(t, filepath.Join(dir, "3"), newTestCA(t, "other CA"), "node-3"))
+	assert.NotNil(t, stranger.Dial(addr))
+	select {
+	case <-accepted:
+		t.Fatal("untrusted peer connected")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestPeerTLSOptionalClientCert(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, "cluster CA")
+	server := writePeerTLS(t, filepath.Join(dir, "server"), ca, "node-1")
+	stranger := writePeerTLS(t, filepath.Join(dir, "stranger"), newTestCA(t, "other CA"), "node-2")
+
+	// accept returns how the server took to a client dialing in with
+	// config.
+	accept := func(config *tls.Config) error {
+		listener, err := tls.Listen("tcp", "127.0.0.1:0", server.Config())
+		assert.Nil(t, err)
+		defer listener.Close()
+		result := make(chan error, 1)
+		go func() {
+			conn, err := listener.Accept()
+			if err != nil {
+				result <- err
+				return
+			}
+			defer conn.Close()
+			result <- conn.(*tls.Conn).Handshake()
+		}()
+		conn, err := tls.Dial("tcp", listener.Addr().String(), config)
+		if err == nil {
+			defer conn.Close()
+		}
+		return <-result
+	}
+	anonymous := &tls.Config{InsecureSkipVerify: true}
+
+	assert.NotNil(t, accept(anonymous))
+	server.OptionalClientCert = true
+	assert.Nil(t, accept(anonymous))
+	// Certificates that are presented must still be trusted.
+	assert.NotNil(t, accept(stranger.Config()))
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/anthdm/foreverstore/errors"
+)
+
+// Query selects objects by key prefix and tags. Tags are the attributes
+// clients store along with objects: an object matches when it carries every
+// tag of the query with the same value, or with any value when the query
+// leaves the value empty.
+type Query struct {
+	Prefix string
+	Tags   map[string]string
+	// Limit bounds the number of results each node returns. Zero means
+	// defaultQueryLimit.
+	Limit int
+}
+
+// QueryResult is an object found by a query, with the metadata the query
+// matched it on.
+type QueryResult struct {
+	// Node is the ID of the node that stored the object.
+	Node      string            `json:"node"`
+	Key       string            `json:"key"`
+	Size      int64             `json:"size"`
+	Encrypted bool              `json:"encrypted,omitempty"`
+	Tags      map[string]string `json:"tags,omitempty"`
+}
+
+// MessageQuery asks a peer for the objects it stored that match a query.
+type MessageQuery struct {
+	Query Query
+}
+
+// MessageQueryResult answers a MessageQuery.
+type MessageQueryResult struct {
+	Results []QueryResult
+}
+
+const (
+	defaultQueryLimit   = 100
+	maxQueryLimit       = 1000
+	defaultQueryTimeout = 5 * time.Second
+	// queryPageSize is the number of keys read at a time while a node
+	// evaluates a query.
+	queryPageSize = 500
+)
+
+// Validate checks the query and fills in the default limit.
+func (q *Query) Validate() error {
+	if q.Limit == 0 {
+		q.Limit = defaultQueryLimit
+	}
+	if q.Limit < 0 || q.Limit > maxQueryLimit {
+		return errors.NewValidationError(fmt.Sprintf("query limit must be between 1 and %d", maxQueryLimit))
+	}
+	return nil
+}
+
+func (q Query) matches(meta ObjectMeta) bool {
+	if len(q.Tags) == 0 {
+		return true
+	}
+	if meta.Client == nil {
+		return false
+	}
+	for name, want := range q.Tags {
+		have, ok := meta.Client.Attributes[name]
+		if !ok || (want != "" && have != want) {
+			return false
+		}
+	}
+	return true
+}
+
+// QueryLocal returns the objects stored by this node that match q. Keys are
+// read a page at a time, so the whole key space is never held in memory.
+func (s *FileServer) QueryLocal(q Query) ([]QueryResult, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+
+	var results []QueryResult
+	for cursor := ""; ; {
+		entries, next, err := s.store.Iterate(s.ID, q.Prefix, cursor, queryPageSize)
+		if err != nil {
+			return nil, errors.Wrap(err, errors.StorageError, "failed to list objects")
+		}
+
+		for _, entry := range entries {
+			if entry.Key == "" {
+				continue
+			}
+			meta, err := s.store.ReadMeta(s.ID, entry.Key)
+			if err != nil && !os.IsNotExist(err) {
+				return nil, errors.Wrap(err, errors.StorageError, "failed to read object metadata")
+			}
+			if !q.matches(meta) {
+				continue
+			}
+
+			result := QueryResult{Node: s.ID, Key: entry.Key, Size: entry.Size}
+			if meta.Client != nil {
+				result.Encrypted = meta.Client.Encrypted
+				result.Tags = meta.Client.Attributes
+			}
+			results = append(results, result)
+			if len(results) == q.Limit {
+				return results, nil
+			}
+		}
+
+		if next == "" {
+			return results, nil
+		}
+		cursor = next
+	}
+}
+
+// Query finds the objects matching q across the cluster. Every node answers
+// for the objects it stored itself, so each object is reported once, by
+// its owner, with up to q.Limit results per node. Peers that have not
+// answered within timeout are left out of the results, which are then
+// partial.
+func (s *FileServer) Query(q Query, timeout time.Duration) ([]QueryResult, Partial, error) {
+	results, err := s.QueryLocal(q)
+	if err != nil {
+		return nil, Partial{}, err
+	}
+
+	answers, errs := requestPeers[MessageQueryResult](s, s.peerAddrs(), MessageQuery{Query: q}, timeout)
+	for _, answer := range answers {
+		results = append(results, answer.Results...)
+	}
+	for addr, err := range errs {
+		s.logger.Warn("Peer %s did not answer query: %v", addr, err)
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Node != results[j].Node {
+			return results[i].Node < results[j].Node
+		}
+		return results[i].Key < results[j].Key
+	})
+	return results, partialAnswer(errs), nil
+}
+
+// answerQuery runs the query of a peer on this node.
+func (s *FileServer) answerQuery(msg MessageQuery) (MessageQueryResult, error) {
+	results, err := s.QueryLocal(msg.Query)
+	return MessageQueryResult{Results: results}, err
+}
+
+// parseTags parses tag predicates given as name=value, or as a bare name
+// matching any value. Names are case insensitive, as they are for the
+// attributes stored through the HTTP API.
+func parseTags(specs []string) map[string]string {
+	if len(specs) == 0 {
+		return nil
+	}
+	tags := make(map[string]string, len(specs))
+	for _, spec := range specs {
+		name, value, _ := strings.Cut(spec, "=")
+		tags[strings.ToLower(strings.TrimSpace(name))] = value
+	}
+	return tags
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/anthdm/foreverstore/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueryMatchesTags(t *testing.T) {
+	meta := ObjectMeta{Client: &ClientMeta{Attributes: map[string]string{"team": "finance", "year": "2024"}}}
+
+	assert.True(t, Query{}.matches(ObjectMeta{}))
+	assert.True(t, Query{Tags: map[string]string{"team": "finance"}}.matches(meta))
+	assert.True(t, Query{Tags: map[string]string{"year": ""}}.matches(meta))
+	assert.False(t, Query{Tags: map[string]string{"team": "legal"}}.matches(meta))
+	assert.False(t, Query{Tags: map[string]string{"team": ""}}.matches(ObjectMeta{}))
+
+	q := Query{Limit: maxQueryLimit + 1}
+	assert.True(t, errors.IsType(q.Validate(), errors.ValidationError))
+}
+
+func TestQueryFindsObjectsAcrossCluster(t *testing.T) {
+	c := newTestCluster(t, 3)
+
+	finance := &ClientMeta{Attributes: map[string]string{"team": "finance"}}
+	legal := &ClientMeta{Attributes: map[string]string{"team": "legal"}}
+	c.storeObject(0, "reports/q1", []byte("q1"), finance)
+	c.storeObject(1, "reports/q2", []byte("q2"), finance)
+	c.storeObject(2, "reports/contract", []byte("contract"), legal)
+	c.storeObject(2, "notes/q3", []byte("q3"), finance)
+
+	query := func(q Query) []string {
+		var results []QueryResult
+		err := c.run("query", func() (err error) {
+			results, _, err = c.nodes[0].Query(q, defaultQueryTimeout)
+			return err
+		})
+		assert.Nil(t, err)
+
+		keys := make([]string, len(results))
+		for i, r := range results {
+			keys[i] = r.Key
+		}
+		return keys
+	}
+
+	// Replicas are not reported again by the nodes holding them.
+	assert.ElementsMatch(t, []string{"reports/q1", "reports/q2", "reports/contract"}, query(Query{Prefix: "reports/"}))
+	assert.ElementsMatch(t, []string{"reports/q1", "reports/q2", "notes/q3"}, query(Query{Tags: map[string]string{"team": "finance"}}))
+	assert.ElementsMatch(t, []string{"reports/q1", "reports/q2"}, query(Query{Prefix: "reports/", Tags: map[string]string{"team": "finance"}}))
+}
+
+func TestQueryReturnsWhatArrivedBeforeTimeout(t *testing.T) {
+	c := newTestCluster(t, 3)
+	c.store(0, "local", []byte("local"))
+	c.store(2, "remote", []byte("remote"))
+	c.partition([]int{0, 1})
+
+	var (
+		results []QueryResult
+		partial Partial
+	)
+	err := c.run("query", func() (err error) {
+		results, partial, err = c.nodes[0].Query(Query{}, defaultQueryTimeout)
+		return err
+	})
+	assert.Nil(t, err)
+	assert.Len(t, results, 1)
+	assert.Equal(t, "local", results[0].Key)
+	assert.True(t, partial.Partial)
+	assert.NotEmpty(t, partial.Unanswered)
+	for _, u := range partial.Unanswered {
+		assert.NotEmpty(t, u.Addr)
+		assert.NotEmpty(t, u.Error)
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/anthdm/foreverstore/errors"
+)
+
+// quotaPageSize is the number of keys read at a time while the usage of
+// the buckets is measured.
+const quotaPageSize = 1000
+
+// bucketUsage keeps the bytes of the objects this node owns, by bucket.
+// It is measured with every capacity report and kept up to date by the
+// writes and deletes made in between.
+type bucketUsage struct {
+	mu     sync.Mutex
+	loaded bool
+	bytes  map[string]int64
+}
+
+func (u *bucketUsage) set(usage map[string]int64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.bytes = make(map[string]int64, len(usage))
+	for bucket, n := range usage {
+		u.bytes[bucket] = n
+	}
+	u.loaded = true
+}
+
+// add counts delta more bytes in the bucket of key. Usage not measured yet
+// is left alone, the measurement counts them.
+func (u *bucketUsage) add(key string, delta int64) {
+	bucket := bucketOf(key)
+	if bucket == "" || delta == 0 {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.loaded {
+		u.bytes[bucket] += delta
+	}
+}
+
+func (u *bucketUsage) get() (map[string]int64, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if !u.loaded {
+		return nil, false
+	}
+	usage := make(map[string]int64, len(u.bytes))
+	for bucket, n := range u.bytes {
+		usage[bucket] = n
+	}
+	return usage, true
+}
+
+// measureBucketUsage sums the size of the objects this node owns by
+// bucket. Objects in the cold tier count with the size of their cold copy.
+func (s *FileServer) measureBucketUsage() (map[string]int64, error) {
+	usage := make(map[string]int64)
+	for cursor := ""; ; {
+		entries, next, err := s.store.Iterate(s.ID, "", cursor, quotaPageSize)
+		if err != nil {
+			return nil, errors.Wrap(err, errors.StorageError, "failed to list objects")
+		}
+		for _, entry := range entries {
+			bucket := bucketOf(entry.Key)
+			if bucket == "" {
+				continue
+			}
+			size := entry.Size
+			if size == 0 {
+				if meta, err := s.store.ReadMeta(s.ID, entry.Key); err == nil && meta.Cold != nil {
+					size = meta.Cold.Size
+				}
+			}
+			usage[bucket] += size
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	s.bucketUsage.set(usage)
+	return usage, nil
+}
+
+// objectSize returns the size of the object this node owns under key, whose
+// metadata is meta, or zero when there is none.
+func (s *FileServer) objectSize(key string, meta ObjectMeta) int64 {
+	if meta.Cold != nil {
+		return meta.Cold.Size
+	}
+	if size := s.localSize(key); size >= 0 {
+		return size
+	}
+	return 0
+}
+
+// localSize returns the size of the local copy of the object of this node
+// stored under key, or -1 if it cannot be read.
+func (s *FileServer) localSize(key string) int64 {
+	size, r, err := s.store.Read(s.ID, key)
+	if err != nil {
+		return -1
+	}
+	r.(io.Closer).Close()
+	return size
+}
+
+// clusterBucketUsage returns the bytes stored in each bucket across the
+// cluster: what this node owns, and what its peers last reported owning.
+func (s *FileServer) clusterBucketUsage() (map[string]int64, error) {
+	usage, ok := s.bucketUsage.get()
+	if !ok {
+		var err error
+		if usage, err = s.measureBucketUsage(); err != nil {
+			return nil, err
+		}
+	}
+
+	s.capacity.mu.Lock()
+	defer s.capacity.mu.Unlock()
+	for _, c := range s.capacity.peers {
+		for bucket, n := range c.Buckets {
+			usage[bucket] += n
+		}
+	}
+	return usage, nil
+}
+
+// quota is a limit on the bytes stored in a set of buckets.
+type quota struct {
+	kind, name string
+	buckets    []string
+	maxBytes   int64
+}
+
+// quotasFor returns the quotas covering bucket.
+func (s *FileServer) quotasFor(bucket string) []quota {
+	var quotas []quota
+	for _, q := range s.quotas() {
+		for _, b := range q.buckets {
+			if b == bucket {
+				quotas = append(quotas, q)
+				break
+			}
+		}
+	}
+	return quotas
+}
+
+// quotas returns the configured quotas, bucket quotas first.
+func (s *FileServer) quotas() []quota {
+	s.settingsLock.RLock()
+	defer s.settingsLock.RUnlock()
+	var quotas []quota
+	for _, q := range s.BucketQuotas {
+		quotas = append(quotas, quota{kind: "bucket", name: q.Bucket, buckets: []string{q.Bucket}, maxBytes: q.MaxBytes})
+	}
+	for _, q := range s.TenantQuotas {
+		quotas = append(quotas, quota{kind: "tenant", name: q.Tenant, buckets: q.Buckets, maxBytes: q.MaxBytes})
+	}
+	return quotas
+}
+
+// checkQuota fails with a QuotaExceededError when growing the objects in
+// the bucket of key by delta bytes would exceed a quota covering it.
+func (s *FileServer) checkQuota(key string, delta int64) error {
+	bucket := bucketOf(key)
+	if bucket == "" || delta <= 0 {
+		return nil
+	}
+	quotas := s.quotasFor(bucket)
+	if len(quotas) == 0 {
+		return nil
+	}
+	usage, err := s.clusterBucketUsage()
+	if err != nil {
+		return err
+	}
+
+	for _, q := range quotas {
+		var used int64
+		for _, b := range q.buckets {
+			used += usage[b]
+		}
+		if used+delta <= q.maxBytes {
+			continue
+		}
+		return errors.NewQuotaExceededError(fmt.Sprintf("%s %q is over its quota: %d of %d bytes used, %d more requested",
+			q.kind, q.name, used, q.maxBytes, delta)).
+			WithContext("key", key).
+			WithContext(q.kind, q.name).
+			WithContext("used_bytes", used).
+			WithContext("limit_bytes", q.maxBytes).
+			WithContext("requested_bytes", delta)
+	}
+	return nil
+}
+
+// QuotaUsage is how much of a quota is used across the cluster.
+type QuotaUsage struct {
+	// Kind is "bucket" or "tenant".
+	Kind    string   `json:"kind"`
+	Name    string   `json:"name"`
+	Buckets []string `json:"buckets"`
+	Used    int64    `json:"used_bytes"`
+	Limit   int64    `json:"limit_bytes"`
+}
+
+// QuotaUsage returns the usage of every configured quota, bucket quotas
+// first.
+func (s *FileServer) QuotaUsage() ([]QuotaUsage, error) {
+	quotas := s.quotas()
+	if len(quotas) == 0 {
+		return []QuotaUsage{}, nil
+	}
+	usage, err := s.clusterBucketUsage()
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]QuotaUsage, len(quotas))
+	for i, q := range quotas {
+		result[i] = QuotaUsage{Kind: q.kind, Name: q.name, Buckets: q.buckets, Limit: q.maxBytes}
+		for _, b := range q.buckets {
+			result[i].Used += usage[b]
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/anthdm/foreverstore/config"
+	"github.com/anthdm/foreverstore/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func (c *testCluster) tryStore(node int, key string, size int) error {
+	c.t.Helper()
+	return c.run("store of "+key, func() error {
+		return c.nodes[node].Store(key, bytes.NewReader(bytes.Repeat([]byte("q"), size)))
+	})
+}
+
+func assertQuotaExceeded(t *testing.T, err error, kind, name string, used int64) {
+	t.Helper()
+	assert.True(t, errors.IsType(err, errors.QuotaExceededError), "%v", err)
+	fsErr, ok := err.(*errors.FileSystemError)
+	if !assert.True(t, ok) {
+		return
+	}
+	assert.Equal(t, name, fsErr.Context[kind])
+	assert.Equal(t, used, fsErr.Context["used_bytes"])
+}
+
+func TestQuotasAreEnforcedClusterWide(t *testing.T) {
+	c := newTestClusterWith(t, 2, func(node int, opts *FileServerOpts) {
+		opts.CapacityInterval = 100 * time.Millisecond
+		opts.BucketQuotas = []config.BucketQuota{{Bucket: "logs", MaxBytes: 60}}
+		opts.TenantQuotas = []config.TenantQuota{{Tenant: "acme", Buckets: []string{"logs", "media"}, MaxBytes: 100}}
+	})
+
+	assert.Nil(t, c.tryStore(0, "logs/a", 50))
+	assertQuotaExceeded(t, c.tryStore(0, "logs/b", 20), "bucket", "logs", 50)
+
+	// Replacing an object only counts the bytes it grows by.
+	assert.Nil(t, c.tryStore(0, "logs/a", 55))
+
+	// Usage on other nodes counts once it is gossiped.
+	assert.Nil(t, c.tryStore(1, "media/x", 40))
+	c.eventually("media usage to be gossiped", func() bool {
+		usage, err := c.nodes[0].clusterBucketUsage()
+		return err == nil && usage["media"] == 40
+	})
+	assertQuotaExceeded(t, c.tryStore(0, "media/y", 10), "tenant", "acme", 95)
+	assert.Nil(t, c.tryStore(0, "other/z", 500))
+
+	quotas, err := c.nodes[0].QuotaUsage()
+	assert.Nil(t, err)
+	assert.Equal(t, []QuotaUsage{
+		{Kind: "bucket", Name: "logs", Buckets: []string{"logs"}, Used: 55, Limit: 60},
+		{Kind: "tenant", Name: "acme", Buckets: []string{"logs", "media"}, Used: 95, Limit: 100},
+	}, quotas)
+
+	// Deletes free up the quota.
+	assert.Nil(t, c.run("delete of logs/a", func() error { return c.nodes[0].deleteObject("logs/a") }))
+	assert.Nil(t, c.tryStore(0, "media/y", 10))
+}
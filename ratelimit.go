@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/anthdm/foreverstore/admin"
+	"github.com/anthdm/foreverstore/clock"
+	"github.com/anthdm/foreverstore/config"
+	"github.com/anthdm/foreverstore/errors"
+)
+
+// rateLimiter is a token bucket filled with rate tokens a second, holding
+// up to a second of them. A zero rate lifts the limit. The rate can be
+// changed while the limiter is in use.
+type rateLimiter struct {
+	mu     sync.Mutex
+	clock  clock.Clock
+	rate   int64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(c clock.Clock, rate int64) *rateLimiter {
+	return &rateLimiter{clock: c, rate: rate, tokens: float64(rate), last: c.Now()}
+}
+
+// Rate returns the tokens added a second, zero when unlimited.
+func (l *rateLimiter) Rate() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+// SetRate changes the tokens added a second, zero lifting the limit.
+func (l *rateLimiter) SetRate(rate int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill()
+	// A limit put in place starts with a full bucket.
+	if l.rate <= 0 || l.tokens > float64(rate) {
+		l.tokens = float64(rate)
+	}
+	l.rate = rate
+}
+
+// refill adds the tokens earned since the last call. It is called with mu
+// held.
+func (l *rateLimiter) refill() {
+	now := l.clock.Now()
+	if elapsed := now.Sub(l.last); elapsed > 0 {
+		l.tokens += elapsed.Seconds() * float64(l.rate)
+		if l.tokens > float64(l.rate) {
+			l.tokens = float64(l.rate)
+		}
+	}
+	l.last = now
+}
+
+// allow takes a token if one is left.
+func (l *rateLimiter) allow() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate <= 0 {
+		return true
+	}
+	l.refill()
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// wait takes n tokens, waiting for those missing to be added.
+func (l *rateLimiter) wait(n int) {
+	l.mu.Lock()
+	if l.rate <= 0 {
+		l.mu.Unlock()
+		return
+	}
+	l.refill()
+	l.tokens -= float64(n)
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	if delay > 0 {
+		l.clock.Sleep(delay)
+	}
+}
+
+// throttledWriter writes to w no faster than its limiter allows, a byte
+// taking a token.
+type throttledWriter struct {
+	io.Writer
+	limiter *rateLimiter
+}
+
+func (w throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// Writes are split so that none waits for more than a second's
+		// worth of tokens.
+		n := len(p)
+		if rate := w.limiter.Rate(); rate > 0 && int64(n) > rate {
+			n = int(rate)
+		}
+		w.limiter.wait(n)
+		m, err := w.Writer.Write(p[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// rateLimited wraps the handler of a client endpoint so that requests past
+// the client rate limit are refused.
+func (s *FileServer) rateLimited(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.clientRate.allow() {
+			w.Header().Set("Retry-After", "1")
+			admin.WriteError(w, errors.NewRateLimitedError("too many requests"))
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// ClientRateLimit returns how many client requests a second the server
+// serves, zero when unlimited.
+func (s *FileServer) ClientRateLimit() int {
+	return int(s.clientRate.Rate())
+}
+
+// SetClientRateLimit changes how many client requests a second a running
+// server serves, zero lifting the limit.
+func (s *FileServer) SetClientRateLimit(rate int) {
+	s.clientRate.SetRate(int64(rate))
+}
+
+// PeerBandwidthLimit returns how many bytes a second the server sends its
+// peers, zero when unlimited.
+func (s *FileServer) PeerBandwidthLimit() int64 {
+	return s.peerBandwidth.Rate()
+}
+
+// SetPeerBandwidthLimit changes how many bytes a second a running server
+// sends its peers, zero lifting the limit.
+func (s *FileServer) SetPeerBandwidthLimit(rate int64) {
+	s.peerBandwidth.SetRate(rate)
+}
+
+// clientRateSetting exposes the client rate limit of s, in requests per
+// second, as a runtime setting backed by cfg.
+func clientRateSetting(cfg *config.Config, s *FileServer) config.RuntimeSetting {
+	return config.RuntimeSetting{
+		Get: func() string { return strconv.Itoa(cfg.ClientRateLimit) },
+		Set: func(value string) error {
+			rate, err := strconv.Atoi(value)
+			if err != nil || rate < 0 {
+				return fmt.Errorf("invalid client rate limit: %s", value)
+			}
+			cfg.ClientRateLimit = rate
+			s.SetClientRateLimit(rate)
+			return nil
+		},
+	}
+}
+
+// peerBandwidthSetting exposes the peer bandwidth limit of s, in bytes per
+// second, as a runtime setting backed by cfg.
+func peerBandwidthSetting(cfg *config.Config, s *FileServer) config.RuntimeSetting {
+	return config.RuntimeSetting{
+		Get: func() string { return strconv.FormatInt(cfg.PeerBandwidthLimit, 10) },
+		Set: func(value string) error {
+			rate, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || rate < 0 {
+				return fmt.Errorf("invalid peer bandwidth limit: %s", value)
+			}
+			cfg.PeerBandwidthLimit = rate
+			s.SetPeerBandwidthLimit(rate)
+			return nil
+		},
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/anthdm/foreverstore/admin"
+	"github.com/anthdm/foreverstore/clock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiterRefillsOverTime(t *testing.T) {
+	c := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	l := newRateLimiter(c, 2)
+
+	assert.True(t, l.allow())
+	assert.True(t, l.allow())
+	assert.False(t, l.allow())
+
+	c.Advance(500 * time.Millisecond)
+	assert.True(t, l.allow())
+	assert.False(t, l.allow())
+
+	// Lifting the limit lets everything through.
+	l.SetRate(0)
+	for i := 0; i < 10; i++ {
+		assert.True(t, l.allow())
+	}
+}
+
+func TestThrottledWriterWaitsForTokens(t *testing.T) {
+	c := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	l := newRateLimiter(c, 100)
+	var buf bytes.Buffer
+	w := throttledWriter{Writer: &buf, limiter: l}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		n, err := w.Write(make([]byte, 250))
+		assert.Nil(t, err)
+		assert.Equal(t, 250, n)
+	}()
+
+	// A second's worth is written at once, the rest as tokens are added.
+	for i := 0; i < 2; i++ {
+		c.BlockUntil(1)
+		c.Advance(time.Second)
+	}
+	<-done
+	assert.Equal(t, 250, buf.Len())
+}
+
+func TestClientRateLimitRefusesExcessRequests(t *testing.T) {
+	server := createTestServer(":0", t.TempDir(), []string{})
+	server.SetClientRateLimit(1)
+	a := admin.NewServer("127.0.0.1:0")
+	registerAdminHandlers(a, server)
+	srv := httptest.NewServer(a.Handler())
+	defer srv.Close()
+
+	req, _ := http.NewRequest(http.MethodPut, srv.URL+"/objects/a", bytes.NewReader([]byte("a")))
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	resp, err = http.Get(srv.URL + "/objects/a")
+	assert.Nil(t, err)
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "1", resp.Header.Get("Retry-After"))
+
+	server.SetClientRateLimit(0)
+	resp, err = http.Get(srv.URL + "/objects/a")
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/anthdm/foreverstore/errors"
+)
+
+const (
+	// readAheadFiles bounds the number of chunked files whose last read
+	// chunk is remembered.
+	readAheadFiles = 1024
+	// readAheadTimeout is how long a prefetch waits for the peers to say
+	// whether they hold the chunk.
+	readAheadTimeout = 500 * time.Millisecond
+)
+
+// chunkKey splits the key of a chunk, which ends in the chunk number like
+// "videos/clip/000012", into the key of its file and the number. Width is
+// the number of digits, kept in the keys of the chunks that follow.
+func chunkKey(key string) (file string, index, width int, ok bool) {
+	i := len(key)
+	for i > 0 && key[i-1] >= '0' && key[i-1] <= '9' {
+		i--
+	}
+	digits := key[i:]
+	if digits == "" || len(digits) > 9 {
+		return "", 0, 0, false
+	}
+	index, _ = strconv.Atoi(digits)
+	return key[:i], index, len(digits), true
+}
+
+// chunkName returns the key of chunk index of file.
+func chunkName(file string, index, width int) string {
+	return fmt.Sprintf("%s%0*d", file, width, index)
+}
+
+// readAheadTracker remembers the last chunk read of each chunked file, to
+// tell the files read in order.
+type readAheadTracker struct {
+	mu   sync.Mutex
+	last map[string]int
+}
+
+// sequential records that chunk index of file was read, and reports
+// whether it follows the chunk read before it.
+func (t *readAheadTracker) sequential(file string, index int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.last == nil {
+		t.last = make(map[string]int)
+	}
+	last, ok := t.last[file]
+	if !ok && len(t.last) >= readAheadFiles {
+		for f := range t.last {
+			delete(t.last, f)
+			break
+		}
+	}
+	t.last[file] = index
+	return ok && index == last+1
+}
+
+// readAhead prefetches the ReadAhead chunks following the one under key
+// when the chunks of its file are being read in order. Chunks missing
+// locally are fetched from the peers, and chunks in the cold tier are
+// brought back, in the background.
+func (s *FileServer) readAhead(key string) {
+	if s.ReadAhead <= 0 {
+		return
+	}
+	file, index, width, ok := chunkKey(key)
+	if !ok || !s.readAheads.sequential(file, index) {
+		return
+	}
+
+	for i := 1; i <= s.ReadAhead; i++ {
+		next := chunkName(file, index+i, width)
+		if s.store.Has(s.ID, next) {
+			if meta, err := s.store.ReadMeta(s.ID, next); err == nil && meta.Cold != nil {
+				go func() {
+					if err := s.rehydrate(next); err != nil {
+						s.logger.Warn("Failed to prefetch %s from the cold tier: %v", next, err)
+					}
+				}()
+			}
+			continue
+		}
+		s.fetches.prefetch(next, s.Clock.Now(), func() error {
+			err := s.prefetch(next)
+			if err != nil {
+				s.logger.Debug("Not prefetching %s: %v", next, err)
+			}
+			return err
+		})
+	}
+}
+
+// prefetch fetches the chunk under key from the peers, when one of the
+// ring owners of the chunk holds it: the chunks past the end of a file do
+// not exist. The owners are asked under fetchLock, so that their answers
+// are not held up behind the stream of another fetch.
+func (s *FileServer) prefetch(key string) error {
+	s.fetchLock.Lock()
+	defer s.fetchLock.Unlock()
+
+	if s.store.Has(s.ID, key) {
+		return nil
+	}
+	replicas, _ := s.fetchOrder(key)
+	answers, _ := requestPeers[MessageReplicaStatus](s, replicas, MessageCheckReplica{
+		ID:           s.ID,
+		Key:          hashKey(key),
+		PresenceOnly: true,
+	}, readAheadTimeout)
+	for _, answer := range answers {
+		if answer.Present {
+			s.logger.Info("Prefetching %s", key)
+			return s.requestFile(key, nil)
+		}
+	}
+	return errors.NewFileNotFoundError(key)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChunkKey(t *testing.T) {
+	file, index, width, ok := chunkKey("videos/clip/000012")
+	assert.True(t, ok)
+	assert.Equal(t, "videos/clip/", file)
+	assert.Equal(t, 12, index)
+	assert.Equal(t, "videos/clip/000013", chunkName(file, index+1, width))
+
+	file, index, width, ok = chunkKey("clip.part9")
+	assert.True(t, ok)
+	assert.Equal(t, "clip.part10", chunkName(file, index+1, width))
+
+	_, _, _, ok = chunkKey("videos/clip.mov")
+	assert.False(t, ok)
+}
+
+func TestSequentialReadsPrefetchNextChunks(t *testing.T) {
+	c := newTestClusterWith(t, 2, func(node int, opts *FileServerOpts) {
+		opts.ReadAhead = 2
+	})
+	s := c.nodes[0]
+
+	chunk := func(i int) string { return fmt.Sprintf("videos/clip/%03d", i) }
+	for i := 0; i < 6; i++ {
+		c.store(0, chunk(i), []byte(fmt.Sprintf("chunk %d", i)))
+		c.assertConverged(0, chunk(i))
+	}
+	for i := 1; i < 6; i++ {
+		assert.Nil(t, s.store.Delete(s.ID, chunk(i)))
+	}
+
+	// A single read is not a stream.
+	assert.Equal(t, []byte("chunk 0"), c.get(0, chunk(0)))
+	assert.Equal(t, 0, s.FetchStats().Prefetches)
+
+	// Reading the next chunk brings the two after it.
+	assert.Equal(t, []byte("chunk 1"), c.get(0, chunk(1)))
+	c.eventually("chunks 2 and 3 to be prefetched", func() bool {
+		return len(s.FetchStats().InFlight) == 0 && s.store.Has(s.ID, chunk(2)) && s.store.Has(s.ID, chunk(3))
+	})
+	assert.Equal(t, 2, s.FetchStats().Prefetches)
+
+	assert.Equal(t, []byte("chunk 2"), c.get(0, chunk(2)))
+	assert.Equal(t, []byte("chunk 3"), c.get(0, chunk(3)))
+	c.eventually("chunks 4 and 5 to be prefetched", func() bool {
+		return len(s.FetchStats().InFlight) == 0 && s.store.Has(s.ID, chunk(4)) && s.store.Has(s.ID, chunk(5))
+	})
+
+	// The chunks past the end of the file are not fetched.
+	assert.Equal(t, []byte("chunk 4"), c.get(0, chunk(4)))
+	assert.Equal(t, []byte("chunk 5"), c.get(0, chunk(5)))
+	c.eventually("prefetches to finish", func() bool {
+		return len(s.FetchStats().InFlight) == 0
+	})
+	assert.False(t, s.store.Has(s.ID, chunk(6)))
+	assert.False(t, s.store.Has(s.ID, chunk(7)))
+
+	stats := s.FetchStats()
+	assert.Equal(t, 1, stats.Fetches-stats.Prefetches)
+}
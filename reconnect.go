@@ -0,0 +1,143 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/anthdm/foreverstore/p2p"
+)
+
+// A node keeps dialing the bootstrap nodes it is not connected to: those
+// it lost the connection to, as they restarted, and those it could not
+// reach as it started. Dials, and the connections they open that are lost
+// at once, are retried with a backoff doubling from reconnectMinBackoff up
+// to ReconnectMaxBackoff, so a node lost is not dialed while it restarts,
+// or while it dials this node back itself.
+
+// reconnectMinBackoff is how often the node checks it is connected to its
+// bootstrap nodes, and the first delay before dialing one again.
+const reconnectMinBackoff = time.Second
+
+// reconnectState tracks the dials of the bootstrap nodes the node is not
+// connected to, by address.
+type reconnectState struct {
+	mu       sync.Mutex
+	attempts map[string]int
+	next     map[string]time.Time
+}
+
+// due reports whether the bootstrap node at addr may be dialed at now.
+func (r *reconnectState) due(addr string, now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return !now.Before(r.next[addr])
+}
+
+// backoff returns the delay before the next dial of the bootstrap node at
+// addr, counting one more attempt. Callers hold r.mu.
+func (r *reconnectState) backoff(addr string, max time.Duration) time.Duration {
+	if r.next == nil {
+		r.attempts = make(map[string]int)
+		r.next = make(map[string]time.Time)
+	}
+	delay := reconnectMinBackoff << r.attempts[addr]
+	if delay > max || delay <= 0 {
+		return max
+	}
+	r.attempts[addr]++
+	return delay
+}
+
+// dialed records a dial of the bootstrap node at addr at now, failed with
+// err if not nil, and returns the delay before the next one. A dial that
+// succeeded is not tried again before the handshake has had the time to
+// complete, unless the connection is lost.
+func (r *reconnectState) dialed(addr string, now time.Time, max time.Duration, err error) time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delay := r.backoff(addr, max)
+	if err == nil {
+		delay = max
+	}
+	r.next[addr] = now.Add(delay)
+	return delay
+}
+
+// lost records that the connection to the bootstrap node at addr was lost
+// at now.
+func (r *reconnectState) lost(addr string, now time.Time, max time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.next[addr] = now.Add(r.backoff(addr, max))
+}
+
+// connected resets the backoff of the bootstrap node at addr.
+func (r *reconnectState) connected(addr string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.attempts, addr)
+	delete(r.next, addr)
+}
+
+// OnPeerDisconnect forgets the peer p once its connection is gone, having
+// failed with err.
+func (s *FileServer) OnPeerDisconnect(p p2p.Peer, err error) {
+	addr := p.RemoteAddr().String()
+	// The connection may have been replaced by another at the same address.
+	if current, ok := s.peer(addr); !ok || current != p {
+		return
+	}
+	if !s.dropPeer(addr) {
+		return
+	}
+	s.logger.Info("Lost connection with peer %s: %v", addr, err)
+	for _, bootstrap := range s.BootstrapNodes {
+		if bootstrap == addr {
+			s.reconnect.lost(addr, s.Clock.Now(), s.ReconnectMaxBackoff)
+		}
+	}
+}
+
+// reconnectLoop dials the bootstrap nodes the node is not connected to
+// until the server stops.
+func (s *FileServer) reconnectLoop() {
+	ticker := s.Clock.NewTicker(reconnectMinBackoff)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C():
+			s.reconnectBootstrap()
+		case <-s.quitch:
+			return
+		}
+	}
+}
+
+func (s *FileServer) reconnectBootstrap() {
+	// Followers join the cluster once promoted.
+	if s.following() {
+		return
+	}
+	for _, addr := range s.BootstrapNodes {
+		// Removed peers are connected to again once added back.
+		if addr == "" || s.removed.hasAddr(addr) {
+			continue
+		}
+		if s.connectedTo(addr) {
+			s.reconnect.connected(addr)
+			continue
+		}
+		now := s.Clock.Now()
+		if !s.reconnect.due(addr, now) {
+			continue
+		}
+		err := s.dial(addr)
+		delay := s.reconnect.dialed(addr, now, s.ReconnectMaxBackoff, err)
+		if err != nil {
+			s.logger.Warn("Failed to reconnect to bootstrap node %s, retrying in %v: %v", addr, delay, err)
+			continue
+		}
+		s.logger.Info("Reconnected to bootstrap node: %s", addr)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/anthdm/foreverstore/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLostBootstrapNodesAreReconnected(t *testing.T) {
+	c := newTestCluster(t, 2)
+	s := c.nodes[1]
+
+	// Node 1 loses its connection to its bootstrap node, and dials it again.
+	c.partition([]int{0}, []int{1})
+	c.faults[1].DropConnections()
+	c.eventually("the connection to be lost", func() bool { return len(s.Peers()) == 0 })
+	c.heal()
+	c.eventually("node 1 to reconnect", func() bool {
+		peers := s.Peers()
+		return len(peers) == 1 && peers[0].Addr == "node-0"
+	})
+	c.store(1, "after", []byte("written once reconnected"))
+	c.assertConverged(1, "after")
+}
+
+func TestReconnectBackoffDoubles(t *testing.T) {
+	var r reconnectState
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	refused := errors.NewConnectionError("connection refused")
+	var delays []time.Duration
+	for i := 0; i < 5; i++ {
+		delays = append(delays, r.dialed("node-0", now, 5*time.Second, refused))
+	}
+	assert.Equal(t, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}, delays)
+	assert.False(t, r.due("node-0", now.Add(4*time.Second)))
+	assert.True(t, r.due("node-0", now.Add(5*time.Second)))
+
+	// A dial that succeeds waits for the handshake, unless the connection
+	// is lost, which backs off as a failed dial.
+	r.connected("node-0")
+	assert.Equal(t, 5*time.Second, r.dialed("node-0", now, 5*time.Second, nil))
+	r.lost("node-0", now, 5*time.Second)
+	assert.False(t, r.due("node-0", now.Add(time.Second)))
+	assert.True(t, r.due("node-0", now.Add(2*time.Second)))
+
+	r.connected("node-0")
+	assert.True(t, r.due("node-0", now))
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"crypto/hmac"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/anthdm/foreverstore/errors"
+	"github.com/anthdm/foreverstore/p2p"
+)
+
+// MessageCheckReplica asks a peer whether its replica of an object is
+// valid: present, and decrypting to content that matches the integrity
+// tag.
+type MessageCheckReplica struct {
+	ID         string
+	Key        string
+	HMAC       []byte
+	KeyVersion uint32
+	// PresenceOnly asks whether the replica is present, without reading it.
+	PresenceOnly bool
+}
+
+// MessageReplicaStatus answers a MessageCheckReplica.
+type MessageReplicaStatus struct {
+	Present bool
+	Valid   bool
+	Error   string
+}
+
+// RepairReport is the outcome of repairing an object.
+type RepairReport struct {
+	Key string `json:"key"`
+	// LocalRepaired is set when the node's own copy was missing or
+	// corrupted and was restored from a valid replica.
+	LocalRepaired bool `json:"local_repaired,omitempty"`
+	// Valid lists the peers holding a valid replica, Repaired those that
+	// were sent one because theirs was missing or corrupted, and
+	// Unreachable those that did not answer.
+	Valid       []string `json:"valid"`
+	Repaired    []string `json:"repaired,omitempty"`
+	Unreachable []string `json:"unreachable,omitempty"`
+	Error       string   `json:"error,omitempty"`
+}
+
+// Healthy reports whether the object needed no repair.
+func (r RepairReport) Healthy() bool {
+	return !r.LocalRepaired && len(r.Repaired) == 0 && r.Error == ""
+}
+
+// RepairStatus reports the progress of a repair of all objects.
+type RepairStatus struct {
+	Running    bool      `json:"running"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at,omitempty"`
+	Checked    int       `json:"checked"`
+	Healthy    int       `json:"healthy"`
+	Repaired   int       `json:"repaired"`
+	Failed     int       `json:"failed"`
+	LastError  string    `json:"last_error,omitempty"`
+}
+
+const (
+	// defaultRepairTimeout bounds the wait for peers to check their
+	// replicas.
+	defaultRepairTimeout = 5 * time.Second
+	// repairPageSize is the number of keys read at a time while all
+	// objects are repaired.
+	repairPageSize = 500
+)
+
+// Repair checks every copy of an object stored by this node and restores
+// the broken ones. A missing or corrupted local copy is fetched again from
+// a peer holding a valid replica, and peers whose replica is missing or
+// corrupted are sent a new one. Peers that do not answer within the repair
+// timeout are left alone and reported as unreachable.
+func (s *FileServer) Repair(key string) (RepairReport, error) {
+	report := RepairReport{Key: key}
+	if err := s.beginOp(); err != nil {
+		return report, err
+	}
+	defer s.ops.end()
+
+	unlock := s.keyLocks.lock(key)
+	defer unlock()
+
+	meta, err := s.store.ReadMeta(s.ID, key)
+	if err != nil && !os.IsNotExist(err) {
+		return report, errors.Wrap(err, errors.StorageError, "failed to read object metadata")
+	}
+	if os.IsNotExist(err) && !s.store.Has(s.ID, key) {
+		// Nothing is left locally to check the replicas against; the first
+		// one passing the integrity tag it was stored with is taken.
+		if err := s.retry(func() error { return s.fetchFileFromNetwork(key, nil) }); err != nil {
+			return report, errors.Wrap(err, errors.FileNotFoundError, "no copy of the object is left")
+		}
+		report.LocalRepaired = true
+		if meta, err = s.store.ReadMeta(s.ID, key); err != nil {
+			// Without an integrity tag, the replicas cannot be checked.
+			return report, nil
+		}
+	}
+	if len(meta.HMAC) == 0 {
+		return report, errors.NewValidationError("object has no integrity tag to check its copies against").
+			WithContext("key", key)
+	}
+
+	localValid := meta.Cold != nil || s.localCopyValid(key, meta)
+	answers := s.checkReplicas(key, meta, defaultRepairTimeout)
+
+	peers := s.connectedPeers()
+	placed := s.replicaPlacement(key, meta, peers)
+
+	var broken []string
+	for addr := range peers {
+		status, ok := answers[addr]
+		_, wanted := placed[addr]
+		switch {
+		case !ok:
+			report.Unreachable = append(report.Unreachable, addr)
+		case status.Valid:
+			report.Valid = append(report.Valid, addr)
+		case status.Present || wanted:
+			broken = append(broken, addr)
+		}
+	}
+	sort.Strings(report.Valid)
+	sort.Strings(broken)
+	sort.Strings(report.Unreachable)
+
+	if !localValid {
+		if len(report.Valid) == 0 {
+			return report, errors.NewCorruptionError("no valid copy of the object is left").
+				WithContext("key", key)
+		}
+		if err := s.restoreLocal(key, meta, report.Valid, peers); err != nil {
+			return report, err
+		}
+		report.LocalRepaired = true
+	}
+
+	for _, addr := range broken {
+		if err := s.pushReplica(peers[addr], key, meta); err != nil {
+			s.logger.Warn("Failed to repair replica of %s on peer %s: %v", key, addr, err)
+			report.Error = err.Error()
+			continue
+		}
+		report.Repaired = append(report.Repaired, addr)
+		if !answers[addr].Present {
+			s.reserveReplica(addr, key, meta)
+		}
+	}
+
+	if !report.Healthy() {
+		s.logger.Info("Repaired %s: local copy restored %v, %d replicas restored",
+			key, report.LocalRepaired, len(report.Repaired))
+	}
+	return report, nil
+}
+
+// replicaPlacement returns the peers, among peers, meant to hold a replica
+// of the object of this node stored under key: those the policy of its
+// bucket does not leave out. It reserves no room on them: callers sending
+// a replica account for it with reserveReplica.
+func (s *FileServer) replicaPlacement(key string, meta ObjectMeta, peers map[string]p2p.Peer) map[string]p2p.Peer {
+	policy := s.bucketPolicy(key)
+	if policy.ReplicationFactor == 0 && len(policy.Sites) == 0 {
+		return peers
+	}
+	return s.placementOf(key, s.replicaSize(key, meta), func(string) bool { return true })
+}
+
+// replicaSize returns the size on the wire of the replica of the object of
+// this node stored under key.
+func (s *FileServer) replicaSize(key string, meta ObjectMeta) int64 {
+	return s.replicaEncryption(bucketOf(key)).size(s.objectSize(key, meta))
+}
+
+// reserveReplica counts the replica of the object stored under key, sent to
+// the peer at addr, against the usage of the peer until its next capacity
+// report.
+func (s *FileServer) reserveReplica(addr, key string, meta ObjectMeta) {
+	s.capacity.reserve(addr, s.replicaSize(key, meta))
+}
+
+// localCopyValid reports whether the node's own copy of an object matches
+// its integrity tag.
+func (s *FileServer) localCopyValid(key string, meta ObjectMeta) bool {
+	_, r, err := s.store.Read(s.ID, key)
+	if err != nil {
+		return false
+	}
+	defer r.(io.Closer).Close()
+
+	sum, err := computeIntegrity(s.keyRing.Lookup, meta.KeyVersion, r)
+	return err == nil && hmac.Equal(sum, meta.HMAC)
+}
+
+// restoreLocal fetches the object from the first of the peers holding a
+// valid replica that serves it, and puts back the metadata it had.
+func (s *FileServer) restoreLocal(key string, meta ObjectMeta, valid []string, peers map[string]p2p.Peer) error {
+	var lastErr error
+	for _, addr := range valid {
+		if err := s.fetchFrom(key, addr, peers[addr], nil); err != nil {
+			lastErr = err
+			continue
+		}
+		if err := s.store.WriteMeta(s.ID, key, meta); err != nil {
+			return errors.Wrap(err, errors.StorageError, "failed to write object metadata")
+		}
+		s.logger.Info("Restored local copy of %s from peer %s", key, addr)
+		return nil
+	}
+	return errors.Wrap(lastErr, errors.NetworkError, "failed to restore object from its replicas")
+}
+
+// pushReplica sends a single peer the replica of an object of this node.
+func (s *FileServer) pushReplica(peer p2p.Peer, key string, meta ObjectMeta) error {
+	return s.pushReplicaAttempt(peer, key, meta, 1)
+}
+
+// pushReplicaAttempt is pushReplica for the attempt-th time the replica is
+// sent, counting those found bad by the peer.
+func (s *FileServer) pushReplicaAttempt(peer p2p.Peer, key string, meta ObjectMeta, attempt int) error {
+	if meta.Cold != nil {
+		if err := s.rehydrateLocked(key); err != nil {
+			return err
+		}
+	}
+	size, r, err := s.store.Read(s.ID, key)
+	if err != nil {
+		return errors.Wrap(err, errors.StorageError, "failed to read object")
+	}
+	defer r.(io.Closer).Close()
+
+	addr := peer.RemoteAddr().String()
+	announce := s.storeFileMessage(key, meta, size)
+	jobs := s.startReplication([]string{key}, []string{addr}, announce.Size)
+	t := s.trace("replicate", key)
+	send := s.expectReplicas(key, []string{addr}, attempt)
+	announce.Replica = send.id
+	err = s.sendReplica(peer, announce, r, send, jobs[addr], t)
+	s.replicasSent(send, err)
+	t.done(err)
+	s.finishReplication(jobs, err)
+	return err
+}
+
+func (s *FileServer) sendReplica(peer p2p.Peer, announce MessageStoreFile, r io.Reader, send *replicaSend, job *replicationJob, t *opTrace) error {
+	addr := peer.RemoteAddr().String()
+	start := t.now()
+	unlock := s.sendLocks.lock(addr)
+	defer unlock()
+
+	if err := s.writeMessage(peer, &Message{Payload: announce}); err != nil {
+		return err
+	}
+
+	// Small delay to ensure the peer is ready
+	s.Clock.Sleep(5 * time.Millisecond)
+	t.since("peer_announce", start)
+
+	var waited time.Duration
+	w := t.timed(s.replication.writer(peer, job), peerPhase(addr), &waited)
+	start = t.now()
+	if err := peer.OpenStream(); err != nil {
+		return errors.Wrap(err, errors.NetworkError, "failed to send stream header")
+	}
+	if _, err := s.replicaEncryption(announce.Bucket).copy(r, io.MultiWriter(w, send)); err != nil {
+		return errors.Wrap(err, errors.EncryptionError, "failed to encrypt and send file data")
+	}
+	t.add("encrypt", t.now().Sub(start)-waited)
+	return nil
+}
+
+// checkReplicas asks every peer to check its replica of an object, and
+// returns the answers received within timeout by peer address.
+func (s *FileServer) checkReplicas(key string, meta ObjectMeta, timeout time.Duration) map[string]MessageReplicaStatus {
+	answers, _ := s.askReplicas(key, MessageCheckReplica{
+		ID:         s.ID,
+		Key:        hashKey(key),
+		HMAC:       meta.HMAC,
+		KeyVersion: meta.KeyVersion,
+	}, timeout)
+	return answers
+}
+
+// askReplicas sends msg to every peer, and returns the answers received
+// within timeout by peer address, partial when some peers did not answer.
+func (s *FileServer) askReplicas(key string, msg MessageCheckReplica, timeout time.Duration) (map[string]MessageReplicaStatus, Partial) {
+	answers, errs := requestPeers[MessageReplicaStatus](s, s.peerAddrs(), msg, timeout)
+	for addr, status := range answers {
+		if status.Error != "" {
+			s.logger.Warn("Peer %s failed to check its replica of %s: %s", addr, key, status.Error)
+		}
+	}
+	for addr, err := range errs {
+		s.logger.Warn("Peer %s did not answer the check of %s: %v", addr, key, err)
+	}
+	return answers, partialAnswer(errs)
+}
+
+// answerCheckReplica checks the replica of a peer's object on this node.
+func (s *FileServer) answerCheckReplica(msg MessageCheckReplica) MessageReplicaStatus {
+	reply := MessageReplicaStatus{Present: s.store.Has(msg.ID, msg.Key)}
+	if reply.Present && !msg.PresenceOnly {
+		valid, err := s.replicaValid(msg)
+		reply.Valid = valid
+		if err != nil {
+			reply.Error = err.Error()
+		}
+	}
+	return reply
+}
+
+// replicaValid decrypts a replica and compares its plaintext with the
+// integrity tag of the check.
+func (s *FileServer) replicaValid(msg MessageCheckReplica) (bool, error) {
+	_, r, err := s.store.Read(msg.ID, msg.Key)
+	if err != nil {
+		return false, err
+	}
+	defer r.(io.Closer).Close()
+
+	mac, err := newIntegrityHash(s.keyRing.Lookup, msg.KeyVersion)
+	if err != nil {
+		return false, err
+	}
+	meta, _ := s.store.ReadMeta(msg.ID, msg.Key)
+	if _, err := copyDecryptAuto(s.keyRing.Lookup, s.decryptSuites(meta.Bucket, meta.Cipher), r, mac); err != nil {
+		// A replica that fails to decrypt is corrupted.
+		return false, nil
+	}
+	return hmac.Equal(mac.Sum(nil), msg.HMAC), nil
+}
+
+// restoresReplica reports whether a store message carries the content a
+// replica was stored with, going by its integrity tag.
+func (s *FileServer) restoresReplica(msg MessageStoreFile) bool {
+	meta, err := s.store.ReadMeta(msg.ID, msg.Key)
+	return err == nil && len(meta.HMAC) > 0 && hmac.Equal(meta.HMAC, msg.HMAC)
+}
+
+// RepairAll repairs every object stored by this node in the background.
+func (s *FileServer) RepairAll() error {
+	s.repairLock.Lock()
+	defer s.repairLock.Unlock()
+
+	if s.repair.Running {
+		return errors.NewValidationError("a repair of all objects is still running")
+	}
+	s.repair = RepairStatus{Running: true, StartedAt: s.Clock.Now()}
+
+	s.logger.Info("Repairing all objects")
+	go s.repairStore()
+	return nil
+}
+
+// RepairStatus returns the progress of the last repair of all objects.
+func (s *FileServer) RepairStatus() RepairStatus {
+	s.repairLock.Lock()
+	defer s.repairLock.Unlock()
+	return s.repair
+}
+
+func (s *FileServer) updateRepair(fn func(*RepairStatus)) {
+	s.repairLock.Lock()
+	defer s.repairLock.Unlock()
+	fn(&s.repair)
+}
+
+func (s *FileServer) repairStore() {
+	defer func() {
+		s.updateRepair(func(st *RepairStatus) {
+			st.Running = false
+			st.FinishedAt = s.Clock.Now()
+		})
+		st := s.RepairStatus()
+		s.logger.Info("Repair finished: %d objects checked, %d repaired, %d failed",
+			st.Checked, st.Repaired, st.Failed)
+	}()
+
+	for cursor := ""; ; {
+		entries, next, err := s.store.Iterate(s.ID, "", cursor, repairPageSize)
+		if err != nil {
+			s.updateRepair(func(st *RepairStatus) { st.LastError = err.Error() })
+			return
+		}
+
+		for _, entry := range entries {
+			if entry.Key == "" {
+				continue
+			}
+			report, err := s.Repair(entry.Key)
+			if err == nil && report.Error != "" {
+				err = errors.NewNetworkError(report.Error)
+			}
+			s.updateRepair(func(st *RepairStatus) {
+				st.Checked++
+				switch {
+				case err != nil:
+					st.Failed++
+					st.LastError = err.Error()
+				case report.Healthy():
+					st.Healthy++
+				default:
+					st.Repaired++
+				}
+			})
+		}
+
+		if next == "" {
+			return
+		}
+		cursor = next
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/anthdm/foreverstore/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func (c *testCluster) repair(node int, key string) (RepairReport, error) {
+	c.t.Helper()
+	var report RepairReport
+	err := c.run("repair of "+key, func() (err error) {
+		report, err = c.nodes[node].Repair(key)
+		return err
+	})
+	return report, err
+}
+
+// corrupt overwrites node's copy of the key stored by origin, leaving its
+// metadata as it was.
+func (c *testCluster) corrupt(node, origin int, key string) {
+	c.t.Helper()
+	o := c.nodes[origin]
+	id, name := o.ID, key
+	if node != origin {
+		name = hashKey(key)
+	}
+	if _, err := c.nodes[node].store.Write(id, name, bytes.NewReader([]byte("bit rot"))); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func TestRepairRestoresCorruptedCopies(t *testing.T) {
+	c := newTestCluster(t, 3)
+	data := []byte("irreplaceable")
+	assert.Nil(t, c.storeLocked(0, "records/deed", data, retainFor(c, 24*time.Hour)))
+	c.assertConverged(0, "records/deed")
+
+	c.corrupt(0, 0, "records/deed")
+	c.corrupt(1, 0, "records/deed")
+
+	report, err := c.repair(0, "records/deed")
+	assert.Nil(t, err)
+	assert.True(t, report.LocalRepaired)
+	assert.Equal(t, []string{c.nodes[2].Transport.Addr()}, report.Valid)
+	assert.Equal(t, []string{c.nodes[1].Transport.Addr()}, report.Repaired)
+	assert.Equal(t, data, c.get(0, "records/deed"))
+
+	// The locked replica was restored to the content it was locked with.
+	meta, err := c.nodes[0].Meta("records/deed")
+	assert.Nil(t, err)
+	check := MessageCheckReplica{ID: c.nodes[0].ID, Key: hashKey("records/deed"), HMAC: meta.HMAC, KeyVersion: meta.KeyVersion}
+	c.eventually("replica to be repaired", func() bool {
+		valid, _ := c.nodes[1].replicaValid(check)
+		return valid
+	})
+	report, err = c.repair(0, "records/deed")
+	assert.Nil(t, err)
+	assert.True(t, report.Healthy())
+	assert.Len(t, report.Valid, 2)
+	assert.NotNil(t, c.replicaLock(1, 0, "records/deed"))
+}
+
+func TestRepairFetchesMissingLocalCopy(t *testing.T) {
+	c := newTestCluster(t, 2)
+	c.store(0, "photo", []byte("holiday"))
+	c.assertConverged(0, "photo")
+	assert.Nil(t, c.nodes[0].store.Delete(c.nodes[0].ID, "photo"))
+
+	report, err := c.repair(0, "photo")
+	assert.Nil(t, err)
+	assert.True(t, report.LocalRepaired)
+	assert.Equal(t, []byte("holiday"), c.get(0, "photo"))
+}
+
+func TestRepairReportsLostObject(t *testing.T) {
+	c := newTestCluster(t, 2)
+	c.store(0, "lost", []byte("gone"))
+	c.assertConverged(0, "lost")
+	c.corrupt(0, 0, "lost")
+	c.corrupt(1, 0, "lost")
+
+	_, err := c.repair(0, "lost")
+	assert.True(t, errors.IsType(err, errors.CorruptionError), "%v", err)
+}
+
+func TestRepairAll(t *testing.T) {
+	c := newTestCluster(t, 2)
+	s := c.nodes[0]
+	c.store(0, "healthy", []byte("fine"))
+	c.store(0, "degraded", []byte("missing a replica"))
+	c.assertConverged(0, "healthy")
+	c.assertConverged(0, "degraded")
+	assert.Nil(t, c.nodes[1].store.Delete(s.ID, hashKey("degraded")))
+
+	assert.Nil(t, s.RepairAll())
+	c.eventually("repair to finish", func() bool {
+		return !s.RepairStatus().Running
+	})
+	status := s.RepairStatus()
+	assert.Equal(t, 2, status.Checked)
+	assert.Equal(t, 1, status.Healthy)
+	assert.Equal(t, 1, status.Repaired)
+	assert.Zero(t, status.Failed)
+	c.eventually("replica to be restored", func() bool {
+		return c.holds(1, 0, "degraded")
+	})
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/anthdm/foreverstore/errors"
+	"github.com/anthdm/foreverstore/p2p"
+)
+
+// Replicas are verified as they are written: the peer hashes the bytes of
+// a replica as it persists them and answers with a MessageReplicaStored,
+// which is checked against the hash of what was sent. A replica that came
+// out short or different is sent again at once, up to replicaMaxAttempts
+// times, rather than go unnoticed until it is read.
+const (
+	replicaMaxAttempts = 3
+	// replicaAckTimeout is how long the acknowledgment of a replica is
+	// waited for before the replica is counted as unverified.
+	replicaAckTimeout = 30 * time.Second
+)
+
+// MessageReplicaStored acknowledges the replica numbered Replica of the
+// object stored under Key in namespace ID: Size is the number of bytes the
+// peer persisted and Hash their SHA-256. Error is set when the peer failed
+// to persist it, with ErrorType its type: a CorruptionError when the
+// replica did not match its announcement and the peer kept the replica it
+// held. Rejected is set when the peer kept a locked replica instead, or
+// refused the replica with Error, being read-only or holding a newer
+// version.
+type MessageReplicaStored struct {
+	ID        string
+	Key       string
+	Replica   uint64
+	Size      int64
+	Hash      []byte
+	Error     string
+	ErrorType errors.ErrorType
+	Rejected  bool
+}
+
+// pendingReplica is a replica sent to a peer whose acknowledgment is
+// awaited.
+type pendingReplica struct {
+	id      uint64
+	addr    string
+	key     string
+	attempt int
+	started time.Time
+	// size and hash describe what was sent, once all of it was; failed
+	// marks a replica that could not be sent.
+	size   int64
+	hash   []byte
+	sent   bool
+	failed bool
+	// ack is the acknowledgment received before the replica was all sent.
+	ack *MessageReplicaStored
+	// confirmed receives whether the peer persisted the replica as sent,
+	// once that is known, for stores waiting on their write consistency.
+	// It is shared by the replicas sent at once.
+	confirmed chan bool
+	settled   sync.Once
+}
+
+// settle records whether the peer persisted the replica as sent.
+func (p *pendingReplica) settle(ok bool) {
+	p.settled.Do(func() { p.confirmed <- ok })
+}
+
+// replicaAcks numbers the replicas sent and keeps those awaiting
+// acknowledgment by peer.
+type replicaAcks struct {
+	mu      sync.Mutex
+	next    uint64
+	pending map[string][]*pendingReplica
+}
+
+// expect numbers a replica of the object stored under key about to be sent
+// to the peers at addrs, and records it as awaited from each.
+func (a *replicaAcks) expect(addrs []string, key string, attempt int, now time.Time) []*pendingReplica {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.pending == nil {
+		a.pending = make(map[string][]*pendingReplica)
+	}
+	a.next++
+	replicas := make([]*pendingReplica, len(addrs))
+	confirmed := make(chan bool, len(addrs))
+	for i, addr := range addrs {
+		p := &pendingReplica{id: a.next, addr: addr, key: key, attempt: attempt, started: now, confirmed: confirmed}
+		a.pending[addr] = append(a.pending[addr], p)
+		replicas[i] = p
+	}
+	return replicas
+}
+
+// sent records that the replicas were sent whole, as size bytes hashing to
+// sum, or could not be, to any peer when err is set or to the dropped
+// peers, and returns those acknowledged already.
+func (a *replicaAcks) sent(replicas []*pendingReplica, size int64, sum []byte, err error, dropped map[string]error) []*pendingReplica {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var settled []*pendingReplica
+	for _, p := range replicas {
+		p.size, p.hash, p.sent, p.failed = size, sum, true, err != nil || dropped[p.addr] != nil
+		if p.failed {
+			p.settle(false)
+		}
+		if p.ack != nil {
+			a.remove(p)
+			settled = append(settled, p)
+		}
+	}
+	return settled
+}
+
+// acked matches an acknowledgment from the peer at addr with the replica
+// it awaits. The replica is returned when it was sent whole already, for
+// the acknowledgment to be checked.
+func (a *replicaAcks) acked(addr string, msg MessageReplicaStored) (*pendingReplica, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, p := range a.pending[addr] {
+		if p.id != msg.Replica || p.ack != nil {
+			continue
+		}
+		p.ack = &msg
+		if !p.sent {
+			return nil, false
+		}
+		a.remove(p)
+		return p, true
+	}
+	return nil, false
+}
+
+// expire returns and forgets the replicas awaiting acknowledgment since
+// before deadline.
+func (a *replicaAcks) expire(deadline time.Time) []*pendingReplica {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var expired []*pendingReplica
+	for _, replicas := range a.pending {
+		for _, p := range replicas {
+			if p.started.Before(deadline) {
+				expired = append(expired, p)
+			}
+		}
+	}
+	for _, p := range expired {
+		a.remove(p)
+		p.settle(false)
+	}
+	return expired
+}
+
+// forget drops the replicas awaiting acknowledgment from the peer at addr.
+func (a *replicaAcks) forget(addr string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, p := range a.pending[addr] {
+		p.settle(false)
+	}
+	delete(a.pending, addr)
+}
+
+// remove drops p from the replicas awaiting acknowledgment. Callers hold
+// mu.
+func (a *replicaAcks) remove(p *pendingReplica) {
+	replicas := a.pending[p.addr]
+	for i, q := range replicas {
+		if q == p {
+			replicas = append(replicas[:i], replicas[i+1:]...)
+			break
+		}
+	}
+	if len(replicas) == 0 {
+		delete(a.pending, p.addr)
+	} else {
+		a.pending[p.addr] = replicas
+	}
+}
+
+// replicaSend is a replica being sent to one or more peers at once. What
+// is sent is written to it to be hashed and counted.
+type replicaSend struct {
+	id       uint64
+	replicas []*pendingReplica
+	h        hash.Hash
+	n        int64
+	// confirmed receives whether each peer persisted its replica as sent.
+	confirmed <-chan bool
+	// dropped are the peers the replica could not be sent to, while it was
+	// sent to the others.
+	dropped map[string]error
+}
+
+func (r *replicaSend) Write(b []byte) (int, error) {
+	r.n += int64(len(b))
+	return r.h.Write(b)
+}
+
+// expectReplicas numbers the replica of the object stored under key about
+// to be sent to the peers at addrs, for the peers to acknowledge.
+func (s *FileServer) expectReplicas(key string, addrs []string, attempt int) *replicaSend {
+	replicas := s.replicaAcks.expect(addrs, key, attempt, s.Clock.Now())
+	r := &replicaSend{replicas: replicas, h: sha256.New()}
+	if len(replicas) > 0 {
+		r.id, r.confirmed = replicas[0].id, replicas[0].confirmed
+	}
+	return r
+}
+
+// replicasSent records the outcome of sending a replica, checking the
+// acknowledgments received already.
+func (s *FileServer) replicasSent(r *replicaSend, err error) {
+	for _, p := range s.replicaAcks.sent(r.replicas, r.n, r.h.Sum(nil), err, r.dropped) {
+		s.verifyReplica(p, *p.ack)
+	}
+}
+
+func (s *FileServer) handleMessageReplicaStored(from string, msg MessageReplicaStored) error {
+	if msg.ID != s.ID {
+		return nil
+	}
+	if p, ok := s.replicaAcks.acked(from, msg); ok {
+		s.verifyReplica(p, msg)
+	}
+	return nil
+}
+
+// verifyReplica checks the acknowledgment of a replica against what was
+// sent, and sends the replica again when they differ.
+func (s *FileServer) verifyReplica(p *pendingReplica, ack MessageReplicaStored) {
+	ok := false
+	defer func() { p.settle(ok) }()
+	var problem string
+	switch {
+	case p.failed:
+		// Failed to send: already counted and reported.
+		return
+	case ack.Rejected && ack.Error != "":
+		s.logger.Warn("Peer %s refused its replica of %s: %s", p.addr, p.key, ack.Error)
+		return
+	case ack.Rejected:
+		s.logger.Warn("Peer %s kept its locked replica of %s", p.addr, p.key)
+		return
+	case ack.ErrorType == errors.CorruptionError:
+		problem = fmt.Sprintf("peer rejected it: %s", ack.Error)
+	case ack.Error != "":
+		problem = fmt.Sprintf("peer failed to persist it: %s", ack.Error)
+	case ack.Size != p.size:
+		problem = fmt.Sprintf("peer persisted %d of %d bytes", ack.Size, p.size)
+	case !bytes.Equal(ack.Hash, p.hash):
+		problem = "peer persisted different content"
+	default:
+		s.replication.verified(p.addr, true)
+		ok = true
+		return
+	}
+
+	s.replication.verified(p.addr, false)
+	if p.attempt >= replicaMaxAttempts {
+		s.logger.Error("Replica of %s on %s is bad after %d attempts: %s", p.key, p.addr, p.attempt, problem)
+		return
+	}
+	s.logger.Warn("Replica of %s on %s is bad, sending it again: %s", p.key, p.addr, problem)
+	go s.resendReplica(p.addr, p.key, p.attempt+1)
+}
+
+// resendReplica sends the peer at addr the replica of the object of this
+// node stored under key again.
+func (s *FileServer) resendReplica(addr, key string, attempt int) {
+	if _, err := s.pushCurrentReplica(addr, key, attempt); err != nil {
+		s.logger.Warn("Failed to send replica of %s to %s again: %v", key, addr, err)
+	}
+}
+
+// pushCurrentReplica sends the peer at addr the replica of the object of
+// this node stored under key, as the object is now, and reports whether it
+// did: the object may have been deleted since it was decided to, or the
+// peer gone.
+func (s *FileServer) pushCurrentReplica(addr, key string, attempt int) (bool, error) {
+	peer, ok := s.peer(addr)
+	if !ok {
+		return false, nil
+	}
+	unlock := s.keyLocks.lock(key)
+	defer unlock()
+
+	meta, err := s.store.ReadMeta(s.ID, key)
+	if os.IsNotExist(err) && !s.store.Has(s.ID, key) {
+		// Deleted since.
+		return false, nil
+	}
+	if err := s.pushReplicaAttempt(peer, key, meta, attempt); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// expireReplicaAcks counts the replicas whose acknowledgment did not come
+// in time as unverified.
+func (s *FileServer) expireReplicaAcks() {
+	for _, p := range s.replicaAcks.expire(s.Clock.Now().Add(-replicaAckTimeout)) {
+		if p.sent && !p.failed {
+			s.logger.Warn("Replica of %s on %s was not acknowledged", p.key, p.addr)
+			s.replication.unverified(p.addr)
+		}
+	}
+}
+
+// ackReplica tells the peer that sent a replica what was persisted of it.
+// It is called on a goroutine of its own: the handler of the peer's
+// messages must not wait on sending to a peer that may itself be waiting
+// for the handler to read its next stream.
+func (s *FileServer) ackReplica(peer p2p.Peer, ack MessageReplicaStored) {
+	defer s.resources.start(poolReplicaAcks, 0)()
+	if err := s.sendMessage(peer, &Message{Payload: ack}); err != nil {
+		s.logger.Warn("Failed to acknowledge replica %s: %v", ack.Key, err)
+	}
+}
+
+// replicaStored is the acknowledgment of the replica announced by msg, of
+// which n bytes hashing to h were persisted before err, if any.
+func replicaStored(msg MessageStoreFile, n int64, h hash.Hash, err error) MessageReplicaStored {
+	ack := MessageReplicaStored{ID: msg.ID, Key: msg.Key, Replica: msg.Replica, Size: n, Hash: h.Sum(nil)}
+	if err != nil {
+		ack.Error = err.Error()
+		ack.ErrorType = errors.GetType(err)
+	}
+	return ack
+}
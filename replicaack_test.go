@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplicaAcks(t *testing.T) {
+	var a replicaAcks
+	now := time.Now()
+	first := a.expect([]string{"a", "b"}, "doc", 1, now)
+	second := a.expect([]string{"a"}, "doc", 1, now.Add(time.Second))
+	assert.NotEqual(t, first[0].id, second[0].id)
+
+	// An acknowledgment that overtakes the end of the stream waits for it.
+	_, ok := a.acked("a", MessageReplicaStored{Replica: first[0].id})
+	assert.False(t, ok)
+	assert.Equal(t, first[:1], a.sent(first, 3, []byte("sum"), nil, nil))
+
+	assert.Empty(t, a.sent(second, 3, []byte("sum"), nil, nil))
+	_, ok = a.acked("b", MessageReplicaStored{Replica: second[0].id})
+	assert.False(t, ok)
+	p, ok := a.acked("a", MessageReplicaStored{Replica: second[0].id})
+	assert.True(t, ok)
+	assert.Equal(t, second[0], p)
+	p, ok = a.acked("b", MessageReplicaStored{Replica: first[1].id})
+	assert.True(t, ok)
+	assert.Equal(t, first[1], p)
+	assert.Empty(t, a.pending)
+
+	old := a.expect([]string{"a"}, "doc", 1, now)
+	a.expect([]string{"a"}, "doc", 1, now.Add(time.Minute))
+	assert.Equal(t, old, a.expire(now.Add(time.Second)))
+	a.forget("a")
+	assert.Empty(t, a.pending)
+}
+
+func TestReplicasVerifiedAndResent(t *testing.T) {
+	c := newTestCluster(t, 3)
+	s := c.nodes[0]
+
+	c.store(0, "doc", bytes.Repeat([]byte("replica "), 64))
+	c.assertConverged(0, "doc")
+	c.eventually("replicas to be verified", func() bool {
+		stats := s.ReplicationStats()
+		return len(stats) == 2 && stats[0].Verified == 1 && stats[1].Verified == 1
+	})
+
+	// A replica that comes out short is sent again at once.
+	peer := c.nodes[1]
+	path := filepath.Join(peer.store.Root, s.ID, peer.store.PathTransformFunc(hashKey("doc")).FullPath())
+	info, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Nil(t, os.Truncate(path, 3))
+
+	send := s.expectReplicas("doc", []string{"node-1"}, 1)
+	send.n = info.Size()
+	assert.Nil(t, s.handleMessageReplicaStored("node-1", MessageReplicaStored{ID: s.ID, Key: hashKey("doc"), Replica: send.id, Size: 3}))
+	s.replicasSent(send, nil)
+
+	c.eventually("replica to be sent again", func() bool {
+		st := s.ReplicationStats()[0]
+		return st.Mismatched == 1 && st.Verified == 2
+	})
+	restored, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, info.Size(), restored.Size())
+	assert.Equal(t, "node-1", s.ReplicationStats()[0].Peer)
+}
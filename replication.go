@@ -0,0 +1,182 @@
+package main
+
+import (
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/anthdm/foreverstore/p2p"
+)
+
+// PeerReplicationStats reports how replication of this node's objects to
+// one peer is keeping up. A peer whose pending replicas grow, or whose
+// oldest pending replica keeps aging, is falling behind.
+type PeerReplicationStats struct {
+	Peer string `json:"peer"`
+	// Pending is the number of replicas being sent to the peer, and
+	// PendingBytes the part of them not sent yet. OldestPending is how
+	// long the oldest of them has been waiting.
+	Pending       int           `json:"pending"`
+	PendingBytes  int64         `json:"pending_bytes"`
+	OldestPending time.Duration `json:"oldest_pending_ns"`
+	// Replicated and Failed count the replicas sent to the peer, and
+	// BytesSent their size on the wire.
+	Replicated     int       `json:"replicated"`
+	Failed         int       `json:"failed"`
+	BytesSent      int64     `json:"bytes_sent"`
+	LastReplicated time.Time `json:"last_replicated,omitempty"`
+	// Verified counts the replicas the peer acknowledged persisting as
+	// sent, Mismatched those it persisted short or different, and
+	// Unverified those it did not acknowledge in time.
+	Verified   int `json:"verified"`
+	Mismatched int `json:"mismatched"`
+	Unverified int `json:"unverified"`
+}
+
+// replicationJob is a replica being sent to a peer.
+type replicationJob struct {
+	peer    string
+	started time.Time
+	size    int64
+	sent    int64
+	// transfer reports the replica among the transfers of the node.
+	transfer *transfer
+}
+
+type peerReplication struct {
+	stats   PeerReplicationStats
+	pending map[*replicationJob]struct{}
+}
+
+// replicationTracker keeps the replication stats of every peer.
+type replicationTracker struct {
+	mu    sync.Mutex
+	peers map[string]*peerReplication
+}
+
+func (t *replicationTracker) peer(addr string) *peerReplication {
+	if t.peers == nil {
+		t.peers = make(map[string]*peerReplication)
+	}
+	p, ok := t.peers[addr]
+	if !ok {
+		p = &peerReplication{
+			stats:   PeerReplicationStats{Peer: addr},
+			pending: make(map[*replicationJob]struct{}),
+		}
+		t.peers[addr] = p
+	}
+	return p
+}
+
+// start records a replica of size bytes on the wire waiting to be sent to
+// each of the peers.
+func (t *replicationTracker) start(peers []string, size int64, now time.Time) map[string]*replicationJob {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	jobs := make(map[string]*replicationJob, len(peers))
+	for _, addr := range peers {
+		job := &replicationJob{peer: addr, started: now, size: size}
+		t.peer(addr).pending[job] = struct{}{}
+		jobs[addr] = job
+	}
+	return jobs
+}
+
+func (t *replicationTracker) progress(job *replicationJob, n int) {
+	t.mu.Lock()
+	job.sent += int64(n)
+	t.mu.Unlock()
+	job.transfer.add(n)
+}
+
+// finish records the outcome of the replicas sent to each peer.
+func (t *replicationTracker) finish(jobs map[string]*replicationJob, err error, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for addr, job := range jobs {
+		p := t.peer(addr)
+		delete(p.pending, job)
+		p.stats.BytesSent += job.sent
+		if err != nil {
+			p.stats.Failed++
+			continue
+		}
+		p.stats.Replicated++
+		p.stats.LastReplicated = now
+	}
+}
+
+// verified records the check of a replica acknowledged by the peer at addr.
+func (t *replicationTracker) verified(addr string, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if ok {
+		t.peer(addr).stats.Verified++
+	} else {
+		t.peer(addr).stats.Mismatched++
+	}
+}
+
+// unverified records a replica the peer at addr did not acknowledge.
+func (t *replicationTracker) unverified(addr string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.peer(addr).stats.Unverified++
+}
+
+// trackedWriter records the bytes written to a peer against a job.
+type trackedWriter struct {
+	io.Writer
+	tracker *replicationTracker
+	job     *replicationJob
+}
+
+func (w trackedWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.tracker.progress(w.job, n)
+	return n, err
+}
+
+// writer returns peer, counting what is written to it against job when the
+// peer is tracked.
+func (t *replicationTracker) writer(peer p2p.Peer, job *replicationJob) io.Writer {
+	if job == nil {
+		return peer
+	}
+	return trackedWriter{Writer: peer, tracker: t, job: job}
+}
+
+// ReplicationStats returns the replication stats of every connected peer,
+// and of the peers gone since that were sent replicas, ordered by peer.
+func (s *FileServer) ReplicationStats() []PeerReplicationStats {
+	addrs := s.peers.addrs()
+
+	t := &s.replication
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, addr := range addrs {
+		t.peer(addr)
+	}
+	now := s.Clock.Now()
+	stats := make([]PeerReplicationStats, 0, len(t.peers))
+	for _, p := range t.peers {
+		st := p.stats
+		for job := range p.pending {
+			st.Pending++
+			if job.sent < job.size {
+				st.PendingBytes += job.size - job.sent
+			}
+			if age := now.Sub(job.started); age > st.OldestPending {
+				st.OldestPending = age
+			}
+		}
+		stats = append(stats, st)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Peer < stats[j].Peer })
+	return stats
+}
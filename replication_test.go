@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/anthdm/foreverstore/p2p"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplicationStatsTrackSlowPeers(t *testing.T) {
+	c := newTestCluster(t, 3)
+	s := c.nodes[0]
+
+	c.faults[0].SetFaults(p2p.FaultConfig{Latency: time.Second})
+	done := make(chan error, 1)
+	go func() { done <- s.Store("slow", bytes.NewReader(bytes.Repeat([]byte("x"), 4096))) }()
+
+	c.eventually("replicas to fall behind", func() bool {
+		stats := s.ReplicationStats()
+		return len(stats) == 2 &&
+			stats[0].Pending == 1 && stats[0].OldestPending >= 500*time.Millisecond &&
+			stats[1].Pending == 1 && stats[1].PendingBytes > 0
+	})
+
+	c.faults[0].SetFaults(p2p.FaultConfig{})
+	assert.Nil(t, c.run("store to finish", func() error { return <-done }))
+
+	for _, st := range s.ReplicationStats() {
+		assert.Zero(t, st.Pending, st.Peer)
+		assert.Zero(t, st.PendingBytes, st.Peer)
+		assert.Zero(t, st.OldestPending, st.Peer)
+		assert.Equal(t, 1, st.Replicated, st.Peer)
+		assert.Greater(t, st.BytesSent, int64(4096), st.Peer)
+		assert.False(t, st.LastReplicated.IsZero(), st.Peer)
+	}
+}
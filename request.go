@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/anthdm/foreverstore/errors"
+)
+
+// MessageRequest asks a peer for something, carried by Payload, that it
+// answers with the MessageResponse of the same ID. Requests spare the
+// features asking peers a question the numbering of their messages and
+// the matching of the answers.
+type MessageRequest struct {
+	ID      string
+	Payload any
+}
+
+// MessageResponse answers the MessageRequest of the same ID with the
+// payload the peer returned, or the error it failed with.
+type MessageResponse struct {
+	ID        string
+	Payload   any
+	Error     string
+	ErrorType errors.ErrorType
+}
+
+// pendingRequest is a request sent to the peer at addr waiting for its
+// response.
+type pendingRequest struct {
+	addr  string
+	reply chan MessageResponse
+}
+
+// request sends payload to the peer at addr and returns the payload of its
+// response. It fails with the error the peer answered with, when the peer
+// disconnects before answering, or when ctx is done first.
+func (s *FileServer) request(ctx context.Context, addr string, payload any) (any, error) {
+	peer, ok := s.peer(addr)
+	if !ok {
+		return nil, errors.NewConnectionError(fmt.Sprintf("peer %s not found", addr))
+	}
+
+	id := generateID()
+	reply := make(chan MessageResponse, 1)
+	s.requestLock.Lock()
+	s.requests[id] = pendingRequest{addr: addr, reply: reply}
+	s.requestLock.Unlock()
+	defer func() {
+		s.requestLock.Lock()
+		delete(s.requests, id)
+		s.requestLock.Unlock()
+	}()
+
+	if err := s.sendMessage(peer, &Message{Payload: MessageRequest{ID: id, Payload: payload}}); err != nil {
+		return nil, err
+	}
+
+	select {
+	case resp := <-reply:
+		if resp.Error != "" {
+			return nil, errors.New(resp.ErrorType, resp.Error).WithContext("peer", addr)
+		}
+		return resp.Payload, nil
+	case <-ctx.Done():
+		return nil, errors.Wrap(ctx.Err(), errors.TimeoutError, fmt.Sprintf("peer %s did not answer", addr))
+	}
+}
+
+// requestAs is request for responses of type T.
+func requestAs[T any](ctx context.Context, s *FileServer, addr string, payload any) (T, error) {
+	var zero T
+	resp, err := s.request(ctx, addr, payload)
+	if err != nil {
+		return zero, err
+	}
+	v, ok := resp.(T)
+	if !ok {
+		return zero, errors.New(errors.NetworkError, fmt.Sprintf("unexpected response %T from peer %s", resp, addr))
+	}
+	return v, nil
+}
+
+// requestPeers sends payload to each of the peers at addrs and returns the
+// responses of type T received within timeout by peer address, along with
+// the errors of the peers that failed to answer, or did not in time.
+func requestPeers[T any](s *FileServer, addrs []string, payload any, timeout time.Duration) (map[string]T, map[string]error) {
+	type answer struct {
+		addr string
+		resp T
+		err  error
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	answers := make(chan answer, len(addrs))
+	for _, addr := range addrs {
+		go func(addr string) {
+			resp, err := requestAs[T](ctx, s, addr, payload)
+			answers <- answer{addr: addr, resp: resp, err: err}
+		}(addr)
+	}
+
+	results := make(map[string]T, len(addrs))
+	errs := make(map[string]error)
+	deadline := s.Clock.After(timeout)
+	for received := 0; received < len(addrs); received++ {
+		select {
+		case a := <-answers:
+			if a.err != nil {
+				errs[a.addr] = a.err
+				continue
+			}
+			results[a.addr] = a.resp
+		case <-deadline:
+			for _, addr := range addrs {
+				if _, ok := results[addr]; !ok && errs[addr] == nil {
+					errs[addr] = errors.New(errors.TimeoutError, fmt.Sprintf("peer %s did not answer", addr))
+				}
+			}
+			return results, errs
+		}
+	}
+	return results, errs
+}
+
+// failRequests fails the requests waiting for an answer from the peer at
+// addr, which will not come.
+func (s *FileServer) failRequests(addr string) {
+	s.requestLock.Lock()
+	defer s.requestLock.Unlock()
+	for id, pending := range s.requests {
+		if pending.addr != addr {
+			continue
+		}
+		select {
+		case pending.reply <- MessageResponse{ID: id, Error: "peer disconnected", ErrorType: errors.ConnectionError}:
+		default:
+		}
+	}
+}
+
+func (s *FileServer) handleMessageRequest(from string, msg MessageRequest) error {
+	peer, ok := s.peer(from)
+	if !ok {
+		return errors.NewConnectionError(fmt.Sprintf("peer %s not found", from))
+	}
+
+	reply := MessageResponse{ID: msg.ID}
+	resp, err := s.answerRequest(from, msg.Payload)
+	if err != nil {
+		reply.Error = err.Error()
+		reply.ErrorType = errors.GetType(err)
+		if reply.ErrorType == "" {
+			reply.ErrorType = errors.InternalError
+		}
+	}
+	reply.Payload = resp
+	if _, ok := msg.Payload.(MessageFindNode); ok {
+		// Lookups come in while replicas stream between the peers, so the
+		// answer is sent on a goroutine of its own, as ackReplica is.
+		go func() {
+			if err := s.sendMessage(peer, &Message{Payload: reply}); err != nil {
+				s.logger.Warn("Failed to answer lookup of %s: %v", from, err)
+			}
+		}()
+		return nil
+	}
+	return s.sendMessage(peer, &Message{Payload: reply})
+}
+
+// answerRequest returns the response to the request of the peer at from.
+func (s *FileServer) answerRequest(from string, payload any) (any, error) {
+	switch v := payload.(type) {
+	case MessageProposeSettings:
+		s.logger.Debug("Handling cluster settings proposal from %s", from)
+		return s.answerProposeSettings(v)
+	case MessageQuery:
+		s.logger.Debug("Handling query from %s", from)
+		return s.answerQuery(v)
+	case MessageListFiles:
+		s.logger.Debug("Handling listing from %s", from)
+		return s.answerListFiles(v)
+	case MessageCheckReplica:
+		if !validNamespace(v.ID) {
+			return nil, errors.NewInvalidInputError("invalid node id in replica check")
+		}
+		s.logger.Debug("Handling replica check from %s", from)
+		return s.answerCheckReplica(v), nil
+	case MessageSyncDigest:
+		if !validNamespace(v.ID) {
+			return nil, errors.NewInvalidInputError("invalid node id in sync digest")
+		}
+		s.logger.Debug("Handling sync digest from %s", from)
+		return s.answerSyncDigest(v)
+	case MessageFindNode:
+		s.logger.Debug("Handling DHT lookup from %s", from)
+		return s.answerFindNode(v), nil
+	case MessageDescribeReplica:
+		if !validNamespace(v.ID) {
+			return nil, errors.NewInvalidInputError("invalid node id in replica description")
+		}
+		s.logger.Debug("Handling replica description from %s", from)
+		return s.answerDescribeReplica(v)
+	default:
+		return nil, errors.NewInvalidInputError(fmt.Sprintf("unsupported request %T", payload))
+	}
+}
+
+func (s *FileServer) handleMessageResponse(from string, msg MessageResponse) error {
+	s.requestLock.Lock()
+	pending, ok := s.requests[msg.ID]
+	s.requestLock.Unlock()
+	if !ok || pending.addr != from {
+		s.logger.Debug("Ignoring response from %s to unknown request %s", from, msg.ID)
+		return nil
+	}
+
+	select {
+	case pending.reply <- msg:
+	default:
+		s.logger.Warn("Dropping extra response from %s to request %s", from, msg.ID)
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/anthdm/foreverstore/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestReturnsTheResponseOfThePeer(t *testing.T) {
+	c := newTestCluster(t, 2)
+	c.store(1, "reports/q1", []byte("q1"))
+	ctx := context.Background()
+
+	var answer MessageQueryResult
+	err := c.run("query request", func() (err error) {
+		answer, err = requestAs[MessageQueryResult](ctx, c.nodes[0], "node-1", MessageQuery{Query: Query{Prefix: "reports/"}})
+		return err
+	})
+	assert.Nil(t, err)
+	if assert.Len(t, answer.Results, 1) {
+		assert.Equal(t, "reports/q1", answer.Results[0].Key)
+	}
+
+	// The errors of the peer come back with their type.
+	err = c.run("bad request", func() error {
+		_, err := requestAs[MessageReplicaStatus](ctx, c.nodes[0], "node-1", MessageCheckReplica{ID: ".."})
+		return err
+	})
+	assert.True(t, errors.IsType(err, errors.InvalidInputError), "got %v", err)
+
+	err = c.run("unsupported request", func() error {
+		_, err := c.nodes[0].request(ctx, "node-1", MessageGoodbye{})
+		return err
+	})
+	assert.True(t, errors.IsType(err, errors.InvalidInputError), "got %v", err)
+
+	// A response of another type than asked for is an error.
+	err = c.run("mistyped request", func() error {
+		_, err := requestAs[MessageReplicaStatus](ctx, c.nodes[0], "node-1", MessageQuery{})
+		return err
+	})
+	assert.NotNil(t, err)
+}
+
+func TestRequestFailsWhenThePeerGoesAway(t *testing.T) {
+	c := newTestCluster(t, 2)
+	c.partition([]int{0}, []int{1})
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.nodes[0].request(context.Background(), "node-1", MessageQuery{})
+		done <- err
+	}()
+	c.eventually("request to be sent", func() bool {
+		c.nodes[0].requestLock.Lock()
+		defer c.nodes[0].requestLock.Unlock()
+		return len(c.nodes[0].requests) == 1
+	})
+
+	c.nodes[0].dropPeer("node-1")
+	err := <-done
+	assert.True(t, errors.IsType(err, errors.ConnectionError), "got %v", err)
+
+	c.nodes[0].requestLock.Lock()
+	assert.Empty(t, c.nodes[0].requests)
+	c.nodes[0].requestLock.Unlock()
+}
+
+func TestRequestPeersReportsPeersThatDidNotAnswer(t *testing.T) {
+	c := newTestCluster(t, 3)
+	c.partition([]int{0, 1})
+
+	var (
+		answers map[string]MessageQueryResult
+		errs    map[string]error
+	)
+	c.run("requests", func() error {
+		answers, errs = requestPeers[MessageQueryResult](c.nodes[0], c.nodes[0].peerAddrs(), MessageQuery{}, defaultQueryTimeout)
+		return nil
+	})
+	assert.Contains(t, answers, "node-1")
+	assert.NotContains(t, answers, "node-2")
+	assert.True(t, errors.IsType(errs["node-2"], errors.TimeoutError), "got %v", errs["node-2"])
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The node keeps its goroutines and open files within a budget, and tracks
+// how busy its pools of workers are. Going over budget leaves the node
+// working: it is warned about, for an operator to look into a leak or a
+// peer flooding it before the process runs out of memory or descriptors.
+
+// ResourceUsage is the use the node makes of its goroutines, open files and
+// workers.
+type ResourceUsage struct {
+	Goroutines    int `json:"goroutines"`
+	MaxGoroutines int `json:"max_goroutines"`
+	// OpenFiles is left at -1 on platforms that do not report it, and
+	// MaxOpenFiles at zero.
+	OpenFiles    int `json:"open_files"`
+	MaxOpenFiles int `json:"max_open_files"`
+	// Pools are the pools of workers of the node, by name.
+	Pools []WorkerPoolUsage `json:"pools"`
+	// OverBudget names the budgets exceeded as of CheckedAt.
+	OverBudget []string  `json:"over_budget,omitempty"`
+	CheckedAt  time.Time `json:"checked_at"`
+}
+
+// WorkerPoolUsage is how busy a pool of workers is.
+type WorkerPoolUsage struct {
+	Name string `json:"name"`
+	// Active are the workers at work, and Size the most the pool runs at
+	// once; zero for pools without a bound.
+	Active int `json:"active"`
+	Size   int `json:"size"`
+	// Peak is the most workers ever at work at once, and Started the work
+	// the pool took on.
+	Peak    int   `json:"peak"`
+	Started int64 `json:"started"`
+	// Utilization is the share of Size at work, zero for unbounded pools.
+	Utilization float64 `json:"utilization"`
+}
+
+// Pools of workers of the node.
+const (
+	// poolPeerMessages handles the messages of peers, a worker per peer
+	// busy while it handles one.
+	poolPeerMessages = "peer_messages"
+	// poolReplicaAcks acknowledges the replicas received from peers.
+	poolReplicaAcks = "replica_acks"
+)
+
+// Budgets of ResourceUsage.OverBudget.
+const (
+	BudgetGoroutines = "goroutines"
+	BudgetOpenFiles  = "open_files"
+)
+
+// defaultOpenFilesShare is the share of the open files limit of the process
+// MaxOpenFiles defaults to.
+const defaultOpenFilesShare = 0.8
+
+type resourceMonitor struct {
+	mu    sync.Mutex
+	pools map[string]*workerPool
+	// over are the budgets exceeded at the last check, warned about once.
+	over map[string]bool
+	// openFiles returns the files the process has open, and its limit.
+	openFiles func() (open, limit int, err error)
+}
+
+type workerPool struct {
+	size    int
+	active  int
+	peak    int
+	started int64
+}
+
+// start records a worker of the pool name, of size workers at most, at
+// work until done is called.
+func (m *resourceMonitor) start(name string, size int) (done func()) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.pools == nil {
+		m.pools = make(map[string]*workerPool)
+	}
+	p, ok := m.pools[name]
+	if !ok {
+		p = &workerPool{}
+		m.pools[name] = p
+	}
+	p.size = size
+	p.active++
+	p.started++
+	if p.active > p.peak {
+		p.peak = p.active
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			m.mu.Lock()
+			p.active--
+			m.mu.Unlock()
+		})
+	}
+}
+
+// poolUsage returns how busy each pool is, by name.
+func (m *resourceMonitor) poolUsage() []WorkerPoolUsage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	pools := make([]WorkerPoolUsage, 0, len(m.pools))
+	for name, p := range m.pools {
+		u := WorkerPoolUsage{Name: name, Active: p.active, Size: p.size, Peak: p.peak, Started: p.started}
+		if p.size > 0 {
+			u.Utilization = float64(p.active) / float64(p.size)
+		}
+		pools = append(pools, u)
+	}
+	sort.Slice(pools, func(i, j int) bool { return pools[i].Name < pools[j].Name })
+	return pools
+}
+
+// ResourceUsage returns the use the node makes of its goroutines, open
+// files and workers.
+func (s *FileServer) ResourceUsage() ResourceUsage {
+	u := ResourceUsage{
+		Goroutines:    runtime.NumGoroutine(),
+		MaxGoroutines: s.MaxGoroutines,
+		OpenFiles:     -1,
+		Pools:         s.resources.poolUsage(),
+		CheckedAt:     s.Clock.Now(),
+	}
+	if open, limit, err := s.resources.openFiles(); err == nil {
+		u.OpenFiles = open
+		u.MaxOpenFiles = s.MaxOpenFiles
+		if u.MaxOpenFiles == 0 {
+			u.MaxOpenFiles = int(float64(limit) * defaultOpenFilesShare)
+		}
+	}
+	if u.Goroutines > u.MaxGoroutines {
+		u.OverBudget = append(u.OverBudget, BudgetGoroutines)
+	}
+	if u.MaxOpenFiles > 0 && u.OpenFiles > u.MaxOpenFiles {
+		u.OverBudget = append(u.OverBudget, BudgetOpenFiles)
+	}
+	return u
+}
+
+func (s *FileServer) resourceLoop() {
+	ticker := s.Clock.NewTicker(s.ResourceCheckInterval)
+	defer ticker.Stop()
+
+	s.checkResources()
+	for {
+		select {
+		case <-ticker.C():
+			s.checkResources()
+		case <-s.quitch:
+			return
+		}
+	}
+}
+
+// checkResources warns when the node goes over one of its budgets, and
+// tells once it is back within. Saturated pools are warned about at every
+// check.
+func (s *FileServer) checkResources() ResourceUsage {
+	u := s.ResourceUsage()
+	over := make(map[string]bool, len(u.OverBudget))
+	for _, budget := range u.OverBudget {
+		over[budget] = true
+	}
+
+	m := &s.resources
+	m.mu.Lock()
+	was := m.over
+	m.over = over
+	m.mu.Unlock()
+
+	for _, budget := range []string{BudgetGoroutines, BudgetOpenFiles} {
+		switch {
+		case over[budget] == was[budget]:
+		case over[budget] && budget == BudgetGoroutines:
+			s.logger.Warn("Running %d goroutines, over the budget of %d", u.Goroutines, u.MaxGoroutines)
+		case over[budget]:
+			s.logger.Warn("Holding %d open files, over the budget of %d", u.OpenFiles, u.MaxOpenFiles)
+		default:
+			s.logger.Info("Back within the budget of %s", budget)
+		}
+	}
+	for _, p := range u.Pools {
+		if p.Size > 0 && p.Active >= p.Size {
+			s.logger.Warn("Worker pool %s is saturated: %d of %d workers busy", p.Name, p.Active, p.Size)
+		}
+	}
+	return u
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResourceUsage(t *testing.T) {
+	c := newTestCluster(t, 2)
+	s := c.nodes[0]
+	c.store(0, "key", []byte("replicated"))
+	c.assertConverged(0, "key")
+
+	// Handling the messages of a peer, and acknowledging its replicas,
+	// count against the pools of the node receiving them.
+	// The acknowledgement is sent once the replica is stored.
+	pools := map[string]WorkerPoolUsage{}
+	c.eventually("the replica to be acknowledged", func() bool {
+		for _, p := range c.nodes[1].ResourceUsage().Pools {
+			pools[p.Name] = p
+		}
+		return pools[poolReplicaAcks].Started > 0
+	})
+	assert.Greater(t, pools[poolPeerMessages].Started, int64(0))
+
+	// The open files budget defaults to a share of the limit of the process.
+	s.resources.openFiles = func() (int, int, error) { return 900, 1000, nil }
+	u := s.checkResources()
+	assert.Equal(t, 800, u.MaxOpenFiles)
+	assert.Equal(t, []string{BudgetOpenFiles}, u.OverBudget)
+
+	s.MaxGoroutines = 1
+	s.MaxOpenFiles = 1000
+	u = s.checkResources()
+	assert.Equal(t, []string{BudgetGoroutines}, u.OverBudget)
+
+	// A pool at its size is fully utilized.
+	done := s.resources.start("test", 2)
+	s.resources.start("test", 2)
+	done()
+	done()
+	for _, p := range s.ResourceUsage().Pools {
+		if p.Name == "test" {
+			assert.Equal(t, WorkerPoolUsage{Name: "test", Active: 1, Size: 2, Peak: 2, Started: 2, Utilization: 0.5}, p)
+		}
+	}
+}
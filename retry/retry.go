@@ -4,6 +4,7 @@ import (
 	"context"
 	"time"
 
+	"github.com/anthdm/foreverstore/clock"
 	"github.com/anthdm/foreverstore/errors"
 	"github.com/anthdm/foreverstore/logger"
 )
@@ -15,6 +16,8 @@ type RetryConfig struct {
 	MaxDelay     time.Duration
 	Multiplier   float64
 	Jitter       bool
+	// Clock times the delays between attempts; nil means the wall clock.
+	Clock clock.Clock
 }
 
 // DefaultRetryConfig returns a default retry configuration
@@ -35,6 +38,10 @@ type RetryableFunc func() error
 func Do(ctx context.Context, config RetryConfig, fn RetryableFunc) error {
 	var lastErr error
 	delay := config.InitialDelay
+	clk := config.Clock
+	if clk == nil {
+		clk = clock.Real()
+	}
 
 	for attempt := 1; attempt <= config.MaxAttempts; attempt++ {
 		// Check if context is cancelled
@@ -73,7 +80,7 @@ func Do(ctx context.Context, config RetryConfig, fn RetryableFunc) error {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
-		case <-time.After(delay):
+		case <-clk.After(delay):
 		}
 
 		// Calculate next delay with exponential backoff
@@ -85,7 +92,7 @@ func Do(ctx context.Context, config RetryConfig, fn RetryableFunc) error {
 		// Add jitter if enabled
 		if config.Jitter {
 			jitter := time.Duration(float64(delay) * 0.1)
-			jitterMultiplier := float64(2*time.Now().UnixNano()%2 - 1)
+			jitterMultiplier := float64(2*clk.Now().UnixNano()%2 - 1)
 			delay += time.Duration(float64(jitter) * jitterMultiplier)
 		}
 	}
@@ -5,6 +5,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/anthdm/foreverstore/clock"
 	"github.com/anthdm/foreverstore/errors"
 )
 
@@ -188,3 +189,36 @@ func TestDefaultRetryConfig(t *testing.T) {
 		t.Error("Expected jitter to be enabled")
 	}
 }
+
+func TestRetryWaitsOnConfiguredClock(t *testing.T) {
+	fake := clock.NewFake(time.Unix(0, 0))
+	config := RetryConfig{
+		MaxAttempts:  3,
+		InitialDelay: time.Hour,
+		MaxDelay:     time.Hour,
+		Multiplier:   2.0,
+		Clock:        fake,
+	}
+
+	attempts := 0
+	done := make(chan error)
+	go func() {
+		done <- Do(context.Background(), config, func() error {
+			attempts++
+			return errors.NewTimeoutError("still waiting")
+		})
+	}()
+
+	// Each delay is an hour of fake time; nothing sleeps for real.
+	for i := 0; i < 2; i++ {
+		fake.BlockUntil(1)
+		fake.Advance(time.Hour)
+	}
+
+	if err := <-done; !errors.IsType(err, errors.TimeoutError) {
+		t.Errorf("Expected timeout error, got: %v", err)
+	}
+	if attempts != 3 {
+		t.Errorf("Expected 3 attempts, got %d", attempts)
+	}
+}
@@ -0,0 +1,130 @@
+// Package ring places keys on nodes by consistent hashing. Every node is
+// hashed to several points of a circle, its virtual nodes, and a key goes
+// to the nodes whose points follow the hash of the key clockwise. Adding or
+// removing a node only moves the keys of the arcs its points cover, and the
+// virtual nodes spread the keys evenly across the nodes.
+package ring
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// DefaultVirtualNodes is the number of points of every node when New is
+// given none.
+const DefaultVirtualNodes = 128
+
+// Ring is a consistent hash ring over node IDs. Rings holding the same
+// nodes with as many virtual nodes place every key alike. A Ring is not
+// safe for concurrent use while nodes are added or removed.
+type Ring struct {
+	virtualNodes int
+	points       []point
+	nodes        map[string]struct{}
+}
+
+type point struct {
+	hash uint64
+	node string
+}
+
+// New returns a ring of nodes with virtualNodes points each, or
+// DefaultVirtualNodes when virtualNodes is not positive.
+func New(virtualNodes int, nodes ...string) *Ring {
+	if virtualNodes <= 0 {
+		virtualNodes = DefaultVirtualNodes
+	}
+	r := &Ring{virtualNodes: virtualNodes, nodes: make(map[string]struct{})}
+	r.Add(nodes...)
+	return r
+}
+
+// Add places nodes on the ring. Nodes on it already are left alone.
+func (r *Ring) Add(nodes ...string) {
+	for _, node := range nodes {
+		if _, ok := r.nodes[node]; ok {
+			continue
+		}
+		r.nodes[node] = struct{}{}
+		for i := 0; i < r.virtualNodes; i++ {
+			r.points = append(r.points, point{hash: hash(node + "#" + strconv.Itoa(i)), node: node})
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool {
+		if r.points[i].hash != r.points[j].hash {
+			return r.points[i].hash < r.points[j].hash
+		}
+		return r.points[i].node < r.points[j].node
+	})
+}
+
+// Remove takes node off the ring.
+func (r *Ring) Remove(node string) {
+	if _, ok := r.nodes[node]; !ok {
+		return
+	}
+	delete(r.nodes, node)
+	points := r.points[:0]
+	for _, p := range r.points {
+		if p.node != node {
+			points = append(points, p)
+		}
+	}
+	r.points = points
+}
+
+// Len returns the number of nodes on the ring.
+func (r *Ring) Len() int {
+	return len(r.nodes)
+}
+
+// Nodes returns the nodes on the ring, in order.
+func (r *Ring) Nodes() []string {
+	nodes := make([]string, 0, len(r.nodes))
+	for node := range r.nodes {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+// Owners returns the first n distinct nodes found clockwise from the hash
+// of key, the owners of its n replicas in order, or every node in that
+// order when n is not positive or exceeds the nodes on the ring.
+func (r *Ring) Owners(key string, n int) []string {
+	if n <= 0 || n > len(r.nodes) {
+		n = len(r.nodes)
+	}
+	if n == 0 {
+		return nil
+	}
+
+	h := hash(key)
+	start := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	owners := make([]string, 0, n)
+	seen := make(map[string]bool, n)
+	for i := 0; len(owners) < n; i++ {
+		p := r.points[(start+i)%len(r.points)]
+		if !seen[p.node] {
+			seen[p.node] = true
+			owners = append(owners, p.node)
+		}
+	}
+	return owners
+}
+
+// hash maps s to a point of the ring. FNV-1a is mixed further, as the
+// hashes of strings differing in their last bytes, such as the virtual
+// nodes of a node, would otherwise cluster.
+func hash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
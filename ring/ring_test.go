@@ -0,0 +1,91 @@
+package ring
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestOwnersAreDistinctAndStable(t *testing.T) {
+	r := New(0, "a", "b", "c", "d")
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		owners := r.Owners(key, 3)
+		if len(owners) != 3 {
+			t.Fatalf("Expected 3 owners of %s, got %v", key, owners)
+		}
+		seen := map[string]bool{}
+		for _, o := range owners {
+			if seen[o] {
+				t.Fatalf("Owner %s of %s listed twice: %v", o, key, owners)
+			}
+			seen[o] = true
+		}
+
+		// Another ring of the same nodes, added in another order, agrees.
+		other := New(0, "d", "c", "b", "a")
+		if got := other.Owners(key, 3); fmt.Sprint(got) != fmt.Sprint(owners) {
+			t.Fatalf("Expected rings of the same nodes to agree on %s: %v and %v", key, owners, got)
+		}
+		// The first owners of a key are the first of its full order.
+		if all := r.Owners(key, 0); fmt.Sprint(all[:3]) != fmt.Sprint(owners) {
+			t.Fatalf("Expected %v to start with %v", all, owners)
+		}
+	}
+
+	if got := r.Owners("key", 10); len(got) != 4 {
+		t.Errorf("Expected every node when asking for more owners than nodes, got %v", got)
+	}
+	if got := New(0).Owners("key", 1); got != nil {
+		t.Errorf("Expected no owner on an empty ring, got %v", got)
+	}
+}
+
+func TestKeysAreSpreadEvenly(t *testing.T) {
+	nodes := []string{"node-1", "node-2", "node-3", "node-4", "node-5"}
+	r := New(0, nodes...)
+	counts := map[string]int{}
+	const keys = 10000
+	for i := 0; i < keys; i++ {
+		counts[r.Owners(fmt.Sprintf("bucket/object-%d", i), 1)[0]]++
+	}
+	for _, node := range nodes {
+		if share := float64(counts[node]) / keys; share < 0.12 || share > 0.28 {
+			t.Errorf("Node %s owns %.1f%% of the keys", node, share*100)
+		}
+	}
+}
+
+func TestAddingANodeOnlyMovesKeysToIt(t *testing.T) {
+	r := New(0, "a", "b", "c")
+	before := map[string]string{}
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		before[key] = r.Owners(key, 1)[0]
+	}
+
+	r.Add("d")
+	moved := 0
+	for key, owner := range before {
+		now := r.Owners(key, 1)[0]
+		if now == owner {
+			continue
+		}
+		if now != "d" {
+			t.Fatalf("Key %s moved from %s to %s, not to the new node", key, owner, now)
+		}
+		moved++
+	}
+	if moved == 0 || moved > 400 {
+		t.Errorf("Expected about a quarter of the keys to move, %d of 1000 did", moved)
+	}
+
+	r.Remove("d")
+	for key, owner := range before {
+		if now := r.Owners(key, 1)[0]; now != owner {
+			t.Fatalf("Expected %s back on %s once the node left, got %s", key, owner, now)
+		}
+	}
+	if r.Len() != 3 || fmt.Sprint(r.Nodes()) != "[a b c]" {
+		t.Errorf("Expected nodes a, b and c, got %v", r.Nodes())
+	}
+}
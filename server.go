@@ -3,37 +3,318 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
 	"encoding/binary"
-	"encoding/gob"
 	"fmt"
 	"io"
+	"math"
+	"os"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/anthdm/foreverstore/clock"
+	"github.com/anthdm/foreverstore/config"
+	"github.com/anthdm/foreverstore/dht"
 	"github.com/anthdm/foreverstore/errors"
 	"github.com/anthdm/foreverstore/logger"
 	"github.com/anthdm/foreverstore/p2p"
 	"github.com/anthdm/foreverstore/retry"
+	"github.com/anthdm/foreverstore/tier"
 )
 
 type FileServerOpts struct {
 	ID                string
 	EncKey            []byte
+	// KeyRing holds all encryption key versions of the node. When nil, a
+	// key ring is created holding only EncKey as version 0.
+	KeyRing           *KeyRing
+	// EncryptionMode selects the format data is encrypted with before it is
+	// sent to peers (EncryptionModeGCM or EncryptionModeCTR). Reads detect
+	// the format, so both can coexist in a cluster.
+	EncryptionMode    string
+	// CipherSuite selects the cipher used by the GCM format; defaults to
+	// CipherSuiteAESGCM.
+	CipherSuite       string
 	StorageRoot       string
 	PathTransformFunc PathTransformFunc
 	Transport         p2p.Transport
 	BootstrapNodes    []string
+	// MaxPeers caps the connections to peers, dialed and accepted; zero
+	// means no limit.
+	MaxPeers int
+	// WriteConsistency is how many copies of an object a store waits to be
+	// persisted for: WriteConsistencyOne, the default, WriteConsistencyQuorum
+	// or WriteConsistencyAll.
+	WriteConsistency string
+	// Identity is the node's signing key for control messages. A new one is
+	// generated when nil.
+	Identity ed25519.PrivateKey
+	// TrustedPeerKeys restricts which peers' messages are accepted. When
+	// empty, the first key each connection signs with is pinned instead.
+	TrustedPeerKeys []ed25519.PublicKey
+	// JoinToken, when set, lets the nodes presenting it join the cluster
+	// through this node (see AcceptJoin).
+	JoinToken string
+	// AdminToken authenticates the writes and administrative operations of
+	// the admin API (see adminOnly). When empty, they are refused.
+	AdminToken string
+	// Config, when set, receives the cluster-wide settings distributed by
+	// other members (see DistributeSettings).
+	Config *config.Config
+	// Clock times every wait, retry and timestamp of the server. It
+	// defaults to the wall clock; tests pass a clock.Fake.
+	Clock clock.Clock
+	// Lifecycle holds the rules applied to the objects this node stores,
+	// evaluated every LifecycleInterval. The node with the lowest ID
+	// leads the evaluation: its rules apply across the cluster.
+	Lifecycle         []config.LifecycleRule
+	LifecycleInterval time.Duration
+	// ColdTier, when set, receives the objects that go unread for
+	// ColdAfter, or that a lifecycle rule transitions.
+	ColdTier  tier.Backend
+	ColdAfter time.Duration
+	// CapacityInterval is how often the node gossips its disk usage to its
+	// peers. Replicas are not placed on peers that reported having no room
+	// for them.
+	CapacityInterval time.Duration
+	// GCInterval is how often the node prunes the directories left empty
+	// in its storage root and the namespaces holding no object.
+	GCInterval time.Duration
+	// AntiEntropyInterval is how often the node sends its peers the
+	// replicas of its objects they miss (see SyncReplicas).
+	AntiEntropyInterval time.Duration
+	// ConsistencyCheckInterval is how often the node compares the replicas
+	// of ConsistencyCheckSample of its objects with them, repairing those
+	// found divergent (see CheckConsistencySample).
+	ConsistencyCheckInterval time.Duration
+	ConsistencyCheckSample   int
+	// HeartbeatInterval is how often the node sends its peers a heartbeat.
+	// Peers not heard from for HeartbeatMisses intervals are dropped.
+	HeartbeatInterval time.Duration
+	HeartbeatMisses   int
+	// ReconnectMaxBackoff bounds the delay between the dials of a bootstrap
+	// node the node is not connected to (see reconnectLoop).
+	ReconnectMaxBackoff time.Duration
+	// CheckOnStart has Start check the storage before serving anything,
+	// verifying the content of CheckSamplePercent percent of the objects
+	// (see CheckStorage).
+	CheckOnStart       bool
+	CheckSamplePercent int
+	// DiskCheckInterval is how often the node checks the free space of its
+	// storage root. It turns read-only when less than DiskMinFreeBytes is
+	// left, or when the disk fails DiskMaxWriteErrors writes between two
+	// checks (see DiskHealth).
+	DiskCheckInterval  time.Duration
+	DiskMinFreeBytes   int64
+	DiskMaxWriteErrors int
+	// ResourceCheckInterval is how often the node counts its goroutines,
+	// open files and busy workers, warning while it has more goroutines
+	// than MaxGoroutines or open files than MaxOpenFiles (see
+	// ResourceUsage).
+	ResourceCheckInterval time.Duration
+	MaxGoroutines         int
+	MaxOpenFiles          int
+	// MaxClockSkew is the difference between the clock of the node and the
+	// clock of a peer, as estimated from its capacity reports, above which
+	// the node warns (see ClockSkew).
+	MaxClockSkew time.Duration
+	// BucketQuotas and TenantQuotas limit the bytes stored across the
+	// cluster in a bucket, and in all the buckets of a tenant. Usage is
+	// summed from the capacity reports of the peers, so writes made on
+	// several nodes within one CapacityInterval can overshoot a quota.
+	BucketQuotas []config.BucketQuota
+	TenantQuotas []config.TenantQuota
+	// BucketPolicies override the replication factor, the sites replicas
+	// go to and the encryption required for the objects of some buckets.
+	// They are replaced by the policies distributed with the cluster
+	// settings.
+	BucketPolicies []config.BucketPolicy
+	// UploadPolicies restrict the size, content type and keys of the
+	// objects clients store, and UploadHook, when set, checks them further
+	// (see checkUpload).
+	UploadPolicies []config.UploadPolicy
+	UploadHook     UploadHook
+	// SlowOpThreshold logs every Store, Get and replication taking longer,
+	// with a breakdown of where the time went. Zero disables it; it can be
+	// changed at runtime with SetSlowOpThreshold.
+	SlowOpThreshold time.Duration
+	// ClientRateLimit is how many requests a second the node serves on its
+	// object endpoints, and PeerBandwidthLimit how many bytes a second it
+	// sends its peers. Zero lifts either limit; both can be changed at
+	// runtime.
+	ClientRateLimit    int
+	PeerBandwidthLimit int64
+	// AccessLog, when set, receives a line of JSON per client operation
+	// served on the admin API; see AccessRecord.
+	AccessLog io.Writer
+	// ReadAhead is how many chunks of a chunked file, stored under keys
+	// ending in the chunk number, are fetched ahead of a client reading its
+	// chunks in order. Zero disables read-ahead.
+	ReadAhead int
+	// ChunkSize is the size of the chunks StoreChunked splits files into.
+	ChunkSize int64
+	// Mirror, when set, receives a copy of every object this node stores,
+	// and their deletions, for recovery from outside the cluster. Changes
+	// reach it asynchronously, independently of the replication to peers.
+	// Every MirrorReconcileInterval, the mirror is brought back in line
+	// with the objects of the node if it missed changes.
+	Mirror                  tier.Backend
+	MirrorReconcileInterval time.Duration
+	// Site labels the datacenter the node runs in, and is reported to the
+	// peers. Gets fetch from the peers of the same site first.
+	// CrossSiteReplication, CrossSiteSync or CrossSiteAsync, sets how the
+	// replicas of this node reach the peers of other sites; async needs a
+	// Site.
+	Site                 string
+	CrossSiteReplication string
+	// Follow, when set, makes the node a read-only follower of that leader,
+	// copying its objects, or those of its bucket FollowBucket only, and
+	// tailing its change feed, waiting up to FollowInterval for changes,
+	// until it is promoted (see Promote).
+	Follow         FollowSource
+	FollowBucket   string
+	FollowInterval time.Duration
+	// PeerTLS, when set, holds the certificates of the TLS connections to
+	// peers, which the transport is configured with, and is reloaded every
+	// TLSReloadInterval.
+	PeerTLS           *PeerTLS
+	TLSReloadInterval time.Duration
+	// AdvertiseAddr, when set, is the address the node introduces itself
+	// to its peers with, rather than the address of its transport.
+	AdvertiseAddr string
 }
 
 type FileServer struct {
 	FileServerOpts
 
+	// slowOpThreshold is the SlowOpThreshold in effect, read atomically.
+	slowOpThreshold int64
+	// clientRate and peerBandwidth enforce the ClientRateLimit and the
+	// PeerBandwidthLimit in effect.
+	clientRate    *rateLimiter
+	peerBandwidth *rateLimiter
+	// accessLog records client operations when AccessLog is set.
+	accessLog *accessLog
+	// uploadRules are the UploadPolicies, compiled.
+	uploadRules []uploadRule
+
+	peers peerRegistry
+	// peerLock guards peerKeys, the identity keys pinned for the connection
+	// from each address.
 	peerLock sync.Mutex
-	peers    map[string]p2p.Peer
-
-	store  *Store
-	quitch chan struct{}
-	logger *logger.Logger
+	peerKeys map[string]ed25519.PublicKey
+	// conns tracks the nodes behind the connections in peers, to keep one
+	// connection to each.
+	conns connManager
+
+	keyRing      *KeyRing
+	rotationLock sync.Mutex
+	rotation     KeyRotationStatus
+
+	migrationLock sync.Mutex
+	migration     MigrationStatus
+
+	settingsLock    sync.RWMutex
+	clusterSettings config.ClusterSettings
+
+	// placement is the hash ring the replicas of objects are placed by.
+	placement placementRing
+	// routes is the routing table of the DHT the replicas are looked up
+	// in, providers the provider records kept at this node, and
+	// announcements the replicas held waiting to be announced.
+	routes        *dht.Table
+	providers     providerRecords
+	announcements announceQueue
+
+	// requests holds the requests to peers waiting for their responses.
+	requestLock sync.Mutex
+	requests    map[string]pendingRequest
+	// gets holds the MessageGetFile sent to peers waiting for their answer.
+	gets pendingGets
+	// inbox holds the messages of each peer waiting to be handled.
+	inbox peerQueues
+
+	repairLock sync.Mutex
+	repair     RepairStatus
+
+	disk diskMonitor
+	// resources tracks the goroutines, open files and workers of the node.
+	resources resourceMonitor
+	// errorCounts counts the failed operations by error type.
+	errorCounts errorCounts
+	// clockSkew estimates how far off the clocks of the peers are.
+	clockSkew clockSkewTracker
+	// liveness records when the peers were last heard from.
+	liveness livenessTracker
+	// reconnect tracks the dials of the bootstrap nodes lost.
+	reconnect reconnectState
+	// removed tracks the peers removed, kept from connecting again.
+	removed removedPeers
+
+	// keyLocks serializes the writes, locks and deletes of each key.
+	keyLocks keyMutex
+	// replicaLocks serializes the writes of each replica held for the
+	// peers, by namespace and hashed key.
+	replicaLocks keyMutex
+	// fences holds the objects moved to another node by a migration.
+	fences writeFences
+	// sendLocks serializes what is written to each peer, by address: a
+	// stream must reach the peer without other messages in between.
+	sendLocks keyMutex
+
+	lifecycleLock sync.Mutex
+	lifecycle     LifecycleStatus
+
+	gc           gcState
+	antiEntropy  antiEntropyState
+	storageCheck storageCheckState
+	jobs         jobManager
+
+	tierStats tierStats
+
+	replication replicationTracker
+	transfers   transferTracker
+	replicaAcks replicaAcks
+
+	// fetches coalesces the concurrent fetches of a key from the network,
+	// and fetchLock serializes those of different keys: the peers answer
+	// each with a stream, read whole before the next fetch starts.
+	fetches    fetchGroup
+	fetchLock  sync.Mutex
+	readAheads readAheadTracker
+
+	capacity    capacityTracker
+	bucketUsage bucketUsage
+
+	mirrorch    chan mirrorOp
+	mirrorStats mirrorStats
+
+	crossSite crossSiteQueue
+
+	follow  follower
+	changes changeFeed
+	// tombstones records the objects deleted, for the peers that missed it.
+	tombstones tombstones
+
+	control controlTracker
+
+	store    *Store
+	quitch   chan struct{}
+	stopOnce sync.Once
+	// ops counts the client operations in progress, and handling the peer
+	// messages being handled, for Shutdown to wait for.
+	ops      inflight
+	handling inflight
+	// files holds the readers returned by Get not closed yet.
+	files openFiles
+	// readych is closed once Start has returned successfully, and donech
+	// once the message loop has stopped.
+	readych chan struct{}
+	donech  chan struct{}
+	logger  *logger.Logger
 }
 
 func NewFileServer(opts FileServerOpts) *FileServer {
@@ -45,39 +326,182 @@ func NewFileServer(opts FileServerOpts) *FileServer {
 	if len(opts.ID) == 0 {
 		opts.ID = generateID()
 	}
+	if len(opts.EncryptionMode) == 0 {
+		opts.EncryptionMode = defaultEncryptionMode
+	}
+	if len(opts.CipherSuite) == 0 {
+		opts.CipherSuite = defaultCipherSuite
+	}
+	if opts.Identity == nil {
+		_, opts.Identity, _ = ed25519.GenerateKey(nil)
+	}
+	if opts.KeyRing == nil {
+		opts.KeyRing = NewKeyRing(0, opts.EncKey)
+	}
+	if opts.Clock == nil {
+		opts.Clock = clock.Real()
+	}
+	if opts.LifecycleInterval == 0 {
+		opts.LifecycleInterval = config.DefaultLifecycleInterval * time.Second
+	}
+	if opts.MirrorReconcileInterval == 0 {
+		opts.MirrorReconcileInterval = config.DefaultMirrorReconcileInterval * time.Second
+	}
+	if opts.CapacityInterval == 0 {
+		opts.CapacityInterval = config.DefaultCapacityInterval * time.Second
+	}
+	if opts.GCInterval == 0 {
+		opts.GCInterval = config.DefaultGCInterval * time.Second
+	}
+	if opts.AntiEntropyInterval == 0 {
+		opts.AntiEntropyInterval = config.DefaultAntiEntropyInterval * time.Second
+	}
+	if opts.ConsistencyCheckInterval == 0 {
+		opts.ConsistencyCheckInterval = config.DefaultConsistencyCheckInterval * time.Second
+	}
+	if opts.ConsistencyCheckSample == 0 {
+		opts.ConsistencyCheckSample = config.DefaultConsistencyCheckSample
+	}
+	if opts.HeartbeatInterval == 0 {
+		opts.HeartbeatInterval = config.DefaultHeartbeatInterval * time.Second
+	}
+	if opts.HeartbeatMisses == 0 {
+		opts.HeartbeatMisses = config.DefaultHeartbeatMisses
+	}
+	if opts.ReconnectMaxBackoff == 0 {
+		opts.ReconnectMaxBackoff = config.DefaultReconnectMaxBackoff * time.Second
+	}
+	if opts.DiskCheckInterval == 0 {
+		opts.DiskCheckInterval = config.DefaultDiskCheckInterval * time.Second
+	}
+	if opts.DiskMinFreeBytes == 0 {
+		opts.DiskMinFreeBytes = config.DefaultDiskMinFreeBytes
+	}
+	if opts.DiskMaxWriteErrors == 0 {
+		opts.DiskMaxWriteErrors = config.DefaultDiskMaxWriteErrors
+	}
+	if opts.WriteConsistency == "" {
+		opts.WriteConsistency = WriteConsistencyOne
+	}
+	if opts.ResourceCheckInterval == 0 {
+		opts.ResourceCheckInterval = config.DefaultResourceCheckInterval * time.Second
+	}
+	if opts.MaxGoroutines == 0 {
+		opts.MaxGoroutines = config.DefaultMaxGoroutines
+	}
+	if opts.MaxClockSkew == 0 {
+		opts.MaxClockSkew = config.DefaultMaxClockSkewMs * time.Millisecond
+	}
+	if len(opts.CrossSiteReplication) == 0 {
+		opts.CrossSiteReplication = CrossSiteSync
+	}
+	if opts.FollowInterval == 0 {
+		opts.FollowInterval = config.DefaultFollowInterval * time.Second
+	}
+	if opts.ChunkSize == 0 {
+		opts.ChunkSize = config.DefaultChunkSizeBytes
+	}
+	if opts.TLSReloadInterval == 0 {
+		opts.TLSReloadInterval = config.DefaultTLSReloadInterval * time.Second
+	}
 
 	// Create a logger with the server's transport address as prefix
 	serverLogger := logger.WithPrefix(fmt.Sprintf("SERVER[%s]", opts.Transport.Addr()))
 
-	return &FileServer{
-		FileServerOpts: opts,
-		store:          NewStore(storeOpts),
-		quitch:         make(chan struct{}),
-		peers:          make(map[string]p2p.Peer),
-		logger:         serverLogger,
+	s := &FileServer{
+		FileServerOpts:  opts,
+		store:           NewStore(storeOpts),
+		keyRing:         opts.KeyRing,
+		quitch:          make(chan struct{}),
+		readych:         make(chan struct{}),
+		donech:          make(chan struct{}),
+		peerKeys:        make(map[string]ed25519.PublicKey),
+		requests:        make(map[string]pendingRequest),
+		mirrorch:        make(chan mirrorOp, mirrorQueueSize),
+		crossSite:       crossSiteQueue{wakech: make(chan struct{}, 1)},
+		routes:          dht.NewTable(opts.ID, 0),
+		announcements:   announceQueue{wakech: make(chan struct{}, 1)},
+		slowOpThreshold: int64(opts.SlowOpThreshold),
+		clientRate:      newRateLimiter(opts.Clock, int64(opts.ClientRateLimit)),
+		peerBandwidth:   newRateLimiter(opts.Clock, opts.PeerBandwidthLimit),
+		uploadRules:     compileUploadPolicies(opts.UploadPolicies),
+		logger:          serverLogger,
+	}
+	s.store.OnWriteError = s.diskWriteFailed
+	s.disk.space = diskSpace
+	s.resources.openFiles = processOpenFiles
+	if opts.AccessLog != nil {
+		s.accessLog = &accessLog{w: opts.AccessLog}
+	}
+	if opts.Follow != nil {
+		s.follow = follower{
+			status: FollowStatus{Following: true, Leader: opts.Follow.Addr(), Bucket: opts.FollowBucket},
+			stopch: make(chan struct{}),
+		}
 	}
+	return s
 }
 
-func (s *FileServer) broadcast(msg *Message) error {
-	buf := new(bytes.Buffer)
-	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
-		return errors.Wrap(err, errors.InternalError, "failed to encode broadcast message")
+// sendMessage sends a control message to a single peer.
+func (s *FileServer) sendMessage(peer p2p.Peer, msg *Message) error {
+	unlock := s.sendLocks.lock(peer.RemoteAddr().String())
+	defer unlock()
+	return s.writeMessage(peer, msg)
+}
+
+// writeMessage is sendMessage for callers already holding the send lock of
+// the peer.
+func (s *FileServer) writeMessage(peer p2p.Peer, msg *Message) error {
+	format := peerFormat(peer)
+	b, err := s.sealControl(peer.RemoteAddr().String(), msg, format)
+	if err != nil {
+		return err
 	}
 
-	s.logger.Debug("Broadcasting message to %d peers", len(s.peers))
+	if err := peer.Send(format.frame(b)); err != nil {
+		return errors.Wrap(err, errors.NetworkError, "failed to send message")
+	}
+	return nil
+}
+
+func (s *FileServer) broadcast(msg *Message) error {
+	return s.multicast(s.connectedPeers(), msg)
+}
+
+// connectedPeers returns a copy of the peers, which AddPeer and RemovePeer
+// may change at any time.
+func (s *FileServer) connectedPeers() map[string]p2p.Peer {
+	return s.peers.snapshot()
+}
+
+// peerAddrs returns the addresses of the peers connected.
+func (s *FileServer) peerAddrs() []string {
+	return s.peers.addrs()
+}
+
+// multicast sends a control message to each of peers.
+func (s *FileServer) multicast(peers map[string]p2p.Peer, msg *Message) error {
+	// The message is sealed once for each format the peers speak.
+	frames := make(map[wireFormat][]byte)
+	// Control messages are numbered for each peer on its own.
+	control := isControl(msg.Payload)
+
+	s.logger.Debug("Broadcasting message to %d peers", len(peers))
 	
 	var lastErr error
 	successCount := 0
 	
-	for addr, peer := range s.peers {
-		if err := peer.Send([]byte{p2p.IncomingMessage}); err != nil {
-			s.logger.Warn("Failed to send message header to peer %s: %v", addr, err)
-			lastErr = err
-			continue
+	for addr, peer := range peers {
+		var err error
+		unlock := s.sendLocks.lock(addr)
+		if control {
+			err = s.writeMessage(peer, msg)
+		} else {
+			err = s.sendFrame(peer, msg, frames)
 		}
-		
-		if err := peer.Send(buf.Bytes()); err != nil {
-			s.logger.Warn("Failed to send message body to peer %s: %v", addr, err)
+		unlock()
+		if err != nil {
+			s.logger.Warn("Failed to send message to peer %s: %v", addr, err)
 			lastErr = err
 			continue
 		}
@@ -85,12 +509,12 @@ func (s *FileServer) broadcast(msg *Message) error {
 		successCount++
 	}
 
-	if successCount == 0 && len(s.peers) > 0 {
+	if successCount == 0 && len(peers) > 0 {
 		return errors.Wrap(lastErr, errors.NetworkError, "failed to broadcast to any peers")
 	}
 	
-	if successCount < len(s.peers) {
-		s.logger.Warn("Broadcast partially failed: %d/%d peers reached", successCount, len(s.peers))
+	if successCount < len(peers) {
+		s.logger.Warn("Broadcast partially failed: %d/%d peers reached", successCount, len(peers))
 	} else {
 		s.logger.Debug("Broadcast successful to all %d peers", successCount)
 	}
@@ -98,37 +522,153 @@ func (s *FileServer) broadcast(msg *Message) error {
 	return nil
 }
 
+// sendFrame sends msg to peer in its format, sealing it the first time the
+// format is needed and keeping the frame in frames for the other peers.
+func (s *FileServer) sendFrame(peer p2p.Peer, msg *Message, frames map[wireFormat][]byte) error {
+	format := peerFormat(peer)
+	frame, ok := frames[format]
+	if !ok {
+		b, err := s.sealMessage(msg, format)
+		if err != nil {
+			return err
+		}
+		frame = format.frame(b)
+		frames[format] = frame
+	}
+	return peer.Send(frame)
+}
+
 type Message struct {
 	Payload any
+	// Seq numbers the control messages sent to a peer, zero for the other
+	// messages. Base is the lowest number the sender has not resolved yet:
+	// it neither resends nor expects an acknowledgment for those before.
+	Seq  uint64
+	Base uint64
 }
 
+// MessageStoreFile announces the replica streamed after it. The peer
+// rejects a replica that is not exactly Size bytes of ciphertext long, or
+// whose plaintext does not match HMAC.
 type MessageStoreFile struct {
 	ID   string
 	Key  string
 	Size int64
+	// HMAC is the integrity tag of the plaintext, computed with the integrity
+	// key of encryption key version KeyVersion.
+	HMAC       []byte
+	KeyVersion uint32
+	Cipher     string
+	// SHA256 is the checksum of the object, which the peer keeps to serve
+	// it with.
+	SHA256 []byte
+	// Bucket is the bucket of the object, for the peer to enforce its
+	// encryption policy; the key is hashed.
+	Bucket string
+	Client *ClientMeta
+	Lock   *ObjectLock
+	// Epoch is the epoch of the version of the object; the peer refuses the
+	// replica when it holds a newer one.
+	Epoch uint64
+	// Replica numbers the replica for the peer to acknowledge it with a
+	// MessageReplicaStored, and is zero when no acknowledgment is awaited.
+	Replica uint64
 }
 
+// MessageGetFile asks a peer for the replica it holds of an object. The
+// whole replica is sent, unless From resumes a transfer that was cut off
+// from that offset into the replica, or Length asks for the sealed chunks
+// covering Length bytes of plaintext from Offset only, after the header.
 type MessageGetFile struct {
-	ID  string
-	Key string
+	ID     string
+	Key    string
+	From   int64
+	Offset int64
+	Length int64
+}
+
+// MessageGetFileResponse answers a MessageGetFile: when Found, the stream of
+// the object follows; otherwise Error says why the peer cannot serve it, so
+// the requester asks another peer at once rather than wait for a stream.
+// The request is repeated in the answer.
+type MessageGetFileResponse struct {
+	ID        string
+	Key       string
+	From      int64
+	Offset    int64
+	Length    int64
+	Found     bool
+	Error     string
+	ErrorType errors.ErrorType
+	// Size is the size of the replica, and Start the offset in it of what
+	// is streamed, after the header for a range.
+	Size  int64
+	Start int64
 }
 
-func (s *FileServer) Get(key string) (io.Reader, error) {
-	// Check if file exists locally first
-	if s.store.Has(s.ID, key) {
+// answer returns the answer to msg, to be completed.
+func (msg MessageGetFile) answer() MessageGetFileResponse {
+	return MessageGetFileResponse{ID: msg.ID, Key: msg.Key, From: msg.From, Offset: msg.Offset, Length: msg.Length}
+}
+
+// request returns the MessageGetFile resp answers.
+func (resp MessageGetFileResponse) request() MessageGetFile {
+	return MessageGetFile{ID: resp.ID, Key: resp.Key, From: resp.From, Offset: resp.Offset, Length: resp.Length}
+}
+
+func (s *FileServer) Get(key string) (_ io.Reader, err error) {
+	defer func() { s.errorCounts.add("get", err) }()
+	if err := s.beginOp(); err != nil {
+		return nil, err
+	}
+	defer s.ops.end()
+
+	t := s.trace("get", key)
+	r, err := s.get(key, t)
+	t.done(err)
+	if err != nil {
+		return nil, err
+	}
+	s.readAhead(key)
+	return s.files.track(r), nil
+}
+
+func (s *FileServer) get(key string, t *opTrace) (io.Reader, error) {
+	// Check if file exists locally first, unless it is still being fetched
+	if !s.fetches.inFlight(key) && s.store.Has(s.ID, key) {
+		start := t.now()
+		if err := s.rehydrate(key); err != nil {
+			return nil, err
+		}
+		t.since("rehydrate", start)
 		s.logger.Info("Serving file (%s) from local disk", key)
+		start = t.now()
 		_, r, err := s.store.Read(s.ID, key)
 		if err != nil {
 			return nil, errors.Wrap(err, errors.StorageError, "failed to read local file")
 		}
-		return r, nil
+		s.touch(key)
+		t.since("local_read", start)
+		return s.verifyLocal(key, r)
+	}
+
+	if s.buried(key) {
+		// The replicas peers kept while they missed the delete are stale.
+		return nil, errors.NewFileNotFoundError(key)
 	}
 
 	s.logger.Info("File (%s) not found locally, fetching from network", key)
 
-	// Use retry logic for network operations
-	err := retry.DoSimple(func() error {
-		return s.fetchFileFromNetwork(key)
+	// Concurrent Gets of the key share one fetch, with retry logic for
+	// network operations
+	err := s.fetches.do(key, s.Clock.Now(), func() error {
+		if s.store.Has(s.ID, key) {
+			// Fetched by the one this Get saw in progress.
+			return nil
+		}
+		return s.retry(func() error {
+			return s.fetchFileFromNetwork(key, t)
+		})
 	})
 	
 	if err != nil {
@@ -141,173 +681,772 @@ func (s *FileServer) Get(key string) (io.Reader, error) {
 		return nil, errors.Wrap(err, errors.StorageError, "failed to read file after network fetch")
 	}
 	
-	return r, nil
+	return s.verifyLocal(key, r)
 }
 
-func (s *FileServer) fetchFileFromNetwork(key string) error {
-	if len(s.peers) == 0 {
-		return errors.NewNetworkError("no peers available for file retrieval")
+// GetRange returns length bytes of the object stored under key from
+// offset, up to its end when length is negative, along with the size of
+// the whole object. An object this node lacks is not fetched whole: only
+// the sealed chunks covering the range are, and each is authenticated as it
+// is decrypted. Buckets that keep their replicas unencrypted have nothing
+// but the integrity tag of the whole object to check them by, so those are
+// fetched whole, as are replicas in the CTR format. Unlike Get, reading a
+// range of a local object does not check its integrity tag.
+func (s *FileServer) GetRange(key string, offset, length int64) (_ io.ReadCloser, size int64, err error) {
+	defer func() { s.errorCounts.add("get", err) }()
+	if err := s.beginOp(); err != nil {
+		return nil, 0, err
+	}
+	defer s.ops.end()
+	if offset < 0 {
+		return nil, 0, errors.NewInvalidInputError("negative range offset").WithContext("key", key)
 	}
 
-	msg := Message{
-		Payload: MessageGetFile{
-			ID:  s.ID,
-			Key: hashKey(key),
-		},
+	t := s.trace("get_range", key)
+	r, size, err := s.getRange(key, offset, length, t)
+	t.done(err)
+	if err != nil {
+		return nil, 0, err
 	}
+	return s.files.track(r).(io.ReadCloser), size, nil
+}
 
-	if err := s.broadcast(&msg); err != nil {
-		return err
+func (s *FileServer) getRange(key string, offset, length int64, t *opTrace) (io.ReadCloser, int64, error) {
+	if s.fetches.inFlight(key) || !s.store.Has(s.ID, key) {
+		if s.buried(key) {
+			return nil, 0, errors.NewFileNotFoundError(key)
+		}
+		if !s.decryptSuites(bucketOf(key), "")[CipherSuiteNone] {
+			data, size, err := s.fetchRange(key, offset, length, t)
+			if err == nil {
+				return io.NopCloser(bytes.NewReader(data)), size, nil
+			}
+			if !errors.IsType(err, errors.EncryptionError) {
+				return nil, 0, err
+			}
+		}
+		r, err := s.get(key, t)
+		if err != nil {
+			return nil, 0, err
+		}
+		if c, ok := r.(io.Closer); ok {
+			c.Close()
+		}
 	}
 
-	// Wait for responses with timeout
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+	start := t.now()
+	if err := s.rehydrate(key); err != nil {
+		return nil, 0, err
+	}
+	size, r, err := s.store.ReadRange(s.ID, key, offset, length)
+	if err == errRangeOutOfBounds {
+		return nil, 0, errors.NewInvalidInputError("range out of bounds").WithContext("key", key).WithContext("size", size)
+	}
+	if err != nil {
+		return nil, 0, errors.Wrap(err, errors.StorageError, "failed to read local file")
+	}
+	s.touch(key)
+	t.since("local_read", start)
+	return r, size, nil
+}
 
-	select {
-	case <-ctx.Done():
-		return errors.NewTimeoutError("timeout waiting for file from network")
-	case <-time.After(500 * time.Millisecond):
-		// Continue with processing responses
+// fetchRange fetches length bytes from offset of the object of this node
+// stored under key, up to its end when length is negative, from the peers
+// requestFile asks, and returns them along with the size of the object.
+func (s *FileServer) fetchRange(key string, offset, length int64, t *opTrace) (data []byte, size int64, err error) {
+	if length < 0 {
+		length = math.MaxInt64
 	}
+	err = s.retry(func() error {
+		start := t.now()
+		s.fetchLock.Lock()
+		defer s.fetchLock.Unlock()
+		t.since("fetch_wait", start)
+		return s.requestFrom(key, t, func(addr string, peer p2p.Peer) error {
+			var err error
+			data, size, err = s.fetchRangeFrom(key, addr, peer, offset, length, t)
+			return err
+		})
+	})
+	return data, size, err
+}
 
-	var lastErr error
-	for addr, peer := range s.peers {
-		// First read the file size so we can limit the amount of bytes that we read
-		// from the connection, so it will not keep hanging.
-		var fileSize int64
-		if err := binary.Read(peer, binary.LittleEndian, &fileSize); err != nil {
-			s.logger.Warn("Failed to read file size from peer %s: %v", addr, err)
-			lastErr = err
-			continue
+// verifyLocal wraps a reader over a local object so that reading it to the
+// end fails if the content does not match its recorded integrity tag.
+// Objects stored before integrity tags were recorded are returned as is.
+func (s *FileServer) verifyLocal(key string, r io.Reader) (io.Reader, error) {
+	meta, err := s.store.ReadMeta(s.ID, key)
+	if err != nil || len(meta.HMAC) == 0 {
+		return r, nil
+	}
+	return newVerifyingReader(r, s.keyRing.Lookup, meta, key)
+}
+
+// Meta returns the metadata of an object stored by this node.
+func (s *FileServer) Meta(key string) (ObjectMeta, error) {
+	meta, err := s.store.ReadMeta(s.ID, key)
+	if os.IsNotExist(err) && !s.store.Has(s.ID, key) {
+		return meta, errors.NewFileNotFoundError(key)
+	}
+	if os.IsNotExist(err) {
+		// Objects stored before metadata was recorded.
+		return ObjectMeta{}, nil
+	}
+	return meta, err
+}
+
+// retry runs fn with the default retry policy, waiting on the server's
+// clock between attempts.
+func (s *FileServer) retry(fn retry.RetryableFunc) error {
+	config := retry.DefaultRetryConfig()
+	config.Clock = s.Clock
+	return retry.DoWithTimeout(30*time.Second, config, fn)
+}
+
+// List returns a page of the objects stored by this node whose key starts
+// with prefix; see Store.Iterate for how cursors work.
+func (s *FileServer) List(prefix, cursor string, limit int) ([]StoreEntry, string, error) {
+	entries, next, err := s.store.Iterate(s.ID, prefix, cursor, limit)
+	if err != nil {
+		return nil, "", errors.Wrap(err, errors.StorageError, "failed to list objects")
+	}
+	return entries, next, nil
+}
+
+func (s *FileServer) fetchFileFromNetwork(key string, t *opTrace) error {
+	start := t.now()
+	s.fetchLock.Lock()
+	defer s.fetchLock.Unlock()
+	t.since("fetch_wait", start)
+	return s.requestFile(key, t)
+}
+
+// requestFile fetches key from the ring owners of its replicas (see
+// fetchOrder), and when none of them provided it, from the nodes the DHT
+// says hold one. The other peers are never asked.
+// Only peers that said they hold the object are asked for it, one after
+// the other, so a silent peer costs at most fetchPeerTimeout at each step.
+// Callers hold fetchLock.
+func (s *FileServer) requestFile(key string, t *opTrace) error {
+	return s.requestFrom(key, t, func(addr string, peer p2p.Peer) error {
+		return s.fetchFrom(key, addr, peer, t)
+	})
+}
+
+// requestFrom calls fetch with the peers holding a replica of key, in the
+// order requestFile asks them, until one succeeds.
+func (s *FileServer) requestFrom(key string, t *opTrace, fetch func(addr string, peer p2p.Peer) error) error {
+	replicas, others := s.fetchOrder(key)
+	if len(replicas)+len(others) == 0 {
+		return errors.NewNetworkError("no peers available for file retrieval")
+	}
+
+	var lastErr error = errors.NewNetworkError("no peers provided the requested file")
+	if len(replicas) > 0 {
+		if lastErr = s.fetchFromAny(key, replicas, t, fetch); lastErr == nil {
+			return nil
 		}
+	}
 
-		n, err := s.store.WriteDecrypt(s.EncKey, s.ID, key, io.LimitReader(peer, fileSize))
-		if err != nil {
-			s.logger.Warn("Failed to write file from peer %s: %v", addr, err)
-			lastErr = err
-			peer.CloseStream()
-			continue
+	start := t.now()
+	asked := make(map[string]bool, len(replicas))
+	for _, addr := range replicas {
+		asked[addr] = true
+	}
+	var providers []string
+	for _, addr := range s.findProviders(key) {
+		if !asked[addr] {
+			providers = append(providers, addr)
 		}
+	}
+	t.since("dht_lookup", start)
+	if len(providers) == 0 {
+		return lastErr
+	}
+	return s.fetchFromAny(key, providers, t, fetch)
+}
 
-		s.logger.Info("Received (%d) bytes from peer %s", n, addr)
-		peer.CloseStream()
-		return nil // Success
+// receiveFile reads an object a peer streams in answer to a MessageGetFile
+// resuming at from, storing it locally under key once it passes integrity
+// verification.
+func (s *FileServer) receiveFile(addr string, peer p2p.Peer, key string, from int64) error {
+	err := s.readFetched(addr, peer, key, from)
+	peer.CloseStream()
+	return err
+}
+
+// readFetched reads an object from the stream of a peer, as sent by
+// sendObject from the offset from, storing it locally under key once it
+// passes integrity verification. The stream is left open.
+// What is received is staged first, and kept when the stream is cut off,
+// for the next fetch to resume from (see resumeOffset).
+func (s *FileServer) readFetched(addr string, peer p2p.Peer, key string, from int64) error {
+	fileSize, integrity, client, lock, err := s.readFetchedHeader(addr, peer)
+	if err != nil {
+		return err
 	}
 
-	if lastErr != nil {
-		return lastErr
+	// Only the suites this node would seal the object with are accepted,
+	// and unencrypted data only along with an integrity tag: nothing else
+	// stops a peer from sending forged content.
+	suites := s.decryptSuites(bucketOf(key), "")
+	var noIntegrity [sha256.Size]byte
+	if suites[CipherSuiteNone] && integrity.HMAC == noIntegrity {
+		err := errors.NewValidationError("fetched file of an unencrypted bucket has no integrity tag").
+			WithContext("key", key)
+		s.logger.Warn("Refusing file from peer %s: %v", addr, err)
+		return err
 	}
-	
-	return errors.NewNetworkError("no peers provided the requested file")
+
+	transfer := s.receiving(key, addr, fileSize)
+	received, err := s.store.WriteStaged(s.ID, key, from, transferReader{Reader: io.LimitReader(peer, fileSize), t: transfer})
+	if err == nil && received < fileSize {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		s.logger.Warn("Transfer of %s from peer %s cut off after %d bytes: %v", key, addr, from+received, err)
+		s.transferred(transfer, err)
+		return err
+	}
+
+	// A staged start that belongs to another version of the object fails
+	// to decrypt, or its integrity check, and is dropped with the rest.
+	n, err := s.store.CommitStaged(s.keyRing.Lookup, suites, s.ID, key)
+	if err != nil {
+		s.logger.Warn("Failed to write file from peer %s: %v", addr, err)
+		s.store.Delete(s.ID, key)
+		s.transferred(transfer, err)
+		return err
+	}
+
+	if err := s.checkFetchedIntegrity(key, integrity, client, lock); err != nil {
+		s.logger.Warn("File from peer %s failed integrity verification: %v", addr, err)
+		s.store.Delete(s.ID, key)
+		s.transferred(transfer, err)
+		return err
+	}
+	s.transferred(transfer, nil)
+
+	s.logger.Info("Received (%d) bytes from peer %s", n, addr)
+	return nil
+}
+
+// readFetchedHeader reads what precedes an object in the stream of a peer,
+// as sent by sendObject.
+func (s *FileServer) readFetchedHeader(addr string, peer p2p.Peer) (fileSize int64, integrity integrityHeader, client *ClientMeta, lock *ObjectLock, err error) {
+	// First read the file size so we can limit the amount of bytes that we read
+	// from the connection, so it will not keep hanging.
+	if err = binary.Read(peer, binary.LittleEndian, &fileSize); err != nil {
+		s.logger.Warn("Failed to read file size from peer %s: %v", addr, err)
+		return
+	}
+	if err = binary.Read(peer, binary.LittleEndian, &integrity); err != nil {
+		s.logger.Warn("Failed to read integrity header from peer %s: %v", addr, err)
+		return
+	}
+	if client, err = readClientMeta(peer); err != nil {
+		s.logger.Warn("Failed to read client metadata from peer %s: %v", addr, err)
+		return
+	}
+	if lock, err = readObjectLock(peer); err != nil {
+		s.logger.Warn("Failed to read object lock from peer %s: %v", addr, err)
+	}
+	return
+}
+
+// readFetchedRange reads the sealed chunks covering length bytes from
+// offset of the plaintext of the object stored under key from the stream
+// of a peer, as answered by resp, and returns that plaintext along with
+// the size of the object. The stream is left open.
+func (s *FileServer) readFetchedRange(addr string, peer p2p.Peer, key string, resp MessageGetFileResponse, offset, length int64) ([]byte, int64, error) {
+	fileSize, _, _, _, err := s.readFetchedHeader(addr, peer)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	transfer := s.receiving(key, addr, fileSize)
+	fetched, err := io.ReadAll(transferReader{Reader: io.LimitReader(peer, fileSize), t: transfer})
+	if err == nil && int64(len(fetched)) < fileSize {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		s.transferred(transfer, err)
+		return nil, 0, err
+	}
+	headerLen := 0
+	if len(fetched) >= len(gcmMagic) {
+		headerLen = gcmHeaderSize(string(fetched[:len(gcmMagic)]))
+	}
+	if headerLen == 0 || headerLen > len(fetched) {
+		err := errors.NewCorruptionError("truncated encrypted data header").WithContext("key", key)
+		s.transferred(transfer, err)
+		return nil, 0, err
+	}
+
+	// Every chunk is authenticated as it is decrypted.
+	span := gcmSpanReader{header: fetched[:headerLen], start: resp.Start, chunks: fetched[headerLen:]}
+	obj, err := openGCMObject(s.keyRing.Lookup, s.decryptSuites(bucketOf(key), ""), span, resp.Size)
+	if err != nil {
+		s.transferred(transfer, err)
+		return nil, 0, err
+	}
+	if offset > obj.Size() {
+		s.transferred(transfer, nil)
+		return nil, obj.Size(), errors.NewInvalidInputError("range out of bounds").WithContext("key", key)
+	}
+	if length > obj.Size()-offset {
+		length = obj.Size() - offset
+	}
+	data := make([]byte, length)
+	if n, err := obj.ReadAt(data, offset); n < len(data) {
+		s.transferred(transfer, err)
+		return nil, 0, err
+	}
+	s.transferred(transfer, nil)
+
+	s.logger.Info("Received (%d) bytes of %s from peer %s", len(data), key, addr)
+	return data, obj.Size(), nil
 }
 
 func (s *FileServer) Store(key string, r io.Reader) error {
+	return s.StoreObject(key, r, nil)
+}
+
+// StoreObject stores an object together with metadata supplied by the
+// client. Objects the client marked as encrypted are stored and returned
+// as is, since the servers do not hold their key.
+func (s *FileServer) StoreObject(key string, r io.Reader, client *ClientMeta) error {
+	return s.StoreLockedObject(key, r, client, nil)
+}
+
+// StoreLockedObject is StoreObject for objects locked from the start; a nil
+// lock stores the object unlocked. Storing fails with an ObjectLockedError
+// when the key holds an object whose lock is still active.
+func (s *FileServer) StoreLockedObject(key string, r io.Reader, client *ClientMeta, lock *ObjectLock) error {
+	_, err := s.StoreObjectOnce(key, "", r, client, lock, nil)
+	return err
+}
+
+// StoreResult is the outcome of a store that succeeded.
+type StoreResult struct {
+	// ETag is the ETag of the object stored, and SHA256 the SHA-256 of its
+	// content, hex encoded.
+	ETag   string
+	SHA256 string
+	// Replayed is set when the store was not applied again, having been
+	// sent with the idempotency token of one that was.
+	Replayed bool
+	// Deduplicated is set when the object held the content stored already,
+	// and was neither written nor replicated again.
+	Deduplicated bool
+}
+
+// StoreObjectOnce is StoreLockedObject for stores a client may send again:
+// a store of key sent with the idempotency token of a store of key that
+// succeeded within the last day is not applied again, whatever its
+// content, and reports replayed. The ETag of the object stored by the
+// first is returned either way. An empty token stores the object as
+// StoreLockedObject does. A checksum, when given, is the SHA-256 the client
+// expects of the content: content hashing to anything else fails with a
+// ChecksumError, before anything is written.
+func (s *FileServer) StoreObjectOnce(key, token string, r io.Reader, client *ClientMeta, lock *ObjectLock, checksum []byte) (res StoreResult, err error) {
+	defer func() { s.errorCounts.add("store", err) }()
+	if err := s.beginOp(); err != nil {
+		return StoreResult{}, err
+	}
+	defer s.ops.end()
+
+	t := s.trace("store", key)
+	res, err = s.storeLocked(key, token, r, client, lock, checksum, t)
+	t.done(err)
+	return res, err
+}
+
+func (s *FileServer) storeLocked(key, token string, r io.Reader, client *ClientMeta, lock *ObjectLock, checksum []byte, t *opTrace) (StoreResult, error) {
+	if err := validateIdempotencyToken(token); err != nil {
+		return StoreResult{}, err
+	}
+	if err := client.Validate(); err != nil {
+		return StoreResult{}, err
+	}
+	if err := s.validateLock(lock); err != nil {
+		return StoreResult{}, err
+	}
+	if err := s.checkBucketPolicy(key); err != nil {
+		return StoreResult{}, err
+	}
+	if err := s.checkWritable(); err != nil {
+		return StoreResult{}, err
+	}
+
+	start := t.now()
+	unlock := s.keyLocks.lock(key)
+	defer unlock()
+	t.since("lock_wait", start)
+
+	if token != "" {
+		if w, ok := s.replayedWrite(key, token); ok {
+			s.logger.Info("Store of %s with token %s already applied", key, token)
+			return StoreResult{ETag: w.ETag, SHA256: w.SHA256, Replayed: true}, nil
+		}
+	}
+	meta, data, unchanged, err := s.storeLocal(key, r, client, lock, checksum, t)
+	if err != nil {
+		return StoreResult{}, err
+	}
+	if !unchanged {
+		if err := s.replicate(key, meta, int64(data.Len()), data, t); err != nil {
+			return StoreResult{}, err
+		}
+	}
+	if token != "" {
+		s.rememberWrite(key, token, meta)
+	}
+	return StoreResult{ETag: meta.ETag(), SHA256: meta.ContentSHA256(), Deduplicated: unchanged}, nil
+}
+
+// storeLocal writes an object of this node to the local store, the caller
+// holding the lock of its key, and returns its metadata and its plaintext
+// for the peers to be sent. An object that held the content already is
+// left as it is, and reported unchanged. Content that does not hash to
+// checksum, when given, is refused.
+func (s *FileServer) storeLocal(key string, r io.Reader, client *ClientMeta, lock *ObjectLock, checksum []byte, t *opTrace) (meta ObjectMeta, data *bytes.Buffer, unchanged bool, err error) {
+	if err := s.fences.check(key); err != nil {
+		return ObjectMeta{}, nil, false, err
+	}
+	if err := s.checkNotLocked(s.ID, key); err != nil {
+		return ObjectMeta{}, nil, false, err
+	}
+	previous, _ := s.store.ReadMeta(s.ID, key)
+
 	s.logger.Info("Storing file: %s", key)
 	
+	keyVersion, _ := s.keyRing.Current()
+	mac, err := newIntegrityHash(s.keyRing.Lookup, keyVersion)
+	if err != nil {
+		return ObjectMeta{}, nil, false, errors.Wrap(err, errors.EncryptionError, "failed to create integrity hash")
+	}
+
 	var (
-		fileBuffer = new(bytes.Buffer)
-		tee        = io.TeeReader(r, fileBuffer)
+		fileBuffer   = new(bytes.Buffer)
+		previousSize = s.objectSize(key, previous)
+		sum          = sha256.New()
 	)
 
+	// Read the object whole before writing anything, so it is checked
+	// against the quotas without touching the copy it replaces.
+	start := t.now()
+	if _, err := io.Copy(io.MultiWriter(fileBuffer, mac, sum), r); err != nil {
+		return ObjectMeta{}, nil, false, errors.Wrap(err, errors.StorageError, "failed to read file")
+	}
+	t.since("read", start)
+	if checksum != nil && !bytes.Equal(sum.Sum(nil), checksum) {
+		return ObjectMeta{}, nil, false, errors.NewChecksumError("content does not match the checksum sent").
+			WithContext("key", key)
+	}
+	client = withContentType(client, fileBuffer.Bytes())
+	if err := s.checkUpload(key, fileBuffer.Bytes(), client); err != nil {
+		return ObjectMeta{}, nil, false, err
+	}
+	if err := s.checkQuota(key, int64(fileBuffer.Len())-previousSize); err != nil {
+		return ObjectMeta{}, nil, false, err
+	}
+	if s.unchanged(key, previous, mac.Sum(nil), keyVersion, client, lock) {
+		// Objects stored before checksums were recorded get theirs.
+		previous.SHA256 = sum.Sum(nil)
+		meta, err := s.touchObject(key, previous)
+		return meta, fileBuffer, err == nil, err
+	}
+
 	// Store file locally first
-	size, err := s.store.Write(s.ID, key, tee)
+	start = t.now()
+	size, err := s.store.Write(s.ID, key, bytes.NewReader(fileBuffer.Bytes()))
 	if err != nil {
-		return errors.Wrap(err, errors.StorageError, "failed to write file locally")
+		return ObjectMeta{}, nil, false, errors.Wrap(err, errors.StorageError, "failed to write file locally")
+	}
+	t.since("local_write", start)
+	s.bucketUsage.add(key, size-previousSize)
+
+	meta = ObjectMeta{
+		HMAC:       mac.Sum(nil),
+		KeyVersion: keyVersion,
+		Cipher:     s.replicaEncryption(bucketOf(key)).cipher(),
+		SHA256:     sum.Sum(nil),
+		Bucket:     bucketOf(key),
+		Client:     client,
+		Lock:       lock,
+		StoredAt:   s.Clock.Now(),
+	}
+	meta.CreatedAt = createdAt(previous, meta.StoredAt)
+	meta.Writes = recentWrites(previous.Writes, meta.StoredAt)
+	meta.Epoch = nextEpoch(previous, meta.StoredAt)
+	if err := s.store.WriteMeta(s.ID, key, meta); err != nil {
+		return ObjectMeta{}, nil, false, errors.Wrap(err, errors.StorageError, "failed to write file metadata")
 	}
+	s.dropColdCopy(key, previous.Cold)
+	s.queueMirror(key, false)
+	s.recordChange(key, ChangePut, meta)
+	s.unbury(key)
 	
 	s.logger.Debug("File stored locally: %s (%d bytes)", key, size)
 
-	// Only replicate if we have peers
-	if len(s.peers) == 0 {
+	return meta, fileBuffer, false, nil
+}
+
+// lockPeers takes the send locks of the peers at addrs, in order so that
+// concurrent callers cannot deadlock, and returns the function releasing
+// them.
+func (s *FileServer) lockPeers(addrs []string) (unlock func()) {
+	sorted := append([]string(nil), addrs...)
+	sort.Strings(sorted)
+	unlocks := make([]func(), len(sorted))
+	for i, addr := range sorted {
+		unlocks[i] = s.sendLocks.lock(addr)
+	}
+	return func() {
+		for _, unlock := range unlocks {
+			unlock()
+		}
+	}
+}
+
+// replicate sends the size bytes of plaintext read from r to the peers, as
+// the replica of the object stored by this node under key. Its phases are
+// timed on t.
+func (s *FileServer) replicate(key string, meta ObjectMeta, size int64, r io.Reader, t *opTrace) error {
+	announce := s.storeFileMessage(key, meta, size)
+	replicaSize := announce.Size
+
+	// The other sites get the replica in the background, once the caller
+	// has released the key.
+	if s.crossSiteAsync() {
+		s.queueCrossSite(key)
+	}
+
+	// Only replicate if we have peers with room for the replica
+	peers := s.placementPeers(key, replicaSize, s.syncReplica)
+	if len(peers) == 0 {
 		s.logger.Warn("No peers available for replication")
 		return nil
 	}
 
-	// Broadcast store message to peers
-	msg := Message{
-		Payload: MessageStoreFile{
-			ID:   s.ID,
-			Key:  hashKey(key),
-			Size: size + 16, // Add encryption overhead
-		},
+	// Replicas are pending from here, so the wait below counts as lag.
+	addrs := make([]string, 0, len(peers))
+	for addr := range peers {
+		addrs = append(addrs, addr)
 	}
-
-	if err := s.broadcast(&msg); err != nil {
-		s.logger.Error("Failed to broadcast store message: %v", err)
-		// Don't fail the entire operation if broadcast fails
+	jobs := s.startReplication([]string{key}, addrs, replicaSize)
+	send := s.expectReplicas(key, addrs, 1)
+	announce.Replica = send.id
+	msg := Message{Payload: announce}
+
+	// Nothing else may be sent to the peers until the stream is complete.
+	start := t.now()
+	unlock := s.lockPeers(addrs)
+
+	for addr, peer := range peers {
+		if err := s.writeMessage(peer, &msg); err != nil {
+			s.logger.Error("Failed to send store message to peer %s: %v", addr, err)
+			// Don't fail the entire operation if a peer misses it
+		}
 	}
 
 	// Small delay to ensure peers are ready
-	time.Sleep(5 * time.Millisecond)
+	s.Clock.Sleep(5 * time.Millisecond)
+	t.since("peer_announce", start)
 
-	// Replicate to all peers
-	return s.replicateTopeers(key, fileBuffer)
+	err := s.replicateTopeers(key, r, peers, send, jobs, t)
+	s.finishReplication(jobs, err)
+	unlock()
+	if err != nil {
+		return err
+	}
+	return s.awaitWriteConsistency(key, send, t)
 }
 
-func (s *FileServer) replicateTopeers(key string, fileBuffer *bytes.Buffer) error {
-	if len(s.peers) == 0 {
-		return nil
+// storeFileMessage announces the replica of an object of this node whose
+// plaintext is size bytes long.
+func (s *FileServer) storeFileMessage(key string, meta ObjectMeta, size int64) MessageStoreFile {
+	bucket := bucketOf(key)
+	enc := s.replicaEncryption(bucket)
+	return MessageStoreFile{
+		ID:         s.ID,
+		Key:        hashKey(key),
+		Size:       enc.size(size),
+		HMAC:       meta.HMAC,
+		KeyVersion: meta.KeyVersion,
+		Cipher:     enc.cipher(),
+		SHA256:     meta.SHA256,
+		Bucket:     bucket,
+		Client:     meta.Client,
+		Lock:       meta.Lock,
+		Epoch:      meta.Epoch,
 	}
+}
 
-	peers := make([]io.Writer, 0, len(s.peers))
-	for _, peer := range s.peers {
-		peers = append(peers, peer)
+// replicateTopeers streams the replica of the object stored under key to
+// the peers. A peer the stream cannot be opened to, or a write to fails, is
+// dropped and the stream goes on to the others: its replica counts as
+// failed, for the write consistency of the store to decide whether the
+// store succeeds without it.
+func (s *FileServer) replicateTopeers(key string, r io.Reader, peers map[string]p2p.Peer, send *replicaSend, jobs map[string]*replicationJob, t *opTrace) error {
+	if len(peers) == 0 {
+		return nil
 	}
-	
-	mw := io.MultiWriter(peers...)
-	
-	// Send stream header
-	if _, err := mw.Write([]byte{p2p.IncomingStream}); err != nil {
-		return errors.Wrap(err, errors.NetworkError, "failed to send stream header")
+
+	// Time spent writing to the peers is timed per peer; the rest of the
+	// stream is encryption. What is sent is hashed, for the peers'
+	// acknowledgments to be checked against.
+	var waited time.Duration
+	out := &replicaFanout{send: send, peers: make(map[string]io.Writer, len(peers))}
+	for addr, peer := range peers {
+		// Send stream header
+		if err := peer.OpenStream(); err != nil {
+			out.drop(addr, errors.Wrap(err, errors.NetworkError, "failed to send stream header"))
+			continue
+		}
+		out.peers[addr] = t.timed(s.replication.writer(peer, jobs[addr]), peerPhase(addr), &waited)
 	}
-	
+	start := t.now()
+
 	// Encrypt and send file data
-	n, err := copyEncrypt(s.EncKey, fileBuffer, mw)
+	n, err := s.replicaEncryption(bucketOf(key)).copy(r, out)
+	send.dropped = out.dropped
+	s.replicasSent(send, err)
+	for addr, dropErr := range out.dropped {
+		s.logger.Warn("Dropped peer %s from the replication of %s: %v", addr, key, dropErr)
+		if job, ok := jobs[addr]; ok {
+			s.finishReplication(map[string]*replicationJob{addr: job}, dropErr)
+			delete(jobs, addr)
+		}
+	}
 	if err != nil {
 		return errors.Wrap(err, errors.EncryptionError, "failed to encrypt and send file data")
 	}
+	t.add("encrypt", t.now().Sub(start)-waited)
 
-	s.logger.Info("File replicated to %d peers (%d bytes)", len(s.peers), n)
+	s.logger.Info("File replicated to %d peers (%d bytes)", len(peers)-len(out.dropped), n)
 	return nil
 }
 
+// replicaFanout writes a replica stream to the replicaSend hashing it and
+// to several peers at once. Unlike an io.MultiWriter, it drops a peer a
+// write fails to and goes on writing to the others.
+type replicaFanout struct {
+	send    *replicaSend
+	peers   map[string]io.Writer
+	dropped map[string]error
+}
+
+func (f *replicaFanout) Write(b []byte) (int, error) {
+	for addr, w := range f.peers {
+		n, err := w.Write(b)
+		if err == nil && n != len(b) {
+			err = io.ErrShortWrite
+		}
+		if err != nil {
+			f.drop(addr, errors.Wrap(err, errors.NetworkError, "failed to send file data"))
+		}
+	}
+	return f.send.Write(b)
+}
+
+func (f *replicaFanout) drop(addr string, err error) {
+	if f.dropped == nil {
+		f.dropped = make(map[string]error)
+	}
+	f.dropped[addr] = err
+	delete(f.peers, addr)
+}
+
+// Stop stops the server at once, cutting off the operations in progress;
+// Shutdown lets them finish first. Once started, the server has closed its
+// connections and the readers returned by Get when Stop returns. Stop can
+// be called any number of times, from any goroutine.
 func (s *FileServer) Stop() {
-	s.logger.Info("Stopping file server")
-	close(s.quitch)
+	s.stopOnce.Do(func() {
+		s.logger.Info("Stopping file server")
+		close(s.quitch)
+	})
+	select {
+	case <-s.readych:
+		s.Wait()
+	default:
+		// Never started, or still starting: the loop stops as it begins.
+	}
 }
 
 func (s *FileServer) OnPeer(p p2p.Peer) error {
-	s.peerLock.Lock()
-	defer s.peerLock.Unlock()
-
 	addr := p.RemoteAddr().String()
-	s.peers[addr] = p
+	if s.removed.hasAddr(addr) {
+		s.forgetPeerKey(addr)
+		s.logger.Info("Refusing removed peer: %s", addr)
+		return errors.NewConnectionError("peer was removed").WithContext("peer", addr)
+	}
+	if n, ok := s.peers.add(addr, p, s.MaxPeers); !ok {
+		s.forgetPeerKey(addr)
+		s.logger.Warn("Refusing peer %s: %d peers connected already", addr, n)
+		return errors.NewConnectionError("peer limit reached").WithContext("peer", addr)
+	}
+	s.control.reconnect(addr)
+	s.liveness.alive(addr, s.Clock.Now())
 
 	s.logger.Info("Connected with peer: %s", addr)
+	// The hello tells the new peer our site and capacity too, rather than
+	// wait for the next capacity report.
+	go s.introduce(addr, p)
+	go s.resendDeletes(addr, p)
+
+	// Bring the new peer up to date with the cluster settings we follow.
+	if cs := s.ClusterSettings(); cs.Version > 0 {
+		msg := Message{Payload: MessageClusterSettings{Settings: cs, Sync: true}}
+		if err := s.sendMessage(p, &msg); err != nil {
+			s.logger.Warn("Failed to send cluster settings to peer %s: %v", addr, err)
+		}
+	}
 
 	return nil
 }
 
 func (s *FileServer) loop() {
+	// Each peer's messages are handled in order by a goroutine of its own.
+	// Handling a message can mean reading a whole stream from the peer; with
+	// a single handler for everyone, nodes replicating to each other at the
+	// same time could each wait for a peer busy reading from another.
 	defer func() {
-		s.logger.Info("File server stopped")
+		s.inbox.closeAll()
 		s.Transport.Close()
+		for addr := range s.connectedPeers() {
+			s.dropPeer(addr)
+		}
+		s.files.closeAll()
+		// A lifecycle evaluation or a mirror reconcile under way
+		// finishes first.
+		s.lifecycleLock.Lock()
+		s.lifecycleLock.Unlock()
+		s.mirrorStats.reconcileMu.Lock()
+		s.mirrorStats.reconcileMu.Unlock()
+		s.logger.Info("File server stopped")
 	}()
 
 	s.logger.Info("Starting message processing loop")
 	
 	for {
 		select {
-		case rpc := <-s.Transport.Consume():
-			var msg Message
-			if err := gob.NewDecoder(bytes.NewReader(rpc.Payload)).Decode(&msg); err != nil {
-				s.logger.Error("Failed to decode message from %s: %v", rpc.From, err)
-				continue
+		case rpc, ok := <-s.Transport.Consume():
+			if !ok {
+				// The transport was closed under us: nothing more can
+				// arrive, so the server stops.
+				s.logger.Warn("Transport closed, stopping")
+				s.stopOnce.Do(func() { close(s.quitch) })
+				return
 			}
-			
-			if err := s.handleMessage(rpc.From, &msg); err != nil {
-				s.logger.Error("Failed to handle message from %s: %v", rpc.From, err)
+			if !s.inbox.push(rpc, s.handlePeerMessages) {
+				s.dropSlowPeer(rpc)
+			} else if _, ok := s.peer(rpc.From); !ok {
+				// The peer was dropped while its message was on the way:
+				// its queue goes away once the message is handled.
+				s.inbox.forget(rpc.From)
 			}
 
 		case <-s.quitch:
@@ -317,14 +1456,119 @@ func (s *FileServer) loop() {
 	}
 }
 
+// dropSlowPeer drops the peer that sent rpc, which its full queue left no
+// room for. A stream it announced is given up, for the connection not to
+// wait for it to be read.
+func (s *FileServer) dropSlowPeer(rpc p2p.RPC) {
+	s.logger.Warn("Dropping peer %s: %d of its messages are waiting to be handled", rpc.From, peerQueueSize)
+	peer, ok := s.peer(rpc.From)
+	if !ok {
+		return
+	}
+	if rpc.Stream {
+		peer.CloseStream()
+	}
+	go s.dropPeer(rpc.From)
+}
+
+func (s *FileServer) handlePeerMessages(rpcs <-chan p2p.RPC) {
+	for rpc := range rpcs {
+		if _, ok := s.peer(rpc.From); ok {
+			s.liveness.alive(rpc.From, s.Clock.Now())
+		}
+		msg, err := s.openMessage(rpc.From, rpcFormat(rpc), rpc.Payload)
+		if err != nil {
+			s.errorCounts.add("open_message", err)
+			s.logger.Error("Rejected message from %s: %v", rpc.From, err)
+			continue
+		}
+		if msg.Seq > 0 && !s.receiveControl(rpc.From, msg) {
+			continue
+		}
+
+		s.handling.enter()
+		done := s.resources.start(poolPeerMessages, s.MaxPeers)
+		if err := s.handleMessage(rpc.From, msg); err != nil {
+			s.errorCounts.add("peer_message", err)
+			s.logger.Error("Failed to handle message from %s: %v", rpc.From, err)
+		}
+		done()
+		s.handling.end()
+	}
+}
+
+func (s *FileServer) peer(addr string) (p2p.Peer, bool) {
+	return s.peers.get(addr)
+}
+
 func (s *FileServer) handleMessage(from string, msg *Message) error {
 	switch v := msg.Payload.(type) {
 	case MessageStoreFile:
+		if !validNamespace(v.ID) {
+			return errors.NewInvalidInputError("invalid node id in store message").WithContext("peer", from)
+		}
 		s.logger.Debug("Handling store file message from %s", from)
 		return s.handleMessageStoreFile(from, v)
 	case MessageGetFile:
+		if !validNamespace(v.ID) {
+			return errors.NewInvalidInputError("invalid node id in get message").WithContext("peer", from)
+		}
 		s.logger.Debug("Handling get file message from %s", from)
 		return s.handleMessageGetFile(from, v)
+	case MessageGetFileResponse:
+		return s.handleMessageGetFileResponse(from, v)
+	case MessageStoreBatch:
+		for _, file := range v.Files {
+			if !validNamespace(file.ID) {
+				return errors.NewInvalidInputError("invalid node id in store batch message").WithContext("peer", from)
+			}
+		}
+		s.logger.Debug("Handling store batch message from %s", from)
+		return s.handleMessageStoreBatch(from, v)
+	case MessageGetBatch:
+		if !validNamespace(v.ID) {
+			return errors.NewInvalidInputError("invalid node id in get batch message").WithContext("peer", from)
+		}
+		s.logger.Debug("Handling get batch message from %s", from)
+		return s.handleMessageGetBatch(from, v)
+	case MessageClusterSettings:
+		s.logger.Debug("Handling cluster settings message from %s", from)
+		return s.handleMessageClusterSettings(from, v)
+	case MessageRequest:
+		return s.handleMessageRequest(from, v)
+	case MessageResponse:
+		return s.handleMessageResponse(from, v)
+	case MessageDeleteFile:
+		if !validNamespace(v.ID) {
+			return errors.NewInvalidInputError("invalid node id in delete message").WithContext("peer", from)
+		}
+		s.logger.Debug("Handling delete file message from %s", from)
+		return s.handleMessageDeleteFile(from, v)
+	case MessageLockObject:
+		if !validNamespace(v.ID) {
+			return errors.NewInvalidInputError("invalid node id in lock message").WithContext("peer", from)
+		}
+		s.logger.Debug("Handling lock object message from %s", from)
+		return s.handleMessageLockObject(from, v)
+	case MessageReplicaStored:
+		return s.handleMessageReplicaStored(from, v)
+	case MessageCapacity:
+		return s.handleMessageCapacity(from, v)
+	case MessageGoodbye:
+		return s.handleMessageGoodbye(from, v)
+	case MessageHello:
+		return s.handleMessageHello(from, v)
+	case MessageJob:
+		return s.handleMessageJob(from, v)
+	case MessageAck:
+		return s.handleMessageAck(from, v)
+	case MessageAddProvider:
+		return s.handleMessageAddProvider(from, v)
+	case MessageRunLifecycle:
+		return s.handleMessageRunLifecycle(from, v)
+	case MessageHeartbeat:
+		// Heard from already.
+		return nil
 	default:
 		s.logger.Warn("Unknown message type from %s", from)
 	}
@@ -332,68 +1576,240 @@ func (s *FileServer) handleMessage(from string, msg *Message) error {
 	return nil
 }
 
+// validNamespace reports whether a node ID received from a peer can safely
+// be used as a directory name in the store.
+func validNamespace(id string) bool {
+	return id != "" && id != "." && id != ".." && !strings.ContainsAny(id, "/\\\x00")
+}
+
 func (s *FileServer) handleMessageGetFile(from string, msg MessageGetFile) error {
 	if !s.store.Has(msg.ID, msg.Key) {
 		err := errors.NewFileNotFoundError(msg.Key)
 		s.logger.Debug("File not found for peer %s: %s", from, msg.Key)
-		return err
+		return s.refuseFile(from, msg, err)
 	}
 
 	s.logger.Info("Serving file (%s) to peer %s", msg.Key, from)
 
 	fileSize, r, err := s.store.Read(msg.ID, msg.Key)
 	if err != nil {
-		return errors.Wrap(err, errors.StorageError, "failed to read file for serving")
+		return s.refuseFile(from, msg, errors.Wrap(err, errors.StorageError, "failed to read file for serving"))
 	}
+	file := r.(*os.File)
+	defer func() {
+		if err := file.Close(); err != nil {
+			s.logger.Warn("Failed to close file reader: %v", err)
+		}
+	}()
 
-	if rc, ok := r.(io.ReadCloser); ok {
-		defer func() {
-			if err := rc.Close(); err != nil {
-				s.logger.Warn("Failed to close file reader: %v", err)
-			}
-		}()
+	found := msg.answer()
+	found.Found = true
+	found.Size = fileSize
+	found.Start = msg.From
+	switch {
+	case msg.Length > 0:
+		header, start, end, err := replicaSpan(file, fileSize, msg.Offset, msg.Length)
+		if err != nil {
+			return s.refuseFile(from, msg, err)
+		}
+		found.Start = start
+		r = io.MultiReader(bytes.NewReader(header), io.NewSectionReader(file, start, end-start))
+		fileSize = int64(len(header)) + end - start
+	case msg.From > 0:
+		if msg.From > fileSize {
+			return s.refuseFile(from, msg, errors.NewInvalidInputError("resume offset past the end of the replica").
+				WithContext("size", fileSize))
+		}
+		r = io.NewSectionReader(file, msg.From, fileSize-msg.From)
+		fileSize -= msg.From
 	}
 
-	peer, ok := s.peers[from]
+	peer, ok := s.peer(from)
 	if !ok {
 		return errors.NewConnectionError(fmt.Sprintf("peer %s not found", from))
 	}
+	unlock := s.sendLocks.lock(from)
+	defer unlock()
 
-	// First send the "incomingStream" byte to the peer and then we can send
-	// the file size as an int64.
-	if err := peer.Send([]byte{p2p.IncomingStream}); err != nil {
+	// The peer hears the file is found, then gets its stream, whose file
+	// size comes first as an int64.
+	if err := s.writeMessage(peer, &Message{Payload: found}); err != nil {
+		return err
+	}
+	if err := peer.OpenStream(); err != nil {
 		return errors.Wrap(err, errors.NetworkError, "failed to send stream header")
 	}
-	
+	return s.sendObject(peer, from, msg.ID, msg.Key, fileSize, r)
+}
+
+// replicaSpan returns the header of the replica in file, of size bytes,
+// and where the sealed chunks covering length bytes of its plaintext from
+// offset lie in it. Replicas in the CTR format have no chunks to pick.
+func replicaSpan(file io.ReaderAt, size, offset, length int64) (header []byte, start, end int64, err error) {
+	header = make([]byte, gcmHeaderLenV3)
+	n, _ := file.ReadAt(header, 0)
+	if n < len(gcmMagic) || !isGCMMagic(string(header[:len(gcmMagic)])) {
+		return nil, 0, 0, errors.NewEncryptionError("replica is not in a seekable encryption format")
+	}
+	h, err := parseGCMHeader(header[:n])
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	start, end = gcmSpan(h, size, offset, length)
+	return header[:h.len], start, end, nil
+}
+
+// refuseFile tells the peer at addr that the object it asked for with msg
+// cannot be served, for the reason err, which it returns.
+func (s *FileServer) refuseFile(addr string, msg MessageGetFile, err error) error {
+	peer, ok := s.peer(addr)
+	if !ok {
+		return err
+	}
+	resp := msg.answer()
+	resp.Error, resp.ErrorType = err.Error(), errors.GetType(err)
+	if sendErr := s.sendMessage(peer, &Message{Payload: resp}); sendErr != nil {
+		s.logger.Warn("Failed to tell peer %s that %s cannot be served: %v", addr, msg.Key, sendErr)
+	}
+	return err
+}
+
+// sendObject writes the fileSize bytes of the object stored under key in
+// namespace id, read from r, to the open stream of the peer at addr, after
+// its size and metadata.
+func (s *FileServer) sendObject(peer p2p.Peer, addr, id, key string, fileSize int64, r io.Reader) error {
 	if err := binary.Write(peer, binary.LittleEndian, fileSize); err != nil {
 		return errors.Wrap(err, errors.NetworkError, "failed to send file size")
 	}
+
+	// Followed by the integrity tag recorded when the replica was stored, so
+	// the requester can verify what it decrypts. Replicas stored without one
+	// send an empty tag.
+	var (
+		integrity integrityHeader
+		client    *ClientMeta
+		lock      *ObjectLock
+	)
+	if meta, err := s.store.ReadMeta(id, key); err == nil {
+		integrity.KeyVersion = meta.KeyVersion
+		copy(integrity.HMAC[:], meta.HMAC)
+		client = meta.Client
+		lock = meta.Lock
+	}
+	if err := binary.Write(peer, binary.LittleEndian, integrity); err != nil {
+		return errors.Wrap(err, errors.NetworkError, "failed to send integrity header")
+	}
+	if err := writeClientMeta(peer, client); err != nil {
+		return errors.Wrap(err, errors.NetworkError, "failed to send client metadata")
+	}
+	if err := writeObjectLock(peer, lock); err != nil {
+		return errors.Wrap(err, errors.NetworkError, "failed to send object lock")
+	}
 	
-	n, err := io.Copy(peer, r)
+	transfer := s.sending(key, addr, fileSize)
+	n, err := io.Copy(transferWriter{Writer: throttledWriter{Writer: peer, limiter: s.peerBandwidth}, t: transfer}, r)
+	s.transferred(transfer, err)
 	if err != nil {
 		return errors.Wrap(err, errors.NetworkError, "failed to send file data")
 	}
 
-	s.logger.Info("Sent file (%s) to peer %s: %d bytes", msg.Key, from, n)
+	s.logger.Info("Sent file (%s) to peer %s: %d bytes", key, addr, n)
 	return nil
 }
 
 func (s *FileServer) handleMessageStoreFile(from string, msg MessageStoreFile) error {
-	peer, ok := s.peers[from]
+	peer, ok := s.peer(from)
 	if !ok {
 		return errors.NewConnectionError(fmt.Sprintf("peer %s not found", from))
 	}
+	err := s.receiveReplica(peer, from, msg, io.LimitReader(peer, msg.Size))
+	peer.CloseStream()
+	return err
+}
 
+// receiveReplica persists the replica announced by msg, read from r, and
+// acknowledges it to the peer when it asked for it.
+func (s *FileServer) receiveReplica(peer p2p.Peer, from string, msg MessageStoreFile, r io.Reader) (err error) {
 	s.logger.Debug("Receiving file from peer %s: %s (%d bytes)", from, msg.Key, msg.Size)
+	transfer := s.receiving(msg.Key, from, msg.Size)
+	defer func() { s.transferred(transfer, err) }()
+	r = transferReader{Reader: r, t: transfer}
+
+	unlock := s.replicaLock(msg.ID, msg.Key)
+	defer unlock()
+
+	// A replica older than the one held, sent on by a rebalance or a
+	// repair that raced with a store, would replace the newer version.
+	if err := s.checkEpoch(msg.ID, msg.Key, msg.Epoch); err != nil {
+		s.logger.Warn("Rejecting stale replica %s from peer %s", msg.Key, from)
+		io.Copy(io.Discard, r)
+		if msg.Replica != 0 {
+			go s.ackReplica(peer, MessageReplicaStored{ID: msg.ID, Key: msg.Key, Replica: msg.Replica, Rejected: true, Error: err.Error(), ErrorType: errors.GetType(err)})
+		}
+		return err
+	}
+
+	// A locked replica is kept as is, unless the message restores the
+	// content it was stored with, as Repair does. The stream still has to
+	// be consumed for the connection to carry on.
+	if err := s.checkNotLocked(msg.ID, msg.Key); err != nil && !s.restoresReplica(msg) {
+		s.logger.Warn("Rejecting overwrite of locked replica %s from peer %s", msg.Key, from)
+		io.Copy(io.Discard, r)
+		if msg.Replica != 0 {
+			go s.ackReplica(peer, MessageReplicaStored{ID: msg.ID, Key: msg.Key, Replica: msg.Replica, Rejected: true})
+		}
+		return err
+	}
 
-	n, err := s.store.Write(msg.ID, msg.Key, io.LimitReader(peer, msg.Size))
+	// A node whose disk is full or failing takes no replicas, which the
+	// sender hears of rather than counting them as lost; neither does a
+	// node whose bucket policy requires the replica to be encrypted.
+	if err := s.checkReplicaEncryption(msg); err != nil {
+		s.logger.Warn("Rejecting replica %s from peer %s: %v", msg.Key, from, err)
+		io.Copy(io.Discard, r)
+		if msg.Replica != 0 {
+			go s.ackReplica(peer, MessageReplicaStored{ID: msg.ID, Key: msg.Key, Replica: msg.Replica, Rejected: true, Error: err.Error(), ErrorType: errors.GetType(err)})
+		}
+		return err
+	}
+	if err := s.disk.writable(); err != nil {
+		s.logger.Warn("Rejecting replica %s from peer %s: %v", msg.Key, from, err)
+		io.Copy(io.Discard, r)
+		if msg.Replica != 0 {
+			go s.ackReplica(peer, MessageReplicaStored{ID: msg.ID, Key: msg.Key, Replica: msg.Replica, Rejected: true, Error: err.Error(), ErrorType: errors.GetType(err)})
+		}
+		return err
+	}
+
+	// What is persisted is hashed on the way, for the sender to check, and
+	// checked against the announcement before it replaces the replica held.
+	h := sha256.New()
+	check := s.newTransferCheck(msg)
+	defer check.finish()
+	n, err := s.store.WriteVerified(msg.ID, msg.Key, io.TeeReader(r, io.MultiWriter(h, check)), check.verify)
 	if err != nil {
-		return errors.Wrap(err, errors.StorageError, "failed to write file from peer")
+		if errors.IsType(err, errors.CorruptionError) {
+			s.logger.Warn("Rejecting replica %s from peer %s: %v", msg.Key, from, err)
+		} else {
+			err = errors.Wrap(err, errors.StorageError, "failed to write file from peer")
+		}
+		if msg.Replica != 0 {
+			go s.ackReplica(peer, replicaStored(msg, n, h, err))
+		}
+		return err
+	}
+
+	meta := ObjectMeta{HMAC: msg.HMAC, KeyVersion: msg.KeyVersion, Cipher: msg.Cipher, SHA256: msg.SHA256, Bucket: msg.Bucket, Client: msg.Client, Lock: msg.Lock, Epoch: msg.Epoch}
+	if err := s.store.WriteMeta(msg.ID, msg.Key, meta); err != nil {
+		s.logger.Warn("Failed to write metadata for %s: %v", msg.Key, err)
 	}
 
 	s.logger.Info("Stored file from peer %s: %s (%d bytes)", from, msg.Key, n)
+	s.announceReplica(msg.ID, msg.Key)
 
-	peer.CloseStream()
+	if msg.Replica != 0 {
+		go s.ackReplica(peer, replicaStored(msg, n, h, nil))
+	}
 	return nil
 }
 
@@ -405,16 +1821,19 @@ func (s *FileServer) bootstrapNetwork() error {
 
 	s.logger.Info("Bootstrapping network with %d nodes", len(s.BootstrapNodes))
 	
+	var wg sync.WaitGroup
 	for _, addr := range s.BootstrapNodes {
 		if len(addr) == 0 {
 			continue
 		}
 
+		wg.Add(1)
 		go func(addr string) {
+			defer wg.Done()
 			s.logger.Info("Attempting to connect to bootstrap node: %s", addr)
 			
-			err := retry.DoSimple(func() error {
-				return s.Transport.Dial(addr)
+			err := s.retry(func() error {
+				return s.dial(addr)
 			})
 			
 			if err != nil {
@@ -424,26 +1843,129 @@ func (s *FileServer) bootstrapNetwork() error {
 			}
 		}(addr)
 	}
+	wg.Wait()
 
 	return nil
 }
 
+// Start listens for peers and dials the bootstrap nodes, then returns,
+// leaving the server running in the background until Stop. Bootstrap
+// nodes that cannot be reached are retried before Start returns, and dialed
+// again with a backoff after that, as are those the node loses.
 func (s *FileServer) Start() error {
+	select {
+	case <-s.quitch:
+		return errors.NewConfigError("server was stopped and cannot be started again")
+	default:
+	}
 	s.logger.Info("Starting file server on %s", s.Transport.Addr())
 
+	if s.CheckOnStart {
+		if _, err := s.CheckStorage(s.CheckSamplePercent); err != nil {
+			s.logger.Warn("Storage check failed: %v", err)
+		}
+	}
+
 	if err := s.Transport.ListenAndAccept(); err != nil {
 		return errors.Wrap(err, errors.NetworkError, "failed to start transport listener")
 	}
 
-	if err := s.bootstrapNetwork(); err != nil {
+	// Followers join the cluster once promoted.
+	if s.following() {
+		go s.followLoop()
+	} else if err := s.bootstrapNetwork(); err != nil {
 		s.logger.Warn("Bootstrap network failed: %v", err)
 	}
 
-	s.loop()
+	if len(s.Lifecycle) > 0 || (s.ColdTier != nil && s.ColdAfter > 0) {
+		go s.lifecycleLoop()
+	}
+	if s.Mirror != nil {
+		go s.mirrorLoop()
+		go s.mirrorReconcileLoop()
+	}
+	if s.crossSiteAsync() {
+		go s.crossSiteLoop()
+	}
+	if s.PeerTLS != nil {
+		go s.tlsLoop()
+	}
+	go s.capacityLoop()
+	go s.controlLoop()
+	go s.gcLoop()
+	go s.antiEntropyLoop()
+	go s.consistencyLoop()
+	go s.heartbeatLoop()
+	go s.reconnectLoop()
+	go s.dhtLoop()
+	go s.diskLoop()
+	go s.resourceLoop()
+
+	go func() {
+		defer close(s.donech)
+		s.loop()
+	}()
+	close(s.readych)
+	return nil
+}
+
+// Ready returns a channel closed once Start has the server listening and
+// bootstrapped.
+func (s *FileServer) Ready() <-chan struct{} {
+	return s.readych
+}
+
+// Wait blocks until a started server has stopped.
+func (s *FileServer) Wait() {
+	<-s.donech
+}
+
+// Run starts the server and serves until ctx is done, then stops it. It
+// also returns when the server is stopped by other means.
+func (s *FileServer) Run(ctx context.Context) error {
+	if err := s.Start(); err != nil {
+		return err
+	}
+	select {
+	case <-ctx.Done():
+		s.Stop()
+	case <-s.donech:
+	}
+	s.Wait()
 	return nil
 }
 
 func init() {
-	gob.Register(MessageStoreFile{})
-	gob.Register(MessageGetFile{})
+	registerMessage(MessageStoreFile{})
+	registerMessage(MessageGetFile{})
+	registerMessage(MessageGetFileResponse{})
+	registerMessage(MessageClusterSettings{})
+	registerMessage(MessageProposeSettings{})
+	registerMessage(MessageQuery{})
+	registerMessage(MessageSyncDigest{})
+	registerMessage(MessageSyncEntries{})
+	registerMessage(MessageDescribeReplica{})
+	registerMessage(MessageHeartbeat{})
+	registerMessage(MessageReplicaDescription{})
+	registerMessage(MessageQueryResult{})
+	registerMessage(MessageListFiles{})
+	registerMessage(MessageListFilesResult{})
+	registerMessage(MessageLockObject{})
+	registerMessage(MessageDeleteFile{})
+	registerMessage(MessageRunLifecycle{})
+	registerMessage(MessageCheckReplica{})
+	registerMessage(MessageReplicaStatus{})
+	registerMessage(MessageReplicaStored{})
+	registerMessage(MessageCapacity{})
+	registerMessage(MessageGoodbye{})
+	registerMessage(MessageAck{})
+	registerMessage(MessageHello{})
+	registerMessage(MessageJob{})
+	registerMessage(MessageRequest{})
+	registerMessage(MessageResponse{})
+	registerMessage(MessageStoreBatch{})
+	registerMessage(MessageGetBatch{})
+	registerMessage(MessageFindNode{})
+	registerMessage(MessageFindNodeResult{})
+	registerMessage(MessageAddProvider{})
 }
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/anthdm/foreverstore/client"
+	"github.com/anthdm/foreverstore/clock"
+	"github.com/anthdm/foreverstore/config"
+	"github.com/anthdm/foreverstore/errors"
+	"github.com/anthdm/foreverstore/logger"
+	"github.com/anthdm/foreverstore/p2p"
+	"github.com/anthdm/foreverstore/tier"
+)
+
+// Option adjusts the server New builds.
+type Option func(*serverBuild)
+
+type serverBuild struct {
+	transport p2p.TCPTransportOpts
+	// key and identity, when set, stand for the key ring and the identity
+	// New would otherwise load, or create, under the storage root.
+	key      []byte
+	identity ed25519.PrivateKey
+	// adjust edit the options of the server once filled in from the
+	// configuration.
+	adjust []func(*FileServerOpts)
+}
+
+// WithClock has the server time its waits, retries and timestamps with c.
+func WithClock(c clock.Clock) Option {
+	return func(b *serverBuild) {
+		b.adjust = append(b.adjust, func(opts *FileServerOpts) { opts.Clock = c })
+	}
+}
+
+// WithEncryptionKey has the server encrypt its data with key, as version
+// EncryptionKeyVersion of the configuration, instead of the key configured
+// or kept in the key file of the storage root.
+func WithEncryptionKey(key []byte) Option {
+	return func(b *serverBuild) { b.key = key }
+}
+
+// WithIdentity has the server sign its control messages with identity
+// instead of the identity kept in the identity file.
+func WithIdentity(identity ed25519.PrivateKey) Option {
+	return func(b *serverBuild) { b.identity = identity }
+}
+
+// WithTransportOptions has fn edit the options of the TCP transport of the
+// server, as filled in from the configuration.
+func WithTransportOptions(fn func(*p2p.TCPTransportOpts)) Option {
+	return func(b *serverBuild) { fn(&b.transport) }
+}
+
+// WithColdTier has the server offload the objects that go unread for after
+// to backend.
+func WithColdTier(backend tier.Backend, after time.Duration) Option {
+	return func(b *serverBuild) {
+		b.adjust = append(b.adjust, func(opts *FileServerOpts) {
+			opts.ColdTier = backend
+			opts.ColdAfter = after
+		})
+	}
+}
+
+// WithMirror has the server back its objects up to backend.
+func WithMirror(backend tier.Backend) Option {
+	return func(b *serverBuild) {
+		b.adjust = append(b.adjust, func(opts *FileServerOpts) { opts.Mirror = backend })
+	}
+}
+
+// WithFollowSource has the server follow the objects of bucket on src, the
+// whole of them when bucket is empty.
+func WithFollowSource(src FollowSource, bucket string) Option {
+	return func(b *serverBuild) {
+		b.adjust = append(b.adjust, func(opts *FileServerOpts) {
+			opts.Follow = src
+			opts.FollowBucket = bucket
+		})
+	}
+}
+
+// WithServerOptions has fn edit the options of the server, as filled in
+// from the configuration, for what the configuration does not cover.
+func WithServerOptions(fn func(*FileServerOpts)) Option {
+	return func(b *serverBuild) { b.adjust = append(b.adjust, fn) }
+}
+
+// New builds a server as the configuration cfg describes it, ready to
+// Start: its TCP transport, wired to the server, its key ring and identity,
+// loaded or created under the storage root, its on-disk layout and its
+// tiers. A nil cfg stands for config.DefaultConfig(). opts adjust the
+// server for embedders.
+func New(cfg *config.Config, opts ...Option) (*FileServer, error) {
+	if cfg == nil {
+		cfg = config.DefaultConfig()
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, errors.Wrap(err, errors.ConfigError, "invalid configuration")
+	}
+
+	b := serverBuild{transport: p2p.TCPTransportOpts{
+		ListenAddr:  cfg.ListenAddr,
+		ListenAddrs: cfg.ListenAddrs,
+		Decoder:     p2p.DefaultDecoder{},
+		TCP: p2p.TCPOptions{
+			KeepAlive:   time.Duration(cfg.TCPKeepAlive) * time.Second,
+			Delay:       !cfg.TCPNoDelay,
+			ReadBuffer:  cfg.TCPReadBuffer,
+			WriteBuffer: cfg.TCPWriteBuffer,
+		},
+	}}
+	var peerTLS *PeerTLS
+	if cfg.TLSCertFile != "" {
+		var err error
+		if peerTLS, err = NewPeerTLS(cfg.TLSCertFile, cfg.TLSKeyFile, cfg.TLSCAFile); err != nil {
+			return nil, err
+		}
+		peerTLS.OptionalClientCert = cfg.TLSClientCertOptional
+		b.transport.TLSConfig = peerTLS.Config()
+	}
+	if cfg.PeerProxy != "" || len(cfg.PeerProxies) > 0 {
+		proxy, err := p2p.NewProxyFunc(cfg.PeerProxy, cfg.PeerProxies)
+		if err != nil {
+			return nil, err
+		}
+		b.transport.Proxy = proxy
+	}
+	for _, opt := range opts {
+		opt(&b)
+	}
+	tcpTransport := p2p.NewTCPTransport(b.transport)
+
+	keyRing, err := b.keyRing(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// Catch keys the cipher suite can't use before any data is written.
+	if keyRing != nil {
+		_, key := keyRing.Current()
+		if _, err := newSuiteAEAD(strings.ToLower(cfg.CipherSuite), key); err != nil {
+			return nil, err
+		}
+	}
+
+	// Objects written with another layout would not be found.
+	pathTransform, err := PathTransformByName(cfg.PathTransform)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkPathTransform(cfg.StorageRoot, cfg.PathTransform); err != nil {
+		return nil, err
+	}
+
+	identity := b.identity
+	if identity == nil {
+		identityFile := cfg.IdentityKeyFile
+		if identityFile == "" {
+			identityFile = filepath.Join(cfg.StorageRoot, defaultIdentityFileName)
+		}
+		if identity, err = loadNodeIdentity(identityFile); err != nil {
+			return nil, err
+		}
+	}
+	var join JoinInfo
+	if cfg.Join != "" {
+		if join, err = joinCluster(cfg, identity); err != nil {
+			return nil, err
+		}
+	}
+	trustedKeys, err := parsePublicKeys(cfg.TrustedPeerKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	var encKey []byte
+	if keyRing != nil {
+		_, encKey = keyRing.Current()
+	}
+
+	fileServerOpts := FileServerOpts{
+		EncKey:                   encKey,
+		KeyRing:                  keyRing,
+		EncryptionMode:           strings.ToLower(cfg.EncryptionMode),
+		CipherSuite:              strings.ToLower(cfg.CipherSuite),
+		StorageRoot:              cfg.StorageRoot,
+		PathTransformFunc:        pathTransform,
+		Transport:                tcpTransport,
+		BootstrapNodes:           cfg.BootstrapNodes,
+		MaxPeers:                 cfg.MaxConnections,
+		WriteConsistency:         strings.ToLower(cfg.WriteConsistency),
+		Identity:                 identity,
+		TrustedPeerKeys:          trustedKeys,
+		JoinToken:                cfg.JoinToken,
+		AdminToken:               cfg.AdminToken,
+		Config:                   cfg,
+		Lifecycle:                cfg.Lifecycle,
+		LifecycleInterval:        time.Duration(cfg.LifecycleInterval) * time.Second,
+		MirrorReconcileInterval:  time.Duration(cfg.MirrorReconcileInterval) * time.Second,
+		CapacityInterval:         time.Duration(cfg.CapacityInterval) * time.Second,
+		GCInterval:               time.Duration(cfg.GCInterval) * time.Second,
+		AntiEntropyInterval:      time.Duration(cfg.AntiEntropyInterval) * time.Second,
+		ConsistencyCheckInterval: time.Duration(cfg.ConsistencyCheckInterval) * time.Second,
+		ConsistencyCheckSample:   cfg.ConsistencyCheckSample,
+		HeartbeatInterval:        time.Duration(cfg.HeartbeatInterval) * time.Second,
+		HeartbeatMisses:          cfg.HeartbeatMisses,
+		ReconnectMaxBackoff:      time.Duration(cfg.ReconnectMaxBackoff) * time.Second,
+		DiskCheckInterval:        time.Duration(cfg.DiskCheckInterval) * time.Second,
+		DiskMinFreeBytes:         cfg.DiskMinFreeBytes,
+		DiskMaxWriteErrors:       cfg.DiskMaxWriteErrors,
+		ResourceCheckInterval:    time.Duration(cfg.ResourceCheckInterval) * time.Second,
+		MaxGoroutines:            cfg.MaxGoroutines,
+		MaxOpenFiles:             cfg.MaxOpenFiles,
+		MaxClockSkew:             time.Duration(cfg.MaxClockSkewMs) * time.Millisecond,
+		CheckOnStart:             cfg.CheckOnStart,
+		CheckSamplePercent:       cfg.CheckSamplePercent,
+		BucketQuotas:             cfg.BucketQuotas,
+		TenantQuotas:             cfg.TenantQuotas,
+		BucketPolicies:           cfg.BucketPolicies,
+		UploadPolicies:           cfg.UploadPolicies,
+		SlowOpThreshold:          time.Duration(cfg.SlowOpThresholdMs) * time.Millisecond,
+		ClientRateLimit:          cfg.ClientRateLimit,
+		PeerBandwidthLimit:       cfg.PeerBandwidthLimit,
+		ReadAhead:                cfg.ReadAheadChunks,
+		ChunkSize:                cfg.ChunkSizeBytes,
+		Site:                     cfg.Site,
+		CrossSiteReplication:     strings.ToLower(cfg.CrossSiteReplication),
+		PeerTLS:                  peerTLS,
+		TLSReloadInterval:        time.Duration(cfg.TLSReloadInterval) * time.Second,
+		AdvertiseAddr:            cfg.AdvertiseAddr,
+	}
+
+	if cfg.HasColdTier() {
+		coldTier, err := tierBackend(cfg.ColdTierDir, cfg.ColdTierEndpoints, cfg.TierToken, "cold/")
+		if err != nil {
+			return nil, err
+		}
+		fileServerOpts.ColdTier = coldTier
+		fileServerOpts.ColdAfter = time.Duration(cfg.ColdAfterDays) * 24 * time.Hour
+	}
+	if cfg.MirrorDir != "" || len(cfg.MirrorEndpoints) > 0 {
+		mirror, err := tierBackend(cfg.MirrorDir, cfg.MirrorEndpoints, cfg.TierToken, "mirror/")
+		if err != nil {
+			return nil, err
+		}
+		fileServerOpts.Mirror = mirror
+	}
+	if cfg.AccessLogFile != "" {
+		maxSize, backups := cfg.AccessLogMaxSizeMB, cfg.AccessLogMaxBackups
+		if maxSize == 0 {
+			maxSize = defaultAccessLogMaxSizeMB
+		}
+		if backups == 0 {
+			backups = defaultAccessLogMaxBackups
+		}
+		accessLog, err := logger.NewRotatingFile(cfg.AccessLogFile, int64(maxSize)<<20, backups)
+		if err != nil {
+			return nil, errors.Wrap(err, errors.ConfigError, "failed to open access log")
+		}
+		fileServerOpts.AccessLog = accessLog
+	}
+	if cfg.Follow != "" {
+		fileServerOpts.Follow = newHTTPFollowSource(cfg.Follow)
+		fileServerOpts.FollowBucket = cfg.FollowBucket
+		fileServerOpts.FollowInterval = time.Duration(cfg.FollowInterval) * time.Second
+	}
+	for _, adjust := range b.adjust {
+		adjust(&fileServerOpts)
+	}
+
+	s := NewFileServer(fileServerOpts)
+	s.adoptClusterSettings(join.Settings)
+	if b.transport.HandshakeFunc == nil {
+		tcpTransport.HandshakeFunc = s.handshake(p2p.HandshakeOpts{
+			Secret:     clusterSecret(cfg.ClusterSecret, cfg.JoinToken),
+			MaxVersion: uint32(cfg.MaxProtocolVersion),
+		})
+	}
+	tcpTransport.OnPeer = s.OnPeer
+	tcpTransport.OnPeerDisconnect = s.OnPeerDisconnect
+
+	return s, nil
+}
+
+// keyRing returns the key ring of the server: the key passed with
+// WithEncryptionKey, or else the keys of the configuration.
+func (b *serverBuild) keyRing(cfg *config.Config) (*KeyRing, error) {
+	if b.key == nil {
+		return loadKeyRing(cfg)
+	}
+	ring := NewKeyRing(cfg.EncryptionKeyVersion, b.key)
+	if err := loadRotatedKeys(cfg.StorageRoot, ring); err != nil {
+		return nil, err
+	}
+	return ring, nil
+}
+
+// tierBackend returns the backend keeping a tier in dir, or when dir is
+// empty in the cluster at endpoints, under keys starting with prefix.
+func tierBackend(dir string, endpoints []string, token, prefix string) (tier.Backend, error) {
+	if dir != "" {
+		return tier.NewDir(dir)
+	}
+	api, err := client.New(client.Options{Endpoints: endpoints, Token: token})
+	if err != nil {
+		return nil, err
+	}
+	return tier.NewCluster(api, prefix), nil
+}
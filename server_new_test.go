@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/anthdm/foreverstore/config"
+	"github.com/anthdm/foreverstore/errors"
+	"github.com/anthdm/foreverstore/p2p"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewBuildsAWiredServer(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.ListenAddr = ":0"
+	cfg.StorageRoot = t.TempDir()
+	key := newEncryptionKey()
+	_, identity, err := ed25519.GenerateKey(nil)
+	assert.Nil(t, err)
+
+	s, err := New(cfg,
+		WithEncryptionKey(key),
+		WithIdentity(identity),
+		WithTransportOptions(func(opts *p2p.TCPTransportOpts) { opts.ListenAddr = "127.0.0.1:0" }),
+		WithServerOptions(func(opts *FileServerOpts) { opts.SlowOpThreshold = time.Minute }),
+	)
+	assert.Nil(t, err)
+	_, current := s.keyRing.Current()
+	assert.Equal(t, key, current)
+	assert.Equal(t, identity, s.Identity)
+	assert.Equal(t, time.Minute, s.FileServerOpts.SlowOpThreshold)
+	assert.Equal(t, cfg.MaxConnections, s.MaxPeers)
+	assert.Same(t, cfg, s.Config)
+
+	// Keys passed in are not persisted under the storage root.
+	_, err = os.Stat(filepath.Join(cfg.StorageRoot, defaultIdentityFileName))
+	assert.True(t, os.IsNotExist(err))
+
+	assert.Nil(t, s.Start())
+	defer s.Stop()
+	assert.True(t, strings.HasPrefix(s.Transport.Addr(), "127.0.0.1:"), s.Transport.Addr())
+
+	assert.Nil(t, s.Store("embedded.txt", bytes.NewReader([]byte("stored by an embedder"))))
+	r, err := s.Get("embedded.txt")
+	assert.Nil(t, err)
+	b, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, "stored by an embedder", string(b))
+}
+
+func TestNewRejectsInvalidConfig(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.StorageRoot = t.TempDir()
+	cfg.WriteConsistency = "most"
+
+	_, err := New(cfg)
+	assert.True(t, errors.IsType(err, errors.ConfigError), err)
+}
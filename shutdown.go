@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/anthdm/foreverstore/errors"
+)
+
+// shutdownPoll is how often Shutdown checks whether the mirror queue has
+// been flushed.
+const shutdownPoll = 10 * time.Millisecond
+
+// MessageGoodbye tells the peers a node is shutting down, so they stop
+// sending it work before its connections go away.
+type MessageGoodbye struct {
+	ID string
+}
+
+// inflight counts the operations in progress, and lets a shutdown refuse
+// new ones and wait for the others to finish.
+type inflight struct {
+	mu      sync.Mutex
+	closed  bool
+	n       int
+	drained chan struct{}
+}
+
+// begin counts an operation in, unless the tracker is closed.
+func (t *inflight) begin() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return false
+	}
+	t.n++
+	return true
+}
+
+// enter counts an operation in even once the tracker is closed, for the
+// work the server cannot refuse, like answering its peers.
+func (t *inflight) enter() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.n++
+}
+
+func (t *inflight) end() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.n--
+	if t.n == 0 && t.drained != nil {
+		close(t.drained)
+		t.drained = nil
+	}
+}
+
+// draining reports whether the tracker is closed.
+func (t *inflight) draining() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.closed
+}
+
+// drain closes the tracker and returns a channel closed once no operation
+// is in progress.
+func (t *inflight) drain() <-chan struct{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closed = true
+	ch := make(chan struct{})
+	if t.n == 0 {
+		close(ch)
+	} else {
+		t.drained = ch
+	}
+	return ch
+}
+
+// openFiles keeps the readers of local files handed out to clients, for
+// the server to close those still open when it stops.
+type openFiles struct {
+	mu    sync.Mutex
+	files map[*openFile]struct{}
+}
+
+// openFile is a reader of a local file that leaves its set when closed.
+type openFile struct {
+	io.Reader
+	closer io.Closer
+	set    *openFiles
+}
+
+func (f *openFile) Close() error {
+	f.set.mu.Lock()
+	delete(f.set.files, f)
+	f.set.mu.Unlock()
+	return f.closer.Close()
+}
+
+// track adds r to the set when it needs closing, and returns the reader to
+// hand out in its place.
+func (o *openFiles) track(r io.Reader) io.Reader {
+	c, ok := r.(io.Closer)
+	if !ok {
+		return r
+	}
+	f := &openFile{Reader: r, closer: c, set: o}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.files == nil {
+		o.files = make(map[*openFile]struct{})
+	}
+	o.files[f] = struct{}{}
+	return f
+}
+
+// closeAll closes the readers still open.
+func (o *openFiles) closeAll() {
+	o.mu.Lock()
+	files := o.files
+	o.files = nil
+	o.mu.Unlock()
+	for f := range files {
+		f.closer.Close()
+	}
+}
+
+// beginOp counts a client operation in, failing once the server is
+// shutting down.
+func (s *FileServer) beginOp() error {
+	if !s.ops.begin() {
+		return errors.NewConnectionError("server is shutting down")
+	}
+	return nil
+}
+
+// Draining reports whether the server is shutting down, refusing new client
+// operations.
+func (s *FileServer) Draining() bool {
+	return s.ops.draining()
+}
+
+// Shutdown stops the server gracefully: it refuses new operations, waits
+// for those in progress and for the mirror queue to be flushed, tells the
+// peers it is leaving, waits for the control messages it sent to be
+// acknowledged and for the messages of the peers being handled, and then
+// stops the server and closes its connections. When ctx is done before
+// everything has drained, the server is stopped anyway and the error of
+// ctx is returned.
+func (s *FileServer) Shutdown(ctx context.Context) error {
+	s.logger.Info("Shutting down file server")
+
+	err := waitDone(ctx, s.ops.drain())
+	if err == nil {
+		err = s.flushMirror(ctx)
+	}
+	for _, stats := range s.ReplicationStats() {
+		if stats.PendingBytes > 0 {
+			s.logger.Warn("Shutting down with %d bytes still to replicate to %s", stats.PendingBytes, stats.Peer)
+		}
+	}
+
+	if pending := s.CrossSiteStatus().Pending; pending > 0 {
+		s.logger.Warn("Shutting down with %d objects still to replicate to other sites", pending)
+	}
+
+	if berr := s.broadcast(&Message{Payload: MessageGoodbye{ID: s.ID}}); berr != nil {
+		s.logger.Warn("Failed to say goodbye to peers: %v", berr)
+	}
+	if err == nil {
+		err = s.flushControl(ctx)
+	}
+	if err == nil {
+		err = waitDone(ctx, s.handling.drain())
+	}
+	if err != nil {
+		s.logger.Warn("Shutdown did not drain in time: %v", err)
+	}
+
+	s.Stop()
+	return err
+}
+
+// waitDone waits for done to be closed, or for ctx to be done.
+func waitDone(ctx context.Context, done <-chan struct{}) error {
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// flushMirror waits until the changes queued for the mirror have been
+// copied to it.
+func (s *FileServer) flushMirror(ctx context.Context) error {
+	if s.Mirror == nil {
+		return nil
+	}
+	for s.mirrorPending() {
+		select {
+		case <-s.Clock.After(shutdownPoll):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// flushControl waits until the control messages sent have been
+// acknowledged or given up on.
+func (s *FileServer) flushControl(ctx context.Context) error {
+	for s.control.pending() > 0 {
+		select {
+		case <-s.Clock.After(shutdownPoll):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (s *FileServer) handleMessageGoodbye(from string, msg MessageGoodbye) error {
+	s.logger.Info("Peer %s (%s) is shutting down", from, msg.ID)
+	s.dropPeer(from)
+	return nil
+}
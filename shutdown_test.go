@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/anthdm/foreverstore/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// refusesOps reports whether s refuses new operations.
+func refusesOps(s *FileServer) bool {
+	if err := s.beginOp(); err != nil {
+		return true
+	}
+	s.ops.end()
+	return false
+}
+
+func TestShutdownDrainsInFlightStores(t *testing.T) {
+	c := newTestCluster(t, 3)
+	s := c.nodes[0]
+
+	pr, pw := io.Pipe()
+	stored := make(chan error, 1)
+	go func() { stored <- s.Store("draining", pr) }()
+	// The store is in progress once it has read the first half.
+	_, err := pw.Write([]byte("written before "))
+	assert.Nil(t, err)
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- s.Shutdown(context.Background()) }()
+	c.eventually("shutdown to refuse new operations", func() bool { return refusesOps(s) })
+
+	err = s.Store("late", bytes.NewReader([]byte("refused")))
+	assert.Equal(t, errors.ConnectionError, errors.GetType(err))
+	select {
+	case err := <-shutdown:
+		t.Fatalf("shutdown returned with a store in progress: %v", err)
+	default:
+	}
+
+	_, err = pw.Write([]byte("and after the shutdown began"))
+	assert.Nil(t, err)
+	pw.Close()
+	assert.Nil(t, c.run("store to finish", func() error { return <-stored }))
+	assert.Nil(t, c.run("shutdown to finish", func() error { return <-shutdown }))
+
+	// The store was replicated before the node left, and its peers let it go.
+	assert.True(t, c.holds(1, 0, "draining"))
+	assert.True(t, c.holds(2, 0, "draining"))
+	c.eventually("peers to drop node 0", func() bool {
+		for _, peer := range c.nodes[1:] {
+			for _, p := range peer.Peers() {
+				if p.Addr == "node-0" {
+					return false
+				}
+			}
+		}
+		return true
+	})
+	s.Stop()
+}
+
+func TestShutdownGivesUpAtDeadline(t *testing.T) {
+	c := newTestCluster(t, 2)
+	s := c.nodes[0]
+
+	pr, pw := io.Pipe()
+	stored := make(chan error, 1)
+	go func() { stored <- s.Store("stuck", pr) }()
+	_, err := pw.Write([]byte("never finished"))
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, s.Shutdown(ctx))
+
+	pw.CloseWithError(io.ErrUnexpectedEOF)
+	assert.NotNil(t, c.run("store to fail", func() error { return <-stored }))
+}
+
+func TestStopReleasesConnectionsFilesAndGoroutines(t *testing.T) {
+	base := runtime.NumGoroutine()
+	c := newTestCluster(t, 3)
+	s := c.nodes[0]
+
+	c.store(0, "open", []byte("left open by a client"))
+	c.assertConverged(0, "open")
+	r, err := s.Get("open")
+	assert.Nil(t, err)
+
+	c.stop()
+	// Stopping again, even concurrently, does nothing.
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.Stop()
+		}()
+	}
+	wg.Wait()
+
+	for _, node := range c.nodes {
+		assert.Empty(t, node.Peers())
+	}
+	_, err = io.ReadAll(r)
+	assert.ErrorIs(t, err, os.ErrClosed)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > base {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<20)
+			t.Fatalf("%d goroutines left running after stop:\n%s",
+				runtime.NumGoroutine()-base, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestClosingTheTransportStopsTheServer(t *testing.T) {
+	c := newTestCluster(t, 2)
+	s := c.nodes[0]
+
+	assert.Nil(t, c.faults[0].Close())
+	c.run("server to stop", func() error {
+		s.Wait()
+		return nil
+	})
+	assert.Empty(t, s.Peers())
+	assert.NotNil(t, s.Start())
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// FetchStatus is a fetch of an object from the network in progress.
+type FetchStatus struct {
+	Key       string    `json:"key"`
+	StartedAt time.Time `json:"started_at"`
+	// Waiters counts the Gets waiting for the fetch, the one that started
+	// it included.
+	Waiters int `json:"waiters"`
+	// Prefetch is set for the fetches started by read-ahead.
+	Prefetch bool `json:"prefetch,omitempty"`
+}
+
+// FetchStats reports the fetches of objects from the network.
+type FetchStats struct {
+	InFlight []FetchStatus `json:"in_flight"`
+	// Fetches counts the fetches made, Prefetches those of them started by
+	// read-ahead, and Coalesced the Gets that waited for a fetch already in
+	// progress instead of making their own.
+	Fetches    int `json:"fetches"`
+	Prefetches int `json:"prefetches"`
+	Coalesced  int `json:"coalesced"`
+}
+
+type fetchCall struct {
+	done      chan struct{}
+	err       error
+	startedAt time.Time
+	waiters   int
+	prefetch  bool
+}
+
+// fetchGroup makes concurrent fetches of the same key share a single one.
+type fetchGroup struct {
+	mu         sync.Mutex
+	calls      map[string]*fetchCall
+	fetches    int
+	prefetches int
+	coalesced  int
+}
+
+// do calls fn to fetch key, unless a fetch of key is already in progress,
+// in which case it waits for that one and returns its result instead. A
+// failed prefetch is not taken as the result: fn is called then.
+func (g *fetchGroup) do(key string, now time.Time, fn func() error) error {
+	for {
+		c, started := g.start(key, now, false)
+		if started {
+			return g.finish(key, c, fn())
+		}
+		<-c.done
+		if c.err == nil || !c.prefetch {
+			return c.err
+		}
+	}
+}
+
+// prefetch calls fn to fetch key on its own goroutine, unless a fetch of
+// key is already in progress. It reports whether it started the fetch.
+func (g *fetchGroup) prefetch(key string, now time.Time, fn func() error) bool {
+	c, started := g.start(key, now, true)
+	if started {
+		go func() { g.finish(key, c, fn()) }()
+	}
+	return started
+}
+
+// start registers a fetch of key, or joins the one in progress, in which
+// case it returns false. Prefetches do not join.
+func (g *fetchGroup) start(key string, now time.Time, prefetch bool) (*fetchCall, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.calls == nil {
+		g.calls = make(map[string]*fetchCall)
+	}
+	if c, ok := g.calls[key]; ok {
+		if !prefetch {
+			c.waiters++
+			g.coalesced++
+		}
+		return c, false
+	}
+
+	c := &fetchCall{done: make(chan struct{}), startedAt: now, prefetch: prefetch}
+	g.fetches++
+	if prefetch {
+		g.prefetches++
+	} else {
+		c.waiters = 1
+	}
+	g.calls[key] = c
+	return c, true
+}
+
+// finish records the result of a fetch and releases its waiters.
+func (g *fetchGroup) finish(key string, c *fetchCall, err error) error {
+	c.err = err
+	g.mu.Lock()
+	delete(g.calls, key)
+	g.mu.Unlock()
+	close(c.done)
+	return err
+}
+
+// inFlight reports whether a fetch of key is in progress.
+func (g *fetchGroup) inFlight(key string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	_, ok := g.calls[key]
+	return ok
+}
+
+func (g *fetchGroup) stats() FetchStats {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	stats := FetchStats{
+		InFlight:   make([]FetchStatus, 0, len(g.calls)),
+		Fetches:    g.fetches,
+		Prefetches: g.prefetches,
+		Coalesced:  g.coalesced,
+	}
+	for key, c := range g.calls {
+		stats.InFlight = append(stats.InFlight, FetchStatus{Key: key, StartedAt: c.startedAt, Waiters: c.waiters, Prefetch: c.prefetch})
+	}
+	sort.Slice(stats.InFlight, func(i, j int) bool { return stats.InFlight[i].Key < stats.InFlight[j].Key })
+	return stats
+}
+
+// FetchStats returns the fetches of objects from the network in progress,
+// ordered by key, and how many were made and shared.
+func (s *FileServer) FetchStats() FetchStats {
+	return s.fetches.stats()
+}
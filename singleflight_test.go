@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConcurrentGetsShareOneFetch(t *testing.T) {
+	c := newTestCluster(t, 3)
+	s := c.nodes[0]
+
+	c.store(0, "shared", []byte("fetched once"))
+	c.assertConverged(0, "shared")
+	assert.Nil(t, s.store.Delete(s.ID, "shared"))
+
+	// The fetch waits for fetchLock, held until every get has joined it.
+	s.fetchLock.Lock()
+	const gets = 20
+	results := make(chan []byte, gets)
+	for i := 0; i < gets; i++ {
+		go func() {
+			r, err := s.Get("shared")
+			if err != nil {
+				t.Errorf("get failed: %v", err)
+				results <- nil
+				return
+			}
+			data, _ := io.ReadAll(r)
+			results <- data
+		}()
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		stats := s.FetchStats()
+		if len(stats.InFlight) == 1 && stats.InFlight[0].Waiters == gets {
+			assert.Equal(t, "shared", stats.InFlight[0].Key)
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for the gets to join the fetch: %+v", stats)
+		}
+		runtime.Gosched()
+	}
+	s.fetchLock.Unlock()
+
+	for i := 0; i < gets; i++ {
+		var data []byte
+		c.eventually("gets to finish", func() bool {
+			select {
+			case data = <-results:
+				return true
+			default:
+				return false
+			}
+		})
+		assert.Equal(t, []byte("fetched once"), data)
+	}
+
+	stats := s.FetchStats()
+	assert.Empty(t, stats.InFlight)
+	assert.Equal(t, 1, stats.Fetches)
+	assert.Equal(t, gets-1, stats.Coalesced)
+
+	// Once the fetch is over the object is read locally.
+	assert.Equal(t, []byte("fetched once"), c.get(0, "shared"))
+	assert.Equal(t, 1, s.FetchStats().Fetches)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/anthdm/foreverstore/clock"
+	"github.com/anthdm/foreverstore/config"
+)
+
+// opTrace times an operation and the phases it goes through, so that an
+// operation slower than the slow-op threshold can be logged with where its
+// time went. A nil trace records nothing.
+type opTrace struct {
+	s     *FileServer
+	op    string
+	key   string
+	start time.Time
+
+	mu     sync.Mutex
+	phases []opPhase
+}
+
+type opPhase struct {
+	name string
+	d    time.Duration
+}
+
+// trace starts timing op on key. It returns nil when slow-op logging is
+// disabled.
+func (s *FileServer) trace(op, key string) *opTrace {
+	if s.SlowOpThreshold() <= 0 {
+		return nil
+	}
+	return &opTrace{s: s, op: op, key: key, start: s.Clock.Now()}
+}
+
+// add counts d against the phase name. Phases keep the order they were
+// first added in.
+func (t *opTrace) add(name string, d time.Duration) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := range t.phases {
+		if t.phases[i].name == name {
+			t.phases[i].d += d
+			return
+		}
+	}
+	t.phases = append(t.phases, opPhase{name: name, d: d})
+}
+
+// since counts the time elapsed from start against the phase name.
+func (t *opTrace) since(name string, start time.Time) {
+	if t == nil {
+		return
+	}
+	t.add(name, t.s.Clock.Now().Sub(start))
+}
+
+// now returns the time on the server's clock, or the zero time for a nil
+// trace, to mark the start of a phase.
+func (t *opTrace) now() time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+	return t.s.Clock.Now()
+}
+
+// done ends the operation, logging it when it took longer than the
+// slow-op threshold.
+func (t *opTrace) done(err error) {
+	if t == nil {
+		return
+	}
+	total := t.s.Clock.Now().Sub(t.start)
+	if threshold := t.s.SlowOpThreshold(); threshold <= 0 || total < threshold {
+		return
+	}
+	t.s.logger.Warn("%s", t.format(total, err))
+}
+
+// format renders the operation as a single line of key=value pairs.
+func (t *opTrace) format(total time.Duration, err error) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	fields := []string{
+		"slow_op",
+		"op=" + t.op,
+		"key=" + strconv.Quote(t.key),
+		"total=" + total.String(),
+	}
+	for _, p := range t.phases {
+		fields = append(fields, p.name+"="+p.d.String())
+	}
+	if err != nil {
+		fields = append(fields, "error="+strconv.Quote(err.Error()))
+	}
+	return strings.Join(fields, " ")
+}
+
+// timedWriter counts the time spent in writes to w against a phase of a
+// trace, and adds it to waited.
+type timedWriter struct {
+	io.Writer
+	clock  clock.Clock
+	trace  *opTrace
+	phase  string
+	waited *time.Duration
+}
+
+func (w timedWriter) Write(p []byte) (int, error) {
+	start := w.clock.Now()
+	n, err := w.Writer.Write(p)
+	d := w.clock.Now().Sub(start)
+	w.trace.add(w.phase, d)
+	*w.waited += d
+	return n, err
+}
+
+// timed returns w, timing its writes against phase when t is not nil. The
+// writes must not be concurrent, as their time is also added to waited.
+func (t *opTrace) timed(w io.Writer, phase string, waited *time.Duration) io.Writer {
+	if t == nil {
+		return w
+	}
+	return timedWriter{Writer: w, clock: t.s.Clock, trace: t, phase: phase, waited: waited}
+}
+
+// peerPhase names the phase of a trace spent waiting on writes to a peer.
+func peerPhase(addr string) string {
+	return fmt.Sprintf("peer_wait[%s]", addr)
+}
+
+// SlowOpThreshold returns how long a Store, Get or replication may take
+// before it is logged as slow; zero disables slow-op logging.
+func (s *FileServer) SlowOpThreshold() time.Duration {
+	return time.Duration(atomic.LoadInt64(&s.slowOpThreshold))
+}
+
+// SetSlowOpThreshold changes the slow-op threshold of a running server.
+func (s *FileServer) SetSlowOpThreshold(d time.Duration) {
+	atomic.StoreInt64(&s.slowOpThreshold, int64(d))
+}
+
+// slowOpSetting exposes the slow-op threshold of s, in milliseconds, as a
+// runtime setting backed by cfg.
+func slowOpSetting(cfg *config.Config, s *FileServer) config.RuntimeSetting {
+	return config.RuntimeSetting{
+		Get: func() string { return strconv.Itoa(cfg.SlowOpThresholdMs) },
+		Set: func(value string) error {
+			ms, err := strconv.Atoi(value)
+			if err != nil || ms < 0 {
+				return fmt.Errorf("invalid slow op threshold: %s", value)
+			}
+			cfg.SlowOpThresholdMs = ms
+			s.SetSlowOpThreshold(time.Duration(ms) * time.Millisecond)
+			return nil
+		},
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/anthdm/foreverstore/logger"
+	"github.com/anthdm/foreverstore/p2p"
+	"github.com/stretchr/testify/assert"
+)
+
+// logBuffer collects the log lines of the servers of a test.
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// lines returns the lines logged so far that contain substr.
+func (b *logBuffer) lines(substr string) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var lines []string
+	for _, line := range strings.Split(b.buf.String(), "\n") {
+		if strings.Contains(line, substr) {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func TestSlowOpsAreLoggedWithBreakdown(t *testing.T) {
+	logs := &logBuffer{}
+	logger.SetGlobalOutput(logs)
+	c := newTestClusterWith(t, 2, func(node int, opts *FileServerOpts) {
+		opts.SlowOpThreshold = time.Millisecond
+	})
+	logger.SetGlobalOutput(os.Stdout)
+	s := c.nodes[0]
+
+	// Replication waits on the peers, which makes every replicated store slow.
+	c.store(0, "logs/a", []byte("slow write"))
+	lines := logs.lines(`slow_op op=store key="logs/a"`)
+	if assert.Len(t, lines, 1) {
+		for _, phase := range []string{"lock_wait=", "read=", "local_write=", "peer_announce=", "peer_wait[node-1]=", "encrypt="} {
+			assert.Contains(t, lines[0], phase)
+		}
+	}
+
+	// A get fetching from the network waits for the peers to answer.
+	c.assertConverged(0, "logs/a")
+	assert.Nil(t, s.store.Delete(s.ID, "logs/a"))
+	c.faults[1].SetFaults(p2p.FaultConfig{Latency: 5 * time.Millisecond})
+	assert.Equal(t, []byte("slow write"), c.get(0, "logs/a"))
+	c.faults[1].SetFaults(p2p.FaultConfig{})
+	lines = logs.lines(`slow_op op=get key="logs/a"`)
+	if assert.Len(t, lines, 1) {
+		assert.Contains(t, lines[0], "peer_request=")
+		assert.Contains(t, lines[0], "receive[node-1]=")
+	}
+
+	s.SetSlowOpThreshold(0)
+	c.store(0, "logs/b", []byte("not traced"))
+	assert.Empty(t, logs.lines(`key="logs/b"`+" "))
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/anthdm/foreverstore/config"
+	"github.com/anthdm/foreverstore/internal/soak"
+	"github.com/anthdm/foreverstore/logger"
+	"github.com/anthdm/foreverstore/p2p"
+)
+
+// soakOpts configures "fs soak": a soak run against an in-process cluster
+// on a memory network.
+type soakOpts struct {
+	soak.Options
+	Nodes   int
+	Latency time.Duration
+	Jitter  time.Duration
+	Root    string
+}
+
+func defaultSoakOpts() soakOpts {
+	return soakOpts{
+		Options: soak.DefaultOptions(),
+		Nodes:   5,
+		Latency: 2 * time.Millisecond,
+		Jitter:  5 * time.Millisecond,
+	}
+}
+
+// soakCluster is the in-process cluster of a soak run. It implements
+// soak.Faults over its memory network, and soak.Replicas by reading the
+// stores of the nodes directly.
+type soakCluster struct {
+	network *p2p.MemoryNetwork
+	nodes   []*FileServer
+	faults  []*p2p.FaultTransport
+}
+
+// runSoak starts an in-process cluster, runs a soak test against it and
+// returns its report. The error is only set when the soak could not be run
+// at all; broken invariants are listed in the report.
+func runSoak(opts soakOpts, out io.Writer) (*soak.Report, error) {
+	if opts.Nodes < 2 {
+		return nil, fmt.Errorf("a soak needs at least 2 nodes, got %d", opts.Nodes)
+	}
+
+	root := opts.Root
+	if root == "" {
+		dir, err := os.MkdirTemp("", "fs-soak-")
+		if err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(dir)
+		root = dir
+	}
+
+	c, err := startSoakCluster(opts, root)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Stop()
+	return soak.Run(c, opts.Options, out)
+}
+
+func startSoakCluster(opts soakOpts, root string) (*soakCluster, error) {
+	c := &soakCluster{network: p2p.NewMemoryNetwork()}
+	key := newEncryptionKey()
+	faults := p2p.FaultConfig{Latency: opts.Latency, Jitter: opts.Jitter}
+
+	for i := 0; i < opts.Nodes; i++ {
+		transport := c.network.NewTransport(p2p.MemoryTransportOpts{ListenAddr: fmt.Sprintf("soak-%d", i)})
+		ft := p2p.NewFaultTransport(transport, faults, opts.Seed+int64(i))
+
+		bootstrap := make([]string, 0, i)
+		for _, node := range c.nodes {
+			bootstrap = append(bootstrap, node.Transport.Addr())
+		}
+
+		s := NewFileServer(FileServerOpts{
+			EncKey:            key,
+			StorageRoot:       fmt.Sprintf("%s/node-%d", root, i),
+			PathTransformFunc: CASPathTransformFunc,
+			Transport:         ft,
+			BootstrapNodes:    bootstrap,
+		})
+		transport.OnPeer = ft.OnPeer(s.OnPeer)
+		transport.OnPeerDisconnect = ft.OnPeerDisconnect(s.OnPeerDisconnect)
+		c.nodes = append(c.nodes, s)
+		c.faults = append(c.faults, ft)
+		if err := s.Start(); err != nil {
+			c.Stop()
+			return nil, err
+		}
+	}
+
+	deadline := time.Now().Add(30 * time.Second)
+	for !c.connected() {
+		if time.Now().After(deadline) {
+			c.Stop()
+			return nil, fmt.Errorf("soak cluster did not connect within 30s")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return c, nil
+}
+
+func (c *soakCluster) connected() bool {
+	for _, s := range c.nodes {
+		if s.peers.len() != len(c.nodes)-1 {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *soakCluster) Size() int {
+	return len(c.nodes)
+}
+
+func (c *soakCluster) Stop() {
+	for _, s := range c.nodes {
+		s.Stop()
+	}
+}
+
+func (c *soakCluster) Store(node int, key string, data []byte) error {
+	return c.nodes[node].Store(key, bytes.NewReader(data))
+}
+
+func (c *soakCluster) Read(node int, key string) (io.ReadCloser, error) {
+	r, err := c.nodes[node].Get(key)
+	if err != nil {
+		return nil, err
+	}
+	if rc, ok := r.(io.ReadCloser); ok {
+		return rc, nil
+	}
+	return io.NopCloser(r), nil
+}
+
+func (c *soakCluster) Stored(node int, key string) (io.ReadCloser, error) {
+	s := c.nodes[node]
+	_, r, err := s.store.Read(s.ID, key)
+	if err != nil {
+		return nil, err
+	}
+	return r.(io.ReadCloser), nil
+}
+
+// Replica decrypts the replica holder keeps of the object origin stored.
+func (c *soakCluster) Replica(holder, origin int, key string) (io.ReadCloser, error) {
+	var (
+		s  = c.nodes[holder]
+		id = c.nodes[origin].ID
+		k  = hashKey(key)
+	)
+	if !s.store.Has(id, k) {
+		return nil, soak.ErrMissing
+	}
+	_, r, err := s.store.Read(id, k)
+	if err != nil {
+		return nil, err
+	}
+
+	meta, _ := s.store.ReadMeta(id, k)
+	suites := s.decryptSuites(meta.Bucket, meta.Cipher)
+	pr, pw := io.Pipe()
+	go func() {
+		defer r.(io.Closer).Close()
+		_, err := copyDecryptAuto(s.keyRing.Lookup, suites, r, pw)
+		pw.CloseWithError(err)
+	}()
+	return pr, nil
+}
+
+func (c *soakCluster) Partition(left []int) {
+	addrs := make([]string, 0, len(left))
+	for _, node := range left {
+		addrs = append(addrs, c.nodes[node].Transport.Addr())
+	}
+	c.network.Partition(addrs)
+}
+
+func (c *soakCluster) Heal() {
+	c.network.Heal()
+}
+
+// runSoakCommand implements "fs soak". It returns the process exit code:
+// 1 when an invariant broke, 2 when the soak could not run.
+func runSoakCommand(args []string) int {
+	opts := defaultSoakOpts()
+	flags := flag.NewFlagSet("soak", flag.ExitOnError)
+	opts.RegisterFlags(flags)
+	flags.IntVar(&opts.Nodes, "nodes", opts.Nodes, "number of nodes in the cluster")
+	flags.DurationVar(&opts.Latency, "latency", opts.Latency, "latency added to every network write and message")
+	flags.DurationVar(&opts.Jitter, "jitter", opts.Jitter, "random latency added on top of -latency")
+	flags.StringVar(&opts.Root, "root", "", "storage directory for the nodes (default: a temporary directory)")
+	logLevel := flags.String("log-level", "error", "log level of the nodes")
+	flags.Parse(args)
+
+	logger.SetGlobalLevel((&config.Config{LogLevel: *logLevel}).GetLogLevel())
+
+	report, err := runSoak(opts, os.Stdout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "soak failed: %v\n", err)
+		return 2
+	}
+	return soak.PrintReport(os.Stdout, report)
+}
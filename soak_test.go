@@ -0,0 +1,28 @@
+package main
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShortSoakHoldsInvariants(t *testing.T) {
+	opts := defaultSoakOpts()
+	opts.Nodes = 3
+	opts.Duration = time.Second
+	opts.ObjectSize = 4 * 1024
+	opts.FaultInterval = 300 * time.Millisecond
+	opts.VerifyInterval = 250 * time.Millisecond
+	opts.Seed = 1
+	opts.Root = t.TempDir()
+
+	report, err := runSoak(opts, io.Discard)
+	assert.Nil(t, err)
+	assert.Empty(t, report.Violations)
+	assert.Greater(t, report.Stores, int64(0))
+	assert.Greater(t, report.Partitions, 0)
+	// The final check covers every object stored.
+	assert.GreaterOrEqual(t, report.Verified, int(report.Stores))
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"io"
+	"time"
+
+	"github.com/anthdm/foreverstore/errors"
+)
+
+// defaultStatTimeout bounds the wait for peers to tell whether they hold a
+// replica of an object being described.
+const defaultStatTimeout = 2 * time.Second
+
+// ObjectStat describes an object stored by this node, from its metadata and
+// without reading it.
+type ObjectStat struct {
+	Key string `json:"key"`
+	// Node is the ID of the node that stored the object.
+	Node        string `json:"node"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"content_type"`
+	// CreatedAt is when the object was first stored under its key, and
+	// ModifiedAt when it was last. Objects stored before creation times
+	// were recorded count from their last store.
+	CreatedAt  time.Time `json:"created_at,omitempty"`
+	ModifiedAt time.Time `json:"modified_at,omitempty"`
+	// Checksum is the ETag of the object, derived from its integrity tag.
+	// It is empty for objects stored without one.
+	Checksum string `json:"checksum,omitempty"`
+	// SHA256 is the SHA-256 of the content of the object, hex encoded, for
+	// clients to check what they read against. It is empty for objects
+	// stored before it was recorded.
+	SHA256 string `json:"sha256,omitempty"`
+	// Replicas counts the peers that said they hold a replica, of those
+	// that answered in time; the count is partial when some did not.
+	Replicas int  `json:"replicas"`
+	Locked   bool `json:"locked,omitempty"`
+	// Cold is set while the object is offloaded to the cold tier.
+	Cold bool `json:"cold,omitempty"`
+	Partial
+}
+
+// createdAt returns when an object replaced by a store at now, whose
+// metadata is previous, was first stored: now when there was none.
+func createdAt(previous ObjectMeta, now time.Time) time.Time {
+	switch {
+	case !previous.CreatedAt.IsZero():
+		return previous.CreatedAt
+	case !previous.StoredAt.IsZero():
+		return previous.StoredAt
+	}
+	return now
+}
+
+// Stat describes the object stored under key, and asks the peers whether
+// they hold a replica of it, waiting up to timeout for their answers. A
+// local copy that is missing is restored from the replicas first, as Get
+// does.
+func (s *FileServer) Stat(key string, timeout time.Duration) (ObjectStat, error) {
+	if !s.store.Has(s.ID, key) {
+		r, err := s.Get(key)
+		if err != nil {
+			return ObjectStat{}, err
+		}
+		if c, ok := r.(io.Closer); ok {
+			c.Close()
+		}
+	}
+
+	entry, meta, err := s.store.Stat(s.ID, key)
+	if err != nil {
+		return ObjectStat{}, errors.Wrap(err, errors.StorageError, "failed to stat object")
+	}
+	stat := ObjectStat{
+		Key:         key,
+		Node:        s.ID,
+		Size:        entry.Size,
+		ContentType: "application/octet-stream",
+		CreatedAt:   meta.CreatedAt,
+		ModifiedAt:  meta.StoredAt,
+		Checksum:    meta.ETag(),
+		SHA256:      meta.ContentSHA256(),
+		Locked:      s.lockStatus(meta.Lock).Locked,
+		Cold:        meta.Cold != nil,
+	}
+	if meta.Client != nil && meta.Client.ContentType != "" {
+		stat.ContentType = meta.Client.ContentType
+	}
+	if stat.CreatedAt.IsZero() {
+		stat.CreatedAt = stat.ModifiedAt
+	}
+
+	answers, partial := s.askReplicas(key, MessageCheckReplica{ID: s.ID, Key: hashKey(key), PresenceOnly: true}, timeout)
+	stat.Partial = partial
+	for _, status := range answers {
+		if status.Present {
+			stat.Replicas++
+		}
+	}
+	return stat, nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/anthdm/foreverstore/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatDescribesObjectsAndCountsTheirReplicas(t *testing.T) {
+	c := newTestCluster(t, 3)
+	s := c.nodes[0]
+	c.store(0, "doc", []byte("first"))
+	created := s.Clock.Now()
+	c.clock.Advance(time.Hour)
+	c.store(0, "doc", []byte("second version"))
+	c.assertConverged(0, "doc")
+
+	var stat ObjectStat
+	stats := func() {
+		t.Helper()
+		assert.Nil(t, c.run("stat", func() (err error) {
+			stat, err = s.Stat("doc", time.Second)
+			return err
+		}))
+	}
+	stats()
+	assert.Equal(t, "doc", stat.Key)
+	assert.Equal(t, s.ID, stat.Node)
+	assert.Equal(t, int64(len("second version")), stat.Size)
+	assert.False(t, stat.CreatedAt.After(created))
+	assert.GreaterOrEqual(t, stat.ModifiedAt.Sub(stat.CreatedAt), time.Hour)
+	assert.NotEmpty(t, stat.Checksum)
+	sum := sha256.Sum256([]byte("second version"))
+	assert.Equal(t, hex.EncodeToString(sum[:]), stat.SHA256)
+	assert.Equal(t, 2, stat.Replicas)
+	assert.False(t, stat.Partial.Partial)
+
+	// A lost local copy is restored from the replicas first.
+	assert.Nil(t, s.store.Delete(s.ID, "doc"))
+	c.partition([]int{0, 1}, []int{2})
+	stats()
+	assert.Equal(t, int64(len("second version")), stat.Size)
+	assert.Equal(t, hex.EncodeToString(sum[:]), stat.SHA256, "the checksum is restored too")
+	assert.Equal(t, 1, stat.Replicas)
+	assert.True(t, stat.Partial.Partial, "the peer cut off is reported")
+
+	_, _, err := s.store.Stat(s.ID, "missing")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestStoreVerifiesTheChecksumSent(t *testing.T) {
+	c := newTestCluster(t, 2)
+	s := c.nodes[0]
+	data := []byte("end to end")
+	sum := sha256.Sum256(data)
+
+	wrong := sha256.Sum256([]byte("something else"))
+	err := c.run("store", func() error {
+		_, err := s.StoreObjectOnce("doc", "", bytes.NewReader(data), nil, nil, wrong[:])
+		return err
+	})
+	assert.True(t, errors.IsType(err, errors.ChecksumError), "%v", err)
+	assert.False(t, s.store.Has(s.ID, "doc"), "nothing is written")
+
+	var res StoreResult
+	assert.Nil(t, c.run("store", func() (err error) {
+		res, err = s.StoreObjectOnce("doc", "", bytes.NewReader(data), nil, nil, sum[:])
+		return err
+	}))
+	assert.Equal(t, hex.EncodeToString(sum[:]), res.SHA256)
+
+	// The replicas keep the checksum, to serve the object with.
+	c.assertConverged(0, "doc")
+	meta, err := c.nodes[1].store.ReadMeta(s.ID, hashKey("doc"))
+	assert.Nil(t, err)
+	assert.Equal(t, sum[:], meta.SHA256)
+}
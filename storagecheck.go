@@ -0,0 +1,256 @@
+package main
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anthdm/foreverstore/errors"
+)
+
+const (
+	// storageCheckLogEvery is the number of objects between the progress
+	// reports of a storage check.
+	storageCheckLogEvery = 10000
+	// storageCheckMaxDamaged bounds the keys listed in a storage check
+	// report as needing repair.
+	storageCheckMaxDamaged = 100
+)
+
+// StorageCheckReport is the outcome of reconciling the metadata of the
+// objects on disk with their files.
+type StorageCheckReport struct {
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	// Objects counts the object files found, in every namespace.
+	Objects int `json:"objects"`
+	// Missing counts the metadata files whose object is gone, Orphans the
+	// objects without metadata, and Corrupt the metadata files that cannot
+	// be read.
+	Missing int `json:"missing"`
+	Orphans int `json:"orphans"`
+	Corrupt int `json:"corrupt"`
+	// Rebuilt counts the metadata of this node's own objects rebuilt from
+	// their content, and Dropped the unreadable metadata of replicas
+	// removed, leaving them as replicas stored before metadata was.
+	Rebuilt int `json:"rebuilt"`
+	Dropped int `json:"dropped"`
+	// Sampled counts the objects whose content was checked against their
+	// integrity tag, and Mismatched those that did not match it.
+	Sampled    int `json:"sampled"`
+	Mismatched int `json:"mismatched"`
+	// TempFiles counts the files of key rotations and of replicas being
+	// received interrupted by a shutdown, removed.
+	TempFiles int `json:"temp_files"`
+	// Damaged lists the keys of this node's own objects found missing or
+	// not matching their integrity tag, for Repair to restore from their
+	// replicas. At most storageCheckMaxDamaged are listed.
+	Damaged []string `json:"damaged,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+type storageCheckState struct {
+	mu     sync.Mutex
+	report StorageCheckReport
+}
+
+// CheckStorage reconciles the metadata of every object on disk with the
+// files, as after an unclean shutdown: metadata left without its object is
+// reported, and the metadata of objects lacking it, or whose metadata
+// cannot be read, is rebuilt from the content of the node's own objects.
+// The content of samplePercent percent of the objects is checked against
+// their integrity tag. Rebuilding races with writes, so the check only
+// runs as the server starts, before it serves anything (see CheckOnStart).
+func (s *FileServer) CheckStorage(samplePercent int) (StorageCheckReport, error) {
+	report := StorageCheckReport{StartedAt: s.Clock.Now()}
+	s.logger.Info("Checking storage integrity, content of %d%% of the objects", samplePercent)
+
+	namespaces, err := os.ReadDir(s.store.Root)
+	if err != nil && !os.IsNotExist(err) {
+		err = errors.Wrap(err, errors.StorageError, "failed to list namespaces")
+		return s.finishStorageCheck(report, err)
+	}
+
+	var lastErr error
+	for _, ns := range namespaces {
+		if !ns.IsDir() {
+			continue
+		}
+		root := filepath.Join(s.store.Root, ns.Name())
+		err := filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			s.checkStorageFile(ns.Name(), path, samplePercent, &report)
+			return nil
+		})
+		if err != nil {
+			lastErr = errors.Wrap(err, errors.StorageError, "failed to walk namespace").WithContext("namespace", ns.Name())
+		}
+	}
+	return s.finishStorageCheck(report, lastErr)
+}
+
+func (s *FileServer) finishStorageCheck(report StorageCheckReport, err error) (StorageCheckReport, error) {
+	report.FinishedAt = s.Clock.Now()
+	if err != nil {
+		report.Error = err.Error()
+	}
+	s.logger.Info("Storage check done: %d objects, %d missing, %d orphans, %d corrupt, %d rebuilt, %d of %d sampled mismatched",
+		report.Objects, report.Missing, report.Orphans, report.Corrupt, report.Rebuilt, report.Mismatched, report.Sampled)
+	if len(report.Damaged) > 0 {
+		s.logger.Warn("Storage check found damaged objects, to repair: %s", strings.Join(report.Damaged, ", "))
+	}
+
+	s.storageCheck.mu.Lock()
+	s.storageCheck.report = report
+	s.storageCheck.mu.Unlock()
+	return report, err
+}
+
+// StorageCheckReport returns the outcome of the last storage check.
+func (s *FileServer) StorageCheckReport() StorageCheckReport {
+	s.storageCheck.mu.Lock()
+	defer s.storageCheck.mu.Unlock()
+	return s.storageCheck.report
+}
+
+// checkStorageFile checks the file at path of namespace ns.
+func (s *FileServer) checkStorageFile(ns, path string, samplePercent int, report *StorageCheckReport) {
+	own := ns == s.ID
+	switch filepath.Ext(path) {
+	case rotateTempExt, receiveTempExt:
+		if err := os.Remove(path); err == nil {
+			report.TempFiles++
+		}
+		return
+	case migrateTempExt:
+		return
+	case metaExt:
+		if _, err := os.Stat(strings.TrimSuffix(path, metaExt)); os.IsNotExist(err) {
+			report.Missing++
+			if meta, err := readMetaFile(path); err == nil && own {
+				report.damaged(meta.Key)
+			}
+		}
+		return
+	}
+
+	report.Objects++
+	if report.Objects%storageCheckLogEvery == 0 {
+		s.logger.Info("Storage check: %d objects checked", report.Objects)
+	}
+
+	meta, err := readMetaFile(path + metaExt)
+	switch {
+	case os.IsNotExist(err):
+		report.Orphans++
+	case err != nil:
+		report.Corrupt++
+	}
+	if err != nil {
+		s.recoverMeta(path, own, report)
+		return
+	}
+
+	if meta.Cold != nil || len(meta.HMAC) == 0 || rand.Intn(100) >= samplePercent {
+		return
+	}
+	report.Sampled++
+	if !s.contentMatches(path, own, meta) {
+		report.Mismatched++
+		s.logger.Warn("Storage check: %s does not match its integrity tag", path)
+		if own {
+			report.damaged(meta.Key)
+		}
+	}
+}
+
+// recoverMeta rebuilds the missing or unreadable metadata of the own object
+// at path from its content, and removes that of a replica: the integrity
+// tag of a replica is its owner's to give.
+func (s *FileServer) recoverMeta(path string, own bool, report *StorageCheckReport) {
+	if !own {
+		if err := os.Remove(path + metaExt); err == nil {
+			report.Dropped++
+		}
+		return
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		s.logger.Warn("Storage check: failed to open %s: %v", path, err)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		s.logger.Warn("Storage check: failed to stat %s: %v", path, err)
+		return
+	}
+	version, _ := s.keyRing.Current()
+	sum, err := computeIntegrity(s.keyRing.Lookup, version, f)
+	if err != nil {
+		s.logger.Warn("Storage check: failed to hash %s: %v", path, err)
+		return
+	}
+
+	// The key cannot be recovered from the path: the object is served by
+	// key but not listed until it is stored again.
+	meta := ObjectMeta{HMAC: sum, KeyVersion: version, Cipher: s.replicaCipher(), StoredAt: info.ModTime()}
+	b, err := json.Marshal(meta)
+	if err == nil {
+		err = os.WriteFile(path+metaExt, b, 0644)
+	}
+	if err != nil {
+		s.logger.Warn("Storage check: failed to rebuild metadata of %s: %v", path, err)
+		return
+	}
+	report.Rebuilt++
+	s.logger.Info("Storage check: rebuilt metadata of %s", path)
+}
+
+// contentMatches reports whether the object at path matches the integrity
+// tag of its metadata: over its content for the node's own objects, and
+// over the plaintext of replicas.
+func (s *FileServer) contentMatches(path string, own bool, meta ObjectMeta) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	mac, err := newIntegrityHash(s.keyRing.Lookup, meta.KeyVersion)
+	if err != nil {
+		return false
+	}
+	if own {
+		_, err = io.Copy(mac, f)
+	} else {
+		_, err = copyDecryptAuto(s.keyRing.Lookup, s.decryptSuites(meta.Bucket, meta.Cipher), f, mac)
+	}
+	return err == nil && hmac.Equal(mac.Sum(nil), meta.HMAC)
+}
+
+func (r *StorageCheckReport) damaged(key string) {
+	if key != "" && len(r.Damaged) < storageCheckMaxDamaged {
+		r.Damaged = append(r.Damaged, key)
+	}
+}
+
+// readMetaFile reads the metadata file at path.
+func readMetaFile(path string) (ObjectMeta, error) {
+	var meta ObjectMeta
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return meta, err
+	}
+	err = json.Unmarshal(b, &meta)
+	return meta, err
+}
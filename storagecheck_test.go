@@ -0,0 +1,60 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckStorage(t *testing.T) {
+	c := newTestCluster(t, 2)
+	s, peer := c.nodes[0], c.nodes[1]
+	for _, key := range []string{"orphan", "corrupt", "missing", "tampered", "intact"} {
+		c.store(0, key, []byte("content of "+key))
+		c.assertConverged(0, key)
+	}
+	path := func(node *FileServer, key string) string {
+		return filepath.Join(node.store.Root, s.ID, node.store.PathTransformFunc(key).FullPath())
+	}
+
+	// What an unclean shutdown can leave behind.
+	assert.Nil(t, os.Remove(path(s, "orphan")+metaExt))
+	assert.Nil(t, os.WriteFile(path(s, "corrupt")+metaExt, []byte("{"), 0644))
+	assert.Nil(t, os.Remove(path(s, "missing")))
+	assert.Nil(t, os.WriteFile(path(s, "tampered"), []byte("something else"), 0644))
+	assert.Nil(t, os.WriteFile(path(s, "intact")+rotateTempExt, []byte("partial"), 0644))
+
+	report, err := s.CheckStorage(100)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, report.Objects)
+	assert.Equal(t, 1, report.Missing)
+	assert.Equal(t, 1, report.Orphans)
+	assert.Equal(t, 1, report.Corrupt)
+	assert.Equal(t, 2, report.Rebuilt)
+	assert.Equal(t, 2, report.Sampled)
+	assert.Equal(t, 1, report.Mismatched)
+	assert.Equal(t, 1, report.TempFiles)
+	assert.ElementsMatch(t, []string{"missing", "tampered"}, report.Damaged)
+	assert.Equal(t, report, s.StorageCheckReport())
+
+	// Rebuilt metadata lets the objects be read and verified again.
+	assert.Equal(t, []byte("content of orphan"), c.get(0, "orphan"))
+	assert.Equal(t, []byte("content of corrupt"), c.get(0, "corrupt"))
+	_, err = os.Stat(path(s, "intact") + rotateTempExt)
+	assert.True(t, os.IsNotExist(err))
+
+	// Replicas are checked by decrypting them; their unreadable metadata
+	// is dropped rather than rebuilt.
+	assert.Nil(t, os.WriteFile(path(peer, hashKey("corrupt"))+metaExt, []byte("{"), 0644))
+	report, err = peer.CheckStorage(100)
+	assert.Nil(t, err)
+	assert.Equal(t, 5, report.Objects)
+	assert.Equal(t, 1, report.Dropped)
+	assert.Equal(t, 4, report.Sampled)
+	assert.Zero(t, report.Mismatched)
+	assert.Empty(t, report.Damaged)
+	_, err = os.Stat(path(peer, hashKey("corrupt")) + metaExt)
+	assert.True(t, os.IsNotExist(err))
+}
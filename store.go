@@ -3,12 +3,15 @@ package main
 import (
 	"crypto/sha1"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"path/filepath"
 	"strings"
+	"syscall"
 )
 
 const defaultRootFolderName = "ggnetwork"
@@ -48,6 +51,9 @@ func (p PathKey) FirstPathName() string {
 }
 
 func (p PathKey) FullPath() string {
+	if p.PathName == "" {
+		return p.Filename
+	}
 	return fmt.Sprintf("%s/%s", p.PathName, p.Filename)
 }
 
@@ -55,6 +61,9 @@ type StoreOpts struct {
 	// Root is the folder name of the root, containing all the folders/files of the system.
 	Root              string
 	PathTransformFunc PathTransformFunc
+	// OnWriteError, when set, is called with the error of every write that
+	// fails, for the server to notice a disk that is full or failing.
+	OnWriteError func(error)
 }
 
 var DefaultPathTransformFunc = func(key string) PathKey {
@@ -93,41 +102,146 @@ func (s *Store) Clear() error {
 	return os.RemoveAll(s.Root)
 }
 
+// Usage returns the bytes taken by the files of every namespace in the
+// store, metadata included. A store nothing was written to yet uses none.
+func (s *Store) Usage() (int64, error) {
+	var used int64
+	err := filepath.WalkDir(s.Root, func(_ string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			var info os.FileInfo
+			if info, err = d.Info(); err == nil {
+				used += info.Size()
+			}
+		}
+		// Files deleted while the store is walked no longer take space.
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	})
+	return used, err
+}
+
+// Delete removes the object stored under key in namespace id along with its
+// metadata, then the directories the removal left empty. Objects sharing a
+// directory with it are left alone. Deleting a missing object is not an
+// error.
 func (s *Store) Delete(id string, key string) error {
 	pathKey := s.PathTransformFunc(key)
+	namespace := filepath.Join(s.Root, id)
+	fullPath := filepath.Join(namespace, pathKey.FullPath())
 
-	defer func() {
-		log.Printf("deleted [%s] from disk", pathKey.Filename)
-	}()
+	for _, path := range []string{fullPath, fullPath + metaExt, fullPath + rotateTempExt, fullPath + receiveTempExt, fullPath + fetchTempExt} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
 
-	firstPathNameWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FirstPathName())
+	// Removing a directory fails once it is not empty, which ends the walk.
+	for dir := filepath.Dir(fullPath); dir != namespace && strings.HasPrefix(dir, namespace); dir = filepath.Dir(dir) {
+		if err := os.Remove(dir); err != nil {
+			break
+		}
+	}
 
-	return os.RemoveAll(firstPathNameWithRoot)
+	log.Printf("deleted [%s] from disk", pathKey.Filename)
+	return nil
 }
 
 func (s *Store) Write(id string, key string, r io.Reader) (int64, error) {
-	return s.writeStream(id, key, r)
+	n, err := s.writeStream(id, key, r)
+	return n, s.writeFailed(err)
+}
+
+// writeFailed reports err, when not nil, to OnWriteError and returns it.
+func (s *Store) writeFailed(err error) error {
+	if err != nil && s.OnWriteError != nil {
+		s.OnWriteError(err)
+	}
+	return err
+}
+
+// diskFault classifies the error of a write: full when the disk has no
+// space left, failing when the disk failed the write itself. Other errors,
+// such as those of reading what was to be written, are neither.
+func diskFault(err error) (full, failing bool) {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return false, false
+	}
+	switch errno {
+	case syscall.ENOSPC:
+		return true, false
+	case syscall.EIO, syscall.EROFS:
+		return false, true
+	}
+	return false, false
+}
+
+// receiveTempExt is the extension of a replica being received, until it is
+// verified and renamed over the object.
+const receiveTempExt = ".recv"
+
+// WriteVerified writes what is read from r under key in namespace id once
+// verify, given the number of bytes read, accepts it. Until then it is
+// written next to the object, which is left as it was when verify fails.
+func (s *Store) WriteVerified(id string, key string, r io.Reader, verify func(n int64) error) (int64, error) {
+	f, err := s.createFile(id, key, receiveTempExt)
+	if err != nil {
+		return 0, s.writeFailed(err)
+	}
+	tmpPath := f.Name()
+	defer os.Remove(tmpPath)
+
+	n, err := io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return n, s.writeFailed(err)
+	}
+	if err := verify(n); err != nil {
+		return n, err
+	}
+	return n, s.writeFailed(os.Rename(tmpPath, strings.TrimSuffix(tmpPath, receiveTempExt)))
 }
 
-func (s *Store) WriteDecrypt(encKey []byte, id string, key string, r io.Reader) (int64, error) {
+// WriteDecrypt decrypts r, sealed with one of suites, into the file of the
+// object stored under key in namespace id.
+func (s *Store) WriteDecrypt(keys KeyLookup, suites suiteSet, id string, key string, r io.Reader) (int64, error) {
 	f, err := s.openFileForWriting(id, key)
 	if err != nil {
-		return 0, err
+		return 0, s.writeFailed(err)
 	}
-	n, err := copyDecrypt(encKey, r, f)
-	return int64(n), err
+	defer f.Close()
+	n, err := copyDecryptAuto(keys, suites, r, f)
+	return n, s.writeFailed(err)
 }
 
 func (s *Store) openFileForWriting(id string, key string) (*os.File, error) {
+	return s.createFile(id, key, "")
+}
+
+// createFile creates the file of the object stored under key in namespace
+// id, with ext appended to its name, and the directories leading to it.
+func (s *Store) createFile(id string, key string, ext string) (*os.File, error) {
 	pathKey := s.PathTransformFunc(key)
 	pathNameWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.PathName)
 	if err := os.MkdirAll(pathNameWithRoot, os.ModePerm); err != nil {
 		return nil, err
 	}
 
-	fullPathWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FullPath())
+	fullPathWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FullPath()) + ext
 
-	return os.Create(fullPathWithRoot)
+	f, err := os.Create(fullPathWithRoot)
+	if os.IsNotExist(err) {
+		// Prune removed the directories in between, as they were empty.
+		if err := os.MkdirAll(pathNameWithRoot, os.ModePerm); err != nil {
+			return nil, err
+		}
+		f, err = os.Create(fullPathWithRoot)
+	}
+	return f, err
 }
 
 func (s *Store) writeStream(id string, key string, r io.Reader) (int64, error) {
@@ -158,3 +272,267 @@ func (s *Store) readStream(id string, key string) (int64, io.ReadCloser, error)
 
 	return fi.Size(), file, nil
 }
+
+// Stat returns the entry of the object of the namespace id stored under
+// key, and its metadata, without reading the object. It fails with an
+// error satisfying os.IsNotExist when there is no such object; objects
+// stored before metadata was recorded have none.
+func (s *Store) Stat(id string, key string) (StoreEntry, ObjectMeta, error) {
+	pathKey := s.PathTransformFunc(key)
+	info, err := os.Stat(filepath.Join(s.Root, id, pathKey.FullPath()))
+	if err != nil {
+		return StoreEntry{}, ObjectMeta{}, err
+	}
+	entry := StoreEntry{Key: key, Path: pathKey.FullPath(), Size: info.Size()}
+
+	meta, err := s.ReadMeta(id, key)
+	if err != nil && !os.IsNotExist(err) {
+		return entry, ObjectMeta{}, err
+	}
+	if meta.Cold != nil {
+		entry.Size = meta.Cold.Size
+	}
+	return entry, meta, nil
+}
+
+// StoreEntry is an object returned by Iterate.
+type StoreEntry struct {
+	// Key is the key the object is stored under. It is empty for objects
+	// stored before keys were recorded in their metadata.
+	Key string `json:"key"`
+	// Path locates the object within its namespace.
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+// errPageFull stops the walk of Iterate once a page is complete.
+var errPageFull = errors.New("page full")
+
+// Iterate returns up to limit objects of the namespace id whose key starts
+// with prefix, along with the cursor to pass to get the next page. Pages
+// follow the order of the objects' paths, so cursors stay valid while
+// objects are added and removed, and only one page of keys is ever held in
+// memory. An empty cursor starts at the beginning; an empty returned
+// cursor means the walk is complete. Objects without a recorded key only
+// match an empty prefix.
+func (s *Store) Iterate(id, prefix, cursor string, limit int) ([]StoreEntry, string, error) {
+	if limit <= 0 {
+		return nil, "", fmt.Errorf("invalid iteration limit: %d", limit)
+	}
+
+	it := storeIterator{root: filepath.Join(s.Root, id), prefix: prefix, limit: limit}
+	var after []string
+	if cursor != "" {
+		after = strings.Split(cursor, "/")
+	}
+
+	err := it.walk("", after)
+	switch {
+	case errors.Is(err, errPageFull):
+		return it.entries, it.entries[len(it.entries)-1].Path, nil
+	case errors.Is(err, os.ErrNotExist):
+		// The namespace has no objects yet.
+		return nil, "", nil
+	case err != nil:
+		return nil, "", err
+	}
+	return it.entries, "", nil
+}
+
+type storeIterator struct {
+	root    string
+	prefix  string
+	limit   int
+	entries []StoreEntry
+}
+
+// walk visits the directory rel in order, skipping everything up to and
+// including the path made of the after components.
+func (it *storeIterator) walk(rel string, after []string) error {
+	dirEntries, err := os.ReadDir(filepath.Join(it.root, rel))
+	if err != nil {
+		if rel != "" && errors.Is(err, os.ErrNotExist) {
+			// Removed while we were walking, same as an empty directory.
+			return nil
+		}
+		return err
+	}
+
+	for _, e := range dirEntries {
+		name := e.Name()
+		var rest []string
+		if len(after) > 0 {
+			if name < after[0] {
+				continue
+			}
+			if name == after[0] {
+				if !e.IsDir() {
+					continue
+				}
+				rest = after[1:]
+			}
+		}
+
+		path := name
+		if rel != "" {
+			path = rel + "/" + name
+		}
+		if e.IsDir() {
+			if err := it.walk(path, rest); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if ext := filepath.Ext(name); ext == metaExt || ext == rotateTempExt || ext == migrateTempExt || ext == receiveTempExt || ext == fetchTempExt {
+			continue
+		}
+		entry, err := it.entry(path, e)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				// Deleted while we were walking.
+				continue
+			}
+			return err
+		}
+		if !strings.HasPrefix(entry.Key, it.prefix) {
+			continue
+		}
+
+		it.entries = append(it.entries, entry)
+		if len(it.entries) == it.limit {
+			return errPageFull
+		}
+	}
+	return nil
+}
+
+func (it *storeIterator) entry(path string, e os.DirEntry) (StoreEntry, error) {
+	entry := StoreEntry{Path: path}
+	info, err := e.Info()
+	if err != nil {
+		return entry, err
+	}
+	entry.Size = info.Size()
+
+	b, err := os.ReadFile(filepath.Join(it.root, path+metaExt))
+	if err == nil {
+		var meta ObjectMeta
+		if json.Unmarshal(b, &meta) == nil {
+			entry.Key = meta.Key
+			if meta.Cold != nil {
+				entry.Size = meta.Cold.Size
+			}
+		}
+	}
+	return entry, nil
+}
+
+// errRangeOutOfBounds is returned for a range starting past the end of an
+// object.
+var errRangeOutOfBounds = errors.New("range out of bounds")
+
+// ReadRange returns length bytes of the object stored under key in
+// namespace id starting at offset, and the size of the whole object. A
+// negative length reads to the end of the object, as does one past it.
+func (s *Store) ReadRange(id string, key string, offset, length int64) (int64, io.ReadCloser, error) {
+	size, file, err := s.readStream(id, key)
+	if err != nil {
+		return 0, nil, err
+	}
+	if offset < 0 || offset > size {
+		file.Close()
+		return size, nil, errRangeOutOfBounds
+	}
+	if length < 0 || offset+length > size {
+		length = size - offset
+	}
+
+	return size, &rangeReader{
+		Reader: io.NewSectionReader(file.(*os.File), offset, length),
+		file:   file.(*os.File),
+	}, nil
+}
+
+// rangeReader reads a range of a file and closes the file.
+type rangeReader struct {
+	io.Reader
+	file *os.File
+}
+
+func (r *rangeReader) Close() error {
+	return r.file.Close()
+}
+
+// fetchTempExt is the extension of the ciphertext of an object being
+// fetched from a peer. It is kept when the transfer is cut off, for the
+// next fetch of the object to resume from.
+const fetchTempExt = ".fetching"
+
+// Staged returns the ciphertext received so far by the fetch of the object
+// stored under key in namespace id, to be closed by the caller, and its
+// size. It fails with an error satisfying os.IsNotExist when there is none.
+func (s *Store) Staged(id string, key string) (int64, io.ReadCloser, error) {
+	pathKey := s.PathTransformFunc(key)
+	file, err := os.Open(fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FullPath()) + fetchTempExt)
+	if err != nil {
+		return 0, nil, err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return 0, nil, err
+	}
+	return fi.Size(), file, nil
+}
+
+// WriteStaged writes what is read from r to the ciphertext staged for the
+// object stored under key in namespace id, starting at offset: whatever
+// was staged past it is dropped. What was written is kept when r fails.
+func (s *Store) WriteStaged(id string, key string, offset int64, r io.Reader) (int64, error) {
+	pathKey := s.PathTransformFunc(key)
+	pathNameWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.PathName)
+	if err := os.MkdirAll(pathNameWithRoot, os.ModePerm); err != nil {
+		return 0, s.writeFailed(err)
+	}
+	f, err := os.OpenFile(fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FullPath())+fetchTempExt, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return 0, s.writeFailed(err)
+	}
+	defer f.Close()
+	if err := f.Truncate(offset); err != nil {
+		return 0, s.writeFailed(err)
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return 0, s.writeFailed(err)
+	}
+	n, err := io.Copy(f, r)
+	return n, s.writeFailed(err)
+}
+
+// CommitStaged decrypts the ciphertext staged for the object stored under
+// key in namespace id, sealed with one of suites, into the object, and
+// drops it.
+func (s *Store) CommitStaged(keys KeyLookup, suites suiteSet, id string, key string) (int64, error) {
+	_, r, err := s.Staged(id, key)
+	if err != nil {
+		return 0, err
+	}
+	n, err := s.WriteDecrypt(keys, suites, id, key, r)
+	r.Close()
+	if err != nil {
+		return n, err
+	}
+	return n, s.DropStaged(id, key)
+}
+
+// DropStaged removes the ciphertext staged for the object stored under key
+// in namespace id, if any.
+func (s *Store) DropStaged(id string, key string) error {
+	pathKey := s.PathTransformFunc(key)
+	err := os.Remove(fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FullPath()) + fetchTempExt)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
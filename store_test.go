@@ -4,6 +4,10 @@ import (
 	"bytes"
 	"fmt"
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"testing"
 )
 
@@ -58,6 +62,132 @@ func TestStore(t *testing.T) {
 	}
 }
 
+func TestStoreIterate(t *testing.T) {
+	s := &Store{StoreOpts{Root: t.TempDir(), PathTransformFunc: CASPathTransformFunc}}
+	id := generateID()
+
+	want := map[string]bool{}
+	for i := 0; i < 25; i++ {
+		key := fmt.Sprintf("logs/%02d", i)
+		if i%5 == 0 {
+			key = fmt.Sprintf("images/%02d", i)
+		}
+		if _, err := s.Write(id, key, bytes.NewReader([]byte(key))); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.WriteMeta(id, key, ObjectMeta{}); err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(key, "logs/") {
+			want[key] = true
+		}
+	}
+
+	// Walk the logs a page at a time, deleting one object that was already
+	// listed and one that was not along the way.
+	got := map[string]bool{}
+	var paths []string
+	pages := 0
+	for cursor := ""; ; pages++ {
+		entries, next, err := s.Iterate(id, "logs/", cursor, 6)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) > 6 {
+			t.Fatalf("page of %d entries exceeds the limit", len(entries))
+		}
+		for _, e := range entries {
+			if got[e.Key] {
+				t.Errorf("%s listed twice", e.Key)
+			}
+			got[e.Key] = true
+			paths = append(paths, e.Path)
+			if e.Size != int64(len(e.Key)) {
+				t.Errorf("%s: size %d", e.Key, e.Size)
+			}
+		}
+		if pages == 1 {
+			s.Delete(id, entries[0].Key)
+			for key := range want {
+				if !got[key] {
+					s.Delete(id, key)
+					delete(want, key)
+					break
+				}
+			}
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+
+	if len(got) != len(want) {
+		t.Errorf("listed %d keys, want %d", len(got), len(want))
+	}
+	for key := range want {
+		if !got[key] {
+			t.Errorf("%s not listed", key)
+		}
+	}
+	if !sort.StringsAreSorted(paths) {
+		t.Error("entries are not in path order")
+	}
+
+	// A directory removed between listing its parent and reading it is
+	// skipped rather than ending the walk.
+	it := storeIterator{root: filepath.Join(s.Root, id), limit: 100}
+	if err := it.walk("gone", nil); err != nil {
+		t.Errorf("walking a removed directory: %v", err)
+	}
+	if err := it.walk("", nil); err != nil || len(it.entries) != len(want)+4 {
+		t.Errorf("walk after a removed directory: %d entries, %v", len(it.entries), err)
+	}
+
+	if entries, next, err := s.Iterate("missing", "", "", 10); err != nil || len(entries) != 0 || next != "" {
+		t.Errorf("iterating a missing namespace: %v %v %q", entries, err, next)
+	}
+	if _, _, err := s.Iterate(id, "", "", 0); err == nil {
+		t.Error("expected an error for a zero limit")
+	}
+}
+
+func TestStoreDeleteKeepsNeighbours(t *testing.T) {
+	s := NewStore(StoreOpts{
+		Root: t.TempDir(),
+		PathTransformFunc: func(key string) PathKey {
+			return PathKey{PathName: "shared/dir", Filename: key}
+		},
+	})
+	id := generateID()
+
+	for _, key := range []string{"a", "b"} {
+		if _, err := s.writeStream(id, key, bytes.NewReader([]byte(key))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.WriteMeta(id, "a", ObjectMeta{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Delete(id, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if s.Has(id, "a") || !s.Has(id, "b") {
+		t.Errorf("expected only a to be deleted")
+	}
+	if _, err := s.ReadMeta(id, "a"); err == nil {
+		t.Errorf("expected the metadata of a to be deleted")
+	}
+
+	if err := s.Delete(id, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := os.ReadDir(filepath.Join(s.Root, id)); len(entries) != 0 {
+		t.Errorf("expected empty directories to be removed, have %v", entries)
+	}
+}
+
 func newStore() *Store {
 	opts := StoreOpts{
 		PathTransformFunc: CASPathTransformFunc,
@@ -0,0 +1,88 @@
+package tier
+
+import (
+	"context"
+	"io"
+	"strings"
+
+	"github.com/anthdm/foreverstore/client"
+	"github.com/anthdm/foreverstore/errors"
+)
+
+// Cluster is a Backend keeping objects in another cluster, through its
+// HTTP API, under keys made of Prefix and their name. Operations are
+// bounded by the timeouts of the client.
+type Cluster struct {
+	API    client.API
+	Prefix string
+}
+
+// NewCluster returns a Cluster backend storing objects through api under
+// keys starting with prefix, typically a bucket such as "cold/".
+func NewCluster(api client.API, prefix string) *Cluster {
+	return &Cluster{API: api, Prefix: prefix}
+}
+
+func (c *Cluster) key(name string) (string, error) {
+	if err := checkName(name); err != nil {
+		return "", err
+	}
+	return c.Prefix + name, nil
+}
+
+// Put stores the object in one request: the cluster replaces an object
+// only once its new content is complete.
+func (c *Cluster) Put(name string, r io.Reader) error {
+	key, err := c.key(name)
+	if err != nil {
+		return err
+	}
+	if err := c.API.Store(context.Background(), key, r); err != nil {
+		return errors.Wrap(err, errors.StorageError, "failed to store tier object")
+	}
+	return nil
+}
+
+func (c *Cluster) Get(name string) (io.ReadCloser, error) {
+	key, err := c.key(name)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := c.API.Get(context.Background(), key)
+	if errors.IsType(err, errors.FileNotFoundError) {
+		return nil, errors.NewFileNotFoundError(name)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, errors.StorageError, "failed to open tier object")
+	}
+	return rc, nil
+}
+
+func (c *Cluster) Delete(name string) error {
+	key, err := c.key(name)
+	if err != nil {
+		return err
+	}
+	err = c.API.Delete(context.Background(), key)
+	if err != nil && !errors.IsType(err, errors.FileNotFoundError) {
+		return errors.Wrap(err, errors.StorageError, "failed to delete tier object")
+	}
+	return nil
+}
+
+func (c *Cluster) List(prefix string) ([]string, error) {
+	var names []string
+	for cursor := ""; ; {
+		objects, next, err := c.API.List(context.Background(), c.Prefix+prefix, cursor, 0)
+		if err != nil {
+			return nil, errors.Wrap(err, errors.StorageError, "failed to list tier objects")
+		}
+		for _, object := range objects {
+			names = append(names, strings.TrimPrefix(object.Key, c.Prefix))
+		}
+		if next == "" {
+			return names, nil
+		}
+		cursor = next
+	}
+}
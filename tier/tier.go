@@ -0,0 +1,133 @@
+// Package tier implements the storage a node keeps objects in outside of
+// the cluster: the cold tier it offloads rarely used objects to, and the
+// mirror it copies every change to. For the cold tier, the node keeps a
+// metadata stub of every offloaded object and brings it back to local disk
+// the next time it is read.
+package tier
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/anthdm/foreverstore/errors"
+)
+
+// Backend is a store outside of the cluster. Names are chosen by the node
+// and never contain a path separator.
+type Backend interface {
+	// Put stores the content of r under name, replacing any previous
+	// content.
+	Put(name string, r io.Reader) error
+	// Get opens the content stored under name. It returns a
+	// FileNotFoundError when there is none.
+	Get(name string) (io.ReadCloser, error)
+	// Delete removes the content stored under name. Deleting a missing
+	// name is not an error.
+	Delete(name string) error
+	// List returns the names starting with prefix, in no particular
+	// order.
+	List(prefix string) ([]string, error)
+}
+
+// Dir is a Backend keeping objects as files in a directory, typically a
+// mount of slower or remote storage.
+type Dir struct {
+	Root string
+}
+
+// NewDir returns a Dir backend storing objects under root, creating it if
+// needed.
+func NewDir(root string) (*Dir, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, errors.Wrap(err, errors.ConfigError, "failed to create tier directory")
+	}
+	return &Dir{Root: root}, nil
+}
+
+// checkName rejects the names that are not a single path element.
+func checkName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return errors.NewInvalidInputError("invalid tier object name: " + name)
+	}
+	return nil
+}
+
+func (d *Dir) path(name string) (string, error) {
+	if err := checkName(name); err != nil {
+		return "", err
+	}
+	return filepath.Join(d.Root, name), nil
+}
+
+// Put writes to a temporary file renamed into place once complete, so a
+// failed Put never leaves a truncated object behind.
+func (d *Dir) Put(name string, r io.Reader) error {
+	path, err := d.path(name)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(d.Root, "."+name+".*")
+	if err != nil {
+		return errors.Wrap(err, errors.StorageError, "failed to create tier object")
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return errors.Wrap(err, errors.StorageError, "failed to write tier object")
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return errors.Wrap(err, errors.StorageError, "failed to write tier object")
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		os.Remove(f.Name())
+		return errors.Wrap(err, errors.StorageError, "failed to store tier object")
+	}
+	return nil
+}
+
+func (d *Dir) Get(name string) (io.ReadCloser, error) {
+	path, err := d.path(name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, errors.NewFileNotFoundError(name)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, errors.StorageError, "failed to open tier object")
+	}
+	return f, nil
+}
+
+func (d *Dir) List(prefix string) ([]string, error) {
+	entries, err := os.ReadDir(d.Root)
+	if err != nil {
+		return nil, errors.Wrap(err, errors.StorageError, "failed to list tier objects")
+	}
+	var names []string
+	for _, entry := range entries {
+		name := entry.Name()
+		// Files starting with a dot are Puts under way.
+		if entry.IsDir() || strings.HasPrefix(name, ".") || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func (d *Dir) Delete(name string) error {
+	path, err := d.path(name)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, errors.StorageError, "failed to delete tier object")
+	}
+	return nil
+}
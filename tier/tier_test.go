@@ -0,0 +1,85 @@
+package tier
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/anthdm/foreverstore/errors"
+	"github.com/anthdm/foreverstore/fstest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDirPutGetDelete(t *testing.T) {
+	d, err := NewDir(t.TempDir())
+	assert.Nil(t, err)
+
+	assert.Nil(t, d.Put("object", bytes.NewReader([]byte("cold data"))))
+	assert.Nil(t, d.Put("object", bytes.NewReader([]byte("replaced"))))
+	assert.Nil(t, d.Put("other", bytes.NewReader([]byte("other"))))
+	names, err := d.List("obj")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"object"}, names)
+	assert.Nil(t, d.Delete("other"))
+
+	rc, err := d.Get("object")
+	assert.Nil(t, err)
+	b, err := io.ReadAll(rc)
+	rc.Close()
+	assert.Nil(t, err)
+	assert.Equal(t, "replaced", string(b))
+
+	assert.Nil(t, d.Delete("object"))
+	assert.Nil(t, d.Delete("object"))
+	_, err = d.Get("object")
+	assert.True(t, errors.IsType(err, errors.FileNotFoundError))
+
+	entries, err := os.ReadDir(d.Root)
+	assert.Nil(t, err)
+	assert.Empty(t, entries, "temporary files left behind")
+}
+
+func TestDirRejectsPaths(t *testing.T) {
+	d, err := NewDir(t.TempDir())
+	assert.Nil(t, err)
+
+	for _, name := range []string{"", "..", "a/b", `a\b`} {
+		assert.NotNil(t, d.Put(name, bytes.NewReader(nil)), name)
+	}
+}
+
+func TestClusterPutGetDelete(t *testing.T) {
+	store := fstest.NewStore()
+	c := NewCluster(store, "cold/")
+
+	assert.Nil(t, c.Put("object", bytes.NewReader([]byte("cold data"))))
+	assert.Nil(t, c.Put("object", bytes.NewReader([]byte("replaced"))))
+	assert.Nil(t, store.Put(context.Background(), "other/object", []byte("not in the tier")))
+	objects, _, err := store.List(context.Background(), "cold/", "", 0)
+	assert.Nil(t, err)
+	assert.Len(t, objects, 1)
+	assert.Equal(t, "cold/object", objects[0].Key)
+	names, err := c.List("")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"object"}, names)
+
+	rc, err := c.Get("object")
+	assert.Nil(t, err)
+	b, err := io.ReadAll(rc)
+	rc.Close()
+	assert.Nil(t, err)
+	assert.Equal(t, "replaced", string(b))
+
+	assert.Nil(t, c.Delete("object"))
+	assert.Nil(t, c.Delete("object"))
+	_, err = c.Get("object")
+	assert.True(t, errors.IsType(err, errors.FileNotFoundError))
+
+	assert.NotNil(t, c.Put("a/b", bytes.NewReader(nil)))
+	store.Fail(errors.NewConnectionError("cluster down"))
+	assert.NotNil(t, c.Put("object", bytes.NewReader(nil)))
+	_, err = c.Get("object")
+	assert.False(t, errors.IsType(err, errors.FileNotFoundError))
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/anthdm/foreverstore/errors"
+)
+
+// ColdCopy records that an object was offloaded to the cold tier. Its local
+// file is then an empty stub, and the object is read back from the tier,
+// encrypted like a replica, the next time it is read.
+type ColdCopy struct {
+	// Name is the object's name in the cold tier.
+	Name string `json:"name"`
+	// Size is the size of the object's plaintext.
+	Size        int64     `json:"size"`
+	OffloadedAt time.Time `json:"offloaded_at"`
+	// Cipher is the cipher suite the cold copy is sealed with.
+	Cipher string `json:"cipher,omitempty"`
+}
+
+// TierStatus counts the moves between the local disk and the cold tier.
+type TierStatus struct {
+	Enabled    bool `json:"enabled"`
+	Offloaded  int  `json:"offloaded"`
+	Rehydrated int  `json:"rehydrated"`
+	// RehydrateTime is the total time reads spent waiting for objects to
+	// come back from the cold tier, and LastRehydrate the time the latest
+	// one took.
+	RehydrateTime time.Duration `json:"rehydrate_time_ns"`
+	LastRehydrate time.Duration `json:"last_rehydrate_ns"`
+}
+
+// accessResolution bounds how often reading an object records the access,
+// so that reads do not each rewrite the object's metadata.
+const accessResolution = time.Hour
+
+type tierStats struct {
+	mu     sync.Mutex
+	status TierStatus
+}
+
+// TierStatus returns the cold tier counters of the node.
+func (s *FileServer) TierStatus() TierStatus {
+	s.tierStats.mu.Lock()
+	defer s.tierStats.mu.Unlock()
+
+	status := s.tierStats.status
+	status.Enabled = s.ColdTier != nil
+	return status
+}
+
+// coldName is the name of an object of this node in the cold tier. Objects
+// of several nodes can share a tier.
+func (s *FileServer) coldName(key string) string {
+	return s.ID + "-" + hashKey(key)
+}
+
+// lastAccess returns when an object was last stored or read.
+func lastAccess(meta ObjectMeta) time.Time {
+	if meta.AccessedAt.After(meta.StoredAt) {
+		return meta.AccessedAt
+	}
+	return meta.StoredAt
+}
+
+// touch records a read of a local object, at most once per
+// accessResolution. Access times only matter to the cold tier.
+func (s *FileServer) touch(key string) {
+	if s.ColdTier == nil || s.ColdAfter == 0 {
+		return
+	}
+	now := s.Clock.Now()
+	meta, err := s.store.ReadMeta(s.ID, key)
+	if err != nil || now.Sub(lastAccess(meta)) < accessResolution {
+		return
+	}
+
+	unlock := s.keyLocks.lock(key)
+	defer unlock()
+	err = updateMetaFile(s.store.metaPath(s.ID, key), func(meta *ObjectMeta) {
+		meta.AccessedAt = now
+	})
+	if err != nil {
+		s.logger.Warn("Failed to record access to %s: %v", key, err)
+	}
+}
+
+// offloadObject moves an object stored by this node to the cold tier,
+// leaving a stub on the local disk. It reports whether the object moved;
+// objects already in the cold tier are left alone.
+func (s *FileServer) offloadObject(key string) (bool, error) {
+	if s.ColdTier == nil {
+		return false, errors.NewConfigError("no cold tier configured")
+	}
+
+	unlock := s.keyLocks.lock(key)
+	defer unlock()
+
+	meta, err := s.store.ReadMeta(s.ID, key)
+	if err != nil && !os.IsNotExist(err) {
+		return false, errors.Wrap(err, errors.StorageError, "failed to read object metadata")
+	}
+	if meta.Cold != nil {
+		return false, nil
+	}
+
+	size, r, err := s.store.Read(s.ID, key)
+	if err != nil {
+		return false, errors.Wrap(err, errors.StorageError, "failed to read object")
+	}
+	defer r.(io.Closer).Close()
+
+	name := s.coldName(key)
+	enc := s.replicaEncryption(bucketOf(key))
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := enc.copy(r, pw)
+		pw.CloseWithError(err)
+	}()
+	err = s.ColdTier.Put(name, pr)
+	pr.CloseWithError(err)
+	if err != nil {
+		return false, errors.Wrap(err, errors.StorageError, "failed to offload object")
+	}
+
+	// The metadata is switched to the cold copy before the local data goes,
+	// so a failure in between leaves an object that is still readable.
+	meta.Cold = &ColdCopy{Name: name, Size: size, OffloadedAt: s.Clock.Now(), Cipher: enc.cipher()}
+	if err := s.store.WriteMeta(s.ID, key, meta); err != nil {
+		s.ColdTier.Delete(name)
+		return false, errors.Wrap(err, errors.StorageError, "failed to write object metadata")
+	}
+	if _, err := s.store.Write(s.ID, key, bytes.NewReader(nil)); err != nil {
+		return false, errors.Wrap(err, errors.StorageError, "failed to release local copy")
+	}
+
+	s.tierStats.mu.Lock()
+	s.tierStats.status.Offloaded++
+	s.tierStats.mu.Unlock()
+	s.logger.Info("Offloaded %s to the cold tier (%d bytes)", key, size)
+	return true, nil
+}
+
+// rehydrate brings an object stored by this node back from the cold tier
+// to the local disk. It does nothing for objects on the local disk.
+func (s *FileServer) rehydrate(key string) error {
+	meta, err := s.store.ReadMeta(s.ID, key)
+	if err != nil || meta.Cold == nil {
+		return nil
+	}
+
+	unlock := s.keyLocks.lock(key)
+	defer unlock()
+	return s.rehydrateLocked(key)
+}
+
+// rehydrateLocked is rehydrate for callers holding the key's lock.
+func (s *FileServer) rehydrateLocked(key string) error {
+	// Another read may have brought it back while this one waited.
+	meta, err := s.store.ReadMeta(s.ID, key)
+	if err != nil || meta.Cold == nil {
+		return nil
+	}
+	if s.ColdTier == nil {
+		return errors.NewConfigError("object is in the cold tier but no cold tier is configured").
+			WithContext("key", key)
+	}
+
+	start := s.Clock.Now()
+	rc, err := s.ColdTier.Get(meta.Cold.Name)
+	if err != nil {
+		return errors.Wrap(err, errors.StorageError, "failed to read object from the cold tier")
+	}
+	defer rc.Close()
+	suites := s.decryptSuites(bucketOf(key), meta.Cold.Cipher)
+	if _, err := s.store.WriteDecrypt(s.keyRing.Lookup, suites, s.ID, key, rc); err != nil {
+		return errors.Wrap(err, errors.StorageError, "failed to restore object from the cold tier")
+	}
+
+	name := meta.Cold.Name
+	meta.Cold = nil
+	meta.AccessedAt = s.Clock.Now()
+	if err := s.store.WriteMeta(s.ID, key, meta); err != nil {
+		return errors.Wrap(err, errors.StorageError, "failed to write object metadata")
+	}
+	if err := s.ColdTier.Delete(name); err != nil {
+		s.logger.Warn("Failed to delete cold copy of %s: %v", key, err)
+	}
+
+	elapsed := s.Clock.Since(start)
+	s.tierStats.mu.Lock()
+	s.tierStats.status.Rehydrated++
+	s.tierStats.status.RehydrateTime += elapsed
+	s.tierStats.status.LastRehydrate = elapsed
+	s.tierStats.mu.Unlock()
+	s.logger.Info("Rehydrated %s from the cold tier in %v", key, elapsed)
+	return nil
+}
+
+// dropColdCopy deletes the cold copy an object had before it was
+// overwritten or deleted.
+func (s *FileServer) dropColdCopy(key string, cold *ColdCopy) {
+	if cold == nil || s.ColdTier == nil {
+		return
+	}
+	if err := s.ColdTier.Delete(cold.Name); err != nil {
+		s.logger.Warn("Failed to delete cold copy of %s: %v", key, err)
+	}
+}
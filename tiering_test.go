@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/anthdm/foreverstore/config"
+	"github.com/anthdm/foreverstore/tier"
+	"github.com/stretchr/testify/assert"
+)
+
+// withColdTier gives node 0 a cold tier in dir, and the lifecycle rules.
+// Both are only evaluated when a test runs them.
+func withColdTier(t *testing.T, dir string, coldAfter time.Duration, rules ...config.LifecycleRule) func(int, *FileServerOpts) {
+	backend, err := tier.NewDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return func(node int, opts *FileServerOpts) {
+		if node == 0 {
+			withLifecycle(rules...)(node, opts)
+			opts.ColdTier = backend
+			opts.ColdAfter = coldAfter
+		}
+	}
+}
+
+func coldFiles(t *testing.T, dir string) []os.DirEntry {
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	return entries
+}
+
+func TestColdTierOffloadsAndRehydrates(t *testing.T) {
+	dir := t.TempDir()
+	c := newTestClusterWith(t, 1, withColdTier(t, dir, 24*time.Hour))
+	s := c.nodes[0]
+
+	data := bytes.Repeat([]byte("rarely read "), 1000)
+	c.store(0, "archive", data)
+	c.clock.Advance(25 * time.Hour)
+	assert.Equal(t, 1, c.runLifecycle(0).Offloaded)
+
+	// Only a stub is left on the local disk, listed with the real size.
+	size, _, err := s.store.Read(s.ID, "archive")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), size)
+	entries, _, err := s.List("", "", 10)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(data)), entries[0].Size)
+
+	files := coldFiles(t, dir)
+	assert.Len(t, files, 1)
+	cold, err := os.ReadFile(dir + "/" + files[0].Name())
+	assert.Nil(t, err)
+	assert.False(t, bytes.Contains(cold, []byte("rarely read")), "cold copy is not encrypted")
+
+	c.clock.Advance(time.Hour)
+	assert.Equal(t, data, c.get(0, "archive"))
+	status := s.TierStatus()
+	assert.Equal(t, 1, status.Offloaded)
+	assert.Equal(t, 1, status.Rehydrated)
+	assert.Empty(t, coldFiles(t, dir))
+
+	meta, err := s.Meta("archive")
+	assert.Nil(t, err)
+	assert.Nil(t, meta.Cold)
+}
+
+func TestRecentlyReadObjectsStayHot(t *testing.T) {
+	c := newTestClusterWith(t, 1, withColdTier(t, t.TempDir(), 24*time.Hour))
+
+	c.store(0, "read", []byte("read every day"))
+	c.store(0, "idle", []byte("never read"))
+	c.clock.Advance(20 * time.Hour)
+	c.get(0, "read")
+	c.clock.Advance(5 * time.Hour)
+
+	assert.Equal(t, 1, c.runLifecycle(0).Offloaded)
+	meta, _ := c.nodes[0].Meta("read")
+	assert.Nil(t, meta.Cold)
+	meta, _ = c.nodes[0].Meta("idle")
+	assert.NotNil(t, meta.Cold)
+}
+
+func TestLifecycleTransitionsToColdTier(t *testing.T) {
+	dir := t.TempDir()
+	rule := config.LifecycleRule{Bucket: "logs", TransitionAfterDays: 2, ExpireAfterDays: 5}
+	c := newTestClusterWith(t, 1, withColdTier(t, dir, 0, rule))
+
+	c.store(0, "logs/app", []byte("application log"))
+	c.store(0, "docs/readme", []byte("kept hot"))
+	c.store(0, "logs/rewritten", []byte("first version"))
+	c.clock.Advance(3 * 24 * time.Hour)
+	assert.Equal(t, 2, c.runLifecycle(0).Offloaded)
+	assert.Len(t, coldFiles(t, dir), 2)
+
+	// Overwriting an offloaded object drops its cold copy.
+	c.store(0, "logs/rewritten", []byte("second version"))
+	assert.Len(t, coldFiles(t, dir), 1)
+	assert.Equal(t, []byte("second version"), c.get(0, "logs/rewritten"))
+
+	// So does expiring it, while the rewritten object ages into the cold
+	// tier in turn.
+	c.clock.Advance(3 * 24 * time.Hour)
+	status := c.runLifecycle(0)
+	assert.Equal(t, 1, status.Expired)
+	assert.Equal(t, 1, status.Offloaded)
+	assert.Len(t, coldFiles(t, dir), 1)
+	assert.Equal(t, []byte("second version"), c.get(0, "logs/rewritten"))
+	assert.Equal(t, []byte("kept hot"), c.get(0, "docs/readme"))
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/anthdm/foreverstore/p2p"
+)
+
+// A tombstone records an object this node deleted. A peer disconnected at
+// the time misses the delete and keeps its replica, which a Get finding no
+// local copy would fetch back: tombstoned keys are reported missing
+// instead, and the delete is sent again to every peer that connects while
+// the tombstone is kept. Tombstones are kept in a file of the storage root
+// so that they survive restarts.
+
+// tombstoneFileName is the file of the storage root the tombstones are
+// kept in.
+const tombstoneFileName = ".tombstones"
+
+// tombstoneRetention is how long a tombstone is kept. A peer away for
+// longer may still hold the replica of an object deleted meanwhile.
+const tombstoneRetention = 7 * 24 * time.Hour
+
+type tombstones struct {
+	mu     sync.Mutex
+	loaded bool
+	// deleted holds the time each key was deleted at.
+	deleted map[string]time.Time
+}
+
+// tombstonePath is the path of the file the tombstones are kept in.
+func (s *FileServer) tombstonePath() string {
+	return filepath.Join(s.store.Root, tombstoneFileName)
+}
+
+// loadTombstones reads the tombstones from their file on first use. The
+// caller holds the lock of the tombstones.
+func (s *FileServer) loadTombstones() {
+	t := &s.tombstones
+	if t.loaded {
+		return
+	}
+	t.loaded = true
+	t.deleted = make(map[string]time.Time)
+
+	b, err := os.ReadFile(s.tombstonePath())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			s.logger.Warn("Failed to read the tombstones: %v", err)
+		}
+		return
+	}
+	if err := json.Unmarshal(b, &t.deleted); err != nil {
+		s.logger.Warn("Failed to decode the tombstones: %v", err)
+		t.deleted = make(map[string]time.Time)
+	}
+}
+
+// bury records the delete of the object under key.
+func (s *FileServer) bury(key string) {
+	t := &s.tombstones
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s.loadTombstones()
+
+	now := s.Clock.Now()
+	for k, at := range t.deleted {
+		if now.Sub(at) > tombstoneRetention {
+			delete(t.deleted, k)
+		}
+	}
+	t.deleted[key] = now
+	s.saveTombstones()
+}
+
+// unbury drops the tombstone of key, once an object is stored under it
+// again.
+func (s *FileServer) unbury(key string) {
+	t := &s.tombstones
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s.loadTombstones()
+
+	if _, ok := t.deleted[key]; !ok {
+		return
+	}
+	delete(t.deleted, key)
+	s.saveTombstones()
+}
+
+// buried reports whether the object under key was deleted.
+func (s *FileServer) buried(key string) bool {
+	t := &s.tombstones
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s.loadTombstones()
+
+	at, ok := t.deleted[key]
+	return ok && s.Clock.Now().Sub(at) <= tombstoneRetention
+}
+
+// buriedKeys returns the keys of the tombstones kept.
+func (s *FileServer) buriedKeys() []string {
+	t := &s.tombstones
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s.loadTombstones()
+
+	now := s.Clock.Now()
+	keys := make([]string, 0, len(t.deleted))
+	for key, at := range t.deleted {
+		if now.Sub(at) <= tombstoneRetention {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// saveTombstones rewrites the file of the tombstones. The caller holds the
+// lock of the tombstones. A tombstone that fails to be saved is still kept
+// until the node restarts.
+func (s *FileServer) saveTombstones() {
+	b, err := json.Marshal(s.tombstones.deleted)
+	if err == nil {
+		path := s.tombstonePath()
+		if err = os.WriteFile(path+".tmp", b, 0644); err == nil {
+			err = os.Rename(path+".tmp", path)
+		}
+	}
+	if err != nil {
+		s.logger.Warn("Failed to save the tombstones: %v", err)
+	}
+}
+
+// resendDeletes sends the peer at addr the deletes of the objects
+// tombstoned, for it to drop the replicas it kept while it missed them.
+func (s *FileServer) resendDeletes(addr string, p p2p.Peer) {
+	keys := s.buriedKeys()
+	for _, key := range keys {
+		msg := Message{Payload: MessageDeleteFile{ID: s.ID, Key: hashKey(key)}}
+		if err := s.sendMessage(p, &msg); err != nil {
+			s.logger.Warn("Failed to resend deletes to peer %s: %v", addr, err)
+			return
+		}
+	}
+	if len(keys) > 0 {
+		s.logger.Debug("Resent %d deletes to peer %s", len(keys), addr)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/anthdm/foreverstore/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeletedObjectsStayDeleted(t *testing.T) {
+	c := newTestCluster(t, 3)
+	s := c.nodes[0]
+	c.store(0, "gone", []byte("deleted while node 2 was cut off"))
+	c.assertConverged(0, "gone")
+
+	// Node 2 misses the delete for longer than it is resent for.
+	c.partition([]int{0, 1}, []int{2})
+	assert.Nil(t, c.run("delete", func() error { return s.Delete("gone") }))
+	c.eventually("the delete to be given up on", func() bool { return s.ControlStats().Failed == 1 })
+	c.heal()
+	assert.True(t, c.holds(2, 0, "gone"))
+
+	// Its stale replica is not fetched back.
+	err := c.run("get", func() error {
+		_, err := s.Get("gone")
+		return err
+	})
+	assert.True(t, errors.IsType(err, errors.FileNotFoundError), "got %v", err)
+	assert.False(t, c.holds(0, 0, "gone"))
+
+	// It drops the replica once it reconnects.
+	assert.Nil(t, s.RemovePeer("node-2"))
+	assert.Nil(t, c.run("reconnect", func() error { return s.AddPeer("node-2") }))
+	c.eventually("node 2 to delete its replica", func() bool { return !c.holds(2, 0, "gone") })
+
+	// Storing the key again lifts the tombstone, which survives restarts
+	// until then.
+	assert.True(t, NewFileServer(s.FileServerOpts).buried("gone"))
+	c.store(0, "gone", []byte("back"))
+	assert.False(t, s.buried("gone"))
+	assert.False(t, NewFileServer(s.FileServerOpts).buried("gone"))
+	assert.Equal(t, []byte("back"), c.get(0, "gone"))
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/hmac"
+	"fmt"
+	"hash"
+	"io"
+
+	"github.com/anthdm/foreverstore/errors"
+)
+
+// transferCheck verifies a replica received from a peer against the
+// MessageStoreFile announcing it, as it is written: its size must be the
+// exact size of the ciphertext announced, and its plaintext, decrypted on
+// the way, must match the integrity tag announced.
+type transferCheck struct {
+	msg MessageStoreFile
+	// pw feeds the decryption of the replica into mac, and done receives
+	// its outcome. Both are nil when the tag cannot be checked.
+	pw   *io.PipeWriter
+	mac  hash.Hash
+	done chan error
+}
+
+// newTransferCheck starts the verification of the replica announced by
+// msg. Replicas announced without an integrity tag, or with one of a key
+// this node does not have, are only checked for their size.
+func (s *FileServer) newTransferCheck(msg MessageStoreFile) *transferCheck {
+	c := &transferCheck{msg: msg}
+	if len(msg.HMAC) == 0 {
+		return c
+	}
+	mac, err := newIntegrityHash(s.keyRing.Lookup, msg.KeyVersion)
+	if err != nil {
+		s.logger.Debug("Cannot verify the integrity tag of replica %s: %v", msg.Key, err)
+		return c
+	}
+
+	suites := s.decryptSuites(msg.Bucket, msg.Cipher)
+	pr, pw := io.Pipe()
+	c.pw, c.mac, c.done = pw, mac, make(chan error, 1)
+	go func() {
+		_, err := copyDecryptAuto(s.keyRing.Lookup, suites, pr, mac)
+		// Whatever follows the end of the ciphertext is dropped.
+		pr.CloseWithError(err)
+		c.done <- err
+	}()
+	return c
+}
+
+// Write feeds b, the next bytes of the replica, to the verification. It
+// never fails: a replica that cannot be decrypted is rejected by verify.
+func (c *transferCheck) Write(b []byte) (int, error) {
+	if c.pw != nil {
+		c.pw.Write(b)
+	}
+	return len(b), nil
+}
+
+// verify checks the n bytes of the replica received. The error returned
+// is a CorruptionError when the replica does not match its announcement.
+func (c *transferCheck) verify(n int64) error {
+	err := c.finish()
+	if n != c.msg.Size {
+		return errors.NewCorruptionError(fmt.Sprintf("received %d of %d bytes announced", n, c.msg.Size))
+	}
+	switch {
+	case c.mac == nil:
+		return nil
+	case errors.IsType(err, errors.EncryptionError):
+		// Sealed with a key this node does not have: not ours to judge.
+		return nil
+	case err != nil:
+		return errors.Wrap(err, errors.CorruptionError, "replica cannot be decrypted")
+	case !hmac.Equal(c.mac.Sum(nil), c.msg.HMAC):
+		return errors.NewCorruptionError("replica does not match its integrity tag")
+	}
+	return nil
+}
+
+// finish ends the decryption of the replica and returns its outcome. It
+// must be called once the replica is received, verified or not.
+func (c *transferCheck) finish() error {
+	if c.pw == nil {
+		return nil
+	}
+	c.pw.Close()
+	c.pw = nil
+	return <-c.done
+}
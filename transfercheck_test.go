@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/anthdm/foreverstore/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplicaTransferVerified(t *testing.T) {
+	c := newTestCluster(t, 1)
+	s := c.nodes[0]
+
+	plaintext := bytes.Repeat([]byte("replica "), 64)
+	version, key := s.keyRing.Current()
+	var sealed bytes.Buffer
+	_, err := copyEncryptMode(s.EncryptionMode, s.CipherSuite, version, key, bytes.NewReader(plaintext), &sealed)
+	assert.Nil(t, err)
+	sum, err := computeIntegrity(s.keyRing.Lookup, version, bytes.NewReader(plaintext))
+	assert.Nil(t, err)
+	announce := MessageStoreFile{ID: "peer", Key: "doc", Size: int64(sealed.Len()), HMAC: sum, KeyVersion: version}
+
+	receive := func(msg MessageStoreFile, data []byte) error {
+		check := s.newTransferCheck(msg)
+		defer check.finish()
+		_, err := s.store.WriteVerified(msg.ID, msg.Key, io.TeeReader(bytes.NewReader(data), check), check.verify)
+		return err
+	}
+	held := func() []byte {
+		_, r, err := s.store.Read("peer", "doc")
+		assert.Nil(t, err)
+		b, _ := io.ReadAll(r)
+		r.(io.Closer).Close()
+		return b
+	}
+
+	assert.Nil(t, receive(announce, sealed.Bytes()))
+	assert.Equal(t, sealed.Bytes(), held())
+
+	// Replicas not matching their announcement are rejected, and the
+	// replica held is kept.
+	tampered := append([]byte(nil), sealed.Bytes()...)
+	tampered[len(tampered)-1] ^= 1
+	short := announce
+	short.Size++
+	forged := announce
+	forged.HMAC = append([]byte{sum[0] ^ 1}, sum[1:]...)
+	for name, err := range map[string]error{
+		"tampered": receive(announce, tampered),
+		"short":    receive(short, sealed.Bytes()),
+		"forged":   receive(forged, sealed.Bytes()),
+	} {
+		assert.Equal(t, errors.CorruptionError, errors.GetType(err), name)
+	}
+	assert.Equal(t, sealed.Bytes(), held())
+
+	// A tag of a key this node does not have cannot be checked.
+	unknown := announce
+	unknown.KeyVersion = 99
+	assert.Nil(t, receive(unknown, sealed.Bytes()))
+
+	ack := replicaStored(announce, 3, s.expectReplicas("doc", nil, 1).h, errors.NewCorruptionError("bad"))
+	assert.Equal(t, errors.CorruptionError, ack.ErrorType)
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Every object stream between this node and a peer is a transfer: replicas
+// sent and received, objects served to peers and fetched from them. The
+// transfers in progress, and the last ones to finish, are kept for
+// operators to see what a busy node is doing.
+
+// TransferDirection tells whether a transfer leaves or reaches the node.
+type TransferDirection string
+
+const (
+	TransferSend    TransferDirection = "send"
+	TransferReceive TransferDirection = "receive"
+)
+
+// transferHistory bounds the finished transfers kept.
+const transferHistory = 50
+
+// Transfer reports an object stream between this node and a peer.
+type Transfer struct {
+	ID uint64 `json:"id"`
+	// Key is the key of the object, or the hash of it that peers know it
+	// by, and Objects the number of objects the stream carries when it is
+	// a batch starting with that one.
+	Key       string            `json:"key"`
+	Objects   int               `json:"objects,omitempty"`
+	Direction TransferDirection `json:"direction"`
+	Peer      string            `json:"peer"`
+	// Size is the size of the stream, Bytes the part of it moved so far,
+	// and Rate the bytes moved per second since it started.
+	Size      int64     `json:"size"`
+	Bytes     int64     `json:"bytes"`
+	Rate      float64   `json:"bytes_per_second"`
+	StartedAt time.Time `json:"started_at"`
+	// FinishedAt is set once the transfer is over, and Error when it
+	// failed.
+	FinishedAt time.Time `json:"finished_at,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// Transfers lists the transfers in progress, oldest first, and the last
+// ones to finish, most recent first.
+type Transfers struct {
+	Active []Transfer `json:"active"`
+	Recent []Transfer `json:"recent"`
+}
+
+// transfer is a transfer in progress.
+type transfer struct {
+	info  Transfer
+	bytes int64
+}
+
+// add counts n more bytes moved. It does nothing on a nil transfer.
+func (t *transfer) add(n int) {
+	if t != nil {
+		atomic.AddInt64(&t.bytes, int64(n))
+	}
+}
+
+// transferTracker keeps the transfers of the node.
+type transferTracker struct {
+	mu     sync.Mutex
+	nextID uint64
+	active map[uint64]*transfer
+	// recent holds the finished transfers, oldest first.
+	recent []Transfer
+}
+
+// begin records the transfer info describes as started, giving it an ID.
+func (tr *transferTracker) begin(info Transfer) *transfer {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if tr.active == nil {
+		tr.active = make(map[uint64]*transfer)
+	}
+	tr.nextID++
+	info.ID = tr.nextID
+	t := &transfer{info: info}
+	tr.active[info.ID] = t
+	return t
+}
+
+// end records the transfer t finished at now, having failed with err if
+// not nil. It does nothing on a nil transfer.
+func (tr *transferTracker) end(t *transfer, err error, now time.Time) {
+	if t == nil {
+		return
+	}
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if _, ok := tr.active[t.info.ID]; !ok {
+		return
+	}
+	delete(tr.active, t.info.ID)
+	info := t.snapshot(now)
+	info.FinishedAt = now
+	if err != nil {
+		info.Error = err.Error()
+	}
+	tr.recent = append(tr.recent, info)
+	if n := len(tr.recent) - transferHistory; n > 0 {
+		tr.recent = append(tr.recent[:0], tr.recent[n:]...)
+	}
+}
+
+// snapshot reports the transfer t as it stands at now.
+func (t *transfer) snapshot(now time.Time) Transfer {
+	info := t.info
+	info.Bytes = atomic.LoadInt64(&t.bytes)
+	if elapsed := now.Sub(info.StartedAt).Seconds(); elapsed > 0 {
+		info.Rate = float64(info.Bytes) / elapsed
+	}
+	return info
+}
+
+// Transfers returns the transfers in progress and the last ones to finish.
+func (s *FileServer) Transfers() Transfers {
+	now := s.Clock.Now()
+	tr := &s.transfers
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	list := Transfers{
+		Active: make([]Transfer, 0, len(tr.active)),
+		Recent: make([]Transfer, 0, len(tr.recent)),
+	}
+	for _, t := range tr.active {
+		list.Active = append(list.Active, t.snapshot(now))
+	}
+	sort.Slice(list.Active, func(i, j int) bool { return list.Active[i].ID < list.Active[j].ID })
+	for i := len(tr.recent) - 1; i >= 0; i-- {
+		list.Recent = append(list.Recent, tr.recent[i])
+	}
+	return list
+}
+
+// sending records a transfer of size bytes of the object stored under
+// key to the peer at addr, starting now.
+func (s *FileServer) sending(key, addr string, size int64) *transfer {
+	return s.transfers.begin(Transfer{Key: key, Direction: TransferSend, Peer: addr, Size: size, StartedAt: s.Clock.Now()})
+}
+
+// receiving records a transfer of size bytes of the object stored under
+// key from the peer at addr, starting now.
+func (s *FileServer) receiving(key, addr string, size int64) *transfer {
+	return s.transfers.begin(Transfer{Key: key, Direction: TransferReceive, Peer: addr, Size: size, StartedAt: s.Clock.Now()})
+}
+
+// transferred records the transfer t finished now, having failed with err
+// if not nil.
+func (s *FileServer) transferred(t *transfer, err error) {
+	s.transfers.end(t, err, s.Clock.Now())
+}
+
+// transferReader counts the bytes read from r against a transfer.
+type transferReader struct {
+	io.Reader
+	t *transfer
+}
+
+func (r transferReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.t.add(n)
+	return n, err
+}
+
+// transferWriter counts the bytes written to w against a transfer.
+type transferWriter struct {
+	io.Writer
+	t *transfer
+}
+
+func (w transferWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.t.add(n)
+	return n, err
+}
+
+// startReplication records replicas of the objects stored under keys, in a
+// stream of size bytes, waiting to be sent to each of the peers.
+func (s *FileServer) startReplication(keys []string, peers []string, size int64) map[string]*replicationJob {
+	now := s.Clock.Now()
+	jobs := s.replication.start(peers, size, now)
+	for addr, job := range jobs {
+		info := Transfer{Key: keys[0], Direction: TransferSend, Peer: addr, Size: size, StartedAt: now}
+		if len(keys) > 1 {
+			info.Objects = len(keys)
+		}
+		job.transfer = s.transfers.begin(info)
+	}
+	return jobs
+}
+
+// finishReplication records the outcome of the replicas sent to each peer.
+func (s *FileServer) finishReplication(jobs map[string]*replicationJob, err error) {
+	now := s.Clock.Now()
+	s.replication.finish(jobs, err, now)
+	for _, job := range jobs {
+		s.transfers.end(job.transfer, err, now)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/anthdm/foreverstore/p2p"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransfersReportStreamsWithPeers(t *testing.T) {
+	c := newTestCluster(t, 2)
+	s := c.nodes[0]
+
+	c.faults[0].SetFaults(p2p.FaultConfig{Latency: time.Second})
+	done := make(chan error, 1)
+	go func() { done <- s.Store("slow", bytes.NewReader(bytes.Repeat([]byte("x"), 4096))) }()
+
+	c.eventually("the replica to be in progress", func() bool {
+		active := s.Transfers().Active
+		return len(active) == 1 && active[0].Bytes > 0
+	})
+	tr := s.Transfers().Active[0]
+	assert.Equal(t, "slow", tr.Key)
+	assert.Equal(t, TransferSend, tr.Direction)
+	assert.Equal(t, "node-1", tr.Peer)
+	assert.Less(t, tr.Bytes, tr.Size)
+	assert.Greater(t, tr.Rate, 0.0)
+	assert.True(t, tr.FinishedAt.IsZero())
+
+	c.faults[0].SetFaults(p2p.FaultConfig{})
+	assert.Nil(t, c.run("store to finish", func() error { return <-done }))
+	sent := s.Transfers()
+	assert.Empty(t, sent.Active)
+	if assert.Len(t, sent.Recent, 1) {
+		assert.Equal(t, tr.ID, sent.Recent[0].ID)
+		assert.Equal(t, sent.Recent[0].Size, sent.Recent[0].Bytes)
+		assert.False(t, sent.Recent[0].FinishedAt.IsZero())
+		assert.Empty(t, sent.Recent[0].Error)
+	}
+
+	c.eventually("the replica to be received", func() bool { return len(c.nodes[1].Transfers().Recent) == 1 })
+	received := c.nodes[1].Transfers().Recent[0]
+	assert.Equal(t, hashKey("slow"), received.Key)
+	assert.Equal(t, TransferReceive, received.Direction)
+	assert.Equal(t, "node-0", received.Peer)
+	assert.Equal(t, tr.Size, received.Bytes)
+}
+
+func TestTransferHistoryIsBounded(t *testing.T) {
+	var tr transferTracker
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < transferHistory+5; i++ {
+		x := tr.begin(Transfer{Key: "k", Direction: TransferSend, Peer: "node-1", Size: 10, StartedAt: now})
+		x.add(10)
+		tr.end(x, nil, now.Add(time.Second))
+	}
+	assert.Empty(t, tr.active)
+	assert.Len(t, tr.recent, transferHistory)
+	assert.Equal(t, uint64(6), tr.recent[0].ID)
+	assert.Equal(t, 10.0, tr.recent[0].Rate)
+}
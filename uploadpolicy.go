@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/anthdm/foreverstore/config"
+	"github.com/anthdm/foreverstore/errors"
+)
+
+// Upload policies (see config.UploadPolicy), and the UploadHook, are
+// checked once the object a client stores has been read, before it is
+// written: an object they refuse is not stored, and not replicated. Objects
+// received from peers, or copied from a leader, were checked by the node
+// their client stored them on.
+
+// Upload describes an object a client is storing, for the UploadHook.
+type Upload struct {
+	Key         string
+	Size        int64
+	ContentType string
+	// Client is the metadata supplied by the client, its content type
+	// detected when it sent none.
+	Client *ClientMeta
+	// Data is the content of the object, which the hook must not modify.
+	Data []byte
+}
+
+// UploadHook is a custom check of the objects clients store. An object it
+// returns an error for is refused; errors that are not a FileSystemError
+// are reported as InvalidInputError.
+type UploadHook func(Upload) error
+
+// uploadRule is an upload policy with its key patterns compiled.
+type uploadRule struct {
+	config.UploadPolicy
+	allow, deny *regexp.Regexp
+	// err is set for policies whose patterns do not compile, which refuse
+	// every object they apply to.
+	err error
+}
+
+func compileUploadPolicies(policies []config.UploadPolicy) []uploadRule {
+	rules := make([]uploadRule, 0, len(policies))
+	for _, p := range policies {
+		rule := uploadRule{UploadPolicy: p}
+		if p.KeyPattern != "" {
+			rule.allow, rule.err = regexp.Compile(p.KeyPattern)
+		}
+		if p.DeniedKeyPattern != "" && rule.err == nil {
+			rule.deny, rule.err = regexp.Compile(p.DeniedKeyPattern)
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// checkUpload checks the object a client is storing under key, read in
+// data, against the upload policies and the UploadHook.
+func (s *FileServer) checkUpload(key string, data []byte, client *ClientMeta) error {
+	contentType := "application/octet-stream"
+	if client != nil && client.ContentType != "" {
+		contentType = client.ContentType
+	}
+	size := int64(len(data))
+
+	for _, rule := range s.uploadRules {
+		if !rule.AppliesTo(key) {
+			continue
+		}
+		scope := "every bucket"
+		if rule.Bucket != "" {
+			scope = "bucket " + rule.Bucket
+		}
+		refuse := func(check, message string) error {
+			return errors.NewInvalidInputError(message).
+				WithContext("key", key).
+				WithContext("policy", scope).
+				WithContext("check", check)
+		}
+		switch {
+		case rule.err != nil:
+			return errors.Wrap(rule.err, errors.ConfigError, "invalid upload policy for "+scope).WithContext("key", key)
+		case rule.MaxObjectBytes > 0 && size > rule.MaxObjectBytes:
+			return refuse("max_object_bytes", fmt.Sprintf("object of %d bytes exceeds the %d bytes allowed in %s", size, rule.MaxObjectBytes, scope))
+		case !rule.AllowsContentType(contentType):
+			return refuse("content_types", fmt.Sprintf("content type %s is not allowed in %s", contentType, scope))
+		case rule.allow != nil && !rule.allow.MatchString(key):
+			return refuse("key_pattern", fmt.Sprintf("key does not match the pattern %s required in %s", rule.KeyPattern, scope))
+		case rule.deny != nil && rule.deny.MatchString(key):
+			return refuse("denied_key_pattern", fmt.Sprintf("key matches the pattern %s denied in %s", rule.DeniedKeyPattern, scope))
+		}
+	}
+
+	if s.UploadHook == nil {
+		return nil
+	}
+	err := s.UploadHook(Upload{Key: key, Size: size, ContentType: contentType, Client: client, Data: data})
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*errors.FileSystemError); !ok {
+		return errors.Wrap(err, errors.InvalidInputError, "upload refused").WithContext("key", key)
+	}
+	return err
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/anthdm/foreverstore/config"
+	"github.com/anthdm/foreverstore/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUploadPoliciesRefuseObjects(t *testing.T) {
+	c := newTestClusterWith(t, 2, func(node int, opts *FileServerOpts) {
+		opts.UploadPolicies = []config.UploadPolicy{
+			{MaxObjectBytes: 64, DeniedKeyPattern: `\.exe$`},
+			{Bucket: "photos", ContentTypes: []string{"image/*"}, KeyPattern: `^photos/[a-z]+\.png$`},
+		}
+		opts.UploadHook = func(u Upload) error {
+			if bytes.Contains(u.Data, []byte("virus")) {
+				return fmt.Errorf("infected")
+			}
+			return nil
+		}
+	})
+	png := []byte("\x89PNG\r\n\x1a\n")
+	store := func(key string, data []byte) error {
+		t.Helper()
+		return c.run("store "+key, func() error {
+			return c.nodes[0].Store(key, bytes.NewReader(data))
+		})
+	}
+	refused := func(key string, data []byte, check string) {
+		t.Helper()
+		err := store(key, data)
+		assert.True(t, errors.IsType(err, errors.InvalidInputError), "%s: %v", key, err)
+		if fsErr, ok := err.(*errors.FileSystemError); ok && check != "" {
+			assert.Equal(t, check, fsErr.Context["check"], key)
+		}
+		assert.False(t, c.holds(0, 0, key), key)
+	}
+
+	assert.Nil(t, store("docs/readme.txt", []byte("hello")))
+	assert.Nil(t, store("photos/cat.png", png))
+	c.assertConverged(0, "photos/cat.png")
+
+	refused("docs/large.txt", []byte(strings.Repeat("x", 65)), "max_object_bytes")
+	refused("tools/setup.exe", []byte("MZ"), "denied_key_pattern")
+	refused("photos/notes.png", []byte("plain text"), "content_types")
+	refused("photos/Cat.png", png, "key_pattern")
+	refused("docs/attachment.txt", []byte("a virus"), "")
+}
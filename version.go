@@ -0,0 +1,5 @@
+package main
+
+// Version is the version of the node, reported to its peers. Release
+// builds set it with -ldflags "-X main.Version=<version>".
+var Version = "dev"
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+
+	"github.com/anthdm/foreverstore/msgpack"
+	"github.com/anthdm/foreverstore/p2p"
+)
+
+// protocolMsgpack is the peer protocol version from which messages are
+// msgpack encoded.
+const protocolMsgpack uint32 = 2
+
+// wireFormat is the encoding of the messages exchanged with a peer: the
+// envelope and the message it carries alike.
+type wireFormat int
+
+const (
+	// formatGob is the encoding of the peers speaking protocol version 1,
+	// or connected without a handshake to agree on one.
+	formatGob wireFormat = iota
+	formatMsgpack
+)
+
+// peerFormat returns the format of the messages sent to p.
+func peerFormat(p p2p.Peer) wireFormat {
+	if p.ProtocolVersion() >= protocolMsgpack {
+		return formatMsgpack
+	}
+	return formatGob
+}
+
+// rpcFormat returns the format of a message received, as its frame tells.
+func rpcFormat(rpc p2p.RPC) wireFormat {
+	if rpc.Msgpack {
+		return formatMsgpack
+	}
+	return formatGob
+}
+
+func (f wireFormat) marshal(v interface{}) ([]byte, error) {
+	if f == formatMsgpack {
+		return msgpack.Marshal(v)
+	}
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (f wireFormat) unmarshal(data []byte, v interface{}) error {
+	if f == formatMsgpack {
+		return msgpack.Unmarshal(data, v)
+	}
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// frame frames a sealed message for the transport.
+func (f wireFormat) frame(sealed []byte) []byte {
+	if f == formatMsgpack {
+		return p2p.EncodeMsgpackMessage(sealed)
+	}
+	return p2p.EncodeMessage(sealed)
+}
+
+// registerMessage registers the type of a message payload with both
+// encodings, for it to be sent in the Payload of a Message.
+func registerMessage(payload interface{}) {
+	gob.Register(payload)
+	msgpack.Register(payload)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/anthdm/foreverstore/p2p"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessageFormatFollowsTheProtocolVersion(t *testing.T) {
+	for _, tc := range []struct {
+		maxVersion uint32
+		msgpack    bool
+	}{
+		{maxVersion: 1, msgpack: false},
+		{maxVersion: p2p.ProtocolVersion, msgpack: true},
+	} {
+		sender := newIdentityTestServer()
+		receiver := newIdentityTestServer()
+		local, remote := net.Pipe()
+
+		received := make(chan p2p.RPC, 1)
+		go func() {
+			defer remote.Close()
+			peer := p2p.NewTCPPeer(remote, false)
+			if err := receiver.handshake(p2p.HandshakeOpts{Secret: testClusterSecret, MaxVersion: tc.maxVersion})(peer); err != nil {
+				t.Error(err)
+				return
+			}
+			var rpc p2p.RPC
+			assert.Nil(t, p2p.DefaultDecoder{}.Decode(remote, &rpc))
+			received <- rpc
+		}()
+
+		peer := p2p.NewTCPPeer(local, true)
+		assert.Nil(t, sender.handshake(p2p.HandshakeOpts{Secret: testClusterSecret})(peer))
+		assert.Equal(t, tc.maxVersion, peer.ProtocolVersion())
+		assert.Nil(t, sender.writeMessage(peer, &Message{Payload: MessageGetFile{ID: "node", Key: "key"}}))
+
+		rpc := <-received
+		local.Close()
+		assert.Equal(t, tc.msgpack, rpc.Msgpack)
+		msg, err := receiver.openMessage("pipe", rpcFormat(rpc), rpc.Payload)
+		assert.Nil(t, err)
+		assert.Equal(t, "key", msg.Payload.(MessageGetFile).Key)
+	}
+}
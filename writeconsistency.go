@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/anthdm/foreverstore/errors"
+)
+
+// The write consistency of a node is how many copies of an object a store
+// waits to be persisted before it succeeds. The copy of the node storing
+// the object counts as one; a replica counts once its peer acknowledged
+// persisting it as sent. A store that falls short fails with a QuorumError,
+// leaving the copies that were made in place for repair to complete.
+const (
+	// WriteConsistencyOne waits for the copy of the node storing the
+	// object only, as nodes did before write consistency was configurable.
+	WriteConsistencyOne = "one"
+	// WriteConsistencyQuorum waits for a majority of the copies placed.
+	WriteConsistencyQuorum = "quorum"
+	// WriteConsistencyAll waits for every copy placed.
+	WriteConsistencyAll = "all"
+)
+
+// requiredReplicas returns how many of the replicas sent to peers must be
+// confirmed for a store to meet the write consistency level.
+func requiredReplicas(level string, sent int) int {
+	switch level {
+	case WriteConsistencyQuorum:
+		// With the local copy, a majority of the sent+1 copies.
+		return (sent + 1) / 2
+	case WriteConsistencyAll:
+		return sent
+	default:
+		return 0
+	}
+}
+
+// awaitWriteConsistency waits for the peers to acknowledge the replicas of
+// the object stored under key sent with send, until enough did for the
+// write consistency of the node, or too many failed to. A replica found bad
+// is sent again, but not waited for.
+func (s *FileServer) awaitWriteConsistency(key string, send *replicaSend, t *opTrace) error {
+	need := requiredReplicas(s.WriteConsistency, len(send.replicas))
+	if need == 0 {
+		return nil
+	}
+	start := t.now()
+	defer t.since("replica_acks", start)
+
+	deadline := s.Clock.After(replicaAckTimeout)
+	confirmed, failed := 0, 0
+	for confirmed < need {
+		if failed > len(send.replicas)-need {
+			return quorumNotMet(key, s.WriteConsistency, confirmed, need, fmt.Sprintf("%d replicas failed", failed))
+		}
+		select {
+		case ok := <-send.confirmed:
+			if ok {
+				confirmed++
+			} else {
+				failed++
+			}
+		case <-deadline:
+			return quorumNotMet(key, s.WriteConsistency, confirmed, need, "timed out waiting for the peers")
+		case <-s.quitch:
+			return quorumNotMet(key, s.WriteConsistency, confirmed, need, "server stopped")
+		}
+	}
+	return nil
+}
+
+func quorumNotMet(key, level string, confirmed, need int, reason string) error {
+	return errors.NewQuorumError(fmt.Sprintf("write consistency %s not met: %d of %d replicas confirmed, %s", level, confirmed, need, reason)).
+		WithContext("key", key)
+}
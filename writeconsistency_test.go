@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/anthdm/foreverstore/errors"
+	"github.com/anthdm/foreverstore/p2p"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequiredReplicas(t *testing.T) {
+	for _, tc := range []struct {
+		level string
+		sent  int
+		want  int
+	}{
+		{WriteConsistencyOne, 2, 0},
+		{WriteConsistencyQuorum, 1, 1},
+		{WriteConsistencyQuorum, 2, 1},
+		{WriteConsistencyQuorum, 3, 2},
+		{WriteConsistencyAll, 2, 2},
+		{WriteConsistencyAll, 0, 0},
+	} {
+		assert.Equal(t, tc.want, requiredReplicas(tc.level, tc.sent), "%s of %d", tc.level, tc.sent)
+	}
+}
+
+func TestWriteConsistency(t *testing.T) {
+	c := newTestClusterWith(t, 3, func(node int, opts *FileServerOpts) {
+		if node == 0 {
+			opts.WriteConsistency = WriteConsistencyAll
+		}
+	})
+	s := c.nodes[0]
+
+	// A store waits for every peer to persist its replica.
+	c.store(0, "everywhere", []byte("on all nodes"))
+	assert.True(t, c.holds(1, 0, "everywhere"))
+	assert.True(t, c.holds(2, 0, "everywhere"))
+
+	// A peer refusing its replica fails the store, the copies made kept.
+	setDiskSpace(c.nodes[2], 1<<20)
+	c.nodes[2].checkDisk()
+	err := c.run("store", func() error { return s.Store("refused", bytes.NewReader([]byte("one short"))) })
+	assert.Equal(t, errors.QuorumError, errors.GetType(err), "got %v", err)
+	assert.True(t, s.store.Has(s.ID, "refused"))
+
+	// A majority of the copies is enough for a quorum.
+	s.WriteConsistency = WriteConsistencyQuorum
+	c.store(0, "majority", []byte("on two of three nodes"))
+	assert.True(t, c.holds(1, 0, "majority"))
+}
+
+// streamlessPeer is a peer no stream can be opened to.
+type streamlessPeer struct {
+	p2p.Peer
+}
+
+func (streamlessPeer) OpenStream() error {
+	return fmt.Errorf("connection reset")
+}
+
+func TestReplicationGoesOnWithoutAFailingPeer(t *testing.T) {
+	c := newTestCluster(t, 3)
+	s := c.nodes[0]
+	failing := c.nodes[2].Transport.Addr()
+	peer, _ := s.peers.get(failing)
+	s.peers.add(failing, streamlessPeer{peer}, 0)
+
+	// At consistency one the store succeeds, and the healthy peer gets its
+	// replica whole.
+	c.store(0, "doc", []byte("replicated around a failing peer"))
+	c.eventually("the healthy peer to hold its replica", func() bool { return c.holds(1, 0, "doc") })
+	assert.False(t, c.holds(2, 0, "doc"))
+
+	// With every replica required, the failed one fails the store.
+	s.WriteConsistency = WriteConsistencyAll
+	err := c.run("store", func() error { return s.Store("all", bytes.NewReader([]byte("everywhere"))) })
+	assert.Equal(t, errors.QuorumError, errors.GetType(err), "got %v", err)
+	assert.True(t, c.holds(1, 0, "all"))
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, fmt.Errorf("broken pipe")
+}
+
+func TestReplicaFanoutDropsFailingPeers(t *testing.T) {
+	var healthy bytes.Buffer
+	send := &replicaSend{h: sha256.New()}
+	out := &replicaFanout{send: send, peers: map[string]io.Writer{"a": &healthy, "b": failingWriter{}}}
+
+	for _, chunk := range []string{"first ", "second"} {
+		n, err := out.Write([]byte(chunk))
+		assert.Nil(t, err)
+		assert.Equal(t, len(chunk), n)
+	}
+	assert.Equal(t, "first second", healthy.String())
+	assert.Equal(t, int64(len("first second")), send.n)
+	assert.Contains(t, out.dropped, "b")
+	assert.NotContains(t, out.dropped, "a")
+}